@@ -3,5 +3,7 @@ package com.example.fcmplayground
 object ApiRoutes {
     const val DEVICES_REGISTER = "/devices/register"
     const val TEST_ACK = "/test/ack"
+
+    fun messageReceipt(messageId: String) = "/messages/$messageId/receipt"
 }
 
@@ -1,12 +1,15 @@
 package com.example.fcmplayground
 
 import android.content.Context
+import android.os.Build
 import android.util.Log
 import android.widget.Toast
 import kotlinx.coroutines.*
 import org.json.JSONObject
 import java.net.HttpURLConnection
 import java.net.URL
+import java.util.Locale
+import java.util.TimeZone
 
 object DeviceRegister {
     private const val TAG = "API"
@@ -17,6 +20,13 @@ object DeviceRegister {
     private const val JSON_KEY_DEVICE_ID = "device_id"
     private const val JSON_KEY_FCM_TOKEN = "fcm_token"
     private const val JSON_KEY_PLATFORM = "platform"
+    private const val JSON_KEY_LOCALE = "locale"
+    private const val JSON_KEY_APP_VERSION = "app_version"
+    private const val JSON_KEY_OS_VERSION = "os_version"
+    private const val JSON_KEY_DEVICE_MODEL = "device_model"
+    private const val JSON_KEY_TIMEZONE = "timezone"
+    private const val JSON_KEY_SDK_VERSION = "sdk_version"
+    private const val OS_VERSION_PREFIX = "Android "
     private const val PLATFORM_ANDROID = "android"
     private const val TOAST_TOKEN_NOT_READY = "FCM token not ready yet"
     private const val CONNECTION_TIMEOUT_MS = 10_000
@@ -43,6 +53,12 @@ object DeviceRegister {
             put(JSON_KEY_DEVICE_ID, deviceId)
             put(JSON_KEY_FCM_TOKEN, fcmToken)
             put(JSON_KEY_PLATFORM, PLATFORM_ANDROID)
+            put(JSON_KEY_LOCALE, Locale.getDefault().toLanguageTag())
+            put(JSON_KEY_APP_VERSION, BuildConfig.VERSION_NAME)
+            put(JSON_KEY_OS_VERSION, OS_VERSION_PREFIX + Build.VERSION.RELEASE)
+            put(JSON_KEY_DEVICE_MODEL, Build.MODEL)
+            put(JSON_KEY_TIMEZONE, TimeZone.getDefault().id)
+            put(JSON_KEY_SDK_VERSION, Build.VERSION.SDK_INT.toString())
         }
 
         CoroutineScope(Dispatchers.IO).launch {
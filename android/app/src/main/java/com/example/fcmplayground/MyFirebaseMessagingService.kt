@@ -17,6 +17,10 @@ import kotlinx.coroutines.launch
 import org.json.JSONObject
 import java.net.HttpURLConnection
 import java.net.URL
+import java.text.SimpleDateFormat
+import java.util.Date
+import java.util.Locale
+import java.util.TimeZone
 
 class MyFirebaseMessagingService : FirebaseMessagingService() {
     companion object {
@@ -35,6 +39,10 @@ class MyFirebaseMessagingService : FirebaseMessagingService() {
         private const val DATA_KEY_TITLE = "title"
         private const val DATA_KEY_BODY = "body"
         private const val DATA_KEY_NONCE = "nonce"
+        private const val DATA_KEY_SENT_TIME = "sent_time"
+        private const val DATA_KEY_ACK_TOKEN = "ack_token"
+        private const val DATA_KEY_MESSAGE_ID = "message_id"
+        private const val DATA_KEY_RECEIPT_TOKEN = "receipt_token"
         
         // Message types
         private const val MSG_TYPE_E2E_TEST = "e2e_test"
@@ -54,6 +62,21 @@ class MyFirebaseMessagingService : FirebaseMessagingService() {
         
         // JSON keys
         private const val JSON_KEY_NONCE = "nonce"
+        private const val JSON_KEY_DEVICE_ID = "device_id"
+        private const val JSON_KEY_APP_VERSION = "app_version"
+        private const val JSON_KEY_OS_VERSION = "os_version"
+        private const val JSON_KEY_RECEIVED_AT = "received_at"
+        private const val JSON_KEY_SENT_TIME = "sent_time"
+        private const val JSON_KEY_ACK_TOKEN = "ack_token"
+        private const val JSON_KEY_EVENT = "event"
+        private const val JSON_KEY_RECEIPT_TOKEN = "receipt_token"
+
+        // Receipt events
+        private const val RECEIPT_EVENT_DELIVERED = "delivered"
+
+        // RFC 3339 timestamps in UTC (java.time requires API 26)
+        private const val RFC3339_FORMAT = "yyyy-MM-dd'T'HH:mm:ss.SSS'Z'"
+        private const val OS_VERSION_PREFIX = "Android "
         
         // Log messages
         private const val LOG_NEW_TOKEN = "New token: "
@@ -61,8 +84,8 @@ class MyFirebaseMessagingService : FirebaseMessagingService() {
         private const val LOG_E2E_MISSING_NONCE = "e2e_test message missing nonce"
         private const val LOG_POST_REQUEST = "POST %s body=%s"
         private const val LOG_READ_RESPONSE_ERROR = "Error reading response stream"
-        private const val LOG_ACK_RESPONSE = "%s HTTP %d, response=%s"
-        private const val LOG_ACK_FAILED = "%s failed"
+        private const val LOG_POST_RESPONSE = "%s HTTP %d, response=%s"
+        private const val LOG_POST_FAILED = "%s failed"
     }
 
     override fun onNewToken(token: String) {
@@ -86,6 +109,7 @@ class MyFirebaseMessagingService : FirebaseMessagingService() {
 
     override fun onMessageReceived(remoteMessage: RemoteMessage) {
         super.onMessageReceived(remoteMessage)
+        val receivedAt = Date()
         val notif = remoteMessage.notification
         Log.d(
             TAG,
@@ -98,13 +122,20 @@ class MyFirebaseMessagingService : FirebaseMessagingService() {
         val title = remoteMessage.notification?.title ?: data[DATA_KEY_TITLE] ?: DEFAULT_TITLE
         val body = remoteMessage.notification?.body ?: data[DATA_KEY_BODY] ?: DEFAULT_BODY
 
+        // Every message sent by the backend carries its id and a receipt token for this device
+        val messageId = data[DATA_KEY_MESSAGE_ID]
+        val receiptToken = data[DATA_KEY_RECEIPT_TOKEN]
+        if (!messageId.isNullOrBlank() && !receiptToken.isNullOrBlank()) {
+            reportDelivered(messageId, receiptToken)
+        }
+
         if (type == MSG_TYPE_E2E_TEST) {
             // e2e test message: show Toast and call ack
             showToast(String.format(TOAST_FORMAT, title, body))
             val nonce = data[DATA_KEY_NONCE]
             if (!nonce.isNullOrBlank()) {
                 Log.d(TAG, String.format(LOG_E2E_MSG, nonce, ACK_ENDPOINT))
-                ackTestMessage(nonce)
+                ackTestMessage(nonce, data[DATA_KEY_ACK_TOKEN], data[DATA_KEY_SENT_TIME], receivedAt)
             } else {
                 Log.w(TAG, LOG_E2E_MISSING_NONCE)
             }
@@ -124,18 +155,48 @@ class MyFirebaseMessagingService : FirebaseMessagingService() {
     }
 
     /**
-     * Call POST /test/ack with { "nonce": "<nonce>" }.
+     * Call POST /test/ack with the nonce, device details and timestamps used
+     * to measure delivery latency (sent_time is echoed back from the message).
+     * The ack_token from the message proves the ack comes from this device.
+     */
+    private fun ackTestMessage(nonce: String, ackToken: String?, sentTime: String?, receivedAt: Date) {
+        val jsonBody = JSONObject().apply {
+            put(JSON_KEY_NONCE, nonce)
+            if (!ackToken.isNullOrBlank()) {
+                put(JSON_KEY_ACK_TOKEN, ackToken)
+            }
+            put(JSON_KEY_DEVICE_ID, DeviceIdManager.getOrCreateDeviceId(this@MyFirebaseMessagingService))
+            put(JSON_KEY_APP_VERSION, BuildConfig.VERSION_NAME)
+            put(JSON_KEY_OS_VERSION, OS_VERSION_PREFIX + Build.VERSION.RELEASE)
+            put(JSON_KEY_RECEIVED_AT, formatRfc3339(receivedAt))
+            if (!sentTime.isNullOrBlank()) {
+                put(JSON_KEY_SENT_TIME, sentTime)
+            }
+        }
+        postJson(ACK_ENDPOINT, jsonBody)
+    }
+
+    /**
+     * Call POST /messages/{id}/receipt to report that the message was delivered.
+     * The receipt_token from the message proves the receipt comes from this device.
      */
-    private fun ackTestMessage(nonce: String) {
+    private fun reportDelivered(messageId: String, receiptToken: String) {
+        val jsonBody = JSONObject().apply {
+            put(JSON_KEY_EVENT, RECEIPT_EVENT_DELIVERED)
+            put(JSON_KEY_RECEIPT_TOKEN, receiptToken)
+        }
+        postJson(ApiRoutes.messageReceipt(messageId), jsonBody)
+    }
+
+    /**
+     * POST a JSON body to an API endpoint and log the response.
+     */
+    private fun postJson(endpoint: String, jsonBody: JSONObject) {
         // Fire-and-forget background call
         CoroutineScope(Dispatchers.IO).launch {
             try {
                 val apiBaseUrl = BuildConfig.API_BASE_URL
-                val url = URL("$apiBaseUrl$ACK_ENDPOINT")
-
-                val jsonBody = JSONObject().apply {
-                    put(JSON_KEY_NONCE, nonce)
-                }
+                val url = URL("$apiBaseUrl$endpoint")
 
                 Log.d(TAG, String.format(LOG_POST_REQUEST, url, jsonBody))
 
@@ -164,13 +225,22 @@ class MyFirebaseMessagingService : FirebaseMessagingService() {
                 }
                 conn.disconnect()
 
-                Log.d(TAG, String.format(LOG_ACK_RESPONSE, ACK_ENDPOINT, code, responseText))
+                Log.d(TAG, String.format(LOG_POST_RESPONSE, endpoint, code, responseText))
             } catch (e: Exception) {
-                Log.e(TAG, String.format(LOG_ACK_FAILED, ACK_ENDPOINT), e)
+                Log.e(TAG, String.format(LOG_POST_FAILED, endpoint), e)
             }
         }
     }
 
+    /**
+     * Format a time as an RFC 3339 UTC timestamp, e.g. 2024-01-15T10:30:00.123Z.
+     */
+    private fun formatRfc3339(date: Date): String {
+        val format = SimpleDateFormat(RFC3339_FORMAT, Locale.US)
+        format.timeZone = TimeZone.getTimeZone("UTC")
+        return format.format(date)
+    }
+
     /**
      * Show a system notification for normal messages.
      * Uses HIGH importance/priority to show heads-up notification (popup).
@@ -0,0 +1,4 @@
+// Package credentials holds the credential handling shared by the Lambdas: authentication to RDS
+// with a password or an IAM auth token (RDS_AUTH_MODE), and the secret providers that read secrets
+// from Secrets Manager, environment variables or files (SECRETS_BACKEND).
+package credentials
@@ -0,0 +1,100 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	"github.com/jackc/pgx/v5"
+)
+
+// Supported values of the RDS_AUTH_MODE environment variable.
+const (
+	RDSAuthModePassword = "password" // Static password from RDS_PASSWORD_SECRET_ARN (default)
+	RDSAuthModeIAM      = "iam"      // Short-lived IAM auth token (works with RDS Proxy)
+)
+
+// RDS IAM auth tokens are valid for 15 minutes.
+// Refresh a bit earlier so a token never expires while a connection is being opened.
+const rdsIAMTokenRefreshAfter = 10 * time.Minute
+
+// RDSAuthMode returns the database authentication mode from RDS_AUTH_MODE.
+func RDSAuthMode() (string, error) {
+	mode := os.Getenv("RDS_AUTH_MODE")
+	switch mode {
+	case "", RDSAuthModePassword:
+		return RDSAuthModePassword, nil
+	case RDSAuthModeIAM:
+		return RDSAuthModeIAM, nil
+	default:
+		return "", fmt.Errorf("invalid RDS_AUTH_MODE: %s (must be '%s' or '%s')", mode, RDSAuthModePassword, RDSAuthModeIAM)
+	}
+}
+
+// RDSIAMTokenSource generates RDS IAM auth tokens and caches them until they are due for refresh.
+type RDSIAMTokenSource struct {
+	endpoint    string // host:port of the RDS instance or RDS Proxy
+	region      string
+	username    string
+	credentials aws.CredentialsProvider
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+// NewRDSIAMTokenSource creates a token source using the default AWS credential chain.
+func NewRDSIAMTokenSource(ctx context.Context, host string, port string, username string) (*RDSIAMTokenSource, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return &RDSIAMTokenSource{
+		endpoint:    net.JoinHostPort(host, port),
+		region:      region,
+		username:    username,
+		credentials: cfg.Credentials,
+	}, nil
+}
+
+// Token returns a cached auth token, or builds a new one if the cached token is due for refresh.
+func (s *RDSIAMTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.refreshAt) {
+		return s.token, nil
+	}
+
+	token, err := auth.BuildAuthToken(ctx, s.endpoint, s.region, s.username, s.credentials)
+	if err != nil {
+		return "", fmt.Errorf("failed to build RDS IAM auth token: %w", err)
+	}
+
+	s.token = token
+	s.refreshAt = time.Now().Add(rdsIAMTokenRefreshAfter)
+	return s.token, nil
+}
+
+// BeforeConnect is used as the pgx BeforeConnect hook.
+// It sets the password of every new connection to a valid IAM auth token.
+func (s *RDSIAMTokenSource) BeforeConnect(ctx context.Context, connConfig *pgx.ConnConfig) error {
+	token, err := s.Token(ctx)
+	if err != nil {
+		return err
+	}
+	connConfig.Password = token
+	return nil
+}
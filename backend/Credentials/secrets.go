@@ -0,0 +1,228 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// Supported values of the SECRETS_BACKEND environment variable.
+const (
+	SecretsBackendSecretsManager = "secretsmanager" // AWS Secrets Manager (default)
+	SecretsBackendEnv            = "env"            // Secret ID is the name of an environment variable
+	SecretsBackendFile           = "file"           // Secret ID is a file name inside SECRETS_DIR
+)
+
+const (
+	defaultSecretsCacheTTL     = 5 * time.Minute
+	defaultSecretsVersionStage = "AWSCURRENT"
+)
+
+// SecretProvider retrieves secret values by secret ID.
+// The meaning of the ID depends on the implementation (ARN, env var name, file name).
+type SecretProvider interface {
+	GetSecret(ctx context.Context, secretID string) (string, error)
+}
+
+var (
+	defaultSecretProviderMu sync.Mutex
+	defaultSecretProvider   SecretProvider
+)
+
+// DefaultSecretProvider returns the process-wide secret provider, creating it on first use.
+// Environment variables (all optional):
+//   - SECRETS_BACKEND: "secretsmanager" (default), "env" or "file"
+//   - SECRETS_DIR: Directory containing secret files (file backend, default: current directory)
+//   - SECRETS_CACHE_TTL: How long Secrets Manager values are cached, e.g. "5m" (default: 5m)
+//   - SECRETS_VERSION_STAGE: Secrets Manager version stage to read (default: AWSCURRENT)
+//
+// Returns:
+//   - SecretProvider: Shared secret provider
+//   - error: Error if the provider cannot be created
+func DefaultSecretProvider(ctx context.Context) (SecretProvider, error) {
+	defaultSecretProviderMu.Lock()
+	defer defaultSecretProviderMu.Unlock()
+
+	if defaultSecretProvider != nil {
+		return defaultSecretProvider, nil
+	}
+
+	provider, err := newSecretProviderFromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultSecretProvider = provider
+	return defaultSecretProvider, nil
+}
+
+// newSecretProviderFromEnv creates a secret provider based on SECRETS_BACKEND.
+func newSecretProviderFromEnv(ctx context.Context) (SecretProvider, error) {
+	backend := os.Getenv("SECRETS_BACKEND")
+	switch backend {
+	case "", SecretsBackendSecretsManager:
+		ttl := defaultSecretsCacheTTL
+		if value := os.Getenv("SECRETS_CACHE_TTL"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid SECRETS_CACHE_TTL: %q (must be a positive duration, e.g. \"5m\")", value)
+			}
+			ttl = d
+		}
+		versionStage := os.Getenv("SECRETS_VERSION_STAGE")
+		if versionStage == "" {
+			versionStage = defaultSecretsVersionStage
+		}
+		return NewSecretsManagerProvider(ctx, versionStage, ttl)
+	case SecretsBackendEnv:
+		return NewEnvSecretProvider(), nil
+	case SecretsBackendFile:
+		return NewFileSecretProvider(os.Getenv("SECRETS_DIR")), nil
+	default:
+		return nil, fmt.Errorf("invalid SECRETS_BACKEND: %s (must be '%s', '%s' or '%s')",
+			backend, SecretsBackendSecretsManager, SecretsBackendEnv, SecretsBackendFile)
+	}
+}
+
+// secretsManagerAPI is the subset of the Secrets Manager client used by SecretsManagerProvider.
+type secretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// cachedSecret is a secret value together with the time it was fetched.
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// SecretsManagerProvider reads secrets from AWS Secrets Manager.
+// Values are cached per (secret ID, version stage) for the configured TTL,
+// so warm invocations do not call Secrets Manager on every request.
+type SecretsManagerProvider struct {
+	client       secretsManagerAPI
+	versionStage string
+	ttl          time.Duration
+	now          func() time.Time // Clock of the cache, time.Now outside tests
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+// NewSecretsManagerProvider creates a Secrets Manager provider using the default AWS config.
+// versionStage is used by GetSecret (e.g. "AWSCURRENT"); ttl <= 0 disables caching.
+func NewSecretsManagerProvider(ctx context.Context, versionStage string, ttl time.Duration) (*SecretsManagerProvider, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return &SecretsManagerProvider{
+		client:       secretsmanager.NewFromConfig(cfg),
+		versionStage: versionStage,
+		ttl:          ttl,
+		now:          time.Now,
+		cache:        make(map[string]cachedSecret),
+	}, nil
+}
+
+// GetSecret returns the secret value for the provider's default version stage.
+func (p *SecretsManagerProvider) GetSecret(ctx context.Context, secretID string) (string, error) {
+	return p.GetSecretVersion(ctx, secretID, p.versionStage)
+}
+
+// GetSecretVersion returns the secret value for a specific version stage
+// (e.g. "AWSPREVIOUS" while a rotation is in progress).
+func (p *SecretsManagerProvider) GetSecretVersion(ctx context.Context, secretID string, versionStage string) (string, error) {
+	if secretID == "" {
+		return "", fmt.Errorf("secret ID is empty")
+	}
+
+	cacheKey := secretID + "|" + versionStage
+
+	p.mu.Lock()
+	cached, ok := p.cache[cacheKey]
+	p.mu.Unlock()
+	if ok && p.ttl > 0 && p.now().Sub(cached.fetchedAt) < p.ttl {
+		return cached.value, nil
+	}
+
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	}
+	if versionStage != "" {
+		input.VersionStage = aws.String(versionStage)
+	}
+
+	result, err := p.client.GetSecretValue(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret value: %w", err)
+	}
+
+	if result.SecretString == nil {
+		return "", fmt.Errorf("secret %s does not contain a SecretString value", secretID)
+	}
+
+	if p.ttl > 0 {
+		p.mu.Lock()
+		p.cache[cacheKey] = cachedSecret{value: *result.SecretString, fetchedAt: p.now()}
+		p.mu.Unlock()
+	}
+
+	return *result.SecretString, nil
+}
+
+// EnvSecretProvider reads secrets from environment variables.
+// The secret ID is the name of the environment variable, e.g. SECRET_ARN=FCM_SERVICE_ACCOUNT_JSON.
+type EnvSecretProvider struct{}
+
+// NewEnvSecretProvider creates an environment variable secret provider.
+func NewEnvSecretProvider() *EnvSecretProvider {
+	return &EnvSecretProvider{}
+}
+
+// GetSecret returns the value of the environment variable named secretID.
+func (p *EnvSecretProvider) GetSecret(ctx context.Context, secretID string) (string, error) {
+	value, ok := os.LookupEnv(secretID)
+	if !ok {
+		return "", fmt.Errorf("secret environment variable %s is not set", secretID)
+	}
+	return value, nil
+}
+
+// FileSecretProvider reads secrets from files in a local directory.
+// The secret ID is the file name relative to the directory, e.g. SECRET_ARN=service-account.json.
+type FileSecretProvider struct {
+	dir string
+}
+
+// NewFileSecretProvider creates a file secret provider rooted at dir (current directory if empty).
+func NewFileSecretProvider(dir string) *FileSecretProvider {
+	return &FileSecretProvider{dir: dir}
+}
+
+// GetSecret returns the contents of the file named secretID, with surrounding whitespace trimmed.
+func (p *FileSecretProvider) GetSecret(ctx context.Context, secretID string) (string, error) {
+	if secretID == "" || !filepath.IsLocal(secretID) {
+		return "", fmt.Errorf("invalid secret file name: %q", secretID)
+	}
+
+	data, err := os.ReadFile(filepath.Join(p.dir, secretID))
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
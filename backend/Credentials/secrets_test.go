@@ -0,0 +1,198 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// fakeSecretsManager serves secret values by "<secret ID>|<version stage>" and records the
+// requests it receives.
+type fakeSecretsManager struct {
+	values   map[string]string
+	requests []string
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	key := aws.ToString(params.SecretId) + "|" + aws.ToString(params.VersionStage)
+	f.requests = append(f.requests, key)
+	value, ok := f.values[key]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func TestSecretsManagerProvider(t *testing.T) {
+	const secretID = "arn:aws:secretsmanager:us-east-1:123456789012:secret:fcm"
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		reads    []time.Duration // Time of each GetSecret after the first fetch
+		stage    string          // SECRETS_VERSION_STAGE of the provider
+		want     string
+		requests int
+	}{
+		{name: "cache hit within the TTL", ttl: 5 * time.Minute, reads: []time.Duration{0, time.Minute, 4 * time.Minute}, stage: "AWSCURRENT", want: "current", requests: 1},
+		{name: "refetch after the TTL", ttl: 5 * time.Minute, reads: []time.Duration{0, 5 * time.Minute, 6 * time.Minute}, stage: "AWSCURRENT", want: "current", requests: 2},
+		{name: "no caching without a TTL", reads: []time.Duration{0, 0}, stage: "AWSCURRENT", want: "current", requests: 2},
+		{name: "previous version", ttl: 5 * time.Minute, reads: []time.Duration{0, time.Minute}, stage: "AWSPREVIOUS", want: "previous", requests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeSecretsManager{values: map[string]string{
+				secretID + "|AWSCURRENT":  "current",
+				secretID + "|AWSPREVIOUS": "previous",
+			}}
+			start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+			now := start
+			provider := &SecretsManagerProvider{
+				client:       client,
+				versionStage: test.stage,
+				ttl:          test.ttl,
+				now:          func() time.Time { return now },
+				cache:        make(map[string]cachedSecret),
+			}
+			for _, elapsed := range test.reads {
+				now = start.Add(elapsed)
+				value, err := provider.GetSecret(t.Context(), secretID)
+				if err != nil || value != test.want {
+					t.Fatalf("got %q, %v after %s; want %q", value, err, elapsed, test.want)
+				}
+			}
+			if len(client.requests) != test.requests {
+				t.Fatalf("got %d Secrets Manager requests %v, want %d", len(client.requests), client.requests, test.requests)
+			}
+		})
+	}
+}
+
+func TestSecretsManagerProviderCachesVersionStagesSeparately(t *testing.T) {
+	const secretID = "db-password"
+	client := &fakeSecretsManager{values: map[string]string{
+		secretID + "|AWSCURRENT":  "new-password",
+		secretID + "|AWSPREVIOUS": "old-password",
+	}}
+	provider := &SecretsManagerProvider{client: client, versionStage: "AWSCURRENT", ttl: time.Minute, now: time.Now, cache: make(map[string]cachedSecret)}
+
+	for range 2 {
+		if value, err := provider.GetSecret(t.Context(), secretID); err != nil || value != "new-password" {
+			t.Fatalf("GetSecret = %q, %v; want the AWSCURRENT value", value, err)
+		}
+		if value, err := provider.GetSecretVersion(t.Context(), secretID, "AWSPREVIOUS"); err != nil || value != "old-password" {
+			t.Fatalf("GetSecretVersion(AWSPREVIOUS) = %q, %v; want the AWSPREVIOUS value", value, err)
+		}
+	}
+	if got := strings.Join(client.requests, " "); got != "db-password|AWSCURRENT db-password|AWSPREVIOUS" {
+		t.Fatalf("unexpected Secrets Manager requests: %s", got)
+	}
+
+	// Missing secrets and empty secret IDs are errors
+	if _, err := provider.GetSecret(t.Context(), "missing"); err == nil {
+		t.Fatal("expected an error for a missing secret")
+	}
+	if _, err := provider.GetSecret(t.Context(), ""); err == nil {
+		t.Fatal("expected an error for an empty secret ID")
+	}
+}
+
+func TestEnvSecretProvider(t *testing.T) {
+	t.Setenv("TEST_FCM_SERVICE_ACCOUNT", `{"project_id":"demo"}`)
+	t.Setenv("TEST_EMPTY_SECRET", "")
+	provider := NewEnvSecretProvider()
+
+	tests := []struct {
+		secretID string
+		want     string
+		wantErr  string
+	}{
+		{secretID: "TEST_FCM_SERVICE_ACCOUNT", want: `{"project_id":"demo"}`},
+		{secretID: "TEST_EMPTY_SECRET", want: ""},
+		{secretID: "TEST_MISSING_SECRET", wantErr: "TEST_MISSING_SECRET is not set"},
+	}
+	for _, test := range tests {
+		value, err := provider.GetSecret(t.Context(), test.secretID)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("GetSecret(%s) = %q, %v; want an error containing %q", test.secretID, value, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || value != test.want {
+			t.Errorf("GetSecret(%s) = %q, %v; want %q", test.secretID, value, err, test.want)
+		}
+	}
+}
+
+func TestFileSecretProvider(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "service-account.json"), []byte("  {\"project_id\":\"demo\"}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	provider := NewFileSecretProvider(dir)
+
+	tests := []struct {
+		secretID string
+		want     string
+		wantErr  string
+	}{
+		{secretID: "service-account.json", want: `{"project_id":"demo"}`},
+		{secretID: "missing.json", wantErr: "failed to read secret file"},
+		{secretID: "", wantErr: "invalid secret file name"},
+		{secretID: "../service-account.json", wantErr: "invalid secret file name"},
+		{secretID: "/etc/passwd", wantErr: "invalid secret file name"},
+	}
+	for _, test := range tests {
+		value, err := provider.GetSecret(t.Context(), test.secretID)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("GetSecret(%q) = %q, %v; want an error containing %q", test.secretID, value, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || value != test.want {
+			t.Errorf("GetSecret(%q) = %q, %v; want %q", test.secretID, value, err, test.want)
+		}
+	}
+}
+
+func TestNewSecretProviderFromEnv(t *testing.T) {
+	tests := []struct {
+		backend string
+		ttl     string
+		want    string // Type of the provider
+		wantErr string
+	}{
+		{backend: "env", want: "*credentials.EnvSecretProvider"},
+		{backend: "file", want: "*credentials.FileSecretProvider"},
+		{backend: "vault", wantErr: "invalid SECRETS_BACKEND"},
+		{backend: "secretsmanager", ttl: "soon", wantErr: "invalid SECRETS_CACHE_TTL"},
+		{backend: "secretsmanager", ttl: "-1m", wantErr: "invalid SECRETS_CACHE_TTL"},
+	}
+	for _, test := range tests {
+		t.Setenv("SECRETS_BACKEND", test.backend)
+		t.Setenv("SECRETS_CACHE_TTL", test.ttl)
+		provider, err := newSecretProviderFromEnv(t.Context())
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("SECRETS_BACKEND=%s SECRETS_CACHE_TTL=%s: got %v, want an error containing %q", test.backend, test.ttl, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SECRETS_BACKEND=%s: %v", test.backend, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", provider); got != test.want {
+			t.Errorf("SECRETS_BACKEND=%s: got a %s, want a %s", test.backend, got, test.want)
+		}
+	}
+}
@@ -4,15 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/fcm-tutorial/lambda/api/common"
 	"github.com/fcm-tutorial/lambda/api/sqlc"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type TestAckRequest struct {
-	Nonce string `json:"nonce"`
+	Nonce    string `json:"nonce"`
+	AckToken string `json:"ack_token"` // data.ack_token of the message, echoed back
+
+	// Optional details reported by the device
+	DeviceId   string `json:"device_id"`
+	AppVersion string `json:"app_version"`
+	OsVersion  string `json:"os_version"`
+	ReceivedAt string `json:"received_at"` // RFC 3339 time the device received the message
+	SentTime   string `json:"sent_time"`   // data.sent_time of the message, echoed back
 }
 
 type TestAckResponse struct {
@@ -20,7 +31,7 @@ type TestAckResponse struct {
 }
 
 // TestAckHandler is the Lambda handler for test acknowledgment
-func TestAckHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func (s *Service) TestAckHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	logger := common.NewLogger()
 	logger.Info(ctx, "Received test ack request")
 
@@ -36,29 +47,84 @@ func TestAckHandler(ctx context.Context, request events.APIGatewayProxyRequest)
 		return logger.BadRequest(ctx, err, "Missing required field: nonce")
 	}
 
+	// Validate optional timestamps
+	receivedAt, err := parseOptionalTime(ackRequest.ReceivedAt)
+	if err != nil {
+		return logger.BadRequest(ctx, fmt.Errorf("invalid received_at: %w", err), "received_at must be an RFC 3339 time")
+	}
+	sentAt, err := parseOptionalTime(ackRequest.SentTime)
+	if err != nil {
+		return logger.BadRequest(ctx, fmt.Errorf("invalid sent_time: %w", err), "sent_time must be an RFC 3339 time")
+	}
+
+	// Verify the ack token: only the device the message was sent to can ack it
+	if ackRequest.AckToken == "" {
+		err := fmt.Errorf("missing ack_token: nonce=%s", ackRequest.Nonce)
+		return logger.Unauthorized(ctx, err, "Missing ack_token")
+	}
+	ackTokenKey, err := s.ackTokenKey(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to get ack token key")
+	}
+	claims, err := verifyAckToken(ackTokenKey, ackRequest.AckToken, s.Clock.Now())
+	if err != nil {
+		return logger.Unauthorized(ctx, err, "Invalid or expired ack_token")
+	}
+	if claims.Nonce != ackRequest.Nonce || (ackRequest.DeviceId != "" && claims.DeviceID != ackRequest.DeviceId) {
+		err := fmt.Errorf("ack_token for nonce=%s, device_id=%s used for nonce=%s, device_id=%s",
+			claims.Nonce, claims.DeviceID, ackRequest.Nonce, ackRequest.DeviceId)
+		return logger.Unauthorized(ctx, err, "ack_token does not match nonce and device_id")
+	}
+	// The token identifies the device even if the client did not send device_id
+	ackRequest.DeviceId = claims.DeviceID
+
 	// Get database connection
-	db, err := common.GetDBConnection()
+	queries, err := s.Store.Queries(ctx)
 	if err != nil {
 		return logger.InternalServerError(ctx, err, "Database connection failed")
 	}
-	defer common.CloseDBConnection(db)
 
-	// Update test run status to ACKED
-	// This will only update if nonce exists AND status is 'PENDING'
-	// If nonce doesn't exist or already ACKED, returns pgx.ErrNoRows
-	queries := sqlc.New(db)
-	_, err = queries.AckTestRun(ctx, ackRequest.Nonce)
+	// Look up the platform of the acknowledging device, for per-platform latency
+	var platform string
+	device, err := queries.GetDeviceByDeviceID(ctx, ackRequest.DeviceId)
+	if err == nil {
+		platform = device.Platform
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	// Record the ack on the run and on the device's delivery, and emit test_run.acked, in one transaction
+	var testRun sqlc.TestRun
+	var event sqlc.Outbox
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		testRun, err = ackTestRun(ctx, queries, ackRequest, platform, sentAt, receivedAt)
+		if err != nil {
+			return err
+		}
+		event, err = s.emitWebhookEvent(ctx, queries, webhookTestRunAcked, TestRunAckedEventData{
+			Nonce:          ackRequest.Nonce,
+			UserID:         testRun.UserID,
+			DeviceID:       ackRequest.DeviceId,
+			Platform:       platform,
+			TestRunLatency: testRunLatency(testRun),
+		})
+		return err
+	})
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			// nonce not found or already ACKED → 404
-			err := fmt.Errorf("test run not found or already acknowledged: nonce=%s", ackRequest.Nonce)
-			return logger.NotFound(ctx, err, "Test run not found or already acknowledged")
+			// nonce not found, already ACKED by this device or no longer PENDING → 404
+			err := fmt.Errorf("test run not found, already acknowledged or expired: nonce=%s", ackRequest.Nonce)
+			return logger.NotFound(ctx, err, "Test run not found, already acknowledged or expired")
 		}
 		// Other database errors → 500
 		return logger.InternalServerError(ctx, err, "Database operation failed")
 	}
 
-	logger.Info(ctx, "Test run acknowledged successfully: nonce=%s", ackRequest.Nonce)
+	latency := testRunLatency(testRun)
+	logger.Info(ctx, "Test run acknowledged successfully: nonce=%s, platform=%s, send_to_ack_ms=%s, receive_to_ack_ms=%s",
+		ackRequest.Nonce, platform, formatOptionalMillis(latency.SendToAckMs), formatOptionalMillis(latency.ReceiveToAckMs))
+
+	s.publishOutbox(ctx, logger, []sqlc.Outbox{event})
 
 	// Prepare success response
 	response := TestAckResponse{
@@ -67,3 +133,74 @@ func TestAckHandler(ctx context.Context, request events.APIGatewayProxyRequest)
 
 	return logger.Success(ctx, response)
 }
+
+// ackTestRun records an ack on the test run and on the acknowledging device's delivery.
+// ackRequest.DeviceId is the device of the verified ack token, so every ack comes from a device.
+//
+// The first ack moves the run from PENDING to ACKED and stores the device's metadata on it.
+// Later acks from other targeted devices of an ACKED run only update their own delivery.
+// Returns pgx.ErrNoRows if neither was updated.
+func ackTestRun(ctx context.Context, queries sqlc.Querier, ackRequest TestAckRequest, platform string, sentAt, receivedAt pgtype.Timestamptz) (sqlc.TestRun, error) {
+	// Update test run status to ACKED
+	// This will only update if nonce exists AND status is 'PENDING' AND expires_at has not passed
+	// If nonce doesn't exist, is already ACKED, expired or failed, returns pgx.ErrNoRows
+	testRun, err := queries.AckTestRun(ctx, sqlc.AckTestRunParams{
+		Nonce:         ackRequest.Nonce,
+		AckDeviceID:   optionalText(ackRequest.DeviceId),
+		AckPlatform:   optionalText(platform),
+		AckAppVersion: optionalText(ackRequest.AppVersion),
+		AckOsVersion:  optionalText(ackRequest.OsVersion),
+		SentAt:        sentAt,
+		ReceivedAt:    receivedAt,
+	})
+	firstAck := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return sqlc.TestRun{}, err
+	}
+
+	// Only updates a delivery of a PENDING or ACKED run before expires_at that this device has not acked yet
+	_, err = queries.AckTestRunDelivery(ctx, sqlc.AckTestRunDeliveryParams{
+		Nonce:      ackRequest.Nonce,
+		DeviceID:   ackRequest.DeviceId,
+		AppVersion: optionalText(ackRequest.AppVersion),
+		OsVersion:  optionalText(ackRequest.OsVersion),
+		ReceivedAt: receivedAt,
+	})
+	switch {
+	case errors.Is(err, pgx.ErrNoRows) && firstAck:
+		// The device was not targeted by the run (e.g. registered after the send)
+		return testRun, nil
+	case err != nil:
+		return sqlc.TestRun{}, err
+	case firstAck:
+		return testRun, nil
+	}
+
+	// A later ack: report the run as acked by the first device
+	return queries.GetTestRunByNonce(ctx, ackRequest.Nonce)
+}
+
+// parseOptionalTime parses an RFC 3339 time; an empty string is NULL
+func parseOptionalTime(value string) (pgtype.Timestamptz, error) {
+	if value == "" {
+		return pgtype.Timestamptz{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return pgtype.Timestamptz{}, err
+	}
+	return pgtype.Timestamptz{Time: t, Valid: true}, nil
+}
+
+// optionalText converts an empty string to NULL
+func optionalText(value string) pgtype.Text {
+	return pgtype.Text{String: value, Valid: value != ""}
+}
+
+// formatOptionalMillis formats a latency for logging
+func formatOptionalMillis(ms *int64) string {
+	if ms == nil {
+		return "n/a"
+	}
+	return strconv.FormatInt(*ms, 10)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestTestAckHandler(t *testing.T) {
+	db := requireDB(t)
+	queries := sqlc.New(db)
+
+	_, err := queries.CreateTestRun(context.Background(), sqlc.CreateTestRunParams{
+		Nonce:     "nonce-1",
+		UserID:    "user-1",
+		ExpiresAt: pgtype.Timestamptz{Time: time.Now().Add(time.Minute), Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to create test run: %v", err)
+	}
+
+	response := invoke(t, testService.TestAckHandler, ackBody(t, testService, TestAckRequest{Nonce: "nonce-1"}), nil)
+	expectStatus(t, response, 200)
+
+	testRun, err := queries.GetTestRunByNonce(context.Background(), "nonce-1")
+	if err != nil {
+		t.Fatalf("failed to get test run: %v", err)
+	}
+	if testRun.Status != "ACKED" || !testRun.AckedAt.Valid {
+		t.Fatalf("expected ACKED test run, got %+v", testRun)
+	}
+
+	// A second ack finds no PENDING run
+	expectStatus(t, invoke(t, testService.TestAckHandler, ackBody(t, testService, TestAckRequest{Nonce: "nonce-1"}), nil), 404)
+}
+
+func TestTestAckHandlerNotFound(t *testing.T) {
+	requireDB(t)
+
+	expectStatus(t, invoke(t, testService.TestAckHandler, ackBody(t, testService, TestAckRequest{Nonce: "unknown"}), nil), 404)
+}
+
+func TestTestAckHandlerBadRequest(t *testing.T) {
+	expectStatus(t, invoke(t, testService.TestAckHandler, `{`, nil), 400)
+	expectStatus(t, invoke(t, testService.TestAckHandler, `{"nonce":""}`, nil), 400)
+}
+
+func TestTestAckHandlerDatabaseUnavailable(t *testing.T) {
+	withUnreachableDatabase(t)
+
+	expectStatus(t, invoke(t, testService.TestAckHandler, ackBody(t, testService, TestAckRequest{Nonce: "nonce-1"}), nil), 500)
+}
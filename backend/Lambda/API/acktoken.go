@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Ack tokens prove that an ack comes from a device that received the e2e test message.
+// SendMessageHandler signs one per device and sends it in the message data; TestAckHandler
+// only accepts acks carrying a valid, unexpired token for the acked nonce and device.
+//
+// A token is base64url(JSON claims) "." base64url(HMAC-SHA256(key, base64url(JSON claims))),
+// with the key read through the secrets layer from ACK_TOKEN_SECRET_ARN.
+//
+// Receipt tokens (see MessageReceiptHandler) are the same, with a message ID instead of a nonce.
+// A token vouches for exactly one of the two, so an ack token never passes as a receipt token.
+
+// ackTokenDataKey is the data key carrying the ack token of e2e test messages (see TestAckRequest.AckToken)
+const ackTokenDataKey = "ack_token"
+
+// minAckTokenKeyLength rejects signing keys too short for HMAC-SHA256
+const minAckTokenKeyLength = 32
+
+// receiptTokenDataKey is the data key carrying the receipt token of every message (see MessageReceiptRequest.ReceiptToken)
+const receiptTokenDataKey = "receipt_token"
+
+// receiptTokenLifetime matches the longest time FCM keeps a message for an offline device
+const receiptTokenLifetime = 28 * 24 * time.Hour
+
+// ackTokenClaims is what an ack or receipt token vouches for
+type ackTokenClaims struct {
+	Nonce     string `json:"n,omitempty"` // Ack tokens only
+	MessageID string `json:"m,omitempty"` // Receipt tokens only
+	DeviceID  string `json:"d"`
+	ExpiresAt int64  `json:"e"` // Unix seconds, the test run's expires_at for ack tokens
+}
+
+// errInvalidAckToken is returned for malformed, tampered or expired tokens
+var errInvalidAckToken = errors.New("invalid ack token")
+
+// signAckToken returns the ack token for claims
+func signAckToken(key []byte, claims ackTokenClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(ackTokenSignature(key, payload)), nil
+}
+
+// verifyAckToken checks the token's signature and expiry and returns its claims
+func verifyAckToken(key []byte, token string, now time.Time) (ackTokenClaims, error) {
+	payload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return ackTokenClaims{}, fmt.Errorf("%w: malformed", errInvalidAckToken)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, ackTokenSignature(key, payload)) {
+		return ackTokenClaims{}, fmt.Errorf("%w: bad signature", errInvalidAckToken)
+	}
+
+	var claims ackTokenClaims
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ackTokenClaims{}, fmt.Errorf("%w: malformed payload", errInvalidAckToken)
+	}
+	if err := json.Unmarshal(data, &claims); err != nil || (claims.Nonce == "") == (claims.MessageID == "") || claims.DeviceID == "" {
+		return ackTokenClaims{}, fmt.Errorf("%w: malformed claims", errInvalidAckToken)
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return ackTokenClaims{}, fmt.Errorf("%w: expired at %s", errInvalidAckToken, time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	return claims, nil
+}
+
+func ackTokenSignature(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// ackTokenKey reads the signing key from the secrets layer. Secrets Manager values are
+// cached by the provider, so this does not call AWS on every request.
+func (s *Service) ackTokenKey(ctx context.Context) ([]byte, error) {
+	if s.AckTokenSecretID == "" {
+		return nil, fmt.Errorf("ACK_TOKEN_SECRET_ARN is not set")
+	}
+	key, err := s.Secrets.GetSecret(ctx, s.AckTokenSecretID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ack token key: %w", err)
+	}
+	if len(key) < minAckTokenKeyLength {
+		return nil, fmt.Errorf("ack token key must be at least %d bytes", minAckTokenKeyLength)
+	}
+	return []byte(key), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAckTokenKey signs ack tokens in tests, for both the fake and the environment-configured service.
+const testAckTokenKey = "test-ack-token-key-0123456789abcdef"
+
+// ackBody returns the JSON body of ack, with a valid ack token for its nonce and device
+// (device-1 if DeviceId is empty) unless AckToken is set.
+func ackBody(t *testing.T, service *Service, ack TestAckRequest) string {
+	t.Helper()
+	if ack.AckToken == "" {
+		deviceID := ack.DeviceId
+		if deviceID == "" {
+			deviceID = "device-1"
+		}
+		ack.AckToken = signTestAckToken(t, ack.Nonce, deviceID, service.Clock.Now().Add(maxAckTimeout))
+	}
+	body, err := json.Marshal(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func signTestAckToken(t *testing.T, nonce, deviceID string, expiresAt time.Time) string {
+	t.Helper()
+	token, err := signAckToken([]byte(testAckTokenKey), ackTokenClaims{Nonce: nonce, DeviceID: deviceID, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAckTokenRoundTrip(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := []byte(testAckTokenKey)
+	token := signTestAckToken(t, "nonce-1", "device-1", now.Add(time.Minute))
+
+	claims, err := verifyAckToken(key, token, now)
+	if err != nil {
+		t.Fatalf("verifyAckToken failed: %v", err)
+	}
+	if claims.Nonce != "nonce-1" || claims.DeviceID != "device-1" || claims.ExpiresAt != now.Add(time.Minute).Unix() {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	other := signTestAckToken(t, "nonce-2", "device-1", now.Add(time.Minute))
+	otherPayload, _, _ := strings.Cut(other, ".")
+
+	for name, token := range map[string]string{
+		"expired":       signTestAckToken(t, "nonce-1", "device-1", now),
+		"other payload": otherPayload + "." + signature,
+		"bad signature": payload + "." + strings.Repeat("A", len(signature)),
+		"no signature":  payload,
+		"garbage":       "not.a-token",
+	} {
+		if _, err := verifyAckToken(key, token, now); !errors.Is(err, errInvalidAckToken) {
+			t.Errorf("%s: expected errInvalidAckToken, got %v", name, err)
+		}
+	}
+
+	if _, err := verifyAckToken([]byte("another-key-0123456789abcdef-0123"), token, now); !errors.Is(err, errInvalidAckToken) {
+		t.Errorf("token verified with another key: %v", err)
+	}
+}
+
+func TestSendMessageSignsAckTokenPerDevice(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	sendE2ETest(t, service, "30")
+
+	sent := fakes.sender.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected two messages, got %+v", sent)
+	}
+	for _, message := range sent {
+		deviceID := map[string]string{"token-1": "device-1", "token-2": "device-2"}[message.Token]
+		claims, err := verifyAckToken([]byte(testAckTokenKey), message.Data[ackTokenDataKey], fakes.clock.Now())
+		if err != nil {
+			t.Fatalf("invalid ack token for %s: %v", message.Token, err)
+		}
+		if claims.Nonce != "nonce-1" || claims.DeviceID != deviceID || claims.ExpiresAt != fakes.clock.Now().Add(30*time.Second).Unix() {
+			t.Fatalf("unexpected claims for %s: %+v", message.Token, claims)
+		}
+	}
+
+	// The token of device-1 acks for device-1 only; sends go out concurrently, in any order
+	token := sent[0].Data[ackTokenDataKey]
+	if sent[0].Token != "token-1" {
+		token = sent[1].Data[ackTokenDataKey]
+	}
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", DeviceId: "device-2", AckToken: token}), nil), 401)
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", AckToken: token}), nil), 200)
+	if status := testRunStatus(t, service); status.DeviceID != "device-1" || status.AckedDeviceCount != 1 {
+		t.Fatalf("expected ack by device-1, got %+v", status)
+	}
+}
+
+func TestAckRejectsInvalidTokens(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	sendE2ETest(t, service, "30")
+	now := fakes.clock.Now()
+
+	for name, ack := range map[string]TestAckRequest{
+		"missing":      {Nonce: "nonce-1", DeviceId: "device-1", AckToken: ""},
+		"other nonce":  {Nonce: "nonce-1", DeviceId: "device-1", AckToken: signTestAckToken(t, "nonce-2", "device-1", now.Add(time.Minute))},
+		"other device": {Nonce: "nonce-1", DeviceId: "device-1", AckToken: signTestAckToken(t, "nonce-1", "device-2", now.Add(time.Minute))},
+		"expired":      {Nonce: "nonce-1", DeviceId: "device-1", AckToken: signTestAckToken(t, "nonce-1", "device-1", now)},
+		"tampered":     {Nonce: "nonce-1", DeviceId: "device-1", AckToken: signTestAckToken(t, "nonce-1", "device-1", now.Add(time.Minute)) + "x"},
+	} {
+		body := ackBody(t, service, ack)
+		if name == "missing" {
+			body = `{"nonce":"nonce-1","device_id":"device-1"}`
+		}
+		if response := invoke(t, service.TestAckHandler, body, nil); response.StatusCode != 401 {
+			t.Errorf("%s: expected 401, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+
+	if status := testRunStatus(t, service); status.Status != testRunStatusPending {
+		t.Fatalf("rejected acks changed the run: %+v", status)
+	}
+}
+
+func TestAckTokenKeyErrors(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+
+	// Without a usable key nothing is persisted or sent
+	fakes.secrets["ack-token-key"] = "short"
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 500)
+	if len(fakes.sender.Sent()) != 0 || len(fakes.querier.testRuns) != 0 {
+		t.Fatal("message sent or test run created without an ack token key")
+	}
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1"}), nil), 500)
+
+	// Every other message carries receipt tokens, so it needs the key too
+	expectStatus(t, invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hi","body":"There"}`, nil), 500)
+	if len(fakes.sender.Sent()) != 0 || len(fakes.querier.messages) != 0 {
+		t.Fatal("message sent or created without an ack token key")
+	}
+}
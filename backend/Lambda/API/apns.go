@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// APNsSender delivers messages to APNs device tokens of the iOS app identified by creds
+type APNsSender interface {
+	Send(ctx context.Context, creds *common.APNsCredentials, message PushMessage) error
+}
+
+// APNs HTTP/2 API endpoints of the production and development environments
+const (
+	apnsProductionBaseURL = "https://api.push.apple.com"
+	apnsSandboxBaseURL    = "https://api.sandbox.push.apple.com"
+)
+
+// apnsAPIBaseURL returns the APNs API base URL override, or "" to choose the endpoint
+// by the environment of each app's credentials.
+// APNS_API_BASE_URL sets it, e.g. to point at a fake APNs server in tests.
+func apnsAPIBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("APNS_API_BASE_URL"), "/")
+}
+
+// apnsProviderTokenLifetime is how long a provider token is reused. APNs rejects tokens older
+// than an hour, and tokens refreshed more often than every 20 minutes.
+const apnsProviderTokenLifetime = 50 * time.Minute
+
+// httpAPNsSender sends messages with the APNs HTTP/2 API, authenticated with provider tokens:
+// ES256 JWTs signed with the team's .p8 key. Tokens are cached per key, like FCM access tokens.
+type httpAPNsSender struct {
+	baseURL string // Overrides the endpoint of both environments if set
+	client  *http.Client
+	clock   Clock
+
+	mu     sync.Mutex
+	tokens map[string]cachedAccessToken // Key: team_id + key_id
+}
+
+// newHTTPAPNsSender creates a sender for the APNs API at baseURL (see apnsAPIBaseURL).
+// The default transport negotiates HTTP/2 over TLS, which APNs requires.
+func newHTTPAPNsSender(baseURL string, clock Clock) *httpAPNsSender {
+	return &httpAPNsSender{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		clock:   clock,
+		tokens:  make(map[string]cachedAccessToken),
+	}
+}
+
+// Send sends an alert notification to a single device. Data keys are added as custom keys
+// next to "aps", where the app reads them from the notification's userInfo.
+func (s *httpAPNsSender) Send(ctx context.Context, creds *common.APNsCredentials, message PushMessage) error {
+	providerToken, err := s.providerToken(creds)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]any{
+		"aps": map[string]any{
+			"alert": map[string]string{
+				"title": message.Title,
+				"body":  message.Body,
+			},
+		},
+	}
+	for key, value := range message.Data {
+		if key != "aps" {
+			payload[key] = value
+		}
+	}
+
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	apnsURL := fmt.Sprintf("%s/3/device/%s", s.endpoint(creds), url.PathEscape(message.Token))
+	req, err := http.NewRequestWithContext(ctx, "POST", apnsURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", creds.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// Errors come with a reason, e.g. {"reason":"BadDeviceToken"}
+	var apnsError struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.Unmarshal(responseBody, &apnsError)
+
+	switch {
+	case resp.StatusCode == http.StatusGone,
+		resp.StatusCode == http.StatusBadRequest && (apnsError.Reason == "BadDeviceToken" || apnsError.Reason == "DeviceTokenNotForTopic"):
+		// The token is no longer active for the topic (Unregistered or ExpiredToken), or never was:
+		// it is malformed or belongs to another app or environment. Sends to it can never succeed.
+		return fmt.Errorf("%w: topic=%s, status=%d, reason=%s", errPushTokenUnregistered, creds.Topic, resp.StatusCode, apnsError.Reason)
+	case resp.StatusCode == http.StatusForbidden && (apnsError.Reason == "ExpiredProviderToken" || apnsError.Reason == "InvalidProviderToken"):
+		// Sign a new token for the next send
+		s.mu.Lock()
+		delete(s.tokens, apnsTokenKey(creds))
+		s.mu.Unlock()
+	case isRejectedStatus(resp.StatusCode):
+		return fmt.Errorf("%w: topic=%s, status=%d, reason=%s", errPushMessageRejected, creds.Topic, resp.StatusCode, apnsError.Reason)
+	}
+	return fmt.Errorf("APNs API returned error: topic=%s, status=%d, reason=%s", creds.Topic, resp.StatusCode, apnsError.Reason)
+}
+
+// endpoint returns the base URL for the environment of creds
+func (s *httpAPNsSender) endpoint(creds *common.APNsCredentials) string {
+	switch {
+	case s.baseURL != "":
+		return s.baseURL
+	case creds.Sandbox:
+		return apnsSandboxBaseURL
+	default:
+		return apnsProductionBaseURL
+	}
+}
+
+// providerToken returns a cached provider token for creds, signing a new one when needed
+func (s *httpAPNsSender) providerToken(creds *common.APNsCredentials) (string, error) {
+	key := apnsTokenKey(creds)
+
+	s.mu.Lock()
+	cached, ok := s.tokens[key]
+	s.mu.Unlock()
+	if ok && s.clock.Now().Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	token, err := s.signProviderToken(creds)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign provider token for topic %s: %w", creds.Topic, err)
+	}
+
+	s.mu.Lock()
+	s.tokens[key] = cachedAccessToken{token: token, expiresAt: s.clock.Now().Add(apnsProviderTokenLifetime)}
+	s.mu.Unlock()
+
+	return token, nil
+}
+
+// signProviderToken signs a provider token with the team's .p8 key
+func (s *httpAPNsSender) signProviderToken(creds *common.APNsCredentials) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("failed to decode PEM block from private key")
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	ecdsaPrivateKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("private key is not ECDSA")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": creds.TeamID,
+		"iat": s.clock.Now().Unix(),
+	})
+	token.Header["kid"] = creds.KeyID
+
+	return token.SignedString(ecdsaPrivateKey)
+}
+
+// apnsTokenKey is the provider token cache key of creds
+func apnsTokenKey(creds *common.APNsCredentials) string {
+	return creds.TeamID + "|" + creds.KeyID
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fakeAPNsTeamID = "TEAM123456"
+	fakeAPNsKeyID  = "KEY7654321"
+	fakeAPNsTopic  = "com.example.app"
+
+	// Device tokens registered by the tests: 32 bytes, hex encoded
+	apnsToken1 = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	apnsToken2 = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+)
+
+// fakeAPNsNotification is a notification accepted by the fake APNs server.
+type fakeAPNsNotification struct {
+	ProtoMajor    int    // HTTP version of the request
+	Token         string // Device token from the path
+	Topic         string // apns-topic header
+	PushType      string // apns-push-type header
+	ProviderToken string // Bearer token of the request
+	Title         string
+	Body          string
+	Data          map[string]string // Custom keys next to "aps"
+}
+
+// fakeAPNsFailure is the error returned for a device token.
+type fakeAPNsFailure struct {
+	status int
+	reason string
+}
+
+// fakeAPNs is an httptest server implementing the APNs HTTP/2 API over TLS. It accepts provider
+// tokens signed with its key for fakeAPNsTeamID and fakeAPNsKeyID.
+type fakeAPNs struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+
+	mu            sync.Mutex
+	notifications []fakeAPNsNotification
+	failTokens    map[string]fakeAPNsFailure
+}
+
+func newFakeAPNs(t *testing.T) *fakeAPNs {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeAPNs{key: key, failTokens: make(map[string]fakeAPNsFailure)}
+	f.server = httptest.NewUnstartedServer(http.HandlerFunc(f.handle))
+	f.server.EnableHTTP2 = true
+	f.server.StartTLS()
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// newSender returns a sender for the fake server that trusts its certificate.
+func (f *fakeAPNs) newSender(clock Clock) *httpAPNsSender {
+	sender := newHTTPAPNsSender(f.server.URL, clock)
+	sender.client = f.server.Client()
+	return sender
+}
+
+// credentials returns APNs credentials with the fake server's signing key.
+func (f *fakeAPNs) credentials(t *testing.T) *common.APNsCredentials {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(f.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &common.APNsCredentials{
+		TeamID:     fakeAPNsTeamID,
+		KeyID:      fakeAPNsKeyID,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		Topic:      fakeAPNsTopic,
+	}
+}
+
+// FailToken makes sends to token return the given HTTP status and reason.
+func (f *fakeAPNs) FailToken(token string, status int, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failTokens[token] = fakeAPNsFailure{status: status, reason: reason}
+}
+
+// Notifications returns the notifications accepted so far.
+func (f *fakeAPNs) Notifications() []fakeAPNsNotification {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeAPNsNotification(nil), f.notifications...)
+}
+
+func (f *fakeAPNs) handle(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, reason string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"reason": reason})
+	}
+
+	// /3/device/{token}
+	token, ok := strings.CutPrefix(r.URL.Path, "/3/device/")
+	if r.Method != http.MethodPost || !ok || token == "" {
+		fail(http.StatusNotFound, "BadPath")
+		return
+	}
+
+	providerToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "bearer ")
+	if !ok {
+		fail(http.StatusForbidden, "MissingProviderToken")
+		return
+	}
+	parsed, err := jwt.Parse(providerToken, func(token *jwt.Token) (any, error) {
+		if token.Header["kid"] != fakeAPNsKeyID {
+			return nil, errors.New("unknown key")
+		}
+		return &f.key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"ES256"}), jwt.WithIssuer(fakeAPNsTeamID))
+	if err != nil || !parsed.Valid {
+		fail(http.StatusForbidden, "InvalidProviderToken")
+		return
+	}
+	if r.Header.Get("apns-topic") != fakeAPNsTopic {
+		fail(http.StatusBadRequest, "TopicDisallowed")
+		return
+	}
+
+	var payload map[string]json.RawMessage
+	var aps struct {
+		Alert struct {
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		} `json:"alert"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || json.Unmarshal(payload["aps"], &aps) != nil {
+		fail(http.StatusBadRequest, "PayloadEmpty")
+		return
+	}
+	data := make(map[string]string)
+	for key, value := range payload {
+		var s string
+		if key != "aps" && json.Unmarshal(value, &s) == nil {
+			data[key] = s
+		}
+	}
+
+	f.mu.Lock()
+	failure, failed := f.failTokens[token]
+	if !failed {
+		f.notifications = append(f.notifications, fakeAPNsNotification{
+			ProtoMajor:    r.ProtoMajor,
+			Token:         token,
+			Topic:         r.Header.Get("apns-topic"),
+			PushType:      r.Header.Get("apns-push-type"),
+			ProviderToken: providerToken,
+			Title:         aps.Alert.Title,
+			Body:          aps.Alert.Body,
+			Data:          data,
+		})
+	}
+	f.mu.Unlock()
+
+	if failed {
+		fail(failure.status, failure.reason)
+		return
+	}
+	w.Header().Set("apns-id", "00000000-0000-0000-0000-000000000001")
+}
+
+// withFakeAPNs gives the "default" app of a fake service APNs credentials for a fake APNs server.
+func withFakeAPNs(t *testing.T, service *Service, fakes *testServiceFakes) *fakeAPNs {
+	t.Helper()
+	apns := newFakeAPNs(t)
+	creds, err := json.Marshal(apns.credentials(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakes.secrets["default-apns-secret"] = string(creds)
+	service.Apps.WithAPNs(map[string]string{"default": "default-apns-secret"})
+	service.APNs = apns.newSender(fakes.clock)
+	return apns
+}
+
+func TestHTTPAPNsSenderSendsOverHTTP2(t *testing.T) {
+	apns := newFakeAPNs(t)
+	sender := apns.newSender(newFakeClock())
+
+	err := sender.Send(t.Context(), apns.credentials(t), PushMessage{
+		Token: apnsToken1,
+		Title: "Hello",
+		Body:  "World",
+		Data:  map[string]string{"message_id": "msg-1", "aps": "ignored"},
+	})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	notifications := apns.Notifications()
+	if len(notifications) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(notifications))
+	}
+	n := notifications[0]
+	if n.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got HTTP/%d", n.ProtoMajor)
+	}
+	if n.Token != apnsToken1 || n.Topic != fakeAPNsTopic || n.PushType != "alert" || n.Title != "Hello" || n.Body != "World" {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+	if len(n.Data) != 1 || n.Data["message_id"] != "msg-1" {
+		t.Fatalf("expected message_id as the only custom key, got %v", n.Data)
+	}
+}
+
+func TestHTTPAPNsSenderCachesProviderToken(t *testing.T) {
+	apns := newFakeAPNs(t)
+	creds := apns.credentials(t)
+	clock := newFakeClock()
+	sender := apns.newSender(clock)
+	send := func() string {
+		t.Helper()
+		if err := sender.Send(t.Context(), creds, PushMessage{Token: apnsToken1, Title: "Hello", Body: "World"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		notifications := apns.Notifications()
+		return notifications[len(notifications)-1].ProviderToken
+	}
+
+	first := send()
+	clock.Advance(time.Minute)
+	if second := send(); second != first {
+		t.Fatal("expected the provider token to be reused")
+	}
+
+	clock.Advance(apnsProviderTokenLifetime)
+	if third := send(); third == first {
+		t.Fatal("expected a new provider token after its lifetime")
+	}
+}
+
+func TestHTTPAPNsSenderErrors(t *testing.T) {
+	apns := newFakeAPNs(t)
+	creds := apns.credentials(t)
+	sender := apns.newSender(newFakeClock())
+	for _, tt := range []struct {
+		status       int
+		reason       string
+		unregistered bool
+	}{
+		{http.StatusGone, "Unregistered", true},
+		{http.StatusBadRequest, "BadDeviceToken", true},
+		{http.StatusBadRequest, "DeviceTokenNotForTopic", true},
+		{http.StatusBadRequest, "PayloadTooLarge", false},
+	} {
+		apns.FailToken(apnsToken1, tt.status, tt.reason)
+		err := sender.Send(t.Context(), creds, PushMessage{Token: apnsToken1, Title: "Hello", Body: "World"})
+		if errors.Is(err, errPushTokenUnregistered) != tt.unregistered || !isFinalPushError(err) || !strings.Contains(err.Error(), tt.reason) {
+			t.Fatalf("%d %s: unexpected error %v", tt.status, tt.reason, err)
+		}
+	}
+	apns.FailToken(apnsToken2, http.StatusServiceUnavailable, "ServiceUnavailable")
+	err := sender.Send(t.Context(), creds, PushMessage{Token: apnsToken2, Title: "Hello", Body: "World"})
+	if err == nil || isFinalPushError(err) {
+		t.Fatalf("expected a transient error, got %v", err)
+	}
+
+	// A key the server does not know
+	other := *creds
+	other.KeyID = "OTHERKEY00"
+	err = sender.Send(t.Context(), &other, PushMessage{Token: "c0ffee", Title: "Hello", Body: "World"})
+	if err == nil || isFinalPushError(err) || !strings.Contains(err.Error(), "InvalidProviderToken") {
+		t.Fatalf("expected an InvalidProviderToken error, got %v", err)
+	}
+	if _, ok := sender.tokens[apnsTokenKey(&other)]; ok {
+		t.Fatal("expected the rejected provider token to be dropped")
+	}
+}
+
+func TestRegisterDeviceAPNsToken(t *testing.T) {
+	service, fakes := newFakeService(t)
+	withFakeAPNs(t, service, fakes)
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"`+apnsToken1+`","token_type":"apns","platform":"ios"}`, nil), 200)
+	if device := fakes.querier.devices[0]; device.TokenType != tokenTypeAPNs || device.FcmToken != apnsToken1 {
+		t.Fatalf("expected an APNs device, got %+v", device)
+	}
+
+	// Switching the app to the Firebase SDK replaces the token and its type
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"ios"}`, nil), 200)
+	if device := fakes.querier.devices[0]; device.TokenType != tokenTypeFCM || device.FcmToken != "token-1" {
+		t.Fatalf("expected an FCM device, got %+v", device)
+	}
+
+	for name, body := range map[string]string{
+		"android":         `{"user_id":"user-1","device_id":"device-2","fcm_token":"` + apnsToken2 + `","token_type":"apns","platform":"android"}`,
+		"app without key": `{"user_id":"user-1","device_id":"device-2","fcm_token":"` + apnsToken2 + `","token_type":"apns","platform":"ios","app_id":"shop"}`,
+		"not hex":         `{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","token_type":"apns","platform":"ios"}`,
+		"unknown type":    `{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","token_type":"hms","platform":"android"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectStatus(t, invoke(t, service.RegisterDeviceHandler, body, nil), 400)
+		})
+	}
+}
+
+func TestSendMessageRoutesByTokenType(t *testing.T) {
+	service, fakes := newFakeService(t)
+	apns := withFakeAPNs(t, service, fakes)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"`+apnsToken1+`","token_type":"apns","platform":"ios"}`, nil), 200)
+
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 200)
+
+	if sent := fakes.sender.Sent(); len(sent) != 1 || sent[0].Token != "token-1" {
+		t.Fatalf("expected only device-1 to be sent to through FCM, got %+v", sent)
+	}
+	notifications := apns.Notifications()
+	if len(notifications) != 1 || notifications[0].Token != apnsToken1 || notifications[0].Title != "E2E" {
+		t.Fatalf("expected device-2 to be sent to through APNs, got %+v", notifications)
+	}
+	data := notifications[0].Data
+	if data[messageIDDataKey] == "" || data[receiptTokenDataKey] == "" || data[ackTokenDataKey] == "" {
+		t.Fatalf("expected message_id, receipt and ack tokens, got %v", data)
+	}
+
+	// The device acks with the token it got through APNs
+	fakes.clock.Advance(time.Second)
+	ack, err := json.Marshal(TestAckRequest{Nonce: "nonce-1", AckToken: data[ackTokenDataKey]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, invoke(t, service.TestAckHandler, string(ack), nil), 200)
+	if status := testRunStatus(t, service); status.Status != "ACKED" || status.DeviceID != "device-2" {
+		t.Fatalf("expected the run to be acked by device-2, got %+v", status)
+	}
+}
+
+func TestSendMessageInvalidatesUnregisteredAPNsToken(t *testing.T) {
+	service, fakes := newFakeService(t)
+	apns := withFakeAPNs(t, service, fakes)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"`+apnsToken1+`","token_type":"apns","platform":"ios"}`, nil), 200)
+	apns.FailToken(apnsToken1, http.StatusGone, "Unregistered")
+
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil), 200)
+	if device := fakes.querier.devices[0]; device.IsActive {
+		t.Fatalf("expected the device to be deactivated, got %+v", device)
+	}
+}
+
+func TestBroadcastRoutesByTokenType(t *testing.T) {
+	service, fakes := newFakeService(t)
+	apns := withFakeAPNs(t, service, fakes)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-2","device_id":"device-2","fcm_token":"`+apnsToken1+`","token_type":"apns","platform":"ios"}`, nil), 200)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-3","device_id":"device-3","fcm_token":"`+apnsToken2+`","token_type":"apns","platform":"ios"}`, nil), 200)
+
+	broadcast := createBroadcast(t, context.Background(), service, `{"category":"system","title":"Outage","body":"We are on it"}`)
+	if broadcast.Status != "COMPLETED" || broadcast.SentCount != 3 || broadcast.FailedCount != 0 {
+		t.Fatalf("unexpected broadcast: %+v", broadcast)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 1 || sent[0].Token != "token-1" {
+		t.Fatalf("expected only device-1 to be sent to through FCM, got %+v", sent)
+	}
+	if notifications := apns.Notifications(); len(notifications) != 2 {
+		t.Fatalf("expected 2 notifications through APNs, got %+v", notifications)
+	}
+}
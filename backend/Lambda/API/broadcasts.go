@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Broadcasts send a message to every active device, e.g. about an outage. Devices are sent to in
+// batches in devices.id order, a bounded number at a time, and every batch is checkpointed in the
+// broadcasts table once it has been sent. The invocation sending a broadcast holds a lease on it.
+// POST /broadcasts sends the first batches itself; BroadcastHandler, which runs on a schedule,
+// resumes RUNNING broadcasts from their checkpoint, including those whose invocation timed out
+// once their lease has expired. A batch interrupted before its checkpoint is sent again.
+
+// Batches of a broadcast, in devices
+const (
+	defaultBroadcastBatchSize = 500
+	maxBroadcastBatchSize     = 1000
+)
+
+// Paging of GET /broadcasts
+const (
+	defaultBroadcastsLimit = 20
+	maxBroadcastsLimit     = 100
+)
+
+const (
+	// broadcastConcurrency bounds the sends in flight per batch
+	broadcastConcurrency = 20
+	// broadcastLease is how long an invocation holds a broadcast. Every checkpoint renews it, so it
+	// must exceed the time to send one batch.
+	broadcastLease = 2 * time.Minute
+	// broadcastBatchMargin is the time a batch needs; no batch starts with less time left
+	broadcastBatchMargin = 10 * time.Second
+	// broadcastRequestTime is how long POST /broadcasts sends before returning, within the
+	// 29 second API Gateway timeout
+	broadcastRequestTime = 20 * time.Second
+	// broadcastWorkerTime is how long BroadcastHandler sends without a Lambda deadline
+	broadcastWorkerTime = 15 * time.Minute
+)
+
+// Statuses of broadcasts
+const (
+	broadcastRunning   = "RUNNING"
+	broadcastCompleted = "COMPLETED"
+	broadcastFailed    = "FAILED"
+)
+
+// CreateBroadcastRequest is a message to every active device. The message fields mean the same
+// as in SendSegmentRequest.
+type CreateBroadcastRequest struct {
+	SegmentMessage
+	BatchSize int `json:"batch_size"` // Devices per batch, default 500
+}
+
+type BroadcastResponse struct {
+	BroadcastID     string         `json:"broadcast_id"`
+	Status          string         `json:"status"` // RUNNING, COMPLETED or FAILED
+	FailureReason   string         `json:"failure_reason,omitempty"`
+	Message         SegmentMessage `json:"message"`
+	BatchSize       int            `json:"batch_size"`
+	TotalDevices    int            `json:"total_devices"` // Active devices when the broadcast was created
+	SentCount       int            `json:"sent_count"`
+	FailedCount     int            `json:"failed_count"`
+	SuppressedCount int            `json:"suppressed_count"` // Devices that opted out of the category
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	CompletedAt     *time.Time     `json:"completed_at,omitempty"`
+}
+
+type ListBroadcastsResponse struct {
+	Broadcasts []BroadcastResponse `json:"broadcasts"`
+}
+
+// BroadcastResult is returned by BroadcastHandler
+type BroadcastResult struct {
+	Broadcasts int `json:"broadcasts"` // Broadcasts resumed
+	Batches    int `json:"batches"`    // Batches sent
+}
+
+// CreateBroadcastHandler is the Lambda handler for POST /broadcasts. It creates the broadcast and
+// sends batches for up to broadcastRequestTime; BroadcastHandler sends the rest.
+func (s *Service) CreateBroadcastHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received create broadcast request")
+
+	var createRequest CreateBroadcastRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &createRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+	if err := createRequest.SegmentMessage.validate(); err != nil {
+		return logger.BadRequest(ctx, err, "Invalid message")
+	}
+	batchSize := defaultBroadcastBatchSize
+	if createRequest.BatchSize != 0 {
+		batchSize = createRequest.BatchSize
+		if batchSize < 1 || batchSize > maxBroadcastBatchSize {
+			err := fmt.Errorf("invalid batch_size: %d", batchSize)
+			return logger.BadRequest(ctx, err, "batch_size must be 1-"+strconv.Itoa(maxBroadcastBatchSize))
+		}
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	// Reject unknown categories and templates before anything is recorded
+	if _, err := prepareSegmentMessage(ctx, queries, createRequest.SegmentMessage); err != nil {
+		if errors.Is(err, errInvalidSegmentMessage) {
+			return logger.BadRequest(ctx, err, "Invalid message")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	broadcastID, err := newBroadcastID()
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to create broadcast ID")
+	}
+	message, err := json.Marshal(createRequest.SegmentMessage)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to encode message")
+	}
+	broadcast, err := queries.CreateBroadcast(ctx, sqlc.CreateBroadcastParams{
+		BroadcastID: broadcastID,
+		Message:     message,
+		BatchSize:   int32(batchSize),
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+
+	logger.Info(ctx, "Broadcast created: broadcast_id=%s, category=%s, devices=%d", broadcastID, createRequest.Category, broadcast.TotalDevices)
+
+	// Send the first batches. Whatever is left, including after a failure, is resumed by BroadcastHandler.
+	claimed, err := queries.ClaimBroadcast(ctx, sqlc.ClaimBroadcastParams{
+		LeaseExpiresAt: s.broadcastLeaseExpiry(),
+		BroadcastID:    pgtype.Text{String: broadcastID, Valid: true},
+	})
+	if err != nil {
+		logger.Error(ctx, err, "Failed to claim broadcast: broadcast_id=%s", broadcastID)
+		return logger.Success(ctx, newBroadcastResponse(broadcast))
+	}
+	broadcast, _, err = s.runBroadcast(ctx, logger, queries, claimed, broadcastStopAt(ctx, broadcastRequestTime))
+	if err != nil {
+		logger.Error(ctx, err, "Broadcast stopped: broadcast_id=%s", broadcastID)
+	}
+
+	return logger.Success(ctx, newBroadcastResponse(broadcast))
+}
+
+// GetBroadcastHandler is the Lambda handler for GET /broadcasts/{broadcast_id}, reporting progress
+func (s *Service) GetBroadcastHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received get broadcast request")
+
+	broadcastID := request.PathParameters["broadcast_id"]
+	if broadcastID == "" {
+		return logger.BadRequest(ctx, nil, "Missing broadcast_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	broadcast, err := queries.GetBroadcast(ctx, broadcastID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err := fmt.Errorf("broadcast not found: %s", broadcastID)
+			return logger.NotFound(ctx, err, "Broadcast not found")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	return logger.Success(ctx, newBroadcastResponse(broadcast))
+}
+
+// ListBroadcastsHandler is the Lambda handler for GET /broadcasts?limit=, newest first
+func (s *Service) ListBroadcastsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list broadcasts request")
+
+	limit := defaultBroadcastsLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxBroadcastsLimit {
+			err := fmt.Errorf("invalid limit: %s", value)
+			return logger.BadRequest(ctx, err, fmt.Sprintf("limit must be 1-%d", maxBroadcastsLimit))
+		}
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	broadcasts, err := queries.ListBroadcasts(ctx, int32(limit))
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	response := ListBroadcastsResponse{Broadcasts: make([]BroadcastResponse, 0, len(broadcasts))}
+	for _, broadcast := range broadcasts {
+		response.Broadcasts = append(response.Broadcasts, newBroadcastResponse(broadcast))
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// BroadcastHandler is the Lambda handler that resumes RUNNING broadcasts no invocation holds,
+// oldest first, until the Lambda deadline is near. It runs on an EventBridge schedule, so the
+// event payload is ignored.
+func (s *Service) BroadcastHandler(ctx context.Context) (*BroadcastResult, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Resuming broadcasts")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		logger.Error(ctx, err, "Database connection failed")
+		return nil, fmt.Errorf("database connection failed: %w", err)
+	}
+
+	stopAt := broadcastStopAt(ctx, broadcastWorkerTime)
+	result := &BroadcastResult{}
+	for time.Until(stopAt) >= broadcastBatchMargin {
+		broadcast, err := queries.ClaimBroadcast(ctx, sqlc.ClaimBroadcastParams{LeaseExpiresAt: s.broadcastLeaseExpiry()})
+		if errors.Is(err, pgx.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			logger.Error(ctx, err, "Failed to claim broadcast")
+			return result, fmt.Errorf("failed to claim broadcast: %w", err)
+		}
+		result.Broadcasts++
+
+		broadcast, batches, err := s.runBroadcast(ctx, logger, queries, broadcast, stopAt)
+		result.Batches += batches
+		if errors.Is(err, errBroadcastLeaseLost) {
+			logger.Error(ctx, err, "Broadcast taken over: broadcast_id=%s", broadcast.BroadcastID)
+			continue
+		}
+		if err != nil {
+			logger.Error(ctx, err, "Broadcast stopped: broadcast_id=%s", broadcast.BroadcastID)
+			return result, fmt.Errorf("broadcast %s stopped: %w", broadcast.BroadcastID, err)
+		}
+	}
+
+	logger.Info(ctx, "Resumed %d broadcasts, sent %d batches", result.Broadcasts, result.Batches)
+
+	return result, nil
+}
+
+// errBroadcastLeaseLost is returned when another invocation recorded a batch first,
+// after the lease of this one expired
+var errBroadcastLeaseLost = errors.New("broadcast lease lost")
+
+// runBroadcast sends batches of a claimed broadcast until it is done or stopAt is near, and
+// returns the broadcast as last recorded with the number of batches sent. The lease is released
+// when it stops early, so the next BroadcastHandler resumes right away.
+// A message that can no longer be sent (e.g. its template was deleted) fails the broadcast.
+func (s *Service) runBroadcast(ctx context.Context, logger *common.Logger, queries sqlc.Querier, broadcast sqlc.Broadcast, stopAt time.Time) (sqlc.Broadcast, int, error) {
+	batches := 0
+	defer func() {
+		if broadcast.Status != broadcastRunning {
+			return
+		}
+		err := queries.ReleaseBroadcast(ctx, sqlc.ReleaseBroadcastParams{
+			BroadcastID:    broadcast.BroadcastID,
+			LeaseExpiresAt: broadcast.LeaseExpiresAt,
+		})
+		if err != nil {
+			logger.Error(ctx, err, "Failed to release broadcast: broadcast_id=%s", broadcast.BroadcastID)
+		}
+	}()
+
+	var message SegmentMessage
+	if err := json.Unmarshal(broadcast.Message, &message); err != nil {
+		return s.failBroadcast(ctx, logger, queries, broadcast, batches, fmt.Errorf("invalid message: %w", err))
+	}
+	prepared, err := prepareSegmentMessage(ctx, queries, message)
+	if errors.Is(err, errInvalidSegmentMessage) {
+		return s.failBroadcast(ctx, logger, queries, broadcast, batches, err)
+	}
+	if err != nil {
+		return broadcast, batches, err
+	}
+	for {
+		checkpointed, batch, err := s.sendBroadcastBatch(ctx, logger, queries, broadcast, prepared)
+		if errors.Is(err, errTemplateRender) {
+			return s.failBroadcast(ctx, logger, queries, broadcast, batches, err)
+		}
+		if errors.Is(err, errBroadcastLeaseLost) {
+			broadcast.Status = "" // Not ours to release
+			return broadcast, batches, err
+		}
+		if err != nil {
+			return broadcast, batches, err
+		}
+		broadcast = checkpointed
+		batches++
+
+		logger.Info(ctx, "Broadcast batch sent: broadcast_id=%s, last_device_id=%d, sent=%d, failed=%d, retried=%d, suppressed=%d, status=%s",
+			broadcast.BroadcastID, batch.LastDeviceID, batch.Sent, batch.Failed, batch.Retried, batch.Suppressed, broadcast.Status)
+
+		if broadcast.Status != broadcastRunning || time.Until(stopAt) < broadcastBatchMargin {
+			return broadcast, batches, nil
+		}
+	}
+}
+
+// failBroadcast marks a broadcast FAILED because of err
+func (s *Service) failBroadcast(ctx context.Context, logger *common.Logger, queries sqlc.Querier, broadcast sqlc.Broadcast, batches int, err error) (sqlc.Broadcast, int, error) {
+	logger.Error(ctx, err, "Broadcast failed: broadcast_id=%s", broadcast.BroadcastID)
+	failed, failErr := queries.FailBroadcast(ctx, sqlc.FailBroadcastParams{
+		BroadcastID:   broadcast.BroadcastID,
+		FailureReason: pgtype.Text{String: err.Error(), Valid: true},
+	})
+	if failErr != nil {
+		return broadcast, batches, fmt.Errorf("failed to mark broadcast as FAILED: %w", failErr)
+	}
+	return failed, batches, nil
+}
+
+// broadcastBatch is the outcome of sending one batch of a broadcast
+type broadcastBatch struct {
+	LastDeviceID int32 // Checkpoint after the batch
+	Sent         int
+	Failed       int
+	Retried      int // Sends left to the relay, which are not counted in the broadcast
+	Suppressed   int
+	Completed    bool // No devices after the batch
+}
+
+// sendBroadcastBatch sends a message to the next batch of devices after the broadcast's checkpoint,
+// and returns the broadcast as recorded after the batch. Each user gets a message of their own per
+// batch. Templates are rendered for the whole batch before anything is recorded; errTemplateRender
+// is returned if that fails.
+//
+// The messages and their sends are enqueued in the transaction that checkpoints the batch, so a
+// batch is never sent twice: sends an invocation leaves behind are published by the relay, and the
+// broadcast resumes after the batch. Failed sends are recorded on the delivery and counted, without
+// stopping the batch.
+func (s *Service) sendBroadcastBatch(ctx context.Context, logger *common.Logger, queries sqlc.Querier, broadcast sqlc.Broadcast, message preparedSegmentMessage) (sqlc.Broadcast, broadcastBatch, error) {
+	rows, err := queries.ListBroadcastDevices(ctx, sqlc.ListBroadcastDevicesParams{
+		AfterID:    broadcast.LastDeviceID,
+		LimitCount: broadcast.BatchSize,
+	})
+	if err != nil {
+		return broadcast, broadcastBatch{}, err
+	}
+	batch := broadcastBatch{LastDeviceID: broadcast.LastDeviceID, Completed: len(rows) < int(broadcast.BatchSize)}
+	var users []userDevices
+	if len(rows) > 0 {
+		batch.LastDeviceID = rows[len(rows)-1].ID
+		users = groupBroadcastDevices(rows)
+	}
+
+	var checkpointed sqlc.Broadcast
+	var enqueued enqueuedMessages
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		var err error
+		enqueued, err = s.enqueueUserMessages(ctx, queries, users, message.outgoing())
+		if err != nil {
+			return err
+		}
+		batch.Suppressed = len(enqueued.suppressed)
+
+		checkpointed, err = queries.CheckpointBroadcast(ctx, sqlc.CheckpointBroadcastParams{
+			LastDeviceID:     batch.LastDeviceID,
+			Suppressed:       int32(batch.Suppressed),
+			Completed:        batch.Completed,
+			LeaseExpiresAt:   s.broadcastLeaseExpiry(),
+			BroadcastID:      broadcast.BroadcastID,
+			PreviousDeviceID: broadcast.LastDeviceID,
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: %s", errBroadcastLeaseLost, broadcast.BroadcastID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record batch: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return broadcast, broadcastBatch{}, err
+	}
+
+	counts := s.publishFCMSends(ctx, logger, enqueued.entries, broadcastConcurrency)
+	batch.Sent, batch.Failed, batch.Retried = counts.Sent, counts.Failed, counts.Retried
+	if batch.Sent == 0 && batch.Failed == 0 {
+		return checkpointed, batch, nil
+	}
+
+	// The batch is checkpointed already; a failed update only leaves its sends uncounted
+	counted, err := queries.RecordBroadcastSends(ctx, sqlc.RecordBroadcastSendsParams{
+		Sent:        int32(batch.Sent),
+		Failed:      int32(batch.Failed),
+		BroadcastID: broadcast.BroadcastID,
+	})
+	if err != nil {
+		logger.Error(ctx, err, "Failed to count broadcast sends: broadcast_id=%s", broadcast.BroadcastID)
+		return checkpointed, batch, nil
+	}
+	return counted, batch, nil
+}
+
+// groupBroadcastDevices groups devices by user, in the order of each user's first device
+func groupBroadcastDevices(rows []sqlc.ListBroadcastDevicesRow) []userDevices {
+	var users []userDevices
+	index := make(map[string]int)
+	for _, row := range rows {
+		i, ok := index[row.UserID]
+		if !ok {
+			i = len(users)
+			index[row.UserID] = i
+			users = append(users, userDevices{userID: row.UserID})
+		}
+		users[i].devices = append(users[i].devices, sqlc.ListActiveDevicesByPlatformsRow{
+			UserID:    row.UserID,
+			DeviceID:  row.DeviceID,
+			Platform:  row.Platform,
+			AppID:     row.AppID,
+			FcmToken:  row.FcmToken,
+			TokenType: row.TokenType,
+			Locale:    row.Locale,
+			IsActive:  row.IsActive,
+			UpdatedAt: row.UpdatedAt,
+		})
+	}
+	return users
+}
+
+// broadcastLeaseExpiry is the expiry of a lease taken or renewed now
+func (s *Service) broadcastLeaseExpiry() pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: s.Clock.Now().Add(broadcastLease), Valid: true}
+}
+
+// broadcastStopAt is when an invocation stops sending: maxRun from now, or the context deadline
+// if that is earlier. It is wall-clock time, like the Lambda deadline.
+func broadcastStopAt(ctx context.Context, maxRun time.Duration) time.Time {
+	stopAt := time.Now().Add(maxRun)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(stopAt) {
+		stopAt = deadline
+	}
+	return stopAt
+}
+
+func newBroadcastID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "bc-" + hex.EncodeToString(b), nil
+}
+
+func newBroadcastResponse(broadcast sqlc.Broadcast) BroadcastResponse {
+	response := BroadcastResponse{
+		BroadcastID:     broadcast.BroadcastID,
+		Status:          broadcast.Status,
+		FailureReason:   broadcast.FailureReason.String,
+		BatchSize:       int(broadcast.BatchSize),
+		TotalDevices:    int(broadcast.TotalDevices),
+		SentCount:       int(broadcast.SentCount),
+		FailedCount:     int(broadcast.FailedCount),
+		SuppressedCount: int(broadcast.SuppressedCount),
+		CreatedAt:       broadcast.CreatedAt.Time,
+		UpdatedAt:       broadcast.UpdatedAt.Time,
+	}
+	// Stored by CreateBroadcastHandler, so it always decodes
+	_ = json.Unmarshal(broadcast.Message, &response.Message)
+	if broadcast.CompletedAt.Valid {
+		completedAt := broadcast.CompletedAt.Time
+		response.CompletedAt = &completedAt
+	}
+	return response
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// createBroadcast invokes CreateBroadcastHandler with ctx and decodes the broadcast. A ctx with a
+// deadline less than broadcastBatchMargin away sends a single batch.
+func createBroadcast(t *testing.T, ctx context.Context, service *Service, body string) BroadcastResponse {
+	t.Helper()
+	response, err := service.CreateBroadcastHandler(ctx, events.APIGatewayProxyRequest{Body: body})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	expectStatus(t, response, 200)
+	var broadcast BroadcastResponse
+	decodeBody(t, response, &broadcast)
+	return broadcast
+}
+
+// getBroadcast invokes GetBroadcastHandler and decodes the broadcast.
+func getBroadcast(t *testing.T, service *Service, broadcastID string) BroadcastResponse {
+	t.Helper()
+	response, err := service.GetBroadcastHandler(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"broadcast_id": broadcastID},
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	expectStatus(t, response, 200)
+	var broadcast BroadcastResponse
+	decodeBody(t, response, &broadcast)
+	return broadcast
+}
+
+// oneBatchContext returns a context whose deadline leaves time for a single batch.
+func oneBatchContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// sentTokens returns the tokens messages were sent to, sorted since batches are sent concurrently.
+func sentTokens(sender *fakeSender) []string {
+	var tokens []string
+	for _, message := range sender.Sent() {
+		tokens = append(tokens, message.Token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+var allSegmentTokens = []string{"token-1", "token-2", "token-3", "token-4", "token-5"}
+
+func TestCreateBroadcastSendsAllDevices(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+
+	// user-1 keeps marketing on device-2 only
+	expectStatus(t, invokePreferences(t, service.PutPreferencesHandler, "user-1",
+		`{"categories":{"marketing":false},"devices":{"device-2":{"marketing":true}}}`), 200)
+
+	broadcast := createBroadcast(t, context.Background(), service, `{"category":"marketing","title":"Sale","body":"Today only","batch_size":2}`)
+	if broadcast.Status != "COMPLETED" || broadcast.TotalDevices != 5 || broadcast.SentCount != 4 ||
+		broadcast.SuppressedCount != 1 || broadcast.FailedCount != 0 || broadcast.BatchSize != 2 || broadcast.CompletedAt == nil {
+		t.Fatalf("unexpected broadcast: %+v", broadcast)
+	}
+	if broadcast.Message.Title != "Sale" || broadcast.Message.Category != "marketing" {
+		t.Fatalf("unexpected message: %+v", broadcast.Message)
+	}
+	if got := getBroadcast(t, service, broadcast.BroadcastID); !reflect.DeepEqual(got, broadcast) {
+		t.Fatalf("expected %+v, got %+v", broadcast, got)
+	}
+
+	if tokens := sentTokens(fakes.sender); !reflect.DeepEqual(tokens, []string{"token-2", "token-3", "token-4", "token-5"}) {
+		t.Fatalf("unexpected messages: %v", tokens)
+	}
+	for _, message := range fakes.sender.Sent() {
+		if message.Data[messageIDDataKey] == "" || message.Data[receiptTokenDataKey] == "" {
+			t.Errorf("message without id or receipt token: %+v", message)
+		}
+	}
+	// user-1's devices were in different batches
+	if len(fakes.querier.messages) != 4 {
+		t.Fatalf("expected one message per user and batch, got %+v", fakes.querier.messages)
+	}
+
+	response := invoke(t, service.ListBroadcastsHandler, "", nil)
+	expectStatus(t, response, 200)
+	var list ListBroadcastsResponse
+	decodeBody(t, response, &list)
+	if len(list.Broadcasts) != 1 || list.Broadcasts[0].BroadcastID != broadcast.BroadcastID {
+		t.Fatalf("unexpected broadcasts: %+v", list)
+	}
+}
+
+func TestBroadcastHandlerResumesFromCheckpoint(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+
+	broadcast := createBroadcast(t, oneBatchContext(t), service, `{"category":"system","title":"Outage","body":"We are on it","batch_size":2}`)
+	if broadcast.Status != "RUNNING" || broadcast.SentCount != 2 || broadcast.CompletedAt != nil {
+		t.Fatalf("expected a running broadcast after one batch, got %+v", broadcast)
+	}
+	if lease := fakes.querier.broadcasts[broadcast.BroadcastID].LeaseExpiresAt; lease.Valid {
+		t.Fatalf("expected the lease to be released, got %v", lease.Time)
+	}
+
+	result, err := service.BroadcastHandler(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Broadcasts != 1 || result.Batches != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if got := getBroadcast(t, service, broadcast.BroadcastID); got.Status != "COMPLETED" || got.SentCount != 5 {
+		t.Fatalf("unexpected broadcast: %+v", got)
+	}
+	if tokens := sentTokens(fakes.sender); !reflect.DeepEqual(tokens, allSegmentTokens) {
+		t.Fatalf("expected one message per device, got %v", tokens)
+	}
+
+	// Nothing is left to resume
+	result, err = service.BroadcastHandler(context.Background())
+	if err != nil || result.Broadcasts != 0 {
+		t.Fatalf("expected no broadcasts, got %+v, %v", result, err)
+	}
+}
+
+func TestBroadcastHandlerWaitsForExpiredLease(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+
+	broadcast := createBroadcast(t, oneBatchContext(t), service, `{"category":"system","title":"Outage","body":"We are on it","batch_size":3}`)
+
+	// An invocation that timed out without releasing its lease
+	_, err := fakes.querier.ClaimBroadcast(context.Background(), sqlc.ClaimBroadcastParams{
+		LeaseExpiresAt: pgtype.Timestamptz{Time: fakes.clock.Now().Add(broadcastLease), Valid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := service.BroadcastHandler(context.Background())
+	if err != nil || result.Broadcasts != 0 {
+		t.Fatalf("expected the broadcast to be held, got %+v, %v", result, err)
+	}
+
+	fakes.clock.Advance(broadcastLease + time.Second)
+	result, err = service.BroadcastHandler(context.Background())
+	if err != nil || result.Broadcasts != 1 || result.Batches != 1 {
+		t.Fatalf("expected the broadcast to be resumed, got %+v, %v", result, err)
+	}
+	if got := getBroadcast(t, service, broadcast.BroadcastID); got.Status != "COMPLETED" || got.SentCount != 5 {
+		t.Fatalf("unexpected broadcast: %+v", got)
+	}
+}
+
+func TestBroadcastRecordsFailures(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	fakes.sender.FailToken("token-3", fmt.Errorf("%w: status=404", errPushTokenUnregistered))
+
+	broadcast := createBroadcast(t, context.Background(), service, `{"category":"system","title":"Hi","body":"There"}`)
+	if broadcast.Status != "COMPLETED" || broadcast.SentCount != 4 || broadcast.FailedCount != 1 {
+		t.Fatalf("unexpected broadcast: %+v", broadcast)
+	}
+	for key, delivery := range fakes.querier.messageDeliveries {
+		if failed := key.DeviceID == "device-3"; failed != (delivery.Status == "SEND_FAILED") {
+			t.Errorf("unexpected delivery of %s: %+v", key.DeviceID, delivery)
+		}
+	}
+	if device, err := fakes.querier.GetDeviceByDeviceID(t.Context(), "device-3"); err != nil || device.IsActive {
+		t.Fatalf("expected device-3 to be deactivated, got %+v, %v", device, err)
+	}
+}
+
+func TestBroadcastLeavesTransientFailuresToTheRelay(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	fakes.sender.FailToken("token-3", errors.New("FCM API returned error: status=503"))
+
+	broadcast := createBroadcast(t, context.Background(), service, `{"category":"system","title":"Hi","body":"There"}`)
+	if broadcast.Status != "COMPLETED" || broadcast.SentCount != 4 || broadcast.FailedCount != 0 {
+		t.Fatalf("unexpected broadcast: %+v", broadcast)
+	}
+	if len(fakes.querier.outbox) != 1 {
+		t.Fatalf("expected the send to device-3 to be kept, got %+v", fakes.querier.outbox)
+	}
+
+	fakes.sender.FailToken("token-3", nil)
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{Published: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	for key, delivery := range fakes.querier.messageDeliveries {
+		if delivery.Status != deliveryStatusSent {
+			t.Errorf("unexpected delivery of %s: %+v", key.DeviceID, delivery)
+		}
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 5 {
+		t.Fatalf("expected every device to be sent to once, got %d messages", len(sent))
+	}
+}
+
+func TestBroadcastFailsWithoutItsTemplate(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putTemplate(t, service, "outage", "en", `{"title":"Outage","body":"{{.service}} is down"}`)
+
+	broadcast := createBroadcast(t, oneBatchContext(t), service, `{"category":"system","template_key":"outage","variables":{"service":"Sync"},"batch_size":2}`)
+	if broadcast.Status != "RUNNING" || broadcast.SentCount != 2 {
+		t.Fatalf("unexpected broadcast: %+v", broadcast)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 2 || sent[0].Body != "Sync is down" {
+		t.Fatalf("unexpected messages: %+v", sent)
+	}
+
+	if _, err := fakes.querier.DeleteTemplate(context.Background(), sqlc.DeleteTemplateParams{TemplateKey: "outage", Locale: "en"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.BroadcastHandler(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := getBroadcast(t, service, broadcast.BroadcastID)
+	if got.Status != "FAILED" || got.FailureReason == "" || got.SentCount != 2 || got.CompletedAt == nil {
+		t.Fatalf("unexpected broadcast: %+v", got)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 2 {
+		t.Fatalf("expected no more messages, got %+v", sent)
+	}
+}
+
+func TestCreateBroadcastBadRequest(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+
+	for name, body := range map[string]string{
+		"invalid body":     `{"category":`,
+		"missing category": `{"title":"Hi","body":"There"}`,
+		"unknown category": `{"category":"newsletter","title":"Hi","body":"There"}`,
+		"unknown template": `{"category":"system","template_key":"missing"}`,
+		"e2e test message": `{"category":"system","title":"Hi","body":"There","data":{"type":"e2e_test","nonce":"nonce-1"}}`,
+		"batch_size -1":    `{"category":"system","title":"Hi","body":"There","batch_size":-1}`,
+		"batch_size 1001":  `{"category":"system","title":"Hi","body":"There","batch_size":1001}`,
+	} {
+		if response := invoke(t, service.CreateBroadcastHandler, body, nil); response.StatusCode != 400 {
+			t.Errorf("%s: expected 400, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+	if len(fakes.querier.broadcasts) != 0 || len(fakes.sender.Sent()) != 0 {
+		t.Fatalf("invalid broadcasts were created: %+v", fakes.querier.broadcasts)
+	}
+
+	expectStatus(t, invoke(t, service.ListBroadcastsHandler, "", map[string]string{"limit": "0"}), 400)
+	response, err := service.GetBroadcastHandler(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"broadcast_id": "bc-missing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, response, 404)
+}
+
+func TestBroadcastHandlers(t *testing.T) {
+	requireDB(t)
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+	registerDevice(t, "user-1", "device-2", "token-2", "ios")
+	registerDevice(t, "user-2", "device-3", "token-3", "android")
+
+	broadcast := createBroadcast(t, oneBatchContext(t), testService, `{"category":"system","title":"Hi","body":"There","batch_size":2}`)
+	if broadcast.Status != "RUNNING" || broadcast.TotalDevices != 3 || broadcast.SentCount != 2 {
+		t.Fatalf("unexpected broadcast: %+v", broadcast)
+	}
+
+	result, err := testService.BroadcastHandler(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Broadcasts != 1 || result.Batches != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if got := getBroadcast(t, testService, broadcast.BroadcastID); got.Status != "COMPLETED" || got.SentCount != 3 {
+		t.Fatalf("unexpected broadcast: %+v", got)
+	}
+	if messages := testFCM.Messages(); len(messages) != 3 {
+		t.Fatalf("expected 3 FCM messages, got %+v", messages)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+)
+
+// Campaigns A/B test push copy: a campaign has variants with a title, body and data, weights and a
+// holdout percentage. POST /messages/send with campaign_id assigns the user to a variant or to the
+// holdout group by hashing user_id with the campaign id (see assignCampaignVariant), sends the
+// variant's copy and records the variant on every delivery, so receipts can be compared per variant.
+// The holdout group gets no message; its users are recorded in campaign_assignments for comparison.
+
+// Limits of campaigns
+const (
+	maxCampaignVariants = 10
+	maxCampaignWeight   = 10000
+	maxHoldoutPercent   = 99
+)
+
+// FCM data keys carrying the campaign and variant of a message, e.g. for attributing conversions in the app
+const (
+	campaignIDDataKey = "campaign_id"
+	variantDataKey    = "variant"
+)
+
+var (
+	campaignIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+	variantPattern    = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+)
+
+// CampaignVariant is one copy of a campaign
+type CampaignVariant struct {
+	Variant string            `json:"variant"` // e.g. "a"
+	Weight  int               `json:"weight"`  // Share of the users outside the holdout group, relative to the other variants
+	Title   string            `json:"title"`
+	Body    string            `json:"body"`
+	Data    map[string]string `json:"data"` // Optional, sent as FCM data unless the request's data overrides it
+}
+
+type PutCampaignRequest struct {
+	Description    string            `json:"description"`
+	Category       string            `json:"category"`        // Notification category of every message of the campaign
+	HoldoutPercent int               `json:"holdout_percent"` // Users that get no message, 0-99
+	Variants       []CampaignVariant `json:"variants"`
+}
+
+type CampaignResponse struct {
+	CampaignID     string            `json:"campaign_id"`
+	Description    string            `json:"description"`
+	Category       string            `json:"category"`
+	HoldoutPercent int               `json:"holdout_percent"`
+	Variants       []CampaignVariant `json:"variants"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+type ListCampaignsResponse struct {
+	Campaigns []CampaignResponse `json:"campaigns"`
+}
+
+type DeleteCampaignResponse struct {
+	OK bool `json:"ok"`
+}
+
+// CampaignVariantStats are the users and deliveries of a variant. Counts of deliveries are per
+// device; OpenRate is the share of the variant's users who opened the message on any device.
+type CampaignVariantStats struct {
+	Variant     string  `json:"variant"`
+	Weight      int     `json:"weight"` // 0 for variants no longer in the campaign
+	Users       int64   `json:"users"`
+	Deliveries  int64   `json:"deliveries"`
+	Sent        int64   `json:"sent"`
+	Failed      int64   `json:"failed"`
+	Delivered   int64   `json:"delivered"`
+	Opened      int64   `json:"opened"`
+	OpenedUsers int64   `json:"opened_users"`
+	OpenRate    float64 `json:"open_rate"`
+}
+
+type CampaignStatsResponse struct {
+	CampaignID   string                 `json:"campaign_id"`
+	HoldoutUsers int64                  `json:"holdout_users"`
+	Variants     []CampaignVariantStats `json:"variants"`
+}
+
+// ListCampaignsHandler is the Lambda handler for GET /campaigns
+func (s *Service) ListCampaignsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list campaigns request")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	campaigns, err := queries.ListCampaigns(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+	variants, err := queries.ListCampaignVariants(ctx, optionalText(""))
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+	variantsByCampaign := make(map[string][]sqlc.CampaignVariant)
+	for _, variant := range variants {
+		variantsByCampaign[variant.CampaignID] = append(variantsByCampaign[variant.CampaignID], variant)
+	}
+
+	response := ListCampaignsResponse{Campaigns: make([]CampaignResponse, 0, len(campaigns))}
+	for _, campaign := range campaigns {
+		campaignResponse, err := newCampaignResponse(campaign, variantsByCampaign[campaign.CampaignID])
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Invalid campaign variant data")
+		}
+		response.Campaigns = append(response.Campaigns, campaignResponse)
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// GetCampaignHandler is the Lambda handler for GET /campaigns/{campaign_id}
+func (s *Service) GetCampaignHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received get campaign request")
+
+	campaignID, err := campaignPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid campaign_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	campaign, variants, err := loadCampaign(ctx, queries, campaignID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err := fmt.Errorf("campaign not found: %s", campaignID)
+		return logger.NotFound(ctx, err, "Campaign not found")
+	}
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	response, err := newCampaignResponse(campaign, variants)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Invalid campaign variant data")
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// PutCampaignHandler is the Lambda handler for PUT /campaigns/{campaign_id}.
+// It creates the campaign or replaces it with all of its variants. Users keep their variant as long
+// as the variants, their weights and the holdout percentage are unchanged.
+func (s *Service) PutCampaignHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received put campaign request")
+
+	campaignID, err := campaignPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid campaign_id")
+	}
+
+	var putRequest PutCampaignRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &putRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+	if err := putRequest.validate(); err != nil {
+		return logger.BadRequest(ctx, err, "Invalid campaign")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	if _, err := queries.GetNotificationCategory(ctx, putRequest.Category); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err := fmt.Errorf("unknown category: %s", putRequest.Category)
+			return logger.BadRequest(ctx, err, "Unknown category")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	variants := make([]sqlc.CampaignVariant, 0, len(putRequest.Variants))
+	for _, variant := range putRequest.Variants {
+		if variant.Data == nil {
+			variant.Data = map[string]string{}
+		}
+		data, err := json.Marshal(variant.Data)
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Failed to encode variant data")
+		}
+		variants = append(variants, sqlc.CampaignVariant{
+			CampaignID: campaignID,
+			Variant:    variant.Variant,
+			Weight:     int32(variant.Weight),
+			Title:      variant.Title,
+			Body:       variant.Body,
+			Data:       data,
+		})
+	}
+
+	var campaign sqlc.Campaign
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		var err error
+		campaign, err = queries.UpsertCampaign(ctx, sqlc.UpsertCampaignParams{
+			CampaignID:     campaignID,
+			Description:    putRequest.Description,
+			Category:       putRequest.Category,
+			HoldoutPercent: int32(putRequest.HoldoutPercent),
+		})
+		if err != nil {
+			return err
+		}
+		if err := queries.DeleteCampaignVariants(ctx, campaignID); err != nil {
+			return err
+		}
+		for _, variant := range variants {
+			err := queries.CreateCampaignVariant(ctx, sqlc.CreateCampaignVariantParams{
+				CampaignID: variant.CampaignID,
+				Variant:    variant.Variant,
+				Weight:     variant.Weight,
+				Title:      variant.Title,
+				Body:       variant.Body,
+				Data:       variant.Data,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create variant %s: %w", variant.Variant, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+
+	logger.Info(ctx, "Campaign saved: campaign_id=%s, variants=%d, holdout_percent=%d", campaignID, len(variants), putRequest.HoldoutPercent)
+
+	response, err := newCampaignResponse(campaign, variants)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Invalid campaign variant data")
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// DeleteCampaignHandler is the Lambda handler for DELETE /campaigns/{campaign_id}.
+// Deliveries of the campaign keep their campaign_id and variant.
+func (s *Service) DeleteCampaignHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received delete campaign request")
+
+	campaignID, err := campaignPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid campaign_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	deleted, err := queries.DeleteCampaign(ctx, campaignID)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+	if deleted == 0 {
+		err := fmt.Errorf("campaign not found: %s", campaignID)
+		return logger.NotFound(ctx, err, "Campaign not found")
+	}
+
+	logger.Info(ctx, "Campaign deleted: campaign_id=%s", campaignID)
+
+	return logger.Success(ctx, DeleteCampaignResponse{OK: true})
+}
+
+// CampaignStatsHandler is the Lambda handler for GET /campaigns/{campaign_id}/stats, comparing the
+// users, deliveries and receipts of each variant and the size of the holdout group
+func (s *Service) CampaignStatsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received campaign stats request")
+
+	campaignID, err := campaignPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid campaign_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	_, variants, err := loadCampaign(ctx, queries, campaignID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err := fmt.Errorf("campaign not found: %s", campaignID)
+		return logger.NotFound(ctx, err, "Campaign not found")
+	}
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+	assignments, err := queries.CountCampaignAssignments(ctx, campaignID)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+	deliveries, err := queries.GetCampaignDeliveryStats(ctx, campaignID)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	// Current variants first, then variants replaced since their messages were sent
+	response := CampaignStatsResponse{CampaignID: campaignID, Variants: []CampaignVariantStats{}}
+	index := make(map[string]int)
+	stats := func(variant string) *CampaignVariantStats {
+		i, ok := index[variant]
+		if !ok {
+			i = len(response.Variants)
+			index[variant] = i
+			response.Variants = append(response.Variants, CampaignVariantStats{Variant: variant})
+		}
+		return &response.Variants[i]
+	}
+	for _, variant := range variants {
+		stats(variant.Variant).Weight = int(variant.Weight)
+	}
+	for _, row := range assignments {
+		if !row.Variant.Valid {
+			response.HoldoutUsers = row.Users
+			continue
+		}
+		stats(row.Variant.String).Users = row.Users
+	}
+	for _, row := range deliveries {
+		variant := stats(row.Variant.String)
+		variant.Deliveries = row.Deliveries
+		variant.Sent = row.Sent
+		variant.Failed = row.Failed
+		variant.Delivered = row.Delivered
+		variant.Opened = row.Opened
+		variant.OpenedUsers = row.OpenedUsers
+	}
+	for i := range response.Variants {
+		if variant := &response.Variants[i]; variant.Users > 0 {
+			variant.OpenRate = float64(variant.OpenedUsers) / float64(variant.Users)
+		}
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// validate checks a campaign before anything is stored; the category is checked by the caller
+func (r PutCampaignRequest) validate() error {
+	if r.Category == "" {
+		return fmt.Errorf("missing required field: category")
+	}
+	if r.HoldoutPercent < 0 || r.HoldoutPercent > maxHoldoutPercent {
+		return fmt.Errorf("holdout_percent must be 0-%d", maxHoldoutPercent)
+	}
+	if len(r.Variants) == 0 || len(r.Variants) > maxCampaignVariants {
+		return fmt.Errorf("a campaign needs 1-%d variants", maxCampaignVariants)
+	}
+	seen := make(map[string]bool, len(r.Variants))
+	for _, variant := range r.Variants {
+		if !variantPattern.MatchString(variant.Variant) {
+			return fmt.Errorf("invalid variant %q: lowercase letters, digits, '_', '.' and '-', up to 32 characters", variant.Variant)
+		}
+		if seen[variant.Variant] {
+			return fmt.Errorf("duplicate variant %q", variant.Variant)
+		}
+		seen[variant.Variant] = true
+		if variant.Weight < 1 || variant.Weight > maxCampaignWeight {
+			return fmt.Errorf("weight of variant %s must be 1-%d", variant.Variant, maxCampaignWeight)
+		}
+		if variant.Title == "" || variant.Body == "" {
+			return fmt.Errorf("missing title or body of variant %s", variant.Variant)
+		}
+	}
+	return nil
+}
+
+// loadCampaign returns a campaign with its variants, or pgx.ErrNoRows for unknown campaigns
+func loadCampaign(ctx context.Context, queries sqlc.Querier, campaignID string) (sqlc.Campaign, []sqlc.CampaignVariant, error) {
+	campaign, err := queries.GetCampaign(ctx, campaignID)
+	if err != nil {
+		return sqlc.Campaign{}, nil, err
+	}
+	variants, err := queries.ListCampaignVariants(ctx, optionalText(campaignID))
+	if err != nil {
+		return sqlc.Campaign{}, nil, err
+	}
+	return campaign, variants, nil
+}
+
+// assignCampaignVariant assigns a user to a variant of a campaign, or to its holdout group if
+// holdout is true. SHA-256 of the campaign id and user_id is split in two: the first 8 bytes pick
+// the holdout group and the next 8 a variant by weight, so the holdout group takes users from all
+// variants alike. Variants are in variant order, as ListCampaignVariants returns them.
+func assignCampaignVariant(campaign sqlc.Campaign, variants []sqlc.CampaignVariant, userID string) (variant sqlc.CampaignVariant, holdout bool) {
+	sum := sha256.Sum256([]byte(campaign.CampaignID + "\x00" + userID))
+	if binary.BigEndian.Uint64(sum[0:8])%100 < uint64(campaign.HoldoutPercent) {
+		return sqlc.CampaignVariant{}, true
+	}
+
+	var totalWeight uint64
+	for _, variant := range variants {
+		totalWeight += uint64(variant.Weight)
+	}
+	point := binary.BigEndian.Uint64(sum[8:16]) % totalWeight
+	for _, variant := range variants {
+		if point < uint64(variant.Weight) {
+			return variant, false
+		}
+		point -= uint64(variant.Weight)
+	}
+	return variants[len(variants)-1], false // Unreachable: point < totalWeight
+}
+
+// campaignSend is a campaign message to one user of POST /messages/send
+type campaignSend struct {
+	campaign sqlc.Campaign
+	variant  sqlc.CampaignVariant // Unset for the holdout group
+	holdout  bool
+	content  messageContent // Copy of the variant
+}
+
+// prepareCampaignSend loads a campaign and assigns the user to one of its variants or to its
+// holdout group. It returns pgx.ErrNoRows for unknown campaigns.
+func prepareCampaignSend(ctx context.Context, queries sqlc.Querier, campaignID, userID string) (campaignSend, error) {
+	campaign, variants, err := loadCampaign(ctx, queries, campaignID)
+	if err != nil {
+		return campaignSend{}, err
+	}
+	if len(variants) == 0 {
+		return campaignSend{}, fmt.Errorf("campaign %s has no variants", campaignID)
+	}
+	send := campaignSend{campaign: campaign}
+	send.variant, send.holdout = assignCampaignVariant(campaign, variants, userID)
+	if send.holdout {
+		return send, nil
+	}
+	data, err := campaignVariantData(send.variant)
+	if err != nil {
+		return campaignSend{}, err
+	}
+	send.content = messageContent{Title: send.variant.Title, Body: send.variant.Body, DefaultData: data}
+	return send, nil
+}
+
+// assignment is the campaign_assignments row of the user
+func (c campaignSend) assignment(userID string) sqlc.UpsertCampaignAssignmentParams {
+	return sqlc.UpsertCampaignAssignmentParams{
+		CampaignID: c.campaign.CampaignID,
+		UserID:     userID,
+		Variant:    optionalText(c.variant.Variant),
+	}
+}
+
+// messageCampaign returns the campaign and variant of the user's message
+func (c campaignSend) messageCampaign() messageCampaign {
+	return messageCampaign{CampaignID: c.campaign.CampaignID, Variant: c.variant.Variant}
+}
+
+// messageCampaign is the campaign variant a message is sent with, recorded on its deliveries.
+// The zero value is a message outside of campaigns.
+type messageCampaign struct {
+	CampaignID string
+	Variant    string
+}
+
+// campaignVariantData decodes campaign_variants.data, which PutCampaignHandler stores as an object of strings
+func campaignVariantData(variant sqlc.CampaignVariant) (map[string]string, error) {
+	var data map[string]string
+	if len(variant.Data) == 0 {
+		return data, nil
+	}
+	if err := json.Unmarshal(variant.Data, &data); err != nil {
+		return nil, fmt.Errorf("invalid data of variant %s/%s: %w", variant.CampaignID, variant.Variant, err)
+	}
+	return data, nil
+}
+
+func campaignPathParameter(request events.APIGatewayProxyRequest) (string, error) {
+	campaignID := request.PathParameters["campaign_id"]
+	if !campaignIDPattern.MatchString(campaignID) {
+		return "", fmt.Errorf("invalid campaign_id %q: lowercase letters, digits, '_', '.' and '-', up to 64 characters", campaignID)
+	}
+	return campaignID, nil
+}
+
+func newCampaignResponse(campaign sqlc.Campaign, variants []sqlc.CampaignVariant) (CampaignResponse, error) {
+	response := CampaignResponse{
+		CampaignID:     campaign.CampaignID,
+		Description:    campaign.Description,
+		Category:       campaign.Category,
+		HoldoutPercent: int(campaign.HoldoutPercent),
+		Variants:       make([]CampaignVariant, 0, len(variants)),
+		CreatedAt:      campaign.CreatedAt.Time,
+		UpdatedAt:      campaign.UpdatedAt.Time,
+	}
+	for _, variant := range variants {
+		data, err := campaignVariantData(variant)
+		if err != nil {
+			return CampaignResponse{}, err
+		}
+		if data == nil {
+			data = map[string]string{}
+		}
+		response.Variants = append(response.Variants, CampaignVariant{
+			Variant: variant.Variant,
+			Weight:  int(variant.Weight),
+			Title:   variant.Title,
+			Body:    variant.Body,
+			Data:    data,
+		})
+	}
+	return response, nil
+}
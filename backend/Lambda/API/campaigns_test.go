@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+)
+
+const abCampaign = `{"description":"welcome copy","category":"marketing","holdout_percent":0,"variants":[` +
+	`{"variant":"a","weight":1,"title":"Welcome","body":"Glad you are here","data":{"screen":"home"}},` +
+	`{"variant":"b","weight":1,"title":"Hi there","body":"Take a look around"}]}`
+
+// invokeCampaign invokes a /campaigns/{campaign_id} handler.
+func invokeCampaign(t *testing.T, handler apiHandler, campaignID, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Body:           body,
+		PathParameters: map[string]string{"campaign_id": campaignID},
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return response
+}
+
+// putCampaign creates or replaces a campaign through PutCampaignHandler.
+func putCampaign(t *testing.T, service *Service, campaignID, body string) CampaignResponse {
+	t.Helper()
+	response := invokeCampaign(t, service.PutCampaignHandler, campaignID, body)
+	expectStatus(t, response, 200)
+	var campaign CampaignResponse
+	decodeBody(t, response, &campaign)
+	return campaign
+}
+
+// campaignStats invokes CampaignStatsHandler and decodes the stats.
+func campaignStats(t *testing.T, service *Service, campaignID string) CampaignStatsResponse {
+	t.Helper()
+	response := invokeCampaign(t, service.CampaignStatsHandler, campaignID, "")
+	expectStatus(t, response, 200)
+	var stats CampaignStatsResponse
+	decodeBody(t, response, &stats)
+	return stats
+}
+
+// sendCampaign sends a campaign message to a user through SendMessageHandler.
+func sendCampaign(t *testing.T, service *Service, campaignID, userID string) SendMessageResponse {
+	t.Helper()
+	response := invoke(t, service.SendMessageHandler, `{"user_id":"`+userID+`","campaign_id":"`+campaignID+`"}`, nil)
+	expectStatus(t, response, 200)
+	var sendResponse SendMessageResponse
+	decodeBody(t, response, &sendResponse)
+	return sendResponse
+}
+
+// testCampaign is a campaign for assignCampaignVariant with variants of the given weights, named a, b, ...
+func testCampaign(holdoutPercent int32, weights ...int32) (sqlc.Campaign, []sqlc.CampaignVariant) {
+	campaign := sqlc.Campaign{CampaignID: "welcome", HoldoutPercent: holdoutPercent}
+	var variants []sqlc.CampaignVariant
+	for i, weight := range weights {
+		variants = append(variants, sqlc.CampaignVariant{CampaignID: "welcome", Variant: string(rune('a' + i)), Weight: weight})
+	}
+	return campaign, variants
+}
+
+func TestCampaignCRUD(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	expectStatus(t, invokeCampaign(t, service.GetCampaignHandler, "welcome", ""), 404)
+	created := putCampaign(t, service, "welcome", abCampaign)
+	if created.Category != "marketing" || len(created.Variants) != 2 || created.Variants[0].Data["screen"] != "home" ||
+		created.Variants[1].Data == nil {
+		t.Fatalf("unexpected campaign: %+v", created)
+	}
+
+	// Replacing a campaign replaces its variants and keeps its creation time
+	fakes.clock.Advance(time.Minute)
+	putCampaign(t, service, "welcome", `{"category":"transactional","holdout_percent":10,"variants":[{"variant":"c","weight":3,"title":"T","body":"B"}]}`)
+	putCampaign(t, service, "other", abCampaign)
+
+	response := invokeCampaign(t, service.GetCampaignHandler, "welcome", "")
+	expectStatus(t, response, 200)
+	var got CampaignResponse
+	decodeBody(t, response, &got)
+	if got.Category != "transactional" || got.HoldoutPercent != 10 || len(got.Variants) != 1 || got.Variants[0].Variant != "c" ||
+		got.Variants[0].Weight != 3 || !got.CreatedAt.Equal(created.CreatedAt) || !got.UpdatedAt.After(got.CreatedAt) {
+		t.Fatalf("unexpected campaign: %+v", got)
+	}
+
+	response = invoke(t, service.ListCampaignsHandler, "", nil)
+	expectStatus(t, response, 200)
+	var list ListCampaignsResponse
+	decodeBody(t, response, &list)
+	if len(list.Campaigns) != 2 || list.Campaigns[0].CampaignID != "other" || len(list.Campaigns[0].Variants) != 2 ||
+		list.Campaigns[1].CampaignID != "welcome" || len(list.Campaigns[1].Variants) != 1 {
+		t.Fatalf("unexpected campaigns: %+v", list)
+	}
+
+	expectStatus(t, invokeCampaign(t, service.DeleteCampaignHandler, "welcome", ""), 200)
+	expectStatus(t, invokeCampaign(t, service.DeleteCampaignHandler, "welcome", ""), 404)
+	expectStatus(t, invokeCampaign(t, service.CampaignStatsHandler, "welcome", ""), 404)
+}
+
+func TestPutCampaignRejectsInvalidCampaigns(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	variant := `{"variant":"a","weight":1,"title":"T","body":"B"}`
+	for name, body := range map[string]string{
+		"invalid body":      `{`,
+		"missing category":  `{"variants":[` + variant + `]}`,
+		"unknown category":  `{"category":"unknown","variants":[` + variant + `]}`,
+		"no variants":       `{"category":"marketing","variants":[]}`,
+		"negative holdout":  `{"category":"marketing","holdout_percent":-1,"variants":[` + variant + `]}`,
+		"everyone held out": `{"category":"marketing","holdout_percent":100,"variants":[` + variant + `]}`,
+		"invalid variant":   `{"category":"marketing","variants":[{"variant":"A b","weight":1,"title":"T","body":"B"}]}`,
+		"duplicate variant": `{"category":"marketing","variants":[` + variant + `,` + variant + `]}`,
+		"zero weight":       `{"category":"marketing","variants":[{"variant":"a","weight":0,"title":"T","body":"B"}]}`,
+		"weight too large":  `{"category":"marketing","variants":[{"variant":"a","weight":10001,"title":"T","body":"B"}]}`,
+		"missing title":     `{"category":"marketing","variants":[{"variant":"a","weight":1,"body":"B"}]}`,
+		"non-string data":   `{"category":"marketing","variants":[{"variant":"a","weight":1,"title":"T","body":"B","data":{"n":1}}]}`,
+		"too many variants": `{"category":"marketing","variants":[` + variantsJSON(maxCampaignVariants+1) + `]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectStatus(t, invokeCampaign(t, service.PutCampaignHandler, "welcome", body), 400)
+		})
+	}
+	putCampaign(t, service, "welcome", `{"category":"marketing","variants":[`+variantsJSON(maxCampaignVariants)+`]}`)
+
+	expectStatus(t, invokeCampaign(t, service.PutCampaignHandler, "Not Valid", abCampaign), 400)
+	expectStatus(t, invokeCampaign(t, service.GetCampaignHandler, "", ""), 400)
+
+	fakes.querier.err = errors.New("connection reset")
+	expectStatus(t, invokeCampaign(t, service.PutCampaignHandler, "welcome", abCampaign), 500)
+}
+
+// variantsJSON returns n valid variants as JSON array elements.
+func variantsJSON(n int) string {
+	var elements string
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			elements += ","
+		}
+		elements += fmt.Sprintf(`{"variant":"v%d","weight":1,"title":"T","body":"B"}`, i)
+	}
+	return elements
+}
+
+func TestAssignCampaignVariant(t *testing.T) {
+	const users = 10000
+	campaign, variants := testCampaign(20, 1, 3)
+
+	counts := make(map[string]int)
+	for i := 0; i < users; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		variant, holdout := assignCampaignVariant(campaign, variants, userID)
+		if again, againHoldout := assignCampaignVariant(campaign, variants, userID); again.Variant != variant.Variant || againHoldout != holdout {
+			t.Fatalf("assignment of %s is not deterministic", userID)
+		}
+		if holdout {
+			counts["holdout"]++
+		} else {
+			counts[variant.Variant]++
+		}
+	}
+	// 20% held out, the rest split 1:3
+	for name, expected := range map[string]float64{"holdout": 0.2 * users, "a": 0.2 * users, "b": 0.6 * users} {
+		if math.Abs(float64(counts[name])-expected) > 0.05*users {
+			t.Errorf("expected about %.0f users in %s, got %d", expected, name, counts[name])
+		}
+	}
+
+	// Users outside the holdout group keep their variant when the holdout percentage changes
+	withoutHoldout, _ := testCampaign(0, 1, 3)
+	for i := 0; i < users; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		variant, holdout := assignCampaignVariant(campaign, variants, userID)
+		if other, _ := assignCampaignVariant(withoutHoldout, variants, userID); !holdout && other.Variant != variant.Variant {
+			t.Fatalf("%s moved from %s to %s", userID, variant.Variant, other.Variant)
+		}
+	}
+
+	// Campaigns assign independently
+	other := campaign
+	other.CampaignID = "other"
+	same := 0
+	for i := 0; i < users; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		a, aHoldout := assignCampaignVariant(campaign, variants, userID)
+		b, bHoldout := assignCampaignVariant(other, variants, userID)
+		if aHoldout == bHoldout && a.Variant == b.Variant {
+			same++
+		}
+	}
+	if same == users {
+		t.Fatal("expected campaigns to assign users differently")
+	}
+}
+
+func TestSendCampaignMessage(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putCampaign(t, service, "welcome", abCampaign)
+
+	campaign, variants, err := loadCampaign(context.Background(), fakes.querier, "welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := assignCampaignVariant(campaign, variants, "user-1")
+
+	sendResponse := sendCampaign(t, service, "welcome", "user-1")
+	if sendResponse.SentCount != 2 || sendResponse.CampaignID != "welcome" || sendResponse.Variant != expected.Variant || sendResponse.Holdout {
+		t.Fatalf("unexpected response: %+v", sendResponse)
+	}
+	message := sentMessageTo(t, fakes, "token-1")
+	if message.Title != expected.Title || message.Body != expected.Body ||
+		message.Data[campaignIDDataKey] != "welcome" || message.Data[variantDataKey] != expected.Variant {
+		t.Fatalf("expected variant %s, got %+v", expected.Variant, message)
+	}
+	if expected.Variant == "a" && message.Data["screen"] != "home" {
+		t.Fatalf("expected the variant's data, got %+v", message.Data)
+	}
+	for _, deviceID := range []string{"device-1", "device-2"} {
+		delivery := fakes.querier.messageDeliveries[fakeMessageDeliveryKey{sendResponse.MessageID, deviceID}]
+		if delivery.CampaignID.String != "welcome" || delivery.Variant.String != expected.Variant {
+			t.Fatalf("expected the variant on the delivery, got %+v", delivery)
+		}
+	}
+
+	// The receipt reports the variant, and the stats count the open
+	response := postReceipt(t, service, sendResponse.MessageID, MessageReceiptRequest{
+		Event:        receiptEventOpened,
+		ReceiptToken: message.Data[receiptTokenDataKey],
+	})
+	expectStatus(t, response, 200)
+	var receipt MessageReceiptResponse
+	decodeBody(t, response, &receipt)
+	if receipt.CampaignID != "welcome" || receipt.Variant != expected.Variant {
+		t.Fatalf("unexpected receipt: %+v", receipt)
+	}
+
+	// A second message keeps the user's variant
+	if again := sendCampaign(t, service, "welcome", "user-1"); again.Variant != expected.Variant {
+		t.Fatalf("expected variant %s again, got %+v", expected.Variant, again)
+	}
+
+	stats := campaignStats(t, service, "welcome")
+	if stats.HoldoutUsers != 0 || len(stats.Variants) != 2 || stats.Variants[0].Variant != "a" || stats.Variants[1].Variant != "b" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	for _, variant := range stats.Variants {
+		want := CampaignVariantStats{Variant: variant.Variant, Weight: 1}
+		if variant.Variant == expected.Variant {
+			want = CampaignVariantStats{Variant: variant.Variant, Weight: 1, Users: 1, Deliveries: 4, Sent: 4, Delivered: 1, Opened: 1, OpenedUsers: 1, OpenRate: 1}
+		}
+		if variant != want {
+			t.Errorf("expected %+v, got %+v", want, variant)
+		}
+	}
+}
+
+func TestSendCampaignMessageHoldout(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putCampaign(t, service, "welcome", `{"category":"marketing","holdout_percent":50,"variants":[{"variant":"a","weight":1,"title":"T","body":"B"}]}`)
+
+	campaign, variants, err := loadCampaign(context.Background(), fakes.querier, "welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	heldOut := map[bool]string{}
+	for _, userID := range []string{"user-1", "user-2", "user-3", "user-4"} {
+		_, holdout := assignCampaignVariant(campaign, variants, userID)
+		heldOut[holdout] = userID
+	}
+	if heldOut[true] == "" || heldOut[false] == "" {
+		t.Fatalf("expected users inside and outside the holdout group, got %v", heldOut)
+	}
+
+	sendResponse := sendCampaign(t, service, "welcome", heldOut[true])
+	if !sendResponse.Holdout || sendResponse.SentCount != 0 || sendResponse.MessageID != "" || sendResponse.Variant != "" {
+		t.Fatalf("unexpected response: %+v", sendResponse)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 0 {
+		t.Fatalf("expected no messages, got %+v", sent)
+	}
+	sendCampaign(t, service, "welcome", heldOut[false])
+
+	stats := campaignStats(t, service, "welcome")
+	if stats.HoldoutUsers != 1 || len(stats.Variants) != 1 || stats.Variants[0].Users != 1 || stats.Variants[0].Deliveries == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSendCampaignMessageBadRequest(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putCampaign(t, service, "welcome", abCampaign)
+
+	for name, body := range map[string]string{
+		"unknown campaign":  `{"user_id":"user-1","campaign_id":"unknown"}`,
+		"with title":        `{"user_id":"user-1","campaign_id":"welcome","title":"T","body":"B"}`,
+		"with template":     `{"user_id":"user-1","campaign_id":"welcome","template_key":"welcome"}`,
+		"other category":    `{"user_id":"user-1","campaign_id":"welcome","category":"system"}`,
+		"e2e test":          `{"user_id":"user-1","campaign_id":"welcome","data":{"type":"e2e_test","nonce":"nonce-1"}}`,
+		"missing user":      `{"campaign_id":"welcome"}`,
+		"missing title too": `{"user_id":"user-1","category":"marketing"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectStatus(t, invoke(t, service.SendMessageHandler, body, nil), 400)
+		})
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 0 {
+		t.Fatalf("expected no messages, got %+v", sent)
+	}
+
+	// The campaign's category may be given
+	expectStatus(t, invoke(t, service.SendMessageHandler, `{"user_id":"user-1","campaign_id":"welcome","category":"marketing"}`, nil), 200)
+}
+
+func TestCampaignHandlers(t *testing.T) {
+	requireDB(t)
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+	registerDevice(t, "user-1", "device-2", "token-2", "ios")
+
+	putCampaign(t, testService, "welcome", abCampaign)
+	sendResponse := sendCampaign(t, testService, "welcome", "user-1")
+	if sendResponse.SentCount != 2 || sendResponse.Variant == "" {
+		t.Fatalf("unexpected response: %+v", sendResponse)
+	}
+	messages := testFCM.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 FCM messages, got %+v", messages)
+	}
+
+	stats := campaignStats(t, testService, "welcome")
+	for _, variant := range stats.Variants {
+		if variant.Variant == sendResponse.Variant && (variant.Users != 1 || variant.Deliveries != 2 || variant.Sent != 2) {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	}
+
+	expectStatus(t, invokeCampaign(t, testService.DeleteCampaignHandler, "welcome", ""), 200)
+	expectStatus(t, invokeCampaign(t, testService.GetCampaignHandler, "welcome", ""), 404)
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/fcm-tutorial/credentials"
+)
+
+// DefaultAppID is the app used when a device registers without an app_id.
+// Its credentials come from SECRET_ARN.
+const DefaultAppID = "default"
+
+// AppRegistry maps app IDs (one per Firebase project) to the secret holding
+// that project's FCM service account JSON, and iOS apps that register APNs device
+// tokens to the secret holding their APNs credentials.
+type AppRegistry struct {
+	secrets     map[string]string
+	apnsSecrets map[string]string
+}
+
+// LoadAppRegistry builds the app registry from environment variables:
+//   - SECRET_ARN: Secret ID of the default app's credentials (optional if FCM_APP_SECRETS defines "default")
+//   - FCM_APP_SECRETS: JSON object mapping app ID to secret ID, e.g. {"shop": "arn:...", "news": "arn:..."}
+//   - APNS_APP_SECRETS: Optional JSON object mapping app ID to the secret ID of its APNs credentials
+//
+// Returns:
+//   - *AppRegistry: Registry with at least one app
+//   - error: Error if FCM_APP_SECRETS or APNS_APP_SECRETS is invalid or no app is configured
+func LoadAppRegistry() (*AppRegistry, error) {
+	secrets := make(map[string]string)
+
+	if appSecrets := os.Getenv("FCM_APP_SECRETS"); appSecrets != "" {
+		if err := json.Unmarshal([]byte(appSecrets), &secrets); err != nil {
+			return nil, fmt.Errorf("failed to parse FCM_APP_SECRETS: %w", err)
+		}
+	}
+
+	if secretARN := os.Getenv("SECRET_ARN"); secretARN != "" {
+		if _, ok := secrets[DefaultAppID]; !ok {
+			secrets[DefaultAppID] = secretARN
+		}
+	}
+
+	for appID, secretID := range secrets {
+		if appID == "" || secretID == "" {
+			return nil, fmt.Errorf("invalid FCM_APP_SECRETS entry: app ID and secret ID must not be empty")
+		}
+	}
+
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no FCM apps configured: set SECRET_ARN or FCM_APP_SECRETS")
+	}
+
+	apnsSecrets := make(map[string]string)
+	if appSecrets := os.Getenv("APNS_APP_SECRETS"); appSecrets != "" {
+		if err := json.Unmarshal([]byte(appSecrets), &apnsSecrets); err != nil {
+			return nil, fmt.Errorf("failed to parse APNS_APP_SECRETS: %w", err)
+		}
+	}
+	for appID, secretID := range apnsSecrets {
+		if appID == "" || secretID == "" {
+			return nil, fmt.Errorf("invalid APNS_APP_SECRETS entry: app ID and secret ID must not be empty")
+		}
+	}
+
+	return NewAppRegistry(secrets).WithAPNs(apnsSecrets), nil
+}
+
+// NewAppRegistry creates a registry from a map of app ID to secret ID.
+func NewAppRegistry(secrets map[string]string) *AppRegistry {
+	return &AppRegistry{secrets: secrets}
+}
+
+// WithAPNs adds the secrets holding the APNs credentials of apps, mapped by app ID, and returns r.
+func (r *AppRegistry) WithAPNs(apnsSecrets map[string]string) *AppRegistry {
+	r.apnsSecrets = apnsSecrets
+	return r
+}
+
+// HasApp reports whether appID is registered.
+func (r *AppRegistry) HasApp(appID string) bool {
+	_, ok := r.secrets[appID]
+	return ok
+}
+
+// HasAPNs reports whether appID has APNs credentials.
+func (r *AppRegistry) HasAPNs(appID string) bool {
+	_, ok := r.apnsSecrets[appID]
+	return ok
+}
+
+// AppIDs returns the registered app IDs in sorted order.
+func (r *AppRegistry) AppIDs() []string {
+	appIDs := make([]string, 0, len(r.secrets))
+	for appID := range r.secrets {
+		appIDs = append(appIDs, appID)
+	}
+	sort.Strings(appIDs)
+	return appIDs
+}
+
+// Credentials returns the FCM credentials of the given app, read through provider.
+func (r *AppRegistry) Credentials(ctx context.Context, provider credentials.SecretProvider, appID string) (*FCMCredentials, error) {
+	secretID, ok := r.secrets[appID]
+	if !ok {
+		return nil, fmt.Errorf("unknown app_id: %s", appID)
+	}
+	return getFCMCredentialsFromSecret(ctx, provider, secretID)
+}
+
+// APNsCredentials returns the APNs credentials of the given app, read through provider.
+func (r *AppRegistry) APNsCredentials(ctx context.Context, provider credentials.SecretProvider, appID string) (*APNsCredentials, error) {
+	secretID, ok := r.apnsSecrets[appID]
+	if !ok {
+		return nil, fmt.Errorf("no APNs credentials for app_id: %s", appID)
+	}
+	return getAPNsCredentialsFromSecret(ctx, provider, secretID)
+}
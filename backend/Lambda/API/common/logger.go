@@ -52,7 +52,7 @@ func (e *ErrorResponse) ToJSON() string {
 // HandleError logs the error and returns a formatted error response
 func (l *Logger) HandleError(ctx context.Context, err error, message string) *ErrorResponse {
 	// Log the error
-	l.Error(ctx, err, message)
+	l.Error(ctx, err, "%s", message)
 
 	// Extract request ID from context if available
 	requestID := ""
@@ -105,6 +105,16 @@ func (l *Logger) InternalServerError(ctx context.Context, err error, message str
 	}, nil
 }
 
+// Unauthorized returns a 401 Unauthorized response
+func (l *Logger) Unauthorized(ctx context.Context, err error, message string) (events.APIGatewayProxyResponse, error) {
+	errorResp := l.HandleError(ctx, err, message)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 401,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       errorResp.ToJSON(),
+	}, nil
+}
+
 // NotFound returns a 404 Not Found response
 func (l *Logger) NotFound(ctx context.Context, err error, message string) (events.APIGatewayProxyResponse, error) {
 	errorResp := l.HandleError(ctx, err, message)
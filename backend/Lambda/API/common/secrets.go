@@ -4,11 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/fcm-tutorial/credentials"
 )
 
 // FCMCredentials represents the FCM service account JSON structure.
@@ -26,58 +23,52 @@ type FCMCredentials struct {
 	UniverseDomain          string `json:"universe_domain"`
 }
 
-// GetFCMCredentials retrieves FCM service account JSON from AWS Secrets Manager.
-// Environment variable required:
-//   - SECRET_ARN: ARN of the secret in Secrets Manager
-//
-// Returns:
-//   - *FCMCredentials: Parsed FCM credentials
-//   - error: Error if retrieval or parsing fails
-func GetFCMCredentials(ctx context.Context) (*FCMCredentials, error) {
-	// Read SECRET_ARN from environment variable
-	secretARN := os.Getenv("SECRET_ARN")
-	if secretARN == "" {
-		return nil, fmt.Errorf("SECRET_ARN environment variable is not set")
+// getFCMCredentialsFromSecret reads and validates the FCM service account JSON stored in secretID.
+func getFCMCredentialsFromSecret(ctx context.Context, provider credentials.SecretProvider, secretID string) (*FCMCredentials, error) {
+	// Values are cached by the provider, so warm invocations don't refetch the secret
+	secretString, err := provider.GetSecret(ctx, secretID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get AWS region from environment variable (default to us-east-1)
-	region := os.Getenv("AWS_REGION")
-	if region == "" {
-		region = "us-east-1"
+	// Parse JSON response into FCMCredentials struct
+	var creds FCMCredentials
+	if err := json.Unmarshal([]byte(secretString), &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse secret JSON: %w", err)
 	}
 
-	// Load AWS SDK config
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
-	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	// Validate required fields
+	if creds.ProjectID == "" || creds.PrivateKey == "" || creds.ClientEmail == "" {
+		return nil, fmt.Errorf("invalid FCM credentials: missing required fields")
 	}
 
-	// Create Secrets Manager client
-	svc := secretsmanager.NewFromConfig(cfg)
+	return &creds, nil
+}
 
-	// Call GetSecretValue with SECRET_ARN
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId:     aws.String(secretARN),
-		VersionStage: aws.String("AWSCURRENT"), // VersionStage defaults to AWSCURRENT if unspecified
-	}
+// APNsCredentials are the token-based APNs credentials of an iOS app: a .p8 signing key
+// of the Apple developer team, and the app's bundle ID.
+type APNsCredentials struct {
+	TeamID     string `json:"team_id"`
+	KeyID      string `json:"key_id"`
+	PrivateKey string `json:"private_key"` // Contents of the .p8 file (PEM, PKCS #8 P-256 key)
+	Topic      string `json:"topic"`       // Bundle ID of the app
+	Sandbox    bool   `json:"sandbox"`     // Send through the development environment, for debug builds
+}
 
-	result, err := svc.GetSecretValue(ctx, input)
+// getAPNsCredentialsFromSecret reads and validates the APNs credentials JSON stored in secretID.
+func getAPNsCredentialsFromSecret(ctx context.Context, provider credentials.SecretProvider, secretID string) (*APNsCredentials, error) {
+	secretString, err := provider.GetSecret(ctx, secretID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get secret value: %w", err)
+		return nil, err
 	}
 
-	// Decrypts secret using the associated KMS key
-	secretString := *result.SecretString
-
-	// Parse JSON response into FCMCredentials struct
-	var creds FCMCredentials
+	var creds APNsCredentials
 	if err := json.Unmarshal([]byte(secretString), &creds); err != nil {
 		return nil, fmt.Errorf("failed to parse secret JSON: %w", err)
 	}
 
-	// Validate required fields
-	if creds.ProjectID == "" || creds.PrivateKey == "" || creds.ClientEmail == "" {
-		return nil, fmt.Errorf("invalid FCM credentials: missing required fields")
+	if creds.TeamID == "" || creds.KeyID == "" || creds.PrivateKey == "" || creds.Topic == "" {
+		return nil, fmt.Errorf("invalid APNs credentials: missing required fields")
 	}
 
 	return &creds, nil
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+)
+
+// registerFakeDevices registers device-1 (token-1, android) and device-2 (token-2, ios) for user-1.
+func registerFakeDevices(t *testing.T, service *Service) {
+	t.Helper()
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios"}`, nil), 200)
+}
+
+func TestTestRunAckedPerDevice(t *testing.T) {
+	service, _ := newFakeService(t)
+	registerFakeDevices(t, service)
+	sendE2ETest(t, service, "30")
+
+	status := testRunStatus(t, service)
+	if status.DeviceCount != 2 || status.AckedDeviceCount != 0 || len(status.Deliveries) != 2 {
+		t.Fatalf("expected 0 of 2 devices acked, got %+v", status)
+	}
+	for _, delivery := range status.Deliveries {
+		if delivery.Status != deliveryStatusSent || delivery.SentAt == nil {
+			t.Fatalf("expected SENT delivery, got %+v", delivery)
+		}
+	}
+
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", DeviceId: "device-2", AppVersion: "2.0"}), nil), 200)
+	status = testRunStatus(t, service)
+	if status.Status != testRunStatusAcked || status.DeviceID != "device-2" || status.AckedDeviceCount != 1 {
+		t.Fatalf("expected run acked by device-2, 1 of 2 devices acked, got %+v", status)
+	}
+
+	// Other devices can still ack the ACKED run, each only once
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", DeviceId: "device-1"}), nil), 200)
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", DeviceId: "device-1"}), nil), 404)
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", DeviceId: "device-3"}), nil), 404)
+
+	status = testRunStatus(t, service)
+	if status.DeviceID != "device-2" || status.DeviceCount != 2 || status.AckedDeviceCount != 2 {
+		t.Fatalf("expected 2 of 2 devices acked, got %+v", status)
+	}
+	if d := status.Deliveries[1]; d.DeviceID != "device-2" || d.Platform != "ios" || d.AppVersion != "2.0" || d.SendToAckMs == nil {
+		t.Fatalf("unexpected delivery to device-2: %+v", d)
+	}
+}
+
+// ackingSender acks every message from inside Send with the message's ack token,
+// like a device that is faster than the send request returning.
+type ackingSender struct {
+	*fakeSender
+	t       *testing.T
+	service *Service
+}
+
+func (s *ackingSender) Send(ctx context.Context, creds *common.FCMCredentials, message PushMessage) error {
+	if err := s.fakeSender.Send(ctx, creds, message); err != nil {
+		return err
+	}
+	ack := TestAckRequest{Nonce: message.Data["nonce"], AckToken: message.Data[ackTokenDataKey]}
+	expectStatus(s.t, invoke(s.t, s.service.TestAckHandler, ackBody(s.t, s.service, ack), nil), 200)
+	return nil
+}
+
+func TestTestRunAckedBeforeSendReturns(t *testing.T) {
+	service, fakes := newFakeService(t)
+	service.Sender = &ackingSender{fakeSender: fakes.sender, t: t, service: service}
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	sendE2ETest(t, service, "30")
+
+	status := testRunStatus(t, service)
+	if status.Status != testRunStatusAcked || status.AckedDeviceCount != 1 {
+		t.Fatalf("expected ACKED run, got %+v", status)
+	}
+	if d := status.Deliveries[0]; d.Status != deliveryStatusAcked || d.SentAt == nil {
+		t.Fatalf("expected ACKED delivery with sent_at, got %+v", d)
+	}
+}
+
+func TestTestRunDuplicateNonce(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	sendE2ETest(t, service, "30")
+
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 409)
+	if sent := fakes.sender.Sent(); len(sent) != 2 {
+		t.Fatalf("expected only the first send to go out, got %d messages", len(sent))
+	}
+}
+
+func TestTestRunDeliverySendFailed(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	fakes.sender.FailToken("token-2", fakeRejection("UNREGISTERED"))
+
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 200)
+
+	status := testRunStatus(t, service)
+	if status.Status != testRunStatusSendFailed || status.DeviceCount != 2 {
+		t.Fatalf("expected SEND_FAILED run with 2 devices, got %+v", status)
+	}
+	if d := status.Deliveries[0]; d.Status != deliveryStatusSent {
+		t.Fatalf("expected SENT delivery to device-1, got %+v", d)
+	}
+	if d := status.Deliveries[1]; d.Status != deliveryStatusSendFailed || d.FailureReason != "UNREGISTERED" {
+		t.Fatalf("expected SEND_FAILED delivery to device-2, got %+v", d)
+	}
+}
+
+func TestTestRunCreationRolledBack(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+
+	// A stray delivery row makes creating the delivery to device-2 fail half way
+	stray := fakeDeliveryKey{Nonce: "nonce-1", DeviceID: "device-2"}
+	fakes.querier.deliveries[stray] = sqlc.TestRunDelivery{Nonce: "nonce-1", DeviceID: "device-2", Status: deliveryStatusPending}
+
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 500)
+	if sent := fakes.sender.Sent(); len(sent) != 0 {
+		t.Fatalf("expected nothing to be sent, got %d messages", len(sent))
+	}
+
+	// Neither the run nor the delivery to device-1 was kept
+	expectStatus(t, invoke(t, service.TestStatusHandler, "", map[string]string{"nonce": "nonce-1"}), 404)
+	if len(fakes.querier.deliveries) != 1 {
+		t.Fatalf("expected only the stray delivery, got %+v", fakes.querier.deliveries)
+	}
+	if len(fakes.querier.outbox) != 0 {
+		t.Fatalf("expected no outbox entries, got %+v", fakes.querier.outbox)
+	}
+}
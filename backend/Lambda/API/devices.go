@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+	_ "time/tzdata" // Timezones are validated with time.LoadLocation; the Lambda image has no zoneinfo
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Paging of GET /devices
+const (
+	defaultDevicesLimit = 50
+	maxDevicesLimit     = 200
+)
+
+// Limits of the device metadata reported on registration
+const (
+	maxVersionLength     = 32 // app_version, sdk_version
+	maxDescriptionLength = 64 // os_version, device_model
+)
+
+// appVersionPattern accepts "1.2", "1.2.3", "1.2.3.45" with an optional pre-release or build suffix ("1.2.3-beta.1+45")
+var appVersionPattern = regexp.MustCompile(`^\d+(\.\d+){1,3}([-+][0-9A-Za-z.+-]+)?$`)
+
+// sdkVersionPattern accepts API levels ("34") and SDK versions ("24.1.0", "11.0.0-beta")
+var sdkVersionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]*$`)
+
+// DeviceMetadata is optional information reported by the app on registration. Every registration
+// replaces it, so fields left out are cleared.
+type DeviceMetadata struct {
+	AppVersion  string `json:"app_version,omitempty"`  // e.g. "1.2.3"
+	OsVersion   string `json:"os_version,omitempty"`   // e.g. "Android 14", "iOS 18.1"
+	DeviceModel string `json:"device_model,omitempty"` // e.g. "Pixel 8"
+	Timezone    string `json:"timezone,omitempty"`     // IANA name, e.g. "Europe/Lisbon"
+	SdkVersion  string `json:"sdk_version,omitempty"`  // Platform SDK level, e.g. Android API level "34"
+}
+
+// DeviceSummary is a device in the GET /devices response; the push token is never returned
+type DeviceSummary struct {
+	UserID    string    `json:"user_id"`
+	DeviceID  string    `json:"device_id"`
+	Platform  string    `json:"platform"`
+	AppID     string    `json:"app_id"`
+	TokenType string    `json:"token_type"` // "fcm" or "apns"
+	Locale    string    `json:"locale,omitempty"`
+	IsActive  bool      `json:"is_active"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	DeviceMetadata
+}
+
+type ListDevicesResponse struct {
+	Devices    []DeviceSummary `json:"devices"`
+	NextCursor string          `json:"next_cursor,omitempty"` // Omitted on the last page
+}
+
+// devicesCursor is the position after the last device of a page, encoded as base64 JSON
+type devicesCursor struct {
+	ID int32 `json:"id"`
+}
+
+// ListDevicesHandler is the Lambda handler for listing devices, oldest registration first:
+// GET /devices?user_id=&platform=&app_id=&app_version=&os_version=&locale=&timezone=&active=&limit=&cursor=
+// All filters are exact matches.
+func (s *Service) ListDevicesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list devices request")
+
+	query := request.QueryStringParameters
+
+	// Validate filters
+	platform := query["platform"]
+	switch platform {
+	case "", "android", "ios":
+	default:
+		err := fmt.Errorf("invalid platform: %s", platform)
+		return logger.BadRequest(ctx, err, "platform must be 'android' or 'ios'")
+	}
+	locale := query["locale"]
+	if locale != "" {
+		normalized, err := normalizeLocale(locale)
+		if err != nil {
+			return logger.BadRequest(ctx, err, "Invalid locale")
+		}
+		locale = normalized
+	}
+	var active pgtype.Bool
+	if value := query["active"]; value != "" {
+		isActive, err := strconv.ParseBool(value)
+		if err != nil {
+			err := fmt.Errorf("invalid active: %s", value)
+			return logger.BadRequest(ctx, err, "active must be true or false")
+		}
+		active = pgtype.Bool{Bool: isActive, Valid: true}
+	}
+	limit := defaultDevicesLimit
+	if value := query["limit"]; value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxDevicesLimit {
+			err := fmt.Errorf("invalid limit: %s", value)
+			return logger.BadRequest(ctx, err, fmt.Sprintf("limit must be 1-%d", maxDevicesLimit))
+		}
+	}
+
+	params := sqlc.ListDevicesParams{
+		UserID:     optionalText(query["user_id"]),
+		Platform:   optionalText(platform),
+		AppID:      optionalText(query["app_id"]),
+		AppVersion: optionalText(query["app_version"]),
+		OsVersion:  optionalText(query["os_version"]),
+		Locale:     optionalText(locale),
+		Timezone:   optionalText(query["timezone"]),
+		IsActive:   active,
+		LimitCount: int32(limit + 1), // One more to know whether there is a next page
+	}
+	if value := query["cursor"]; value != "" {
+		cursor, err := decodeDevicesCursor(value)
+		if err != nil {
+			return logger.BadRequest(ctx, err, "Invalid cursor")
+		}
+		params.AfterID = cursor.ID
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	devices, err := queries.ListDevices(ctx, params)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	// Build response
+	response := ListDevicesResponse{Devices: make([]DeviceSummary, 0, limit)}
+	if len(devices) > limit {
+		devices = devices[:limit]
+		response.NextCursor, err = encodeDevicesCursor(devicesCursor{ID: devices[limit-1].ID})
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Failed to create cursor")
+		}
+	}
+	for _, device := range devices {
+		response.Devices = append(response.Devices, newDeviceSummary(device))
+	}
+
+	logger.Info(ctx, "Listed devices: user_id=%s, platform=%s, count=%d, more=%t",
+		query["user_id"], platform, len(response.Devices), response.NextCursor != "")
+
+	return logger.Success(ctx, response)
+}
+
+func newDeviceSummary(device sqlc.ListDevicesRow) DeviceSummary {
+	return DeviceSummary{
+		UserID:    device.UserID,
+		DeviceID:  device.DeviceID,
+		Platform:  device.Platform,
+		AppID:     device.AppID,
+		TokenType: device.TokenType,
+		Locale:    device.Locale.String,
+		IsActive:  device.IsActive,
+		UpdatedAt: device.UpdatedAt.Time,
+		DeviceMetadata: DeviceMetadata{
+			AppVersion:  device.AppVersion.String,
+			OsVersion:   device.OsVersion.String,
+			DeviceModel: device.DeviceModel.String,
+			Timezone:    device.Timezone.String,
+			SdkVersion:  device.SdkVersion.String,
+		},
+	}
+}
+
+// validate checks the fields that are set; all of them are optional
+func (m DeviceMetadata) validate() error {
+	if m.AppVersion != "" && (len(m.AppVersion) > maxVersionLength || !appVersionPattern.MatchString(m.AppVersion)) {
+		return fmt.Errorf("invalid app_version: %q (must be like 1.2.3, at most %d characters)", m.AppVersion, maxVersionLength)
+	}
+	if err := validateDescription("os_version", m.OsVersion); err != nil {
+		return err
+	}
+	if err := validateDescription("device_model", m.DeviceModel); err != nil {
+		return err
+	}
+	if m.Timezone != "" {
+		// "Local" is the Lambda's own timezone, not an IANA name
+		if _, err := time.LoadLocation(m.Timezone); err != nil || m.Timezone == "Local" {
+			return fmt.Errorf("invalid timezone: %q (must be an IANA name like Europe/Lisbon)", m.Timezone)
+		}
+	}
+	if m.SdkVersion != "" && (len(m.SdkVersion) > maxVersionLength || !sdkVersionPattern.MatchString(m.SdkVersion)) {
+		return fmt.Errorf("invalid sdk_version: %q (at most %d letters, digits and .+_-)", m.SdkVersion, maxVersionLength)
+	}
+	return nil
+}
+
+// validateDescription checks free-form metadata such as "Galaxy S24 Ultra": printable UTF-8,
+// at most maxDescriptionLength characters
+func validateDescription(field, value string) error {
+	if !utf8.ValidString(value) || utf8.RuneCountInString(value) > maxDescriptionLength {
+		return fmt.Errorf("invalid %s: must be at most %d characters", field, maxDescriptionLength)
+	}
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("invalid %s: %q contains unprintable characters", field, value)
+		}
+	}
+	return nil
+}
+
+func encodeDevicesCursor(cursor devicesCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeDevicesCursor(value string) (devicesCursor, error) {
+	var cursor devicesCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID < 1 {
+		return cursor, fmt.Errorf("invalid cursor: %s", value)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// listDevices invokes ListDevicesHandler and decodes the page.
+func listDevices(t *testing.T, service *Service, query map[string]string) ListDevicesResponse {
+	t.Helper()
+	response := invoke(t, service.ListDevicesHandler, "", query)
+	expectStatus(t, response, 200)
+	var list ListDevicesResponse
+	decodeBody(t, response, &list)
+	return list
+}
+
+// deviceIDs returns the device IDs of a page in order.
+func deviceIDs(devices []DeviceSummary) []string {
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.DeviceID)
+	}
+	return ids
+}
+
+func TestRegisterDeviceStoresMetadata(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","locale":"pt_br",
+		  "app_version":"1.4.0-beta.2","os_version":"Android 14","device_model":"Pixel 8","timezone":"America/Sao_Paulo","sdk_version":"34"}`, nil), 200)
+
+	list := listDevices(t, service, nil)
+	want := DeviceMetadata{AppVersion: "1.4.0-beta.2", OsVersion: "Android 14", DeviceModel: "Pixel 8", Timezone: "America/Sao_Paulo", SdkVersion: "34"}
+	if len(list.Devices) != 1 || list.Devices[0].DeviceMetadata != want || list.Devices[0].Locale != "pt-BR" {
+		t.Fatalf("unexpected devices: %+v", list.Devices)
+	}
+
+	// Registering again replaces the metadata; fields left out are cleared
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_version":"1.5.0"}`, nil), 200)
+	if device := fakes.querier.devices[0]; device.AppVersion.String != "1.5.0" || device.OsVersion.Valid || device.Timezone.Valid {
+		t.Fatalf("metadata not replaced: %+v", device)
+	}
+}
+
+func TestRegisterDeviceRejectsInvalidMetadata(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	for name, metadata := range map[string]string{
+		"app_version not a version": `"app_version":"latest"`,
+		"app_version too long":      `"app_version":"1.0.0-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"`,
+		"os_version control chars":  `"os_version":"Android\u000014"`,
+		"device_model too long":     `"device_model":"` + strings.Repeat("a", 65) + `"`,
+		"unknown timezone":          `"timezone":"Mars/Olympus_Mons"`,
+		"local timezone":            `"timezone":"Local"`,
+		"sdk_version with spaces":   `"sdk_version":"API 34"`,
+	} {
+		body := `{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android",` + metadata + `}`
+		if response := invoke(t, service.RegisterDeviceHandler, body, nil); response.StatusCode != 400 {
+			t.Errorf("%s: expected 400, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+	if len(fakes.querier.devices) != 0 {
+		t.Fatalf("devices with invalid metadata were stored: %+v", fakes.querier.devices)
+	}
+}
+
+func TestListDevicesFilters(t *testing.T) {
+	service, _ := newFakeService(t)
+	for _, body := range []string{
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_version":"1.4.0","timezone":"Europe/Lisbon","locale":"pt-PT"}`,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios","app_version":"1.5.0","os_version":"iOS 18.1"}`,
+		`{"user_id":"user-2","device_id":"device-3","fcm_token":"token-3","platform":"android","app_version":"1.5.0","timezone":"Europe/Lisbon"}`,
+	} {
+		expectStatus(t, invoke(t, service.RegisterDeviceHandler, body, nil), 200)
+	}
+
+	tests := []struct {
+		query map[string]string
+		want  []string
+	}{
+		{map[string]string{}, []string{"device-1", "device-2", "device-3"}},
+		{map[string]string{"user_id": "user-1"}, []string{"device-1", "device-2"}},
+		{map[string]string{"platform": "android"}, []string{"device-1", "device-3"}},
+		{map[string]string{"app_version": "1.5.0"}, []string{"device-2", "device-3"}},
+		{map[string]string{"app_version": "1.5.0", "platform": "ios"}, []string{"device-2"}},
+		{map[string]string{"os_version": "iOS 18.1"}, []string{"device-2"}},
+		{map[string]string{"timezone": "Europe/Lisbon"}, []string{"device-1", "device-3"}},
+		{map[string]string{"locale": "pt_pt"}, []string{"device-1"}},
+		{map[string]string{"active": "false"}, []string{}},
+		{map[string]string{"app_id": "shop"}, []string{}},
+	}
+	for _, test := range tests {
+		if got := deviceIDs(listDevices(t, service, test.query).Devices); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("query %v: expected %v, got %v", test.query, test.want, got)
+		}
+	}
+}
+
+func TestListDevicesPaginates(t *testing.T) {
+	service, _ := newFakeService(t)
+	registerFakeDevices(t, service)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-2","device_id":"device-3","fcm_token":"token-3","platform":"android"}`, nil), 200)
+
+	var ids []string
+	cursor := ""
+	for page := 0; ; page++ {
+		query := map[string]string{"limit": "2"}
+		if cursor != "" {
+			query["cursor"] = cursor
+		}
+		list := listDevices(t, service, query)
+		if len(list.Devices) > 2 || page > 1 {
+			t.Fatalf("unexpected page %d: %+v", page, list)
+		}
+		ids = append(ids, deviceIDs(list.Devices)...)
+		if list.NextCursor == "" {
+			break
+		}
+		cursor = list.NextCursor
+	}
+	if want := []string{"device-1", "device-2", "device-3"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("expected devices in registration order, got %v", ids)
+	}
+}
+
+func TestListDevicesInvalidParameters(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	for _, query := range []map[string]string{
+		{"platform": "web"},
+		{"locale": "portuguese!"},
+		{"active": "maybe"},
+		{"limit": "0"},
+		{"limit": "201"},
+		{"cursor": "not-a-cursor"},
+	} {
+		expectStatus(t, invoke(t, service.ListDevicesHandler, "", query), 400)
+	}
+}
+
+func TestListDevicesHandler(t *testing.T) {
+	requireDB(t)
+	expectStatus(t, invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_version":"2.0.1","timezone":"Asia/Tokyo","device_model":"Pixel 8"}`, nil), 200)
+	registerDevice(t, "user-1", "device-2", "token-2", "ios")
+
+	list := listDevices(t, testService, map[string]string{"app_version": "2.0.1"})
+	if len(list.Devices) != 1 || list.Devices[0].DeviceID != "device-1" ||
+		list.Devices[0].Timezone != "Asia/Tokyo" || list.Devices[0].DeviceModel != "Pixel 8" {
+		t.Fatalf("unexpected devices: %+v", list.Devices)
+	}
+	if got := deviceIDs(listDevices(t, testService, map[string]string{"user_id": "user-1"}).Devices); len(got) != 2 {
+		t.Fatalf("expected both devices of user-1, got %v", got)
+	}
+}
@@ -0,0 +1,2197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// In-memory fakes of the Service dependencies, for unit tests that need neither
+// Postgres nor network access.
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fakeSecretProvider serves secrets from a map.
+type fakeSecretProvider map[string]string
+
+func (p fakeSecretProvider) GetSecret(ctx context.Context, secretID string) (string, error) {
+	value, ok := p[secretID]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", secretID)
+	}
+	return value, nil
+}
+
+// fakeSentMessage is a message accepted by fakeSender.
+type fakeSentMessage struct {
+	ProjectID string
+	PushMessage
+}
+
+// fakeSender records messages instead of sending them.
+type fakeSender struct {
+	mu         sync.Mutex
+	sent       []fakeSentMessage
+	failTokens map[string]error // FCM token -> error returned for it
+}
+
+func newFakeSender() *fakeSender {
+	return &fakeSender{failTokens: make(map[string]error)}
+}
+
+func (s *fakeSender) Send(ctx context.Context, creds *common.FCMCredentials, message PushMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err, ok := s.failTokens[message.Token]; ok {
+		return err
+	}
+	s.sent = append(s.sent, fakeSentMessage{ProjectID: creds.ProjectID, PushMessage: message})
+	return nil
+}
+
+// FailToken makes sends to token fail with err, or succeed again if err is nil.
+func (s *fakeSender) FailToken(token string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failTokens, token)
+		return
+	}
+	s.failTokens[token] = err
+}
+
+// Sent returns the messages sent so far.
+func (s *fakeSender) Sent() []fakeSentMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeSentMessage(nil), s.sent...)
+}
+
+// fakeRejection is a final send error, like a 4xx of the push service, whose message is the reason.
+type fakeRejection string
+
+func (r fakeRejection) Error() string { return string(r) }
+func (r fakeRejection) Unwrap() error { return errPushMessageRejected }
+
+// fakeStore hands out a shared fakeQuerier, or fails like an unreachable database.
+type fakeStore struct {
+	querier *fakeQuerier
+	connErr error // Returned by Queries if set
+}
+
+func (s *fakeStore) Queries(ctx context.Context) (sqlc.Querier, error) {
+	if s.connErr != nil {
+		return nil, s.connErr
+	}
+	return s.querier, nil
+}
+
+// InTx restores the querier's tables if fn fails. Transactions are not isolated
+// from each other, which is fine as long as tests don't run handlers concurrently.
+func (s *fakeStore) InTx(ctx context.Context, fn func(queries sqlc.Querier) error) error {
+	if s.connErr != nil {
+		return s.connErr
+	}
+	saved := s.querier.snapshot()
+	if err := fn(s.querier); err != nil {
+		s.querier.restore(saved)
+		return err
+	}
+	return nil
+}
+
+// Listen subscribes to the notifications of the querier. Unlike Postgres, they are
+// delivered immediately rather than when the transaction commits.
+func (s *fakeStore) Listen(ctx context.Context, channel string) (Subscription, error) {
+	if s.connErr != nil {
+		return nil, s.connErr
+	}
+	return s.querier.listen(channel), nil
+}
+
+// ListSegmentDevices evaluates the compiled condition of the filter on the querier's devices (see
+// fakeSegmentCondition) instead of running its SQL.
+func (s *fakeStore) ListSegmentDevices(ctx context.Context, filter segmentFilter, afterUserID string, userLimit int) ([]sqlc.ListActiveDevicesByPlatformsRow, error) {
+	if s.connErr != nil {
+		return nil, s.connErr
+	}
+	devices, err := s.querier.segmentDevices(filter)
+	if err != nil {
+		return nil, err
+	}
+	var rows []sqlc.ListActiveDevicesByPlatformsRow
+	users := 0
+	for _, device := range devices {
+		if device.UserID <= afterUserID {
+			continue
+		}
+		if len(rows) == 0 || rows[len(rows)-1].UserID != device.UserID {
+			if users == userLimit {
+				break
+			}
+			users++
+		}
+		rows = append(rows, sqlc.ListActiveDevicesByPlatformsRow{
+			UserID:    device.UserID,
+			DeviceID:  device.DeviceID,
+			Platform:  device.Platform,
+			AppID:     device.AppID,
+			FcmToken:  device.FcmToken,
+			TokenType: device.TokenType,
+			Locale:    device.Locale,
+			IsActive:  device.IsActive,
+			UpdatedAt: device.UpdatedAt,
+		})
+	}
+	return rows, nil
+}
+
+func (s *fakeStore) CountSegment(ctx context.Context, filter segmentFilter) (segmentSize, error) {
+	if s.connErr != nil {
+		return segmentSize{}, s.connErr
+	}
+	devices, err := s.querier.segmentDevices(filter)
+	if err != nil {
+		return segmentSize{}, err
+	}
+	var size segmentSize
+	users := make(map[string]bool)
+	for _, device := range devices {
+		size.Devices++
+		users[device.UserID] = true
+		if device.Platform == "android" {
+			size.Android++
+		} else {
+			size.IOS++
+		}
+	}
+	size.Users = int64(len(users))
+	return size, nil
+}
+
+// segmentDevices returns the active android and ios devices matching filter, ordered by user_id and device_id.
+func (q *fakeQuerier) segmentDevices(filter segmentFilter) ([]sqlc.Device, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var devices []sqlc.Device
+	for _, device := range q.devices {
+		if device.IsActive && (device.Platform == "android" || device.Platform == "ios") && segmentMatches(filter, device) {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].UserID != devices[j].UserID {
+			return devices[i].UserID < devices[j].UserID
+		}
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices, nil
+}
+
+// fakeSegmentCondition evaluates the SQL condition of a compiled segment filter on a device, so
+// the fake store runs the compiler's output rather than the parsed expression. It understands the
+// SQL compileSegmentFilter writes, with Postgres' NULL semantics: a comparison with a NULL
+// attribute is NULL, which COALESCE turns into FALSE.
+type fakeSegmentCondition struct {
+	sql    string
+	pos    int
+	args   []any
+	device sqlc.Device
+}
+
+// segmentMatches reports whether the device matches the condition of filter.
+func segmentMatches(filter segmentFilter, device sqlc.Device) bool {
+	c := &fakeSegmentCondition{sql: filter.condition, args: filter.args, device: device}
+	matches := c.condition()
+	if c.pos != len(c.sql) {
+		c.fail("end of condition")
+	}
+	return matches
+}
+
+func (c *fakeSegmentCondition) fail(expected string) {
+	panic(fmt.Sprintf("fake segment condition: expected %s at %d of %s", expected, c.pos, c.sql))
+}
+
+func (c *fakeSegmentCondition) consume(prefix string) bool {
+	if !strings.HasPrefix(c.sql[c.pos:], prefix) {
+		return false
+	}
+	c.pos += len(prefix)
+	return true
+}
+
+func (c *fakeSegmentCondition) expect(prefix string) {
+	if !c.consume(prefix) {
+		c.fail(strconv.Quote(prefix))
+	}
+}
+
+// condition evaluates COALESCE(comparison, FALSE), (NOT condition) or a parenthesized
+// AND or OR of conditions
+func (c *fakeSegmentCondition) condition() bool {
+	switch {
+	case c.consume("COALESCE("):
+		matches, ok := c.comparison()
+		c.expect(", FALSE)")
+		return ok && matches
+	case c.consume("(NOT "):
+		matches := !c.condition()
+		c.expect(")")
+		return matches
+	case c.consume("("):
+		matches := c.condition()
+		for {
+			switch {
+			case c.consume(" AND "):
+				matches = c.condition() && matches
+			case c.consume(" OR "):
+				matches = c.condition() || matches
+			default:
+				c.expect(")")
+				return matches
+			}
+		}
+	}
+	c.fail("condition")
+	return false
+}
+
+// comparison evaluates "operand op operand" or "operand IN (operand, ...)"; ok is false if it is NULL
+func (c *fakeSegmentCondition) comparison() (matches, ok bool) {
+	left, ok := c.operand()
+	if c.consume(" IN (") {
+		for {
+			right, _ := c.operand()
+			matches = matches || ok && compareSegmentOperands(left, right) == 0
+			if !c.consume(", ") {
+				break
+			}
+		}
+		c.expect(")")
+		return matches, ok
+	}
+	for _, op := range []string{" != ", " <= ", " >= ", " = ", " < ", " > "} {
+		if !c.consume(op) {
+			continue
+		}
+		right, _ := c.operand()
+		if !ok {
+			return false, false
+		}
+		cmp := compareSegmentOperands(left, right)
+		switch strings.TrimSpace(op) {
+		case "=":
+			return cmp == 0, ok
+		case "!=":
+			return cmp != 0, ok
+		case "<":
+			return cmp < 0, ok
+		case "<=":
+			return cmp <= 0, ok
+		case ">":
+			return cmp > 0, ok
+		default:
+			return cmp >= 0, ok
+		}
+	}
+	c.fail("operator")
+	return false, false
+}
+
+// operand evaluates a column, a parameter or segment_version_key of either; ok is false if it is NULL
+func (c *fakeSegmentCondition) operand() (value any, ok bool) {
+	if c.consume("segment_version_key(") {
+		version, ok := c.operand()
+		c.consume("::text")
+		c.expect(")")
+		if !ok {
+			return nil, false
+		}
+		key, ok := fakeVersionKey(version.(string))
+		return key, ok
+	}
+	if c.consume("$") {
+		end := c.pos
+		for end < len(c.sql) && c.sql[end] >= '0' && c.sql[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(c.sql[c.pos:end])
+		if err != nil || n < 1 || n > len(c.args) {
+			c.fail("parameter")
+		}
+		c.pos = end
+		return c.args[n-1], true
+	}
+
+	end := c.pos
+	for end < len(c.sql) && (c.sql[end] == '_' || c.sql[end] >= 'a' && c.sql[end] <= 'z') {
+		end++
+	}
+	column := c.sql[c.pos:end]
+	c.pos = end
+	if column == "updated_at" {
+		return c.device.UpdatedAt.Time, c.device.UpdatedAt.Valid
+	}
+	columns := map[string]pgtype.Text{
+		"user_id":      {String: c.device.UserID, Valid: true},
+		"platform":     {String: c.device.Platform, Valid: true},
+		"app_id":       {String: c.device.AppID, Valid: true},
+		"locale":       c.device.Locale,
+		"os_version":   c.device.OsVersion,
+		"device_model": c.device.DeviceModel,
+		"timezone":     c.device.Timezone,
+		"app_version":  c.device.AppVersion,
+		"sdk_version":  c.device.SdkVersion,
+	}
+	text, found := columns[column]
+	if !found {
+		c.fail("column")
+	}
+	return text.String, text.Valid
+}
+
+// compareSegmentOperands compares two non-NULL operands of the same type
+func compareSegmentOperands(a, b any) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case [4]int:
+		b := b.([4]int)
+		for i := range a {
+			if cmp := compareInts(a[i], b[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		return 0
+	}
+	panic(fmt.Sprintf("unexpected segment operand %T", a))
+}
+
+// fakeVersionKey does what the segment_version_key SQL function does.
+func fakeVersionKey(version string) ([4]int, bool) {
+	var key [4]int
+	match := regexp.MustCompile(`^\d+(\.\d+){0,3}`).FindString(version)
+	if match == "" {
+		return key, false
+	}
+	for i, component := range strings.Split(match, ".") {
+		key[i], _ = strconv.Atoi(component)
+	}
+	return key, true
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// fakeSubscription receives the notifications of a fakeQuerier.
+type fakeSubscription struct {
+	querier       *fakeQuerier
+	channel       string
+	notifications chan string
+}
+
+func (s *fakeSubscription) Next(ctx context.Context) (string, error) {
+	select {
+	case s.querier.waiting <- struct{}{}:
+	default:
+	}
+	select {
+	case payload := <-s.notifications:
+		return payload, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *fakeSubscription) Close() {
+	s.querier.mu.Lock()
+	defer s.querier.mu.Unlock()
+	delete(s.querier.subscriptions, s)
+}
+
+// fakeQuerier implements sqlc.Querier on in-memory tables, following the
+// semantics of the SQL in queries.sql (NOW() is the fake clock).
+type fakeQuerier struct {
+	clock Clock
+	err   error // Returned by every query if set
+
+	mu         sync.Mutex
+	devices    []sqlc.Device
+	testRuns   map[string]sqlc.TestRun
+	deliveries map[fakeDeliveryKey]sqlc.TestRunDelivery
+
+	messages          map[string]sqlc.Message
+	messageDeliveries map[fakeMessageDeliveryKey]sqlc.MessageDelivery
+
+	templates map[fakeTemplateKey]sqlc.Template
+	segments  map[string]sqlc.Segment
+
+	broadcasts map[string]sqlc.Broadcast
+
+	campaigns           map[string]sqlc.Campaign
+	campaignVariants    map[fakeCampaignVariantKey]sqlc.CampaignVariant
+	campaignAssignments map[fakeCampaignAssignmentKey]sqlc.CampaignAssignment
+
+	webhookSubscriptions  map[string]sqlc.WebhookSubscription
+	webhookDeliveries     map[int64]sqlc.WebhookDelivery
+	webhookDeadLetters    map[int64]sqlc.WebhookDeadLetter
+	lastWebhookDeliveryID int64 // Like a sequence, not rolled back with a transaction
+
+	outbox         map[int64]sqlc.Outbox
+	lastOutboxID   int64 // Like a sequence, not rolled back with a transaction
+	outboxCapacity int   // CreateOutboxEntry fails once the outbox holds this many entries, if set
+
+	categories  map[string]sqlc.NotificationCategory // Seeded like migration 0010
+	preferences map[fakePreferenceKey]sqlc.NotificationPreference
+
+	subscriptions map[*fakeSubscription]struct{}
+	waiting       chan struct{} // Holds a value once a subscriber starts waiting
+}
+
+// fakeDeliveryKey is the primary key of test_run_deliveries.
+type fakeDeliveryKey struct {
+	Nonce    string
+	DeviceID string
+}
+
+// fakeMessageDeliveryKey is the primary key of message_deliveries.
+type fakeMessageDeliveryKey struct {
+	MessageID string
+	DeviceID  string
+}
+
+// fakeTemplateKey is the primary key of templates.
+type fakeTemplateKey struct {
+	TemplateKey string
+	Locale      string
+}
+
+// fakeCampaignVariantKey is the primary key of campaign_variants.
+type fakeCampaignVariantKey struct {
+	CampaignID string
+	Variant    string
+}
+
+// fakeCampaignAssignmentKey is the primary key of campaign_assignments.
+type fakeCampaignAssignmentKey struct {
+	CampaignID string
+	UserID     string
+}
+
+// fakePreferenceKey is the primary key of notification_preferences.
+type fakePreferenceKey struct {
+	UserID   string
+	DeviceID string
+	Category string
+}
+
+var _ sqlc.Querier = (*fakeQuerier)(nil)
+
+func newFakeQuerier(clock Clock) *fakeQuerier {
+	return &fakeQuerier{
+		clock:      clock,
+		testRuns:   make(map[string]sqlc.TestRun),
+		deliveries: make(map[fakeDeliveryKey]sqlc.TestRunDelivery),
+
+		messages:          make(map[string]sqlc.Message),
+		messageDeliveries: make(map[fakeMessageDeliveryKey]sqlc.MessageDelivery),
+
+		templates: make(map[fakeTemplateKey]sqlc.Template),
+		segments:  make(map[string]sqlc.Segment),
+
+		broadcasts: make(map[string]sqlc.Broadcast),
+
+		campaigns:           make(map[string]sqlc.Campaign),
+		campaignVariants:    make(map[fakeCampaignVariantKey]sqlc.CampaignVariant),
+		campaignAssignments: make(map[fakeCampaignAssignmentKey]sqlc.CampaignAssignment),
+
+		webhookSubscriptions: make(map[string]sqlc.WebhookSubscription),
+		webhookDeliveries:    make(map[int64]sqlc.WebhookDelivery),
+		webhookDeadLetters:   make(map[int64]sqlc.WebhookDeadLetter),
+
+		outbox: make(map[int64]sqlc.Outbox),
+
+		categories: map[string]sqlc.NotificationCategory{
+			"system":        {Category: "system", Mandatory: true, DefaultEnabled: true},
+			"security":      {Category: "security", Mandatory: true, DefaultEnabled: true},
+			"transactional": {Category: "transactional", DefaultEnabled: true},
+			"marketing":     {Category: "marketing", DefaultEnabled: true},
+		},
+		preferences: make(map[fakePreferenceKey]sqlc.NotificationPreference),
+
+		subscriptions: make(map[*fakeSubscription]struct{}),
+		waiting:       make(chan struct{}, 1),
+	}
+}
+
+func (q *fakeQuerier) listen(channel string) *fakeSubscription {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	subscription := &fakeSubscription{querier: q, channel: channel, notifications: make(chan string, 16)}
+	q.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+// notifyStatusLocked does what the test_runs_status_notify trigger does. q.mu must be held.
+func (q *fakeQuerier) notifyStatusLocked(nonce string) {
+	for subscription := range q.subscriptions {
+		if subscription.channel != testRunStatusChannel {
+			continue
+		}
+		select {
+		case subscription.notifications <- nonce:
+		default: // Dropped, like a full notification queue
+		}
+	}
+}
+
+// fakeTables is a copy of the fakeQuerier tables, see fakeStore.InTx.
+type fakeTables struct {
+	devices              []sqlc.Device
+	testRuns             map[string]sqlc.TestRun
+	deliveries           map[fakeDeliveryKey]sqlc.TestRunDelivery
+	messages             map[string]sqlc.Message
+	messageDeliveries    map[fakeMessageDeliveryKey]sqlc.MessageDelivery
+	templates            map[fakeTemplateKey]sqlc.Template
+	segments             map[string]sqlc.Segment
+	broadcasts           map[string]sqlc.Broadcast
+	campaigns            map[string]sqlc.Campaign
+	campaignVariants     map[fakeCampaignVariantKey]sqlc.CampaignVariant
+	campaignAssignments  map[fakeCampaignAssignmentKey]sqlc.CampaignAssignment
+	webhookSubscriptions map[string]sqlc.WebhookSubscription
+	webhookDeliveries    map[int64]sqlc.WebhookDelivery
+	webhookDeadLetters   map[int64]sqlc.WebhookDeadLetter
+	outbox               map[int64]sqlc.Outbox
+	preferences          map[fakePreferenceKey]sqlc.NotificationPreference
+}
+
+func (q *fakeQuerier) snapshot() fakeTables {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tables := fakeTables{
+		devices:              append([]sqlc.Device(nil), q.devices...),
+		testRuns:             make(map[string]sqlc.TestRun, len(q.testRuns)),
+		deliveries:           make(map[fakeDeliveryKey]sqlc.TestRunDelivery, len(q.deliveries)),
+		messages:             make(map[string]sqlc.Message, len(q.messages)),
+		messageDeliveries:    make(map[fakeMessageDeliveryKey]sqlc.MessageDelivery, len(q.messageDeliveries)),
+		templates:            make(map[fakeTemplateKey]sqlc.Template, len(q.templates)),
+		segments:             make(map[string]sqlc.Segment, len(q.segments)),
+		broadcasts:           make(map[string]sqlc.Broadcast, len(q.broadcasts)),
+		campaigns:            make(map[string]sqlc.Campaign, len(q.campaigns)),
+		campaignVariants:     make(map[fakeCampaignVariantKey]sqlc.CampaignVariant, len(q.campaignVariants)),
+		campaignAssignments:  make(map[fakeCampaignAssignmentKey]sqlc.CampaignAssignment, len(q.campaignAssignments)),
+		webhookSubscriptions: make(map[string]sqlc.WebhookSubscription, len(q.webhookSubscriptions)),
+		webhookDeliveries:    make(map[int64]sqlc.WebhookDelivery, len(q.webhookDeliveries)),
+		webhookDeadLetters:   make(map[int64]sqlc.WebhookDeadLetter, len(q.webhookDeadLetters)),
+		outbox:               make(map[int64]sqlc.Outbox, len(q.outbox)),
+		preferences:          make(map[fakePreferenceKey]sqlc.NotificationPreference, len(q.preferences)),
+	}
+	for nonce, testRun := range q.testRuns {
+		tables.testRuns[nonce] = testRun
+	}
+	for key, delivery := range q.deliveries {
+		tables.deliveries[key] = delivery
+	}
+	for messageID, message := range q.messages {
+		tables.messages[messageID] = message
+	}
+	for key, delivery := range q.messageDeliveries {
+		tables.messageDeliveries[key] = delivery
+	}
+	for key, template := range q.templates {
+		tables.templates[key] = template
+	}
+	for segmentID, segment := range q.segments {
+		tables.segments[segmentID] = segment
+	}
+	for broadcastID, broadcast := range q.broadcasts {
+		tables.broadcasts[broadcastID] = broadcast
+	}
+	for campaignID, campaign := range q.campaigns {
+		tables.campaigns[campaignID] = campaign
+	}
+	for key, variant := range q.campaignVariants {
+		tables.campaignVariants[key] = variant
+	}
+	for key, assignment := range q.campaignAssignments {
+		tables.campaignAssignments[key] = assignment
+	}
+	for subscriptionID, subscription := range q.webhookSubscriptions {
+		tables.webhookSubscriptions[subscriptionID] = subscription
+	}
+	for deliveryID, delivery := range q.webhookDeliveries {
+		tables.webhookDeliveries[deliveryID] = delivery
+	}
+	for deliveryID, deadLetter := range q.webhookDeadLetters {
+		tables.webhookDeadLetters[deliveryID] = deadLetter
+	}
+	for outboxID, entry := range q.outbox {
+		tables.outbox[outboxID] = entry
+	}
+	for key, preference := range q.preferences {
+		tables.preferences[key] = preference
+	}
+	return tables
+}
+
+func (q *fakeQuerier) restore(tables fakeTables) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.devices = tables.devices
+	q.testRuns = tables.testRuns
+	q.deliveries = tables.deliveries
+	q.messages = tables.messages
+	q.messageDeliveries = tables.messageDeliveries
+	q.templates = tables.templates
+	q.segments = tables.segments
+	q.broadcasts = tables.broadcasts
+	q.campaigns = tables.campaigns
+	q.campaignVariants = tables.campaignVariants
+	q.campaignAssignments = tables.campaignAssignments
+	q.webhookSubscriptions = tables.webhookSubscriptions
+	q.webhookDeliveries = tables.webhookDeliveries
+	q.webhookDeadLetters = tables.webhookDeadLetters
+	q.outbox = tables.outbox
+	q.preferences = tables.preferences
+}
+
+func (q *fakeQuerier) now() pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: q.clock.Now(), Valid: true}
+}
+
+// sortByVariant orders rows like ORDER BY variant: NULL (the holdout group) last.
+func sortByVariant[T any](rows []T, variant func(T) pgtype.Text) {
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := variant(rows[i]), variant(rows[j])
+		if a.Valid != b.Valid {
+			return a.Valid
+		}
+		return a.String < b.String
+	})
+}
+
+func (q *fakeQuerier) AckTestRun(ctx context.Context, arg sqlc.AckTestRunParams) (sqlc.TestRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.TestRun{}, q.err
+	}
+	testRun, ok := q.testRuns[arg.Nonce]
+	if !ok || testRun.Status != "PENDING" || !testRun.ExpiresAt.Time.After(q.clock.Now()) {
+		return sqlc.TestRun{}, pgx.ErrNoRows
+	}
+	testRun.Status = "ACKED"
+	testRun.AckedAt = q.now()
+	testRun.AckDeviceID = arg.AckDeviceID
+	testRun.AckPlatform = arg.AckPlatform
+	testRun.AckAppVersion = arg.AckAppVersion
+	testRun.AckOsVersion = arg.AckOsVersion
+	testRun.SentAt = arg.SentAt
+	testRun.ReceivedAt = arg.ReceivedAt
+	q.testRuns[arg.Nonce] = testRun
+	q.notifyStatusLocked(arg.Nonce)
+	return testRun, nil
+}
+
+func (q *fakeQuerier) AckTestRunDelivery(ctx context.Context, arg sqlc.AckTestRunDeliveryParams) (sqlc.TestRunDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.TestRunDelivery{}, q.err
+	}
+	key := fakeDeliveryKey{Nonce: arg.Nonce, DeviceID: arg.DeviceID}
+	delivery, ok := q.deliveries[key]
+	if !ok || (delivery.Status != "PENDING" && delivery.Status != "SENT") {
+		return sqlc.TestRunDelivery{}, pgx.ErrNoRows
+	}
+	testRun := q.testRuns[arg.Nonce]
+	if (testRun.Status != "PENDING" && testRun.Status != "ACKED") || !testRun.ExpiresAt.Time.After(q.clock.Now()) {
+		return sqlc.TestRunDelivery{}, pgx.ErrNoRows
+	}
+	delivery.Status = "ACKED"
+	delivery.AckedAt = q.now()
+	delivery.AppVersion = arg.AppVersion
+	delivery.OsVersion = arg.OsVersion
+	delivery.ReceivedAt = arg.ReceivedAt
+	q.deliveries[key] = delivery
+	return delivery, nil
+}
+
+func (q *fakeQuerier) CheckpointBroadcast(ctx context.Context, arg sqlc.CheckpointBroadcastParams) (sqlc.Broadcast, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Broadcast{}, q.err
+	}
+	broadcast, ok := q.broadcasts[arg.BroadcastID]
+	if !ok || broadcast.Status != "RUNNING" || broadcast.LastDeviceID != arg.PreviousDeviceID {
+		return sqlc.Broadcast{}, pgx.ErrNoRows
+	}
+	broadcast.LastDeviceID = arg.LastDeviceID
+	broadcast.SuppressedCount += arg.Suppressed
+	broadcast.LeaseExpiresAt = arg.LeaseExpiresAt
+	broadcast.CompletedAt = pgtype.Timestamptz{}
+	if arg.Completed {
+		broadcast.Status = "COMPLETED"
+		broadcast.CompletedAt = q.now()
+		broadcast.LeaseExpiresAt = pgtype.Timestamptz{}
+	}
+	broadcast.UpdatedAt = q.now()
+	q.broadcasts[arg.BroadcastID] = broadcast
+	return broadcast, nil
+}
+
+func (q *fakeQuerier) RecordBroadcastSends(ctx context.Context, arg sqlc.RecordBroadcastSendsParams) (sqlc.Broadcast, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Broadcast{}, q.err
+	}
+	broadcast, ok := q.broadcasts[arg.BroadcastID]
+	if !ok {
+		return sqlc.Broadcast{}, pgx.ErrNoRows
+	}
+	broadcast.SentCount += arg.Sent
+	broadcast.FailedCount += arg.Failed
+	broadcast.UpdatedAt = q.now()
+	q.broadcasts[arg.BroadcastID] = broadcast
+	return broadcast, nil
+}
+
+func (q *fakeQuerier) ClaimBroadcast(ctx context.Context, arg sqlc.ClaimBroadcastParams) (sqlc.Broadcast, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Broadcast{}, q.err
+	}
+	now := q.clock.Now()
+	var claimed *sqlc.Broadcast
+	for _, broadcast := range q.broadcasts {
+		if broadcast.Status != "RUNNING" || (broadcast.LeaseExpiresAt.Valid && !broadcast.LeaseExpiresAt.Time.Before(now)) {
+			continue
+		}
+		if arg.BroadcastID.Valid && broadcast.BroadcastID != arg.BroadcastID.String {
+			continue
+		}
+		if claimed == nil || broadcast.CreatedAt.Time.Before(claimed.CreatedAt.Time) {
+			broadcast := broadcast
+			claimed = &broadcast
+		}
+	}
+	if claimed == nil {
+		return sqlc.Broadcast{}, pgx.ErrNoRows
+	}
+	claimed.LeaseExpiresAt = arg.LeaseExpiresAt
+	claimed.UpdatedAt = q.now()
+	q.broadcasts[claimed.BroadcastID] = *claimed
+	return *claimed, nil
+}
+
+func (q *fakeQuerier) ClaimOutboxEntries(ctx context.Context, arg sqlc.ClaimOutboxEntriesParams) ([]sqlc.Outbox, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var available []sqlc.Outbox
+	for _, entry := range q.outbox {
+		if !entry.AvailableAt.Time.After(q.clock.Now()) {
+			available = append(available, entry)
+		}
+	}
+	sort.Slice(available, func(i, j int) bool {
+		if !available[i].AvailableAt.Time.Equal(available[j].AvailableAt.Time) {
+			return available[i].AvailableAt.Time.Before(available[j].AvailableAt.Time)
+		}
+		return available[i].OutboxID < available[j].OutboxID
+	})
+	if len(available) > int(arg.LimitCount) {
+		available = available[:arg.LimitCount]
+	}
+	for i, entry := range available {
+		entry.AvailableAt = arg.LeaseExpiresAt
+		entry.Attempts++
+		q.outbox[entry.OutboxID] = entry
+		available[i] = entry
+	}
+	return available, nil
+}
+
+func (q *fakeQuerier) ClaimWebhookDeliveries(ctx context.Context, arg sqlc.ClaimWebhookDeliveriesParams) ([]sqlc.ClaimWebhookDeliveriesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var due []sqlc.WebhookDelivery
+	for _, delivery := range q.webhookDeliveries {
+		if !delivery.NextAttemptAt.Time.After(q.clock.Now()) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Time.Equal(due[j].NextAttemptAt.Time) {
+			return due[i].NextAttemptAt.Time.Before(due[j].NextAttemptAt.Time)
+		}
+		return due[i].DeliveryID < due[j].DeliveryID
+	})
+	if len(due) > int(arg.LimitCount) {
+		due = due[:arg.LimitCount]
+	}
+	rows := make([]sqlc.ClaimWebhookDeliveriesRow, 0, len(due))
+	for _, delivery := range due {
+		delivery.NextAttemptAt = arg.LeaseExpiresAt
+		q.webhookDeliveries[delivery.DeliveryID] = delivery
+		subscription := q.webhookSubscriptions[delivery.SubscriptionID]
+		rows = append(rows, sqlc.ClaimWebhookDeliveriesRow{
+			DeliveryID:     delivery.DeliveryID,
+			SubscriptionID: delivery.SubscriptionID,
+			EventID:        delivery.EventID,
+			EventType:      delivery.EventType,
+			Payload:        delivery.Payload,
+			Attempts:       delivery.Attempts,
+			Url:            subscription.Url,
+			Secret:         subscription.Secret,
+		})
+	}
+	return rows, nil
+}
+
+func (q *fakeQuerier) CountCampaignAssignments(ctx context.Context, campaignID string) ([]sqlc.CountCampaignAssignmentsRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	users := make(map[pgtype.Text]int64)
+	for key, assignment := range q.campaignAssignments {
+		if key.CampaignID == campaignID {
+			users[assignment.Variant]++
+		}
+	}
+	var rows []sqlc.CountCampaignAssignmentsRow
+	for variant, count := range users {
+		rows = append(rows, sqlc.CountCampaignAssignmentsRow{Variant: variant, Users: count})
+	}
+	sortByVariant(rows, func(row sqlc.CountCampaignAssignmentsRow) pgtype.Text { return row.Variant })
+	return rows, nil
+}
+
+func (q *fakeQuerier) CreateBroadcast(ctx context.Context, arg sqlc.CreateBroadcastParams) (sqlc.Broadcast, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Broadcast{}, q.err
+	}
+	if _, ok := q.broadcasts[arg.BroadcastID]; ok {
+		return sqlc.Broadcast{}, fmt.Errorf("duplicate broadcast %s", arg.BroadcastID)
+	}
+	var totalDevices int32
+	for _, device := range q.devices {
+		if device.IsActive && (device.Platform == "android" || device.Platform == "ios") {
+			totalDevices++
+		}
+	}
+	broadcast := sqlc.Broadcast{
+		BroadcastID:  arg.BroadcastID,
+		Message:      arg.Message,
+		BatchSize:    arg.BatchSize,
+		Status:       "RUNNING",
+		TotalDevices: totalDevices,
+		CreatedAt:    q.now(),
+		UpdatedAt:    q.now(),
+	}
+	q.broadcasts[arg.BroadcastID] = broadcast
+	return broadcast, nil
+}
+
+func (q *fakeQuerier) CreateCampaignVariant(ctx context.Context, arg sqlc.CreateCampaignVariantParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if _, ok := q.campaigns[arg.CampaignID]; !ok {
+		return fmt.Errorf("foreign key violation: campaign %s does not exist", arg.CampaignID)
+	}
+	key := fakeCampaignVariantKey{arg.CampaignID, arg.Variant}
+	if _, ok := q.campaignVariants[key]; ok {
+		return fmt.Errorf("duplicate key: campaign variant %+v", key)
+	}
+	if arg.Weight <= 0 {
+		return fmt.Errorf("check violation: weight %d", arg.Weight)
+	}
+	q.campaignVariants[key] = sqlc.CampaignVariant{
+		CampaignID: arg.CampaignID,
+		Variant:    arg.Variant,
+		Weight:     arg.Weight,
+		Title:      arg.Title,
+		Body:       arg.Body,
+		Data:       arg.Data,
+	}
+	return nil
+}
+
+func (q *fakeQuerier) CreateMessage(ctx context.Context, arg sqlc.CreateMessageParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if _, ok := q.messages[arg.MessageID]; ok {
+		return fmt.Errorf("duplicate key: message %s already exists", arg.MessageID)
+	}
+	q.messages[arg.MessageID] = sqlc.Message{MessageID: arg.MessageID, UserID: arg.UserID, CreatedAt: q.now()}
+	return nil
+}
+
+func (q *fakeQuerier) CreateMessageDelivery(ctx context.Context, arg sqlc.CreateMessageDeliveryParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	key := fakeMessageDeliveryKey{MessageID: arg.MessageID, DeviceID: arg.DeviceID}
+	if _, ok := q.messages[arg.MessageID]; !ok {
+		return fmt.Errorf("foreign key violation: message %s does not exist", arg.MessageID)
+	}
+	if _, ok := q.messageDeliveries[key]; ok {
+		return fmt.Errorf("duplicate key: message delivery (%s, %s) already exists", arg.MessageID, arg.DeviceID)
+	}
+	q.messageDeliveries[key] = sqlc.MessageDelivery{
+		MessageID:  arg.MessageID,
+		DeviceID:   arg.DeviceID,
+		Platform:   arg.Platform,
+		AppID:      arg.AppID,
+		Status:     "PENDING",
+		CampaignID: arg.CampaignID,
+		Variant:    arg.Variant,
+	}
+	return nil
+}
+
+func (q *fakeQuerier) CreateNotificationPreference(ctx context.Context, arg sqlc.CreateNotificationPreferenceParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if _, ok := q.categories[arg.Category]; !ok {
+		return fmt.Errorf("foreign key violation: unknown category %s", arg.Category)
+	}
+	key := fakePreferenceKey{arg.UserID, arg.DeviceID, arg.Category}
+	if _, ok := q.preferences[key]; ok {
+		return fmt.Errorf("duplicate key: notification preference %+v", key)
+	}
+	q.preferences[key] = sqlc.NotificationPreference{
+		UserID:    arg.UserID,
+		DeviceID:  arg.DeviceID,
+		Category:  arg.Category,
+		Enabled:   arg.Enabled,
+		UpdatedAt: q.now(),
+	}
+	return nil
+}
+
+func (q *fakeQuerier) CreateOutboxEntry(ctx context.Context, arg sqlc.CreateOutboxEntryParams) (sqlc.Outbox, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Outbox{}, q.err
+	}
+	if q.outboxCapacity > 0 && len(q.outbox) >= q.outboxCapacity {
+		return sqlc.Outbox{}, fmt.Errorf("outbox full: %d entries", len(q.outbox))
+	}
+	q.lastOutboxID++
+	entry := sqlc.Outbox{
+		OutboxID:    q.lastOutboxID,
+		Kind:        arg.Kind,
+		Payload:     arg.Payload,
+		AvailableAt: arg.AvailableAt,
+		CreatedAt:   q.now(),
+	}
+	q.outbox[entry.OutboxID] = entry
+	return entry, nil
+}
+
+func (q *fakeQuerier) CreateTestRun(ctx context.Context, arg sqlc.CreateTestRunParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if _, ok := q.testRuns[arg.Nonce]; ok {
+		return 0, nil // ON CONFLICT (nonce) DO NOTHING
+	}
+	q.testRuns[arg.Nonce] = sqlc.TestRun{
+		Nonce:     arg.Nonce,
+		UserID:    arg.UserID,
+		Status:    "PENDING",
+		CreatedAt: q.now(),
+		ExpiresAt: arg.ExpiresAt,
+	}
+	return 1, nil
+}
+
+func (q *fakeQuerier) CreateTestRunDelivery(ctx context.Context, arg sqlc.CreateTestRunDeliveryParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	key := fakeDeliveryKey{Nonce: arg.Nonce, DeviceID: arg.DeviceID}
+	if _, ok := q.testRuns[arg.Nonce]; !ok {
+		return fmt.Errorf("foreign key violation: test run %s does not exist", arg.Nonce)
+	}
+	if _, ok := q.deliveries[key]; ok {
+		return fmt.Errorf("duplicate key: delivery (%s, %s) already exists", arg.Nonce, arg.DeviceID)
+	}
+	q.deliveries[key] = sqlc.TestRunDelivery{
+		Nonce:    arg.Nonce,
+		DeviceID: arg.DeviceID,
+		Platform: arg.Platform,
+		AppID:    arg.AppID,
+		Status:   "PENDING",
+	}
+	return nil
+}
+
+func (q *fakeQuerier) CreateWebhookSubscription(ctx context.Context, arg sqlc.CreateWebhookSubscriptionParams) (sqlc.WebhookSubscription, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.WebhookSubscription{}, q.err
+	}
+	if _, ok := q.webhookSubscriptions[arg.SubscriptionID]; ok {
+		return sqlc.WebhookSubscription{}, fmt.Errorf("duplicate key: webhook subscription %s already exists", arg.SubscriptionID)
+	}
+	subscription := sqlc.WebhookSubscription{
+		SubscriptionID: arg.SubscriptionID,
+		Url:            arg.Url,
+		EventTypes:     append([]string(nil), arg.EventTypes...),
+		Secret:         arg.Secret,
+		Description:    arg.Description,
+		CreatedAt:      q.now(),
+	}
+	q.webhookSubscriptions[arg.SubscriptionID] = subscription
+	return subscription, nil
+}
+
+func (q *fakeQuerier) DeactivateDeviceToken(ctx context.Context, arg sqlc.DeactivateDeviceTokenParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	var deactivated int64
+	for i, device := range q.devices {
+		if device.DeviceID == arg.DeviceID && device.FcmToken == arg.FcmToken && device.IsActive {
+			q.devices[i].IsActive = false
+			q.devices[i].UpdatedAt = q.now()
+			deactivated++
+		}
+	}
+	return deactivated, nil
+}
+
+func (q *fakeQuerier) DeadLetterWebhookDelivery(ctx context.Context, arg sqlc.DeadLetterWebhookDeliveryParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	delivery, ok := q.webhookDeliveries[arg.DeliveryID]
+	if !ok {
+		return 0, nil
+	}
+	delete(q.webhookDeliveries, arg.DeliveryID)
+	q.webhookDeadLetters[arg.DeliveryID] = sqlc.WebhookDeadLetter{
+		DeliveryID:     delivery.DeliveryID,
+		SubscriptionID: delivery.SubscriptionID,
+		EventID:        delivery.EventID,
+		EventType:      delivery.EventType,
+		Payload:        delivery.Payload,
+		Attempts:       delivery.Attempts + 1,
+		LastError:      arg.LastError,
+		CreatedAt:      delivery.CreatedAt,
+		FailedAt:       q.now(),
+	}
+	return 1, nil
+}
+
+// expire marks a PENDING run past its expiry as EXPIRED; the caller holds q.mu.
+func (q *fakeQuerier) DeleteCampaign(ctx context.Context, campaignID string) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if _, ok := q.campaigns[campaignID]; !ok {
+		return 0, nil
+	}
+	delete(q.campaigns, campaignID)
+	for key := range q.campaignVariants {
+		if key.CampaignID == campaignID {
+			delete(q.campaignVariants, key)
+		}
+	}
+	for key := range q.campaignAssignments {
+		if key.CampaignID == campaignID {
+			delete(q.campaignAssignments, key)
+		}
+	}
+	return 1, nil
+}
+
+func (q *fakeQuerier) DeleteCampaignVariants(ctx context.Context, campaignID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	for key := range q.campaignVariants {
+		if key.CampaignID == campaignID {
+			delete(q.campaignVariants, key)
+		}
+	}
+	return nil
+}
+
+func (q *fakeQuerier) DeleteNotificationPreferences(ctx context.Context, userID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	for key := range q.preferences {
+		if key.UserID == userID {
+			delete(q.preferences, key)
+		}
+	}
+	return nil
+}
+
+func (q *fakeQuerier) DeleteOutboxEntry(ctx context.Context, outboxID int64) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if _, ok := q.outbox[outboxID]; !ok {
+		return 0, nil
+	}
+	delete(q.outbox, outboxID)
+	return 1, nil
+}
+
+func (q *fakeQuerier) DeleteSegment(ctx context.Context, segmentID string) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if _, ok := q.segments[segmentID]; !ok {
+		return 0, nil
+	}
+	delete(q.segments, segmentID)
+	return 1, nil
+}
+
+func (q *fakeQuerier) DeleteTemplate(ctx context.Context, arg sqlc.DeleteTemplateParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	key := fakeTemplateKey{arg.TemplateKey, arg.Locale}
+	if _, ok := q.templates[key]; !ok {
+		return 0, nil
+	}
+	delete(q.templates, key)
+	return 1, nil
+}
+
+func (q *fakeQuerier) expire(testRun sqlc.TestRun) (sqlc.TestRun, bool) {
+	if testRun.Status != "PENDING" || testRun.ExpiresAt.Time.After(q.clock.Now()) {
+		return testRun, false
+	}
+	testRun.Status = "EXPIRED"
+	testRun.FailureReason = pgtype.Text{String: "no ack received before expires_at", Valid: true}
+	q.testRuns[testRun.Nonce] = testRun
+	q.notifyStatusLocked(testRun.Nonce)
+	return testRun, true
+}
+
+func (q *fakeQuerier) DeleteWebhookDelivery(ctx context.Context, deliveryID int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	delete(q.webhookDeliveries, deliveryID)
+	return nil
+}
+
+func (q *fakeQuerier) DeleteWebhookSubscription(ctx context.Context, subscriptionID string) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if _, ok := q.webhookSubscriptions[subscriptionID]; !ok {
+		return 0, nil
+	}
+	delete(q.webhookSubscriptions, subscriptionID)
+	for deliveryID, delivery := range q.webhookDeliveries {
+		if delivery.SubscriptionID == subscriptionID {
+			delete(q.webhookDeliveries, deliveryID)
+		}
+	}
+	for deliveryID, deadLetter := range q.webhookDeadLetters {
+		if deadLetter.SubscriptionID == subscriptionID {
+			delete(q.webhookDeadLetters, deliveryID)
+		}
+	}
+	return 1, nil
+}
+
+func (q *fakeQuerier) EnqueueWebhookEvent(ctx context.Context, arg sqlc.EnqueueWebhookEventParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	subscriptionIDs := make([]string, 0, len(q.webhookSubscriptions))
+	for subscriptionID, subscription := range q.webhookSubscriptions {
+		if slices.Contains(subscription.EventTypes, arg.EventType) {
+			subscriptionIDs = append(subscriptionIDs, subscriptionID)
+		}
+	}
+	sort.Strings(subscriptionIDs)
+	for _, subscriptionID := range subscriptionIDs {
+		q.lastWebhookDeliveryID++
+		q.webhookDeliveries[q.lastWebhookDeliveryID] = sqlc.WebhookDelivery{
+			DeliveryID:     q.lastWebhookDeliveryID,
+			SubscriptionID: subscriptionID,
+			EventID:        arg.EventID,
+			EventType:      arg.EventType,
+			Payload:        arg.Payload,
+			NextAttemptAt:  q.now(),
+			CreatedAt:      q.now(),
+		}
+	}
+	return int64(len(subscriptionIDs)), nil
+}
+
+func (q *fakeQuerier) ExpirePendingTestRuns(ctx context.Context) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	var expired int64
+	for _, testRun := range q.testRuns {
+		if _, ok := q.expire(testRun); ok {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (q *fakeQuerier) ExpireTestRun(ctx context.Context, nonce string) (sqlc.TestRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.TestRun{}, q.err
+	}
+	testRun, ok := q.expire(q.testRuns[nonce])
+	if !ok {
+		return sqlc.TestRun{}, pgx.ErrNoRows
+	}
+	return testRun, nil
+}
+
+func (q *fakeQuerier) FailBroadcast(ctx context.Context, arg sqlc.FailBroadcastParams) (sqlc.Broadcast, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Broadcast{}, q.err
+	}
+	broadcast, ok := q.broadcasts[arg.BroadcastID]
+	if !ok || broadcast.Status != "RUNNING" {
+		return sqlc.Broadcast{}, pgx.ErrNoRows
+	}
+	broadcast.Status = "FAILED"
+	broadcast.FailureReason = arg.FailureReason
+	broadcast.LeaseExpiresAt = pgtype.Timestamptz{}
+	broadcast.CompletedAt = q.now()
+	broadcast.UpdatedAt = q.now()
+	q.broadcasts[arg.BroadcastID] = broadcast
+	return broadcast, nil
+}
+
+func (q *fakeQuerier) GetBroadcast(ctx context.Context, broadcastID string) (sqlc.Broadcast, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Broadcast{}, q.err
+	}
+	broadcast, ok := q.broadcasts[broadcastID]
+	if !ok {
+		return sqlc.Broadcast{}, pgx.ErrNoRows
+	}
+	return broadcast, nil
+}
+
+func (q *fakeQuerier) GetCampaign(ctx context.Context, campaignID string) (sqlc.Campaign, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Campaign{}, q.err
+	}
+	campaign, ok := q.campaigns[campaignID]
+	if !ok {
+		return sqlc.Campaign{}, pgx.ErrNoRows
+	}
+	return campaign, nil
+}
+
+func (q *fakeQuerier) GetCampaignDeliveryStats(ctx context.Context, campaignID string) ([]sqlc.GetCampaignDeliveryStatsRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	stats := make(map[pgtype.Text]*sqlc.GetCampaignDeliveryStatsRow)
+	openedUsers := make(map[pgtype.Text]map[string]bool)
+	for key, delivery := range q.messageDeliveries {
+		if !delivery.CampaignID.Valid || delivery.CampaignID.String != campaignID {
+			continue
+		}
+		row, ok := stats[delivery.Variant]
+		if !ok {
+			row = &sqlc.GetCampaignDeliveryStatsRow{Variant: delivery.Variant}
+			stats[delivery.Variant] = row
+			openedUsers[delivery.Variant] = make(map[string]bool)
+		}
+		row.Deliveries++
+		switch delivery.Status {
+		case "SENT":
+			row.Sent++
+		case "SEND_FAILED":
+			row.Failed++
+		}
+		if delivery.DeliveredAt.Valid {
+			row.Delivered++
+		}
+		if delivery.OpenedAt.Valid {
+			row.Opened++
+			openedUsers[delivery.Variant][q.messages[key.MessageID].UserID] = true
+		}
+	}
+	var rows []sqlc.GetCampaignDeliveryStatsRow
+	for variant, row := range stats {
+		row.OpenedUsers = int64(len(openedUsers[variant]))
+		rows = append(rows, *row)
+	}
+	sortByVariant(rows, func(row sqlc.GetCampaignDeliveryStatsRow) pgtype.Text { return row.Variant })
+	return rows, nil
+}
+
+func (q *fakeQuerier) GetDeviceByDeviceID(ctx context.Context, deviceID string) (sqlc.GetDeviceByDeviceIDRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.GetDeviceByDeviceIDRow{}, q.err
+	}
+	for _, device := range q.devices {
+		if device.DeviceID == deviceID {
+			return sqlc.GetDeviceByDeviceIDRow{
+				UserID:    device.UserID,
+				DeviceID:  device.DeviceID,
+				Platform:  device.Platform,
+				AppID:     device.AppID,
+				FcmToken:  device.FcmToken,
+				IsActive:  device.IsActive,
+				UpdatedAt: device.UpdatedAt,
+			}, nil
+		}
+	}
+	return sqlc.GetDeviceByDeviceIDRow{}, pgx.ErrNoRows
+}
+
+func (q *fakeQuerier) GetMessageDelivery(ctx context.Context, arg sqlc.GetMessageDeliveryParams) (sqlc.MessageDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.MessageDelivery{}, q.err
+	}
+	delivery, ok := q.messageDeliveries[fakeMessageDeliveryKey{MessageID: arg.MessageID, DeviceID: arg.DeviceID}]
+	if !ok {
+		return sqlc.MessageDelivery{}, pgx.ErrNoRows
+	}
+	return delivery, nil
+}
+
+func (q *fakeQuerier) GetNotificationCategory(ctx context.Context, category string) (sqlc.NotificationCategory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.NotificationCategory{}, q.err
+	}
+	notificationCategory, ok := q.categories[category]
+	if !ok {
+		return sqlc.NotificationCategory{}, pgx.ErrNoRows
+	}
+	return notificationCategory, nil
+}
+
+func (q *fakeQuerier) GetSegment(ctx context.Context, segmentID string) (sqlc.Segment, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Segment{}, q.err
+	}
+	segment, ok := q.segments[segmentID]
+	if !ok {
+		return sqlc.Segment{}, pgx.ErrNoRows
+	}
+	return segment, nil
+}
+
+func (q *fakeQuerier) GetTemplate(ctx context.Context, arg sqlc.GetTemplateParams) (sqlc.Template, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Template{}, q.err
+	}
+	template, ok := q.templates[fakeTemplateKey{arg.TemplateKey, arg.Locale}]
+	if !ok {
+		return sqlc.Template{}, pgx.ErrNoRows
+	}
+	return template, nil
+}
+
+func (q *fakeQuerier) GetTestRunByNonce(ctx context.Context, nonce string) (sqlc.TestRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.TestRun{}, q.err
+	}
+	testRun, ok := q.testRuns[nonce]
+	if !ok {
+		return sqlc.TestRun{}, pgx.ErrNoRows
+	}
+	return testRun, nil
+}
+
+func (q *fakeQuerier) GetTestRunStats(ctx context.Context, arg sqlc.GetTestRunStatsParams) (sqlc.GetTestRunStatsRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.GetTestRunStatsRow{}, q.err
+	}
+	var row sqlc.GetTestRunStatsRow
+	var latencies []float64
+	for _, testRun := range q.testRuns {
+		if (arg.UserID.Valid && testRun.UserID != arg.UserID.String) ||
+			testRun.CreatedAt.Time.Before(arg.Since.Time) || !testRun.CreatedAt.Time.Before(arg.Until.Time) {
+			continue
+		}
+		row.Total++
+		switch testRun.Status {
+		case testRunStatusAcked:
+			row.Acked++
+			sentAt := testRun.CreatedAt
+			if testRun.SentAt.Valid {
+				sentAt = testRun.SentAt
+			}
+			latencies = append(latencies, float64(testRun.AckedAt.Time.Sub(sentAt.Time).Microseconds())/1000)
+		case testRunStatusPending:
+			row.Pending++
+		case testRunStatusExpired:
+			row.Expired++
+		case testRunStatusSendFailed:
+			row.SendFailed++
+		}
+	}
+	sort.Float64s(latencies)
+	row.P50AckLatencyMs = percentileCont(latencies, 0.5)
+	row.P95AckLatencyMs = percentileCont(latencies, 0.95)
+	return row, nil
+}
+
+// percentileCont interpolates like Postgres percentile_cont over sorted values, 0 if there are none.
+func percentileCont(sorted []float64, fraction float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	position := fraction * float64(len(sorted)-1)
+	lower := int(position)
+	if lower == len(sorted)-1 {
+		return sorted[lower]
+	}
+	return sorted[lower] + (position-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+func (q *fakeQuerier) GetWebhookSubscription(ctx context.Context, subscriptionID string) (sqlc.WebhookSubscription, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.WebhookSubscription{}, q.err
+	}
+	subscription, ok := q.webhookSubscriptions[subscriptionID]
+	if !ok {
+		return sqlc.WebhookSubscription{}, pgx.ErrNoRows
+	}
+	return subscription, nil
+}
+
+func (q *fakeQuerier) ListActiveDevicesByPlatforms(ctx context.Context, userID string) ([]sqlc.ListActiveDevicesByPlatformsRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var rows []sqlc.ListActiveDevicesByPlatformsRow
+	for _, device := range q.devices {
+		if device.UserID != userID || !device.IsActive || (device.Platform != "android" && device.Platform != "ios") {
+			continue
+		}
+		rows = append(rows, sqlc.ListActiveDevicesByPlatformsRow{
+			UserID:    device.UserID,
+			DeviceID:  device.DeviceID,
+			Platform:  device.Platform,
+			AppID:     device.AppID,
+			FcmToken:  device.FcmToken,
+			TokenType: device.TokenType,
+			Locale:    device.Locale,
+			IsActive:  device.IsActive,
+			UpdatedAt: device.UpdatedAt,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].DeviceID < rows[j].DeviceID })
+	return rows, nil
+}
+
+func (q *fakeQuerier) ListBroadcastDevices(ctx context.Context, arg sqlc.ListBroadcastDevicesParams) ([]sqlc.ListBroadcastDevicesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var rows []sqlc.ListBroadcastDevicesRow
+	for _, device := range q.devices {
+		if !device.IsActive || (device.Platform != "android" && device.Platform != "ios") || device.ID <= arg.AfterID {
+			continue
+		}
+		rows = append(rows, sqlc.ListBroadcastDevicesRow{
+			ID:        device.ID,
+			UserID:    device.UserID,
+			DeviceID:  device.DeviceID,
+			Platform:  device.Platform,
+			AppID:     device.AppID,
+			FcmToken:  device.FcmToken,
+			TokenType: device.TokenType,
+			Locale:    device.Locale,
+			IsActive:  device.IsActive,
+			UpdatedAt: device.UpdatedAt,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	if len(rows) > int(arg.LimitCount) {
+		rows = rows[:arg.LimitCount]
+	}
+	return rows, nil
+}
+
+func (q *fakeQuerier) ListBroadcasts(ctx context.Context, limitCount int32) ([]sqlc.Broadcast, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var broadcasts []sqlc.Broadcast
+	for _, broadcast := range q.broadcasts {
+		broadcasts = append(broadcasts, broadcast)
+	}
+	sort.Slice(broadcasts, func(i, j int) bool {
+		if !broadcasts[i].CreatedAt.Time.Equal(broadcasts[j].CreatedAt.Time) {
+			return broadcasts[i].CreatedAt.Time.After(broadcasts[j].CreatedAt.Time)
+		}
+		return broadcasts[i].BroadcastID < broadcasts[j].BroadcastID
+	})
+	if len(broadcasts) > int(limitCount) {
+		broadcasts = broadcasts[:limitCount]
+	}
+	return broadcasts, nil
+}
+
+func (q *fakeQuerier) ListCampaignVariants(ctx context.Context, campaignID pgtype.Text) ([]sqlc.CampaignVariant, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var variants []sqlc.CampaignVariant
+	for key, variant := range q.campaignVariants {
+		if !campaignID.Valid || key.CampaignID == campaignID.String {
+			variants = append(variants, variant)
+		}
+	}
+	sort.Slice(variants, func(i, j int) bool {
+		if variants[i].CampaignID != variants[j].CampaignID {
+			return variants[i].CampaignID < variants[j].CampaignID
+		}
+		return variants[i].Variant < variants[j].Variant
+	})
+	return variants, nil
+}
+
+func (q *fakeQuerier) ListCampaigns(ctx context.Context) ([]sqlc.Campaign, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var campaigns []sqlc.Campaign
+	for _, campaign := range q.campaigns {
+		campaigns = append(campaigns, campaign)
+	}
+	sort.Slice(campaigns, func(i, j int) bool { return campaigns[i].CampaignID < campaigns[j].CampaignID })
+	return campaigns, nil
+}
+
+func (q *fakeQuerier) ListDevices(ctx context.Context, arg sqlc.ListDevicesParams) ([]sqlc.ListDevicesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	matches := func(filter pgtype.Text, value string) bool {
+		return !filter.Valid || filter.String == value
+	}
+	var rows []sqlc.ListDevicesRow
+	for _, device := range q.devices {
+		if !matches(arg.UserID, device.UserID) || !matches(arg.Platform, device.Platform) ||
+			!matches(arg.AppID, device.AppID) || device.ID <= arg.AfterID ||
+			(arg.AppVersion.Valid && device.AppVersion != arg.AppVersion) ||
+			(arg.OsVersion.Valid && device.OsVersion != arg.OsVersion) ||
+			(arg.Locale.Valid && device.Locale != arg.Locale) ||
+			(arg.Timezone.Valid && device.Timezone != arg.Timezone) ||
+			(arg.IsActive.Valid && device.IsActive != arg.IsActive.Bool) {
+			continue
+		}
+		rows = append(rows, sqlc.ListDevicesRow{
+			ID:          device.ID,
+			UserID:      device.UserID,
+			DeviceID:    device.DeviceID,
+			Platform:    device.Platform,
+			AppID:       device.AppID,
+			TokenType:   device.TokenType,
+			Locale:      device.Locale,
+			AppVersion:  device.AppVersion,
+			OsVersion:   device.OsVersion,
+			DeviceModel: device.DeviceModel,
+			Timezone:    device.Timezone,
+			SdkVersion:  device.SdkVersion,
+			IsActive:    device.IsActive,
+			UpdatedAt:   device.UpdatedAt,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	if len(rows) > int(arg.LimitCount) {
+		rows = rows[:arg.LimitCount]
+	}
+	return rows, nil
+}
+
+func (q *fakeQuerier) ListNotificationCategories(ctx context.Context) ([]sqlc.NotificationCategory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var categories []sqlc.NotificationCategory
+	for _, category := range q.categories {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].Category < categories[j].Category })
+	return categories, nil
+}
+
+func (q *fakeQuerier) ListNotificationPreferences(ctx context.Context, userID string) ([]sqlc.NotificationPreference, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var preferences []sqlc.NotificationPreference
+	for key, preference := range q.preferences {
+		if key.UserID == userID {
+			preferences = append(preferences, preference)
+		}
+	}
+	sort.Slice(preferences, func(i, j int) bool {
+		if preferences[i].DeviceID != preferences[j].DeviceID {
+			return preferences[i].DeviceID < preferences[j].DeviceID
+		}
+		return preferences[i].Category < preferences[j].Category
+	})
+	return preferences, nil
+}
+
+func (q *fakeQuerier) ListSegments(ctx context.Context) ([]sqlc.Segment, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var segments []sqlc.Segment
+	for _, segment := range q.segments {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].SegmentID < segments[j].SegmentID })
+	return segments, nil
+}
+
+func (q *fakeQuerier) ListTemplates(ctx context.Context, templateKey pgtype.Text) ([]sqlc.Template, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var templates []sqlc.Template
+	for key, template := range q.templates {
+		if !templateKey.Valid || key.TemplateKey == templateKey.String {
+			templates = append(templates, template)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].TemplateKey != templates[j].TemplateKey {
+			return templates[i].TemplateKey < templates[j].TemplateKey
+		}
+		return templates[i].Locale < templates[j].Locale
+	})
+	return templates, nil
+}
+
+func (q *fakeQuerier) ListTestRunDeliveries(ctx context.Context, nonce string) ([]sqlc.TestRunDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var deliveries []sqlc.TestRunDelivery
+	for key, delivery := range q.deliveries {
+		if key.Nonce == nonce {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].DeviceID < deliveries[j].DeviceID })
+	return deliveries, nil
+}
+
+func (q *fakeQuerier) ListTestRuns(ctx context.Context, arg sqlc.ListTestRunsParams) ([]sqlc.TestRun, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var testRuns []sqlc.TestRun
+	for _, testRun := range q.testRuns {
+		if (arg.UserID.Valid && testRun.UserID != arg.UserID.String) ||
+			(arg.Status.Valid && testRun.Status != arg.Status.String) ||
+			testRun.CreatedAt.Time.Before(arg.Since.Time) {
+			continue
+		}
+		if arg.CursorCreatedAt.Valid && !testRunBefore(testRun, arg.CursorCreatedAt.Time, arg.CursorNonce.String) {
+			continue
+		}
+		testRuns = append(testRuns, testRun)
+	}
+	sort.Slice(testRuns, func(i, j int) bool {
+		return testRunBefore(testRuns[j], testRuns[i].CreatedAt.Time, testRuns[i].Nonce)
+	})
+	if len(testRuns) > int(arg.LimitCount) {
+		testRuns = testRuns[:arg.LimitCount]
+	}
+	return testRuns, nil
+}
+
+// testRunBefore reports whether (created_at, nonce) of testRun sorts before (createdAt, nonce).
+func testRunBefore(testRun sqlc.TestRun, createdAt time.Time, nonce string) bool {
+	if !testRun.CreatedAt.Time.Equal(createdAt) {
+		return testRun.CreatedAt.Time.Before(createdAt)
+	}
+	return testRun.Nonce < nonce
+}
+
+func (q *fakeQuerier) ListWebhookDeadLetters(ctx context.Context, arg sqlc.ListWebhookDeadLettersParams) ([]sqlc.WebhookDeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	var deadLetters []sqlc.WebhookDeadLetter
+	for _, deadLetter := range q.webhookDeadLetters {
+		if deadLetter.SubscriptionID == arg.SubscriptionID {
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	}
+	sort.Slice(deadLetters, func(i, j int) bool {
+		if !deadLetters[i].FailedAt.Time.Equal(deadLetters[j].FailedAt.Time) {
+			return deadLetters[i].FailedAt.Time.After(deadLetters[j].FailedAt.Time)
+		}
+		return deadLetters[i].DeliveryID > deadLetters[j].DeliveryID
+	})
+	if len(deadLetters) > int(arg.LimitCount) {
+		deadLetters = deadLetters[:arg.LimitCount]
+	}
+	return deadLetters, nil
+}
+
+func (q *fakeQuerier) ListWebhookSubscriptions(ctx context.Context) ([]sqlc.WebhookSubscription, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	subscriptions := make([]sqlc.WebhookSubscription, 0, len(q.webhookSubscriptions))
+	for _, subscription := range q.webhookSubscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if !subscriptions[i].CreatedAt.Time.Equal(subscriptions[j].CreatedAt.Time) {
+			return subscriptions[i].CreatedAt.Time.Before(subscriptions[j].CreatedAt.Time)
+		}
+		return subscriptions[i].SubscriptionID < subscriptions[j].SubscriptionID
+	})
+	return subscriptions, nil
+}
+
+func (q *fakeQuerier) MarkMessageDeliverySendFailed(ctx context.Context, arg sqlc.MarkMessageDeliverySendFailedParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	key := fakeMessageDeliveryKey{MessageID: arg.MessageID, DeviceID: arg.DeviceID}
+	delivery, ok := q.messageDeliveries[key]
+	if !ok || delivery.Status != "PENDING" {
+		return nil
+	}
+	delivery.Status = "SEND_FAILED"
+	delivery.FailureReason = arg.FailureReason
+	q.messageDeliveries[key] = delivery
+	return nil
+}
+
+func (q *fakeQuerier) MarkMessageDeliverySent(ctx context.Context, arg sqlc.MarkMessageDeliverySentParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	key := fakeMessageDeliveryKey{MessageID: arg.MessageID, DeviceID: arg.DeviceID}
+	delivery, ok := q.messageDeliveries[key]
+	if !ok || delivery.Status != "PENDING" {
+		return nil
+	}
+	delivery.Status = "SENT"
+	delivery.SentAt = q.now()
+	q.messageDeliveries[key] = delivery
+	return nil
+}
+
+func (q *fakeQuerier) MarkTestRunDeliverySendFailed(ctx context.Context, arg sqlc.MarkTestRunDeliverySendFailedParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	key := fakeDeliveryKey{Nonce: arg.Nonce, DeviceID: arg.DeviceID}
+	delivery, ok := q.deliveries[key]
+	if !ok || delivery.Status != "PENDING" {
+		return nil
+	}
+	delivery.Status = "SEND_FAILED"
+	delivery.FailureReason = arg.FailureReason
+	q.deliveries[key] = delivery
+	return nil
+}
+
+func (q *fakeQuerier) MarkTestRunDeliverySent(ctx context.Context, arg sqlc.MarkTestRunDeliverySentParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	key := fakeDeliveryKey{Nonce: arg.Nonce, DeviceID: arg.DeviceID}
+	delivery, ok := q.deliveries[key]
+	if !ok || (delivery.Status != "PENDING" && delivery.Status != "ACKED") {
+		return nil
+	}
+	if delivery.Status == "PENDING" {
+		delivery.Status = "SENT"
+	}
+	delivery.SentAt = q.now()
+	q.deliveries[key] = delivery
+	return nil
+}
+
+func (q *fakeQuerier) MarkTestRunSendFailed(ctx context.Context, arg sqlc.MarkTestRunSendFailedParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	testRun, ok := q.testRuns[arg.Nonce]
+	if !ok || testRun.Status != "PENDING" {
+		return nil
+	}
+	testRun.Status = "SEND_FAILED"
+	testRun.FailureReason = arg.FailureReason
+	q.testRuns[arg.Nonce] = testRun
+	q.notifyStatusLocked(arg.Nonce)
+	return nil
+}
+
+func (q *fakeQuerier) RecordMessageReceipt(ctx context.Context, arg sqlc.RecordMessageReceiptParams) (sqlc.MessageDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.MessageDelivery{}, q.err
+	}
+	key := fakeMessageDeliveryKey{MessageID: arg.MessageID, DeviceID: arg.DeviceID}
+	delivery, ok := q.messageDeliveries[key]
+	if !ok || (delivery.Status != "PENDING" && delivery.Status != "SENT") {
+		return sqlc.MessageDelivery{}, pgx.ErrNoRows
+	}
+	firstTime := func(t *pgtype.Timestamptz) {
+		if !t.Valid {
+			*t = q.now()
+		}
+	}
+	firstTime(&delivery.DeliveredAt)
+	switch arg.Event {
+	case "opened":
+		firstTime(&delivery.OpenedAt)
+	case "dismissed":
+		firstTime(&delivery.DismissedAt)
+	}
+	q.messageDeliveries[key] = delivery
+	return delivery, nil
+}
+
+func (q *fakeQuerier) ReleaseBroadcast(ctx context.Context, arg sqlc.ReleaseBroadcastParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	broadcast, ok := q.broadcasts[arg.BroadcastID]
+	if !ok || broadcast.Status != "RUNNING" || !broadcast.LeaseExpiresAt.Valid || !broadcast.LeaseExpiresAt.Time.Equal(arg.LeaseExpiresAt.Time) {
+		return nil
+	}
+	broadcast.LeaseExpiresAt = pgtype.Timestamptz{}
+	broadcast.UpdatedAt = q.now()
+	q.broadcasts[arg.BroadcastID] = broadcast
+	return nil
+}
+
+func (q *fakeQuerier) RetryOutboxEntry(ctx context.Context, arg sqlc.RetryOutboxEntryParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	entry, ok := q.outbox[arg.OutboxID]
+	if !ok {
+		return nil
+	}
+	entry.AvailableAt = arg.AvailableAt
+	entry.LastError = arg.LastError
+	q.outbox[arg.OutboxID] = entry
+	return nil
+}
+
+func (q *fakeQuerier) RetryWebhookDelivery(ctx context.Context, arg sqlc.RetryWebhookDeliveryParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	delivery, ok := q.webhookDeliveries[arg.DeliveryID]
+	if !ok {
+		return nil
+	}
+	delivery.Attempts++
+	delivery.NextAttemptAt = arg.NextAttemptAt
+	delivery.LastError = arg.LastError
+	q.webhookDeliveries[arg.DeliveryID] = delivery
+	return nil
+}
+
+func (q *fakeQuerier) UpsertCampaign(ctx context.Context, arg sqlc.UpsertCampaignParams) (sqlc.Campaign, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Campaign{}, q.err
+	}
+	if _, ok := q.categories[arg.Category]; !ok {
+		return sqlc.Campaign{}, fmt.Errorf("foreign key violation: unknown category %s", arg.Category)
+	}
+	campaign, ok := q.campaigns[arg.CampaignID]
+	if !ok {
+		campaign = sqlc.Campaign{CampaignID: arg.CampaignID, CreatedAt: q.now()}
+	}
+	campaign.Description = arg.Description
+	campaign.Category = arg.Category
+	campaign.HoldoutPercent = arg.HoldoutPercent
+	campaign.UpdatedAt = q.now()
+	q.campaigns[arg.CampaignID] = campaign
+	return campaign, nil
+}
+
+func (q *fakeQuerier) UpsertCampaignAssignment(ctx context.Context, arg sqlc.UpsertCampaignAssignmentParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if _, ok := q.campaigns[arg.CampaignID]; !ok {
+		return fmt.Errorf("foreign key violation: campaign %s does not exist", arg.CampaignID)
+	}
+	key := fakeCampaignAssignmentKey{arg.CampaignID, arg.UserID}
+	assignment, ok := q.campaignAssignments[key]
+	if !ok {
+		assignment = sqlc.CampaignAssignment{CampaignID: arg.CampaignID, UserID: arg.UserID, AssignedAt: q.now()}
+	}
+	assignment.Variant = arg.Variant
+	q.campaignAssignments[key] = assignment
+	return nil
+}
+
+func (q *fakeQuerier) UpsertDevice(ctx context.Context, arg sqlc.UpsertDeviceParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	for i, device := range q.devices {
+		if device.UserID == arg.UserID && device.DeviceID == arg.DeviceID {
+			q.devices[i].AppID = arg.AppID
+			q.devices[i].FcmToken = arg.FcmToken
+			q.devices[i].TokenType = arg.TokenType
+			q.devices[i].Locale = arg.Locale
+			q.devices[i].AppVersion = arg.AppVersion
+			q.devices[i].OsVersion = arg.OsVersion
+			q.devices[i].DeviceModel = arg.DeviceModel
+			q.devices[i].Timezone = arg.Timezone
+			q.devices[i].SdkVersion = arg.SdkVersion
+			q.devices[i].IsActive = true
+			q.devices[i].UpdatedAt = q.now()
+			return nil
+		}
+	}
+	q.devices = append(q.devices, sqlc.Device{
+		ID:          int32(len(q.devices) + 1),
+		UserID:      arg.UserID,
+		DeviceID:    arg.DeviceID,
+		Platform:    arg.Platform,
+		AppID:       arg.AppID,
+		FcmToken:    arg.FcmToken,
+		TokenType:   arg.TokenType,
+		Locale:      arg.Locale,
+		AppVersion:  arg.AppVersion,
+		OsVersion:   arg.OsVersion,
+		DeviceModel: arg.DeviceModel,
+		Timezone:    arg.Timezone,
+		SdkVersion:  arg.SdkVersion,
+		IsActive:    true,
+		UpdatedAt:   q.now(),
+	})
+	return nil
+}
+
+func (q *fakeQuerier) UpsertSegment(ctx context.Context, arg sqlc.UpsertSegmentParams) (sqlc.Segment, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Segment{}, q.err
+	}
+	segment, ok := q.segments[arg.SegmentID]
+	if !ok {
+		segment = sqlc.Segment{SegmentID: arg.SegmentID, CreatedAt: q.now()}
+	}
+	segment.Description = arg.Description
+	segment.Expression = arg.Expression
+	segment.UpdatedAt = q.now()
+	q.segments[arg.SegmentID] = segment
+	return segment, nil
+}
+
+func (q *fakeQuerier) UpsertTemplate(ctx context.Context, arg sqlc.UpsertTemplateParams) (sqlc.Template, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return sqlc.Template{}, q.err
+	}
+	key := fakeTemplateKey{arg.TemplateKey, arg.Locale}
+	template, ok := q.templates[key]
+	if !ok {
+		template = sqlc.Template{TemplateKey: arg.TemplateKey, Locale: arg.Locale, CreatedAt: q.now()}
+	}
+	template.Title = arg.Title
+	template.Body = arg.Body
+	template.DefaultData = arg.DefaultData
+	template.UpdatedAt = q.now()
+	q.templates[key] = template
+	return template, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// FCMSender delivers messages to FCM registration tokens of the Firebase project identified by creds
+type FCMSender interface {
+	Send(ctx context.Context, creds *common.FCMCredentials, message PushMessage) error
+}
+
+// defaultFCMAPIBaseURL is the FCM HTTP v1 API endpoint
+const defaultFCMAPIBaseURL = "https://fcm.googleapis.com"
+
+// fcmAPIBaseURL returns the FCM API base URL.
+// FCM_API_BASE_URL overrides it, e.g. to point at a fake FCM server in tests.
+func fcmAPIBaseURL() string {
+	if baseURL := os.Getenv("FCM_API_BASE_URL"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	return defaultFCMAPIBaseURL
+}
+
+// accessTokenRefreshMargin is how long before expiry a cached access token is replaced
+const accessTokenRefreshMargin = 5 * time.Minute
+
+// cachedAccessToken is an OAuth2 access token together with its expiry
+type cachedAccessToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// httpFCMSender sends messages with the FCM HTTP v1 API.
+// OAuth2 access tokens are cached per service account, so warm invocations
+// don't exchange a new JWT for every request.
+type httpFCMSender struct {
+	baseURL string
+	client  *http.Client
+	clock   Clock
+
+	mu     sync.Mutex
+	tokens map[string]cachedAccessToken // Key: client_email + private_key_id
+}
+
+// newHTTPFCMSender creates a sender for the FCM API at baseURL (see fcmAPIBaseURL)
+func newHTTPFCMSender(baseURL string, clock Clock) *httpFCMSender {
+	return &httpFCMSender{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		clock:   clock,
+		tokens:  make(map[string]cachedAccessToken),
+	}
+}
+
+// Send sends a push notification to a single device using FCM HTTP v1 API
+func (s *httpFCMSender) Send(ctx context.Context, creds *common.FCMCredentials, message PushMessage) error {
+	accessToken, err := s.accessToken(ctx, creds)
+	if err != nil {
+		return err
+	}
+
+	// Build FCM message payload
+	payload := map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": message.Token,
+			"notification": map[string]string{
+				"title": message.Title,
+				"body":  message.Body,
+			},
+		},
+	}
+
+	// Add data if provided
+	if len(message.Data) > 0 {
+		payload["message"].(map[string]interface{})["data"] = message.Data
+	}
+
+	// Marshal request body
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	// Build FCM API URL
+	fcmURL := fmt.Sprintf("%s/v1/projects/%s/messages:send", s.baseURL, creds.ProjectID)
+
+	// Create HTTP request
+	req, err := http.NewRequestWithContext(ctx, "POST", fcmURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	// Send request
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Read response body
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	// Check response status
+	// FCM answers 404 with error code UNREGISTERED; a 404 without it is a wrong URL or project
+	if resp.StatusCode == http.StatusNotFound && bytes.Contains(responseBody, []byte("UNREGISTERED")) {
+		return fmt.Errorf("%w: project=%s, status=%d, body=%s", errPushTokenUnregistered, creds.ProjectID, resp.StatusCode, string(responseBody))
+	}
+	if isRejectedStatus(resp.StatusCode) {
+		return fmt.Errorf("%w: project=%s, status=%d, body=%s", errPushMessageRejected, creds.ProjectID, resp.StatusCode, string(responseBody))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("FCM API returned error: project=%s, status=%d, body=%s", creds.ProjectID, resp.StatusCode, string(responseBody))
+	}
+
+	return nil
+}
+
+// accessToken returns a cached access token for creds, generating a new one when needed
+func (s *httpFCMSender) accessToken(ctx context.Context, creds *common.FCMCredentials) (string, error) {
+	key := creds.ClientEmail + "|" + creds.PrivateKeyID
+
+	s.mu.Lock()
+	cached, ok := s.tokens[key]
+	s.mu.Unlock()
+	if ok && s.clock.Now().Before(cached.expiresAt.Add(-accessTokenRefreshMargin)) {
+		return cached.token, nil
+	}
+
+	token, expiresIn, err := s.generateAccessToken(ctx, creds)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate access token for project %s: %w", creds.ProjectID, err)
+	}
+
+	s.mu.Lock()
+	s.tokens[key] = cachedAccessToken{token: token, expiresAt: s.clock.Now().Add(expiresIn)}
+	s.mu.Unlock()
+
+	return token, nil
+}
+
+// generateAccessToken generates an OAuth2 access token from FCM service account credentials
+func (s *httpFCMSender) generateAccessToken(ctx context.Context, creds *common.FCMCredentials) (string, time.Duration, error) {
+	// Parse RSA private key from PEM format
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", 0, fmt.Errorf("failed to decode PEM block from private key")
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	rsaPrivateKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", 0, fmt.Errorf("private key is not RSA")
+	}
+
+	// Create JWT claims
+	now := s.clock.Now()
+	claims := jwt.MapClaims{
+		"iss":   creds.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/firebase.messaging",
+		"aud":   creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(1 * time.Hour).Unix(),
+	}
+
+	// Create and sign JWT
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = creds.PrivateKeyID
+
+	jwtString, err := token.SignedString(rsaPrivateKey)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to sign JWT: %w", err)
+	}
+
+	// Exchange JWT for access token
+	data := url.Values{}
+	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	data.Set("assertion", jwtString)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", creds.TokenURI, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create token request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to request access token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", 0, fmt.Errorf("failed to get access token: status=%d, body=%s", resp.StatusCode, string(body))
+	}
+
+	// Parse response
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", 0, fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	return tokenResponse.AccessToken, time.Duration(tokenResponse.ExpiresIn) * time.Second, nil
+}
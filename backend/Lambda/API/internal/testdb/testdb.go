@@ -0,0 +1,209 @@
+// Package testdb provides an ephemeral Postgres for tests.
+//
+// Start uses TEST_DATABASE_URL if set. Otherwise it runs initdb/pg_ctl from a local
+// Postgres installation (POSTGRES_BIN_DIR, PATH or /usr/lib/postgresql/*/bin) in a
+// temporary directory. The server only listens on a Unix socket, so no network is needed.
+// Each call to NewDatabase creates a fresh database with all migrations applied.
+package testdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fcm-tutorial/schema"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrUnavailable is returned by Start when no Postgres can be used. Tests should skip.
+var ErrUnavailable = errors.New("no Postgres available: set TEST_DATABASE_URL or install Postgres (POSTGRES_BIN_DIR)")
+
+// Server is a running Postgres server used by tests.
+type Server struct {
+	adminURL string // Connection string of the server's maintenance database
+	dir      string // Temp directory with data and socket (ephemeral server) or empty (TEST_DATABASE_URL)
+	pgCtl    string // Path to pg_ctl for ephemeral servers
+	dataDir  string // Data directory for ephemeral servers
+
+	databases []string
+}
+
+var databaseCounter atomic.Int64
+
+// Start returns a Postgres server for tests, or ErrUnavailable.
+func Start(ctx context.Context) (*Server, error) {
+	if adminURL := os.Getenv("TEST_DATABASE_URL"); adminURL != "" {
+		return &Server{adminURL: adminURL}, nil
+	}
+
+	binDir, err := findPostgresBinDir()
+	if err != nil {
+		return nil, err
+	}
+
+	// initdb refuses to run as root
+	if os.Geteuid() == 0 {
+		return nil, fmt.Errorf("%w (cannot run initdb as root)", ErrUnavailable)
+	}
+
+	dir, err := os.MkdirTemp("", "fcm-testdb-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+
+	server := &Server{
+		dir:     dir,
+		pgCtl:   filepath.Join(binDir, "pg_ctl"),
+		dataDir: filepath.Join(dir, "data"),
+	}
+	server.adminURL = fmt.Sprintf("host=%s port=5432 user=postgres dbname=postgres sslmode=disable", dir)
+
+	initdb := exec.CommandContext(ctx, filepath.Join(binDir, "initdb"),
+		"-D", server.dataDir, "-U", "postgres", "--auth=trust", "--encoding=UTF8", "--no-sync")
+	if output, err := initdb.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("initdb failed: %w\n%s", err, output)
+	}
+
+	// listen_addresses='' disables TCP: only the Unix socket in dir is used
+	start := exec.CommandContext(ctx, server.pgCtl, "start", "-w",
+		"-D", server.dataDir,
+		"-l", filepath.Join(dir, "postgres.log"),
+		"-o", fmt.Sprintf("-c listen_addresses='' -k %s -p 5432 -c fsync=off", dir))
+	if output, err := start.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("pg_ctl start failed: %w\n%s", err, output)
+	}
+
+	return server, nil
+}
+
+// findPostgresBinDir locates a directory containing initdb and pg_ctl.
+func findPostgresBinDir() (string, error) {
+	var candidates []string
+	if dir := os.Getenv("POSTGRES_BIN_DIR"); dir != "" {
+		candidates = append(candidates, dir)
+	}
+	if path, err := exec.LookPath("pg_ctl"); err == nil {
+		candidates = append(candidates, filepath.Dir(path))
+	}
+	// Debian/Ubuntu install the binaries outside PATH; prefer the newest version
+	versioned, _ := filepath.Glob("/usr/lib/postgresql/*/bin")
+	sort.Sort(sort.Reverse(sort.StringSlice(versioned)))
+	candidates = append(candidates, versioned...)
+
+	for _, dir := range candidates {
+		if isExecutable(filepath.Join(dir, "initdb")) && isExecutable(filepath.Join(dir, "pg_ctl")) {
+			return dir, nil
+		}
+	}
+	return "", ErrUnavailable
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0o111 != 0
+}
+
+// NewDatabase creates a new, empty database, applies all migrations and returns its connection string.
+func (s *Server) NewDatabase(ctx context.Context) (string, error) {
+	name := fmt.Sprintf("fcm_test_%d_%d", os.Getpid(), databaseCounter.Add(1))
+
+	admin, err := pgx.Connect(ctx, s.adminURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to test server: %w", err)
+	}
+	defer admin.Close(ctx)
+
+	if _, err := admin.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{name}.Sanitize()); err != nil {
+		return "", fmt.Errorf("failed to create database %s: %w", name, err)
+	}
+	s.databases = append(s.databases, name)
+
+	dbURL, err := s.databaseURL(name)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := pgx.Connect(ctx, dbURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to database %s: %w", name, err)
+	}
+	defer conn.Close(ctx)
+
+	migrations, err := schema.Migrations()
+	if err != nil {
+		return "", err
+	}
+	for _, migration := range migrations {
+		if _, err := conn.Exec(ctx, migration.Up); err != nil {
+			return "", fmt.Errorf("failed to apply migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return dbURL, nil
+}
+
+// databaseURL returns the connection URL of database name on this server.
+func (s *Server) databaseURL(name string) (string, error) {
+	config, err := pgx.ParseConfig(s.adminURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse admin connection string: %w", err)
+	}
+
+	query := url.Values{}
+	query.Set("sslmode", "disable")
+	if config.TLSConfig != nil {
+		query.Set("sslmode", "require")
+	}
+
+	u := url.URL{Scheme: "postgres", Path: "/" + name}
+	if strings.HasPrefix(config.Host, "/") {
+		// Unix socket directory
+		query.Set("host", config.Host)
+		query.Set("port", strconv.Itoa(int(config.Port)))
+	} else {
+		u.Host = net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	}
+	if config.Password != "" {
+		u.User = url.UserPassword(config.User, config.Password)
+	} else {
+		u.User = url.User(config.User)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Stop drops the databases created by NewDatabase and stops an ephemeral server.
+func (s *Server) Stop(ctx context.Context) error {
+	if s.pgCtl == "" {
+		// External server: only clean up our databases
+		admin, err := pgx.Connect(ctx, s.adminURL)
+		if err != nil {
+			return err
+		}
+		defer admin.Close(ctx)
+		for _, name := range s.databases {
+			admin.Exec(ctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{name}.Sanitize()+" WITH (FORCE)")
+		}
+		return nil
+	}
+
+	stop := exec.CommandContext(ctx, s.pgCtl, "stop", "-D", s.dataDir, "-m", "immediate")
+	output, err := stop.CombinedOutput()
+	os.RemoveAll(s.dir)
+	if err != nil {
+		return fmt.Errorf("pg_ctl stop failed: %w\n%s", err, output)
+	}
+	return nil
+}
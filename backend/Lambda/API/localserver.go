@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+)
+
+// maxLocalRequestBodyBytes matches the API Gateway payload limit (10 MB)
+const maxLocalRequestBodyBytes = 10 << 20
+
+// runLocalServer serves all API routes over plain HTTP on addr (e.g. ":8080")
+// until SIGINT/SIGTERM, so the handlers can be run without deploying to AWS.
+func runLocalServer(addr string, service *Service) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	routes := apiRoutes(service)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newLocalServerMux(routes),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("[INFO] Local API server listening on %s", addr)
+		for _, route := range routes {
+			log.Printf("[INFO]   %s %s", route.method, route.resource)
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("[INFO] Shutting down local API server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down local server: %w", err)
+	}
+	return common.CloseDBConnection()
+}
+
+// newLocalServerMux registers every route on a new ServeMux
+func newLocalServerMux(routes []apiRoute) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.Handle(route.method+" "+route.resource, adaptAPIGatewayHandler(route.resource, route.handler))
+	}
+	return mux
+}
+
+// adaptAPIGatewayHandler converts a net/http request into an APIGatewayProxyRequest,
+// invokes the Lambda handler and writes its APIGatewayProxyResponse back
+func adaptAPIGatewayHandler(resource string, handler apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLocalRequestBodyBytes))
+		if err != nil {
+			http.Error(w, `{"message":"Request body too large"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		request := events.APIGatewayProxyRequest{
+			Resource:                        resource,
+			Path:                            r.URL.Path,
+			HTTPMethod:                      r.Method,
+			Headers:                         make(map[string]string, len(r.Header)),
+			MultiValueHeaders:               make(map[string][]string, len(r.Header)),
+			QueryStringParameters:           make(map[string]string),
+			MultiValueQueryStringParameters: make(map[string][]string),
+			Body:                            string(body),
+			RequestContext: events.APIGatewayProxyRequestContext{
+				RequestID:    fmt.Sprintf("local-%d", time.Now().UnixNano()),
+				Stage:        "local",
+				ResourcePath: resource,
+				Path:         r.URL.Path,
+				HTTPMethod:   r.Method,
+				Identity: events.APIGatewayRequestIdentity{
+					SourceIP:  r.RemoteAddr,
+					UserAgent: r.UserAgent(),
+				},
+			},
+		}
+
+		// Path parameters use the same {name} syntax in API Gateway resources and ServeMux patterns
+		for _, name := range resourcePathParameters(resource) {
+			if request.PathParameters == nil {
+				request.PathParameters = make(map[string]string)
+			}
+			request.PathParameters[name] = r.PathValue(name)
+		}
+
+		// API Gateway passes the last value in Headers and all values in MultiValueHeaders
+		for name, values := range r.Header {
+			request.Headers[name] = values[len(values)-1]
+			request.MultiValueHeaders[name] = values
+		}
+		for name, values := range r.URL.Query() {
+			request.QueryStringParameters[name] = values[len(values)-1]
+			request.MultiValueQueryStringParameters[name] = values
+		}
+
+		response, err := handler(r.Context(), request)
+		if err != nil {
+			// API Gateway returns 502 when the Lambda function itself fails
+			log.Printf("[ERROR] Handler for %s %s failed: %v", r.Method, resource, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			io.WriteString(w, `{"message":"Internal server error"}`)
+			return
+		}
+
+		for name, value := range response.Headers {
+			w.Header().Set(name, value)
+		}
+		for name, values := range response.MultiValueHeaders {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+
+		responseBody := []byte(response.Body)
+		if response.IsBase64Encoded {
+			responseBody, err = base64.StdEncoding.DecodeString(response.Body)
+			if err != nil {
+				log.Printf("[ERROR] Invalid base64 response body for %s %s: %v", r.Method, resource, err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		}
+
+		statusCode := response.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		w.WriteHeader(statusCode)
+		w.Write(responseBody)
+
+		log.Printf("[INFO] %s %s -> %d", r.Method, strings.TrimSuffix(r.URL.RequestURI(), "?"), statusCode)
+	}
+}
+
+// resourcePathParameters returns the names of the {name} segments of an API Gateway resource
+func resourcePathParameters(resource string) []string {
+	var names []string
+	for _, segment := range strings.Split(resource, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, strings.Trim(segment, "{}"))
+		}
+	}
+	return names
+}
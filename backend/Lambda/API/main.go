@@ -1,25 +1,53 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
 
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 func main() {
+	// Dependencies are created once per execution environment and shared by all invocations
+	service, err := newServiceFromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to initialize: %v", err)
+	}
+
+	// LOCAL_HTTP=:8080 serves all routes over plain HTTP instead of running as a Lambda
+	if addr := os.Getenv("LOCAL_HTTP"); addr != "" {
+		if err := runLocalServer(addr, service); err != nil {
+			log.Fatalf("[ERROR] Local server failed: %v", err)
+		}
+		return
+	}
+
 	// Select handler based on LAMBDA_HANDLER environment variable
 	// Default to RegisterDeviceHandler for backward compatibility
 	handler := os.Getenv("LAMBDA_HANDLER")
 	switch handler {
 	case "SendMessageHandler", "send":
-		lambda.Start(SendMessageHandler)
+		lambda.Start(service.SendMessageHandler)
 	case "TestAckHandler", "ack":
-		lambda.Start(TestAckHandler)
+		lambda.Start(service.TestAckHandler)
 	case "TestStatusHandler", "status":
-		lambda.Start(TestStatusHandler)
+		lambda.Start(service.TestStatusHandler)
+	case "SweepTestRunsHandler", "sweep":
+		lambda.Start(service.SweepTestRunsHandler)
+	case "BroadcastHandler", "broadcast":
+		lambda.Start(service.BroadcastHandler)
+	case "WebhookHandler", "webhook":
+		lambda.Start(service.WebhookHandler)
+	case "RelayHandler", "relay":
+		lambda.Start(service.RelayHandler)
+	case "ProbeHandler", "probe":
+		lambda.Start(service.ProbeHandler)
+	case "RouterHandler", "api":
+		lambda.Start(service.RouterHandler)
 	case "RegisterDeviceHandler", "register", "":
-		lambda.Start(RegisterDeviceHandler)
+		lambda.Start(service.RegisterDeviceHandler)
 	default:
-		lambda.Start(RegisterDeviceHandler)
+		lambda.Start(service.RegisterDeviceHandler)
 	}
 }
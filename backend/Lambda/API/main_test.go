@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/credentials"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/internal/testdb"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Shared test environment, set up once in TestMain
+var (
+	testDatabaseURL string // Empty if no Postgres is available
+	testDBSkipMsg   string
+	testFCM         *fakeFCM
+	testService     *Service // Production wiring, configured through the environment
+)
+
+// TestMain starts an ephemeral Postgres (if available) and a fake FCM server,
+// and configures the handlers to use them through environment variables.
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	ctx := context.Background()
+
+	testFCM = newFakeFCM()
+	defer testFCM.Close()
+
+	creds, err := testFCM.credentialsJSON("test-project")
+	if err != nil {
+		log.Fatalf("failed to create fake FCM credentials: %v", err)
+	}
+
+	// Secrets come from environment variables instead of Secrets Manager
+	os.Setenv("SECRETS_BACKEND", credentials.SecretsBackendEnv)
+	os.Setenv("SECRET_ARN", "TEST_FCM_CREDENTIALS")
+	os.Setenv("TEST_FCM_CREDENTIALS", creds)
+	os.Setenv("ACK_TOKEN_SECRET_ARN", "TEST_ACK_TOKEN_KEY")
+	os.Setenv("TEST_ACK_TOKEN_KEY", testAckTokenKey)
+	os.Setenv("FCM_API_BASE_URL", testFCM.URL())
+	os.Setenv("WEBHOOK_ALLOW_PRIVATE_ADDRESSES", "true")
+
+	server, err := testdb.Start(ctx)
+	switch {
+	case errors.Is(err, testdb.ErrUnavailable):
+		testDBSkipMsg = err.Error()
+	case err != nil:
+		log.Fatalf("failed to start test database: %v", err)
+	default:
+		defer server.Stop(ctx)
+		testDatabaseURL, err = server.NewDatabase(ctx)
+		if err != nil {
+			log.Fatalf("failed to create test database: %v", err)
+		}
+	}
+
+	// Without Postgres, handlers fail fast when they try to connect
+	if testDatabaseURL != "" {
+		os.Setenv("DATABASE_URL", testDatabaseURL)
+	} else {
+		os.Setenv("DATABASE_URL", unreachableDatabaseURL)
+	}
+	defer common.CloseDBConnection()
+
+	testService, err = newServiceFromEnv(ctx)
+	if err != nil {
+		log.Fatalf("failed to create service: %v", err)
+	}
+	testService.WebhookClient = testWebhookClient(true)
+
+	return m.Run()
+}
+
+// unreachableDatabaseURL points at a port nothing listens on, used to exercise 500 paths
+const unreachableDatabaseURL = "postgres://postgres@127.0.0.1:1/unreachable?sslmode=disable&connect_timeout=1"
+
+// requireDB skips the test if no Postgres is available, and otherwise
+// empties all tables and resets the fake FCM server.
+func requireDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	if testDatabaseURL == "" {
+		t.Skip(testDBSkipMsg)
+	}
+
+	testFCM.Reset()
+
+	db, err := common.GetDBConnection(context.Background())
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+	if _, err := db.Exec(context.Background(), "TRUNCATE devices, test_runs, test_run_deliveries, messages, message_deliveries, templates, notification_preferences, segments, broadcasts, campaigns, campaign_variants, campaign_assignments, webhook_subscriptions, webhook_deliveries, webhook_dead_letters, outbox RESTART IDENTITY"); err != nil {
+		t.Fatalf("failed to reset test database: %v", err)
+	}
+	return db
+}
+
+// withUnreachableDatabase makes GetDBConnection fail for the rest of the test.
+func withUnreachableDatabase(t *testing.T) {
+	t.Helper()
+	common.CloseDBConnection()
+	t.Setenv("DATABASE_URL", unreachableDatabaseURL)
+	t.Cleanup(func() { common.CloseDBConnection() })
+}
+
+// invoke calls a handler with a JSON body and query parameters, like API Gateway would.
+func invoke(t *testing.T, handler apiHandler, body string, query map[string]string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Body:                  body,
+		QueryStringParameters: query,
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return response
+}
+
+// expectStatus fails the test if the response does not have the expected status code.
+func expectStatus(t *testing.T, response events.APIGatewayProxyResponse, statusCode int) {
+	t.Helper()
+	if response.StatusCode != statusCode {
+		t.Fatalf("expected status %d, got %d: %s", statusCode, response.StatusCode, response.Body)
+	}
+}
+
+// decodeBody unmarshals the response body into v.
+func decodeBody(t *testing.T, response events.APIGatewayProxyResponse, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(response.Body), v); err != nil {
+		t.Fatalf("failed to decode response body %q: %v", response.Body, err)
+	}
+}
+
+// fakeFCMMessage is a message received by the fake FCM server.
+type fakeFCMMessage struct {
+	ProjectID string
+	Token     string
+	Title     string
+	Body      string
+	Data      map[string]string
+}
+
+// fakeFCM is an httptest server implementing the OAuth2 token endpoint
+// and the FCM HTTP v1 messages:send endpoint.
+type fakeFCM struct {
+	server *httptest.Server
+
+	mu            sync.Mutex
+	messages      []fakeFCMMessage
+	failTokens    map[string]int // FCM token -> HTTP status returned for it
+	tokenRequests int            // Number of access tokens issued
+}
+
+const fakeFCMAccessToken = "fake-access-token"
+
+func newFakeFCM() *fakeFCM {
+	f := &fakeFCM{failTokens: make(map[string]int)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeFCM) URL() string { return f.server.URL }
+
+func (f *fakeFCM) Close() { f.server.Close() }
+
+// Reset forgets received messages and configured failures.
+func (f *fakeFCM) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = nil
+	f.failTokens = make(map[string]int)
+	f.tokenRequests = 0
+}
+
+// FailToken makes sends to token return the given HTTP status; 404 reports the token as UNREGISTERED.
+func (f *fakeFCM) FailToken(token string, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failTokens[token] = status
+}
+
+// Messages returns the messages received so far.
+func (f *fakeFCM) Messages() []fakeFCMMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeFCMMessage(nil), f.messages...)
+}
+
+// TokenRequests returns the number of access tokens issued so far.
+func (f *fakeFCM) TokenRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tokenRequests
+}
+
+// credentialsJSON returns a service account JSON whose token_uri points at the fake server.
+func (f *fakeFCM) credentialsJSON(projectID string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := json.Marshal(common.FCMCredentials{
+		Type:         "service_account",
+		ProjectID:    projectID,
+		PrivateKeyID: "test-key",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "fcm@" + projectID + ".iam.gserviceaccount.com",
+		TokenURI:     f.server.URL + "/token",
+	})
+	return string(creds), err
+}
+
+func (f *fakeFCM) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/token" {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("assertion") == "" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.tokenRequests++
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":3600}`, fakeFCMAccessToken)
+		return
+	}
+
+	// /v1/projects/{project}/messages:send
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 4 || parts[0] != "v1" || parts[1] != "projects" || parts[3] != "messages:send" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+fakeFCMAccessToken {
+		http.Error(w, `{"error":{"status":"UNAUTHENTICATED"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		Message struct {
+			Token        string            `json:"token"`
+			Notification map[string]string `json:"notification"`
+			Data         map[string]string `json:"data"`
+		} `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error":{"status":"INVALID_ARGUMENT"}}`, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	status, fail := f.failTokens[request.Message.Token]
+	if !fail {
+		f.messages = append(f.messages, fakeFCMMessage{
+			ProjectID: parts[2],
+			Token:     request.Message.Token,
+			Title:     request.Message.Notification["title"],
+			Body:      request.Message.Notification["body"],
+			Data:      request.Message.Data,
+		})
+	}
+	f.mu.Unlock()
+
+	if fail && status == http.StatusNotFound {
+		http.Error(w, `{"error":{"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`, status)
+		return
+	}
+	if fail {
+		http.Error(w, `{"error":{"status":"UNAVAILABLE"}}`, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"name":"projects/%s/messages/%d"}`, parts[2], len(f.Messages()))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// CloudWatch Embedded Metric Format (EMF): a JSON log line with an "_aws" section
+// describing which of its fields are metrics. Lambda ships stdout to CloudWatch Logs,
+// which extracts the metrics without any PutMetricData calls.
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+
+// Units of EMF metrics
+const (
+	metricUnitCount        = "Count"
+	metricUnitMilliseconds = "Milliseconds"
+)
+
+// metric is one metric value of an EMF document
+type metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// emfMetricDefinition describes a metric in the "_aws" section
+type emfMetricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string                `json:"Namespace"`
+	Dimensions [][]string            `json:"Dimensions"`
+	Metrics    []emfMetricDefinition `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"` // Milliseconds since the epoch
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// writeEMF writes metrics as a single EMF log line.
+// All dimensions form one dimension set; properties are searchable in Logs Insights but are not metrics.
+func writeEMF(w io.Writer, timestamp time.Time, namespace string, dimensions map[string]string, metrics []metric, properties map[string]interface{}) error {
+	document := make(map[string]interface{}, len(dimensions)+len(metrics)+len(properties)+1)
+	for name, value := range properties {
+		document[name] = value
+	}
+
+	dimensionNames := make([]string, 0, len(dimensions))
+	for name, value := range dimensions {
+		dimensionNames = append(dimensionNames, name)
+		document[name] = value
+	}
+	sort.Strings(dimensionNames)
+
+	definitions := make([]emfMetricDefinition, 0, len(metrics))
+	for _, m := range metrics {
+		definitions = append(definitions, emfMetricDefinition{Name: m.Name, Unit: m.Unit})
+		document[m.Name] = m.Value
+	}
+
+	document["_aws"] = emfMetadata{
+		Timestamp: timestamp.UnixMilli(),
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  namespace,
+			Dimensions: [][]string{dimensionNames},
+			Metrics:    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("failed to marshal EMF document: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", line)
+	return err
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Side effects of domain changes, FCM sends and webhook events, go through the outbox table.
+// A handler writes them as outbox entries in the transaction of the change (enqueueOutbox), so
+// either both or neither are committed, and publishes them once the transaction has committed.
+// Entries are written with available_at at the end of outboxLease: RelayHandler, which runs on a
+// schedule, publishes the entries their writer did not, because it failed, crashed or timed out.
+//
+// Publishing is at least once. Duplicates are avoided where possible: an FCM send is skipped if
+// its delivery is no longer PENDING, and of two invocations publishing the same entry only the
+// first to delete it commits its changes (see DeleteOutboxEntry). A message can still be sent
+// twice if an invocation stops between the send and its commit, so devices dedupe on
+// data.message_id, as webhook receivers do on X-Webhook-ID.
+
+// Outbox entry kinds
+const (
+	outboxFCMSend      = "fcm_send"      // A message to one device, see fcmSendPayload
+	outboxWebhookEvent = "webhook_event" // A WebhookEvent to enqueue for the subscriptions to its type
+)
+
+const (
+	// outboxLease is how long the relay leaves an entry to the invocation that wrote or claimed it.
+	// It must exceed the time an API request takes to publish its entries.
+	outboxLease = 2 * time.Minute
+	// outboxMaxAttempts is the number of relay attempts before an entry is given up
+	outboxMaxAttempts = 5
+	// outboxInitialBackoff is the delay after the first failed relay attempt; it doubles after every attempt
+	outboxInitialBackoff = 30 * time.Second
+	// outboxMaxBackoff caps the delay between relay attempts
+	outboxMaxBackoff = 10 * time.Minute
+	// outboxBatchSize is the number of entries claimed at a time
+	outboxBatchSize = 20
+	// outboxEntryMargin is the time publishing an entry may take, the FCM request timeout;
+	// the relay publishes no entry with less time left
+	outboxEntryMargin = 30 * time.Second
+	// outboxWorkerTime is how long RelayHandler publishes without a Lambda deadline
+	outboxWorkerTime = 5 * time.Minute
+	// fcmSendConcurrency bounds the sends in flight when a request publishes its fcm_send entries
+	fcmSendConcurrency = 20
+)
+
+// errOutboxEntryFailed wraps the error of a side effect that failed for good, e.g. a message FCM
+// rejected (see isFinalPushError): the failure was recorded and the entry deleted, so it is not retried
+var errOutboxEntryFailed = errors.New("outbox entry failed")
+
+// errOutboxEntryPublished rolls back the changes of publishing an entry that another invocation
+// published first
+var errOutboxEntryPublished = errors.New("outbox entry already published")
+
+// fcmSendPayload is the payload of fcm_send entries: a message to one device
+type fcmSendPayload struct {
+	MessageID string        `json:"message_id"`
+	Device    fcmSendDevice `json:"device"`
+	Title     string        `json:"title"`
+	Body      string        `json:"body"`
+	// Without the receipt and ack tokens, which are signed when the message is sent
+	Data       map[string]string `json:"data"`
+	CampaignID string            `json:"campaign_id,omitempty"`
+	Variant    string            `json:"variant,omitempty"`
+	// e2e test messages only: the test run, and when its ack token expires (Unix time)
+	Nonce             string `json:"nonce,omitempty"`
+	AckTokenExpiresAt int64  `json:"ack_token_expires_at,omitempty"`
+}
+
+// fcmSendDevice is the device of an fcm_send entry. Entries can outlive the version that wrote
+// them, so their format is defined here rather than by a generated row type.
+type fcmSendDevice struct {
+	DeviceID  string `json:"device_id"`
+	UserID    string `json:"user_id"`
+	Platform  string `json:"platform"`
+	AppID     string `json:"app_id"`
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	Locale    string `json:"locale,omitempty"`
+}
+
+func newFCMSendDevice(device sqlc.ListActiveDevicesByPlatformsRow) fcmSendDevice {
+	return fcmSendDevice{
+		DeviceID:  device.DeviceID,
+		UserID:    device.UserID,
+		Platform:  device.Platform,
+		AppID:     device.AppID,
+		Token:     device.FcmToken,
+		TokenType: device.TokenType,
+		Locale:    device.Locale.String,
+	}
+}
+
+// messageEvent is the data of the message.sent and message.failed events of the send
+func (p fcmSendPayload) messageEvent() MessageEventData {
+	return MessageEventData{
+		MessageID:  p.MessageID,
+		UserID:     p.Device.UserID,
+		DeviceID:   p.Device.DeviceID,
+		Platform:   p.Device.Platform,
+		AppID:      p.Device.AppID,
+		CampaignID: p.CampaignID,
+		Variant:    p.Variant,
+		Nonce:      p.Nonce,
+	}
+}
+
+// RelayResult is returned by RelayHandler
+type RelayResult struct {
+	Published int `json:"published"` // Entries published
+	Failed    int `json:"failed"`    // Entries whose side effect failed for good, or that were given up
+	Retried   int `json:"retried"`   // Entries whose publishing failed and will be retried
+}
+
+// RelayHandler is the Lambda handler that publishes the outbox entries their writers did not,
+// until there are none or the Lambda deadline is near. It runs on an EventBridge schedule, so
+// the event payload is ignored.
+func (s *Service) RelayHandler(ctx context.Context) (*RelayResult, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Relaying outbox entries")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		logger.Error(ctx, err, "Database connection failed")
+		return nil, fmt.Errorf("database connection failed: %w", err)
+	}
+
+	stopAt := broadcastStopAt(ctx, outboxWorkerTime)
+	result := &RelayResult{}
+	for time.Until(stopAt) >= outboxEntryMargin {
+		entries, err := queries.ClaimOutboxEntries(ctx, sqlc.ClaimOutboxEntriesParams{
+			LeaseExpiresAt: pgtype.Timestamptz{Time: s.Clock.Now().Add(outboxLease), Valid: true},
+			LimitCount:     outboxBatchSize,
+		})
+		if err != nil {
+			logger.Error(ctx, err, "Failed to claim outbox entries")
+			return result, fmt.Errorf("failed to claim outbox entries: %w", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			// Entries left unpublished are claimed again once their lease expires
+			if time.Until(stopAt) < outboxEntryMargin {
+				break
+			}
+			err := s.publishOutboxEntry(ctx, logger, entry)
+			if err := s.recordRelayAttempt(ctx, logger, queries, entry, err, result); err != nil {
+				logger.Error(ctx, err, "Failed to record relay attempt: outbox_id=%d", entry.OutboxID)
+				return result, fmt.Errorf("failed to record relay attempt: %w", err)
+			}
+		}
+	}
+
+	logger.Info(ctx, "Relayed %d outbox entries, %d failed, %d to retry", result.Published, result.Failed, result.Retried)
+
+	return result, nil
+}
+
+// recordRelayAttempt schedules the next attempt of an entry that could not be published, or gives
+// it up after its last attempt. Published and failed entries have been deleted already.
+func (s *Service) recordRelayAttempt(ctx context.Context, logger *common.Logger, queries sqlc.Querier, entry sqlc.Outbox, publishErr error, result *RelayResult) error {
+	if publishErr == nil {
+		result.Published++
+		return nil
+	}
+	if errors.Is(publishErr, errOutboxEntryFailed) {
+		result.Failed++
+		return nil
+	}
+
+	if entry.Attempts >= outboxMaxAttempts {
+		logger.Error(ctx, publishErr, "Outbox entry given up after %d attempts: outbox_id=%d, kind=%s", entry.Attempts, entry.OutboxID, entry.Kind)
+		result.Failed++
+		return s.giveUpOutboxEntry(ctx, logger, entry, fmt.Errorf("given up after %d attempts: %w", entry.Attempts, publishErr))
+	}
+
+	backoff := outboxBackoff(int(entry.Attempts))
+	logger.Info(ctx, "Outbox entry attempt %d failed, retrying in %s: outbox_id=%d, kind=%s, error=%v",
+		entry.Attempts, backoff, entry.OutboxID, entry.Kind, publishErr)
+	result.Retried++
+	return queries.RetryOutboxEntry(ctx, sqlc.RetryOutboxEntryParams{
+		OutboxID:    entry.OutboxID,
+		AvailableAt: pgtype.Timestamptz{Time: s.Clock.Now().Add(backoff), Valid: true},
+		LastError:   optionalText(publishErr.Error()),
+	})
+}
+
+// giveUpOutboxEntry deletes an entry that could not be published. A message that was never sent
+// is recorded as SEND_FAILED, so the delivery and the test run don't stay PENDING.
+func (s *Service) giveUpOutboxEntry(ctx context.Context, logger *common.Logger, entry sqlc.Outbox, reason error) error {
+	var followUps []sqlc.Outbox
+	err := s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		if _, err := queries.DeleteOutboxEntry(ctx, entry.OutboxID); err != nil {
+			return err
+		}
+		var payload fcmSendPayload
+		if entry.Kind != outboxFCMSend || json.Unmarshal(entry.Payload, &payload) != nil {
+			return nil
+		}
+		var err error
+		followUps, err = s.recordFCMSend(ctx, logger, queries, payload, reason)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.publishOutbox(ctx, logger, followUps)
+	return nil
+}
+
+// outboxBackoff is the delay after the given number of failed relay attempts:
+// outboxInitialBackoff doubled after every attempt, up to outboxMaxBackoff
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxInitialBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, outboxMaxBackoff)
+}
+
+// enqueueOutbox writes an entry in the caller's transaction, for the caller to publish once the
+// transaction has committed. The relay leaves it alone for outboxLease.
+func (s *Service) enqueueOutbox(ctx context.Context, queries sqlc.Querier, kind string, payload any) (sqlc.Outbox, error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return sqlc.Outbox{}, fmt.Errorf("failed to encode %s outbox entry: %w", kind, err)
+	}
+	return queries.CreateOutboxEntry(ctx, sqlc.CreateOutboxEntryParams{
+		Kind:        kind,
+		Payload:     encoded,
+		AvailableAt: pgtype.Timestamptz{Time: s.Clock.Now().Add(outboxLease), Valid: true},
+	})
+}
+
+// publishOutbox publishes entries written by a committed transaction. Errors are only logged:
+// the domain change has been made, and the relay publishes the entries later.
+func (s *Service) publishOutbox(ctx context.Context, logger *common.Logger, entries []sqlc.Outbox) {
+	for _, entry := range entries {
+		if err := s.publishOutboxEntry(ctx, logger, entry); err != nil {
+			logger.Error(ctx, err, "Failed to publish outbox entry: outbox_id=%d, kind=%s", entry.OutboxID, entry.Kind)
+		}
+	}
+}
+
+// fcmSendCounts are the outcomes of publishing fcm_send entries
+type fcmSendCounts struct {
+	Sent    int
+	Failed  int // Failed for good and recorded on the delivery
+	Retried int // Failed transiently and left to the relay
+}
+
+// publishFCMSends publishes the fcm_send entries written by a committed transaction, up to
+// concurrency at a time, and counts the outcomes
+func (s *Service) publishFCMSends(ctx context.Context, logger *common.Logger, entries []sqlc.Outbox, concurrency int) fcmSendCounts {
+	errs := make([]error, len(entries))
+	inFlight := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		inFlight <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			errs[i] = s.publishFCMSend(ctx, logger, entry)
+		}()
+	}
+	wg.Wait()
+
+	var counts fcmSendCounts
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			counts.Sent++
+		case errors.Is(err, errOutboxEntryFailed):
+			counts.Failed++
+		default:
+			counts.Retried++
+		}
+		if err != nil {
+			logger.Error(ctx, err, "Failed to send message: outbox_id=%d", entries[i].OutboxID)
+		}
+	}
+	return counts
+}
+
+// publishOutboxEntry performs the side effect of an entry and deletes it. An error wrapping
+// errOutboxEntryFailed means the entry was deleted too; after any other error it is kept.
+func (s *Service) publishOutboxEntry(ctx context.Context, logger *common.Logger, entry sqlc.Outbox) error {
+	switch entry.Kind {
+	case outboxFCMSend:
+		return s.publishFCMSend(ctx, logger, entry)
+	case outboxWebhookEvent:
+		return s.publishWebhookEvent(ctx, logger, entry)
+	default:
+		// Possibly written by a newer version during a deployment
+		return fmt.Errorf("unknown outbox entry kind: %s", entry.Kind)
+	}
+}
+
+// publishFCMSend sends the message of an fcm_send entry, unless an earlier attempt did, and
+// records the outcome on the deliveries together with the message.sent or message.failed event.
+// A send that failed transiently, e.g. with a network error or a 5xx, is not recorded: the entry
+// is kept for the relay, which records the failure once it gives up (see giveUpOutboxEntry).
+func (s *Service) publishFCMSend(ctx context.Context, logger *common.Logger, entry sqlc.Outbox) error {
+	var payload fcmSendPayload
+	if err := json.Unmarshal(entry.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid fcm_send payload: %w", err)
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return err
+	}
+
+	delivery, err := queries.GetMessageDelivery(ctx, sqlc.GetMessageDeliveryParams{MessageID: payload.MessageID, DeviceID: payload.Device.DeviceID})
+	if err != nil {
+		return fmt.Errorf("failed to get message delivery: %w", err)
+	}
+	if delivery.Status != deliveryStatusPending {
+		logger.Info(ctx, "Message already %s, not sent again: message_id=%s, device_id=%s", delivery.Status, payload.MessageID, payload.Device.DeviceID)
+		_, err := queries.DeleteOutboxEntry(ctx, entry.OutboxID)
+		return err
+	}
+
+	sendErr := s.sendFCMPayload(ctx, payload)
+	if sendErr != nil && !isFinalPushError(sendErr) {
+		return fmt.Errorf("failed to send message: %w", sendErr)
+	}
+
+	var followUps []sqlc.Outbox
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		deleted, err := queries.DeleteOutboxEntry(ctx, entry.OutboxID)
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return errOutboxEntryPublished
+		}
+		followUps, err = s.recordFCMSend(ctx, logger, queries, payload, sendErr)
+		return err
+	})
+	if errors.Is(err, errOutboxEntryPublished) {
+		logger.Info(ctx, "Message sent concurrently by another invocation: message_id=%s, device_id=%s", payload.MessageID, payload.Device.DeviceID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record message send: %w", err)
+	}
+	s.publishOutbox(ctx, logger, followUps)
+
+	if sendErr != nil {
+		return fmt.Errorf("%w: %w", errOutboxEntryFailed, sendErr)
+	}
+	return nil
+}
+
+// sendFCMPayload signs the device's receipt token, and ack token for e2e test messages, and sends
+// the message through the device's push provider
+func (s *Service) sendFCMPayload(ctx context.Context, payload fcmSendPayload) error {
+	// Each device belongs to an app (Firebase project or iOS app) with its own credentials
+	provider, err := s.pushProvider(ctx, devicePushProviderKey(payload.Device))
+	if err != nil {
+		return err
+	}
+	tokenKey, err := s.ackTokenKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Each device gets its own tokens, so receipts and acks can only be reported for the device that got the message
+	tokens := map[string]ackTokenClaims{
+		receiptTokenDataKey: {
+			MessageID: payload.MessageID,
+			DeviceID:  payload.Device.DeviceID,
+			ExpiresAt: s.Clock.Now().Add(receiptTokenLifetime).Unix(),
+		},
+	}
+	if payload.Nonce != "" {
+		tokens[ackTokenDataKey] = ackTokenClaims{
+			Nonce:     payload.Nonce,
+			DeviceID:  payload.Device.DeviceID,
+			ExpiresAt: payload.AckTokenExpiresAt,
+		}
+	}
+	messageData, err := withSignedTokens(payload.Data, tokenKey, tokens)
+	if err != nil {
+		return err
+	}
+
+	return provider.Send(ctx, PushMessage{
+		Token: payload.Device.Token,
+		Title: payload.Title,
+		Body:  payload.Body,
+		Data:  messageData,
+	})
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+)
+
+// relayOutbox runs RelayHandler once.
+func relayOutbox(t *testing.T, service *Service) RelayResult {
+	t.Helper()
+	result, err := service.RelayHandler(t.Context())
+	if err != nil {
+		t.Fatalf("RelayHandler failed: %v", err)
+	}
+	return *result
+}
+
+// enqueueUnpublishedSend writes a message to the active devices of user-1 with its fcm_send
+// entries, as SendMessageHandler does before it publishes them, and returns the entries.
+func enqueueUnpublishedSend(t *testing.T, service *Service, messageID string) []sqlc.Outbox {
+	t.Helper()
+	ctx := t.Context()
+
+	var entries []sqlc.Outbox
+	err := service.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		devices, err := queries.ListActiveDevicesByPlatforms(ctx, "user-1")
+		if err != nil {
+			return err
+		}
+		if err := createMessage(ctx, queries, messageID, "user-1", devices, messageCampaign{}); err != nil {
+			return err
+		}
+		for _, device := range devices {
+			entry, err := service.enqueueOutbox(ctx, queries, outboxFCMSend, fcmSendPayload{
+				MessageID: messageID,
+				Device:    newFCMSendDevice(device),
+				Title:     "Hello",
+				Body:      "World",
+				Data:      map[string]string{"message_id": messageID},
+			})
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestFCMSendPayloadFormat(t *testing.T) {
+	// Entries queued by a previous version must still decode after a deployment
+	const queued = `{"message_id":"msg-1","device":{"device_id":"device-1","user_id":"user-1","platform":"ios",` +
+		`"app_id":"shop","token":"token-1","token_type":"apns","locale":"pt-BR"},"title":"Hello","body":"World",` +
+		`"data":{"message_id":"msg-1"},"nonce":"nonce-1","ack_token_expires_at":1700000000}`
+	var payload fcmSendPayload
+	if err := json.Unmarshal([]byte(queued), &payload); err != nil {
+		t.Fatal(err)
+	}
+	want := fcmSendDevice{DeviceID: "device-1", UserID: "user-1", Platform: "ios", AppID: "shop", Token: "token-1", TokenType: "apns", Locale: "pt-BR"}
+	if payload.Device != want || payload.MessageID != "msg-1" || payload.Nonce != "nonce-1" || payload.AckTokenExpiresAt != 1700000000 {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != queued {
+		t.Fatalf("payload format changed:\n got %s\nwant %s", encoded, queued)
+	}
+}
+
+func TestSendMessagePublishesOutbox(t *testing.T) {
+	service, fakes := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookDeviceRegistered, webhookMessageSent)
+	registerFakeDevices(t, service)
+
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil), 200)
+	if sent := fakes.sender.Sent(); len(sent) != 2 {
+		t.Fatalf("expected 2 messages to be sent, got %d", len(sent))
+	}
+
+	// Every entry was published by the request that wrote it, so the relay finds nothing
+	if len(fakes.querier.outbox) != 0 {
+		t.Fatalf("expected an empty outbox, got %+v", fakes.querier.outbox)
+	}
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 2 {
+		t.Fatalf("expected no more messages to be sent, got %d", len(sent))
+	}
+
+	deliverWebhooks(t, service)
+	if got := fmt.Sprint(receivedEvents(receiver.Received())); got != "[device.registered device.registered message.sent message.sent]" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+}
+
+func TestRelayHandlerPublishesLeftoverEntries(t *testing.T) {
+	service, fakes := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookMessageSent)
+	registerFakeDevices(t, service)
+	enqueueUnpublishedSend(t, service, "msg-1")
+
+	// The writer may still be publishing the entries until their lease expires
+	if result := relayOutbox(t, service); result != (RelayResult{}) {
+		t.Fatalf("unexpected result before the lease expired: %+v", result)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 0 {
+		t.Fatalf("expected nothing to be sent, got %d messages", len(sent))
+	}
+
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{Published: 2}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	sent := fakes.sender.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 messages to be sent, got %d", len(sent))
+	}
+	for _, message := range sent {
+		if message.Data["message_id"] != "msg-1" || message.Data[receiptTokenDataKey] == "" {
+			t.Fatalf("expected message_id and a receipt token, got %+v", message.Data)
+		}
+	}
+	for key, delivery := range fakes.querier.messageDeliveries {
+		if delivery.Status != deliveryStatusSent {
+			t.Fatalf("expected SENT delivery to %s, got %s", key.DeviceID, delivery.Status)
+		}
+	}
+	if len(fakes.querier.outbox) != 0 {
+		t.Fatalf("expected an empty outbox, got %+v", fakes.querier.outbox)
+	}
+
+	// The message.sent events were enqueued with the sends
+	deliverWebhooks(t, service)
+	if got := fmt.Sprint(receivedEvents(receiver.Received())); got != "[message.sent message.sent]" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+
+	// Published entries are not published again
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestRelayHandlerSkipsSentMessages(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	entries := enqueueUnpublishedSend(t, service, "msg-1")
+
+	// The writer sent to device-1 and crashed before it deleted the entry
+	key := fakeMessageDeliveryKey{MessageID: "msg-1", DeviceID: "device-1"}
+	delivery := fakes.querier.messageDeliveries[key]
+	delivery.Status = deliveryStatusSent
+	fakes.querier.messageDeliveries[key] = delivery
+
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{Published: 2}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	sent := fakes.sender.Sent()
+	if len(sent) != 1 || sent[0].Token != "token-2" {
+		t.Fatalf("expected only device-2 to be sent to, got %+v", sent)
+	}
+
+	// An entry published concurrently by another invocation is not recorded twice
+	if err := service.publishOutboxEntry(t.Context(), common.NewLogger(), entries[1]); err != nil {
+		t.Fatalf("publishing an already published entry failed: %v", err)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 1 {
+		t.Fatalf("expected no more messages to be sent, got %d", len(sent))
+	}
+}
+
+func TestRelayHandlerRecordsRejectedSends(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	enqueueUnpublishedSend(t, service, "msg-1")
+	fakes.sender.FailToken("token-2", fakeRejection("INVALID_ARGUMENT"))
+
+	// FCM rejections are final, as for SendMessageHandler
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{Published: 1, Failed: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	delivery := fakes.querier.messageDeliveries[fakeMessageDeliveryKey{MessageID: "msg-1", DeviceID: "device-2"}]
+	if delivery.Status != deliveryStatusSendFailed || delivery.FailureReason.String != "INVALID_ARGUMENT" {
+		t.Fatalf("expected SEND_FAILED delivery to device-2, got %+v", delivery)
+	}
+	if len(fakes.querier.outbox) != 0 {
+		t.Fatalf("expected an empty outbox, got %+v", fakes.querier.outbox)
+	}
+}
+
+func TestRelayHandlerRetriesTransientSendErrors(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	fakes.sender.FailToken("token-2", errors.New("FCM API returned error: status=503"))
+
+	response := invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil)
+	expectStatus(t, response, 200)
+	var body SendMessageResponse
+	decodeBody(t, response, &body)
+	if body.SentCount != 1 || body.FailedCount != 0 || body.RetriedCount != 1 {
+		t.Fatalf("expected 1 sent and 1 retried, got %s", response.Body)
+	}
+
+	// The send to device-2 is not recorded as failed, but kept for the relay
+	var messageID string
+	for messageID = range fakes.querier.messages {
+	}
+	key := fakeMessageDeliveryKey{MessageID: messageID, DeviceID: "device-2"}
+	if delivery := fakes.querier.messageDeliveries[key]; delivery.Status != deliveryStatusPending {
+		t.Fatalf("expected PENDING delivery to device-2, got %+v", delivery)
+	}
+	if len(fakes.querier.outbox) != 1 {
+		t.Fatalf("expected the entry of device-2 to be kept, got %+v", fakes.querier.outbox)
+	}
+
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{Retried: 1}) {
+		t.Fatalf("unexpected result while FCM is unavailable: %+v", result)
+	}
+	if delivery := fakes.querier.messageDeliveries[key]; delivery.Status != deliveryStatusPending {
+		t.Fatalf("expected PENDING delivery to device-2, got %+v", delivery)
+	}
+
+	// FCM is back by the next attempt
+	fakes.sender.FailToken("token-2", nil)
+	fakes.clock.Advance(outboxBackoff(1))
+	if result := relayOutbox(t, service); result != (RelayResult{Published: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if delivery := fakes.querier.messageDeliveries[key]; delivery.Status != deliveryStatusSent {
+		t.Fatalf("expected SENT delivery to device-2, got %+v", delivery)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 2 || sent[1].Token != "token-2" {
+		t.Fatalf("expected device-2 to be sent to by the relay, got %+v", sent)
+	}
+	if len(fakes.querier.outbox) != 0 {
+		t.Fatalf("expected an empty outbox, got %+v", fakes.querier.outbox)
+	}
+}
+
+func TestRelayHandlerRetriesAndGivesUp(t *testing.T) {
+	service, fakes := newFakeService(t)
+	ctx := t.Context()
+
+	var entry sqlc.Outbox
+	err := service.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		var err error
+		entry, err = service.enqueueOutbox(ctx, queries, "future_kind", map[string]string{})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakes.clock.Advance(outboxLease)
+	for attempt := 1; attempt < outboxMaxAttempts; attempt++ {
+		if result := relayOutbox(t, service); result != (RelayResult{Retried: 1}) {
+			t.Fatalf("attempt %d: unexpected result: %+v", attempt, result)
+		}
+		retried := fakes.querier.outbox[entry.OutboxID]
+		if retried.LastError.String != "unknown outbox entry kind: future_kind" {
+			t.Fatalf("attempt %d: unexpected last_error %q", attempt, retried.LastError.String)
+		}
+		if want := fakes.clock.Now().Add(outboxBackoff(attempt)); !retried.AvailableAt.Time.Equal(want) {
+			t.Fatalf("attempt %d: expected the next attempt at %s, got %s", attempt, want, retried.AvailableAt.Time)
+		}
+
+		// Not attempted again before the backoff has passed
+		if result := relayOutbox(t, service); result != (RelayResult{}) {
+			t.Fatalf("attempt %d: unexpected result during backoff: %+v", attempt, result)
+		}
+		fakes.clock.Advance(outboxBackoff(attempt))
+	}
+
+	if result := relayOutbox(t, service); result != (RelayResult{Failed: 1}) {
+		t.Fatalf("unexpected result of the last attempt: %+v", result)
+	}
+	if len(fakes.querier.outbox) != 0 {
+		t.Fatalf("expected the entry to be given up, got %+v", fakes.querier.outbox)
+	}
+}
+
+func TestRelayHandlerGivesUpSends(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+
+	// A send that could not be published is recorded as failed, so the delivery doesn't stay PENDING
+	entries := enqueueUnpublishedSend(t, service, "msg-1")
+	if err := service.giveUpOutboxEntry(t.Context(), common.NewLogger(), entries[0], errors.New("given up")); err != nil {
+		t.Fatalf("giveUpOutboxEntry failed: %v", err)
+	}
+	delivery := fakes.querier.messageDeliveries[fakeMessageDeliveryKey{MessageID: "msg-1", DeviceID: "device-1"}]
+	if delivery.Status != deliveryStatusSendFailed || delivery.FailureReason.String != "given up" {
+		t.Fatalf("expected SEND_FAILED delivery to device-1, got %+v", delivery)
+	}
+	if len(fakes.querier.outbox) != 1 {
+		t.Fatalf("expected only the entry of device-2 to be left, got %+v", fakes.querier.outbox)
+	}
+}
+
+func TestRelayHandlerDatabaseUnavailable(t *testing.T) {
+	service, fakes := newFakeService(t)
+	fakes.store.connErr = errors.New("connection refused")
+
+	if _, err := service.RelayHandler(t.Context()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 10 * time.Minute},
+		{20, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+)
+
+// Every message belongs to a notification category (SendMessageRequest.Category). Users can turn
+// off a category for all of their devices or for one device, except mandatory categories such as
+// security alerts. Without a preference, a category's default_enabled applies.
+
+// systemCategory is the mandatory category of e2e test and delivery probe messages
+const systemCategory = "system"
+
+// userWidePreference is the notification_preferences.device_id of preferences for all devices of a user
+const userWidePreference = ""
+
+// CategoryPreference is a notification category with the user's setting in GET /users/{user_id}/preferences
+type CategoryPreference struct {
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	Mandatory   bool   `json:"mandatory"` // Cannot be turned off
+	Enabled     bool   `json:"enabled"`   // For all devices without an override in devices
+}
+
+type PreferencesResponse struct {
+	UserID     string                     `json:"user_id"`
+	Categories []CategoryPreference       `json:"categories"`
+	Devices    map[string]map[string]bool `json:"devices"` // Per-device overrides by device ID and category
+}
+
+// PutPreferencesRequest replaces all preferences of a user; categories left out revert to their default
+type PutPreferencesRequest struct {
+	Categories map[string]bool            `json:"categories"` // By category, for all devices
+	Devices    map[string]map[string]bool `json:"devices"`    // By device ID and category
+}
+
+// GetPreferencesHandler is the Lambda handler for GET /users/{user_id}/preferences
+func (s *Service) GetPreferencesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received get preferences request")
+
+	userID := request.PathParameters["user_id"]
+	if userID == "" {
+		err := fmt.Errorf("missing path parameter: user_id")
+		return logger.BadRequest(ctx, err, "Missing user_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	response, err := preferencesResponse(ctx, queries, userID)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// PutPreferencesHandler is the Lambda handler for PUT /users/{user_id}/preferences
+func (s *Service) PutPreferencesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received put preferences request")
+
+	userID := request.PathParameters["user_id"]
+	if userID == "" {
+		err := fmt.Errorf("missing path parameter: user_id")
+		return logger.BadRequest(ctx, err, "Missing user_id")
+	}
+
+	var putRequest PutPreferencesRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &putRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	categories, err := notificationCategories(ctx, queries)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	// Validate categories, and that mandatory categories are not turned off
+	var preferences []sqlc.CreateNotificationPreferenceParams
+	addPreferences := func(deviceID string, enabled map[string]bool) error {
+		for category, on := range enabled {
+			notificationCategory, ok := categories[category]
+			if !ok {
+				return fmt.Errorf("unknown category: %s", category)
+			}
+			if notificationCategory.Mandatory && !on {
+				return fmt.Errorf("category %s is mandatory and cannot be turned off", category)
+			}
+			preferences = append(preferences, sqlc.CreateNotificationPreferenceParams{
+				UserID:   userID,
+				DeviceID: deviceID,
+				Category: category,
+				Enabled:  on,
+			})
+		}
+		return nil
+	}
+	if err := addPreferences(userWidePreference, putRequest.Categories); err != nil {
+		return logger.BadRequest(ctx, err, "Invalid category preference")
+	}
+	for deviceID, enabled := range putRequest.Devices {
+		// Only the user's own devices can have preferences
+		device, err := queries.GetDeviceByDeviceID(ctx, deviceID)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && device.UserID != userID) {
+			err := fmt.Errorf("device %q is not a device of user %s", deviceID, userID)
+			return logger.BadRequest(ctx, err, "Unknown device_id")
+		}
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Database query failed")
+		}
+		if err := addPreferences(deviceID, enabled); err != nil {
+			return logger.BadRequest(ctx, err, "Invalid category preference")
+		}
+	}
+
+	// Replace the user's preferences in one transaction, so sends never see half of them
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		if err := queries.DeleteNotificationPreferences(ctx, userID); err != nil {
+			return err
+		}
+		for _, preference := range preferences {
+			if err := queries.CreateNotificationPreference(ctx, preference); err != nil {
+				return fmt.Errorf("failed to create preference for category %s, device %q: %w", preference.Category, preference.DeviceID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to save preferences")
+	}
+
+	logger.Info(ctx, "Preferences saved: user_id=%s, preferences=%d", userID, len(preferences))
+
+	response, err := preferencesResponse(ctx, queries, userID)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// preferencesResponse returns every category with the user's setting, and the user's device overrides
+func preferencesResponse(ctx context.Context, queries sqlc.Querier, userID string) (PreferencesResponse, error) {
+	categories, err := queries.ListNotificationCategories(ctx)
+	if err != nil {
+		return PreferencesResponse{}, err
+	}
+	preferences, err := loadNotificationPreferences(ctx, queries, userID)
+	if err != nil {
+		return PreferencesResponse{}, err
+	}
+
+	response := PreferencesResponse{
+		UserID:     userID,
+		Categories: make([]CategoryPreference, 0, len(categories)),
+		Devices:    make(map[string]map[string]bool),
+	}
+	for _, category := range categories {
+		response.Categories = append(response.Categories, CategoryPreference{
+			Category:    category.Category,
+			Description: category.Description,
+			Mandatory:   category.Mandatory,
+			Enabled:     preferences.enabled(category, userWidePreference),
+		})
+	}
+	for deviceID, enabled := range preferences {
+		if deviceID != userWidePreference {
+			response.Devices[deviceID] = enabled
+		}
+	}
+	return response, nil
+}
+
+// notificationCategories returns all categories by name
+func notificationCategories(ctx context.Context, queries sqlc.Querier) (map[string]sqlc.NotificationCategory, error) {
+	categories, err := queries.ListNotificationCategories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]sqlc.NotificationCategory, len(categories))
+	for _, category := range categories {
+		byName[category.Category] = category
+	}
+	return byName, nil
+}
+
+// notificationPreferences are the explicit preferences of a user by device ID (userWidePreference
+// for all devices) and category
+type notificationPreferences map[string]map[string]bool
+
+func loadNotificationPreferences(ctx context.Context, queries sqlc.Querier, userID string) (notificationPreferences, error) {
+	rows, err := queries.ListNotificationPreferences(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	preferences := make(notificationPreferences)
+	for _, row := range rows {
+		if preferences[row.DeviceID] == nil {
+			preferences[row.DeviceID] = make(map[string]bool)
+		}
+		preferences[row.DeviceID][row.Category] = row.Enabled
+	}
+	return preferences, nil
+}
+
+// enabled reports whether messages of category are sent to a device: mandatory categories always are,
+// otherwise the device's preference applies, then the user-wide one, then the category default
+func (p notificationPreferences) enabled(category sqlc.NotificationCategory, deviceID string) bool {
+	if category.Mandatory {
+		return true
+	}
+	if enabled, ok := p[deviceID][category.Category]; ok {
+		return enabled
+	}
+	if enabled, ok := p[userWidePreference][category.Category]; ok {
+		return enabled
+	}
+	return category.DefaultEnabled
+}
+
+// suppressedDevices splits devices into those that get messages of category and the IDs of
+// those that opted out, sorted
+func suppressedDevices(devices []sqlc.ListActiveDevicesByPlatformsRow, category sqlc.NotificationCategory, preferences notificationPreferences) ([]sqlc.ListActiveDevicesByPlatformsRow, []string) {
+	var recipients []sqlc.ListActiveDevicesByPlatformsRow
+	suppressed := []string{}
+	for _, device := range devices {
+		if preferences.enabled(category, device.DeviceID) {
+			recipients = append(recipients, device)
+		} else {
+			suppressed = append(suppressed, device.DeviceID)
+		}
+	}
+	sort.Strings(suppressed)
+	return recipients, suppressed
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// invokePreferences invokes a /users/{user_id}/preferences handler.
+func invokePreferences(t *testing.T, handler apiHandler, userID, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Body:           body,
+		PathParameters: map[string]string{"user_id": userID},
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return response
+}
+
+// getPreferences returns the preferences of userID.
+func getPreferences(t *testing.T, service *Service, userID string) PreferencesResponse {
+	t.Helper()
+	response := invokePreferences(t, service.GetPreferencesHandler, userID, "")
+	expectStatus(t, response, 200)
+	var preferences PreferencesResponse
+	decodeBody(t, response, &preferences)
+	return preferences
+}
+
+// enabledCategories returns the user-wide setting of each category.
+func enabledCategories(preferences PreferencesResponse) map[string]bool {
+	enabled := make(map[string]bool, len(preferences.Categories))
+	for _, category := range preferences.Categories {
+		enabled[category.Category] = category.Enabled
+	}
+	return enabled
+}
+
+func TestPreferencesDefaults(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	preferences := getPreferences(t, service, "user-1")
+	want := map[string]bool{"marketing": true, "security": true, "system": true, "transactional": true}
+	if got := enabledCategories(preferences); !reflect.DeepEqual(got, want) || len(preferences.Devices) != 0 {
+		t.Fatalf("unexpected default preferences: %+v", preferences)
+	}
+	if preferences.Categories[0].Category != "marketing" || preferences.Categories[0].Mandatory {
+		t.Fatalf("expected categories sorted by name, got %+v", preferences.Categories)
+	}
+}
+
+func TestPutPreferences(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+
+	response := invokePreferences(t, service.PutPreferencesHandler, "user-1",
+		`{"categories":{"marketing":false,"security":true},"devices":{"device-2":{"marketing":true,"transactional":false}}}`)
+	expectStatus(t, response, 200)
+	var preferences PreferencesResponse
+	decodeBody(t, response, &preferences)
+	if got := enabledCategories(preferences); got["marketing"] || !got["transactional"] {
+		t.Fatalf("unexpected user-wide preferences: %+v", preferences)
+	}
+	if want := map[string]map[string]bool{"device-2": {"marketing": true, "transactional": false}}; !reflect.DeepEqual(preferences.Devices, want) {
+		t.Fatalf("unexpected device preferences: %+v", preferences.Devices)
+	}
+	if got := getPreferences(t, service, "user-1"); !reflect.DeepEqual(got, preferences) {
+		t.Fatalf("GET returned %+v after PUT returned %+v", got, preferences)
+	}
+
+	// PUT replaces every preference of the user
+	expectStatus(t, invokePreferences(t, service.PutPreferencesHandler, "user-1", `{"categories":{"transactional":false}}`), 200)
+	preferences = getPreferences(t, service, "user-1")
+	if got := enabledCategories(preferences); !got["marketing"] || got["transactional"] || len(preferences.Devices) != 0 {
+		t.Fatalf("preferences not replaced: %+v", preferences)
+	}
+	if len(fakes.querier.preferences) != 1 {
+		t.Fatalf("expected one stored preference, got %+v", fakes.querier.preferences)
+	}
+}
+
+func TestPutPreferencesRejectsInvalidPreferences(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-2","device_id":"device-3","fcm_token":"token-3","platform":"android"}`, nil), 200)
+
+	for name, body := range map[string]string{
+		"unknown category":   `{"categories":{"newsletter":false}}`,
+		"mandatory category": `{"categories":{"security":false}}`,
+		"mandatory device":   `{"devices":{"device-1":{"system":false}}}`,
+		"unknown device":     `{"devices":{"device-9":{"marketing":false}}}`,
+		"other user":         `{"devices":{"device-3":{"marketing":false}}}`,
+		"not booleans":       `{"categories":{"marketing":"off"}}`,
+	} {
+		if response := invokePreferences(t, service.PutPreferencesHandler, "user-1", body); response.StatusCode != 400 {
+			t.Errorf("%s: expected 400, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+	if len(fakes.querier.preferences) != 0 {
+		t.Fatalf("invalid preferences were stored: %+v", fakes.querier.preferences)
+	}
+
+	expectStatus(t, invokePreferences(t, service.GetPreferencesHandler, "", ""), 400)
+}
+
+func TestSendMessageSuppressesOptedOutDevices(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+
+	// Marketing is off for the user, except on device-2
+	expectStatus(t, invokePreferences(t, service.PutPreferencesHandler, "user-1",
+		`{"categories":{"marketing":false},"devices":{"device-2":{"marketing":true}}}`), 200)
+
+	response := invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"marketing","title":"Sale","body":"50% off"}`, nil)
+	expectStatus(t, response, 200)
+	var sendResponse SendMessageResponse
+	decodeBody(t, response, &sendResponse)
+	if sendResponse.SentCount != 1 || !reflect.DeepEqual(sendResponse.SuppressedDeviceIDs, []string{"device-1"}) {
+		t.Fatalf("expected device-1 to be suppressed, got %s", response.Body)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 1 || sent[0].Token != "token-2" {
+		t.Fatalf("expected one message to token-2, got %+v", sent)
+	}
+	if _, ok := fakes.querier.messageDeliveries[fakeMessageDeliveryKey{sendResponse.MessageID, "device-1"}]; ok {
+		t.Fatal("delivery created for a suppressed device")
+	}
+
+	// Mandatory categories reach every device
+	response = invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"security","title":"New sign-in","body":"From Lisbon"}`, nil)
+	expectStatus(t, response, 200)
+	decodeBody(t, response, &sendResponse)
+	if sendResponse.SentCount != 2 || len(sendResponse.SuppressedDeviceIDs) != 0 {
+		t.Fatalf("expected a security alert to reach both devices, got %s", response.Body)
+	}
+
+	// A user without devices left gets no message at all
+	expectStatus(t, invokePreferences(t, service.PutPreferencesHandler, "user-1",
+		`{"categories":{"marketing":false}}`), 200)
+	messages := len(fakes.querier.messages)
+	response = invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"marketing","title":"Sale","body":"50% off"}`, nil)
+	expectStatus(t, response, 200)
+	sendResponse = SendMessageResponse{}
+	decodeBody(t, response, &sendResponse)
+	if sendResponse.SentCount != 0 || sendResponse.MessageID != "" || len(sendResponse.SuppressedDeviceIDs) != 2 || len(fakes.querier.messages) != messages {
+		t.Fatalf("expected both devices to be suppressed and no message, got %s", response.Body)
+	}
+
+	expectStatus(t, invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"newsletter","title":"Hi","body":"There"}`, nil), 400)
+}
+
+func TestPreferencesHandlers(t *testing.T) {
+	requireDB(t)
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+	registerDevice(t, "user-1", "device-2", "token-2", "ios")
+
+	expectStatus(t, invokePreferences(t, testService.PutPreferencesHandler, "user-1",
+		`{"categories":{"marketing":false},"devices":{"device-2":{"marketing":true}}}`), 200)
+	preferences := getPreferences(t, testService, "user-1")
+	if enabledCategories(preferences)["marketing"] || !preferences.Devices["device-2"]["marketing"] {
+		t.Fatalf("unexpected preferences: %+v", preferences)
+	}
+
+	response := invoke(t, testService.SendMessageHandler, `{"user_id":"user-1","category":"marketing","title":"Sale","body":"50% off"}`, nil)
+	expectStatus(t, response, 200)
+	var sendResponse SendMessageResponse
+	decodeBody(t, response, &sendResponse)
+	if sendResponse.SentCount != 1 || !reflect.DeepEqual(sendResponse.SuppressedDeviceIDs, []string{"device-1"}) {
+		t.Fatalf("expected device-1 to be suppressed, got %s", response.Body)
+	}
+	if messages := testFCM.Messages(); len(messages) != 1 || messages[0].Token != "token-2" {
+		t.Fatalf("unexpected FCM messages: %+v", messages)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+)
+
+// ProbeConfig configures ProbeHandler, see loadProbeConfig
+type ProbeConfig struct {
+	UserID        string        // Canary user whose devices run the app and ack e2e test messages
+	Timeout       time.Duration // How long to wait for the ack; also the test run's ack timeout
+	RetryInterval time.Duration // How long to pause after a failed status check before checking again
+	Namespace     string        // CloudWatch metrics namespace
+	Environment   string        // Value of the Environment metric dimension
+}
+
+// Defaults of ProbeConfig
+const (
+	defaultProbeTimeout       = 60 * time.Second
+	defaultProbeRetryInterval = 2 * time.Second
+	defaultProbeNamespace     = "FCMTutorial/Probe"
+)
+
+// loadProbeConfig reads the probe configuration from the environment:
+//   - PROBE_USER_ID: canary user (required by ProbeHandler only)
+//   - PROBE_TIMEOUT: e.g. "60s", at most the maximum ack timeout
+//   - PROBE_RETRY_INTERVAL: e.g. "2s"
+//   - PROBE_METRICS_NAMESPACE: default "FCMTutorial/Probe"
+//   - ENVIRONMENT: metric dimension, e.g. "dev"
+func loadProbeConfig() (ProbeConfig, error) {
+	config := ProbeConfig{
+		UserID:      os.Getenv("PROBE_USER_ID"),
+		Namespace:   os.Getenv("PROBE_METRICS_NAMESPACE"),
+		Environment: os.Getenv("ENVIRONMENT"),
+	}
+	if config.Namespace == "" {
+		config.Namespace = defaultProbeNamespace
+	}
+
+	var err error
+	if config.Timeout, err = common.DurationFromEnv("PROBE_TIMEOUT", defaultProbeTimeout); err != nil {
+		return ProbeConfig{}, err
+	}
+	if config.Timeout > maxAckTimeout {
+		return ProbeConfig{}, fmt.Errorf("invalid PROBE_TIMEOUT: must be at most %s", maxAckTimeout)
+	}
+	if config.RetryInterval, err = common.DurationFromEnv("PROBE_RETRY_INTERVAL", defaultProbeRetryInterval); err != nil {
+		return ProbeConfig{}, err
+	}
+
+	return config, nil
+}
+
+// ProbeResult is returned by ProbeHandler
+type ProbeResult struct {
+	Nonce            string `json:"nonce"`
+	Passed           bool   `json:"passed"`                   // The message was acknowledged before the timeout
+	Status           string `json:"status,omitempty"`         // Last test run status, empty if the send request failed
+	FailureReason    string `json:"failure_reason,omitempty"` // Set if the probe did not pass
+	Platform         string `json:"platform,omitempty"`       // Platform of the first device to ack
+	DeviceCount      int    `json:"device_count"`
+	AckedDeviceCount int    `json:"acked_device_count"`
+
+	TestRunLatency
+}
+
+// Metrics emitted by ProbeHandler
+const (
+	probeSuccessMetric        = "ProbeSuccess"        // 1 if the probe passed, 0 otherwise
+	probeSendToAckMetric      = "SendToAckLatency"    // See TestRunLatency.SendToAckMs
+	probeReceiveToAckMetric   = "ReceiveToAckLatency" // See TestRunLatency.ReceiveToAckMs
+	probeEnvironmentDimension = "Environment"
+)
+
+// ProbeHandler is the Lambda handler for the synthetic delivery probe, run on an EventBridge schedule.
+// It does what test/e2e_test.py does: send an e2e test message to the canary user and wait for the
+// ack through test_runs, going through the same handlers as the API. Pass/fail and latency are
+// written to stdout as CloudWatch EMF metrics.
+//
+// A failed probe is reported through its metrics and result, not as an error, so Lambda does not
+// retry the invocation and send more probes.
+func (s *Service) ProbeHandler(ctx context.Context) (*ProbeResult, error) {
+	logger := common.NewLogger()
+
+	if s.Probe.UserID == "" {
+		err := fmt.Errorf("PROBE_USER_ID is not set")
+		logger.Error(ctx, err, "Probe is not configured")
+		return nil, err
+	}
+
+	nonce, err := newProbeNonce()
+	if err != nil {
+		logger.Error(ctx, err, "Failed to generate probe nonce")
+		return nil, err
+	}
+	logger.Info(ctx, "Starting delivery probe: nonce=%s, user_id=%s, timeout=%s", nonce, s.Probe.UserID, s.Probe.Timeout)
+
+	result := s.runProbe(ctx, nonce)
+
+	if err := s.writeProbeMetrics(result); err != nil {
+		logger.Error(ctx, err, "Failed to write probe metrics")
+	}
+
+	if result.Passed {
+		logger.Info(ctx, "Probe passed: nonce=%s, platform=%s, send_to_ack_ms=%s, receive_to_ack_ms=%s",
+			nonce, result.Platform, formatOptionalMillis(result.SendToAckMs), formatOptionalMillis(result.ReceiveToAckMs))
+	} else {
+		logger.Error(ctx, nil, "Probe failed: nonce=%s, status=%s, reason=%s", nonce, result.Status, result.FailureReason)
+	}
+
+	return result, nil
+}
+
+// runProbe sends the probe message and waits until its test run leaves PENDING or the timeout elapses.
+// It waits in TestStatusHandler (GET /test/status?wait=), so an ack ends the wait right away.
+func (s *Service) runProbe(ctx context.Context, nonce string) *ProbeResult {
+	result := &ProbeResult{Nonce: nonce}
+	deadline := s.Clock.Now().Add(s.Probe.Timeout)
+
+	// Send through SendMessageHandler, exactly like the e2e test does through the API
+	data, err := json.Marshal(map[string]string{"type": "e2e_test", "nonce": nonce})
+	if err != nil {
+		result.FailureReason = err.Error()
+		return result
+	}
+	body, err := json.Marshal(SendMessageRequest{
+		UserID:            s.Probe.UserID,
+		Category:          systemCategory,
+		Title:             "Delivery probe",
+		Body:              "Synthetic delivery check",
+		Data:              data,
+		AckTimeoutSeconds: int(math.Ceil(s.Probe.Timeout.Seconds())),
+	})
+	if err != nil {
+		result.FailureReason = err.Error()
+		return result
+	}
+	response, err := s.SendMessageHandler(ctx, events.APIGatewayProxyRequest{Body: string(body)})
+	if err == nil && response.StatusCode != 200 {
+		err = fmt.Errorf("HTTP %d: %s", response.StatusCode, response.Body)
+	}
+	if err != nil {
+		result.FailureReason = fmt.Sprintf("send failed: %v", err)
+		return result
+	}
+
+	for {
+		// Errors are retried until the timeout, like the e2e test does
+		status, err := s.probeStatus(ctx, nonce, deadline.Sub(s.Clock.Now()))
+		if err == nil {
+			result.Status = status.Status
+			result.FailureReason = status.FailureReason
+			result.Platform = status.Platform
+			result.DeviceCount = status.DeviceCount
+			result.AckedDeviceCount = status.AckedDeviceCount
+			result.TestRunLatency = status.TestRunLatency
+			if status.Status != testRunStatusPending {
+				result.Passed = status.Status == testRunStatusAcked
+				return result
+			}
+		} else {
+			result.FailureReason = err.Error()
+		}
+
+		if !s.Clock.Now().Before(deadline) {
+			result.FailureReason = fmt.Sprintf("no ack within %s", s.Probe.Timeout)
+			return result
+		}
+		if err != nil {
+			// A failed check returns right away, so pause instead of retrying in a tight loop
+			select {
+			case <-time.After(s.Probe.RetryInterval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			result.FailureReason = fmt.Sprintf("probe cancelled: %v", ctx.Err())
+			return result
+		}
+	}
+}
+
+// probeStatus looks up the probe's test run through TestStatusHandler, waiting up to wait (in whole
+// seconds, at least 1 and at most maxStatusWait) while it is PENDING. TestStatusHandler ends the
+// wait when the run changes status or expires, and expires the run once it is past expires_at.
+func (s *Service) probeStatus(ctx context.Context, nonce string, wait time.Duration) (StatusResponse, error) {
+	waitSeconds := int(math.Ceil(wait.Seconds()))
+	waitSeconds = max(1, min(waitSeconds, int(maxStatusWait.Seconds())))
+	response, err := s.TestStatusHandler(ctx, events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"nonce": nonce, "wait": strconv.Itoa(waitSeconds)},
+	})
+	if err != nil {
+		return StatusResponse{}, err
+	}
+	if response.StatusCode != 200 {
+		return StatusResponse{}, fmt.Errorf("status check failed: HTTP %d: %s", response.StatusCode, response.Body)
+	}
+
+	var status StatusResponse
+	if err := json.Unmarshal([]byte(response.Body), &status); err != nil {
+		return StatusResponse{}, fmt.Errorf("invalid status response: %w", err)
+	}
+	return status, nil
+}
+
+// writeProbeMetrics writes the probe result as an EMF document to s.Metrics
+func (s *Service) writeProbeMetrics(result *ProbeResult) error {
+	success := 0.0
+	if result.Passed {
+		success = 1
+	}
+	metrics := []metric{{Name: probeSuccessMetric, Unit: metricUnitCount, Value: success}}
+	if result.SendToAckMs != nil {
+		metrics = append(metrics, metric{Name: probeSendToAckMetric, Unit: metricUnitMilliseconds, Value: float64(*result.SendToAckMs)})
+	}
+	if result.ReceiveToAckMs != nil {
+		metrics = append(metrics, metric{Name: probeReceiveToAckMetric, Unit: metricUnitMilliseconds, Value: float64(*result.ReceiveToAckMs)})
+	}
+
+	dimensions := map[string]string{}
+	if s.Probe.Environment != "" {
+		dimensions[probeEnvironmentDimension] = s.Probe.Environment
+	}
+
+	properties := map[string]interface{}{
+		"nonce":              result.Nonce,
+		"status":             result.Status,
+		"failure_reason":     result.FailureReason,
+		"platform":           result.Platform,
+		"device_count":       result.DeviceCount,
+		"acked_device_count": result.AckedDeviceCount,
+	}
+
+	return writeEMF(s.Metrics, s.Clock.Now(), s.Probe.Namespace, dimensions, metrics, properties)
+}
+
+// newProbeNonce returns a random nonce that identifies probe runs in test_runs
+func newProbeNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "probe-" + hex.EncodeToString(b), nil
+}
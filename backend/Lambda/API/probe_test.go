@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+)
+
+// newFakeProbe configures service to probe user-1 and returns the buffer receiving its metrics.
+func newFakeProbe(service *Service, timeout time.Duration) *bytes.Buffer {
+	metrics := &bytes.Buffer{}
+	service.Metrics = metrics
+	service.Probe = ProbeConfig{
+		UserID:        "user-1",
+		Timeout:       timeout,
+		RetryInterval: time.Millisecond,
+		Namespace:     "Test/Probe",
+		Environment:   "test",
+	}
+	return metrics
+}
+
+// decodeEMF decodes the single EMF document in metrics.
+func decodeEMF(t *testing.T, metrics *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(metrics.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one EMF document, got %q", metrics.String())
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &document); err != nil {
+		t.Fatalf("invalid EMF document %q: %v", lines[0], err)
+	}
+	return document
+}
+
+// emfMetricNames returns the metric names declared in an EMF document.
+func emfMetricNames(t *testing.T, document map[string]interface{}) []string {
+	t.Helper()
+	var metadata emfMetadata
+	raw, _ := json.Marshal(document["_aws"])
+	if err := json.Unmarshal(raw, &metadata); err != nil || len(metadata.CloudWatchMetrics) != 1 {
+		t.Fatalf("invalid _aws metadata: %s", raw)
+	}
+	directive := metadata.CloudWatchMetrics[0]
+	if directive.Namespace != "Test/Probe" || len(directive.Dimensions) != 1 || len(directive.Dimensions[0]) != 1 ||
+		directive.Dimensions[0][0] != probeEnvironmentDimension {
+		t.Fatalf("unexpected EMF directive: %+v", directive)
+	}
+
+	var names []string
+	for _, definition := range directive.Metrics {
+		names = append(names, definition.Name)
+	}
+	return names
+}
+
+func TestProbePasses(t *testing.T) {
+	service, fakes := newFakeService(t)
+	service.Sender = &ackingSender{fakeSender: fakes.sender, t: t, service: service}
+	metrics := newFakeProbe(service, time.Second)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+
+	result, err := service.ProbeHandler(t.Context())
+	if err != nil {
+		t.Fatalf("ProbeHandler failed: %v", err)
+	}
+	if !result.Passed || result.Status != testRunStatusAcked || result.Platform != "android" ||
+		result.AckedDeviceCount != 1 || result.SendToAckMs == nil {
+		t.Fatalf("expected passed probe, got %+v", result)
+	}
+	if !strings.HasPrefix(result.Nonce, "probe-") {
+		t.Fatalf("unexpected nonce %q", result.Nonce)
+	}
+
+	sent := fakes.sender.Sent()
+	if len(sent) != 1 || sent[0].Data["nonce"] != result.Nonce || sent[0].Data["type"] != "e2e_test" {
+		t.Fatalf("unexpected probe message: %+v", sent)
+	}
+
+	document := decodeEMF(t, metrics)
+	if names := emfMetricNames(t, document); strings.Join(names, ",") != "ProbeSuccess,SendToAckLatency" {
+		t.Fatalf("unexpected metrics: %v", names)
+	}
+	if document[probeSuccessMetric] != 1.0 || document[probeEnvironmentDimension] != "test" || document["nonce"] != result.Nonce {
+		t.Fatalf("unexpected EMF document: %v", document)
+	}
+}
+
+// slowSender advances the clock on every send, like a send that takes delay.
+type slowSender struct {
+	*fakeSender
+	clock *fakeClock
+	delay time.Duration
+}
+
+func (s *slowSender) Send(ctx context.Context, creds *common.FCMCredentials, message PushMessage) error {
+	s.clock.Advance(s.delay)
+	return s.fakeSender.Send(ctx, creds, message)
+}
+
+func TestProbeTimesOut(t *testing.T) {
+	service, fakes := newFakeService(t)
+	// The probe times out during the send; the run, whose ack timeout is rounded up to 2s,
+	// expires 300ms later, which ends the status wait
+	service.Sender = &slowSender{fakeSender: fakes.sender, clock: fakes.clock, delay: 1700 * time.Millisecond}
+	metrics := newFakeProbe(service, 1500*time.Millisecond)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+
+	result, err := service.ProbeHandler(t.Context())
+	if err != nil {
+		t.Fatalf("ProbeHandler failed: %v", err)
+	}
+	if result.Passed || result.Status != testRunStatusPending || !strings.Contains(result.FailureReason, "no ack within") {
+		t.Fatalf("expected timed out probe, got %+v", result)
+	}
+
+	document := decodeEMF(t, metrics)
+	if names := emfMetricNames(t, document); strings.Join(names, ",") != "ProbeSuccess" {
+		t.Fatalf("unexpected metrics: %v", names)
+	}
+	if document[probeSuccessMetric] != 0.0 {
+		t.Fatalf("expected ProbeSuccess 0, got %v", document[probeSuccessMetric])
+	}
+}
+
+func TestProbeWakesOnAck(t *testing.T) {
+	service, fakes := newFakeService(t)
+	newFakeProbe(service, time.Minute)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+
+	results := make(chan *ProbeResult, 1)
+	start := time.Now()
+	go func() {
+		result, err := service.ProbeHandler(t.Context())
+		if err != nil {
+			t.Errorf("ProbeHandler failed: %v", err)
+		}
+		results <- result
+	}()
+
+	// The probe waits in TestStatusHandler, for up to 25s, until the device acks
+	<-fakes.querier.waiting
+	message := sentMessageTo(t, fakes, "token-1")
+	ack := TestAckRequest{Nonce: message.Data["nonce"], AckToken: message.Data[ackTokenDataKey]}
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, ack), nil), 200)
+
+	result := <-results
+	if result == nil || !result.Passed || result.Status != testRunStatusAcked {
+		t.Fatalf("expected passed probe, got %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("ack did not wake the probe: waited %s", elapsed)
+	}
+}
+
+func TestProbeRetriesStatusErrors(t *testing.T) {
+	service, fakes := newFakeService(t)
+	service.Sender = &ackingSender{fakeSender: fakes.sender, t: t, service: service}
+	newFakeProbe(service, time.Minute)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+
+	// The first status check fails, the next one finds the acked run
+	service.Store = &failingListenStore{Store: service.Store, failures: 1}
+	result, err := service.ProbeHandler(t.Context())
+	if err != nil {
+		t.Fatalf("ProbeHandler failed: %v", err)
+	}
+	if !result.Passed || result.Status != testRunStatusAcked || result.FailureReason != "" {
+		t.Fatalf("expected passed probe, got %+v", result)
+	}
+}
+
+// failingListenStore fails the first failures Listen calls, like an unreachable database.
+type failingListenStore struct {
+	Store
+	failures int
+}
+
+func (s *failingListenStore) Listen(ctx context.Context, channel string) (Subscription, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("connection refused")
+	}
+	return s.Store.Listen(ctx, channel)
+}
+
+func TestProbeFailsFast(t *testing.T) {
+	service, fakes := newFakeService(t)
+	newFakeProbe(service, time.Hour)
+
+	// Without devices the run is SEND_FAILED right away
+	result, err := service.ProbeHandler(t.Context())
+	if err != nil {
+		t.Fatalf("ProbeHandler failed: %v", err)
+	}
+	if result.Passed || result.Status != testRunStatusSendFailed || result.FailureReason != noDevicesFailureReason {
+		t.Fatalf("expected SEND_FAILED probe, got %+v", result)
+	}
+
+	// Send request errors are reported without a status
+	fakes.store.connErr = errors.New("connection refused")
+	result, err = service.ProbeHandler(t.Context())
+	if err != nil {
+		t.Fatalf("ProbeHandler failed: %v", err)
+	}
+	if result.Passed || result.Status != "" || !strings.Contains(result.FailureReason, "HTTP 500") {
+		t.Fatalf("expected failed send, got %+v", result)
+	}
+}
+
+func TestProbeNotConfigured(t *testing.T) {
+	service, _ := newFakeService(t)
+	newFakeProbe(service, time.Second)
+	service.Probe.UserID = ""
+
+	if _, err := service.ProbeHandler(t.Context()); err == nil {
+		t.Fatal("expected error without PROBE_USER_ID")
+	}
+}
+
+func TestLoadProbeConfig(t *testing.T) {
+	t.Setenv("PROBE_USER_ID", "canary")
+	t.Setenv("PROBE_TIMEOUT", "")
+	t.Setenv("PROBE_RETRY_INTERVAL", "500ms")
+
+	config, err := loadProbeConfig()
+	if err != nil {
+		t.Fatalf("loadProbeConfig failed: %v", err)
+	}
+	if config.UserID != "canary" || config.Timeout != defaultProbeTimeout || config.RetryInterval != 500*time.Millisecond ||
+		config.Namespace != defaultProbeNamespace {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+
+	for _, timeout := range []string{"2h", "-1s", "soon"} {
+		t.Setenv("PROBE_TIMEOUT", timeout)
+		if _, err := loadProbeConfig(); err == nil {
+			t.Fatalf("expected error for PROBE_TIMEOUT=%s", timeout)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+)
+
+// Each device's token belongs to one push service, recorded in devices.token_type:
+// FCM registration tokens are sent with the FCM HTTP v1 API (fcm.go), APNs device tokens
+// of iOS apps without the Firebase SDK directly with the APNs HTTP/2 API (apns.go).
+const (
+	tokenTypeFCM  = "fcm"
+	tokenTypeAPNs = "apns"
+)
+
+// PushMessage is a notification for a single device
+type PushMessage struct {
+	Token string            // Push token of the device: an FCM registration token or an APNs device token
+	Title string            // Notification title
+	Body  string            // Notification body
+	Data  map[string]string // Optional data payload
+}
+
+// PushProvider delivers messages to the devices of one app through one push service
+type PushProvider interface {
+	Send(ctx context.Context, message PushMessage) error
+}
+
+// errPushTokenUnregistered is wrapped by Send when the push service reports that the device's token
+// is no longer valid, e.g. because the app was uninstalled. Sends to the token will keep failing.
+var errPushTokenUnregistered = errors.New("push token is unregistered")
+
+// errPushMessageRejected is wrapped by Send when the push service rejected the message with a
+// client error other than 429 Too Many Requests, e.g. FCM's INVALID_ARGUMENT: sending it again fails
+// the same way. Any other error, e.g. a timeout or a 5xx, may succeed when retried.
+var errPushMessageRejected = errors.New("push message rejected")
+
+// isFinalPushError reports whether a send failed for good, because the push service rejected the
+// device's token or the message
+func isFinalPushError(err error) bool {
+	return errors.Is(err, errPushTokenUnregistered) || errors.Is(err, errPushMessageRejected)
+}
+
+// fcmProvider sends through FCM with the credentials of the app's Firebase project
+type fcmProvider struct {
+	sender FCMSender
+	creds  *common.FCMCredentials
+}
+
+func (p fcmProvider) Send(ctx context.Context, message PushMessage) error {
+	return p.sender.Send(ctx, p.creds, message)
+}
+
+// apnsProvider sends through APNs with the app's signing key and bundle ID
+type apnsProvider struct {
+	sender APNsSender
+	creds  *common.APNsCredentials
+}
+
+func (p apnsProvider) Send(ctx context.Context, message PushMessage) error {
+	return p.sender.Send(ctx, p.creds, message)
+}
+
+// isRejectedStatus reports whether a push service's HTTP status rejects the request for good:
+// a 4xx other than 429 Too Many Requests
+func isRejectedStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
+
+// pushProviderKey identifies the provider of a device: its app and token type
+type pushProviderKey struct {
+	appID     string
+	tokenType string
+}
+
+// pushProvider returns the provider for tokens of tokenType of the app appID,
+// with the app's credentials for that push service
+func (s *Service) pushProvider(ctx context.Context, key pushProviderKey) (PushProvider, error) {
+	switch key.tokenType {
+	case tokenTypeFCM:
+		creds, err := s.Apps.Credentials(ctx, s.Secrets, key.appID)
+		if err != nil {
+			return nil, err
+		}
+		return fcmProvider{sender: s.Sender, creds: creds}, nil
+	case tokenTypeAPNs:
+		if s.APNs == nil {
+			return nil, fmt.Errorf("APNs is not configured")
+		}
+		creds, err := s.Apps.APNsCredentials(ctx, s.Secrets, key.appID)
+		if err != nil {
+			return nil, err
+		}
+		return apnsProvider{sender: s.APNs, creds: creds}, nil
+	default:
+		return nil, fmt.Errorf("unknown token type: %s", key.tokenType)
+	}
+}
+
+// devicePushProviderKey returns the provider key of a device. Devices without a token type,
+// e.g. in outbox entries written before token types were recorded, have FCM tokens.
+func devicePushProviderKey(device fcmSendDevice) pushProviderKey {
+	tokenType := device.TokenType
+	if tokenType == "" {
+		tokenType = tokenTypeFCM
+	}
+	return pushProviderKey{appID: device.AppID, tokenType: tokenType}
+}
@@ -1,37 +1,499 @@
 -- name: GetDeviceByDeviceID :one
-SELECT user_id, device_id, platform, fcm_token, is_active, updated_at
+SELECT user_id, device_id, platform, app_id, fcm_token, is_active, updated_at
 FROM devices
 WHERE device_id = $1
 LIMIT 1;
 
 -- name: UpsertDevice :exec
-INSERT INTO devices (user_id, device_id, platform, fcm_token, is_active, updated_at)
-VALUES ($1, $2, $3, $4, TRUE, NOW())
+INSERT INTO devices (user_id, device_id, platform, app_id, fcm_token, token_type, locale, app_version, os_version, device_model, timezone, sdk_version, is_active, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, TRUE, NOW())
 ON CONFLICT (user_id, device_id)
 DO UPDATE SET
+    app_id = EXCLUDED.app_id,
     fcm_token = EXCLUDED.fcm_token,
+    token_type = EXCLUDED.token_type,
+    locale = EXCLUDED.locale,
+    app_version = EXCLUDED.app_version,
+    os_version = EXCLUDED.os_version,
+    device_model = EXCLUDED.device_model,
+    timezone = EXCLUDED.timezone,
+    sdk_version = EXCLUDED.sdk_version,
     is_active = TRUE,
     updated_at = NOW();
 
+-- name: ListDevices :many
+-- Oldest registration first; the cursor is the id of the last device of the previous page
+SELECT id, user_id, device_id, platform, app_id, token_type, locale, app_version, os_version, device_model, timezone, sdk_version, is_active, updated_at
+FROM devices
+WHERE (sqlc.narg('user_id')::text IS NULL OR user_id = sqlc.narg('user_id'))
+  AND (sqlc.narg('platform')::text IS NULL OR platform = sqlc.narg('platform'))
+  AND (sqlc.narg('app_id')::text IS NULL OR app_id = sqlc.narg('app_id'))
+  AND (sqlc.narg('app_version')::text IS NULL OR app_version = sqlc.narg('app_version'))
+  AND (sqlc.narg('os_version')::text IS NULL OR os_version = sqlc.narg('os_version'))
+  AND (sqlc.narg('locale')::text IS NULL OR locale = sqlc.narg('locale'))
+  AND (sqlc.narg('timezone')::text IS NULL OR timezone = sqlc.narg('timezone'))
+  AND (sqlc.narg('is_active')::boolean IS NULL OR is_active = sqlc.narg('is_active'))
+  AND id > sqlc.arg('after_id')
+ORDER BY id
+LIMIT sqlc.arg('limit_count');
+
 
 -- name: ListActiveDevicesByPlatforms :many
-SELECT user_id, device_id, platform, fcm_token, is_active, updated_at
+SELECT user_id, device_id, platform, app_id, fcm_token, token_type, locale, is_active, updated_at
 FROM devices
 WHERE user_id = $1 AND is_active = TRUE AND platform IN ('android', 'ios');
 
--- name: CreateTestRun :exec
-INSERT INTO test_runs (nonce, user_id, status, created_at)
-VALUES ($1, $2, 'PENDING', NOW())
+-- name: DeactivateDeviceToken :execrows
+-- Only if the device still has the token: a token registered since the send stays active
+UPDATE devices
+SET is_active = FALSE, updated_at = NOW()
+WHERE device_id = $1 AND fcm_token = $2 AND is_active = TRUE;
+
+-- name: CreateTestRun :execrows
+INSERT INTO test_runs (nonce, user_id, status, created_at, expires_at)
+VALUES ($1, $2, 'PENDING', NOW(), $3)
 ON CONFLICT (nonce) DO NOTHING;
 
 -- name: AckTestRun :one
 UPDATE test_runs
-SET status = 'ACKED', acked_at = NOW()
-WHERE nonce = $1 AND status = 'PENDING'
-RETURNING nonce, user_id, status, created_at, acked_at;
+SET status = 'ACKED', acked_at = NOW(),
+    ack_device_id = $2, ack_platform = $3, ack_app_version = $4, ack_os_version = $5,
+    sent_at = $6, received_at = $7
+WHERE nonce = $1 AND status = 'PENDING' AND expires_at > NOW()
+RETURNING nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at;
 
 -- name: GetTestRunByNonce :one
-SELECT nonce, user_id, status, created_at, acked_at
+SELECT nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at
 FROM test_runs
 WHERE nonce = $1
 LIMIT 1;
+
+-- name: MarkTestRunSendFailed :exec
+UPDATE test_runs
+SET status = 'SEND_FAILED', failure_reason = $2
+WHERE nonce = $1 AND status = 'PENDING';
+
+-- name: ExpireTestRun :one
+UPDATE test_runs
+SET status = 'EXPIRED', failure_reason = 'no ack received before expires_at'
+WHERE nonce = $1 AND status = 'PENDING' AND expires_at <= NOW()
+RETURNING nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at;
+
+-- name: ExpirePendingTestRuns :execrows
+UPDATE test_runs
+SET status = 'EXPIRED', failure_reason = 'no ack received before expires_at'
+WHERE status = 'PENDING' AND expires_at <= NOW();
+
+-- name: CreateTestRunDelivery :exec
+INSERT INTO test_run_deliveries (nonce, device_id, platform, app_id, status)
+VALUES ($1, $2, $3, $4, 'PENDING');
+
+-- name: MarkTestRunDeliverySent :exec
+-- A device may ack before the send returns; its delivery then stays ACKED
+UPDATE test_run_deliveries
+SET status = CASE WHEN status = 'PENDING' THEN 'SENT' ELSE status END, sent_at = NOW()
+WHERE nonce = $1 AND device_id = $2 AND status IN ('PENDING', 'ACKED');
+
+-- name: MarkTestRunDeliverySendFailed :exec
+UPDATE test_run_deliveries
+SET status = 'SEND_FAILED', failure_reason = $3
+WHERE nonce = $1 AND device_id = $2 AND status = 'PENDING';
+
+-- name: AckTestRunDelivery :one
+UPDATE test_run_deliveries d
+SET status = 'ACKED', acked_at = NOW(), app_version = $3, os_version = $4, received_at = $5
+FROM test_runs r
+WHERE d.nonce = r.nonce AND d.nonce = $1 AND d.device_id = $2 AND d.status IN ('PENDING', 'SENT')
+  AND r.status IN ('PENDING', 'ACKED') AND r.expires_at > NOW()
+RETURNING d.nonce, d.device_id, d.platform, d.app_id, d.status, d.failure_reason, d.sent_at, d.acked_at, d.app_version, d.os_version, d.received_at;
+
+-- name: ListTestRunDeliveries :many
+SELECT nonce, device_id, platform, app_id, status, failure_reason, sent_at, acked_at, app_version, os_version, received_at
+FROM test_run_deliveries
+WHERE nonce = $1
+ORDER BY device_id;
+
+-- name: ListTestRuns :many
+-- Newest first; the cursor is the (created_at, nonce) of the last run of the previous page
+SELECT nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at
+FROM test_runs
+WHERE (sqlc.narg('user_id')::text IS NULL OR user_id = sqlc.narg('user_id'))
+  AND (sqlc.narg('status')::text IS NULL OR status = sqlc.narg('status'))
+  AND created_at >= sqlc.arg('since')
+  AND (sqlc.narg('cursor_created_at')::timestamptz IS NULL
+       OR (created_at, nonce) < (sqlc.narg('cursor_created_at'), sqlc.narg('cursor_nonce')::text))
+ORDER BY created_at DESC, nonce DESC
+LIMIT sqlc.arg('limit_count');
+
+-- name: GetTestRunStats :one
+-- Ack latency is measured like TestRunLatency.SendToAckMs; percentiles are 0 without ACKED runs
+SELECT
+    COUNT(*) AS total,
+    COUNT(*) FILTER (WHERE status = 'ACKED') AS acked,
+    COUNT(*) FILTER (WHERE status = 'PENDING') AS pending,
+    COUNT(*) FILTER (WHERE status = 'EXPIRED') AS expired,
+    COUNT(*) FILTER (WHERE status = 'SEND_FAILED') AS send_failed,
+    COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM acked_at - COALESCE(sent_at, created_at)) * 1000)
+        FILTER (WHERE status = 'ACKED'), 0)::float8 AS p50_ack_latency_ms,
+    COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM acked_at - COALESCE(sent_at, created_at)) * 1000)
+        FILTER (WHERE status = 'ACKED'), 0)::float8 AS p95_ack_latency_ms
+FROM test_runs
+WHERE (sqlc.narg('user_id')::text IS NULL OR user_id = sqlc.narg('user_id'))
+  AND created_at >= sqlc.arg('since')
+  AND created_at < sqlc.arg('until');
+
+-- name: CreateMessage :exec
+INSERT INTO messages (message_id, user_id, created_at)
+VALUES ($1, $2, NOW());
+
+-- name: CreateMessageDelivery :exec
+INSERT INTO message_deliveries (message_id, device_id, platform, app_id, status, campaign_id, variant)
+VALUES ($1, $2, $3, $4, 'PENDING', $5, $6);
+
+-- name: GetMessageDelivery :one
+SELECT message_id, device_id, platform, app_id, status, failure_reason, sent_at, delivered_at, opened_at, dismissed_at, campaign_id, variant
+FROM message_deliveries
+WHERE message_id = $1 AND device_id = $2;
+
+-- name: MarkMessageDeliverySent :exec
+UPDATE message_deliveries
+SET status = 'SENT', sent_at = NOW()
+WHERE message_id = $1 AND device_id = $2 AND status = 'PENDING';
+
+-- name: MarkMessageDeliverySendFailed :exec
+UPDATE message_deliveries
+SET status = 'SEND_FAILED', failure_reason = $3
+WHERE message_id = $1 AND device_id = $2 AND status = 'PENDING';
+
+-- name: RecordMessageReceipt :one
+-- Each event keeps the time it was first reported; opened and dismissed imply delivered.
+-- A receipt may arrive before the send returns, so PENDING deliveries accept it too.
+UPDATE message_deliveries
+SET delivered_at = COALESCE(delivered_at, NOW()),
+    opened_at = CASE WHEN sqlc.arg('event')::text = 'opened' THEN COALESCE(opened_at, NOW()) ELSE opened_at END,
+    dismissed_at = CASE WHEN sqlc.arg('event')::text = 'dismissed' THEN COALESCE(dismissed_at, NOW()) ELSE dismissed_at END
+WHERE message_id = sqlc.arg('message_id') AND device_id = sqlc.arg('device_id') AND status IN ('PENDING', 'SENT')
+RETURNING message_id, device_id, platform, app_id, status, failure_reason, sent_at, delivered_at, opened_at, dismissed_at, campaign_id, variant;
+
+-- name: UpsertTemplate :one
+INSERT INTO templates (template_key, locale, title, body, default_data, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+ON CONFLICT (template_key, locale)
+DO UPDATE SET
+    title = EXCLUDED.title,
+    body = EXCLUDED.body,
+    default_data = EXCLUDED.default_data,
+    updated_at = NOW()
+RETURNING template_key, locale, title, body, default_data, created_at, updated_at;
+
+-- name: GetTemplate :one
+SELECT template_key, locale, title, body, default_data, created_at, updated_at
+FROM templates
+WHERE template_key = $1 AND locale = $2;
+
+-- name: ListTemplates :many
+SELECT template_key, locale, title, body, default_data, created_at, updated_at
+FROM templates
+WHERE sqlc.narg('template_key')::text IS NULL OR template_key = sqlc.narg('template_key')
+ORDER BY template_key, locale;
+
+-- name: DeleteTemplate :execrows
+DELETE FROM templates
+WHERE template_key = $1 AND locale = $2;
+
+-- name: GetNotificationCategory :one
+SELECT category, description, mandatory, default_enabled
+FROM notification_categories
+WHERE category = $1;
+
+-- name: ListNotificationCategories :many
+SELECT category, description, mandatory, default_enabled
+FROM notification_categories
+ORDER BY category;
+
+-- name: ListNotificationPreferences :many
+SELECT user_id, device_id, category, enabled, updated_at
+FROM notification_preferences
+WHERE user_id = $1
+ORDER BY device_id, category;
+
+-- name: DeleteNotificationPreferences :exec
+DELETE FROM notification_preferences
+WHERE user_id = $1;
+
+-- name: CreateNotificationPreference :exec
+INSERT INTO notification_preferences (user_id, device_id, category, enabled, updated_at)
+VALUES ($1, $2, $3, $4, NOW());
+
+-- name: UpsertSegment :one
+INSERT INTO segments (segment_id, description, expression, created_at, updated_at)
+VALUES ($1, $2, $3, NOW(), NOW())
+ON CONFLICT (segment_id)
+DO UPDATE SET
+    description = EXCLUDED.description,
+    expression = EXCLUDED.expression,
+    updated_at = NOW()
+RETURNING segment_id, description, expression, created_at, updated_at;
+
+-- name: GetSegment :one
+SELECT segment_id, description, expression, created_at, updated_at
+FROM segments
+WHERE segment_id = $1;
+
+-- name: ListSegments :many
+SELECT segment_id, description, expression, created_at, updated_at
+FROM segments
+ORDER BY segment_id;
+
+-- name: DeleteSegment :execrows
+DELETE FROM segments
+WHERE segment_id = $1;
+
+-- name: CreateBroadcast :one
+-- total_devices counts the devices the broadcast targets now; devices registered later are included
+INSERT INTO broadcasts (broadcast_id, message, batch_size, total_devices, created_at, updated_at)
+VALUES ($1, $2, $3, (SELECT COUNT(*) FROM devices WHERE is_active = TRUE AND platform IN ('android', 'ios')), NOW(), NOW())
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at;
+
+-- name: GetBroadcast :one
+SELECT broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
+FROM broadcasts
+WHERE broadcast_id = $1;
+
+-- name: ListBroadcasts :many
+SELECT broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
+FROM broadcasts
+ORDER BY created_at DESC, broadcast_id
+LIMIT sqlc.arg('limit_count');
+
+-- name: ClaimBroadcast :one
+-- Takes the lease of the oldest RUNNING broadcast that no invocation holds, or of the given one.
+-- Returns no rows if there is none.
+UPDATE broadcasts
+SET lease_expires_at = sqlc.arg('lease_expires_at'), updated_at = NOW()
+WHERE broadcast_id = (
+    SELECT b.broadcast_id
+    FROM broadcasts b
+    WHERE b.status = 'RUNNING'
+      AND (b.lease_expires_at IS NULL OR b.lease_expires_at < NOW())
+      AND (sqlc.narg('broadcast_id')::text IS NULL OR b.broadcast_id = sqlc.narg('broadcast_id'))
+    ORDER BY b.created_at
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED)
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at;
+
+-- name: CheckpointBroadcast :one
+-- Records a batch whose sends are enqueued in the same transaction and extends the lease, or completes
+-- the broadcast. The broadcast must still be at previous_device_id, so each batch is recorded once.
+-- Returns no rows otherwise.
+UPDATE broadcasts
+SET last_device_id = sqlc.arg('last_device_id'),
+    suppressed_count = suppressed_count + sqlc.arg('suppressed')::int,
+    status = CASE WHEN sqlc.arg('completed')::boolean THEN 'COMPLETED' ELSE status END,
+    completed_at = CASE WHEN sqlc.arg('completed')::boolean THEN NOW() END,
+    lease_expires_at = CASE WHEN sqlc.arg('completed')::boolean THEN NULL ELSE sqlc.arg('lease_expires_at')::timestamptz END,
+    updated_at = NOW()
+WHERE broadcast_id = sqlc.arg('broadcast_id')
+  AND status = 'RUNNING'
+  AND last_device_id = sqlc.arg('previous_device_id')
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at;
+
+-- name: RecordBroadcastSends :one
+-- Counts the sends of a checkpointed batch that were published; sends left to the relay are not counted
+UPDATE broadcasts
+SET sent_count = sent_count + sqlc.arg('sent')::int,
+    failed_count = failed_count + sqlc.arg('failed')::int,
+    updated_at = NOW()
+WHERE broadcast_id = sqlc.arg('broadcast_id')
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at;
+
+-- name: ReleaseBroadcast :exec
+-- Gives up a lease, so the next invocation can resume the broadcast without waiting for it to expire
+UPDATE broadcasts
+SET lease_expires_at = NULL, updated_at = NOW()
+WHERE broadcast_id = $1 AND status = 'RUNNING' AND lease_expires_at = $2;
+
+-- name: FailBroadcast :one
+UPDATE broadcasts
+SET status = 'FAILED', failure_reason = $2, lease_expires_at = NULL, completed_at = NOW(), updated_at = NOW()
+WHERE broadcast_id = $1 AND status = 'RUNNING'
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at;
+
+-- name: ListBroadcastDevices :many
+-- Active devices after a broadcast's checkpoint, in id order
+SELECT id, user_id, device_id, platform, app_id, fcm_token, token_type, locale, is_active, updated_at
+FROM devices
+WHERE is_active = TRUE AND platform IN ('android', 'ios') AND id > sqlc.arg('after_id')
+ORDER BY id
+LIMIT sqlc.arg('limit_count');
+
+-- name: UpsertCampaign :one
+INSERT INTO campaigns (campaign_id, description, category, holdout_percent, created_at, updated_at)
+VALUES ($1, $2, $3, $4, NOW(), NOW())
+ON CONFLICT (campaign_id)
+DO UPDATE SET
+    description = EXCLUDED.description,
+    category = EXCLUDED.category,
+    holdout_percent = EXCLUDED.holdout_percent,
+    updated_at = NOW()
+RETURNING campaign_id, description, category, holdout_percent, created_at, updated_at;
+
+-- name: GetCampaign :one
+SELECT campaign_id, description, category, holdout_percent, created_at, updated_at
+FROM campaigns
+WHERE campaign_id = $1;
+
+-- name: ListCampaigns :many
+SELECT campaign_id, description, category, holdout_percent, created_at, updated_at
+FROM campaigns
+ORDER BY campaign_id;
+
+-- name: DeleteCampaign :execrows
+-- Variants and assignments are deleted with the campaign; deliveries keep their campaign_id and variant
+DELETE FROM campaigns
+WHERE campaign_id = $1;
+
+-- name: DeleteCampaignVariants :exec
+DELETE FROM campaign_variants
+WHERE campaign_id = $1;
+
+-- name: CreateCampaignVariant :exec
+INSERT INTO campaign_variants (campaign_id, variant, weight, title, body, data)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: ListCampaignVariants :many
+-- Variants of the campaign, or of all campaigns without campaign_id
+SELECT campaign_id, variant, weight, title, body, data
+FROM campaign_variants
+WHERE (sqlc.narg('campaign_id')::text IS NULL OR campaign_id = sqlc.narg('campaign_id'))
+ORDER BY campaign_id, variant;
+
+-- name: UpsertCampaignAssignment :exec
+-- Keeps the time of the first assignment. The variant only changes if the campaign's variants were replaced.
+INSERT INTO campaign_assignments (campaign_id, user_id, variant, assigned_at)
+VALUES ($1, $2, $3, NOW())
+ON CONFLICT (campaign_id, user_id)
+DO UPDATE SET variant = EXCLUDED.variant;
+
+-- name: CountCampaignAssignments :many
+-- Users by variant; the holdout group has a NULL variant
+SELECT variant, COUNT(*) AS users
+FROM campaign_assignments
+WHERE campaign_id = $1
+GROUP BY variant
+ORDER BY variant;
+
+-- name: GetCampaignDeliveryStats :many
+-- Deliveries and receipts by variant. opened_users counts users who opened the message on any device.
+SELECT d.variant,
+    COUNT(*) AS deliveries,
+    COUNT(*) FILTER (WHERE d.status = 'SENT') AS sent,
+    COUNT(*) FILTER (WHERE d.status = 'SEND_FAILED') AS failed,
+    COUNT(d.delivered_at) AS delivered,
+    COUNT(d.opened_at) AS opened,
+    COUNT(DISTINCT m.user_id) FILTER (WHERE d.opened_at IS NOT NULL) AS opened_users
+FROM message_deliveries d
+JOIN messages m ON m.message_id = d.message_id
+WHERE d.campaign_id = sqlc.arg('campaign_id')::text
+GROUP BY d.variant
+ORDER BY d.variant;
+
+-- name: CreateWebhookSubscription :one
+INSERT INTO webhook_subscriptions (subscription_id, url, event_types, secret, description)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING subscription_id, url, event_types, secret, description, created_at;
+
+-- name: GetWebhookSubscription :one
+SELECT subscription_id, url, event_types, secret, description, created_at
+FROM webhook_subscriptions
+WHERE subscription_id = $1;
+
+-- name: ListWebhookSubscriptions :many
+SELECT subscription_id, url, event_types, secret, description, created_at
+FROM webhook_subscriptions
+ORDER BY created_at, subscription_id;
+
+-- name: DeleteWebhookSubscription :execrows
+-- Pending deliveries and dead letters are deleted with the subscription
+DELETE FROM webhook_subscriptions
+WHERE subscription_id = $1;
+
+-- name: EnqueueWebhookEvent :execrows
+-- One delivery per subscription to the event type; returns the number of subscriptions
+INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload)
+SELECT subscription_id, sqlc.arg('event_id')::text, sqlc.arg('event_type')::text, sqlc.arg('payload')::jsonb
+FROM webhook_subscriptions
+WHERE sqlc.arg('event_type')::text = ANY(event_types);
+
+-- name: ClaimWebhookDeliveries :many
+-- Takes due deliveries by moving next_attempt_at to the end of a lease, so concurrent invocations
+-- skip them. A delivery whose invocation stops before recording the attempt is retried after the lease.
+UPDATE webhook_deliveries d
+SET next_attempt_at = sqlc.arg('lease_expires_at')
+FROM webhook_subscriptions s
+WHERE s.subscription_id = d.subscription_id
+  AND d.delivery_id IN (
+    SELECT w.delivery_id
+    FROM webhook_deliveries w
+    WHERE w.next_attempt_at <= NOW()
+    ORDER BY w.next_attempt_at, w.delivery_id
+    LIMIT sqlc.arg('limit_count')
+    FOR UPDATE SKIP LOCKED)
+RETURNING d.delivery_id, d.subscription_id, d.event_id, d.event_type, d.payload, d.attempts, s.url, s.secret;
+
+-- name: DeleteWebhookDelivery :exec
+DELETE FROM webhook_deliveries
+WHERE delivery_id = $1;
+
+-- name: RetryWebhookDelivery :exec
+UPDATE webhook_deliveries
+SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3
+WHERE delivery_id = $1;
+
+-- name: DeadLetterWebhookDelivery :execrows
+-- Moves a delivery to webhook_dead_letters after its last failed attempt
+WITH failed AS (
+    DELETE FROM webhook_deliveries
+    WHERE delivery_id = sqlc.arg('delivery_id')
+    RETURNING delivery_id, subscription_id, event_id, event_type, payload, attempts, created_at
+)
+INSERT INTO webhook_dead_letters (delivery_id, subscription_id, event_id, event_type, payload, attempts, last_error, created_at)
+SELECT delivery_id, subscription_id, event_id, event_type, payload, attempts + 1, sqlc.arg('last_error')::text, created_at
+FROM failed;
+
+-- name: ListWebhookDeadLetters :many
+-- Newest first
+SELECT delivery_id, subscription_id, event_id, event_type, payload, attempts, last_error, created_at, failed_at
+FROM webhook_dead_letters
+WHERE subscription_id = sqlc.arg('subscription_id')
+ORDER BY failed_at DESC, delivery_id DESC
+LIMIT sqlc.arg('limit_count');
+
+-- name: CreateOutboxEntry :one
+INSERT INTO outbox (kind, payload, available_at)
+VALUES ($1, $2, $3)
+RETURNING outbox_id, kind, payload, attempts, available_at, last_error, created_at;
+
+-- name: ClaimOutboxEntries :many
+-- Takes available entries by moving available_at to the end of a lease, so concurrent invocations
+-- skip them. An entry whose invocation stops before publishing it is taken again after the lease.
+UPDATE outbox
+SET available_at = sqlc.arg('lease_expires_at'), attempts = attempts + 1
+WHERE outbox_id IN (
+    SELECT outbox_id
+    FROM outbox
+    WHERE available_at <= NOW()
+    ORDER BY available_at, outbox_id
+    LIMIT sqlc.arg('limit_count')
+    FOR UPDATE SKIP LOCKED)
+RETURNING outbox_id, kind, payload, attempts, available_at, last_error, created_at;
+
+-- name: DeleteOutboxEntry :execrows
+-- Returns 0 if another invocation published the entry first
+DELETE FROM outbox
+WHERE outbox_id = $1;
+
+-- name: RetryOutboxEntry :exec
+UPDATE outbox
+SET available_at = $2, last_error = $3
+WHERE outbox_id = $1;
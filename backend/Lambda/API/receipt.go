@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Receipt events reported by devices for any message
+const (
+	receiptEventDelivered = "delivered" // The message reached the device
+	receiptEventOpened    = "opened"    // The user opened the notification
+	receiptEventDismissed = "dismissed" // The user dismissed the notification
+)
+
+type MessageReceiptRequest struct {
+	Event        string `json:"event"`         // delivered, opened or dismissed
+	ReceiptToken string `json:"receipt_token"` // data.receipt_token of the message, echoed back
+	DeviceId     string `json:"device_id"`     // Optional, must match the token
+}
+
+type MessageReceiptResponse struct {
+	OK          bool       `json:"ok"`
+	MessageID   string     `json:"message_id"`
+	DeviceID    string     `json:"device_id"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	OpenedAt    *time.Time `json:"opened_at,omitempty"`
+	DismissedAt *time.Time `json:"dismissed_at,omitempty"`
+	CampaignID  string     `json:"campaign_id,omitempty"` // Campaign messages only, see campaigns.go
+	Variant     string     `json:"variant,omitempty"`
+}
+
+// MessageReceiptHandler is the Lambda handler for POST /messages/{id}/receipt.
+// It records a delivered, opened or dismissed event of a message on the reporting device's delivery.
+func (s *Service) MessageReceiptHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received message receipt request")
+
+	messageID := request.PathParameters["id"]
+	if messageID == "" {
+		err := fmt.Errorf("missing path parameter: id")
+		return logger.BadRequest(ctx, err, "Missing message id")
+	}
+
+	var receiptRequest MessageReceiptRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &receiptRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+
+	switch receiptRequest.Event {
+	case receiptEventDelivered, receiptEventOpened, receiptEventDismissed:
+	default:
+		err := fmt.Errorf("invalid event: %q", receiptRequest.Event)
+		return logger.BadRequest(ctx, err, "event must be delivered, opened or dismissed")
+	}
+
+	// Verify the receipt token: only a device the message was sent to can report on it
+	if receiptRequest.ReceiptToken == "" {
+		err := fmt.Errorf("missing receipt_token: message_id=%s", messageID)
+		return logger.Unauthorized(ctx, err, "Missing receipt_token")
+	}
+	tokenKey, err := s.ackTokenKey(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to get ack token key")
+	}
+	claims, err := verifyAckToken(tokenKey, receiptRequest.ReceiptToken, s.Clock.Now())
+	if err != nil {
+		return logger.Unauthorized(ctx, err, "Invalid or expired receipt_token")
+	}
+	if claims.MessageID != messageID || (receiptRequest.DeviceId != "" && claims.DeviceID != receiptRequest.DeviceId) {
+		err := fmt.Errorf("receipt_token for message_id=%s, device_id=%s used for message_id=%s, device_id=%s",
+			claims.MessageID, claims.DeviceID, messageID, receiptRequest.DeviceId)
+		return logger.Unauthorized(ctx, err, "receipt_token does not match message id and device_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	// Repeated receipts of an event keep its first time, so clients can safely retry
+	delivery, err := queries.RecordMessageReceipt(ctx, sqlc.RecordMessageReceiptParams{
+		Event:     receiptRequest.Event,
+		MessageID: messageID,
+		DeviceID:  claims.DeviceID,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Unknown message or device, or the send to the device failed → 404
+			err := fmt.Errorf("message delivery not found: message_id=%s, device_id=%s", messageID, claims.DeviceID)
+			return logger.NotFound(ctx, err, "Message delivery not found")
+		}
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+
+	logger.Info(ctx, "Message receipt recorded: message_id=%s, device_id=%s, event=%s", messageID, claims.DeviceID, receiptRequest.Event)
+
+	response := MessageReceiptResponse{
+		OK:          true,
+		MessageID:   delivery.MessageID,
+		DeviceID:    delivery.DeviceID,
+		DeliveredAt: optionalTimePtr(delivery.DeliveredAt),
+		OpenedAt:    optionalTimePtr(delivery.OpenedAt),
+		DismissedAt: optionalTimePtr(delivery.DismissedAt),
+		CampaignID:  delivery.CampaignID.String,
+		Variant:     delivery.Variant.String,
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// optionalTimePtr converts NULL to nil
+func optionalTimePtr(value pgtype.Timestamptz) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t := value.Time
+	return &t
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// postReceipt invokes MessageReceiptHandler for message messageID.
+func postReceipt(t *testing.T, service *Service, messageID string, receipt MessageReceiptRequest) events.APIGatewayProxyResponse {
+	t.Helper()
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := service.MessageReceiptHandler(context.Background(), events.APIGatewayProxyRequest{
+		Body:           string(body),
+		PathParameters: map[string]string{"id": messageID},
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return response
+}
+
+// sentMessageTo returns the message sent to an FCM token.
+func sentMessageTo(t *testing.T, fakes *testServiceFakes, token string) fakeSentMessage {
+	t.Helper()
+	for _, message := range fakes.sender.Sent() {
+		if message.Token == token {
+			return message
+		}
+	}
+	t.Fatalf("no message sent to %s", token)
+	return fakeSentMessage{}
+}
+
+func TestMessageReceipts(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+
+	response := invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil)
+	expectStatus(t, response, 200)
+	var sendResponse SendMessageResponse
+	decodeBody(t, response, &sendResponse)
+
+	android := sentMessageTo(t, fakes, "token-1")
+	ios := sentMessageTo(t, fakes, "token-2")
+	messageID := android.Data[messageIDDataKey]
+	if messageID == "" || messageID != sendResponse.MessageID || ios.Data[messageIDDataKey] != messageID {
+		t.Fatalf("message_id %q not sent to every device: %+v", sendResponse.MessageID, fakes.sender.Sent())
+	}
+	if delivery := fakes.querier.messageDeliveries[fakeMessageDeliveryKey{messageID, "device-1"}]; delivery.Status != deliveryStatusSent {
+		t.Fatalf("expected SENT delivery, got %+v", delivery)
+	}
+
+	receipt := func(message fakeSentMessage, event string) MessageReceiptResponse {
+		t.Helper()
+		response := postReceipt(t, service, messageID, MessageReceiptRequest{Event: event, ReceiptToken: message.Data[receiptTokenDataKey]})
+		expectStatus(t, response, 200)
+		var receipt MessageReceiptResponse
+		decodeBody(t, response, &receipt)
+		return receipt
+	}
+
+	// device-1 reports delivered, then opened; each event keeps its first time
+	deliveredAt := fakes.clock.Now()
+	receipt(android, receiptEventDelivered)
+	fakes.clock.Advance(time.Minute)
+	openedAt := fakes.clock.Now()
+	receipt(android, receiptEventOpened)
+	fakes.clock.Advance(time.Minute)
+	got := receipt(android, receiptEventOpened)
+	if got.DeviceID != "device-1" || !got.DeliveredAt.Equal(deliveredAt) || !got.OpenedAt.Equal(openedAt) || got.DismissedAt != nil {
+		t.Fatalf("unexpected receipt for device-1: %+v", got)
+	}
+
+	// device-2 only reports dismissed, which implies delivered
+	got = receipt(ios, receiptEventDismissed)
+	if got.DeviceID != "device-2" || got.DeliveredAt == nil || !got.DeliveredAt.Equal(*got.DismissedAt) || got.OpenedAt != nil {
+		t.Fatalf("unexpected receipt for device-2: %+v", got)
+	}
+}
+
+func TestMessageReceiptRejectsInvalidRequests(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	sendE2ETest(t, service, "30")
+
+	message := sentMessageTo(t, fakes, "token-1")
+	messageID := message.Data[messageIDDataKey]
+	token := message.Data[receiptTokenDataKey]
+	now := fakes.clock.Now()
+	sign := func(claims ackTokenClaims) string {
+		t.Helper()
+		token, err := signAckToken([]byte(testAckTokenKey), claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	for name, receipt := range map[string]MessageReceiptRequest{
+		"missing":       {Event: receiptEventDelivered},
+		"other device":  {Event: receiptEventDelivered, ReceiptToken: token, DeviceId: "device-2"},
+		"other message": {Event: receiptEventDelivered, ReceiptToken: sign(ackTokenClaims{MessageID: "msg-other", DeviceID: "device-1", ExpiresAt: now.Add(time.Hour).Unix()})},
+		"ack token":     {Event: receiptEventDelivered, ReceiptToken: message.Data[ackTokenDataKey]},
+		"both ids":      {Event: receiptEventDelivered, ReceiptToken: sign(ackTokenClaims{Nonce: "nonce-1", MessageID: messageID, DeviceID: "device-1", ExpiresAt: now.Add(time.Hour).Unix()})},
+	} {
+		if response := postReceipt(t, service, messageID, receipt); response.StatusCode != 401 {
+			t.Errorf("%s: expected 401, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+
+	expectStatus(t, postReceipt(t, service, messageID, MessageReceiptRequest{Event: "read", ReceiptToken: token}), 400)
+	expectStatus(t, postReceipt(t, service, "", MessageReceiptRequest{Event: receiptEventDelivered, ReceiptToken: token}), 400)
+
+	// A valid token for a device the message was not sent to
+	other := sign(ackTokenClaims{MessageID: messageID, DeviceID: "device-3", ExpiresAt: now.Add(time.Hour).Unix()})
+	expectStatus(t, postReceipt(t, service, messageID, MessageReceiptRequest{Event: receiptEventDelivered, ReceiptToken: other}), 404)
+
+	// Receipt tokens outlive FCM's longest message lifetime, but not forever
+	fakes.clock.Advance(receiptTokenLifetime)
+	expectStatus(t, postReceipt(t, service, messageID, MessageReceiptRequest{Event: receiptEventOpened, ReceiptToken: token}), 401)
+}
+
+func TestMessageReceiptFailedDelivery(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	fakes.sender.FailToken("token-1", fakeRejection("UNREGISTERED"))
+
+	expectStatus(t, invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil), 200)
+
+	if len(fakes.querier.messages) != 1 {
+		t.Fatalf("expected one message, got %+v", fakes.querier.messages)
+	}
+	var messageID string
+	for messageID = range fakes.querier.messages {
+	}
+	delivery := fakes.querier.messageDeliveries[fakeMessageDeliveryKey{messageID, "device-1"}]
+	if delivery.Status != deliveryStatusSendFailed || delivery.FailureReason.String != "UNREGISTERED" {
+		t.Fatalf("expected SEND_FAILED delivery to device-1, got %+v", delivery)
+	}
+
+	// The device never got the message, so even a validly signed receipt is not recorded
+	token, err := signAckToken([]byte(testAckTokenKey), ackTokenClaims{
+		MessageID: messageID, DeviceID: "device-1", ExpiresAt: fakes.clock.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, postReceipt(t, service, messageID, MessageReceiptRequest{Event: receiptEventDelivered, ReceiptToken: token}), 404)
+}
+
+func TestMessageReceiptHandler(t *testing.T) {
+	requireDB(t)
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+
+	response := invoke(t, testService.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil)
+	expectStatus(t, response, 200)
+	var sendResponse SendMessageResponse
+	decodeBody(t, response, &sendResponse)
+
+	messages := testFCM.Messages()
+	if len(messages) != 1 || messages[0].Data[messageIDDataKey] != sendResponse.MessageID {
+		t.Fatalf("unexpected FCM messages: %+v", messages)
+	}
+	token := messages[0].Data[receiptTokenDataKey]
+
+	for _, event := range []string{receiptEventDelivered, receiptEventOpened} {
+		expectStatus(t, postReceipt(t, testService, sendResponse.MessageID, MessageReceiptRequest{Event: event, ReceiptToken: token, DeviceId: "device-1"}), 200)
+	}
+	response = postReceipt(t, testService, sendResponse.MessageID, MessageReceiptRequest{Event: receiptEventOpened, ReceiptToken: token})
+	expectStatus(t, response, 200)
+
+	var receipt MessageReceiptResponse
+	decodeBody(t, response, &receipt)
+	if receipt.DeliveredAt == nil || receipt.OpenedAt == nil || receipt.OpenedAt.Before(*receipt.DeliveredAt) || receipt.DismissedAt != nil {
+		t.Fatalf("unexpected receipt: %+v", receipt)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"regexp"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/fcm-tutorial/lambda/api/common"
@@ -12,18 +13,26 @@ import (
 )
 
 type RegisterDeviceRequest struct {
-	UserId   string `json:"user_id"`
-	DeviceId string `json:"device_id"`
-	FcmToken string `json:"fcm_token"`
-	Platform string `json:"platform"`
+	UserId    string `json:"user_id"`
+	DeviceId  string `json:"device_id"`
+	FcmToken  string `json:"fcm_token"`  // The push token: an APNs device token if token_type is "apns"
+	TokenType string `json:"token_type"` // Optional "fcm" (default) or "apns", for iOS apps without the Firebase SDK
+	Platform  string `json:"platform"`
+	AppId     string `json:"app_id"` // Optional, defaults to "default"
+	Locale    string `json:"locale"` // Optional BCP 47 language tag, e.g. "pt-BR"; selects the template locale
+
+	DeviceMetadata // Optional app_version, os_version, device_model, timezone, sdk_version
 }
 
+// apnsDeviceTokenPattern matches APNs device tokens: hex, 32 bytes today but documented to vary in length
+var apnsDeviceTokenPattern = regexp.MustCompile(`^(?:[0-9a-fA-F]{2}){32,100}$`)
+
 type RegisterDeviceResponse struct {
 	OK bool `json:"ok"`
 }
 
 // RegisterDeviceHandler is the Lambda handler for device registration
-func RegisterDeviceHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func (s *Service) RegisterDeviceHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	logger := common.NewLogger()
 	logger.Info(ctx, "Received device registration request")
 
@@ -50,16 +59,57 @@ func RegisterDeviceHandler(ctx context.Context, request events.APIGatewayProxyRe
 		return logger.BadRequest(ctx, err, "Platform must be 'android' or 'ios'")
 	}
 
+	// Validate app_id against the configured Firebase apps, or the apps with APNs credentials for APNs tokens
+	if registerDeviceRequest.AppId == "" {
+		registerDeviceRequest.AppId = common.DefaultAppID
+	}
+	switch registerDeviceRequest.TokenType {
+	case "", tokenTypeFCM:
+		registerDeviceRequest.TokenType = tokenTypeFCM
+		if !s.Apps.HasApp(registerDeviceRequest.AppId) {
+			err := fmt.Errorf("unknown app_id: %s (must be one of %v)", registerDeviceRequest.AppId, s.Apps.AppIDs())
+			return logger.BadRequest(ctx, err, "Unknown app_id")
+		}
+	case tokenTypeAPNs:
+		if registerDeviceRequest.Platform != "ios" {
+			err := fmt.Errorf("APNs token for platform %s", registerDeviceRequest.Platform)
+			return logger.BadRequest(ctx, err, "token_type 'apns' requires platform 'ios'")
+		}
+		if !s.Apps.HasAPNs(registerDeviceRequest.AppId) {
+			err := fmt.Errorf("no APNs credentials for app_id: %s", registerDeviceRequest.AppId)
+			return logger.BadRequest(ctx, err, "app_id has no APNs credentials")
+		}
+		if !apnsDeviceTokenPattern.MatchString(registerDeviceRequest.FcmToken) {
+			err := fmt.Errorf("invalid APNs device token: device_id=%s", registerDeviceRequest.DeviceId)
+			return logger.BadRequest(ctx, err, "APNs device token must be hex")
+		}
+	default:
+		err := fmt.Errorf("invalid token_type: %s (must be 'fcm' or 'apns')", registerDeviceRequest.TokenType)
+		return logger.BadRequest(ctx, err, "token_type must be 'fcm' or 'apns'")
+	}
+
+	// Validate locale; "pt_br" and "pt-br" are stored as "pt-BR", like template locales
+	if registerDeviceRequest.Locale != "" {
+		locale, err := normalizeLocale(registerDeviceRequest.Locale)
+		if err != nil {
+			return logger.BadRequest(ctx, err, "Invalid locale")
+		}
+		registerDeviceRequest.Locale = locale
+	}
+
+	// Validate optional device metadata
+	if err := registerDeviceRequest.DeviceMetadata.validate(); err != nil {
+		return logger.BadRequest(ctx, err, "Invalid device metadata")
+	}
+
 	// Get database connection
-	db, err := common.GetDBConnection()
+	queries, err := s.Store.Queries(ctx)
 	if err != nil {
 		return logger.InternalServerError(ctx, err, "Database connection failed")
 	}
-	defer common.CloseDBConnection(db)
 
 	// Check if device_id already exists with a different user_id
 	// device_id should be globally unique (one device can only belong to one user)
-	queries := sqlc.New(db)
 	existingDevice, err := queries.GetDeviceByDeviceID(ctx, registerDeviceRequest.DeviceId)
 	if err == nil {
 		// Device exists, check if it belongs to a different user
@@ -84,20 +134,45 @@ func RegisterDeviceHandler(ctx context.Context, request events.APIGatewayProxyRe
 
 	// Upsert device record using sqlc
 	// Database has UNIQUE constraint on (user_id, device_id)
-	// - If (user_id, device_id) combination exists: update fcm_token, is_active = TRUE, updated_at = NOW()
+	// - If (user_id, device_id) combination exists: update app_id, fcm_token, token_type, locale, metadata, is_active = TRUE, updated_at = NOW()
 	// - If (user_id, device_id) combination does not exist: insert a new row
-	err = queries.UpsertDevice(ctx, sqlc.UpsertDeviceParams{
-		UserID:   registerDeviceRequest.UserId,
-		DeviceID: registerDeviceRequest.DeviceId,
-		Platform: registerDeviceRequest.Platform,
-		FcmToken: registerDeviceRequest.FcmToken,
+	// The device.registered event is emitted in the same transaction
+	var event sqlc.Outbox
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		err := queries.UpsertDevice(ctx, sqlc.UpsertDeviceParams{
+			UserID:      registerDeviceRequest.UserId,
+			DeviceID:    registerDeviceRequest.DeviceId,
+			Platform:    registerDeviceRequest.Platform,
+			AppID:       registerDeviceRequest.AppId,
+			FcmToken:    registerDeviceRequest.FcmToken,
+			TokenType:   registerDeviceRequest.TokenType,
+			Locale:      optionalText(registerDeviceRequest.Locale),
+			AppVersion:  optionalText(registerDeviceRequest.AppVersion),
+			OsVersion:   optionalText(registerDeviceRequest.OsVersion),
+			DeviceModel: optionalText(registerDeviceRequest.DeviceModel),
+			Timezone:    optionalText(registerDeviceRequest.Timezone),
+			SdkVersion:  optionalText(registerDeviceRequest.SdkVersion),
+		})
+		if err != nil {
+			return err
+		}
+		event, err = s.emitWebhookEvent(ctx, queries, webhookDeviceRegistered, DeviceEventData{
+			UserID:   registerDeviceRequest.UserId,
+			DeviceID: registerDeviceRequest.DeviceId,
+			Platform: registerDeviceRequest.Platform,
+			AppID:    registerDeviceRequest.AppId,
+			Locale:   registerDeviceRequest.Locale,
+		})
+		return err
 	})
 	if err != nil {
 		return logger.InternalServerError(ctx, err, "Database operation failed")
 	}
 
-	logger.Info(ctx, "Device registered successfully: user_id=%s, device_id=%s",
-		registerDeviceRequest.UserId, registerDeviceRequest.DeviceId)
+	logger.Info(ctx, "Device registered successfully: user_id=%s, device_id=%s, app_id=%s, token_type=%s",
+		registerDeviceRequest.UserId, registerDeviceRequest.DeviceId, registerDeviceRequest.AppId, registerDeviceRequest.TokenType)
+
+	s.publishOutbox(ctx, logger, []sqlc.Outbox{event})
 
 	// Prepare success response (README requires: { "ok": true })
 	response := RegisterDeviceResponse{
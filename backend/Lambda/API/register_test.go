@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+)
+
+func TestRegisterDeviceHandler(t *testing.T) {
+	db := requireDB(t)
+	queries := sqlc.New(db)
+
+	response := invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil)
+	expectStatus(t, response, 200)
+
+	var body RegisterDeviceResponse
+	decodeBody(t, response, &body)
+	if !body.OK {
+		t.Fatalf("expected ok=true, got %s", response.Body)
+	}
+
+	device, err := queries.GetDeviceByDeviceID(context.Background(), "device-1")
+	if err != nil {
+		t.Fatalf("device not stored: %v", err)
+	}
+	if device.UserID != "user-1" || device.FcmToken != "token-1" || device.AppID != "default" || !device.IsActive {
+		t.Fatalf("unexpected device: %+v", device)
+	}
+
+	// Registering again for the same user updates the token
+	response = invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-2","platform":"android"}`, nil)
+	expectStatus(t, response, 200)
+
+	device, err = queries.GetDeviceByDeviceID(context.Background(), "device-1")
+	if err != nil {
+		t.Fatalf("device not stored: %v", err)
+	}
+	if device.FcmToken != "token-2" {
+		t.Fatalf("expected token-2 after re-registration, got %s", device.FcmToken)
+	}
+}
+
+func TestRegisterDeviceHandlerConflict(t *testing.T) {
+	requireDB(t)
+
+	response := invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"ios"}`, nil)
+	expectStatus(t, response, 200)
+
+	// device_id is globally unique: another user cannot claim it
+	response = invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-2","device_id":"device-1","fcm_token":"token-2","platform":"ios"}`, nil)
+	expectStatus(t, response, 409)
+}
+
+func TestRegisterDeviceHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `{"user_id":`},
+		{"missing fcm_token", `{"user_id":"user-1","device_id":"device-1","platform":"android"}`},
+		{"invalid platform", `{"user_id":"user-1","device_id":"device-1","fcm_token":"t","platform":"web"}`},
+		{"unknown app_id", `{"user_id":"user-1","device_id":"device-1","fcm_token":"t","platform":"ios","app_id":"nope"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, invoke(t, testService.RegisterDeviceHandler, tt.body, nil), 400)
+		})
+	}
+}
+
+func TestRegisterDeviceHandlerDatabaseUnavailable(t *testing.T) {
+	withUnreachableDatabase(t)
+
+	response := invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil)
+	expectStatus(t, response, 500)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+)
+
+// apiHandler is the signature shared by all API Gateway Lambda handlers
+type apiHandler func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// apiRoute maps an HTTP method and API Gateway resource to a handler
+type apiRoute struct {
+	method   string
+	resource string
+	handler  apiHandler
+}
+
+// apiRoutes mirrors the API Gateway routes defined in infra/API_Gateway.
+// It is served by the local server, and by RouterHandler for routes without a function of their own.
+func apiRoutes(service *Service) []apiRoute {
+	return []apiRoute{
+		{http.MethodGet, "/devices", service.ListDevicesHandler},
+		{http.MethodPost, "/devices/register", service.RegisterDeviceHandler},
+		{http.MethodPost, "/messages/send", service.SendMessageHandler},
+		{http.MethodPost, "/messages/{id}/receipt", service.MessageReceiptHandler},
+		{http.MethodGet, "/templates", service.ListTemplatesHandler},
+		{http.MethodGet, "/templates/{key}/{locale}", service.GetTemplateHandler},
+		{http.MethodPut, "/templates/{key}/{locale}", service.PutTemplateHandler},
+		{http.MethodDelete, "/templates/{key}/{locale}", service.DeleteTemplateHandler},
+		{http.MethodGet, "/segments", service.ListSegmentsHandler},
+		{http.MethodGet, "/segments/{segment_id}", service.GetSegmentHandler},
+		{http.MethodPut, "/segments/{segment_id}", service.PutSegmentHandler},
+		{http.MethodDelete, "/segments/{segment_id}", service.DeleteSegmentHandler},
+		{http.MethodGet, "/segments/{segment_id}/preview", service.PreviewSegmentHandler},
+		{http.MethodPost, "/segments/{segment_id}/send", service.SendSegmentHandler},
+		{http.MethodGet, "/broadcasts", service.ListBroadcastsHandler},
+		{http.MethodPost, "/broadcasts", service.CreateBroadcastHandler},
+		{http.MethodGet, "/broadcasts/{broadcast_id}", service.GetBroadcastHandler},
+		{http.MethodGet, "/campaigns", service.ListCampaignsHandler},
+		{http.MethodGet, "/campaigns/{campaign_id}", service.GetCampaignHandler},
+		{http.MethodPut, "/campaigns/{campaign_id}", service.PutCampaignHandler},
+		{http.MethodDelete, "/campaigns/{campaign_id}", service.DeleteCampaignHandler},
+		{http.MethodGet, "/campaigns/{campaign_id}/stats", service.CampaignStatsHandler},
+		{http.MethodGet, "/webhooks", service.ListWebhooksHandler},
+		{http.MethodPost, "/webhooks", service.CreateWebhookHandler},
+		{http.MethodGet, "/webhooks/{subscription_id}", service.GetWebhookHandler},
+		{http.MethodDelete, "/webhooks/{subscription_id}", service.DeleteWebhookHandler},
+		{http.MethodGet, "/webhooks/{subscription_id}/dead-letters", service.ListWebhookDeadLettersHandler},
+		{http.MethodGet, "/users/{user_id}/preferences", service.GetPreferencesHandler},
+		{http.MethodPut, "/users/{user_id}/preferences", service.PutPreferencesHandler},
+		{http.MethodPost, "/test/ack", service.TestAckHandler},
+		{http.MethodGet, "/test/status", service.TestStatusHandler},
+		{http.MethodGet, "/test/runs", service.ListTestRunsHandler},
+		{http.MethodGet, "/test/runs/stats", service.TestRunStatsHandler},
+	}
+}
+
+// RouterHandler is the Lambda handler of the api function. It dispatches on the API Gateway
+// resource (e.g. "/test/runs") and HTTP method, so new routes do not each need their own function.
+func (s *Service) RouterHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	for _, route := range apiRoutes(s) {
+		if route.resource == request.Resource && route.method == request.HTTPMethod {
+			return route.handler(ctx, request)
+		}
+	}
+
+	logger := common.NewLogger()
+	err := fmt.Errorf("no route for %s %s", request.HTTPMethod, request.Resource)
+	return logger.NotFound(ctx, err, "Route not found")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Paging and time windows of GET /test/runs and GET /test/runs/stats
+const (
+	defaultTestRunsLimit  = 50
+	maxTestRunsLimit      = 200
+	defaultTestRunsWindow = 7 * 24 * time.Hour // since defaults to now minus this
+)
+
+// TestRunSummary is a test run in the GET /test/runs response
+type TestRunSummary struct {
+	Nonce         string     `json:"nonce"`
+	UserID        string     `json:"user_id"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	AckedAt       *time.Time `json:"acked_at,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+	Platform      string     `json:"platform,omitempty"` // Platform of the first device to ack
+
+	TestRunLatency
+}
+
+type ListTestRunsResponse struct {
+	Runs       []TestRunSummary `json:"runs"`
+	NextCursor string           `json:"next_cursor,omitempty"` // Omitted on the last page
+}
+
+// TestRunStatsResponse is the GET /test/runs/stats response
+type TestRunStatsResponse struct {
+	UserID     string    `json:"user_id,omitempty"` // Omitted for stats across all users
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+	Total      int64     `json:"total"`
+	Acked      int64     `json:"acked"`
+	Pending    int64     `json:"pending"`
+	Expired    int64     `json:"expired"`
+	SendFailed int64     `json:"send_failed"`
+	// ACKED / (ACKED + EXPIRED + SEND_FAILED); runs still PENDING are not counted. Omitted without finished runs
+	AckRate *float64 `json:"ack_rate,omitempty"`
+	// Send-to-ack latency percentiles of ACKED runs, omitted without ACKED runs
+	P50AckLatencyMs *float64 `json:"p50_ack_latency_ms,omitempty"`
+	P95AckLatencyMs *float64 `json:"p95_ack_latency_ms,omitempty"`
+}
+
+// testRunsCursor is the position after the last run of a page, encoded as base64 JSON
+type testRunsCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	Nonce     string    `json:"nonce"`
+}
+
+// ListTestRunsHandler is the Lambda handler for listing test runs, newest first:
+// GET /test/runs?user_id=&status=&since=&limit=&cursor=
+func (s *Service) ListTestRunsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list test runs request")
+
+	query := request.QueryStringParameters
+
+	// Validate filters
+	status := query["status"]
+	switch status {
+	case "", testRunStatusPending, testRunStatusAcked, testRunStatusExpired, testRunStatusSendFailed:
+	default:
+		err := fmt.Errorf("invalid status: %s", status)
+		return logger.BadRequest(ctx, err, "status must be PENDING, ACKED, EXPIRED or SEND_FAILED")
+	}
+	since, err := parseTimeParam(query["since"], s.Clock.Now().Add(-defaultTestRunsWindow))
+	if err != nil {
+		return logger.BadRequest(ctx, fmt.Errorf("invalid since: %w", err), "since must be an RFC 3339 time")
+	}
+	limit := defaultTestRunsLimit
+	if value := query["limit"]; value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxTestRunsLimit {
+			err := fmt.Errorf("invalid limit: %s", value)
+			return logger.BadRequest(ctx, err, fmt.Sprintf("limit must be 1-%d", maxTestRunsLimit))
+		}
+	}
+
+	params := sqlc.ListTestRunsParams{
+		UserID:     optionalText(query["user_id"]),
+		Status:     optionalText(status),
+		Since:      pgtype.Timestamptz{Time: since, Valid: true},
+		LimitCount: int32(limit + 1), // One more to know whether there is a next page
+	}
+	if value := query["cursor"]; value != "" {
+		cursor, err := decodeTestRunsCursor(value)
+		if err != nil {
+			return logger.BadRequest(ctx, err, "Invalid cursor")
+		}
+		params.CursorCreatedAt = pgtype.Timestamptz{Time: cursor.CreatedAt, Valid: true}
+		params.CursorNonce = pgtype.Text{String: cursor.Nonce, Valid: true}
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	testRuns, err := queries.ListTestRuns(ctx, params)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	// Build response
+	response := ListTestRunsResponse{Runs: make([]TestRunSummary, 0, limit)}
+	if len(testRuns) > limit {
+		testRuns = testRuns[:limit]
+		last := testRuns[limit-1]
+		response.NextCursor, err = encodeTestRunsCursor(testRunsCursor{CreatedAt: last.CreatedAt.Time, Nonce: last.Nonce})
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Failed to create cursor")
+		}
+	}
+	for _, testRun := range testRuns {
+		response.Runs = append(response.Runs, newTestRunSummary(testRun))
+	}
+
+	logger.Info(ctx, "Listed test runs: user_id=%s, status=%s, count=%d, more=%t",
+		query["user_id"], status, len(response.Runs), response.NextCursor != "")
+
+	return logger.Success(ctx, response)
+}
+
+// TestRunStatsHandler is the Lambda handler for aggregate test run statistics over a time window:
+// GET /test/runs/stats?user_id=&since=&until=
+func (s *Service) TestRunStatsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received test run stats request")
+
+	query := request.QueryStringParameters
+
+	// Validate the time window
+	now := s.Clock.Now()
+	until, err := parseTimeParam(query["until"], now)
+	if err != nil {
+		return logger.BadRequest(ctx, fmt.Errorf("invalid until: %w", err), "until must be an RFC 3339 time")
+	}
+	since, err := parseTimeParam(query["since"], until.Add(-defaultTestRunsWindow))
+	if err != nil {
+		return logger.BadRequest(ctx, fmt.Errorf("invalid since: %w", err), "since must be an RFC 3339 time")
+	}
+	if !since.Before(until) {
+		err := fmt.Errorf("since %s is not before until %s", since.Format(time.RFC3339), until.Format(time.RFC3339))
+		return logger.BadRequest(ctx, err, "since must be before until")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	stats, err := queries.GetTestRunStats(ctx, sqlc.GetTestRunStatsParams{
+		UserID: optionalText(query["user_id"]),
+		Since:  pgtype.Timestamptz{Time: since, Valid: true},
+		Until:  pgtype.Timestamptz{Time: until, Valid: true},
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	// Build response
+	response := TestRunStatsResponse{
+		UserID:     query["user_id"],
+		Since:      since,
+		Until:      until,
+		Total:      stats.Total,
+		Acked:      stats.Acked,
+		Pending:    stats.Pending,
+		Expired:    stats.Expired,
+		SendFailed: stats.SendFailed,
+	}
+	if finished := stats.Acked + stats.Expired + stats.SendFailed; finished > 0 {
+		ackRate := float64(stats.Acked) / float64(finished)
+		response.AckRate = &ackRate
+	}
+	if stats.Acked > 0 {
+		p50, p95 := stats.P50AckLatencyMs, stats.P95AckLatencyMs
+		response.P50AckLatencyMs = &p50
+		response.P95AckLatencyMs = &p95
+	}
+
+	logger.Info(ctx, "Test run stats queried: user_id=%s, total=%d, acked=%d", query["user_id"], stats.Total, stats.Acked)
+
+	return logger.Success(ctx, response)
+}
+
+// newTestRunSummary converts a test run for the list response
+func newTestRunSummary(testRun sqlc.TestRun) TestRunSummary {
+	summary := TestRunSummary{
+		Nonce:          testRun.Nonce,
+		UserID:         testRun.UserID,
+		Status:         testRun.Status,
+		CreatedAt:      testRun.CreatedAt.Time,
+		ExpiresAt:      testRun.ExpiresAt.Time,
+		FailureReason:  testRun.FailureReason.String,
+		Platform:       testRun.AckPlatform.String,
+		TestRunLatency: testRunLatency(testRun),
+	}
+	if testRun.Status == testRunStatusAcked && testRun.AckedAt.Valid {
+		ackedAt := testRun.AckedAt.Time
+		summary.AckedAt = &ackedAt
+	}
+	return summary
+}
+
+// parseTimeParam parses an RFC 3339 query parameter, returning fallback if it is empty
+func parseTimeParam(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func encodeTestRunsCursor(cursor testRunsCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeTestRunsCursor(value string) (testRunsCursor, error) {
+	var cursor testRunsCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Nonce == "" || cursor.CreatedAt.IsZero() {
+		return cursor, fmt.Errorf("invalid cursor: %s", value)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// seedTestRun stores a test run created age ago; ACKED runs are acked ackMs after creation.
+func seedTestRun(fakes *testServiceFakes, nonce, userID, status string, age time.Duration, ackMs int64) {
+	createdAt := fakes.clock.Now().Add(-age)
+	testRun := sqlc.TestRun{
+		Nonce:     nonce,
+		UserID:    userID,
+		Status:    status,
+		CreatedAt: pgtype.Timestamptz{Time: createdAt, Valid: true},
+		ExpiresAt: pgtype.Timestamptz{Time: createdAt.Add(defaultAckTimeout), Valid: true},
+	}
+	if status == testRunStatusAcked {
+		testRun.AckedAt = pgtype.Timestamptz{Time: createdAt.Add(time.Duration(ackMs) * time.Millisecond), Valid: true}
+		testRun.AckPlatform = pgtype.Text{String: "android", Valid: true}
+	}
+	fakes.querier.testRuns[nonce] = testRun
+}
+
+func listTestRuns(t *testing.T, service *Service, query map[string]string) ListTestRunsResponse {
+	t.Helper()
+	response := invoke(t, service.ListTestRunsHandler, "", query)
+	expectStatus(t, response, 200)
+	var list ListTestRunsResponse
+	decodeBody(t, response, &list)
+	return list
+}
+
+func testRunNonces(runs []TestRunSummary) []string {
+	nonces := make([]string, 0, len(runs))
+	for _, run := range runs {
+		nonces = append(nonces, run.Nonce)
+	}
+	return nonces
+}
+
+func TestListTestRunsPaginates(t *testing.T) {
+	service, fakes := newFakeService(t)
+	seedTestRun(fakes, "run-1", "user-1", testRunStatusAcked, 5*time.Hour, 800)
+	seedTestRun(fakes, "run-2", "user-1", testRunStatusExpired, 4*time.Hour, 0)
+	seedTestRun(fakes, "run-3", "user-1", testRunStatusSendFailed, 3*time.Hour, 0)
+	seedTestRun(fakes, "run-4", "user-2", testRunStatusPending, 2*time.Hour, 0)
+	seedTestRun(fakes, "run-5", "user-1", testRunStatusAcked, time.Hour, 200)
+
+	var nonces []string
+	cursor := ""
+	for page := 0; ; page++ {
+		query := map[string]string{"limit": "2"}
+		if cursor != "" {
+			query["cursor"] = cursor
+		}
+		list := listTestRuns(t, service, query)
+		if len(list.Runs) > 2 || page > 2 {
+			t.Fatalf("unexpected page %d: %+v", page, list)
+		}
+		nonces = append(nonces, testRunNonces(list.Runs)...)
+		if list.NextCursor == "" {
+			break
+		}
+		cursor = list.NextCursor
+	}
+	if got := len(nonces); got != 5 || nonces[0] != "run-5" || nonces[4] != "run-1" {
+		t.Fatalf("expected runs newest first, got %v", nonces)
+	}
+
+	// The first page carries the ack details
+	first := listTestRuns(t, service, map[string]string{"limit": "1"}).Runs[0]
+	if first.Status != testRunStatusAcked || first.AckedAt == nil || first.Platform != "android" ||
+		first.SendToAckMs == nil || *first.SendToAckMs != 200 {
+		t.Fatalf("unexpected run summary: %+v", first)
+	}
+}
+
+func TestListTestRunsFilters(t *testing.T) {
+	service, fakes := newFakeService(t)
+	seedTestRun(fakes, "run-old", "user-1", testRunStatusAcked, 8*24*time.Hour, 100)
+	seedTestRun(fakes, "run-1", "user-1", testRunStatusAcked, time.Hour, 100)
+	seedTestRun(fakes, "run-2", "user-1", testRunStatusExpired, time.Hour, 0)
+	seedTestRun(fakes, "run-3", "user-2", testRunStatusAcked, time.Hour, 100)
+
+	tests := []struct {
+		query map[string]string
+		want  int
+	}{
+		{map[string]string{}, 3}, // run-old is outside the default window
+		{map[string]string{"user_id": "user-1"}, 2},
+		{map[string]string{"status": testRunStatusAcked}, 2},
+		{map[string]string{"user_id": "user-1", "status": testRunStatusExpired}, 1},
+		{map[string]string{"since": fakes.clock.Now().Add(-10 * 24 * time.Hour).Format(time.RFC3339)}, 4},
+	}
+	for _, test := range tests {
+		if got := listTestRuns(t, service, test.query).Runs; len(got) != test.want {
+			t.Errorf("query %v: expected %d runs, got %v", test.query, test.want, testRunNonces(got))
+		}
+	}
+}
+
+func TestListTestRunsInvalidParameters(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	for _, query := range []map[string]string{
+		{"status": "DONE"},
+		{"since": "yesterday"},
+		{"limit": "0"},
+		{"limit": "201"},
+		{"limit": "ten"},
+		{"cursor": "not-a-cursor"},
+	} {
+		expectStatus(t, invoke(t, service.ListTestRunsHandler, "", query), 400)
+	}
+}
+
+func TestTestRunStats(t *testing.T) {
+	service, fakes := newFakeService(t)
+	seedTestRun(fakes, "run-1", "user-1", testRunStatusAcked, time.Hour, 100)
+	seedTestRun(fakes, "run-2", "user-1", testRunStatusAcked, time.Hour, 200)
+	seedTestRun(fakes, "run-3", "user-1", testRunStatusAcked, time.Hour, 300)
+	seedTestRun(fakes, "run-4", "user-1", testRunStatusExpired, time.Hour, 0)
+	seedTestRun(fakes, "run-5", "user-1", testRunStatusPending, time.Minute, 0)
+	seedTestRun(fakes, "run-6", "user-2", testRunStatusSendFailed, time.Hour, 0)
+
+	response := invoke(t, service.TestRunStatsHandler, "", map[string]string{"user_id": "user-1"})
+	expectStatus(t, response, 200)
+	var stats TestRunStatsResponse
+	decodeBody(t, response, &stats)
+
+	if stats.Total != 5 || stats.Acked != 3 || stats.Expired != 1 || stats.Pending != 1 || stats.SendFailed != 0 {
+		t.Fatalf("unexpected counts: %+v", stats)
+	}
+	if stats.AckRate == nil || *stats.AckRate != 0.75 {
+		t.Fatalf("expected ack rate 0.75, got %v", stats.AckRate)
+	}
+	if stats.P50AckLatencyMs == nil || *stats.P50AckLatencyMs != 200 ||
+		stats.P95AckLatencyMs == nil || *stats.P95AckLatencyMs != 290 {
+		t.Fatalf("unexpected latency percentiles: p50=%v p95=%v", stats.P50AckLatencyMs, stats.P95AckLatencyMs)
+	}
+	if !stats.Until.Equal(fakes.clock.Now()) || !stats.Since.Equal(fakes.clock.Now().Add(-defaultTestRunsWindow)) {
+		t.Fatalf("unexpected window: %s - %s", stats.Since, stats.Until)
+	}
+
+	// Without finished runs there is no rate and no latency
+	response = invoke(t, service.TestRunStatsHandler, "", map[string]string{"user_id": "user-3"})
+	expectStatus(t, response, 200)
+	stats = TestRunStatsResponse{}
+	decodeBody(t, response, &stats)
+	if stats.Total != 0 || stats.AckRate != nil || stats.P50AckLatencyMs != nil || stats.P95AckLatencyMs != nil {
+		t.Fatalf("expected empty stats, got %+v", stats)
+	}
+}
+
+func TestTestRunStatsInvalidWindow(t *testing.T) {
+	service, fakes := newFakeService(t)
+	now := fakes.clock.Now()
+
+	for _, query := range []map[string]string{
+		{"since": "last week"},
+		{"until": "now"},
+		{"since": now.Format(time.RFC3339), "until": now.Add(-time.Hour).Format(time.RFC3339)},
+	} {
+		expectStatus(t, invoke(t, service.TestRunStatsHandler, "", query), 400)
+	}
+}
+
+func TestRouterHandler(t *testing.T) {
+	service, fakes := newFakeService(t)
+	seedTestRun(fakes, "run-1", "user-1", testRunStatusAcked, time.Hour, 100)
+
+	route := func(method, resource string) events.APIGatewayProxyResponse {
+		t.Helper()
+		response, err := service.RouterHandler(t.Context(), events.APIGatewayProxyRequest{
+			HTTPMethod:            method,
+			Resource:              resource,
+			QueryStringParameters: map[string]string{"nonce": "run-1"},
+		})
+		if err != nil {
+			t.Fatalf("RouterHandler returned error: %v", err)
+		}
+		return response
+	}
+
+	var list ListTestRunsResponse
+	response := route(http.MethodGet, "/test/runs")
+	expectStatus(t, response, 200)
+	decodeBody(t, response, &list)
+	if len(list.Runs) != 1 {
+		t.Fatalf("expected one run, got %+v", list)
+	}
+
+	expectStatus(t, route(http.MethodGet, "/test/runs/stats"), 200)
+	expectStatus(t, route(http.MethodGet, "/test/status"), 200)
+	expectStatus(t, route(http.MethodGet, "/devices"), 200)
+	expectStatus(t, route(http.MethodPost, "/messages/{id}/receipt"), 400) // Routed, but no id
+	expectStatus(t, route(http.MethodGet, "/templates"), 200)
+	expectStatus(t, route(http.MethodDelete, "/templates/{key}/{locale}"), 400) // Routed, but no key
+	expectStatus(t, route(http.MethodGet, "/users/{user_id}/preferences"), 400) // Routed, but no user_id
+	expectStatus(t, route(http.MethodGet, "/segments"), 200)
+	expectStatus(t, route(http.MethodPut, "/segments/{segment_id}"), 400)         // Routed, but no segment_id
+	expectStatus(t, route(http.MethodGet, "/segments/{segment_id}/preview"), 400) // Routed, but no segment_id
+	expectStatus(t, route(http.MethodPost, "/segments/{segment_id}/send"), 400)   // Routed, but no segment_id
+	expectStatus(t, route(http.MethodGet, "/broadcasts"), 200)
+	expectStatus(t, route(http.MethodGet, "/broadcasts/{broadcast_id}"), 400) // Routed, but no broadcast_id
+	expectStatus(t, route(http.MethodGet, "/campaigns"), 200)
+	expectStatus(t, route(http.MethodPut, "/campaigns/{campaign_id}"), 400)       // Routed, but no campaign_id
+	expectStatus(t, route(http.MethodGet, "/campaigns/{campaign_id}/stats"), 400) // Routed, but no campaign_id
+	expectStatus(t, route(http.MethodGet, "/webhooks"), 200)
+	expectStatus(t, route(http.MethodDelete, "/webhooks/{subscription_id}"), 400)           // Routed, but no subscription_id
+	expectStatus(t, route(http.MethodGet, "/webhooks/{subscription_id}/dead-letters"), 400) // Routed, but no subscription_id
+	expectStatus(t, route(http.MethodPost, "/test/runs"), 404)
+	expectStatus(t, route(http.MethodGet, "/unknown"), 404)
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment filters select devices by their attributes, e.g.
+//
+//	platform = "android" AND app_version >= "2.3" AND last_seen > now-30d
+//
+// Comparisons are combined with AND, OR, NOT and parentheses, and "field IN (v1, v2)" matches any
+// of the values. parseSegmentFilter turns the expression into a segmentExpr tree, which
+// compileSegmentFilter compiles into a SQL condition on devices. Field names map to fixed columns
+// and every value becomes a query parameter, so expressions cannot inject SQL.
+
+// Limits of segment filter expressions
+const (
+	maxSegmentFilterLength      = 2000
+	maxSegmentFilterComparisons = 50
+)
+
+// segmentFieldKind decides the operators and values a field accepts
+type segmentFieldKind int
+
+const (
+	segmentTextField    segmentFieldKind = iota // = and != against strings
+	segmentVersionField                         // Dotted versions compared numerically: "2.10" > "2.9"
+	segmentTimeField                            // Compared against now±duration ("now-30d") or an RFC 3339 time
+)
+
+type segmentField struct {
+	column string
+	kind   segmentFieldKind
+}
+
+// segmentFields are the device attributes a filter can use
+var segmentFields = map[string]segmentField{
+	"user_id":      {"user_id", segmentTextField},
+	"platform":     {"platform", segmentTextField},
+	"app_id":       {"app_id", segmentTextField},
+	"locale":       {"locale", segmentTextField},
+	"os_version":   {"os_version", segmentTextField},
+	"device_model": {"device_model", segmentTextField},
+	"timezone":     {"timezone", segmentTextField},
+	"app_version":  {"app_version", segmentVersionField},
+	"sdk_version":  {"sdk_version", segmentVersionField},
+	"last_seen":    {"updated_at", segmentTimeField}, // Devices are updated whenever the app registers
+}
+
+var (
+	// segmentVersionPattern is a version value: up to four numeric components
+	segmentVersionPattern = regexp.MustCompile(`^\d+(\.\d+){0,3}$`)
+	// segmentDurationPattern is the offset of a relative time, e.g. "30d"
+	segmentDurationPattern = regexp.MustCompile(`^(\d+)([smhdw])$`)
+)
+
+var segmentDurationUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// segmentExpr is a node of a parsed segment filter
+type segmentExpr interface {
+	// compile writes the SQL condition of the node, adding its values as parameters
+	compile(c *segmentCompiler)
+}
+
+type segmentAnd struct{ operands []segmentExpr }
+
+type segmentOr struct{ operands []segmentExpr }
+
+type segmentNot struct{ operand segmentExpr }
+
+// segmentComparison compares a field with one value, or with any of the values of IN
+type segmentComparison struct {
+	field  string // Key of segmentFields
+	op     string // =, !=, <, <=, >, >= or IN
+	values []segmentValue
+}
+
+// segmentValue is a string, version or time. Relative times are resolved when the filter is compiled.
+type segmentValue struct {
+	text     string
+	relative bool          // now + offset
+	offset   time.Duration // Of relative times
+	time     time.Time     // Absolute times
+}
+
+// at returns the time of a time value, relative to now
+func (v segmentValue) at(now time.Time) time.Time {
+	if v.relative {
+		return now.Add(v.offset)
+	}
+	return v.time
+}
+
+// segmentFilter is a segment expression compiled into a SQL condition on devices at a point in
+// time (the now of relative times)
+type segmentFilter struct {
+	condition string // Uses the parameters $1 to $len(args)
+	args      []any
+}
+
+// compileSegmentFilter compiles a parsed expression with relative times resolved against now
+func compileSegmentFilter(expr segmentExpr, now time.Time) segmentFilter {
+	c := &segmentCompiler{now: now}
+	expr.compile(c)
+	return segmentFilter{condition: c.sql.String(), args: c.args}
+}
+
+// Segments target active android and ios devices, like POST /messages/send
+const segmentDevicesCondition = "is_active AND platform IN ('android', 'ios')"
+
+// devicesQuery returns the query for the devices matching the filter of the first userLimit users
+// after afterUserID, with the columns of sqlc.ListActiveDevicesByPlatformsRow, ordered by user_id
+// and device_id
+func (f segmentFilter) devicesQuery(afterUserID string, userLimit int) (string, []any) {
+	args := append(append([]any(nil), f.args...), afterUserID, userLimit)
+	query := fmt.Sprintf(`SELECT user_id, device_id, platform, app_id, fcm_token, token_type, locale, is_active, updated_at
+FROM devices
+WHERE %[1]s AND %[2]s
+  AND user_id IN (
+    SELECT DISTINCT user_id
+    FROM devices
+    WHERE %[1]s AND %[2]s AND user_id > $%[3]d
+    ORDER BY user_id
+    LIMIT $%[4]d)
+ORDER BY user_id, device_id`, segmentDevicesCondition, f.condition, len(args)-1, len(args))
+	return query, args
+}
+
+// sizeQuery returns the query counting the devices matching the filter, their users and
+// the devices of each platform
+func (f segmentFilter) sizeQuery() (string, []any) {
+	query := fmt.Sprintf(`SELECT
+    COUNT(*) AS devices,
+    COUNT(DISTINCT user_id) AS users,
+    COUNT(*) FILTER (WHERE platform = 'android') AS android,
+    COUNT(*) FILTER (WHERE platform = 'ios') AS ios
+FROM devices
+WHERE %s AND %s`, segmentDevicesCondition, f.condition)
+	return query, f.args
+}
+
+type segmentCompiler struct {
+	now  time.Time
+	sql  strings.Builder
+	args []any
+}
+
+// param adds a query parameter and returns its placeholder
+func (c *segmentCompiler) param(value any) string {
+	c.args = append(c.args, value)
+	return "$" + strconv.Itoa(len(c.args))
+}
+
+func (e segmentAnd) compile(c *segmentCompiler) { compileSegmentOperands(c, e.operands, " AND ") }
+
+func (e segmentOr) compile(c *segmentCompiler) { compileSegmentOperands(c, e.operands, " OR ") }
+
+func compileSegmentOperands(c *segmentCompiler, operands []segmentExpr, operator string) {
+	c.sql.WriteString("(")
+	for i, operand := range operands {
+		if i > 0 {
+			c.sql.WriteString(operator)
+		}
+		operand.compile(c)
+	}
+	c.sql.WriteString(")")
+}
+
+func (e segmentNot) compile(c *segmentCompiler) {
+	c.sql.WriteString("(NOT ")
+	e.operand.compile(c)
+	c.sql.WriteString(")")
+}
+
+// compile wraps every comparison in COALESCE(..., FALSE): devices without the attribute (NULL)
+// never match a comparison, and NOT of such a comparison matches them
+func (e segmentComparison) compile(c *segmentCompiler) {
+	field := segmentFields[e.field]
+	column := field.column
+	value := func(v segmentValue) string { return c.param(v.text) }
+	switch field.kind {
+	case segmentVersionField:
+		column = "segment_version_key(" + column + ")"
+		value = func(v segmentValue) string { return "segment_version_key(" + c.param(v.text) + "::text)" }
+	case segmentTimeField:
+		value = func(v segmentValue) string { return c.param(v.at(c.now)) }
+	}
+
+	c.sql.WriteString("COALESCE(" + column)
+	if e.op == "IN" {
+		c.sql.WriteString(" IN (")
+		for i, v := range e.values {
+			if i > 0 {
+				c.sql.WriteString(", ")
+			}
+			c.sql.WriteString(value(v))
+		}
+		c.sql.WriteString(")")
+	} else {
+		c.sql.WriteString(" " + e.op + " " + value(e.values[0]))
+	}
+	c.sql.WriteString(", FALSE)")
+}
+
+// Tokens of segment filter expressions
+type segmentTokenKind int
+
+const (
+	segmentEOF     segmentTokenKind = iota
+	segmentIdent                    // Field names, keywords and now
+	segmentString                   // "quoted", with Go escapes
+	segmentLiteral                  // Unquoted numbers, versions and durations: 34, 2.3, 30d
+	segmentSymbol                   // Operators, parentheses, comma, + and -
+)
+
+type segmentToken struct {
+	kind segmentTokenKind
+	text string // Unquoted for strings
+	pos  int    // Byte offset in the expression
+}
+
+// segmentSymbols are the symbol tokens, longest first
+var segmentSymbols = []string{"!=", "<=", ">=", "=", "<", ">", "(", ")", ",", "+", "-"}
+
+func tokenizeSegmentFilter(expression string) ([]segmentToken, error) {
+	var tokens []segmentToken
+	for pos := 0; pos < len(expression); {
+		r := rune(expression[pos])
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			pos++
+		case r == '"':
+			end := pos + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at position %d", pos)
+			}
+			text, err := strconv.Unquote(expression[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %v", pos, err)
+			}
+			tokens = append(tokens, segmentToken{segmentString, text, pos})
+			pos = end + 1
+		case r != '.' && isSegmentWordByte(expression[pos]):
+			end := pos
+			for end < len(expression) && isSegmentWordByte(expression[end]) {
+				end++
+			}
+			kind := segmentIdent
+			if '0' <= r && r <= '9' {
+				kind = segmentLiteral
+			}
+			tokens = append(tokens, segmentToken{kind, expression[pos:end], pos})
+			pos = end
+		default:
+			symbol := ""
+			for _, s := range segmentSymbols {
+				if strings.HasPrefix(expression[pos:], s) {
+					symbol = s
+					break
+				}
+			}
+			if symbol == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, pos)
+			}
+			tokens = append(tokens, segmentToken{segmentSymbol, symbol, pos})
+			pos += len(symbol)
+		}
+	}
+	return append(tokens, segmentToken{segmentEOF, "", len(expression)}), nil
+}
+
+func isSegmentWordByte(b byte) bool {
+	return b == '_' || b == '.' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+// parseSegmentFilter parses a filter expression:
+//
+//	expr       = and { "OR" and }
+//	and        = unary { "AND" unary }
+//	unary      = "NOT" unary | "(" expr ")" | comparison
+//	comparison = field op value | field "IN" "(" value { "," value } ")"
+//	op         = "=" | "!=" | "<" | "<=" | ">" | ">="
+//	value      = string | literal | "now" [ ("+" | "-") duration ]
+//
+// Keywords are case-insensitive.
+func parseSegmentFilter(expression string) (segmentExpr, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+	if len(expression) > maxSegmentFilterLength {
+		return nil, fmt.Errorf("expression longer than %d characters", maxSegmentFilterLength)
+	}
+	tokens, err := tokenizeSegmentFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &segmentParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != segmentEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", token.text, token.pos)
+	}
+	return expr, nil
+}
+
+type segmentParser struct {
+	tokens      []segmentToken
+	next        int
+	comparisons int
+}
+
+func (p *segmentParser) peek() segmentToken { return p.tokens[p.next] }
+
+func (p *segmentParser) advance() segmentToken {
+	token := p.tokens[p.next]
+	if token.kind != segmentEOF {
+		p.next++
+	}
+	return token
+}
+
+// keyword consumes the next token if it is the keyword
+func (p *segmentParser) keyword(keyword string) bool {
+	if token := p.peek(); token.kind == segmentIdent && strings.EqualFold(token.text, keyword) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+// symbol consumes the next token if it is the symbol
+func (p *segmentParser) symbol(symbol string) bool {
+	if token := p.peek(); token.kind == segmentSymbol && token.text == symbol {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *segmentParser) expect(symbol string) error {
+	if !p.symbol(symbol) {
+		token := p.peek()
+		return fmt.Errorf("expected %q at position %d, got %s", symbol, token.pos, describeSegmentToken(token))
+	}
+	return nil
+}
+
+func describeSegmentToken(token segmentToken) string {
+	if token.kind == segmentEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(token.text)
+}
+
+func (p *segmentParser) parseOr() (segmentExpr, error) {
+	operands, err := p.parseOperands("OR", p.parseAnd)
+	if err != nil || len(operands) == 1 {
+		return firstSegmentOperand(operands), err
+	}
+	return segmentOr{operands}, nil
+}
+
+func (p *segmentParser) parseAnd() (segmentExpr, error) {
+	operands, err := p.parseOperands("AND", p.parseUnary)
+	if err != nil || len(operands) == 1 {
+		return firstSegmentOperand(operands), err
+	}
+	return segmentAnd{operands}, nil
+}
+
+// parseOperands parses operands separated by a keyword
+func (p *segmentParser) parseOperands(keyword string, parseOperand func() (segmentExpr, error)) ([]segmentExpr, error) {
+	var operands []segmentExpr
+	for {
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if !p.keyword(keyword) {
+			return operands, nil
+		}
+	}
+}
+
+func firstSegmentOperand(operands []segmentExpr) segmentExpr {
+	if len(operands) == 0 {
+		return nil
+	}
+	return operands[0]
+}
+
+func (p *segmentParser) parseUnary() (segmentExpr, error) {
+	if p.keyword("NOT") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return segmentNot{operand}, nil
+	}
+	if p.symbol("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *segmentParser) parseComparison() (segmentExpr, error) {
+	token := p.advance()
+	if token.kind != segmentIdent {
+		return nil, fmt.Errorf("expected a field at position %d, got %s", token.pos, describeSegmentToken(token))
+	}
+	name := strings.ToLower(token.text)
+	field, ok := segmentFields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d (must be one of %s)", token.text, token.pos, segmentFieldNames())
+	}
+	p.comparisons++
+	if p.comparisons > maxSegmentFilterComparisons {
+		return nil, fmt.Errorf("more than %d comparisons", maxSegmentFilterComparisons)
+	}
+
+	comparison := segmentComparison{field: name}
+	opToken := p.peek()
+	if p.keyword("IN") {
+		if field.kind == segmentTimeField {
+			return nil, fmt.Errorf("IN is not supported for %s at position %d", name, opToken.pos)
+		}
+		comparison.op = "IN"
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			value, err := p.parseValue(name, field)
+			if err != nil {
+				return nil, err
+			}
+			comparison.values = append(comparison.values, value)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return comparison, nil
+	}
+
+	switch opToken.text {
+	case "=", "!=":
+		if field.kind == segmentTimeField {
+			return nil, fmt.Errorf("operator %s is not supported for %s at position %d (use <, <=, > or >=)", opToken.text, name, opToken.pos)
+		}
+	case "<", "<=", ">", ">=":
+		if field.kind == segmentTextField {
+			return nil, fmt.Errorf("operator %s is not supported for %s at position %d (use =, != or IN)", opToken.text, name, opToken.pos)
+		}
+	default:
+		return nil, fmt.Errorf("expected an operator after %s at position %d, got %s", name, opToken.pos, describeSegmentToken(opToken))
+	}
+	p.advance()
+	comparison.op = opToken.text
+	value, err := p.parseValue(name, field)
+	if err != nil {
+		return nil, err
+	}
+	comparison.values = []segmentValue{value}
+	return comparison, nil
+}
+
+// parseValue parses a value of a field, validating it for the field's kind
+func (p *segmentParser) parseValue(name string, field segmentField) (segmentValue, error) {
+	token := p.advance()
+	if field.kind == segmentTimeField {
+		return p.parseTime(name, token)
+	}
+	if token.kind != segmentString && token.kind != segmentLiteral {
+		return segmentValue{}, fmt.Errorf("expected a value for %s at position %d, got %s", name, token.pos, describeSegmentToken(token))
+	}
+	switch {
+	case field.kind == segmentVersionField && !segmentVersionPattern.MatchString(token.text):
+		return segmentValue{}, fmt.Errorf("invalid version %q for %s at position %d (must be like 2.3 or 2.3.1)", token.text, name, token.pos)
+	case name == "locale":
+		// Devices store normalized locales, see RegisterDeviceHandler
+		locale, err := normalizeLocale(token.text)
+		if err != nil {
+			return segmentValue{}, fmt.Errorf("%v at position %d", err, token.pos)
+		}
+		return segmentValue{text: locale}, nil
+	}
+	return segmentValue{text: token.text}, nil
+}
+
+// parseTime parses now, now+duration, now-duration or a quoted RFC 3339 time
+func (p *segmentParser) parseTime(name string, token segmentToken) (segmentValue, error) {
+	if token.kind == segmentString {
+		t, err := time.Parse(time.RFC3339, token.text)
+		if err != nil {
+			return segmentValue{}, fmt.Errorf("invalid time %q for %s at position %d (must be RFC 3339 or now-30d)", token.text, name, token.pos)
+		}
+		return segmentValue{time: t}, nil
+	}
+	if token.kind != segmentIdent || !strings.EqualFold(token.text, "now") {
+		return segmentValue{}, fmt.Errorf("expected a time for %s at position %d, got %s (e.g. now-30d)", name, token.pos, describeSegmentToken(token))
+	}
+
+	value := segmentValue{relative: true}
+	sign := time.Duration(1)
+	switch {
+	case p.symbol("+"):
+	case p.symbol("-"):
+		sign = -1
+	default:
+		return value, nil
+	}
+	durationToken := p.advance()
+	match := segmentDurationPattern.FindStringSubmatch(durationToken.text)
+	if durationToken.kind != segmentLiteral || match == nil {
+		return segmentValue{}, fmt.Errorf("expected a duration like 30d at position %d, got %s", durationToken.pos, describeSegmentToken(durationToken))
+	}
+	amount, err := strconv.Atoi(match[1])
+	if err != nil || amount > 3650 {
+		return segmentValue{}, fmt.Errorf("duration %s at position %d is too long", durationToken.text, durationToken.pos)
+	}
+	value.offset = sign * time.Duration(amount) * segmentDurationUnits[match[2]]
+	return value, nil
+}
+
+// segmentFieldNames lists the field names for error messages
+func segmentFieldNames() string {
+	names := make([]string, 0, len(segmentFields))
+	for name := range segmentFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileSegmentFilter(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expression string
+		condition  string
+		args       []any
+	}{
+		{
+			`platform = "android"`,
+			`COALESCE(platform = $1, FALSE)`,
+			[]any{"android"},
+		},
+		{
+			`platform = "android" AND app_version >= "2.3" AND last_seen > now-30d`,
+			`(COALESCE(platform = $1, FALSE) AND COALESCE(segment_version_key(app_version) >= segment_version_key($2::text), FALSE) AND COALESCE(updated_at > $3, FALSE))`,
+			[]any{"android", "2.3", now.Add(-30 * 24 * time.Hour)},
+		},
+		{
+			// AND binds tighter than OR; keywords are case-insensitive and locales are normalized
+			`locale in ("pt_br", "pt-PT") or not timezone != "Europe/Lisbon" and sdk_version < 34`,
+			`(COALESCE(locale IN ($1, $2), FALSE) OR ((NOT COALESCE(timezone != $3, FALSE)) AND COALESCE(segment_version_key(sdk_version) < segment_version_key($4::text), FALSE)))`,
+			[]any{"pt-BR", "pt-PT", "Europe/Lisbon", "34"},
+		},
+		{
+			`(user_id = "a" OR user_id = "b") AND last_seen <= "2026-09-01T00:00:00Z"`,
+			`((COALESCE(user_id = $1, FALSE) OR COALESCE(user_id = $2, FALSE)) AND COALESCE(updated_at <= $3, FALSE))`,
+			[]any{"a", "b", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			`last_seen >= now + 2h`,
+			`COALESCE(updated_at >= $1, FALSE)`,
+			[]any{now.Add(2 * time.Hour)},
+		},
+	}
+	for _, test := range tests {
+		expr, err := parseSegmentFilter(test.expression)
+		if err != nil {
+			t.Errorf("parseSegmentFilter(%q): %v", test.expression, err)
+			continue
+		}
+		filter := compileSegmentFilter(expr, now)
+		if filter.condition != test.condition || !reflect.DeepEqual(filter.args, test.args) {
+			t.Errorf("compile(%q) = %s %v; want %s %v", test.expression, filter.condition, filter.args, test.condition, test.args)
+		}
+	}
+}
+
+func TestSegmentFilterQueries(t *testing.T) {
+	expr, err := parseSegmentFilter(`platform = "ios"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := compileSegmentFilter(expr, time.Now())
+
+	query, args := filter.devicesQuery("user-9", 101)
+	if !reflect.DeepEqual(args, []any{"ios", "user-9", 101}) {
+		t.Fatalf("unexpected devices query args: %v", args)
+	}
+	for _, part := range []string{"COALESCE(platform = $1, FALSE)", "user_id > $2", "LIMIT $3", "ORDER BY user_id, device_id"} {
+		if !strings.Contains(query, part) {
+			t.Errorf("devices query does not contain %q:\n%s", part, query)
+		}
+	}
+
+	query, args = filter.sizeQuery()
+	if !reflect.DeepEqual(args, []any{"ios"}) || !strings.Contains(query, segmentDevicesCondition+" AND COALESCE(platform = $1, FALSE)") {
+		t.Fatalf("unexpected size query: %s %v", query, args)
+	}
+}
+
+func TestParseSegmentFilterErrors(t *testing.T) {
+	for expression, want := range map[string]string{
+		``:                                  "empty expression",
+		`platform`:                          "expected an operator",
+		`platform = `:                       "expected a value",
+		`platform == "ios"`:                 "expected a value",
+		`platform > "ios"`:                  "operator > is not supported for platform",
+		`colour = "red"`:                    `unknown field "colour"`,
+		`app_version >= "latest"`:           `invalid version "latest"`,
+		`app_version >= 1.2.3.4.5`:          "invalid version",
+		`last_seen = now`:                   "operator = is not supported for last_seen",
+		`last_seen > 30d`:                   "expected a time",
+		`last_seen > now-30y`:               "expected a duration",
+		`last_seen > now-9999d`:             "too long",
+		`last_seen > "yesterday"`:           "invalid time",
+		`last_seen IN (now)`:                "IN is not supported",
+		`locale = "not a locale"`:           "invalid locale",
+		`platform = "ios" AND`:              "expected a field",
+		`(platform = "ios"`:                 `expected ")"`,
+		`platform IN ("ios"`:                `expected ")"`,
+		`platform = "ios" platform = "ios"`: `unexpected "platform"`,
+		`platform = "ios`:                   "unterminated string",
+		`platform = "ios" ; DROP TABLE x`:   "unexpected character ';'",
+		`platform = "é" OR ü = "x"`:         "unexpected character",
+		strings.Repeat(" ", 2001) + `x = 1`: "longer than 2000",
+		strings.Repeat(`platform = "ios" OR `, 50) + `platform = "ios"`: "more than 50 comparisons",
+	} {
+		_, err := parseSegmentFilter(expression)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseSegmentFilter(%q) = %v; want an error containing %q", expression, err, want)
+		}
+	}
+}
+
+// TestSegmentFilterMatches runs compiled filters through the fake store and, if a database is
+// available, through the SQL of devicesQuery and sizeQuery, so the fake cannot drift from Postgres.
+func TestSegmentFilterMatches(t *testing.T) {
+	t.Run("fake", func(t *testing.T) {
+		service, fakes := newFakeService(t)
+		checkSegmentFilterMatches(t, service, fakes.clock.Now())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		requireDB(t)
+		checkSegmentFilterMatches(t, testService, time.Now())
+	})
+}
+
+func checkSegmentFilterMatches(t *testing.T, service *Service, now time.Time) {
+	ctx := t.Context()
+	for _, body := range []string{
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","locale":"pt-BR","app_version":"2.10.0","sdk_version":"34","timezone":"Europe/Lisbon"}`,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios","locale":"en-US","app_version":"2.9"}`,
+		`{"user_id":"user-2","device_id":"device-3","fcm_token":"token-3","platform":"android","sdk_version":"preview"}`,
+		`{"user_id":"user-3","device_id":"device-4","fcm_token":"token-4","platform":"ios","app_version":"3.0","timezone":"America/New_York"}`,
+	} {
+		expectStatus(t, invoke(t, service.RegisterDeviceHandler, body, nil), 200)
+	}
+	platforms := map[string]string{"device-1": "android", "device-2": "ios", "device-3": "android", "device-4": "ios"}
+
+	tests := []struct {
+		expression string
+		devices    []string
+	}{
+		{`platform = "android"`, []string{"device-1", "device-3"}},
+		{`app_version >= "2.10"`, []string{"device-1", "device-4"}},
+		// Devices without the attribute match no comparison on it, but NOT of one
+		{`app_version < "2.10"`, []string{"device-2"}},
+		{`NOT app_version >= "2.10"`, []string{"device-2", "device-3"}},
+		{`timezone != "Europe/Lisbon"`, []string{"device-4"}},
+		{`NOT timezone = "Europe/Lisbon"`, []string{"device-2", "device-3", "device-4"}},
+		// "preview" has no numeric sort key, so it is NULL like a missing version
+		{`sdk_version < 40`, []string{"device-1"}},
+		{`NOT sdk_version < 40`, []string{"device-2", "device-3", "device-4"}},
+		{`locale IN ("pt_br", "en-US") AND NOT sdk_version >= 30`, []string{"device-2"}},
+		{`sdk_version = 34 OR (platform = "ios" AND NOT app_version > "2.9")`, []string{"device-1", "device-2"}},
+		{`last_seen > now-1d AND user_id != "user-1"`, []string{"device-3", "device-4"}},
+		{`last_seen < now-1d`, nil},
+	}
+	for _, tt := range tests {
+		expr, err := parseSegmentFilter(tt.expression)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expression, err)
+		}
+		filter := compileSegmentFilter(expr, now)
+
+		rows, err := service.Store.ListSegmentDevices(ctx, filter, "", 10)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expression, err)
+		}
+		var devices []string
+		for _, row := range rows {
+			devices = append(devices, row.DeviceID)
+		}
+		if !reflect.DeepEqual(devices, tt.devices) {
+			t.Errorf("%s: got devices %v, want %v", tt.expression, devices, tt.devices)
+		}
+
+		want := segmentSize{Devices: int64(len(tt.devices))}
+		users := make(map[string]bool)
+		for _, row := range rows {
+			users[row.UserID] = true
+		}
+		want.Users = int64(len(users))
+		for _, device := range tt.devices {
+			if platforms[device] == "android" {
+				want.Android++
+			} else {
+				want.IOS++
+			}
+		}
+		if size, err := service.Store.CountSegment(ctx, filter); err != nil || size != want {
+			t.Errorf("%s: got size %+v, %v, want %+v", tt.expression, size, err, want)
+		}
+	}
+
+	// Batches are whole users after the cursor, with every column of the row
+	expr, err := parseSegmentFilter(`platform IN ("android", "ios")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := service.Store.ListSegmentDevices(ctx, compileSegmentFilter(expr, now), "user-1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected the device of user-2, got %+v", rows)
+	}
+	if row := rows[0]; row.UserID != "user-2" || row.DeviceID != "device-3" || row.Platform != "android" || row.AppID != "default" ||
+		row.FcmToken != "token-3" || row.TokenType != tokenTypeFCM || row.Locale.Valid || !row.IsActive || !row.UpdatedAt.Valid {
+		t.Fatalf("unexpected row: %+v", row)
+	}
+}
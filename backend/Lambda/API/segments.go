@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+)
+
+// Segments are saved filter expressions over device attributes (see segmentfilter.go).
+// POST /segments/{segment_id}/send sends a message to the active devices of a segment one batch of
+// users at a time: each call sends to up to batch_size users and returns the cursor of the next batch.
+// Every user gets their own message, like POST /messages/send, and notification preferences apply.
+
+// Batches of POST /segments/{segment_id}/send, in users
+const (
+	defaultSegmentBatchSize = 100
+	maxSegmentBatchSize     = 500
+)
+
+var segmentIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+type PutSegmentRequest struct {
+	Description string `json:"description"`
+	Expression  string `json:"expression"` // e.g. platform = "android" AND app_version >= "2.3"
+}
+
+type SegmentResponse struct {
+	SegmentID   string    `json:"segment_id"`
+	Description string    `json:"description"`
+	Expression  string    `json:"expression"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type ListSegmentsResponse struct {
+	Segments []SegmentResponse `json:"segments"`
+}
+
+type DeleteSegmentResponse struct {
+	OK bool `json:"ok"`
+}
+
+// SegmentPreviewResponse is the current size of a segment. Notification preferences depend on
+// the category of a message, so devices that opted out are included.
+type SegmentPreviewResponse struct {
+	SegmentID   string           `json:"segment_id"`
+	DeviceCount int64            `json:"device_count"`
+	UserCount   int64            `json:"user_count"`
+	Platforms   map[string]int64 `json:"platforms"` // Device count by platform
+}
+
+// SegmentMessage is a message sent to every device of a segment. The fields mean the same as in
+// SendMessageRequest; e2e test messages can only be sent to a single user.
+type SegmentMessage struct {
+	Category    string          `json:"category"`
+	Title       string          `json:"title"`
+	Body        string          `json:"body"`
+	Data        json.RawMessage `json:"data"`
+	TemplateKey string          `json:"template_key"`
+	Variables   map[string]any  `json:"variables"`
+}
+
+type SendSegmentRequest struct {
+	SegmentMessage
+	BatchSize int    `json:"batch_size"` // Users per batch, default 100
+	Cursor    string `json:"cursor"`     // next_cursor of the previous batch; empty for the first batch
+}
+
+type SendSegmentResponse struct {
+	OK              bool   `json:"ok"`
+	SegmentID       string `json:"segment_id"`
+	UserCount       int    `json:"user_count"` // Users of the batch
+	SentCount       int    `json:"sent_count"`
+	FailedCount     int    `json:"failed_count"`          // Devices FCM did not accept, see message_deliveries
+	RetriedCount    int    `json:"retried_count"`         // Devices whose send failed transiently; the relay retries them
+	SuppressedCount int    `json:"suppressed_count"`      // Devices that opted out of the category
+	NextCursor      string `json:"next_cursor,omitempty"` // Omitted after the last batch
+}
+
+// segmentCursor is the position after the last user of a batch, encoded as base64 JSON
+type segmentCursor struct {
+	UserID string `json:"user_id"`
+}
+
+// segmentSize counts the active devices of a segment
+type segmentSize struct {
+	Devices int64
+	Users   int64
+	Android int64
+	IOS     int64
+}
+
+// ListSegmentsHandler is the Lambda handler for GET /segments
+func (s *Service) ListSegmentsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list segments request")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	segments, err := queries.ListSegments(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	response := ListSegmentsResponse{Segments: make([]SegmentResponse, 0, len(segments))}
+	for _, segment := range segments {
+		response.Segments = append(response.Segments, newSegmentResponse(segment))
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// GetSegmentHandler is the Lambda handler for GET /segments/{segment_id}
+func (s *Service) GetSegmentHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received get segment request")
+
+	segmentID, err := segmentPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid segment_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	segment, err := queries.GetSegment(ctx, segmentID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err := fmt.Errorf("segment not found: %s", segmentID)
+			return logger.NotFound(ctx, err, "Segment not found")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	return logger.Success(ctx, newSegmentResponse(segment))
+}
+
+// PutSegmentHandler is the Lambda handler for PUT /segments/{segment_id}.
+// It creates the segment or replaces its description and expression.
+func (s *Service) PutSegmentHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received put segment request")
+
+	segmentID, err := segmentPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid segment_id")
+	}
+
+	var putRequest PutSegmentRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &putRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+
+	// Reject invalid expressions now rather than on every send
+	if _, err := parseSegmentFilter(putRequest.Expression); err != nil {
+		return logger.BadRequest(ctx, fmt.Errorf("invalid expression: %w", err), "Invalid segment expression")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	segment, err := queries.UpsertSegment(ctx, sqlc.UpsertSegmentParams{
+		SegmentID:   segmentID,
+		Description: putRequest.Description,
+		Expression:  putRequest.Expression,
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+
+	logger.Info(ctx, "Segment saved: segment_id=%s, expression=%s", segmentID, putRequest.Expression)
+
+	return logger.Success(ctx, newSegmentResponse(segment))
+}
+
+// DeleteSegmentHandler is the Lambda handler for DELETE /segments/{segment_id}
+func (s *Service) DeleteSegmentHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received delete segment request")
+
+	segmentID, err := segmentPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid segment_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	deleted, err := queries.DeleteSegment(ctx, segmentID)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+	if deleted == 0 {
+		err := fmt.Errorf("segment not found: %s", segmentID)
+		return logger.NotFound(ctx, err, "Segment not found")
+	}
+
+	logger.Info(ctx, "Segment deleted: segment_id=%s", segmentID)
+
+	return logger.Success(ctx, DeleteSegmentResponse{OK: true})
+}
+
+// PreviewSegmentHandler is the Lambda handler for GET /segments/{segment_id}/preview,
+// counting the active devices and users the segment currently matches
+func (s *Service) PreviewSegmentHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received preview segment request")
+
+	segmentID, err := segmentPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid segment_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	filter, err := s.loadSegmentFilter(ctx, queries, segmentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err := fmt.Errorf("segment not found: %s", segmentID)
+		return logger.NotFound(ctx, err, "Segment not found")
+	}
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to load segment")
+	}
+
+	size, err := s.Store.CountSegment(ctx, filter)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	logger.Info(ctx, "Previewed segment: segment_id=%s, devices=%d, users=%d", segmentID, size.Devices, size.Users)
+
+	return logger.Success(ctx, SegmentPreviewResponse{
+		SegmentID:   segmentID,
+		DeviceCount: size.Devices,
+		UserCount:   size.Users,
+		Platforms:   map[string]int64{"android": size.Android, "ios": size.IOS},
+	})
+}
+
+// SendSegmentHandler is the Lambda handler for POST /segments/{segment_id}/send, sending a message
+// to the next batch of the segment's users
+func (s *Service) SendSegmentHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received send segment request")
+
+	segmentID, err := segmentPathParameter(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid segment_id")
+	}
+
+	var sendRequest SendSegmentRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &sendRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+	if err := sendRequest.SegmentMessage.validate(); err != nil {
+		return logger.BadRequest(ctx, err, "Invalid message")
+	}
+	batchSize := defaultSegmentBatchSize
+	if sendRequest.BatchSize != 0 {
+		batchSize = sendRequest.BatchSize
+		if batchSize < 1 || batchSize > maxSegmentBatchSize {
+			err := fmt.Errorf("invalid batch_size: %d", batchSize)
+			return logger.BadRequest(ctx, err, "batch_size must be 1-"+strconv.Itoa(maxSegmentBatchSize))
+		}
+	}
+	afterUserID := ""
+	if sendRequest.Cursor != "" {
+		cursor, err := decodeSegmentCursor(sendRequest.Cursor)
+		if err != nil {
+			return logger.BadRequest(ctx, err, "Invalid cursor")
+		}
+		afterUserID = cursor.UserID
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	filter, err := s.loadSegmentFilter(ctx, queries, segmentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err := fmt.Errorf("segment not found: %s", segmentID)
+		return logger.NotFound(ctx, err, "Segment not found")
+	}
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to load segment")
+	}
+
+	prepared, err := prepareSegmentMessage(ctx, queries, sendRequest.SegmentMessage)
+	if errors.Is(err, errInvalidSegmentMessage) {
+		return logger.BadRequest(ctx, err, "Invalid message")
+	}
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	batch, err := s.sendSegmentBatch(ctx, logger, filter, prepared, afterUserID, batchSize)
+	if errors.Is(err, errTemplateRender) {
+		return logger.BadRequest(ctx, err, "Template cannot be rendered: missing variables or locale")
+	}
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to send to segment")
+	}
+
+	response := SendSegmentResponse{
+		OK:              true,
+		SegmentID:       segmentID,
+		UserCount:       batch.Users,
+		SentCount:       batch.Sent,
+		FailedCount:     batch.Failed,
+		RetriedCount:    batch.Retried,
+		SuppressedCount: batch.Suppressed,
+	}
+	if batch.NextUserID != "" {
+		response.NextCursor, err = encodeSegmentCursor(segmentCursor{UserID: batch.NextUserID})
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Failed to create cursor")
+		}
+	}
+
+	logger.Info(ctx, "Sent to segment batch: segment_id=%s, users=%d, sent=%d, failed=%d, retried=%d, suppressed=%d, more=%t",
+		segmentID, batch.Users, batch.Sent, batch.Failed, batch.Retried, batch.Suppressed, response.NextCursor != "")
+
+	return logger.Success(ctx, response)
+}
+
+// errInvalidSegmentMessage is returned for messages with an unknown category or template
+var errInvalidSegmentMessage = errors.New("invalid message")
+
+// validate checks a message like SendMessageHandler does, without the user
+func (m SegmentMessage) validate() error {
+	if m.TemplateKey != "" && (m.Title != "" || m.Body != "") {
+		return fmt.Errorf("template_key cannot be combined with title or body")
+	}
+	if m.TemplateKey == "" && m.Variables != nil {
+		return fmt.Errorf("variables require template_key")
+	}
+	if m.Category == "" || (m.TemplateKey == "" && (m.Title == "" || m.Body == "")) {
+		return fmt.Errorf("missing required fields: category, title, body (or template_key)")
+	}
+	if e2eTestNonce(m.Data) != "" {
+		return fmt.Errorf("e2e test messages can only be sent to a user with POST /messages/send")
+	}
+	return nil
+}
+
+// preparedSegmentMessage is a validated message with its category and templates
+type preparedSegmentMessage struct {
+	SegmentMessage
+	category  sqlc.NotificationCategory
+	templates []sqlc.Template // Every locale of TemplateKey
+}
+
+// prepareSegmentMessage looks up the category and templates of a message
+func prepareSegmentMessage(ctx context.Context, queries sqlc.Querier, message SegmentMessage) (preparedSegmentMessage, error) {
+	prepared := preparedSegmentMessage{SegmentMessage: message}
+	category, err := queries.GetNotificationCategory(ctx, message.Category)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return prepared, fmt.Errorf("%w: unknown category: %s", errInvalidSegmentMessage, message.Category)
+	}
+	if err != nil {
+		return prepared, err
+	}
+	prepared.category = category
+	if message.TemplateKey != "" {
+		prepared.templates, err = queries.ListTemplates(ctx, optionalText(message.TemplateKey))
+		if err != nil {
+			return prepared, err
+		}
+		if len(prepared.templates) == 0 {
+			return prepared, fmt.Errorf("%w: unknown template_key: %s", errInvalidSegmentMessage, message.TemplateKey)
+		}
+	}
+	return prepared, nil
+}
+
+// outgoing returns the message each user gets
+func (m preparedSegmentMessage) outgoing() outgoingMessage {
+	return outgoingMessage{
+		category:  m.category,
+		templates: m.templates,
+		variables: m.Variables,
+		content:   messageContent{Title: m.Title, Body: m.Body},
+		data:      parseMessageData(m.Data),
+	}
+}
+
+// loadSegmentFilter parses a saved segment and compiles it at the current time.
+// It returns pgx.ErrNoRows for unknown segments.
+func (s *Service) loadSegmentFilter(ctx context.Context, queries sqlc.Querier, segmentID string) (segmentFilter, error) {
+	segment, err := queries.GetSegment(ctx, segmentID)
+	if err != nil {
+		return segmentFilter{}, err
+	}
+	expr, err := parseSegmentFilter(segment.Expression)
+	if err != nil {
+		return segmentFilter{}, fmt.Errorf("invalid expression of segment %s: %w", segmentID, err)
+	}
+	return compileSegmentFilter(expr, s.Clock.Now()), nil
+}
+
+// segmentBatch is the outcome of sending to one batch of a segment's users
+type segmentBatch struct {
+	Users      int
+	Sent       int
+	Failed     int
+	Retried    int
+	Suppressed int
+	NextUserID string // Last user of the batch if there are more users, otherwise ""
+}
+
+// sendSegmentBatch sends a message to the devices of up to batchSize users of a segment after
+// afterUserID, in user_id order. Each user gets a message of their own. Templates are rendered
+// for the whole batch before anything is recorded; errTemplateRender is returned if that fails.
+// The batch is recorded in one transaction and then sent, fcmSendConcurrency devices at a time:
+// failed sends are recorded on the delivery and counted, without stopping the batch, and sends
+// that failed transiently are left to the relay.
+func (s *Service) sendSegmentBatch(ctx context.Context, logger *common.Logger, filter segmentFilter, message preparedSegmentMessage, afterUserID string, batchSize int) (segmentBatch, error) {
+	// One more user to know whether there is a next batch
+	devices, err := s.Store.ListSegmentDevices(ctx, filter, afterUserID, batchSize+1)
+	if err != nil {
+		return segmentBatch{}, err
+	}
+	users := groupDevicesByUser(devices)
+
+	var batch segmentBatch
+	if len(users) > batchSize {
+		users = users[:batchSize]
+		batch.NextUserID = users[batchSize-1].userID
+	}
+	batch.Users = len(users)
+
+	// The messages, their deliveries and the sends of the whole batch are recorded together, so
+	// no delivery is left that nothing will send (see outbox.go), and a batch that fails to be
+	// recorded sends nothing and can be retried with the same cursor
+	var enqueued enqueuedMessages
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		var err error
+		enqueued, err = s.enqueueUserMessages(ctx, queries, users, message.outgoing())
+		return err
+	})
+	if err != nil {
+		return segmentBatch{}, err
+	}
+	batch.Suppressed = len(enqueued.suppressed)
+
+	counts := s.publishFCMSends(ctx, logger, enqueued.entries, fcmSendConcurrency)
+	batch.Sent, batch.Failed, batch.Retried = counts.Sent, counts.Failed, counts.Retried
+	return batch, nil
+}
+
+// userDevices are the devices of one user
+type userDevices struct {
+	userID  string
+	devices []sqlc.ListActiveDevicesByPlatformsRow
+}
+
+// groupDevicesByUser groups devices sorted by user_id, keeping the order
+func groupDevicesByUser(devices []sqlc.ListActiveDevicesByPlatformsRow) []userDevices {
+	var users []userDevices
+	for _, device := range devices {
+		if len(users) == 0 || users[len(users)-1].userID != device.UserID {
+			users = append(users, userDevices{userID: device.UserID})
+		}
+		last := &users[len(users)-1]
+		last.devices = append(last.devices, device)
+	}
+	return users
+}
+
+// segmentPathParameter returns the validated segment ID of the path
+func segmentPathParameter(request events.APIGatewayProxyRequest) (string, error) {
+	segmentID := request.PathParameters["segment_id"]
+	if !segmentIDPattern.MatchString(segmentID) {
+		return "", fmt.Errorf("invalid segment_id: %q (must match %s)", segmentID, segmentIDPattern)
+	}
+	return segmentID, nil
+}
+
+func newSegmentResponse(segment sqlc.Segment) SegmentResponse {
+	return SegmentResponse{
+		SegmentID:   segment.SegmentID,
+		Description: segment.Description,
+		Expression:  segment.Expression,
+		CreatedAt:   segment.CreatedAt.Time,
+		UpdatedAt:   segment.UpdatedAt.Time,
+	}
+}
+
+func encodeSegmentCursor(cursor segmentCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSegmentCursor(value string) (segmentCursor, error) {
+	var cursor segmentCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.UserID == "" {
+		return cursor, fmt.Errorf("invalid cursor: %s", value)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// invokeSegment invokes a /segments/{segment_id} handler.
+func invokeSegment(t *testing.T, handler apiHandler, segmentID, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Body:           body,
+		PathParameters: map[string]string{"segment_id": segmentID},
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return response
+}
+
+// putSegment creates or replaces a segment through PutSegmentHandler.
+func putSegment(t *testing.T, service *Service, segmentID, expression string) {
+	t.Helper()
+	body := `{"description":"test segment","expression":` + quoteJSON(expression) + `}`
+	expectStatus(t, invokeSegment(t, service.PutSegmentHandler, segmentID, body), 200)
+}
+
+// previewSegment invokes PreviewSegmentHandler and decodes the size.
+func previewSegment(t *testing.T, service *Service, segmentID string) SegmentPreviewResponse {
+	t.Helper()
+	response := invokeSegment(t, service.PreviewSegmentHandler, segmentID, "")
+	expectStatus(t, response, 200)
+	var preview SegmentPreviewResponse
+	decodeBody(t, response, &preview)
+	return preview
+}
+
+// sendSegment invokes SendSegmentHandler and decodes the batch.
+func sendSegment(t *testing.T, service *Service, segmentID, body string) SendSegmentResponse {
+	t.Helper()
+	response := invokeSegment(t, service.SendSegmentHandler, segmentID, body)
+	expectStatus(t, response, 200)
+	var batch SendSegmentResponse
+	decodeBody(t, response, &batch)
+	return batch
+}
+
+func quoteJSON(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// registerSegmentDevices registers devices of four users with different app versions:
+// user-1 android 2.10 and ios 2.2, user-2 android 2.3.1, user-3 ios without a version, user-4 android 1.9.
+func registerSegmentDevices(t *testing.T, service *Service) {
+	t.Helper()
+	for _, body := range []string{
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_version":"2.10.0"}`,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios","app_version":"2.2"}`,
+		`{"user_id":"user-2","device_id":"device-3","fcm_token":"token-3","platform":"android","app_version":"2.3.1-beta.1"}`,
+		`{"user_id":"user-3","device_id":"device-4","fcm_token":"token-4","platform":"ios"}`,
+		`{"user_id":"user-4","device_id":"device-5","fcm_token":"token-5","platform":"android","app_version":"1.9"}`,
+	} {
+		expectStatus(t, invoke(t, service.RegisterDeviceHandler, body, nil), 200)
+	}
+}
+
+func TestSegmentCRUD(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	expectStatus(t, invokeSegment(t, service.GetSegmentHandler, "android", ""), 404)
+	putSegment(t, service, "android", `platform = "android"`)
+	putSegment(t, service, "beta", `app_version >= "3.0"`)
+
+	// Replacing a segment keeps its creation time
+	fakes.clock.Advance(time.Minute)
+	putSegment(t, service, "android", `platform = "android" AND last_seen > now-30d`)
+
+	response := invokeSegment(t, service.GetSegmentHandler, "android", "")
+	expectStatus(t, response, 200)
+	var got SegmentResponse
+	decodeBody(t, response, &got)
+	if got.Expression != `platform = "android" AND last_seen > now-30d` || got.Description != "test segment" || !got.UpdatedAt.After(got.CreatedAt) {
+		t.Fatalf("unexpected segment: %+v", got)
+	}
+
+	response = invoke(t, service.ListSegmentsHandler, "", nil)
+	expectStatus(t, response, 200)
+	var list ListSegmentsResponse
+	decodeBody(t, response, &list)
+	if len(list.Segments) != 2 || list.Segments[0].SegmentID != "android" || list.Segments[1].SegmentID != "beta" {
+		t.Fatalf("unexpected segments: %+v", list)
+	}
+
+	expectStatus(t, invokeSegment(t, service.DeleteSegmentHandler, "beta", ""), 200)
+	expectStatus(t, invokeSegment(t, service.DeleteSegmentHandler, "beta", ""), 404)
+	expectStatus(t, invokeSegment(t, service.PreviewSegmentHandler, "beta", ""), 404)
+	expectStatus(t, invokeSegment(t, service.SendSegmentHandler, "beta", `{"category":"system","title":"Hi","body":"There"}`), 404)
+}
+
+func TestPutSegmentRejectsInvalidSegments(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	for name, test := range map[string]struct{ segmentID, body string }{
+		"invalid segment_id":   {"Not Valid", `{"expression":"platform = \"ios\""}`},
+		"invalid body":         {"ios", `{"expression":`},
+		"missing expression":   {"ios", `{"description":"iOS"}`},
+		"invalid expression":   {"ios", `{"expression":"platform ~ \"ios\""}`},
+		"unknown field":        {"ios", `{"expression":"fcm_token = \"token-1\""}`},
+		"sql in an expression": {"ios", `{"expression":"platform = 'ios'; DROP TABLE devices"}`},
+	} {
+		if response := invokeSegment(t, service.PutSegmentHandler, test.segmentID, test.body); response.StatusCode != 400 {
+			t.Errorf("%s: expected 400, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+	if len(fakes.querier.segments) != 0 {
+		t.Fatalf("invalid segments were stored: %+v", fakes.querier.segments)
+	}
+}
+
+func TestPreviewSegment(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+
+	// device-5 is no longer seen
+	fakes.clock.Advance(40 * 24 * time.Hour)
+	for _, body := range []string{
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_version":"2.10.0"}`,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios","app_version":"2.2"}`,
+		`{"user_id":"user-2","device_id":"device-3","fcm_token":"token-3","platform":"android","app_version":"2.3.1-beta.1"}`,
+		`{"user_id":"user-3","device_id":"device-4","fcm_token":"token-4","platform":"ios"}`,
+	} {
+		expectStatus(t, invoke(t, service.RegisterDeviceHandler, body, nil), 200)
+	}
+
+	tests := []struct {
+		expression string
+		want       SegmentPreviewResponse
+	}{
+		{`platform = "android"`, SegmentPreviewResponse{DeviceCount: 3, UserCount: 3, Platforms: map[string]int64{"android": 3, "ios": 0}}},
+		// Versions compare numerically, and the pre-release suffix is ignored
+		{`app_version >= "2.3"`, SegmentPreviewResponse{DeviceCount: 2, UserCount: 2, Platforms: map[string]int64{"android": 2, "ios": 0}}},
+		{`platform = "android" AND app_version >= "2.3" AND last_seen > now-30d`, SegmentPreviewResponse{DeviceCount: 2, UserCount: 2, Platforms: map[string]int64{"android": 2, "ios": 0}}},
+		{`last_seen < now-30d`, SegmentPreviewResponse{DeviceCount: 1, UserCount: 1, Platforms: map[string]int64{"android": 1, "ios": 0}}},
+		// Devices without a version match no comparison, but NOT of one
+		{`app_version < "2.3"`, SegmentPreviewResponse{DeviceCount: 2, UserCount: 2, Platforms: map[string]int64{"android": 1, "ios": 1}}},
+		{`NOT app_version >= "2.3"`, SegmentPreviewResponse{DeviceCount: 3, UserCount: 3, Platforms: map[string]int64{"android": 1, "ios": 2}}},
+		{`user_id IN ("user-1", "user-3") OR platform != "android"`, SegmentPreviewResponse{DeviceCount: 3, UserCount: 2, Platforms: map[string]int64{"android": 1, "ios": 2}}},
+		{`app_id = "shop"`, SegmentPreviewResponse{DeviceCount: 0, UserCount: 0, Platforms: map[string]int64{"android": 0, "ios": 0}}},
+	}
+	for _, test := range tests {
+		putSegment(t, service, "preview", test.expression)
+		test.want.SegmentID = "preview"
+		if got := previewSegment(t, service, "preview"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %+v, got %+v", test.expression, test.want, got)
+		}
+	}
+}
+
+func TestSendSegmentInBatches(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putSegment(t, service, "current", `app_version >= "2.2"`)
+
+	// user-1 keeps marketing on device-2 only
+	expectStatus(t, invokePreferences(t, service.PutPreferencesHandler, "user-1",
+		`{"categories":{"marketing":false},"devices":{"device-2":{"marketing":true}}}`), 200)
+
+	body := `{"category":"marketing","title":"New version","body":"Update now","batch_size":1`
+	first := sendSegment(t, service, "current", body+`}`)
+	if first.UserCount != 1 || first.SentCount != 1 || first.SuppressedCount != 1 || first.NextCursor == "" {
+		t.Fatalf("unexpected first batch: %+v", first)
+	}
+	second := sendSegment(t, service, "current", body+`,"cursor":"`+first.NextCursor+`"}`)
+	if second.UserCount != 1 || second.SentCount != 1 || second.NextCursor != "" {
+		t.Fatalf("unexpected second batch: %+v", second)
+	}
+
+	var tokens []string
+	for _, message := range fakes.sender.Sent() {
+		tokens = append(tokens, message.Token)
+		if message.Data[messageIDDataKey] == "" || message.Data[receiptTokenDataKey] == "" {
+			t.Errorf("message without id or receipt token: %+v", message)
+		}
+	}
+	if !reflect.DeepEqual(tokens, []string{"token-2", "token-3"}) {
+		t.Fatalf("expected messages to token-2 and token-3, got %v", tokens)
+	}
+	if len(fakes.querier.messages) != 2 {
+		t.Fatalf("expected one message per user, got %+v", fakes.querier.messages)
+	}
+}
+
+func TestSendSegmentRecordsFailures(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putSegment(t, service, "android", `platform = "android"`)
+	fakes.sender.FailToken("token-3", fmt.Errorf("%w: status=404", errPushTokenUnregistered))
+
+	batch := sendSegment(t, service, "android", `{"category":"system","title":"Hi","body":"There"}`)
+	if batch.UserCount != 3 || batch.SentCount != 2 || batch.FailedCount != 1 || batch.NextCursor != "" {
+		t.Fatalf("unexpected batch: %+v", batch)
+	}
+	for key, delivery := range fakes.querier.messageDeliveries {
+		if failed := key.DeviceID == "device-3"; failed != (delivery.Status == "SEND_FAILED") {
+			t.Errorf("unexpected delivery of %s: %+v", key.DeviceID, delivery)
+		}
+	}
+	if device, err := fakes.querier.GetDeviceByDeviceID(t.Context(), "device-3"); err != nil || device.IsActive {
+		t.Fatalf("expected device-3 to be deactivated, got %+v, %v", device, err)
+	}
+}
+
+func TestSendSegmentRollsBackFailedBatch(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putSegment(t, service, "android", `platform = "android"`)
+
+	// Recording the send to the last user fails, so nothing of the batch is recorded or sent
+	fakes.querier.outboxCapacity = 2
+	body := `{"category":"system","title":"Hi","body":"There"}`
+	expectStatus(t, invokeSegment(t, service.SendSegmentHandler, "android", body), 500)
+	if len(fakes.sender.Sent()) != 0 || len(fakes.querier.messages) != 0 || len(fakes.querier.outbox) != 0 {
+		t.Fatalf("expected nothing to be recorded or sent, got %+v, %+v", fakes.querier.messages, fakes.sender.Sent())
+	}
+
+	// Retrying the batch sends to every user once
+	fakes.querier.outboxCapacity = 0
+	if batch := sendSegment(t, service, "android", body); batch.UserCount != 3 || batch.SentCount != 3 {
+		t.Fatalf("unexpected batch: %+v", batch)
+	}
+	if sent := fakes.sender.Sent(); len(sent) != 3 {
+		t.Fatalf("expected 3 messages, got %+v", sent)
+	}
+}
+
+func TestSendSegmentLeavesTransientFailuresToTheRelay(t *testing.T) {
+	service, fakes := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookMessageSent)
+	registerSegmentDevices(t, service)
+	putSegment(t, service, "android", `platform = "android"`)
+	fakes.sender.FailToken("token-3", errors.New("FCM API returned error: status=503"))
+
+	batch := sendSegment(t, service, "android", `{"category":"system","title":"Hi","body":"There"}`)
+	if batch.SentCount != 2 || batch.FailedCount != 0 || batch.RetriedCount != 1 {
+		t.Fatalf("unexpected batch: %+v", batch)
+	}
+	if len(fakes.querier.outbox) != 1 {
+		t.Fatalf("expected the send to device-3 to be kept, got %+v", fakes.querier.outbox)
+	}
+
+	fakes.sender.FailToken("token-3", nil)
+	fakes.clock.Advance(outboxLease)
+	if result := relayOutbox(t, service); result != (RelayResult{Published: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// Segment sends emit message.sent like any other send
+	deliverWebhooks(t, service)
+	if got := fmt.Sprint(receivedEvents(receiver.Received())); got != "[message.sent message.sent message.sent]" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+}
+
+func TestSendSegmentTemplateMessage(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putSegment(t, service, "old", `app_version < "2.0"`)
+	putTemplate(t, service, "update", "en", `{"title":"Update","body":"Version {{.version}} is out"}`)
+
+	sendSegment(t, service, "old", `{"category":"system","template_key":"update","variables":{"version":"2.10"}}`)
+	if sent := fakes.sender.Sent(); len(sent) != 1 || sent[0].Token != "token-5" || sent[0].Body != "Version 2.10 is out" {
+		t.Fatalf("unexpected messages: %+v", sent)
+	}
+
+	// Rendering fails before anything is sent
+	expectStatus(t, invokeSegment(t, service.SendSegmentHandler, "old", `{"category":"system","template_key":"update"}`), 400)
+	if sent := fakes.sender.Sent(); len(sent) != 1 {
+		t.Fatalf("expected no more messages, got %+v", sent)
+	}
+}
+
+func TestSendSegmentBadRequest(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerSegmentDevices(t, service)
+	putSegment(t, service, "all", `platform IN ("android", "ios")`)
+
+	for name, body := range map[string]string{
+		"invalid body":      `{"category":`,
+		"missing category":  `{"title":"Hi","body":"There"}`,
+		"missing body":      `{"category":"system","title":"Hi"}`,
+		"unknown category":  `{"category":"newsletter","title":"Hi","body":"There"}`,
+		"unknown template":  `{"category":"system","template_key":"missing"}`,
+		"template and body": `{"category":"system","template_key":"update","body":"There"}`,
+		"e2e test message":  `{"category":"system","title":"Hi","body":"There","data":{"type":"e2e_test","nonce":"nonce-1"}}`,
+		"batch_size -1":     `{"category":"system","title":"Hi","body":"There","batch_size":-1}`,
+		"batch_size 501":    `{"category":"system","title":"Hi","body":"There","batch_size":501}`,
+		"invalid cursor":    `{"category":"system","title":"Hi","body":"There","cursor":"not-a-cursor"}`,
+	} {
+		if response := invokeSegment(t, service.SendSegmentHandler, "all", body); response.StatusCode != 400 {
+			t.Errorf("%s: expected 400, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+	expectStatus(t, invokeSegment(t, service.SendSegmentHandler, "All", `{"category":"system","title":"Hi","body":"There"}`), 400)
+	if sent := fakes.sender.Sent(); len(sent) != 0 {
+		t.Fatalf("expected no messages, got %+v", sent)
+	}
+}
+
+func TestSegmentHandlers(t *testing.T) {
+	requireDB(t)
+	expectStatus(t, invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_version":"2.10.0"}`, nil), 200)
+	expectStatus(t, invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-2","device_id":"device-2","fcm_token":"token-2","platform":"android","app_version":"2.9"}`, nil), 200)
+	registerDevice(t, "user-3", "device-3", "token-3", "ios")
+
+	putSegment(t, testService, "android-2-10", `platform = "android" AND app_version >= "2.10" AND last_seen > now-30d`)
+	if preview := previewSegment(t, testService, "android-2-10"); preview.DeviceCount != 1 || preview.UserCount != 1 {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+	putSegment(t, testService, "no-version", `NOT app_version >= "1.0"`)
+	if preview := previewSegment(t, testService, "no-version"); preview.DeviceCount != 1 || preview.Platforms["ios"] != 1 {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	putSegment(t, testService, "everyone", `last_seen > now-1h`)
+	first := sendSegment(t, testService, "everyone", `{"category":"system","title":"Hi","body":"There","batch_size":2}`)
+	if first.UserCount != 2 || first.SentCount != 2 || first.NextCursor == "" {
+		t.Fatalf("unexpected first batch: %+v", first)
+	}
+	second := sendSegment(t, testService, "everyone", `{"category":"system","title":"Hi","body":"There","batch_size":2,"cursor":"`+first.NextCursor+`"}`)
+	if second.UserCount != 1 || second.SentCount != 1 || second.NextCursor != "" {
+		t.Fatalf("unexpected second batch: %+v", second)
+	}
+	if messages := testFCM.Messages(); len(messages) != 3 {
+		t.Fatalf("expected 3 FCM messages, got %+v", messages)
+	}
+}
@@ -1,38 +1,54 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/fcm-tutorial/lambda/api/common"
 	"github.com/fcm-tutorial/lambda/api/sqlc"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type SendMessageRequest struct {
-	UserID string          `json:"user_id"`
-	Title  string          `json:"title"`
-	Body   string          `json:"body"`
-	Data   json.RawMessage `json:"data"`
+	UserID string `json:"user_id"`
+	// Notification category, e.g. "marketing"; devices that opted out of it are not sent to, see preferences.go
+	Category string          `json:"category"`
+	Title    string          `json:"title"` // Required unless template_key is set
+	Body     string          `json:"body"`  // Required unless template_key is set
+	Data     json.RawMessage `json:"data"`
+	// Optional, instead of title and body: the template to render in each device's locale, see templates.go
+	TemplateKey string         `json:"template_key"`
+	Variables   map[string]any `json:"variables"` // Values of the template's {{.name}} references
+	// Optional, e2e test messages only: seconds until an unacknowledged test run expires
+	AckTimeoutSeconds int `json:"ack_timeout_seconds"`
+	// Optional, instead of title, body and template_key: the campaign whose variant the user gets, see campaigns.go
+	CampaignID string `json:"campaign_id"`
 }
 
 type SendMessageResponse struct {
-	OK        bool `json:"ok"`
-	SentCount int  `json:"sent_count"`
+	OK           bool   `json:"ok"`
+	MessageID    string `json:"message_id"`
+	SentCount    int    `json:"sent_count"`
+	FailedCount  int    `json:"failed_count"`  // Devices the push service did not accept, see message_deliveries
+	RetriedCount int    `json:"retried_count"` // Devices whose send failed transiently; the relay retries them
+	// Active devices of the user not sent to, because they opted out of the category
+	SuppressedDeviceIDs []string `json:"suppressed_device_ids"`
+	// Campaign messages only: the variant the user got, or holdout if the user is in the holdout
+	// group and got no message
+	CampaignID string `json:"campaign_id,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	Holdout    bool   `json:"holdout,omitempty"`
 }
 
-func SendMessageHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+// SendMessageHandler is the Lambda handler for sending a message to all devices of a user
+func (s *Service) SendMessageHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	logger := common.NewLogger()
 	logger.Info(ctx, "Received send message request")
 
@@ -41,219 +57,544 @@ func SendMessageHandler(ctx context.Context, request events.APIGatewayProxyReque
 		return logger.BadRequest(ctx, nil, "Invalid request body")
 	}
 
-	// Validate required fields
-	if sendMessageRequest.UserID == "" || sendMessageRequest.Title == "" || sendMessageRequest.Body == "" {
-		err := fmt.Errorf("missing required fields: user_id, title, body")
+	// Validate required fields: a message has either a campaign, a template or a literal title and body
+	if sendMessageRequest.CampaignID != "" {
+		if sendMessageRequest.Title != "" || sendMessageRequest.Body != "" || sendMessageRequest.TemplateKey != "" || sendMessageRequest.Variables != nil {
+			err := fmt.Errorf("campaign_id cannot be combined with title, body, template_key or variables")
+			return logger.BadRequest(ctx, err, "Use either campaign_id, template_key or title and body")
+		}
+		if e2eTestNonce(sendMessageRequest.Data) != "" {
+			err := fmt.Errorf("e2e test messages cannot be sent with campaign_id")
+			return logger.BadRequest(ctx, err, "e2e test messages cannot be campaign messages")
+		}
+	} else if sendMessageRequest.TemplateKey != "" {
+		if sendMessageRequest.Title != "" || sendMessageRequest.Body != "" {
+			err := fmt.Errorf("template_key cannot be combined with title or body")
+			return logger.BadRequest(ctx, err, "Use either template_key or title and body")
+		}
+	} else if sendMessageRequest.Variables != nil {
+		err := fmt.Errorf("variables without template_key")
+		return logger.BadRequest(ctx, err, "variables require template_key")
+	}
+	if sendMessageRequest.UserID == "" || (sendMessageRequest.CampaignID == "" && (sendMessageRequest.Category == "" ||
+		(sendMessageRequest.TemplateKey == "" && (sendMessageRequest.Title == "" || sendMessageRequest.Body == "")))) {
+		err := fmt.Errorf("missing required fields: user_id, category, title, body (or template_key or campaign_id)")
 		return logger.BadRequest(ctx, err, "Missing required fields")
 	}
 
+	// If data.type == "e2e_test" and data.nonce is present, the message is tracked in test_runs
+	nonce := e2eTestNonce(sendMessageRequest.Data)
+	ackTimeout := defaultAckTimeout
+	if sendMessageRequest.AckTimeoutSeconds != 0 {
+		ackTimeout = time.Duration(sendMessageRequest.AckTimeoutSeconds) * time.Second
+		if ackTimeout < 0 || ackTimeout > maxAckTimeout {
+			err := fmt.Errorf("invalid ack_timeout_seconds: %d (must be 1-%d)", sendMessageRequest.AckTimeoutSeconds, int(maxAckTimeout.Seconds()))
+			return logger.BadRequest(ctx, err, "Invalid ack_timeout_seconds")
+		}
+	}
+	testRun := sqlc.CreateTestRunParams{
+		Nonce:     nonce,
+		UserID:    sendMessageRequest.UserID,
+		ExpiresAt: pgtype.Timestamptz{Time: s.Clock.Now().Add(ackTimeout), Valid: true},
+	}
+
 	// Get database connection
-	db, err := common.GetDBConnection()
+	queries, err := s.Store.Queries(ctx)
 	if err != nil {
 		return logger.InternalServerError(ctx, err, "Database connection failed")
 	}
-	defer common.CloseDBConnection(db)
+
+	// A campaign provides the category and the copy: that of the variant the user is assigned to
+	defaultContent := messageContent{Title: sendMessageRequest.Title, Body: sendMessageRequest.Body}
+	var campaign campaignSend
+	if sendMessageRequest.CampaignID != "" {
+		campaign, err = prepareCampaignSend(ctx, queries, sendMessageRequest.CampaignID, sendMessageRequest.UserID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				err := fmt.Errorf("unknown campaign_id: %s", sendMessageRequest.CampaignID)
+				return logger.BadRequest(ctx, err, "Unknown campaign_id")
+			}
+			return logger.InternalServerError(ctx, err, "Failed to load campaign")
+		}
+		if sendMessageRequest.Category != "" && sendMessageRequest.Category != campaign.campaign.Category {
+			err := fmt.Errorf("category %s does not match category %s of campaign %s", sendMessageRequest.Category, campaign.campaign.Category, sendMessageRequest.CampaignID)
+			return logger.BadRequest(ctx, err, "category does not match the campaign")
+		}
+		sendMessageRequest.Category = campaign.campaign.Category
+
+		// The holdout group gets no message, but is recorded for comparison with the variants
+		if campaign.holdout {
+			if err := queries.UpsertCampaignAssignment(ctx, campaign.assignment(sendMessageRequest.UserID)); err != nil {
+				return logger.InternalServerError(ctx, err, "Database operation failed")
+			}
+			logger.Info(ctx, "User in holdout group, not sent: campaign_id=%s, user_id=%s", sendMessageRequest.CampaignID, sendMessageRequest.UserID)
+			return logger.Success(ctx, SendMessageResponse{
+				OK:                  true,
+				SuppressedDeviceIDs: []string{},
+				CampaignID:          sendMessageRequest.CampaignID,
+				Holdout:             true,
+			})
+		}
+		defaultContent = campaign.content
+	}
+
+	category, err := queries.GetNotificationCategory(ctx, sendMessageRequest.Category)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err := fmt.Errorf("unknown category: %s", sendMessageRequest.Category)
+			return logger.BadRequest(ctx, err, "Unknown category")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
 
 	// Query devices for all rows where user_id = ? and is_active = TRUE (only android and ios)
-	queries := sqlc.New(db)
 	devices, err := queries.ListActiveDevicesByPlatforms(ctx, sendMessageRequest.UserID)
 	if err != nil {
 		return logger.InternalServerError(ctx, err, "Database query failed")
 	}
 
-	// Send message to each device
-	for _, device := range devices {
-		err = sendMessageToDevice(ctx, device.FcmToken, sendMessageRequest.Title, sendMessageRequest.Body, sendMessageRequest.Data)
+	// Without title and body, the template is rendered for each device in its own locale
+	var templates []sqlc.Template
+	if sendMessageRequest.TemplateKey != "" {
+		templates, err = queries.ListTemplates(ctx, optionalText(sendMessageRequest.TemplateKey))
 		if err != nil {
-			return logger.InternalServerError(ctx, err, "Failed to send message to device")
+			return logger.InternalServerError(ctx, err, "Database query failed")
 		}
+		if len(templates) == 0 {
+			err := fmt.Errorf("unknown template_key: %s", sendMessageRequest.TemplateKey)
+			return logger.BadRequest(ctx, err, "Unknown template_key")
+		}
+	}
+
+	data := parseMessageData(sendMessageRequest.Data)
+	if data == nil {
+		data = make(map[string]string)
+	}
+	if sendMessageRequest.CampaignID != "" {
+		data[campaignIDDataKey] = sendMessageRequest.CampaignID
+		data[variantDataKey] = campaign.variant.Variant
+	}
+	message := outgoingMessage{
+		category:  category,
+		templates: templates,
+		variables: sendMessageRequest.Variables,
+		content:   defaultContent,
+		data:      data,
+		campaign:  campaign.messageCampaign(),
+	}
+	if nonce != "" {
+		// Echoed back by the device's ack to measure send-to-ack latency
+		data[sentTimeDataKey] = s.Clock.Now().UTC().Format(time.RFC3339Nano)
+		message.nonce = nonce
+		message.ackTokenExpiresAt = testRun.ExpiresAt.Time.Unix()
 	}
 
-	// If data.type == "e2e_test" and data.nonce is present, insert into test_runs
-	if len(sendMessageRequest.Data) > 0 {
-		var dataMap map[string]interface{}
-		if err := json.Unmarshal(sendMessageRequest.Data, &dataMap); err == nil {
-			if dataType, ok := dataMap["type"].(string); ok && dataType == "e2e_test" {
-				if nonce, ok := dataMap["nonce"].(string); ok && nonce != "" {
-					// Insert test run record
-					err = queries.CreateTestRun(ctx, sqlc.CreateTestRunParams{
-						Nonce:  nonce,
-						UserID: sendMessageRequest.UserID,
-					})
-					if err != nil {
-						logger.Error(ctx, err, "Failed to create test run record")
-						// Don't fail the request if test run creation fails, just log it
-					} else {
-						logger.Info(ctx, "Created test run record: nonce=%s, user_id=%s", nonce, sendMessageRequest.UserID)
-					}
-				}
+	// Persist the message, the test run, one delivery per device and the sends in one transaction,
+	// so a device can never report a receipt for a message (or ack a run) that does not exist yet,
+	// and no delivery is left that nothing will send (see outbox.go)
+	var enqueued enqueuedMessages
+	err = s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		if sendMessageRequest.CampaignID != "" {
+			if err := queries.UpsertCampaignAssignment(ctx, campaign.assignment(sendMessageRequest.UserID)); err != nil {
+				return err
 			}
 		}
+		var err error
+		enqueued, err = s.enqueueUserMessages(ctx, queries, []userDevices{{userID: sendMessageRequest.UserID, devices: devices}}, message)
+		if err != nil {
+			return err
+		}
+		if nonce != "" {
+			var recipients []sqlc.ListActiveDevicesByPlatformsRow
+			if len(enqueued.messages) > 0 {
+				recipients = enqueued.messages[0].devices
+			}
+			if err := createTestRun(ctx, queries, testRun, recipients); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errTestRunExists) {
+		errorResp := logger.HandleError(ctx, err, "Test run already exists for nonce")
+		return events.APIGatewayProxyResponse{
+			StatusCode: 409, // Conflict
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       errorResp.ToJSON(),
+		}, nil
+	}
+	if errors.Is(err, errTemplateRender) {
+		return logger.BadRequest(ctx, err, "Template cannot be rendered: missing variables or locale")
 	}
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to create message")
+	}
+	if len(enqueued.suppressed) > 0 {
+		logger.Info(ctx, "Suppressed devices that opted out of category %s: %v", category.Category, enqueued.suppressed)
+	}
+	messageID := ""
+	if len(enqueued.messages) > 0 {
+		messageID = enqueued.messages[0].messageID
+		logger.Info(ctx, "Created message record: message_id=%s, user_id=%s, devices=%d", messageID, sendMessageRequest.UserID, len(enqueued.messages[0].devices))
+	}
+	if nonce != "" {
+		logger.Info(ctx, "Created test run record: nonce=%s, message_id=%s, expires_at=%s",
+			nonce, messageID, testRun.ExpiresAt.Time.Format(time.RFC3339))
+	}
+
+	// Send to every device. The message is recorded already, so failed sends don't fail the request,
+	// which a client would retry with a new message: a send that fails for good is recorded on its
+	// delivery, and one that failed transiently stays in the outbox for the relay.
+	counts := s.publishFCMSends(ctx, logger, enqueued.entries, fcmSendConcurrency)
 
 	// Prepare success response
 	response := SendMessageResponse{
-		OK:        true,
-		SentCount: len(devices),
+		OK:                  true,
+		MessageID:           messageID,
+		SentCount:           counts.Sent,
+		FailedCount:         counts.Failed,
+		RetriedCount:        counts.Retried,
+		SuppressedDeviceIDs: enqueued.suppressed,
+		CampaignID:          sendMessageRequest.CampaignID,
+		Variant:             campaign.variant.Variant,
 	}
 
 	return logger.Success(ctx, response)
 }
 
-// sendMessageToDevice sends a push notification to a single device using FCM HTTP v1 API
-func sendMessageToDevice(ctx context.Context, fcmToken string, title string, body string, data json.RawMessage) error {
-	// Get FCM credentials from Secrets Manager
-	creds, err := common.GetFCMCredentials(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get FCM credentials: %w", err)
-	}
+// Expiry of e2e test runs, see SendMessageRequest.AckTimeoutSeconds
+const (
+	defaultAckTimeout = 2 * time.Minute
+	maxAckTimeout     = 1 * time.Hour
+)
 
-	// Generate OAuth2 access token
-	accessToken, err := generateAccessToken(ctx, creds)
-	if err != nil {
-		return fmt.Errorf("failed to generate access token: %w", err)
+// sentTimeDataKey is the data key carrying the send time of e2e test messages (see TestAckRequest.SentTime)
+const sentTimeDataKey = "sent_time"
+
+// messageIDDataKey is the data key carrying the ID of every message, used in POST /messages/{id}/receipt
+const messageIDDataKey = "message_id"
+
+// newMessageID returns a random, unguessable message ID
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return "msg-" + hex.EncodeToString(b), nil
+}
 
-	// Parse data if provided
-	var dataMap map[string]string
-	if len(data) > 0 {
-		if err := json.Unmarshal(data, &dataMap); err != nil {
-			// If data is not a map, treat it as a single string value
-			fmt.Printf("WARNING: Invalid JSON for 'data' field: %v. Raw data: %s\n", err, string(data))
-			dataMap = map[string]string{"data": string(data)}
-		}
+// e2eTestNonce returns data.nonce if data.type is "e2e_test", or "" for other messages
+func e2eTestNonce(data json.RawMessage) string {
+	if len(data) == 0 {
+		return ""
 	}
 
-	// Build FCM message payload
-	message := map[string]interface{}{
-		"message": map[string]interface{}{
-			"token": fcmToken,
-			"notification": map[string]string{
-				"title": title,
-				"body":  body,
-			},
-		},
+	var dataMap map[string]interface{}
+	if err := json.Unmarshal(data, &dataMap); err != nil {
+		return ""
+	}
+	if dataType, ok := dataMap["type"].(string); !ok || dataType != "e2e_test" {
+		return ""
 	}
+	nonce, _ := dataMap["nonce"].(string)
+	return nonce
+}
+
+// outgoingMessage is a message to the devices of users, each of whom gets a message of their own
+type outgoingMessage struct {
+	category  sqlc.NotificationCategory
+	templates []sqlc.Template   // Every locale of the template to render for each device, if any
+	variables map[string]any    // Values of the template's {{.name}} references
+	content   messageContent    // Title and body of messages without a template
+	data      map[string]string // Data of every message, to which its message ID is added
+	campaign  messageCampaign
+	// e2e test messages only: the test run, and when its ack token expires (Unix time)
+	nonce             string
+	ackTokenExpiresAt int64
+}
+
+// userMessage is the message recorded for one user
+type userMessage struct {
+	userID    string
+	messageID string
+	devices   []sqlc.ListActiveDevicesByPlatformsRow // Without the devices that opted out of the category
+}
 
-	// Add data if provided
-	if len(dataMap) > 0 {
-		message["message"].(map[string]interface{})["data"] = dataMap
+// enqueuedMessages are the messages recorded by enqueueUserMessages
+type enqueuedMessages struct {
+	messages   []userMessage
+	entries    []sqlc.Outbox // Their fcm_send entries, to publish once the transaction has committed
+	suppressed []string      // Devices left out because they opted out of the category
+}
+
+// enqueueUserMessages records a message to the devices of each user, with a PENDING delivery per
+// device, and enqueues its sends, in the caller's transaction. Devices that opted out of the
+// category are left out, and users without devices left get no message. The template is rendered
+// for every device and the token signing key fetched before anything is recorded, so a missing
+// variable (errTemplateRender) or a misconfigured key fails cleanly.
+func (s *Service) enqueueUserMessages(ctx context.Context, queries sqlc.Querier, users []userDevices, message outgoingMessage) (enqueuedMessages, error) {
+	enqueued := enqueuedMessages{suppressed: []string{}}
+
+	// Leave out devices that opted out of the category; they get no delivery at all
+	var recipients []sqlc.ListActiveDevicesByPlatformsRow
+	for _, user := range users {
+		preferences, err := loadNotificationPreferences(ctx, queries, user.userID)
+		if err != nil {
+			return enqueuedMessages{}, err
+		}
+		devices, suppressed := suppressedDevices(user.devices, message.category, preferences)
+		enqueued.suppressed = append(enqueued.suppressed, suppressed...)
+		if len(devices) > 0 {
+			enqueued.messages = append(enqueued.messages, userMessage{userID: user.userID, devices: devices})
+			recipients = append(recipients, devices...)
+		}
 	}
 
-	// Marshal request body
-	requestBody, err := json.Marshal(message)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request body: %w", err)
+	var deviceContents map[string]messageContent
+	if len(message.templates) > 0 && len(recipients) > 0 {
+		var err error
+		deviceContents, err = renderTemplateForDevices(message.templates, recipients, message.variables, s.DefaultLocale)
+		if err != nil {
+			return enqueuedMessages{}, err
+		}
+	}
+	if _, err := s.ackTokenKey(ctx); err != nil {
+		return enqueuedMessages{}, fmt.Errorf("failed to get ack token key: %w", err)
 	}
 
-	// Build FCM API URL
-	fcmURL := fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", creds.ProjectID)
+	for i := range enqueued.messages {
+		user := &enqueued.messages[i]
+		messageID, err := newMessageID()
+		if err != nil {
+			return enqueuedMessages{}, err
+		}
+		user.messageID = messageID
+		if err := createMessage(ctx, queries, messageID, user.userID, user.devices, message.campaign); err != nil {
+			return enqueuedMessages{}, fmt.Errorf("failed to create message for user %s: %w", user.userID, err)
+		}
 
-	// Create HTTP request
-	req, err := http.NewRequestWithContext(ctx, "POST", fcmURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %w", err)
+		data := withDefaultData(message.data, map[string]string{messageIDDataKey: messageID})
+		for _, device := range user.devices {
+			content, ok := deviceContents[device.DeviceID]
+			if !ok {
+				content = message.content
+			}
+			entry, err := s.enqueueOutbox(ctx, queries, outboxFCMSend, fcmSendPayload{
+				MessageID:         messageID,
+				Device:            newFCMSendDevice(device),
+				Title:             content.Title,
+				Body:              content.Body,
+				Data:              withDefaultData(content.DefaultData, data),
+				CampaignID:        message.campaign.CampaignID,
+				Variant:           message.campaign.Variant,
+				Nonce:             message.nonce,
+				AckTokenExpiresAt: message.ackTokenExpiresAt,
+			})
+			if err != nil {
+				return enqueuedMessages{}, fmt.Errorf("failed to enqueue send to device %s: %w", device.DeviceID, err)
+			}
+			enqueued.entries = append(enqueued.entries, entry)
+		}
 	}
+	return enqueued, nil
+}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
-
-	// Send request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// createMessage inserts the message with a PENDING delivery per device, recording the campaign variant if any
+func createMessage(ctx context.Context, queries sqlc.Querier, messageID, userID string, devices []sqlc.ListActiveDevicesByPlatformsRow, campaign messageCampaign) error {
+	if err := queries.CreateMessage(ctx, sqlc.CreateMessageParams{MessageID: messageID, UserID: userID}); err != nil {
+		return err
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %w", err)
+	for _, device := range devices {
+		err := queries.CreateMessageDelivery(ctx, sqlc.CreateMessageDeliveryParams{
+			MessageID:  messageID,
+			DeviceID:   device.DeviceID,
+			Platform:   device.Platform,
+			AppID:      device.AppID,
+			CampaignID: optionalText(campaign.CampaignID),
+			Variant:    optionalText(campaign.Variant),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create message delivery for device %s: %w", device.DeviceID, err)
+		}
 	}
-	defer resp.Body.Close()
+	return nil
+}
+
+// errTestRunExists is returned by createTestRun if the nonce has been used before
+var errTestRunExists = errors.New("test run already exists")
 
-	// Read response body
-	responseBody, err := io.ReadAll(resp.Body)
+// noDevicesFailureReason is the failure reason of test runs sent to a user without devices
+const noDevicesFailureReason = "no active devices for user"
+
+// createTestRun inserts a PENDING test run with a PENDING delivery per device.
+// Nothing will ever acknowledge a run without devices, so it is SEND_FAILED right away.
+func createTestRun(ctx context.Context, queries sqlc.Querier, testRun sqlc.CreateTestRunParams, devices []sqlc.ListActiveDevicesByPlatformsRow) error {
+	created, err := queries.CreateTestRun(ctx, testRun)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return err
+	}
+	if created == 0 {
+		return fmt.Errorf("%w: nonce=%s", errTestRunExists, testRun.Nonce)
 	}
 
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("FCM API returned error: status=%d, body=%s", resp.StatusCode, string(responseBody))
+	for _, device := range devices {
+		err := queries.CreateTestRunDelivery(ctx, sqlc.CreateTestRunDeliveryParams{
+			Nonce:    testRun.Nonce,
+			DeviceID: device.DeviceID,
+			Platform: device.Platform,
+			AppID:    device.AppID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create delivery for device %s: %w", device.DeviceID, err)
+		}
 	}
 
+	if len(devices) == 0 {
+		return queries.MarkTestRunSendFailed(ctx, sqlc.MarkTestRunSendFailedParams{
+			Nonce:         testRun.Nonce,
+			FailureReason: pgtype.Text{String: noDevicesFailureReason, Valid: true},
+		})
+	}
 	return nil
 }
 
-// generateAccessToken generates an OAuth2 access token from FCM service account credentials
-func generateAccessToken(ctx context.Context, creds *common.FCMCredentials) (string, error) {
-	// Parse RSA private key from PEM format
-	block, _ := pem.Decode([]byte(creds.PrivateKey))
-	if block == nil {
-		return "", fmt.Errorf("failed to decode PEM block from private key")
+// recordFCMSend records the outcome of a send on the message delivery and the test run delivery,
+// and emits message.sent or message.failed. A device whose token FCM or APNs reported as unregistered is
+// deactivated. Returns the webhook entries to publish once the caller's transaction has committed.
+func (s *Service) recordFCMSend(ctx context.Context, logger *common.Logger, queries sqlc.Querier, payload fcmSendPayload, sendErr error) ([]sqlc.Outbox, error) {
+	event := payload.messageEvent()
+	if sendErr == nil {
+		err := queries.MarkMessageDeliverySent(ctx, sqlc.MarkMessageDeliverySentParams{MessageID: payload.MessageID, DeviceID: payload.Device.DeviceID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark message delivery as SENT: %w", err)
+		}
+		if payload.Nonce != "" {
+			err = queries.MarkTestRunDeliverySent(ctx, sqlc.MarkTestRunDeliverySentParams{Nonce: payload.Nonce, DeviceID: payload.Device.DeviceID})
+			if err != nil {
+				return nil, fmt.Errorf("failed to mark test run delivery as SENT: %w", err)
+			}
+		}
+		entry, err := s.emitWebhookEvent(ctx, queries, webhookMessageSent, event)
+		if err != nil {
+			return nil, err
+		}
+		return []sqlc.Outbox{entry}, nil
 	}
 
-	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	reason := sendErr.Error()
+	err := queries.MarkMessageDeliverySendFailed(ctx, sqlc.MarkMessageDeliverySendFailedParams{
+		MessageID:     payload.MessageID,
+		DeviceID:      payload.Device.DeviceID,
+		FailureReason: pgtype.Text{String: reason, Valid: true},
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to parse private key: %w", err)
+		return nil, fmt.Errorf("failed to mark message delivery as SEND_FAILED: %w", err)
 	}
-
-	rsaPrivateKey, ok := privateKey.(*rsa.PrivateKey)
-	if !ok {
-		return "", fmt.Errorf("private key is not RSA")
+	if payload.Nonce != "" {
+		if err := s.recordTestRunSendFailure(ctx, logger, queries, payload.Nonce, payload.Device.DeviceID, reason); err != nil {
+			return nil, err
+		}
 	}
+	event.FailureReason = reason
+	entry, err := s.emitWebhookEvent(ctx, queries, webhookMessageFailed, event)
+	if err != nil {
+		return nil, err
+	}
+	entries := []sqlc.Outbox{entry}
 
-	// Create JWT claims
-	now := time.Now()
-	claims := jwt.MapClaims{
-		"iss":   creds.ClientEmail,
-		"scope": "https://www.googleapis.com/auth/firebase.messaging",
-		"aud":   creds.TokenURI,
-		"iat":   now.Unix(),
-		"exp":   now.Add(1 * time.Hour).Unix(),
+	if errors.Is(sendErr, errPushTokenUnregistered) {
+		invalidated, err := s.invalidateDeviceToken(ctx, logger, queries, payload.Device)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, invalidated...)
 	}
+	return entries, nil
+}
 
-	// Create and sign JWT
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	token.Header["kid"] = creds.PrivateKeyID
+// recordTestRunSendFailure marks the delivery to deviceID and the whole test run as SEND_FAILED,
+// so the e2e test can stop polling immediately
+func (s *Service) recordTestRunSendFailure(ctx context.Context, logger *common.Logger, queries sqlc.Querier, nonce, deviceID, reason string) error {
+	failureReason := pgtype.Text{String: reason, Valid: true}
 
-	jwtString, err := token.SignedString(rsaPrivateKey)
+	err := queries.MarkTestRunDeliverySendFailed(ctx, sqlc.MarkTestRunDeliverySendFailedParams{
+		Nonce:         nonce,
+		DeviceID:      deviceID,
+		FailureReason: failureReason,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to sign JWT: %w", err)
+		return fmt.Errorf("failed to mark test run delivery as SEND_FAILED: %w", err)
 	}
 
-	// Exchange JWT for access token
-	data := url.Values{}
-	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
-	data.Set("assertion", jwtString)
-
-	req, err := http.NewRequestWithContext(ctx, "POST", creds.TokenURI, strings.NewReader(data.Encode()))
+	err = queries.MarkTestRunSendFailed(ctx, sqlc.MarkTestRunSendFailedParams{
+		Nonce:         nonce,
+		FailureReason: failureReason,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create token request: %w", err)
+		return fmt.Errorf("failed to mark test run as SEND_FAILED: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	logger.Info(ctx, "Test run marked as SEND_FAILED: nonce=%s, device_id=%s, reason=%s", nonce, deviceID, reason)
+	return nil
+}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+// invalidateDeviceToken deactivates a device whose token FCM or APNs reported as unregistered, so it is not
+// sent to again until it registers a new token, and emits device.token_invalidated. Returns the
+// webhook entry to publish, if the device was deactivated.
+func (s *Service) invalidateDeviceToken(ctx context.Context, logger *common.Logger, queries sqlc.Querier, device fcmSendDevice) ([]sqlc.Outbox, error) {
+	deactivated, err := queries.DeactivateDeviceToken(ctx, sqlc.DeactivateDeviceTokenParams{
+		DeviceID: device.DeviceID,
+		FcmToken: device.Token,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to request access token: %w", err)
+		return nil, fmt.Errorf("failed to deactivate device with unregistered token: %w", err)
+	}
+	if deactivated == 0 {
+		// The device registered a new token since it was loaded
+		return nil, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to get access token: status=%d, body=%s", resp.StatusCode, string(body))
+	logger.Info(ctx, "Device deactivated, push token unregistered: user_id=%s, device_id=%s, token_type=%s", device.UserID, device.DeviceID, device.TokenType)
+	entry, err := s.emitWebhookEvent(ctx, queries, webhookDeviceTokenInvalidated, DeviceEventData{
+		UserID:   device.UserID,
+		DeviceID: device.DeviceID,
+		Platform: device.Platform,
+		AppID:    device.AppID,
+		Locale:   device.Locale,
+	})
+	if err != nil {
+		return nil, err
 	}
+	return []sqlc.Outbox{entry}, nil
+}
 
-	// Parse response
-	var tokenResponse struct {
-		AccessToken string `json:"access_token"`
-		TokenType   string `json:"token_type"`
-		ExpiresIn   int    `json:"expires_in"`
+// withSignedTokens returns a copy of data with a signed token added under each data key
+func withSignedTokens(data map[string]string, key []byte, tokens map[string]ackTokenClaims) (map[string]string, error) {
+	withTokens := make(map[string]string, len(data)+len(tokens))
+	for k, v := range data {
+		withTokens[k] = v
+	}
+	for dataKey, claims := range tokens {
+		token, err := signAckToken(key, claims)
+		if err != nil {
+			return nil, err
+		}
+		withTokens[dataKey] = token
 	}
+	return withTokens, nil
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-		return "", fmt.Errorf("failed to decode token response: %w", err)
+// parseMessageData converts the request's data object into FCM data (string values only)
+func parseMessageData(data json.RawMessage) map[string]string {
+	if len(data) == 0 {
+		return nil
 	}
 
-	return tokenResponse.AccessToken, nil
+	var dataMap map[string]string
+	if err := json.Unmarshal(data, &dataMap); err != nil {
+		// If data is not a map, treat it as a single string value
+		fmt.Printf("WARNING: Invalid JSON for 'data' field: %v. Raw data: %s\n", err, string(data))
+		dataMap = map[string]string{"data": string(data)}
+	}
+	return dataMap
 }
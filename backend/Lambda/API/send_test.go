@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+)
+
+// registerDevice registers a device through the handler.
+func registerDevice(t *testing.T, userID, deviceID, fcmToken, platform string) {
+	t.Helper()
+	expectStatus(t, invoke(t, testService.RegisterDeviceHandler, `{"user_id":"`+userID+`","device_id":"`+deviceID+
+		`","fcm_token":"`+fcmToken+`","platform":"`+platform+`"}`, nil), 200)
+}
+
+func TestSendMessageHandler(t *testing.T) {
+	requireDB(t)
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+	registerDevice(t, "user-1", "device-2", "token-2", "ios")
+	registerDevice(t, "user-2", "device-3", "token-3", "android")
+
+	response := invoke(t, testService.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"Hello","body":"World","data":{"key":"value"}}`, nil)
+	expectStatus(t, response, 200)
+
+	var body SendMessageResponse
+	decodeBody(t, response, &body)
+	if !body.OK || body.SentCount != 2 {
+		t.Fatalf("expected ok=true and sent_count=2, got %s", response.Body)
+	}
+
+	messages := testFCM.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 FCM messages, got %d", len(messages))
+	}
+	for _, message := range messages {
+		if message.ProjectID != "test-project" || message.Title != "Hello" || message.Body != "World" || message.Data["key"] != "value" {
+			t.Fatalf("unexpected FCM message: %+v", message)
+		}
+		if message.Token != "token-1" && message.Token != "token-2" {
+			t.Fatalf("message sent to another user's device: %+v", message)
+		}
+	}
+}
+
+func TestSendMessageHandlerNoDevices(t *testing.T) {
+	requireDB(t)
+
+	response := invoke(t, testService.SendMessageHandler, `{"user_id":"nobody","category":"system","title":"Hello","body":"World"}`, nil)
+	expectStatus(t, response, 200)
+
+	var body SendMessageResponse
+	decodeBody(t, response, &body)
+	if body.SentCount != 0 || len(testFCM.Messages()) != 0 {
+		t.Fatalf("expected nothing to be sent, got %s", response.Body)
+	}
+}
+
+func TestSendMessageHandlerCreatesTestRun(t *testing.T) {
+	db := requireDB(t)
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+
+	response := invoke(t, testService.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil)
+	expectStatus(t, response, 200)
+
+	testRun, err := sqlc.New(db).GetTestRunByNonce(context.Background(), "nonce-1")
+	if err != nil {
+		t.Fatalf("test run not created: %v", err)
+	}
+	if testRun.UserID != "user-1" || testRun.Status != "PENDING" {
+		t.Fatalf("unexpected test run: %+v", testRun)
+	}
+
+	deliveries, err := sqlc.New(db).ListTestRunDeliveries(context.Background(), "nonce-1")
+	if err != nil {
+		t.Fatalf("failed to list deliveries: %v", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].DeviceID != "device-1" || deliveries[0].Status != "SENT" || !deliveries[0].SentAt.Valid {
+		t.Fatalf("unexpected deliveries: %+v", deliveries)
+	}
+
+	// The nonce cannot be reused
+	response = invoke(t, testService.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil)
+	expectStatus(t, response, 409)
+}
+
+func TestSendMessageHandlerFCMError(t *testing.T) {
+	requireDB(t)
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+	testFCM.FailToken("token-1", 503)
+
+	response := invoke(t, testService.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil)
+	expectStatus(t, response, 500)
+}
+
+func TestSendMessageHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `not json`},
+		{"missing title", `{"user_id":"user-1","category":"system","body":"World"}`},
+		{"missing user_id", `{"category":"system","title":"Hello","body":"World"}`},
+		{"missing category", `{"user_id":"user-1","title":"Hello","body":"World"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, invoke(t, testService.SendMessageHandler, tt.body, nil), 400)
+		})
+	}
+}
+
+func TestSendMessageHandlerDatabaseUnavailable(t *testing.T) {
+	withUnreachableDatabase(t)
+
+	response := invoke(t, testService.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil)
+	expectStatus(t, response, 500)
+}
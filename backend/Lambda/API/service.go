@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fcm-tutorial/credentials"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+)
+
+// Service implements the API handlers. All external dependencies are injected,
+// so the handler logic can be unit tested with in-memory fakes instead of
+// Postgres, FCM and Secrets Manager.
+type Service struct {
+	Store   Store                      // Database access
+	Sender  FCMSender                  // Delivers push notifications to FCM registration tokens
+	APNs    APNsSender                 // Delivers push notifications to APNs device tokens, see push.go
+	Secrets credentials.SecretProvider // Holds the FCM service account JSON and APNs credentials of each app
+	Apps    *common.AppRegistry        // Maps app IDs to the secret holding their credentials
+	Clock   Clock                      // Current time
+	Metrics io.Writer                  // Receives CloudWatch EMF metrics (stdout in Lambda)
+	Probe   ProbeConfig                // Used by ProbeHandler only
+
+	WebhookClient       *http.Client // Posts webhook deliveries, see newWebhookClient
+	WebhookAllowPrivate bool         // Lets subscriptions target loopback and private addresses, for local development
+
+	AckTokenSecretID string // Secret holding the key that signs ack tokens, see acktoken.go
+	DefaultLocale    string // Template locale for devices without a template in their own locale, see templates.go
+}
+
+// newServiceFromEnv creates the service used in production.
+// See common.GetDBConnection, credentials.DefaultSecretProvider, common.LoadAppRegistry and loadProbeConfig
+// for the environment variables involved. ACK_TOKEN_SECRET_ARN is the ID of the ack token signing key,
+// DEFAULT_LOCALE (default "en") the fallback locale of message templates.
+// WEBHOOK_ALLOW_PRIVATE_ADDRESSES=true lets webhooks target loopback and private addresses.
+func newServiceFromEnv(ctx context.Context) (*Service, error) {
+	secrets, err := credentials.DefaultSecretProvider(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret provider: %w", err)
+	}
+
+	apps, err := common.LoadAppRegistry()
+	if err != nil {
+		return nil, fmt.Errorf("FCM app configuration is invalid: %w", err)
+	}
+
+	probe, err := loadProbeConfig()
+	if err != nil {
+		return nil, fmt.Errorf("probe configuration is invalid: %w", err)
+	}
+
+	ackTokenSecretID := os.Getenv("ACK_TOKEN_SECRET_ARN")
+	if ackTokenSecretID == "" {
+		return nil, fmt.Errorf("ACK_TOKEN_SECRET_ARN is not set")
+	}
+
+	defaultLocale := defaultTemplateLocale
+	if locale := os.Getenv("DEFAULT_LOCALE"); locale != "" {
+		defaultLocale = locale
+	}
+	defaultLocale, err = normalizeLocale(defaultLocale)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_LOCALE: %w", err)
+	}
+
+	webhookAllowPrivate := false
+	if value := os.Getenv("WEBHOOK_ALLOW_PRIVATE_ADDRESSES"); value != "" {
+		webhookAllowPrivate, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_ALLOW_PRIVATE_ADDRESSES: %w", err)
+		}
+	}
+
+	clock := systemClock{}
+	return &Service{
+		Store:   poolStore{},
+		Sender:  newHTTPFCMSender(fcmAPIBaseURL(), clock),
+		APNs:    newHTTPAPNsSender(apnsAPIBaseURL(), clock),
+		Secrets: secrets,
+		Apps:    apps,
+		Clock:   clock,
+		Metrics: os.Stdout,
+		Probe:   probe,
+
+		WebhookClient:       newWebhookClient(webhookAllowPrivate),
+		WebhookAllowPrivate: webhookAllowPrivate,
+
+		AckTokenSecretID: ackTokenSecretID,
+		DefaultLocale:    defaultLocale,
+	}, nil
+}
+
+// Store gives handlers access to the database.
+type Store interface {
+	// Queries returns the queries to use for one request
+	Queries(ctx context.Context) (sqlc.Querier, error)
+	// InTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise
+	InTx(ctx context.Context, fn func(queries sqlc.Querier) error) error
+	// Listen subscribes to a Postgres NOTIFY channel. The subscription must be closed
+	Listen(ctx context.Context, channel string) (Subscription, error)
+	// ListSegmentDevices returns the active devices matching a segment filter of the first userLimit
+	// users after afterUserID, ordered by user_id and device_id. sqlc cannot generate dynamic filters.
+	ListSegmentDevices(ctx context.Context, filter segmentFilter, afterUserID string, userLimit int) ([]sqlc.ListActiveDevicesByPlatformsRow, error)
+	// CountSegment counts the active devices matching a segment filter
+	CountSegment(ctx context.Context, filter segmentFilter) (segmentSize, error)
+}
+
+// Subscription receives the notifications sent to a channel after Listen returned.
+type Subscription interface {
+	// Next blocks until the next notification and returns its payload
+	Next(ctx context.Context) (string, error)
+	Close()
+}
+
+// poolStore runs queries on the process-wide pool from common.GetDBConnection.
+// The pool is looked up on every request, so it can be rebuilt after a failed health check.
+type poolStore struct{}
+
+func (poolStore) Queries(ctx context.Context) (sqlc.Querier, error) {
+	db, err := common.GetDBConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sqlc.New(db), nil
+}
+
+func (poolStore) InTx(ctx context.Context, fn func(queries sqlc.Querier) error) error {
+	db, err := common.GetDBConnection(ctx)
+	if err != nil {
+		return err
+	}
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return fn(sqlc.New(db).WithTx(tx))
+	})
+}
+
+// Listen opens a dedicated connection for the lifetime of the subscription, since notifications
+// are delivered to the session that ran LISTEN. Holding a pool connection instead would leave
+// the handler's own queries a single connection with the default pool size.
+func (poolStore) Listen(ctx context.Context, channel string) (Subscription, error) {
+	conn, err := common.ConnectDedicated(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		closeListenConn(conn)
+		return nil, err
+	}
+	return &poolSubscription{conn: conn}, nil
+}
+
+func (poolStore) ListSegmentDevices(ctx context.Context, filter segmentFilter, afterUserID string, userLimit int) ([]sqlc.ListActiveDevicesByPlatformsRow, error) {
+	db, err := common.GetDBConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, args := filter.devicesQuery(afterUserID, userLimit)
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	// By name, so the hand-written query does not depend on the column order of the generated row
+	return pgx.CollectRows(rows, pgx.RowToStructByName[sqlc.ListActiveDevicesByPlatformsRow])
+}
+
+func (poolStore) CountSegment(ctx context.Context, filter segmentFilter) (segmentSize, error) {
+	db, err := common.GetDBConnection(ctx)
+	if err != nil {
+		return segmentSize{}, err
+	}
+	query, args := filter.sizeQuery()
+	var size segmentSize
+	err = db.QueryRow(ctx, query, args...).Scan(&size.Devices, &size.Users, &size.Android, &size.IOS)
+	return size, err
+}
+
+type poolSubscription struct {
+	conn *pgx.Conn
+}
+
+func (s *poolSubscription) Next(ctx context.Context) (string, error) {
+	notification, err := s.conn.WaitForNotification(ctx)
+	if err != nil {
+		return "", err
+	}
+	return notification.Payload, nil
+}
+
+// Close closes the subscription's connection, which ends the LISTEN session.
+func (s *poolSubscription) Close() {
+	closeListenConn(s.conn)
+}
+
+func closeListenConn(conn *pgx.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), listenCloseTimeout)
+	defer cancel()
+	conn.Close(ctx)
+}
+
+// listenCloseTimeout bounds closing a subscription's connection
+const listenCloseTimeout = 2 * time.Second
+
+// Clock returns the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
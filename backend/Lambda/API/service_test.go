@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+)
+
+// testServiceFakes are the in-memory dependencies of a Service created by newFakeService.
+type testServiceFakes struct {
+	clock   *fakeClock
+	querier *fakeQuerier
+	store   *fakeStore
+	sender  *fakeSender
+	secrets fakeSecretProvider
+}
+
+// newFakeService returns a Service backed entirely by fakes, with two apps:
+// "default" (project "default-project") and "shop" (project "shop-project"),
+// signing ack tokens with testAckTokenKey and falling back to "en" templates.
+func newFakeService(t *testing.T) (*Service, *testServiceFakes) {
+	t.Helper()
+
+	clock := newFakeClock()
+	fakes := &testServiceFakes{
+		clock:   clock,
+		querier: newFakeQuerier(clock),
+		sender:  newFakeSender(),
+		secrets: fakeSecretProvider{},
+	}
+	fakes.store = &fakeStore{querier: fakes.querier}
+
+	for secretID, projectID := range map[string]string{"default-secret": "default-project", "shop-secret": "shop-project"} {
+		creds, err := json.Marshal(common.FCMCredentials{
+			ProjectID:   projectID,
+			PrivateKey:  "unused",
+			ClientEmail: "fcm@" + projectID + ".iam.gserviceaccount.com",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fakes.secrets[secretID] = string(creds)
+	}
+
+	fakes.secrets["ack-token-key"] = testAckTokenKey
+
+	service := &Service{
+		Store:   fakes.store,
+		Sender:  fakes.sender,
+		Secrets: fakes.secrets,
+		Apps:    common.NewAppRegistry(map[string]string{"default": "default-secret", "shop": "shop-secret"}),
+		Clock:   clock,
+
+		WebhookClient:       testWebhookClient(true),
+		WebhookAllowPrivate: true,
+
+		AckTokenSecretID: "ack-token-key",
+		DefaultLocale:    "en",
+	}
+	return service, fakes
+}
+
+func TestServiceRegisterDevice(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_id":"shop"}`, nil), 200)
+
+	device, err := fakes.querier.GetDeviceByDeviceID(t.Context(), "device-1")
+	if err != nil {
+		t.Fatalf("device not stored: %v", err)
+	}
+	if device.AppID != "shop" || !device.UpdatedAt.Time.Equal(fakes.clock.Now()) {
+		t.Fatalf("unexpected device: %+v", device)
+	}
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-2","device_id":"device-1","fcm_token":"token-2","platform":"android"}`, nil), 409)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios","app_id":"news"}`, nil), 400)
+}
+
+func TestServiceRegisterDeviceDatabaseErrors(t *testing.T) {
+	service, fakes := newFakeService(t)
+	body := `{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`
+
+	fakes.store.connErr = errors.New("connection refused")
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler, body, nil), 500)
+
+	fakes.store.connErr = nil
+	fakes.querier.err = errors.New("query failed")
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler, body, nil), 500)
+}
+
+func TestServiceSendMessageUsesAppCredentials(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios","app_id":"shop"}`, nil), 200)
+
+	response := invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"Hello","body":"World","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil)
+	expectStatus(t, response, 200)
+
+	sent := fakes.sender.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(sent))
+	}
+	projects := map[string]string{}
+	for _, message := range sent {
+		projects[message.Token] = message.ProjectID
+		if message.Data["nonce"] != "nonce-1" {
+			t.Fatalf("data not forwarded: %+v", message)
+		}
+	}
+	if projects["token-1"] != "default-project" || projects["token-2"] != "shop-project" {
+		t.Fatalf("messages sent with wrong credentials: %v", projects)
+	}
+
+	testRun, err := fakes.querier.GetTestRunByNonce(t.Context(), "nonce-1")
+	if err != nil {
+		t.Fatalf("test run not created: %v", err)
+	}
+	if testRun.Status != "PENDING" || !testRun.CreatedAt.Time.Equal(fakes.clock.Now()) {
+		t.Fatalf("unexpected test run: %+v", testRun)
+	}
+}
+
+func TestServiceSendMessageErrors(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","app_id":"shop"}`, nil), 200)
+	body := `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`
+
+	// Once the message is recorded, failed sends are left to the relay instead of failing the request
+	expectRetried := func() {
+		t.Helper()
+		response := invoke(t, service.SendMessageHandler, body, nil)
+		expectStatus(t, response, 200)
+		var sendResponse SendMessageResponse
+		decodeBody(t, response, &sendResponse)
+		if sendResponse.SentCount != 0 || sendResponse.RetriedCount != 1 {
+			t.Fatalf("expected the send to be retried, got %s", response.Body)
+		}
+	}
+	fakes.sender.FailToken("token-1", errors.New("FCM unavailable"))
+	expectRetried()
+
+	delete(fakes.secrets, "shop-secret")
+	expectRetried()
+
+	fakes.store.connErr = errors.New("connection refused")
+	expectStatus(t, invoke(t, service.SendMessageHandler, body, nil), 500)
+}
+
+func TestServiceAckAndStatus(t *testing.T) {
+	service, fakes := newFakeService(t)
+	status := map[string]string{"nonce": "nonce-1"}
+
+	expectStatus(t, invoke(t, service.TestStatusHandler, "", status), 404)
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1"}), nil), 404)
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 200)
+
+	fakes.clock.Advance(3 * time.Second)
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1"}), nil), 200)
+
+	response := invoke(t, service.TestStatusHandler, "", status)
+	expectStatus(t, response, 200)
+
+	var statusResponse StatusResponse
+	decodeBody(t, response, &statusResponse)
+	if statusResponse.Status != "ACKED" || statusResponse.AckedAt == nil || !statusResponse.AckedAt.Equal(fakes.clock.Now()) {
+		t.Fatalf("unexpected status: %s", response.Body)
+	}
+
+	fakes.querier.err = errors.New("query failed")
+	expectStatus(t, invoke(t, service.TestStatusHandler, "", status), 500)
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1"}), nil), 500)
+}
+
+func TestHTTPFCMSenderCachesAccessToken(t *testing.T) {
+	testFCM.Reset()
+
+	credsJSON, err := testFCM.credentialsJSON("cache-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var creds common.FCMCredentials
+	if err := json.Unmarshal([]byte(credsJSON), &creds); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	sender := newHTTPFCMSender(testFCM.URL(), clock)
+	send := func() {
+		t.Helper()
+		if err := sender.Send(t.Context(), &creds, PushMessage{Token: "token-1", Title: "Hello", Body: "World"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	send()
+	send()
+	if got := testFCM.TokenRequests(); got != 1 {
+		t.Fatalf("expected 1 token request, got %d", got)
+	}
+
+	// The fake issues tokens valid for one hour; they are refreshed shortly before expiry
+	clock.Advance(time.Hour - accessTokenRefreshMargin)
+	send()
+	if got := testFCM.TokenRequests(); got != 2 {
+		t.Fatalf("expected token to be refreshed, got %d token requests", got)
+	}
+
+	if messages := testFCM.Messages(); len(messages) != 3 || messages[0].ProjectID != "cache-project" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+}
+
+func TestHTTPFCMSenderUnregisteredToken(t *testing.T) {
+	testFCM.Reset()
+
+	credsJSON, err := testFCM.credentialsJSON("unregistered-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var creds common.FCMCredentials
+	if err := json.Unmarshal([]byte(credsJSON), &creds); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := newHTTPFCMSender(testFCM.URL(), newFakeClock())
+	testFCM.FailToken("token-1", http.StatusNotFound)
+	testFCM.FailToken("token-2", http.StatusServiceUnavailable)
+	testFCM.FailToken("token-3", http.StatusBadRequest)
+	testFCM.FailToken("token-4", http.StatusTooManyRequests)
+
+	err = sender.Send(t.Context(), &creds, PushMessage{Token: "token-1", Title: "Hello", Body: "World"})
+	if !errors.Is(err, errPushTokenUnregistered) {
+		t.Fatalf("expected errPushTokenUnregistered, got %v", err)
+	}
+	err = sender.Send(t.Context(), &creds, PushMessage{Token: "token-3", Title: "Hello", Body: "World"})
+	if !errors.Is(err, errPushMessageRejected) {
+		t.Fatalf("expected errPushMessageRejected, got %v", err)
+	}
+	for _, token := range []string{"token-2", "token-4"} {
+		err = sender.Send(t.Context(), &creds, PushMessage{Token: token, Title: "Hello", Body: "World"})
+		if err == nil || isFinalPushError(err) {
+			t.Fatalf("expected a transient error for %s, got %v", token, err)
+		}
+	}
+}
+
+func TestServiceAckMetadataAndLatency(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"ios"}`, nil), 200)
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 200)
+
+	// The device receives sent_time with the message and echoes it back
+	sentTime := fakes.sender.Sent()[0].Data[sentTimeDataKey]
+	if sentTime == "" {
+		t.Fatal("e2e test message has no sent_time")
+	}
+	receivedAt := fakes.clock.Now().Add(1500 * time.Millisecond)
+	fakes.clock.Advance(2 * time.Second)
+
+	ack := ackBody(t, service, TestAckRequest{
+		Nonce:      "nonce-1",
+		DeviceId:   "device-1",
+		AppVersion: "1.2.3",
+		OsVersion:  "iOS 18.1",
+		ReceivedAt: receivedAt.Format(time.RFC3339Nano),
+		SentTime:   sentTime,
+	})
+	expectStatus(t, invoke(t, service.TestAckHandler, ack, nil), 200)
+
+	status := testRunStatus(t, service)
+	if status.DeviceID != "device-1" || status.Platform != "ios" || status.AppVersion != "1.2.3" || status.OSVersion != "iOS 18.1" {
+		t.Fatalf("ack metadata not returned: %+v", status)
+	}
+	if status.SendToAckMs == nil || *status.SendToAckMs != 2000 {
+		t.Fatalf("expected send_to_ack_ms=2000, got %v", status.SendToAckMs)
+	}
+	if status.ReceiveToAckMs == nil || *status.ReceiveToAckMs != 500 {
+		t.Fatalf("expected receive_to_ack_ms=500, got %v", status.ReceiveToAckMs)
+	}
+}
+
+func TestServiceAckInvalidTimestamps(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	expectStatus(t, invoke(t, service.TestAckHandler, `{"nonce":"nonce-1","received_at":"yesterday"}`, nil), 400)
+	expectStatus(t, invoke(t, service.TestAckHandler, `{"nonce":"nonce-1","sent_time":"1700000000"}`, nil), 400)
+}
@@ -8,20 +8,189 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type Broadcast struct {
+	BroadcastID     string             `json:"broadcast_id"`
+	Message         []byte             `json:"message"`
+	BatchSize       int32              `json:"batch_size"`
+	Status          string             `json:"status"`
+	FailureReason   pgtype.Text        `json:"failure_reason"`
+	TotalDevices    int32              `json:"total_devices"`
+	LastDeviceID    int32              `json:"last_device_id"`
+	SentCount       int32              `json:"sent_count"`
+	FailedCount     int32              `json:"failed_count"`
+	SuppressedCount int32              `json:"suppressed_count"`
+	LeaseExpiresAt  pgtype.Timestamptz `json:"lease_expires_at"`
+	CreatedAt       pgtype.Timestamptz `json:"created_at"`
+	UpdatedAt       pgtype.Timestamptz `json:"updated_at"`
+	CompletedAt     pgtype.Timestamptz `json:"completed_at"`
+}
+
+type Campaign struct {
+	CampaignID     string             `json:"campaign_id"`
+	Description    string             `json:"description"`
+	Category       string             `json:"category"`
+	HoldoutPercent int32              `json:"holdout_percent"`
+	CreatedAt      pgtype.Timestamptz `json:"created_at"`
+	UpdatedAt      pgtype.Timestamptz `json:"updated_at"`
+}
+
+type CampaignAssignment struct {
+	CampaignID string             `json:"campaign_id"`
+	UserID     string             `json:"user_id"`
+	Variant    pgtype.Text        `json:"variant"`
+	AssignedAt pgtype.Timestamptz `json:"assigned_at"`
+}
+
+type CampaignVariant struct {
+	CampaignID string `json:"campaign_id"`
+	Variant    string `json:"variant"`
+	Weight     int32  `json:"weight"`
+	Title      string `json:"title"`
+	Body       string `json:"body"`
+	Data       []byte `json:"data"`
+}
+
 type Device struct {
-	ID        int32              `json:"id"`
+	ID          int32              `json:"id"`
+	UserID      string             `json:"user_id"`
+	DeviceID    string             `json:"device_id"`
+	Platform    string             `json:"platform"`
+	FcmToken    string             `json:"fcm_token"`
+	IsActive    bool               `json:"is_active"`
+	UpdatedAt   pgtype.Timestamptz `json:"updated_at"`
+	AppID       string             `json:"app_id"`
+	Locale      pgtype.Text        `json:"locale"`
+	AppVersion  pgtype.Text        `json:"app_version"`
+	OsVersion   pgtype.Text        `json:"os_version"`
+	DeviceModel pgtype.Text        `json:"device_model"`
+	Timezone    pgtype.Text        `json:"timezone"`
+	SdkVersion  pgtype.Text        `json:"sdk_version"`
+	TokenType   string             `json:"token_type"`
+}
+
+type Message struct {
+	MessageID string             `json:"message_id"`
+	UserID    string             `json:"user_id"`
+	CreatedAt pgtype.Timestamptz `json:"created_at"`
+}
+
+type MessageDelivery struct {
+	MessageID     string             `json:"message_id"`
+	DeviceID      string             `json:"device_id"`
+	Platform      string             `json:"platform"`
+	AppID         string             `json:"app_id"`
+	Status        string             `json:"status"`
+	FailureReason pgtype.Text        `json:"failure_reason"`
+	SentAt        pgtype.Timestamptz `json:"sent_at"`
+	DeliveredAt   pgtype.Timestamptz `json:"delivered_at"`
+	OpenedAt      pgtype.Timestamptz `json:"opened_at"`
+	DismissedAt   pgtype.Timestamptz `json:"dismissed_at"`
+	CampaignID    pgtype.Text        `json:"campaign_id"`
+	Variant       pgtype.Text        `json:"variant"`
+}
+
+type NotificationCategory struct {
+	Category       string `json:"category"`
+	Description    string `json:"description"`
+	Mandatory      bool   `json:"mandatory"`
+	DefaultEnabled bool   `json:"default_enabled"`
+}
+
+type NotificationPreference struct {
 	UserID    string             `json:"user_id"`
 	DeviceID  string             `json:"device_id"`
-	Platform  string             `json:"platform"`
-	FcmToken  string             `json:"fcm_token"`
-	IsActive  bool               `json:"is_active"`
+	Category  string             `json:"category"`
+	Enabled   bool               `json:"enabled"`
 	UpdatedAt pgtype.Timestamptz `json:"updated_at"`
 }
 
+type Outbox struct {
+	OutboxID    int64              `json:"outbox_id"`
+	Kind        string             `json:"kind"`
+	Payload     []byte             `json:"payload"`
+	Attempts    int32              `json:"attempts"`
+	AvailableAt pgtype.Timestamptz `json:"available_at"`
+	LastError   pgtype.Text        `json:"last_error"`
+	CreatedAt   pgtype.Timestamptz `json:"created_at"`
+}
+
+type Segment struct {
+	SegmentID   string             `json:"segment_id"`
+	Description string             `json:"description"`
+	Expression  string             `json:"expression"`
+	CreatedAt   pgtype.Timestamptz `json:"created_at"`
+	UpdatedAt   pgtype.Timestamptz `json:"updated_at"`
+}
+
+type Template struct {
+	TemplateKey string             `json:"template_key"`
+	Locale      string             `json:"locale"`
+	Title       string             `json:"title"`
+	Body        string             `json:"body"`
+	DefaultData []byte             `json:"default_data"`
+	CreatedAt   pgtype.Timestamptz `json:"created_at"`
+	UpdatedAt   pgtype.Timestamptz `json:"updated_at"`
+}
+
 type TestRun struct {
-	Nonce     string             `json:"nonce"`
-	UserID    string             `json:"user_id"`
-	Status    string             `json:"status"`
-	CreatedAt pgtype.Timestamptz `json:"created_at"`
-	AckedAt   pgtype.Timestamptz `json:"acked_at"`
+	Nonce         string             `json:"nonce"`
+	UserID        string             `json:"user_id"`
+	Status        string             `json:"status"`
+	CreatedAt     pgtype.Timestamptz `json:"created_at"`
+	AckedAt       pgtype.Timestamptz `json:"acked_at"`
+	ExpiresAt     pgtype.Timestamptz `json:"expires_at"`
+	FailureReason pgtype.Text        `json:"failure_reason"`
+	AckDeviceID   pgtype.Text        `json:"ack_device_id"`
+	AckPlatform   pgtype.Text        `json:"ack_platform"`
+	AckAppVersion pgtype.Text        `json:"ack_app_version"`
+	AckOsVersion  pgtype.Text        `json:"ack_os_version"`
+	SentAt        pgtype.Timestamptz `json:"sent_at"`
+	ReceivedAt    pgtype.Timestamptz `json:"received_at"`
+}
+
+type TestRunDelivery struct {
+	Nonce         string             `json:"nonce"`
+	DeviceID      string             `json:"device_id"`
+	Platform      string             `json:"platform"`
+	AppID         string             `json:"app_id"`
+	Status        string             `json:"status"`
+	FailureReason pgtype.Text        `json:"failure_reason"`
+	SentAt        pgtype.Timestamptz `json:"sent_at"`
+	AckedAt       pgtype.Timestamptz `json:"acked_at"`
+	AppVersion    pgtype.Text        `json:"app_version"`
+	OsVersion     pgtype.Text        `json:"os_version"`
+	ReceivedAt    pgtype.Timestamptz `json:"received_at"`
+}
+
+type WebhookDeadLetter struct {
+	DeliveryID     int64              `json:"delivery_id"`
+	SubscriptionID string             `json:"subscription_id"`
+	EventID        string             `json:"event_id"`
+	EventType      string             `json:"event_type"`
+	Payload        []byte             `json:"payload"`
+	Attempts       int32              `json:"attempts"`
+	LastError      string             `json:"last_error"`
+	CreatedAt      pgtype.Timestamptz `json:"created_at"`
+	FailedAt       pgtype.Timestamptz `json:"failed_at"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID     int64              `json:"delivery_id"`
+	SubscriptionID string             `json:"subscription_id"`
+	EventID        string             `json:"event_id"`
+	EventType      string             `json:"event_type"`
+	Payload        []byte             `json:"payload"`
+	Attempts       int32              `json:"attempts"`
+	NextAttemptAt  pgtype.Timestamptz `json:"next_attempt_at"`
+	LastError      pgtype.Text        `json:"last_error"`
+	CreatedAt      pgtype.Timestamptz `json:"created_at"`
+}
+
+type WebhookSubscription struct {
+	SubscriptionID string             `json:"subscription_id"`
+	Url            string             `json:"url"`
+	EventTypes     []string           `json:"event_types"`
+	Secret         string             `json:"secret"`
+	Description    string             `json:"description"`
+	CreatedAt      pgtype.Timestamptz `json:"created_at"`
 }
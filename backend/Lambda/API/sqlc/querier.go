@@ -6,15 +6,111 @@ package sqlc
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type Querier interface {
-	AckTestRun(ctx context.Context, nonce string) (TestRun, error)
-	CreateTestRun(ctx context.Context, arg CreateTestRunParams) error
+	AckTestRun(ctx context.Context, arg AckTestRunParams) (TestRun, error)
+	AckTestRunDelivery(ctx context.Context, arg AckTestRunDeliveryParams) (TestRunDelivery, error)
+	// Records a batch whose sends are enqueued in the same transaction and extends the lease, or completes
+	// the broadcast. The broadcast must still be at previous_device_id, so each batch is recorded once.
+	// Returns no rows otherwise.
+	CheckpointBroadcast(ctx context.Context, arg CheckpointBroadcastParams) (Broadcast, error)
+	// Takes the lease of the oldest RUNNING broadcast that no invocation holds, or of the given one.
+	// Returns no rows if there is none.
+	ClaimBroadcast(ctx context.Context, arg ClaimBroadcastParams) (Broadcast, error)
+	// Takes available entries by moving available_at to the end of a lease, so concurrent invocations
+	// skip them. An entry whose invocation stops before publishing it is taken again after the lease.
+	ClaimOutboxEntries(ctx context.Context, arg ClaimOutboxEntriesParams) ([]Outbox, error)
+	// Takes due deliveries by moving next_attempt_at to the end of a lease, so concurrent invocations
+	// skip them. A delivery whose invocation stops before recording the attempt is retried after the lease.
+	ClaimWebhookDeliveries(ctx context.Context, arg ClaimWebhookDeliveriesParams) ([]ClaimWebhookDeliveriesRow, error)
+	// Users by variant; the holdout group has a NULL variant
+	CountCampaignAssignments(ctx context.Context, campaignID string) ([]CountCampaignAssignmentsRow, error)
+	// total_devices counts the devices the broadcast targets now; devices registered later are included
+	CreateBroadcast(ctx context.Context, arg CreateBroadcastParams) (Broadcast, error)
+	CreateCampaignVariant(ctx context.Context, arg CreateCampaignVariantParams) error
+	CreateMessage(ctx context.Context, arg CreateMessageParams) error
+	CreateMessageDelivery(ctx context.Context, arg CreateMessageDeliveryParams) error
+	CreateNotificationPreference(ctx context.Context, arg CreateNotificationPreferenceParams) error
+	CreateOutboxEntry(ctx context.Context, arg CreateOutboxEntryParams) (Outbox, error)
+	CreateTestRun(ctx context.Context, arg CreateTestRunParams) (int64, error)
+	CreateTestRunDelivery(ctx context.Context, arg CreateTestRunDeliveryParams) error
+	CreateWebhookSubscription(ctx context.Context, arg CreateWebhookSubscriptionParams) (WebhookSubscription, error)
+	// Only if the device still has the token: a token registered since the send stays active
+	DeactivateDeviceToken(ctx context.Context, arg DeactivateDeviceTokenParams) (int64, error)
+	// Moves a delivery to webhook_dead_letters after its last failed attempt
+	DeadLetterWebhookDelivery(ctx context.Context, arg DeadLetterWebhookDeliveryParams) (int64, error)
+	// Variants and assignments are deleted with the campaign; deliveries keep their campaign_id and variant
+	DeleteCampaign(ctx context.Context, campaignID string) (int64, error)
+	DeleteCampaignVariants(ctx context.Context, campaignID string) error
+	DeleteNotificationPreferences(ctx context.Context, userID string) error
+	// Returns 0 if another invocation published the entry first
+	DeleteOutboxEntry(ctx context.Context, outboxID int64) (int64, error)
+	DeleteSegment(ctx context.Context, segmentID string) (int64, error)
+	DeleteTemplate(ctx context.Context, arg DeleteTemplateParams) (int64, error)
+	DeleteWebhookDelivery(ctx context.Context, deliveryID int64) error
+	// Pending deliveries and dead letters are deleted with the subscription
+	DeleteWebhookSubscription(ctx context.Context, subscriptionID string) (int64, error)
+	// One delivery per subscription to the event type; returns the number of subscriptions
+	EnqueueWebhookEvent(ctx context.Context, arg EnqueueWebhookEventParams) (int64, error)
+	ExpirePendingTestRuns(ctx context.Context) (int64, error)
+	ExpireTestRun(ctx context.Context, nonce string) (TestRun, error)
+	FailBroadcast(ctx context.Context, arg FailBroadcastParams) (Broadcast, error)
+	GetBroadcast(ctx context.Context, broadcastID string) (Broadcast, error)
+	GetCampaign(ctx context.Context, campaignID string) (Campaign, error)
+	// Deliveries and receipts by variant. opened_users counts users who opened the message on any device.
+	GetCampaignDeliveryStats(ctx context.Context, campaignID string) ([]GetCampaignDeliveryStatsRow, error)
 	GetDeviceByDeviceID(ctx context.Context, deviceID string) (GetDeviceByDeviceIDRow, error)
+	GetMessageDelivery(ctx context.Context, arg GetMessageDeliveryParams) (MessageDelivery, error)
+	GetNotificationCategory(ctx context.Context, category string) (NotificationCategory, error)
+	GetSegment(ctx context.Context, segmentID string) (Segment, error)
+	GetTemplate(ctx context.Context, arg GetTemplateParams) (Template, error)
 	GetTestRunByNonce(ctx context.Context, nonce string) (TestRun, error)
+	// Ack latency is measured like TestRunLatency.SendToAckMs; percentiles are 0 without ACKED runs
+	GetTestRunStats(ctx context.Context, arg GetTestRunStatsParams) (GetTestRunStatsRow, error)
+	GetWebhookSubscription(ctx context.Context, subscriptionID string) (WebhookSubscription, error)
 	ListActiveDevicesByPlatforms(ctx context.Context, userID string) ([]ListActiveDevicesByPlatformsRow, error)
+	// Active devices after a broadcast's checkpoint, in id order
+	ListBroadcastDevices(ctx context.Context, arg ListBroadcastDevicesParams) ([]ListBroadcastDevicesRow, error)
+	ListBroadcasts(ctx context.Context, limitCount int32) ([]Broadcast, error)
+	// Variants of the campaign, or of all campaigns without campaign_id
+	ListCampaignVariants(ctx context.Context, campaignID pgtype.Text) ([]CampaignVariant, error)
+	ListCampaigns(ctx context.Context) ([]Campaign, error)
+	// Oldest registration first; the cursor is the id of the last device of the previous page
+	ListDevices(ctx context.Context, arg ListDevicesParams) ([]ListDevicesRow, error)
+	ListNotificationCategories(ctx context.Context) ([]NotificationCategory, error)
+	ListNotificationPreferences(ctx context.Context, userID string) ([]NotificationPreference, error)
+	ListSegments(ctx context.Context) ([]Segment, error)
+	ListTemplates(ctx context.Context, templateKey pgtype.Text) ([]Template, error)
+	ListTestRunDeliveries(ctx context.Context, nonce string) ([]TestRunDelivery, error)
+	// Newest first; the cursor is the (created_at, nonce) of the last run of the previous page
+	ListTestRuns(ctx context.Context, arg ListTestRunsParams) ([]TestRun, error)
+	// Newest first
+	ListWebhookDeadLetters(ctx context.Context, arg ListWebhookDeadLettersParams) ([]WebhookDeadLetter, error)
+	ListWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error)
+	MarkMessageDeliverySendFailed(ctx context.Context, arg MarkMessageDeliverySendFailedParams) error
+	MarkMessageDeliverySent(ctx context.Context, arg MarkMessageDeliverySentParams) error
+	MarkTestRunDeliverySendFailed(ctx context.Context, arg MarkTestRunDeliverySendFailedParams) error
+	// A device may ack before the send returns; its delivery then stays ACKED
+	MarkTestRunDeliverySent(ctx context.Context, arg MarkTestRunDeliverySentParams) error
+	MarkTestRunSendFailed(ctx context.Context, arg MarkTestRunSendFailedParams) error
+	// Counts the sends of a checkpointed batch that were published; sends left to the relay are not counted
+	RecordBroadcastSends(ctx context.Context, arg RecordBroadcastSendsParams) (Broadcast, error)
+	// Each event keeps the time it was first reported; opened and dismissed imply delivered.
+	// A receipt may arrive before the send returns, so PENDING deliveries accept it too.
+	RecordMessageReceipt(ctx context.Context, arg RecordMessageReceiptParams) (MessageDelivery, error)
+	// Gives up a lease, so the next invocation can resume the broadcast without waiting for it to expire
+	ReleaseBroadcast(ctx context.Context, arg ReleaseBroadcastParams) error
+	RetryOutboxEntry(ctx context.Context, arg RetryOutboxEntryParams) error
+	RetryWebhookDelivery(ctx context.Context, arg RetryWebhookDeliveryParams) error
+	UpsertCampaign(ctx context.Context, arg UpsertCampaignParams) (Campaign, error)
+	// Keeps the time of the first assignment. The variant only changes if the campaign's variants were replaced.
+	UpsertCampaignAssignment(ctx context.Context, arg UpsertCampaignAssignmentParams) error
 	UpsertDevice(ctx context.Context, arg UpsertDeviceParams) error
+	UpsertSegment(ctx context.Context, arg UpsertSegmentParams) (Segment, error)
+	UpsertTemplate(ctx context.Context, arg UpsertTemplateParams) (Template, error)
 }
 
 var _ Querier = (*Queries)(nil)
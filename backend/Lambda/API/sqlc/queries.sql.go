@@ -13,13 +13,33 @@ import (
 
 const ackTestRun = `-- name: AckTestRun :one
 UPDATE test_runs
-SET status = 'ACKED', acked_at = NOW()
-WHERE nonce = $1 AND status = 'PENDING'
-RETURNING nonce, user_id, status, created_at, acked_at
+SET status = 'ACKED', acked_at = NOW(),
+    ack_device_id = $2, ack_platform = $3, ack_app_version = $4, ack_os_version = $5,
+    sent_at = $6, received_at = $7
+WHERE nonce = $1 AND status = 'PENDING' AND expires_at > NOW()
+RETURNING nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at
 `
 
-func (q *Queries) AckTestRun(ctx context.Context, nonce string) (TestRun, error) {
-	row := q.db.QueryRow(ctx, ackTestRun, nonce)
+type AckTestRunParams struct {
+	Nonce         string             `json:"nonce"`
+	AckDeviceID   pgtype.Text        `json:"ack_device_id"`
+	AckPlatform   pgtype.Text        `json:"ack_platform"`
+	AckAppVersion pgtype.Text        `json:"ack_app_version"`
+	AckOsVersion  pgtype.Text        `json:"ack_os_version"`
+	SentAt        pgtype.Timestamptz `json:"sent_at"`
+	ReceivedAt    pgtype.Timestamptz `json:"received_at"`
+}
+
+func (q *Queries) AckTestRun(ctx context.Context, arg AckTestRunParams) (TestRun, error) {
+	row := q.db.QueryRow(ctx, ackTestRun,
+		arg.Nonce,
+		arg.AckDeviceID,
+		arg.AckPlatform,
+		arg.AckAppVersion,
+		arg.AckOsVersion,
+		arg.SentAt,
+		arg.ReceivedAt,
+	)
 	var i TestRun
 	err := row.Scan(
 		&i.Nonce,
@@ -27,107 +47,196 @@ func (q *Queries) AckTestRun(ctx context.Context, nonce string) (TestRun, error)
 		&i.Status,
 		&i.CreatedAt,
 		&i.AckedAt,
+		&i.ExpiresAt,
+		&i.FailureReason,
+		&i.AckDeviceID,
+		&i.AckPlatform,
+		&i.AckAppVersion,
+		&i.AckOsVersion,
+		&i.SentAt,
+		&i.ReceivedAt,
 	)
 	return i, err
 }
 
-const createTestRun = `-- name: CreateTestRun :exec
-INSERT INTO test_runs (nonce, user_id, status, created_at)
-VALUES ($1, $2, 'PENDING', NOW())
-ON CONFLICT (nonce) DO NOTHING
+const ackTestRunDelivery = `-- name: AckTestRunDelivery :one
+UPDATE test_run_deliveries d
+SET status = 'ACKED', acked_at = NOW(), app_version = $3, os_version = $4, received_at = $5
+FROM test_runs r
+WHERE d.nonce = r.nonce AND d.nonce = $1 AND d.device_id = $2 AND d.status IN ('PENDING', 'SENT')
+  AND r.status IN ('PENDING', 'ACKED') AND r.expires_at > NOW()
+RETURNING d.nonce, d.device_id, d.platform, d.app_id, d.status, d.failure_reason, d.sent_at, d.acked_at, d.app_version, d.os_version, d.received_at
 `
 
-type CreateTestRunParams struct {
-	Nonce  string `json:"nonce"`
-	UserID string `json:"user_id"`
+type AckTestRunDeliveryParams struct {
+	Nonce      string             `json:"nonce"`
+	DeviceID   string             `json:"device_id"`
+	AppVersion pgtype.Text        `json:"app_version"`
+	OsVersion  pgtype.Text        `json:"os_version"`
+	ReceivedAt pgtype.Timestamptz `json:"received_at"`
 }
 
-func (q *Queries) CreateTestRun(ctx context.Context, arg CreateTestRunParams) error {
-	_, err := q.db.Exec(ctx, createTestRun, arg.Nonce, arg.UserID)
-	return err
+func (q *Queries) AckTestRunDelivery(ctx context.Context, arg AckTestRunDeliveryParams) (TestRunDelivery, error) {
+	row := q.db.QueryRow(ctx, ackTestRunDelivery,
+		arg.Nonce,
+		arg.DeviceID,
+		arg.AppVersion,
+		arg.OsVersion,
+		arg.ReceivedAt,
+	)
+	var i TestRunDelivery
+	err := row.Scan(
+		&i.Nonce,
+		&i.DeviceID,
+		&i.Platform,
+		&i.AppID,
+		&i.Status,
+		&i.FailureReason,
+		&i.SentAt,
+		&i.AckedAt,
+		&i.AppVersion,
+		&i.OsVersion,
+		&i.ReceivedAt,
+	)
+	return i, err
 }
 
-const getDeviceByDeviceID = `-- name: GetDeviceByDeviceID :one
-SELECT user_id, device_id, platform, fcm_token, is_active, updated_at
-FROM devices
-WHERE device_id = $1
-LIMIT 1
+const checkpointBroadcast = `-- name: CheckpointBroadcast :one
+UPDATE broadcasts
+SET last_device_id = $1,
+    suppressed_count = suppressed_count + $2::int,
+    status = CASE WHEN $3::boolean THEN 'COMPLETED' ELSE status END,
+    completed_at = CASE WHEN $3::boolean THEN NOW() END,
+    lease_expires_at = CASE WHEN $3::boolean THEN NULL ELSE $4::timestamptz END,
+    updated_at = NOW()
+WHERE broadcast_id = $5
+  AND status = 'RUNNING'
+  AND last_device_id = $6
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
 `
 
-type GetDeviceByDeviceIDRow struct {
-	UserID    string             `json:"user_id"`
-	DeviceID  string             `json:"device_id"`
-	Platform  string             `json:"platform"`
-	FcmToken  string             `json:"fcm_token"`
-	IsActive  bool               `json:"is_active"`
-	UpdatedAt pgtype.Timestamptz `json:"updated_at"`
+type CheckpointBroadcastParams struct {
+	LastDeviceID     int32              `json:"last_device_id"`
+	Suppressed       int32              `json:"suppressed"`
+	Completed        bool               `json:"completed"`
+	LeaseExpiresAt   pgtype.Timestamptz `json:"lease_expires_at"`
+	BroadcastID      string             `json:"broadcast_id"`
+	PreviousDeviceID int32              `json:"previous_device_id"`
 }
 
-func (q *Queries) GetDeviceByDeviceID(ctx context.Context, deviceID string) (GetDeviceByDeviceIDRow, error) {
-	row := q.db.QueryRow(ctx, getDeviceByDeviceID, deviceID)
-	var i GetDeviceByDeviceIDRow
+// Records a batch whose sends are enqueued in the same transaction and extends the lease, or completes
+// the broadcast. The broadcast must still be at previous_device_id, so each batch is recorded once.
+// Returns no rows otherwise.
+func (q *Queries) CheckpointBroadcast(ctx context.Context, arg CheckpointBroadcastParams) (Broadcast, error) {
+	row := q.db.QueryRow(ctx, checkpointBroadcast,
+		arg.LastDeviceID,
+		arg.Suppressed,
+		arg.Completed,
+		arg.LeaseExpiresAt,
+		arg.BroadcastID,
+		arg.PreviousDeviceID,
+	)
+	var i Broadcast
 	err := row.Scan(
-		&i.UserID,
-		&i.DeviceID,
-		&i.Platform,
-		&i.FcmToken,
-		&i.IsActive,
+		&i.BroadcastID,
+		&i.Message,
+		&i.BatchSize,
+		&i.Status,
+		&i.FailureReason,
+		&i.TotalDevices,
+		&i.LastDeviceID,
+		&i.SentCount,
+		&i.FailedCount,
+		&i.SuppressedCount,
+		&i.LeaseExpiresAt,
+		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.CompletedAt,
 	)
 	return i, err
 }
 
-const getTestRunByNonce = `-- name: GetTestRunByNonce :one
-SELECT nonce, user_id, status, created_at, acked_at
-FROM test_runs
-WHERE nonce = $1
-LIMIT 1
+const claimBroadcast = `-- name: ClaimBroadcast :one
+UPDATE broadcasts
+SET lease_expires_at = $1, updated_at = NOW()
+WHERE broadcast_id = (
+    SELECT b.broadcast_id
+    FROM broadcasts b
+    WHERE b.status = 'RUNNING'
+      AND (b.lease_expires_at IS NULL OR b.lease_expires_at < NOW())
+      AND ($2::text IS NULL OR b.broadcast_id = $2)
+    ORDER BY b.created_at
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED)
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
 `
 
-func (q *Queries) GetTestRunByNonce(ctx context.Context, nonce string) (TestRun, error) {
-	row := q.db.QueryRow(ctx, getTestRunByNonce, nonce)
-	var i TestRun
+type ClaimBroadcastParams struct {
+	LeaseExpiresAt pgtype.Timestamptz `json:"lease_expires_at"`
+	BroadcastID    pgtype.Text        `json:"broadcast_id"`
+}
+
+// Takes the lease of the oldest RUNNING broadcast that no invocation holds, or of the given one.
+// Returns no rows if there is none.
+func (q *Queries) ClaimBroadcast(ctx context.Context, arg ClaimBroadcastParams) (Broadcast, error) {
+	row := q.db.QueryRow(ctx, claimBroadcast, arg.LeaseExpiresAt, arg.BroadcastID)
+	var i Broadcast
 	err := row.Scan(
-		&i.Nonce,
-		&i.UserID,
+		&i.BroadcastID,
+		&i.Message,
+		&i.BatchSize,
 		&i.Status,
+		&i.FailureReason,
+		&i.TotalDevices,
+		&i.LastDeviceID,
+		&i.SentCount,
+		&i.FailedCount,
+		&i.SuppressedCount,
+		&i.LeaseExpiresAt,
 		&i.CreatedAt,
-		&i.AckedAt,
+		&i.UpdatedAt,
+		&i.CompletedAt,
 	)
 	return i, err
 }
 
-const listActiveDevicesByPlatforms = `-- name: ListActiveDevicesByPlatforms :many
-SELECT user_id, device_id, platform, fcm_token, is_active, updated_at
-FROM devices
-WHERE user_id = $1 AND is_active = TRUE AND platform IN ('android', 'ios')
+const claimOutboxEntries = `-- name: ClaimOutboxEntries :many
+UPDATE outbox
+SET available_at = $1, attempts = attempts + 1
+WHERE outbox_id IN (
+    SELECT outbox_id
+    FROM outbox
+    WHERE available_at <= NOW()
+    ORDER BY available_at, outbox_id
+    LIMIT $2
+    FOR UPDATE SKIP LOCKED)
+RETURNING outbox_id, kind, payload, attempts, available_at, last_error, created_at
 `
 
-type ListActiveDevicesByPlatformsRow struct {
-	UserID    string             `json:"user_id"`
-	DeviceID  string             `json:"device_id"`
-	Platform  string             `json:"platform"`
-	FcmToken  string             `json:"fcm_token"`
-	IsActive  bool               `json:"is_active"`
-	UpdatedAt pgtype.Timestamptz `json:"updated_at"`
+type ClaimOutboxEntriesParams struct {
+	LeaseExpiresAt pgtype.Timestamptz `json:"lease_expires_at"`
+	LimitCount     int32              `json:"limit_count"`
 }
 
-func (q *Queries) ListActiveDevicesByPlatforms(ctx context.Context, userID string) ([]ListActiveDevicesByPlatformsRow, error) {
-	rows, err := q.db.Query(ctx, listActiveDevicesByPlatforms, userID)
+// Takes available entries by moving available_at to the end of a lease, so concurrent invocations
+// skip them. An entry whose invocation stops before publishing it is taken again after the lease.
+func (q *Queries) ClaimOutboxEntries(ctx context.Context, arg ClaimOutboxEntriesParams) ([]Outbox, error) {
+	rows, err := q.db.Query(ctx, claimOutboxEntries, arg.LeaseExpiresAt, arg.LimitCount)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []ListActiveDevicesByPlatformsRow
+	var items []Outbox
 	for rows.Next() {
-		var i ListActiveDevicesByPlatformsRow
+		var i Outbox
 		if err := rows.Scan(
-			&i.UserID,
-			&i.DeviceID,
-			&i.Platform,
-			&i.FcmToken,
-			&i.IsActive,
-			&i.UpdatedAt,
+			&i.OutboxID,
+			&i.Kind,
+			&i.Payload,
+			&i.Attempts,
+			&i.AvailableAt,
+			&i.LastError,
+			&i.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -139,29 +248,1903 @@ func (q *Queries) ListActiveDevicesByPlatforms(ctx context.Context, userID strin
 	return items, nil
 }
 
-const upsertDevice = `-- name: UpsertDevice :exec
-INSERT INTO devices (user_id, device_id, platform, fcm_token, is_active, updated_at)
-VALUES ($1, $2, $3, $4, TRUE, NOW())
-ON CONFLICT (user_id, device_id)
-DO UPDATE SET
-    fcm_token = EXCLUDED.fcm_token,
-    is_active = TRUE,
-    updated_at = NOW()
+const claimWebhookDeliveries = `-- name: ClaimWebhookDeliveries :many
+UPDATE webhook_deliveries d
+SET next_attempt_at = $1
+FROM webhook_subscriptions s
+WHERE s.subscription_id = d.subscription_id
+  AND d.delivery_id IN (
+    SELECT w.delivery_id
+    FROM webhook_deliveries w
+    WHERE w.next_attempt_at <= NOW()
+    ORDER BY w.next_attempt_at, w.delivery_id
+    LIMIT $2
+    FOR UPDATE SKIP LOCKED)
+RETURNING d.delivery_id, d.subscription_id, d.event_id, d.event_type, d.payload, d.attempts, s.url, s.secret
 `
 
-type UpsertDeviceParams struct {
+type ClaimWebhookDeliveriesParams struct {
+	LeaseExpiresAt pgtype.Timestamptz `json:"lease_expires_at"`
+	LimitCount     int32              `json:"limit_count"`
+}
+
+type ClaimWebhookDeliveriesRow struct {
+	DeliveryID     int64  `json:"delivery_id"`
+	SubscriptionID string `json:"subscription_id"`
+	EventID        string `json:"event_id"`
+	EventType      string `json:"event_type"`
+	Payload        []byte `json:"payload"`
+	Attempts       int32  `json:"attempts"`
+	Url            string `json:"url"`
+	Secret         string `json:"secret"`
+}
+
+// Takes due deliveries by moving next_attempt_at to the end of a lease, so concurrent invocations
+// skip them. A delivery whose invocation stops before recording the attempt is retried after the lease.
+func (q *Queries) ClaimWebhookDeliveries(ctx context.Context, arg ClaimWebhookDeliveriesParams) ([]ClaimWebhookDeliveriesRow, error) {
+	rows, err := q.db.Query(ctx, claimWebhookDeliveries, arg.LeaseExpiresAt, arg.LimitCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ClaimWebhookDeliveriesRow
+	for rows.Next() {
+		var i ClaimWebhookDeliveriesRow
+		if err := rows.Scan(
+			&i.DeliveryID,
+			&i.SubscriptionID,
+			&i.EventID,
+			&i.EventType,
+			&i.Payload,
+			&i.Attempts,
+			&i.Url,
+			&i.Secret,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const countCampaignAssignments = `-- name: CountCampaignAssignments :many
+SELECT variant, COUNT(*) AS users
+FROM campaign_assignments
+WHERE campaign_id = $1
+GROUP BY variant
+ORDER BY variant
+`
+
+type CountCampaignAssignmentsRow struct {
+	Variant pgtype.Text `json:"variant"`
+	Users   int64       `json:"users"`
+}
+
+// Users by variant; the holdout group has a NULL variant
+func (q *Queries) CountCampaignAssignments(ctx context.Context, campaignID string) ([]CountCampaignAssignmentsRow, error) {
+	rows, err := q.db.Query(ctx, countCampaignAssignments, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CountCampaignAssignmentsRow
+	for rows.Next() {
+		var i CountCampaignAssignmentsRow
+		if err := rows.Scan(&i.Variant, &i.Users); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const createBroadcast = `-- name: CreateBroadcast :one
+INSERT INTO broadcasts (broadcast_id, message, batch_size, total_devices, created_at, updated_at)
+VALUES ($1, $2, $3, (SELECT COUNT(*) FROM devices WHERE is_active = TRUE AND platform IN ('android', 'ios')), NOW(), NOW())
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
+`
+
+type CreateBroadcastParams struct {
+	BroadcastID string `json:"broadcast_id"`
+	Message     []byte `json:"message"`
+	BatchSize   int32  `json:"batch_size"`
+}
+
+// total_devices counts the devices the broadcast targets now; devices registered later are included
+func (q *Queries) CreateBroadcast(ctx context.Context, arg CreateBroadcastParams) (Broadcast, error) {
+	row := q.db.QueryRow(ctx, createBroadcast, arg.BroadcastID, arg.Message, arg.BatchSize)
+	var i Broadcast
+	err := row.Scan(
+		&i.BroadcastID,
+		&i.Message,
+		&i.BatchSize,
+		&i.Status,
+		&i.FailureReason,
+		&i.TotalDevices,
+		&i.LastDeviceID,
+		&i.SentCount,
+		&i.FailedCount,
+		&i.SuppressedCount,
+		&i.LeaseExpiresAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.CompletedAt,
+	)
+	return i, err
+}
+
+const createCampaignVariant = `-- name: CreateCampaignVariant :exec
+INSERT INTO campaign_variants (campaign_id, variant, weight, title, body, data)
+VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+type CreateCampaignVariantParams struct {
+	CampaignID string `json:"campaign_id"`
+	Variant    string `json:"variant"`
+	Weight     int32  `json:"weight"`
+	Title      string `json:"title"`
+	Body       string `json:"body"`
+	Data       []byte `json:"data"`
+}
+
+func (q *Queries) CreateCampaignVariant(ctx context.Context, arg CreateCampaignVariantParams) error {
+	_, err := q.db.Exec(ctx, createCampaignVariant,
+		arg.CampaignID,
+		arg.Variant,
+		arg.Weight,
+		arg.Title,
+		arg.Body,
+		arg.Data,
+	)
+	return err
+}
+
+const createMessage = `-- name: CreateMessage :exec
+INSERT INTO messages (message_id, user_id, created_at)
+VALUES ($1, $2, NOW())
+`
+
+type CreateMessageParams struct {
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+}
+
+func (q *Queries) CreateMessage(ctx context.Context, arg CreateMessageParams) error {
+	_, err := q.db.Exec(ctx, createMessage, arg.MessageID, arg.UserID)
+	return err
+}
+
+const createMessageDelivery = `-- name: CreateMessageDelivery :exec
+INSERT INTO message_deliveries (message_id, device_id, platform, app_id, status, campaign_id, variant)
+VALUES ($1, $2, $3, $4, 'PENDING', $5, $6)
+`
+
+type CreateMessageDeliveryParams struct {
+	MessageID  string      `json:"message_id"`
+	DeviceID   string      `json:"device_id"`
+	Platform   string      `json:"platform"`
+	AppID      string      `json:"app_id"`
+	CampaignID pgtype.Text `json:"campaign_id"`
+	Variant    pgtype.Text `json:"variant"`
+}
+
+func (q *Queries) CreateMessageDelivery(ctx context.Context, arg CreateMessageDeliveryParams) error {
+	_, err := q.db.Exec(ctx, createMessageDelivery,
+		arg.MessageID,
+		arg.DeviceID,
+		arg.Platform,
+		arg.AppID,
+		arg.CampaignID,
+		arg.Variant,
+	)
+	return err
+}
+
+const createNotificationPreference = `-- name: CreateNotificationPreference :exec
+INSERT INTO notification_preferences (user_id, device_id, category, enabled, updated_at)
+VALUES ($1, $2, $3, $4, NOW())
+`
+
+type CreateNotificationPreferenceParams struct {
 	UserID   string `json:"user_id"`
 	DeviceID string `json:"device_id"`
-	Platform string `json:"platform"`
-	FcmToken string `json:"fcm_token"`
+	Category string `json:"category"`
+	Enabled  bool   `json:"enabled"`
 }
 
-func (q *Queries) UpsertDevice(ctx context.Context, arg UpsertDeviceParams) error {
-	_, err := q.db.Exec(ctx, upsertDevice,
+func (q *Queries) CreateNotificationPreference(ctx context.Context, arg CreateNotificationPreferenceParams) error {
+	_, err := q.db.Exec(ctx, createNotificationPreference,
 		arg.UserID,
 		arg.DeviceID,
+		arg.Category,
+		arg.Enabled,
+	)
+	return err
+}
+
+const createOutboxEntry = `-- name: CreateOutboxEntry :one
+INSERT INTO outbox (kind, payload, available_at)
+VALUES ($1, $2, $3)
+RETURNING outbox_id, kind, payload, attempts, available_at, last_error, created_at
+`
+
+type CreateOutboxEntryParams struct {
+	Kind        string             `json:"kind"`
+	Payload     []byte             `json:"payload"`
+	AvailableAt pgtype.Timestamptz `json:"available_at"`
+}
+
+func (q *Queries) CreateOutboxEntry(ctx context.Context, arg CreateOutboxEntryParams) (Outbox, error) {
+	row := q.db.QueryRow(ctx, createOutboxEntry, arg.Kind, arg.Payload, arg.AvailableAt)
+	var i Outbox
+	err := row.Scan(
+		&i.OutboxID,
+		&i.Kind,
+		&i.Payload,
+		&i.Attempts,
+		&i.AvailableAt,
+		&i.LastError,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createTestRun = `-- name: CreateTestRun :execrows
+INSERT INTO test_runs (nonce, user_id, status, created_at, expires_at)
+VALUES ($1, $2, 'PENDING', NOW(), $3)
+ON CONFLICT (nonce) DO NOTHING
+`
+
+type CreateTestRunParams struct {
+	Nonce     string             `json:"nonce"`
+	UserID    string             `json:"user_id"`
+	ExpiresAt pgtype.Timestamptz `json:"expires_at"`
+}
+
+func (q *Queries) CreateTestRun(ctx context.Context, arg CreateTestRunParams) (int64, error) {
+	result, err := q.db.Exec(ctx, createTestRun, arg.Nonce, arg.UserID, arg.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const createTestRunDelivery = `-- name: CreateTestRunDelivery :exec
+INSERT INTO test_run_deliveries (nonce, device_id, platform, app_id, status)
+VALUES ($1, $2, $3, $4, 'PENDING')
+`
+
+type CreateTestRunDeliveryParams struct {
+	Nonce    string `json:"nonce"`
+	DeviceID string `json:"device_id"`
+	Platform string `json:"platform"`
+	AppID    string `json:"app_id"`
+}
+
+func (q *Queries) CreateTestRunDelivery(ctx context.Context, arg CreateTestRunDeliveryParams) error {
+	_, err := q.db.Exec(ctx, createTestRunDelivery,
+		arg.Nonce,
+		arg.DeviceID,
 		arg.Platform,
-		arg.FcmToken,
+		arg.AppID,
+	)
+	return err
+}
+
+const createWebhookSubscription = `-- name: CreateWebhookSubscription :one
+INSERT INTO webhook_subscriptions (subscription_id, url, event_types, secret, description)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING subscription_id, url, event_types, secret, description, created_at
+`
+
+type CreateWebhookSubscriptionParams struct {
+	SubscriptionID string   `json:"subscription_id"`
+	Url            string   `json:"url"`
+	EventTypes     []string `json:"event_types"`
+	Secret         string   `json:"secret"`
+	Description    string   `json:"description"`
+}
+
+func (q *Queries) CreateWebhookSubscription(ctx context.Context, arg CreateWebhookSubscriptionParams) (WebhookSubscription, error) {
+	row := q.db.QueryRow(ctx, createWebhookSubscription,
+		arg.SubscriptionID,
+		arg.Url,
+		arg.EventTypes,
+		arg.Secret,
+		arg.Description,
 	)
+	var i WebhookSubscription
+	err := row.Scan(
+		&i.SubscriptionID,
+		&i.Url,
+		&i.EventTypes,
+		&i.Secret,
+		&i.Description,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const deactivateDeviceToken = `-- name: DeactivateDeviceToken :execrows
+UPDATE devices
+SET is_active = FALSE, updated_at = NOW()
+WHERE device_id = $1 AND fcm_token = $2 AND is_active = TRUE
+`
+
+type DeactivateDeviceTokenParams struct {
+	DeviceID string `json:"device_id"`
+	FcmToken string `json:"fcm_token"`
+}
+
+// Only if the device still has the token: a token registered since the send stays active
+func (q *Queries) DeactivateDeviceToken(ctx context.Context, arg DeactivateDeviceTokenParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deactivateDeviceToken, arg.DeviceID, arg.FcmToken)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deadLetterWebhookDelivery = `-- name: DeadLetterWebhookDelivery :execrows
+WITH failed AS (
+    DELETE FROM webhook_deliveries
+    WHERE delivery_id = $1
+    RETURNING delivery_id, subscription_id, event_id, event_type, payload, attempts, created_at
+)
+INSERT INTO webhook_dead_letters (delivery_id, subscription_id, event_id, event_type, payload, attempts, last_error, created_at)
+SELECT delivery_id, subscription_id, event_id, event_type, payload, attempts + 1, $2::text, created_at
+FROM failed
+`
+
+type DeadLetterWebhookDeliveryParams struct {
+	DeliveryID int64  `json:"delivery_id"`
+	LastError  string `json:"last_error"`
+}
+
+// Moves a delivery to webhook_dead_letters after its last failed attempt
+func (q *Queries) DeadLetterWebhookDelivery(ctx context.Context, arg DeadLetterWebhookDeliveryParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deadLetterWebhookDelivery, arg.DeliveryID, arg.LastError)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteCampaign = `-- name: DeleteCampaign :execrows
+DELETE FROM campaigns
+WHERE campaign_id = $1
+`
+
+// Variants and assignments are deleted with the campaign; deliveries keep their campaign_id and variant
+func (q *Queries) DeleteCampaign(ctx context.Context, campaignID string) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteCampaign, campaignID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteCampaignVariants = `-- name: DeleteCampaignVariants :exec
+DELETE FROM campaign_variants
+WHERE campaign_id = $1
+`
+
+func (q *Queries) DeleteCampaignVariants(ctx context.Context, campaignID string) error {
+	_, err := q.db.Exec(ctx, deleteCampaignVariants, campaignID)
+	return err
+}
+
+const deleteNotificationPreferences = `-- name: DeleteNotificationPreferences :exec
+DELETE FROM notification_preferences
+WHERE user_id = $1
+`
+
+func (q *Queries) DeleteNotificationPreferences(ctx context.Context, userID string) error {
+	_, err := q.db.Exec(ctx, deleteNotificationPreferences, userID)
 	return err
 }
+
+const deleteOutboxEntry = `-- name: DeleteOutboxEntry :execrows
+DELETE FROM outbox
+WHERE outbox_id = $1
+`
+
+// Returns 0 if another invocation published the entry first
+func (q *Queries) DeleteOutboxEntry(ctx context.Context, outboxID int64) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteOutboxEntry, outboxID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteSegment = `-- name: DeleteSegment :execrows
+DELETE FROM segments
+WHERE segment_id = $1
+`
+
+func (q *Queries) DeleteSegment(ctx context.Context, segmentID string) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteSegment, segmentID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteTemplate = `-- name: DeleteTemplate :execrows
+DELETE FROM templates
+WHERE template_key = $1 AND locale = $2
+`
+
+type DeleteTemplateParams struct {
+	TemplateKey string `json:"template_key"`
+	Locale      string `json:"locale"`
+}
+
+func (q *Queries) DeleteTemplate(ctx context.Context, arg DeleteTemplateParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteTemplate, arg.TemplateKey, arg.Locale)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteWebhookDelivery = `-- name: DeleteWebhookDelivery :exec
+DELETE FROM webhook_deliveries
+WHERE delivery_id = $1
+`
+
+func (q *Queries) DeleteWebhookDelivery(ctx context.Context, deliveryID int64) error {
+	_, err := q.db.Exec(ctx, deleteWebhookDelivery, deliveryID)
+	return err
+}
+
+const deleteWebhookSubscription = `-- name: DeleteWebhookSubscription :execrows
+DELETE FROM webhook_subscriptions
+WHERE subscription_id = $1
+`
+
+// Pending deliveries and dead letters are deleted with the subscription
+func (q *Queries) DeleteWebhookSubscription(ctx context.Context, subscriptionID string) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteWebhookSubscription, subscriptionID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const enqueueWebhookEvent = `-- name: EnqueueWebhookEvent :execrows
+INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload)
+SELECT subscription_id, $1::text, $2::text, $3::jsonb
+FROM webhook_subscriptions
+WHERE $2::text = ANY(event_types)
+`
+
+type EnqueueWebhookEventParams struct {
+	EventID   string `json:"event_id"`
+	EventType string `json:"event_type"`
+	Payload   []byte `json:"payload"`
+}
+
+// One delivery per subscription to the event type; returns the number of subscriptions
+func (q *Queries) EnqueueWebhookEvent(ctx context.Context, arg EnqueueWebhookEventParams) (int64, error) {
+	result, err := q.db.Exec(ctx, enqueueWebhookEvent, arg.EventID, arg.EventType, arg.Payload)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const expirePendingTestRuns = `-- name: ExpirePendingTestRuns :execrows
+UPDATE test_runs
+SET status = 'EXPIRED', failure_reason = 'no ack received before expires_at'
+WHERE status = 'PENDING' AND expires_at <= NOW()
+`
+
+func (q *Queries) ExpirePendingTestRuns(ctx context.Context) (int64, error) {
+	result, err := q.db.Exec(ctx, expirePendingTestRuns)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const expireTestRun = `-- name: ExpireTestRun :one
+UPDATE test_runs
+SET status = 'EXPIRED', failure_reason = 'no ack received before expires_at'
+WHERE nonce = $1 AND status = 'PENDING' AND expires_at <= NOW()
+RETURNING nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at
+`
+
+func (q *Queries) ExpireTestRun(ctx context.Context, nonce string) (TestRun, error) {
+	row := q.db.QueryRow(ctx, expireTestRun, nonce)
+	var i TestRun
+	err := row.Scan(
+		&i.Nonce,
+		&i.UserID,
+		&i.Status,
+		&i.CreatedAt,
+		&i.AckedAt,
+		&i.ExpiresAt,
+		&i.FailureReason,
+		&i.AckDeviceID,
+		&i.AckPlatform,
+		&i.AckAppVersion,
+		&i.AckOsVersion,
+		&i.SentAt,
+		&i.ReceivedAt,
+	)
+	return i, err
+}
+
+const failBroadcast = `-- name: FailBroadcast :one
+UPDATE broadcasts
+SET status = 'FAILED', failure_reason = $2, lease_expires_at = NULL, completed_at = NOW(), updated_at = NOW()
+WHERE broadcast_id = $1 AND status = 'RUNNING'
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
+`
+
+type FailBroadcastParams struct {
+	BroadcastID   string      `json:"broadcast_id"`
+	FailureReason pgtype.Text `json:"failure_reason"`
+}
+
+func (q *Queries) FailBroadcast(ctx context.Context, arg FailBroadcastParams) (Broadcast, error) {
+	row := q.db.QueryRow(ctx, failBroadcast, arg.BroadcastID, arg.FailureReason)
+	var i Broadcast
+	err := row.Scan(
+		&i.BroadcastID,
+		&i.Message,
+		&i.BatchSize,
+		&i.Status,
+		&i.FailureReason,
+		&i.TotalDevices,
+		&i.LastDeviceID,
+		&i.SentCount,
+		&i.FailedCount,
+		&i.SuppressedCount,
+		&i.LeaseExpiresAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.CompletedAt,
+	)
+	return i, err
+}
+
+const getBroadcast = `-- name: GetBroadcast :one
+SELECT broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
+FROM broadcasts
+WHERE broadcast_id = $1
+`
+
+func (q *Queries) GetBroadcast(ctx context.Context, broadcastID string) (Broadcast, error) {
+	row := q.db.QueryRow(ctx, getBroadcast, broadcastID)
+	var i Broadcast
+	err := row.Scan(
+		&i.BroadcastID,
+		&i.Message,
+		&i.BatchSize,
+		&i.Status,
+		&i.FailureReason,
+		&i.TotalDevices,
+		&i.LastDeviceID,
+		&i.SentCount,
+		&i.FailedCount,
+		&i.SuppressedCount,
+		&i.LeaseExpiresAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.CompletedAt,
+	)
+	return i, err
+}
+
+const getCampaign = `-- name: GetCampaign :one
+SELECT campaign_id, description, category, holdout_percent, created_at, updated_at
+FROM campaigns
+WHERE campaign_id = $1
+`
+
+func (q *Queries) GetCampaign(ctx context.Context, campaignID string) (Campaign, error) {
+	row := q.db.QueryRow(ctx, getCampaign, campaignID)
+	var i Campaign
+	err := row.Scan(
+		&i.CampaignID,
+		&i.Description,
+		&i.Category,
+		&i.HoldoutPercent,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getCampaignDeliveryStats = `-- name: GetCampaignDeliveryStats :many
+SELECT d.variant,
+    COUNT(*) AS deliveries,
+    COUNT(*) FILTER (WHERE d.status = 'SENT') AS sent,
+    COUNT(*) FILTER (WHERE d.status = 'SEND_FAILED') AS failed,
+    COUNT(d.delivered_at) AS delivered,
+    COUNT(d.opened_at) AS opened,
+    COUNT(DISTINCT m.user_id) FILTER (WHERE d.opened_at IS NOT NULL) AS opened_users
+FROM message_deliveries d
+JOIN messages m ON m.message_id = d.message_id
+WHERE d.campaign_id = $1::text
+GROUP BY d.variant
+ORDER BY d.variant
+`
+
+type GetCampaignDeliveryStatsRow struct {
+	Variant     pgtype.Text `json:"variant"`
+	Deliveries  int64       `json:"deliveries"`
+	Sent        int64       `json:"sent"`
+	Failed      int64       `json:"failed"`
+	Delivered   int64       `json:"delivered"`
+	Opened      int64       `json:"opened"`
+	OpenedUsers int64       `json:"opened_users"`
+}
+
+// Deliveries and receipts by variant. opened_users counts users who opened the message on any device.
+func (q *Queries) GetCampaignDeliveryStats(ctx context.Context, campaignID string) ([]GetCampaignDeliveryStatsRow, error) {
+	rows, err := q.db.Query(ctx, getCampaignDeliveryStats, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetCampaignDeliveryStatsRow
+	for rows.Next() {
+		var i GetCampaignDeliveryStatsRow
+		if err := rows.Scan(
+			&i.Variant,
+			&i.Deliveries,
+			&i.Sent,
+			&i.Failed,
+			&i.Delivered,
+			&i.Opened,
+			&i.OpenedUsers,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDeviceByDeviceID = `-- name: GetDeviceByDeviceID :one
+SELECT user_id, device_id, platform, app_id, fcm_token, is_active, updated_at
+FROM devices
+WHERE device_id = $1
+LIMIT 1
+`
+
+type GetDeviceByDeviceIDRow struct {
+	UserID    string             `json:"user_id"`
+	DeviceID  string             `json:"device_id"`
+	Platform  string             `json:"platform"`
+	AppID     string             `json:"app_id"`
+	FcmToken  string             `json:"fcm_token"`
+	IsActive  bool               `json:"is_active"`
+	UpdatedAt pgtype.Timestamptz `json:"updated_at"`
+}
+
+func (q *Queries) GetDeviceByDeviceID(ctx context.Context, deviceID string) (GetDeviceByDeviceIDRow, error) {
+	row := q.db.QueryRow(ctx, getDeviceByDeviceID, deviceID)
+	var i GetDeviceByDeviceIDRow
+	err := row.Scan(
+		&i.UserID,
+		&i.DeviceID,
+		&i.Platform,
+		&i.AppID,
+		&i.FcmToken,
+		&i.IsActive,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getMessageDelivery = `-- name: GetMessageDelivery :one
+SELECT message_id, device_id, platform, app_id, status, failure_reason, sent_at, delivered_at, opened_at, dismissed_at, campaign_id, variant
+FROM message_deliveries
+WHERE message_id = $1 AND device_id = $2
+`
+
+type GetMessageDeliveryParams struct {
+	MessageID string `json:"message_id"`
+	DeviceID  string `json:"device_id"`
+}
+
+func (q *Queries) GetMessageDelivery(ctx context.Context, arg GetMessageDeliveryParams) (MessageDelivery, error) {
+	row := q.db.QueryRow(ctx, getMessageDelivery, arg.MessageID, arg.DeviceID)
+	var i MessageDelivery
+	err := row.Scan(
+		&i.MessageID,
+		&i.DeviceID,
+		&i.Platform,
+		&i.AppID,
+		&i.Status,
+		&i.FailureReason,
+		&i.SentAt,
+		&i.DeliveredAt,
+		&i.OpenedAt,
+		&i.DismissedAt,
+		&i.CampaignID,
+		&i.Variant,
+	)
+	return i, err
+}
+
+const getNotificationCategory = `-- name: GetNotificationCategory :one
+SELECT category, description, mandatory, default_enabled
+FROM notification_categories
+WHERE category = $1
+`
+
+func (q *Queries) GetNotificationCategory(ctx context.Context, category string) (NotificationCategory, error) {
+	row := q.db.QueryRow(ctx, getNotificationCategory, category)
+	var i NotificationCategory
+	err := row.Scan(
+		&i.Category,
+		&i.Description,
+		&i.Mandatory,
+		&i.DefaultEnabled,
+	)
+	return i, err
+}
+
+const getSegment = `-- name: GetSegment :one
+SELECT segment_id, description, expression, created_at, updated_at
+FROM segments
+WHERE segment_id = $1
+`
+
+func (q *Queries) GetSegment(ctx context.Context, segmentID string) (Segment, error) {
+	row := q.db.QueryRow(ctx, getSegment, segmentID)
+	var i Segment
+	err := row.Scan(
+		&i.SegmentID,
+		&i.Description,
+		&i.Expression,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getTemplate = `-- name: GetTemplate :one
+SELECT template_key, locale, title, body, default_data, created_at, updated_at
+FROM templates
+WHERE template_key = $1 AND locale = $2
+`
+
+type GetTemplateParams struct {
+	TemplateKey string `json:"template_key"`
+	Locale      string `json:"locale"`
+}
+
+func (q *Queries) GetTemplate(ctx context.Context, arg GetTemplateParams) (Template, error) {
+	row := q.db.QueryRow(ctx, getTemplate, arg.TemplateKey, arg.Locale)
+	var i Template
+	err := row.Scan(
+		&i.TemplateKey,
+		&i.Locale,
+		&i.Title,
+		&i.Body,
+		&i.DefaultData,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getTestRunByNonce = `-- name: GetTestRunByNonce :one
+SELECT nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at
+FROM test_runs
+WHERE nonce = $1
+LIMIT 1
+`
+
+func (q *Queries) GetTestRunByNonce(ctx context.Context, nonce string) (TestRun, error) {
+	row := q.db.QueryRow(ctx, getTestRunByNonce, nonce)
+	var i TestRun
+	err := row.Scan(
+		&i.Nonce,
+		&i.UserID,
+		&i.Status,
+		&i.CreatedAt,
+		&i.AckedAt,
+		&i.ExpiresAt,
+		&i.FailureReason,
+		&i.AckDeviceID,
+		&i.AckPlatform,
+		&i.AckAppVersion,
+		&i.AckOsVersion,
+		&i.SentAt,
+		&i.ReceivedAt,
+	)
+	return i, err
+}
+
+const getTestRunStats = `-- name: GetTestRunStats :one
+SELECT
+    COUNT(*) AS total,
+    COUNT(*) FILTER (WHERE status = 'ACKED') AS acked,
+    COUNT(*) FILTER (WHERE status = 'PENDING') AS pending,
+    COUNT(*) FILTER (WHERE status = 'EXPIRED') AS expired,
+    COUNT(*) FILTER (WHERE status = 'SEND_FAILED') AS send_failed,
+    COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM acked_at - COALESCE(sent_at, created_at)) * 1000)
+        FILTER (WHERE status = 'ACKED'), 0)::float8 AS p50_ack_latency_ms,
+    COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM acked_at - COALESCE(sent_at, created_at)) * 1000)
+        FILTER (WHERE status = 'ACKED'), 0)::float8 AS p95_ack_latency_ms
+FROM test_runs
+WHERE ($1::text IS NULL OR user_id = $1)
+  AND created_at >= $2
+  AND created_at < $3
+`
+
+type GetTestRunStatsParams struct {
+	UserID pgtype.Text        `json:"user_id"`
+	Since  pgtype.Timestamptz `json:"since"`
+	Until  pgtype.Timestamptz `json:"until"`
+}
+
+type GetTestRunStatsRow struct {
+	Total           int64   `json:"total"`
+	Acked           int64   `json:"acked"`
+	Pending         int64   `json:"pending"`
+	Expired         int64   `json:"expired"`
+	SendFailed      int64   `json:"send_failed"`
+	P50AckLatencyMs float64 `json:"p50_ack_latency_ms"`
+	P95AckLatencyMs float64 `json:"p95_ack_latency_ms"`
+}
+
+// Ack latency is measured like TestRunLatency.SendToAckMs; percentiles are 0 without ACKED runs
+func (q *Queries) GetTestRunStats(ctx context.Context, arg GetTestRunStatsParams) (GetTestRunStatsRow, error) {
+	row := q.db.QueryRow(ctx, getTestRunStats, arg.UserID, arg.Since, arg.Until)
+	var i GetTestRunStatsRow
+	err := row.Scan(
+		&i.Total,
+		&i.Acked,
+		&i.Pending,
+		&i.Expired,
+		&i.SendFailed,
+		&i.P50AckLatencyMs,
+		&i.P95AckLatencyMs,
+	)
+	return i, err
+}
+
+const getWebhookSubscription = `-- name: GetWebhookSubscription :one
+SELECT subscription_id, url, event_types, secret, description, created_at
+FROM webhook_subscriptions
+WHERE subscription_id = $1
+`
+
+func (q *Queries) GetWebhookSubscription(ctx context.Context, subscriptionID string) (WebhookSubscription, error) {
+	row := q.db.QueryRow(ctx, getWebhookSubscription, subscriptionID)
+	var i WebhookSubscription
+	err := row.Scan(
+		&i.SubscriptionID,
+		&i.Url,
+		&i.EventTypes,
+		&i.Secret,
+		&i.Description,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const listActiveDevicesByPlatforms = `-- name: ListActiveDevicesByPlatforms :many
+SELECT user_id, device_id, platform, app_id, fcm_token, token_type, locale, is_active, updated_at
+FROM devices
+WHERE user_id = $1 AND is_active = TRUE AND platform IN ('android', 'ios')
+`
+
+type ListActiveDevicesByPlatformsRow struct {
+	UserID    string             `json:"user_id"`
+	DeviceID  string             `json:"device_id"`
+	Platform  string             `json:"platform"`
+	AppID     string             `json:"app_id"`
+	FcmToken  string             `json:"fcm_token"`
+	TokenType string             `json:"token_type"`
+	Locale    pgtype.Text        `json:"locale"`
+	IsActive  bool               `json:"is_active"`
+	UpdatedAt pgtype.Timestamptz `json:"updated_at"`
+}
+
+func (q *Queries) ListActiveDevicesByPlatforms(ctx context.Context, userID string) ([]ListActiveDevicesByPlatformsRow, error) {
+	rows, err := q.db.Query(ctx, listActiveDevicesByPlatforms, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListActiveDevicesByPlatformsRow
+	for rows.Next() {
+		var i ListActiveDevicesByPlatformsRow
+		if err := rows.Scan(
+			&i.UserID,
+			&i.DeviceID,
+			&i.Platform,
+			&i.AppID,
+			&i.FcmToken,
+			&i.TokenType,
+			&i.Locale,
+			&i.IsActive,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listBroadcastDevices = `-- name: ListBroadcastDevices :many
+SELECT id, user_id, device_id, platform, app_id, fcm_token, token_type, locale, is_active, updated_at
+FROM devices
+WHERE is_active = TRUE AND platform IN ('android', 'ios') AND id > $1
+ORDER BY id
+LIMIT $2
+`
+
+type ListBroadcastDevicesParams struct {
+	AfterID    int32 `json:"after_id"`
+	LimitCount int32 `json:"limit_count"`
+}
+
+type ListBroadcastDevicesRow struct {
+	ID        int32              `json:"id"`
+	UserID    string             `json:"user_id"`
+	DeviceID  string             `json:"device_id"`
+	Platform  string             `json:"platform"`
+	AppID     string             `json:"app_id"`
+	FcmToken  string             `json:"fcm_token"`
+	TokenType string             `json:"token_type"`
+	Locale    pgtype.Text        `json:"locale"`
+	IsActive  bool               `json:"is_active"`
+	UpdatedAt pgtype.Timestamptz `json:"updated_at"`
+}
+
+// Active devices after a broadcast's checkpoint, in id order
+func (q *Queries) ListBroadcastDevices(ctx context.Context, arg ListBroadcastDevicesParams) ([]ListBroadcastDevicesRow, error) {
+	rows, err := q.db.Query(ctx, listBroadcastDevices, arg.AfterID, arg.LimitCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListBroadcastDevicesRow
+	for rows.Next() {
+		var i ListBroadcastDevicesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.DeviceID,
+			&i.Platform,
+			&i.AppID,
+			&i.FcmToken,
+			&i.TokenType,
+			&i.Locale,
+			&i.IsActive,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listBroadcasts = `-- name: ListBroadcasts :many
+SELECT broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
+FROM broadcasts
+ORDER BY created_at DESC, broadcast_id
+LIMIT $1
+`
+
+func (q *Queries) ListBroadcasts(ctx context.Context, limitCount int32) ([]Broadcast, error) {
+	rows, err := q.db.Query(ctx, listBroadcasts, limitCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Broadcast
+	for rows.Next() {
+		var i Broadcast
+		if err := rows.Scan(
+			&i.BroadcastID,
+			&i.Message,
+			&i.BatchSize,
+			&i.Status,
+			&i.FailureReason,
+			&i.TotalDevices,
+			&i.LastDeviceID,
+			&i.SentCount,
+			&i.FailedCount,
+			&i.SuppressedCount,
+			&i.LeaseExpiresAt,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.CompletedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listCampaignVariants = `-- name: ListCampaignVariants :many
+SELECT campaign_id, variant, weight, title, body, data
+FROM campaign_variants
+WHERE ($1::text IS NULL OR campaign_id = $1)
+ORDER BY campaign_id, variant
+`
+
+// Variants of the campaign, or of all campaigns without campaign_id
+func (q *Queries) ListCampaignVariants(ctx context.Context, campaignID pgtype.Text) ([]CampaignVariant, error) {
+	rows, err := q.db.Query(ctx, listCampaignVariants, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CampaignVariant
+	for rows.Next() {
+		var i CampaignVariant
+		if err := rows.Scan(
+			&i.CampaignID,
+			&i.Variant,
+			&i.Weight,
+			&i.Title,
+			&i.Body,
+			&i.Data,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listCampaigns = `-- name: ListCampaigns :many
+SELECT campaign_id, description, category, holdout_percent, created_at, updated_at
+FROM campaigns
+ORDER BY campaign_id
+`
+
+func (q *Queries) ListCampaigns(ctx context.Context) ([]Campaign, error) {
+	rows, err := q.db.Query(ctx, listCampaigns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Campaign
+	for rows.Next() {
+		var i Campaign
+		if err := rows.Scan(
+			&i.CampaignID,
+			&i.Description,
+			&i.Category,
+			&i.HoldoutPercent,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDevices = `-- name: ListDevices :many
+SELECT id, user_id, device_id, platform, app_id, token_type, locale, app_version, os_version, device_model, timezone, sdk_version, is_active, updated_at
+FROM devices
+WHERE ($1::text IS NULL OR user_id = $1)
+  AND ($2::text IS NULL OR platform = $2)
+  AND ($3::text IS NULL OR app_id = $3)
+  AND ($4::text IS NULL OR app_version = $4)
+  AND ($5::text IS NULL OR os_version = $5)
+  AND ($6::text IS NULL OR locale = $6)
+  AND ($7::text IS NULL OR timezone = $7)
+  AND ($8::boolean IS NULL OR is_active = $8)
+  AND id > $9
+ORDER BY id
+LIMIT $10
+`
+
+type ListDevicesParams struct {
+	UserID     pgtype.Text `json:"user_id"`
+	Platform   pgtype.Text `json:"platform"`
+	AppID      pgtype.Text `json:"app_id"`
+	AppVersion pgtype.Text `json:"app_version"`
+	OsVersion  pgtype.Text `json:"os_version"`
+	Locale     pgtype.Text `json:"locale"`
+	Timezone   pgtype.Text `json:"timezone"`
+	IsActive   pgtype.Bool `json:"is_active"`
+	AfterID    int32       `json:"after_id"`
+	LimitCount int32       `json:"limit_count"`
+}
+
+type ListDevicesRow struct {
+	ID          int32              `json:"id"`
+	UserID      string             `json:"user_id"`
+	DeviceID    string             `json:"device_id"`
+	Platform    string             `json:"platform"`
+	AppID       string             `json:"app_id"`
+	TokenType   string             `json:"token_type"`
+	Locale      pgtype.Text        `json:"locale"`
+	AppVersion  pgtype.Text        `json:"app_version"`
+	OsVersion   pgtype.Text        `json:"os_version"`
+	DeviceModel pgtype.Text        `json:"device_model"`
+	Timezone    pgtype.Text        `json:"timezone"`
+	SdkVersion  pgtype.Text        `json:"sdk_version"`
+	IsActive    bool               `json:"is_active"`
+	UpdatedAt   pgtype.Timestamptz `json:"updated_at"`
+}
+
+// Oldest registration first; the cursor is the id of the last device of the previous page
+func (q *Queries) ListDevices(ctx context.Context, arg ListDevicesParams) ([]ListDevicesRow, error) {
+	rows, err := q.db.Query(ctx, listDevices,
+		arg.UserID,
+		arg.Platform,
+		arg.AppID,
+		arg.AppVersion,
+		arg.OsVersion,
+		arg.Locale,
+		arg.Timezone,
+		arg.IsActive,
+		arg.AfterID,
+		arg.LimitCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDevicesRow
+	for rows.Next() {
+		var i ListDevicesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.DeviceID,
+			&i.Platform,
+			&i.AppID,
+			&i.TokenType,
+			&i.Locale,
+			&i.AppVersion,
+			&i.OsVersion,
+			&i.DeviceModel,
+			&i.Timezone,
+			&i.SdkVersion,
+			&i.IsActive,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listNotificationCategories = `-- name: ListNotificationCategories :many
+SELECT category, description, mandatory, default_enabled
+FROM notification_categories
+ORDER BY category
+`
+
+func (q *Queries) ListNotificationCategories(ctx context.Context) ([]NotificationCategory, error) {
+	rows, err := q.db.Query(ctx, listNotificationCategories)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []NotificationCategory
+	for rows.Next() {
+		var i NotificationCategory
+		if err := rows.Scan(
+			&i.Category,
+			&i.Description,
+			&i.Mandatory,
+			&i.DefaultEnabled,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listNotificationPreferences = `-- name: ListNotificationPreferences :many
+SELECT user_id, device_id, category, enabled, updated_at
+FROM notification_preferences
+WHERE user_id = $1
+ORDER BY device_id, category
+`
+
+func (q *Queries) ListNotificationPreferences(ctx context.Context, userID string) ([]NotificationPreference, error) {
+	rows, err := q.db.Query(ctx, listNotificationPreferences, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []NotificationPreference
+	for rows.Next() {
+		var i NotificationPreference
+		if err := rows.Scan(
+			&i.UserID,
+			&i.DeviceID,
+			&i.Category,
+			&i.Enabled,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listSegments = `-- name: ListSegments :many
+SELECT segment_id, description, expression, created_at, updated_at
+FROM segments
+ORDER BY segment_id
+`
+
+func (q *Queries) ListSegments(ctx context.Context) ([]Segment, error) {
+	rows, err := q.db.Query(ctx, listSegments)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Segment
+	for rows.Next() {
+		var i Segment
+		if err := rows.Scan(
+			&i.SegmentID,
+			&i.Description,
+			&i.Expression,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTemplates = `-- name: ListTemplates :many
+SELECT template_key, locale, title, body, default_data, created_at, updated_at
+FROM templates
+WHERE $1::text IS NULL OR template_key = $1
+ORDER BY template_key, locale
+`
+
+func (q *Queries) ListTemplates(ctx context.Context, templateKey pgtype.Text) ([]Template, error) {
+	rows, err := q.db.Query(ctx, listTemplates, templateKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Template
+	for rows.Next() {
+		var i Template
+		if err := rows.Scan(
+			&i.TemplateKey,
+			&i.Locale,
+			&i.Title,
+			&i.Body,
+			&i.DefaultData,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTestRunDeliveries = `-- name: ListTestRunDeliveries :many
+SELECT nonce, device_id, platform, app_id, status, failure_reason, sent_at, acked_at, app_version, os_version, received_at
+FROM test_run_deliveries
+WHERE nonce = $1
+ORDER BY device_id
+`
+
+func (q *Queries) ListTestRunDeliveries(ctx context.Context, nonce string) ([]TestRunDelivery, error) {
+	rows, err := q.db.Query(ctx, listTestRunDeliveries, nonce)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []TestRunDelivery
+	for rows.Next() {
+		var i TestRunDelivery
+		if err := rows.Scan(
+			&i.Nonce,
+			&i.DeviceID,
+			&i.Platform,
+			&i.AppID,
+			&i.Status,
+			&i.FailureReason,
+			&i.SentAt,
+			&i.AckedAt,
+			&i.AppVersion,
+			&i.OsVersion,
+			&i.ReceivedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTestRuns = `-- name: ListTestRuns :many
+SELECT nonce, user_id, status, created_at, acked_at, expires_at, failure_reason, ack_device_id, ack_platform, ack_app_version, ack_os_version, sent_at, received_at
+FROM test_runs
+WHERE ($1::text IS NULL OR user_id = $1)
+  AND ($2::text IS NULL OR status = $2)
+  AND created_at >= $3
+  AND ($4::timestamptz IS NULL
+       OR (created_at, nonce) < ($4, $5::text))
+ORDER BY created_at DESC, nonce DESC
+LIMIT $6
+`
+
+type ListTestRunsParams struct {
+	UserID          pgtype.Text        `json:"user_id"`
+	Status          pgtype.Text        `json:"status"`
+	Since           pgtype.Timestamptz `json:"since"`
+	CursorCreatedAt pgtype.Timestamptz `json:"cursor_created_at"`
+	CursorNonce     pgtype.Text        `json:"cursor_nonce"`
+	LimitCount      int32              `json:"limit_count"`
+}
+
+// Newest first; the cursor is the (created_at, nonce) of the last run of the previous page
+func (q *Queries) ListTestRuns(ctx context.Context, arg ListTestRunsParams) ([]TestRun, error) {
+	rows, err := q.db.Query(ctx, listTestRuns,
+		arg.UserID,
+		arg.Status,
+		arg.Since,
+		arg.CursorCreatedAt,
+		arg.CursorNonce,
+		arg.LimitCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []TestRun
+	for rows.Next() {
+		var i TestRun
+		if err := rows.Scan(
+			&i.Nonce,
+			&i.UserID,
+			&i.Status,
+			&i.CreatedAt,
+			&i.AckedAt,
+			&i.ExpiresAt,
+			&i.FailureReason,
+			&i.AckDeviceID,
+			&i.AckPlatform,
+			&i.AckAppVersion,
+			&i.AckOsVersion,
+			&i.SentAt,
+			&i.ReceivedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listWebhookDeadLetters = `-- name: ListWebhookDeadLetters :many
+SELECT delivery_id, subscription_id, event_id, event_type, payload, attempts, last_error, created_at, failed_at
+FROM webhook_dead_letters
+WHERE subscription_id = $1
+ORDER BY failed_at DESC, delivery_id DESC
+LIMIT $2
+`
+
+type ListWebhookDeadLettersParams struct {
+	SubscriptionID string `json:"subscription_id"`
+	LimitCount     int32  `json:"limit_count"`
+}
+
+// Newest first
+func (q *Queries) ListWebhookDeadLetters(ctx context.Context, arg ListWebhookDeadLettersParams) ([]WebhookDeadLetter, error) {
+	rows, err := q.db.Query(ctx, listWebhookDeadLetters, arg.SubscriptionID, arg.LimitCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WebhookDeadLetter
+	for rows.Next() {
+		var i WebhookDeadLetter
+		if err := rows.Scan(
+			&i.DeliveryID,
+			&i.SubscriptionID,
+			&i.EventID,
+			&i.EventType,
+			&i.Payload,
+			&i.Attempts,
+			&i.LastError,
+			&i.CreatedAt,
+			&i.FailedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listWebhookSubscriptions = `-- name: ListWebhookSubscriptions :many
+SELECT subscription_id, url, event_types, secret, description, created_at
+FROM webhook_subscriptions
+ORDER BY created_at, subscription_id
+`
+
+func (q *Queries) ListWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	rows, err := q.db.Query(ctx, listWebhookSubscriptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WebhookSubscription
+	for rows.Next() {
+		var i WebhookSubscription
+		if err := rows.Scan(
+			&i.SubscriptionID,
+			&i.Url,
+			&i.EventTypes,
+			&i.Secret,
+			&i.Description,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const markMessageDeliverySendFailed = `-- name: MarkMessageDeliverySendFailed :exec
+UPDATE message_deliveries
+SET status = 'SEND_FAILED', failure_reason = $3
+WHERE message_id = $1 AND device_id = $2 AND status = 'PENDING'
+`
+
+type MarkMessageDeliverySendFailedParams struct {
+	MessageID     string      `json:"message_id"`
+	DeviceID      string      `json:"device_id"`
+	FailureReason pgtype.Text `json:"failure_reason"`
+}
+
+func (q *Queries) MarkMessageDeliverySendFailed(ctx context.Context, arg MarkMessageDeliverySendFailedParams) error {
+	_, err := q.db.Exec(ctx, markMessageDeliverySendFailed, arg.MessageID, arg.DeviceID, arg.FailureReason)
+	return err
+}
+
+const markMessageDeliverySent = `-- name: MarkMessageDeliverySent :exec
+UPDATE message_deliveries
+SET status = 'SENT', sent_at = NOW()
+WHERE message_id = $1 AND device_id = $2 AND status = 'PENDING'
+`
+
+type MarkMessageDeliverySentParams struct {
+	MessageID string `json:"message_id"`
+	DeviceID  string `json:"device_id"`
+}
+
+func (q *Queries) MarkMessageDeliverySent(ctx context.Context, arg MarkMessageDeliverySentParams) error {
+	_, err := q.db.Exec(ctx, markMessageDeliverySent, arg.MessageID, arg.DeviceID)
+	return err
+}
+
+const markTestRunDeliverySendFailed = `-- name: MarkTestRunDeliverySendFailed :exec
+UPDATE test_run_deliveries
+SET status = 'SEND_FAILED', failure_reason = $3
+WHERE nonce = $1 AND device_id = $2 AND status = 'PENDING'
+`
+
+type MarkTestRunDeliverySendFailedParams struct {
+	Nonce         string      `json:"nonce"`
+	DeviceID      string      `json:"device_id"`
+	FailureReason pgtype.Text `json:"failure_reason"`
+}
+
+func (q *Queries) MarkTestRunDeliverySendFailed(ctx context.Context, arg MarkTestRunDeliverySendFailedParams) error {
+	_, err := q.db.Exec(ctx, markTestRunDeliverySendFailed, arg.Nonce, arg.DeviceID, arg.FailureReason)
+	return err
+}
+
+const markTestRunDeliverySent = `-- name: MarkTestRunDeliverySent :exec
+UPDATE test_run_deliveries
+SET status = CASE WHEN status = 'PENDING' THEN 'SENT' ELSE status END, sent_at = NOW()
+WHERE nonce = $1 AND device_id = $2 AND status IN ('PENDING', 'ACKED')
+`
+
+type MarkTestRunDeliverySentParams struct {
+	Nonce    string `json:"nonce"`
+	DeviceID string `json:"device_id"`
+}
+
+// A device may ack before the send returns; its delivery then stays ACKED
+func (q *Queries) MarkTestRunDeliverySent(ctx context.Context, arg MarkTestRunDeliverySentParams) error {
+	_, err := q.db.Exec(ctx, markTestRunDeliverySent, arg.Nonce, arg.DeviceID)
+	return err
+}
+
+const markTestRunSendFailed = `-- name: MarkTestRunSendFailed :exec
+UPDATE test_runs
+SET status = 'SEND_FAILED', failure_reason = $2
+WHERE nonce = $1 AND status = 'PENDING'
+`
+
+type MarkTestRunSendFailedParams struct {
+	Nonce         string      `json:"nonce"`
+	FailureReason pgtype.Text `json:"failure_reason"`
+}
+
+func (q *Queries) MarkTestRunSendFailed(ctx context.Context, arg MarkTestRunSendFailedParams) error {
+	_, err := q.db.Exec(ctx, markTestRunSendFailed, arg.Nonce, arg.FailureReason)
+	return err
+}
+
+const recordBroadcastSends = `-- name: RecordBroadcastSends :one
+UPDATE broadcasts
+SET sent_count = sent_count + $1::int,
+    failed_count = failed_count + $2::int,
+    updated_at = NOW()
+WHERE broadcast_id = $3
+RETURNING broadcast_id, message, batch_size, status, failure_reason, total_devices, last_device_id, sent_count, failed_count, suppressed_count, lease_expires_at, created_at, updated_at, completed_at
+`
+
+type RecordBroadcastSendsParams struct {
+	Sent        int32  `json:"sent"`
+	Failed      int32  `json:"failed"`
+	BroadcastID string `json:"broadcast_id"`
+}
+
+// Counts the sends of a checkpointed batch that were published; sends left to the relay are not counted
+func (q *Queries) RecordBroadcastSends(ctx context.Context, arg RecordBroadcastSendsParams) (Broadcast, error) {
+	row := q.db.QueryRow(ctx, recordBroadcastSends, arg.Sent, arg.Failed, arg.BroadcastID)
+	var i Broadcast
+	err := row.Scan(
+		&i.BroadcastID,
+		&i.Message,
+		&i.BatchSize,
+		&i.Status,
+		&i.FailureReason,
+		&i.TotalDevices,
+		&i.LastDeviceID,
+		&i.SentCount,
+		&i.FailedCount,
+		&i.SuppressedCount,
+		&i.LeaseExpiresAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.CompletedAt,
+	)
+	return i, err
+}
+
+const recordMessageReceipt = `-- name: RecordMessageReceipt :one
+UPDATE message_deliveries
+SET delivered_at = COALESCE(delivered_at, NOW()),
+    opened_at = CASE WHEN $1::text = 'opened' THEN COALESCE(opened_at, NOW()) ELSE opened_at END,
+    dismissed_at = CASE WHEN $1::text = 'dismissed' THEN COALESCE(dismissed_at, NOW()) ELSE dismissed_at END
+WHERE message_id = $2 AND device_id = $3 AND status IN ('PENDING', 'SENT')
+RETURNING message_id, device_id, platform, app_id, status, failure_reason, sent_at, delivered_at, opened_at, dismissed_at, campaign_id, variant
+`
+
+type RecordMessageReceiptParams struct {
+	Event     string `json:"event"`
+	MessageID string `json:"message_id"`
+	DeviceID  string `json:"device_id"`
+}
+
+// Each event keeps the time it was first reported; opened and dismissed imply delivered.
+// A receipt may arrive before the send returns, so PENDING deliveries accept it too.
+func (q *Queries) RecordMessageReceipt(ctx context.Context, arg RecordMessageReceiptParams) (MessageDelivery, error) {
+	row := q.db.QueryRow(ctx, recordMessageReceipt, arg.Event, arg.MessageID, arg.DeviceID)
+	var i MessageDelivery
+	err := row.Scan(
+		&i.MessageID,
+		&i.DeviceID,
+		&i.Platform,
+		&i.AppID,
+		&i.Status,
+		&i.FailureReason,
+		&i.SentAt,
+		&i.DeliveredAt,
+		&i.OpenedAt,
+		&i.DismissedAt,
+		&i.CampaignID,
+		&i.Variant,
+	)
+	return i, err
+}
+
+const releaseBroadcast = `-- name: ReleaseBroadcast :exec
+UPDATE broadcasts
+SET lease_expires_at = NULL, updated_at = NOW()
+WHERE broadcast_id = $1 AND status = 'RUNNING' AND lease_expires_at = $2
+`
+
+type ReleaseBroadcastParams struct {
+	BroadcastID    string             `json:"broadcast_id"`
+	LeaseExpiresAt pgtype.Timestamptz `json:"lease_expires_at"`
+}
+
+// Gives up a lease, so the next invocation can resume the broadcast without waiting for it to expire
+func (q *Queries) ReleaseBroadcast(ctx context.Context, arg ReleaseBroadcastParams) error {
+	_, err := q.db.Exec(ctx, releaseBroadcast, arg.BroadcastID, arg.LeaseExpiresAt)
+	return err
+}
+
+const retryOutboxEntry = `-- name: RetryOutboxEntry :exec
+UPDATE outbox
+SET available_at = $2, last_error = $3
+WHERE outbox_id = $1
+`
+
+type RetryOutboxEntryParams struct {
+	OutboxID    int64              `json:"outbox_id"`
+	AvailableAt pgtype.Timestamptz `json:"available_at"`
+	LastError   pgtype.Text        `json:"last_error"`
+}
+
+func (q *Queries) RetryOutboxEntry(ctx context.Context, arg RetryOutboxEntryParams) error {
+	_, err := q.db.Exec(ctx, retryOutboxEntry, arg.OutboxID, arg.AvailableAt, arg.LastError)
+	return err
+}
+
+const retryWebhookDelivery = `-- name: RetryWebhookDelivery :exec
+UPDATE webhook_deliveries
+SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3
+WHERE delivery_id = $1
+`
+
+type RetryWebhookDeliveryParams struct {
+	DeliveryID    int64              `json:"delivery_id"`
+	NextAttemptAt pgtype.Timestamptz `json:"next_attempt_at"`
+	LastError     pgtype.Text        `json:"last_error"`
+}
+
+func (q *Queries) RetryWebhookDelivery(ctx context.Context, arg RetryWebhookDeliveryParams) error {
+	_, err := q.db.Exec(ctx, retryWebhookDelivery, arg.DeliveryID, arg.NextAttemptAt, arg.LastError)
+	return err
+}
+
+const upsertCampaign = `-- name: UpsertCampaign :one
+INSERT INTO campaigns (campaign_id, description, category, holdout_percent, created_at, updated_at)
+VALUES ($1, $2, $3, $4, NOW(), NOW())
+ON CONFLICT (campaign_id)
+DO UPDATE SET
+    description = EXCLUDED.description,
+    category = EXCLUDED.category,
+    holdout_percent = EXCLUDED.holdout_percent,
+    updated_at = NOW()
+RETURNING campaign_id, description, category, holdout_percent, created_at, updated_at
+`
+
+type UpsertCampaignParams struct {
+	CampaignID     string `json:"campaign_id"`
+	Description    string `json:"description"`
+	Category       string `json:"category"`
+	HoldoutPercent int32  `json:"holdout_percent"`
+}
+
+func (q *Queries) UpsertCampaign(ctx context.Context, arg UpsertCampaignParams) (Campaign, error) {
+	row := q.db.QueryRow(ctx, upsertCampaign,
+		arg.CampaignID,
+		arg.Description,
+		arg.Category,
+		arg.HoldoutPercent,
+	)
+	var i Campaign
+	err := row.Scan(
+		&i.CampaignID,
+		&i.Description,
+		&i.Category,
+		&i.HoldoutPercent,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const upsertCampaignAssignment = `-- name: UpsertCampaignAssignment :exec
+INSERT INTO campaign_assignments (campaign_id, user_id, variant, assigned_at)
+VALUES ($1, $2, $3, NOW())
+ON CONFLICT (campaign_id, user_id)
+DO UPDATE SET variant = EXCLUDED.variant
+`
+
+type UpsertCampaignAssignmentParams struct {
+	CampaignID string      `json:"campaign_id"`
+	UserID     string      `json:"user_id"`
+	Variant    pgtype.Text `json:"variant"`
+}
+
+// Keeps the time of the first assignment. The variant only changes if the campaign's variants were replaced.
+func (q *Queries) UpsertCampaignAssignment(ctx context.Context, arg UpsertCampaignAssignmentParams) error {
+	_, err := q.db.Exec(ctx, upsertCampaignAssignment, arg.CampaignID, arg.UserID, arg.Variant)
+	return err
+}
+
+const upsertDevice = `-- name: UpsertDevice :exec
+INSERT INTO devices (user_id, device_id, platform, app_id, fcm_token, token_type, locale, app_version, os_version, device_model, timezone, sdk_version, is_active, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, TRUE, NOW())
+ON CONFLICT (user_id, device_id)
+DO UPDATE SET
+    app_id = EXCLUDED.app_id,
+    fcm_token = EXCLUDED.fcm_token,
+    token_type = EXCLUDED.token_type,
+    locale = EXCLUDED.locale,
+    app_version = EXCLUDED.app_version,
+    os_version = EXCLUDED.os_version,
+    device_model = EXCLUDED.device_model,
+    timezone = EXCLUDED.timezone,
+    sdk_version = EXCLUDED.sdk_version,
+    is_active = TRUE,
+    updated_at = NOW()
+`
+
+type UpsertDeviceParams struct {
+	UserID      string      `json:"user_id"`
+	DeviceID    string      `json:"device_id"`
+	Platform    string      `json:"platform"`
+	AppID       string      `json:"app_id"`
+	FcmToken    string      `json:"fcm_token"`
+	TokenType   string      `json:"token_type"`
+	Locale      pgtype.Text `json:"locale"`
+	AppVersion  pgtype.Text `json:"app_version"`
+	OsVersion   pgtype.Text `json:"os_version"`
+	DeviceModel pgtype.Text `json:"device_model"`
+	Timezone    pgtype.Text `json:"timezone"`
+	SdkVersion  pgtype.Text `json:"sdk_version"`
+}
+
+func (q *Queries) UpsertDevice(ctx context.Context, arg UpsertDeviceParams) error {
+	_, err := q.db.Exec(ctx, upsertDevice,
+		arg.UserID,
+		arg.DeviceID,
+		arg.Platform,
+		arg.AppID,
+		arg.FcmToken,
+		arg.TokenType,
+		arg.Locale,
+		arg.AppVersion,
+		arg.OsVersion,
+		arg.DeviceModel,
+		arg.Timezone,
+		arg.SdkVersion,
+	)
+	return err
+}
+
+const upsertSegment = `-- name: UpsertSegment :one
+INSERT INTO segments (segment_id, description, expression, created_at, updated_at)
+VALUES ($1, $2, $3, NOW(), NOW())
+ON CONFLICT (segment_id)
+DO UPDATE SET
+    description = EXCLUDED.description,
+    expression = EXCLUDED.expression,
+    updated_at = NOW()
+RETURNING segment_id, description, expression, created_at, updated_at
+`
+
+type UpsertSegmentParams struct {
+	SegmentID   string `json:"segment_id"`
+	Description string `json:"description"`
+	Expression  string `json:"expression"`
+}
+
+func (q *Queries) UpsertSegment(ctx context.Context, arg UpsertSegmentParams) (Segment, error) {
+	row := q.db.QueryRow(ctx, upsertSegment, arg.SegmentID, arg.Description, arg.Expression)
+	var i Segment
+	err := row.Scan(
+		&i.SegmentID,
+		&i.Description,
+		&i.Expression,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const upsertTemplate = `-- name: UpsertTemplate :one
+INSERT INTO templates (template_key, locale, title, body, default_data, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+ON CONFLICT (template_key, locale)
+DO UPDATE SET
+    title = EXCLUDED.title,
+    body = EXCLUDED.body,
+    default_data = EXCLUDED.default_data,
+    updated_at = NOW()
+RETURNING template_key, locale, title, body, default_data, created_at, updated_at
+`
+
+type UpsertTemplateParams struct {
+	TemplateKey string `json:"template_key"`
+	Locale      string `json:"locale"`
+	Title       string `json:"title"`
+	Body        string `json:"body"`
+	DefaultData []byte `json:"default_data"`
+}
+
+func (q *Queries) UpsertTemplate(ctx context.Context, arg UpsertTemplateParams) (Template, error) {
+	row := q.db.QueryRow(ctx, upsertTemplate,
+		arg.TemplateKey,
+		arg.Locale,
+		arg.Title,
+		arg.Body,
+		arg.DefaultData,
+	)
+	var i Template
+	err := row.Scan(
+		&i.TemplateKey,
+		&i.Locale,
+		&i.Title,
+		&i.Body,
+		&i.DefaultData,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
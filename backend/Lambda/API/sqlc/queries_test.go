@@ -0,0 +1,1096 @@
+package sqlc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fcm-tutorial/lambda/api/internal/testdb"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	testPool      *pgxpool.Pool // nil if no Postgres is available
+	testDBSkipMsg string
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	ctx := context.Background()
+
+	server, err := testdb.Start(ctx)
+	switch {
+	case errors.Is(err, testdb.ErrUnavailable):
+		testDBSkipMsg = err.Error()
+		return m.Run()
+	case err != nil:
+		log.Fatalf("failed to start test database: %v", err)
+	}
+	defer server.Stop(ctx)
+
+	dbURL, err := server.NewDatabase(ctx)
+	if err != nil {
+		log.Fatalf("failed to create test database: %v", err)
+	}
+	testPool, err = pgxpool.New(ctx, dbURL)
+	if err != nil {
+		log.Fatalf("failed to connect to test database: %v", err)
+	}
+	defer testPool.Close()
+
+	return m.Run()
+}
+
+// newQueries skips the test if no Postgres is available and otherwise returns
+// queries against emptied tables.
+func newQueries(t *testing.T) *sqlc.Queries {
+	t.Helper()
+	if testPool == nil {
+		t.Skip(testDBSkipMsg)
+	}
+	if _, err := testPool.Exec(context.Background(), "TRUNCATE devices, test_runs, test_run_deliveries, messages, message_deliveries, templates, notification_preferences, segments, broadcasts, campaigns, campaign_variants, campaign_assignments, webhook_subscriptions, webhook_deliveries, webhook_dead_letters, outbox RESTART IDENTITY"); err != nil {
+		t.Fatalf("failed to reset test database: %v", err)
+	}
+	return sqlc.New(testPool)
+}
+
+func TestDeviceQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	if _, err := queries.GetDeviceByDeviceID(ctx, "device-1"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+
+	devices := []sqlc.UpsertDeviceParams{
+		{UserID: "user-1", DeviceID: "device-1", Platform: "android", AppID: "default", FcmToken: "token-1", TokenType: "fcm"},
+		{UserID: "user-1", DeviceID: "device-2", Platform: "ios", AppID: "shop", FcmToken: "token-2", TokenType: "fcm"},
+		{UserID: "user-2", DeviceID: "device-3", Platform: "android", AppID: "default", FcmToken: "token-3", TokenType: "fcm"},
+	}
+	for _, device := range devices {
+		if err := queries.UpsertDevice(ctx, device); err != nil {
+			t.Fatalf("UpsertDevice(%s) failed: %v", device.DeviceID, err)
+		}
+	}
+
+	device, err := queries.GetDeviceByDeviceID(ctx, "device-2")
+	if err != nil {
+		t.Fatalf("GetDeviceByDeviceID failed: %v", err)
+	}
+	if device.UserID != "user-1" || device.Platform != "ios" || device.AppID != "shop" ||
+		device.FcmToken != "token-2" || !device.IsActive || !device.UpdatedAt.Valid {
+		t.Fatalf("unexpected device: %+v", device)
+	}
+
+	// Upserting an existing (user_id, device_id) updates app, token, token type and locale
+	err = queries.UpsertDevice(ctx, sqlc.UpsertDeviceParams{
+		UserID: "user-1", DeviceID: "device-2", Platform: "ios", AppID: "news", FcmToken: "token-2b", TokenType: "apns",
+		Locale: pgtype.Text{String: "pt-BR", Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("UpsertDevice update failed: %v", err)
+	}
+	device, err = queries.GetDeviceByDeviceID(ctx, "device-2")
+	if err != nil {
+		t.Fatalf("GetDeviceByDeviceID failed: %v", err)
+	}
+	if device.AppID != "news" || device.FcmToken != "token-2b" {
+		t.Fatalf("upsert did not update device: %+v", device)
+	}
+
+	active, err := queries.ListActiveDevicesByPlatforms(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("ListActiveDevicesByPlatforms failed: %v", err)
+	}
+	if len(active) != 2 {
+		t.Fatalf("expected 2 active devices for user-1, got %d", len(active))
+	}
+	for _, device := range active {
+		if (device.DeviceID == "device-2") != (device.Locale.String == "pt-BR") {
+			t.Fatalf("unexpected device locale: %+v", device)
+		}
+		if (device.DeviceID == "device-2") != (device.TokenType == "apns") {
+			t.Fatalf("unexpected device token type: %+v", device)
+		}
+	}
+
+	// APNs tokens only belong to iOS devices
+	err = queries.UpsertDevice(ctx, sqlc.UpsertDeviceParams{
+		UserID: "user-1", DeviceID: "device-4", Platform: "android", AppID: "default", FcmToken: "token-4", TokenType: "apns",
+	})
+	if err == nil {
+		t.Fatal("expected an APNs token of an android device to be rejected")
+	}
+
+	// Inactive devices are not listed
+	if _, err := testPool.Exec(ctx, "UPDATE devices SET is_active = FALSE WHERE device_id = 'device-1'"); err != nil {
+		t.Fatalf("failed to deactivate device: %v", err)
+	}
+	active, err = queries.ListActiveDevicesByPlatforms(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("ListActiveDevicesByPlatforms failed: %v", err)
+	}
+	if len(active) != 1 || active[0].DeviceID != "device-2" {
+		t.Fatalf("expected only device-2 to be active, got %+v", active)
+	}
+
+	// A token is only invalidated while the device still has it
+	if n, err := queries.DeactivateDeviceToken(ctx, sqlc.DeactivateDeviceTokenParams{DeviceID: "device-2", FcmToken: "token-2"}); err != nil || n != 0 {
+		t.Fatalf("DeactivateDeviceToken with an old token = %d, %v", n, err)
+	}
+	if n, err := queries.DeactivateDeviceToken(ctx, sqlc.DeactivateDeviceTokenParams{DeviceID: "device-2", FcmToken: "token-2b"}); err != nil || n != 1 {
+		t.Fatalf("DeactivateDeviceToken = %d, %v", n, err)
+	}
+	if device, err := queries.GetDeviceByDeviceID(ctx, "device-2"); err != nil || device.IsActive {
+		t.Fatalf("device not deactivated: %+v, %v", device, err)
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	text := func(value string) pgtype.Text { return pgtype.Text{String: value, Valid: true} }
+	devices := []sqlc.UpsertDeviceParams{
+		{UserID: "user-1", DeviceID: "device-1", Platform: "android", AppID: "default", FcmToken: "token-1", TokenType: "fcm",
+			AppVersion: text("1.4.0"), OsVersion: text("Android 14"), DeviceModel: text("Pixel 8"), Timezone: text("Europe/Lisbon"), SdkVersion: text("34")},
+		{UserID: "user-1", DeviceID: "device-2", Platform: "ios", AppID: "default", FcmToken: "token-2", TokenType: "fcm", AppVersion: text("1.5.0")},
+		{UserID: "user-2", DeviceID: "device-3", Platform: "android", AppID: "default", FcmToken: "token-3", TokenType: "fcm", AppVersion: text("1.5.0")},
+	}
+	for _, device := range devices {
+		if err := queries.UpsertDevice(ctx, device); err != nil {
+			t.Fatalf("UpsertDevice(%s) failed: %v", device.DeviceID, err)
+		}
+	}
+
+	all, err := queries.ListDevices(ctx, sqlc.ListDevicesParams{LimitCount: 10})
+	if err != nil {
+		t.Fatalf("ListDevices failed: %v", err)
+	}
+	if len(all) != 3 || all[0].DeviceID != "device-1" || all[0].DeviceModel.String != "Pixel 8" ||
+		all[0].Timezone.String != "Europe/Lisbon" || all[0].SdkVersion.String != "34" {
+		t.Fatalf("unexpected devices: %+v", all)
+	}
+
+	filtered, err := queries.ListDevices(ctx, sqlc.ListDevicesParams{
+		AppVersion: text("1.5.0"), Platform: text("android"), IsActive: pgtype.Bool{Bool: true, Valid: true}, LimitCount: 10,
+	})
+	if err != nil {
+		t.Fatalf("ListDevices failed: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].DeviceID != "device-3" {
+		t.Fatalf("expected only device-3, got %+v", filtered)
+	}
+
+	// The next page starts after the id of the last device
+	page, err := queries.ListDevices(ctx, sqlc.ListDevicesParams{AfterID: all[0].ID, LimitCount: 1})
+	if err != nil {
+		t.Fatalf("ListDevices failed: %v", err)
+	}
+	if len(page) != 1 || page[0].DeviceID != "device-2" {
+		t.Fatalf("expected device-2 after device-1, got %+v", page)
+	}
+}
+
+func TestTestRunQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	if _, err := queries.GetTestRunByNonce(ctx, "nonce-1"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+
+	params := sqlc.CreateTestRunParams{Nonce: "nonce-1", UserID: "user-1", ExpiresAt: timeFromNow(time.Minute)}
+	if created, err := queries.CreateTestRun(ctx, params); err != nil || created != 1 {
+		t.Fatalf("CreateTestRun = %d, %v; want 1 row created", created, err)
+	}
+	// Creating the same nonce again is a no-op
+	params.UserID = "user-2"
+	if created, err := queries.CreateTestRun(ctx, params); err != nil || created != 0 {
+		t.Fatalf("CreateTestRun with duplicate nonce = %d, %v; want 0 rows created", created, err)
+	}
+
+	testRun, err := queries.GetTestRunByNonce(ctx, "nonce-1")
+	if err != nil {
+		t.Fatalf("GetTestRunByNonce failed: %v", err)
+	}
+	if testRun.UserID != "user-1" || testRun.Status != "PENDING" || testRun.AckedAt.Valid || !testRun.CreatedAt.Valid || !testRun.ExpiresAt.Valid {
+		t.Fatalf("unexpected test run: %+v", testRun)
+	}
+
+	acked, err := queries.AckTestRun(ctx, sqlc.AckTestRunParams{
+		Nonce:         "nonce-1",
+		AckDeviceID:   pgtype.Text{String: "device-1", Valid: true},
+		AckPlatform:   pgtype.Text{String: "android", Valid: true},
+		AckAppVersion: pgtype.Text{String: "1.0", Valid: true},
+		AckOsVersion:  pgtype.Text{String: "Android 15", Valid: true},
+		SentAt:        timeFromNow(-2 * time.Second),
+		ReceivedAt:    timeFromNow(-time.Second),
+	})
+	if err != nil {
+		t.Fatalf("AckTestRun failed: %v", err)
+	}
+	if acked.Status != "ACKED" || !acked.AckedAt.Valid {
+		t.Fatalf("unexpected acked test run: %+v", acked)
+	}
+	if acked.AckDeviceID.String != "device-1" || acked.AckPlatform.String != "android" || acked.AckAppVersion.String != "1.0" ||
+		acked.AckOsVersion.String != "Android 15" || !acked.SentAt.Valid || !acked.ReceivedAt.Valid {
+		t.Fatalf("ack metadata not stored: %+v", acked)
+	}
+
+	// Only PENDING runs can be acknowledged
+	if _, err := queries.AckTestRun(ctx, sqlc.AckTestRunParams{Nonce: "nonce-1"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows for second ack, got %v", err)
+	}
+	if _, err := queries.AckTestRun(ctx, sqlc.AckTestRunParams{Nonce: "unknown"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows for unknown nonce, got %v", err)
+	}
+}
+
+// timeFromNow returns a timestamp d from now (negative for the past).
+func timeFromNow(d time.Duration) pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: time.Now().Add(d), Valid: true}
+}
+
+func TestTestRunExpiryQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	runs := []sqlc.CreateTestRunParams{
+		{Nonce: "expired-1", UserID: "user-1", ExpiresAt: timeFromNow(-time.Minute)},
+		{Nonce: "expired-2", UserID: "user-1", ExpiresAt: timeFromNow(-time.Second)},
+		{Nonce: "pending", UserID: "user-1", ExpiresAt: timeFromNow(time.Minute)},
+	}
+	for _, run := range runs {
+		if _, err := queries.CreateTestRun(ctx, run); err != nil {
+			t.Fatalf("CreateTestRun(%s) failed: %v", run.Nonce, err)
+		}
+	}
+
+	// Runs past expires_at can no longer be acknowledged
+	if _, err := queries.AckTestRun(ctx, sqlc.AckTestRunParams{Nonce: "expired-1"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows acking an expired run, got %v", err)
+	}
+
+	expired, err := queries.ExpireTestRun(ctx, "expired-1")
+	if err != nil {
+		t.Fatalf("ExpireTestRun failed: %v", err)
+	}
+	if expired.Status != "EXPIRED" || !expired.FailureReason.Valid {
+		t.Fatalf("unexpected expired run: %+v", expired)
+	}
+	if _, err := queries.ExpireTestRun(ctx, "pending"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows expiring a run before expires_at, got %v", err)
+	}
+
+	count, err := queries.ExpirePendingTestRuns(ctx)
+	if err != nil {
+		t.Fatalf("ExpirePendingTestRuns failed: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 run to be expired by the sweep, got %d", count)
+	}
+
+	pending, err := queries.GetTestRunByNonce(ctx, "pending")
+	if err != nil {
+		t.Fatalf("GetTestRunByNonce failed: %v", err)
+	}
+	if pending.Status != "PENDING" {
+		t.Fatalf("run before expires_at was expired: %+v", pending)
+	}
+}
+
+func TestMarkTestRunSendFailed(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	if _, err := queries.CreateTestRun(ctx, sqlc.CreateTestRunParams{Nonce: "nonce-1", UserID: "user-1", ExpiresAt: timeFromNow(time.Minute)}); err != nil {
+		t.Fatalf("CreateTestRun failed: %v", err)
+	}
+
+	err := queries.MarkTestRunSendFailed(ctx, sqlc.MarkTestRunSendFailedParams{
+		Nonce:         "nonce-1",
+		FailureReason: pgtype.Text{String: "FCM unavailable", Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("MarkTestRunSendFailed failed: %v", err)
+	}
+
+	testRun, err := queries.GetTestRunByNonce(ctx, "nonce-1")
+	if err != nil {
+		t.Fatalf("GetTestRunByNonce failed: %v", err)
+	}
+	if testRun.Status != "SEND_FAILED" || testRun.FailureReason.String != "FCM unavailable" {
+		t.Fatalf("unexpected test run: %+v", testRun)
+	}
+
+	if _, err := queries.AckTestRun(ctx, sqlc.AckTestRunParams{Nonce: "nonce-1"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows acking a failed run, got %v", err)
+	}
+}
+
+func TestTestRunDeliveryQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	if _, err := queries.CreateTestRun(ctx, sqlc.CreateTestRunParams{Nonce: "nonce-1", UserID: "user-1", ExpiresAt: timeFromNow(time.Minute)}); err != nil {
+		t.Fatalf("CreateTestRun failed: %v", err)
+	}
+	for _, deviceID := range []string{"device-1", "device-2", "device-3"} {
+		err := queries.CreateTestRunDelivery(ctx, sqlc.CreateTestRunDeliveryParams{
+			Nonce: "nonce-1", DeviceID: deviceID, Platform: "android", AppID: "default",
+		})
+		if err != nil {
+			t.Fatalf("CreateTestRunDelivery(%s) failed: %v", deviceID, err)
+		}
+	}
+
+	// Deliveries reference an existing run
+	err := queries.CreateTestRunDelivery(ctx, sqlc.CreateTestRunDeliveryParams{
+		Nonce: "unknown", DeviceID: "device-1", Platform: "android", AppID: "default",
+	})
+	if err == nil {
+		t.Fatal("expected foreign key violation for a delivery of an unknown run")
+	}
+
+	// device-1 acks before its send is marked, device-2 is sent normally, device-3 fails
+	if _, err := queries.AckTestRunDelivery(ctx, sqlc.AckTestRunDeliveryParams{
+		Nonce: "nonce-1", DeviceID: "device-1", AppVersion: pgtype.Text{String: "1.0", Valid: true},
+	}); err != nil {
+		t.Fatalf("AckTestRunDelivery failed: %v", err)
+	}
+	for _, deviceID := range []string{"device-1", "device-2"} {
+		if err := queries.MarkTestRunDeliverySent(ctx, sqlc.MarkTestRunDeliverySentParams{Nonce: "nonce-1", DeviceID: deviceID}); err != nil {
+			t.Fatalf("MarkTestRunDeliverySent(%s) failed: %v", deviceID, err)
+		}
+	}
+	err = queries.MarkTestRunDeliverySendFailed(ctx, sqlc.MarkTestRunDeliverySendFailedParams{
+		Nonce: "nonce-1", DeviceID: "device-3", FailureReason: pgtype.Text{String: "UNREGISTERED", Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("MarkTestRunDeliverySendFailed failed: %v", err)
+	}
+
+	// A device can only ack once, and a failed delivery cannot be acked
+	for _, deviceID := range []string{"device-1", "device-3"} {
+		if _, err := queries.AckTestRunDelivery(ctx, sqlc.AckTestRunDeliveryParams{Nonce: "nonce-1", DeviceID: deviceID}); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("expected pgx.ErrNoRows acking %s, got %v", deviceID, err)
+		}
+	}
+
+	deliveries, err := queries.ListTestRunDeliveries(ctx, "nonce-1")
+	if err != nil {
+		t.Fatalf("ListTestRunDeliveries failed: %v", err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 deliveries, got %+v", deliveries)
+	}
+	if d := deliveries[0]; d.Status != "ACKED" || !d.AckedAt.Valid || !d.SentAt.Valid || d.AppVersion.String != "1.0" {
+		t.Fatalf("unexpected delivery to device-1: %+v", d)
+	}
+	if d := deliveries[1]; d.Status != "SENT" || !d.SentAt.Valid || d.AckedAt.Valid {
+		t.Fatalf("unexpected delivery to device-2: %+v", d)
+	}
+	if d := deliveries[2]; d.Status != "SEND_FAILED" || d.FailureReason.String != "UNREGISTERED" {
+		t.Fatalf("unexpected delivery to device-3: %+v", d)
+	}
+
+	// Deliveries of an expired run can no longer be acked
+	if _, err := testPool.Exec(ctx, "UPDATE test_runs SET expires_at = NOW() - INTERVAL '1 second'"); err != nil {
+		t.Fatalf("failed to expire test run: %v", err)
+	}
+	if _, err := queries.AckTestRunDelivery(ctx, sqlc.AckTestRunDeliveryParams{Nonce: "nonce-1", DeviceID: "device-2"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows acking a delivery of an expired run, got %v", err)
+	}
+}
+
+func TestTestRunHistoryQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	// Runs are created in order, so created_at increases with the nonce
+	for _, run := range []struct{ nonce, userID string }{
+		{"nonce-1", "user-1"}, {"nonce-2", "user-1"}, {"nonce-3", "user-2"}, {"nonce-4", "user-1"},
+	} {
+		if _, err := queries.CreateTestRun(ctx, sqlc.CreateTestRunParams{Nonce: run.nonce, UserID: run.userID, ExpiresAt: timeFromNow(time.Minute)}); err != nil {
+			t.Fatalf("CreateTestRun(%s) failed: %v", run.nonce, err)
+		}
+	}
+	if _, err := queries.AckTestRun(ctx, sqlc.AckTestRunParams{Nonce: "nonce-2"}); err != nil {
+		t.Fatalf("AckTestRun failed: %v", err)
+	}
+	if err := queries.MarkTestRunSendFailed(ctx, sqlc.MarkTestRunSendFailedParams{
+		Nonce: "nonce-1", FailureReason: pgtype.Text{String: "no devices", Valid: true},
+	}); err != nil {
+		t.Fatalf("MarkTestRunSendFailed failed: %v", err)
+	}
+
+	since := timeFromNow(-time.Hour)
+	firstPage, err := queries.ListTestRuns(ctx, sqlc.ListTestRunsParams{Since: since, LimitCount: 2})
+	if err != nil {
+		t.Fatalf("ListTestRuns failed: %v", err)
+	}
+	if len(firstPage) != 2 || firstPage[0].Nonce != "nonce-4" || firstPage[1].Nonce != "nonce-3" {
+		t.Fatalf("unexpected first page: %+v", firstPage)
+	}
+	last := firstPage[len(firstPage)-1]
+	secondPage, err := queries.ListTestRuns(ctx, sqlc.ListTestRunsParams{
+		Since:           since,
+		CursorCreatedAt: last.CreatedAt,
+		CursorNonce:     pgtype.Text{String: last.Nonce, Valid: true},
+		LimitCount:      2,
+	})
+	if err != nil {
+		t.Fatalf("ListTestRuns after cursor failed: %v", err)
+	}
+	if len(secondPage) != 2 || secondPage[0].Nonce != "nonce-2" || secondPage[1].Nonce != "nonce-1" {
+		t.Fatalf("unexpected second page: %+v", secondPage)
+	}
+
+	filtered, err := queries.ListTestRuns(ctx, sqlc.ListTestRunsParams{
+		UserID:     pgtype.Text{String: "user-1", Valid: true},
+		Status:     pgtype.Text{String: "PENDING", Valid: true},
+		Since:      since,
+		LimitCount: 10,
+	})
+	if err != nil {
+		t.Fatalf("ListTestRuns with filters failed: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].Nonce != "nonce-4" {
+		t.Fatalf("unexpected filtered runs: %+v", filtered)
+	}
+
+	stats, err := queries.GetTestRunStats(ctx, sqlc.GetTestRunStatsParams{
+		UserID: pgtype.Text{String: "user-1", Valid: true},
+		Since:  since,
+		Until:  timeFromNow(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("GetTestRunStats failed: %v", err)
+	}
+	if stats.Total != 3 || stats.Acked != 1 || stats.Pending != 1 || stats.SendFailed != 1 || stats.Expired != 0 ||
+		stats.P50AckLatencyMs < 0 || stats.P95AckLatencyMs < stats.P50AckLatencyMs {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	empty, err := queries.GetTestRunStats(ctx, sqlc.GetTestRunStatsParams{Since: timeFromNow(time.Hour), Until: timeFromNow(2 * time.Hour)})
+	if err != nil {
+		t.Fatalf("GetTestRunStats for an empty window failed: %v", err)
+	}
+	if empty.Total != 0 || empty.P50AckLatencyMs != 0 || empty.P95AckLatencyMs != 0 {
+		t.Fatalf("expected empty stats, got %+v", empty)
+	}
+}
+
+func TestMessageDeliveryQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	if err := queries.CreateMessage(ctx, sqlc.CreateMessageParams{MessageID: "msg-1", UserID: "user-1"}); err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+	for _, deviceID := range []string{"device-1", "device-2", "device-3"} {
+		err := queries.CreateMessageDelivery(ctx, sqlc.CreateMessageDeliveryParams{
+			MessageID: "msg-1", DeviceID: deviceID, Platform: "android", AppID: "default",
+		})
+		if err != nil {
+			t.Fatalf("CreateMessageDelivery(%s) failed: %v", deviceID, err)
+		}
+	}
+
+	// Deliveries reference an existing message
+	err := queries.CreateMessageDelivery(ctx, sqlc.CreateMessageDeliveryParams{
+		MessageID: "unknown", DeviceID: "device-1", Platform: "android", AppID: "default",
+	})
+	if err == nil {
+		t.Fatal("expected foreign key violation for a delivery of an unknown message")
+	}
+
+	// device-1 reports delivery before its send is marked, device-2 is sent normally, device-3 fails
+	delivered, err := queries.RecordMessageReceipt(ctx, sqlc.RecordMessageReceiptParams{Event: "delivered", MessageID: "msg-1", DeviceID: "device-1"})
+	if err != nil {
+		t.Fatalf("RecordMessageReceipt failed: %v", err)
+	}
+	if !delivered.DeliveredAt.Valid || delivered.OpenedAt.Valid || delivered.Status != "PENDING" {
+		t.Fatalf("unexpected delivery after delivered receipt: %+v", delivered)
+	}
+	for _, deviceID := range []string{"device-1", "device-2"} {
+		if err := queries.MarkMessageDeliverySent(ctx, sqlc.MarkMessageDeliverySentParams{MessageID: "msg-1", DeviceID: deviceID}); err != nil {
+			t.Fatalf("MarkMessageDeliverySent(%s) failed: %v", deviceID, err)
+		}
+	}
+	err = queries.MarkMessageDeliverySendFailed(ctx, sqlc.MarkMessageDeliverySendFailedParams{
+		MessageID: "msg-1", DeviceID: "device-3", FailureReason: pgtype.Text{String: "UNREGISTERED", Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("MarkMessageDeliverySendFailed failed: %v", err)
+	}
+
+	// Repeated events keep their first time; opened implies delivered
+	opened, err := queries.RecordMessageReceipt(ctx, sqlc.RecordMessageReceiptParams{Event: "opened", MessageID: "msg-1", DeviceID: "device-1"})
+	if err != nil {
+		t.Fatalf("RecordMessageReceipt failed: %v", err)
+	}
+	if opened.Status != "SENT" || !opened.DeliveredAt.Time.Equal(delivered.DeliveredAt.Time) || !opened.OpenedAt.Valid || opened.DismissedAt.Valid {
+		t.Fatalf("unexpected delivery to device-1: %+v", opened)
+	}
+	dismissed, err := queries.RecordMessageReceipt(ctx, sqlc.RecordMessageReceiptParams{Event: "dismissed", MessageID: "msg-1", DeviceID: "device-2"})
+	if err != nil {
+		t.Fatalf("RecordMessageReceipt failed: %v", err)
+	}
+	if !dismissed.DeliveredAt.Valid || !dismissed.DismissedAt.Valid || dismissed.OpenedAt.Valid {
+		t.Fatalf("unexpected delivery to device-2: %+v", dismissed)
+	}
+
+	// Failed and unknown deliveries take no receipts
+	for _, deviceID := range []string{"device-3", "device-4"} {
+		_, err := queries.RecordMessageReceipt(ctx, sqlc.RecordMessageReceiptParams{Event: "delivered", MessageID: "msg-1", DeviceID: deviceID})
+		if !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("expected pgx.ErrNoRows for a receipt from %s, got %v", deviceID, err)
+		}
+	}
+
+	if got, err := queries.GetMessageDelivery(ctx, sqlc.GetMessageDeliveryParams{MessageID: "msg-1", DeviceID: "device-3"}); err != nil || got.Status != "SEND_FAILED" || got.FailureReason.String != "UNREGISTERED" {
+		t.Fatalf("GetMessageDelivery = %+v, %v", got, err)
+	}
+	if _, err := queries.GetMessageDelivery(ctx, sqlc.GetMessageDeliveryParams{MessageID: "msg-1", DeviceID: "device-4"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+}
+
+func TestTemplateQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	if _, err := queries.GetTemplate(ctx, sqlc.GetTemplateParams{TemplateKey: "welcome", Locale: "en"}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+
+	for _, template := range []sqlc.UpsertTemplateParams{
+		{TemplateKey: "welcome", Locale: "pt-BR", Title: "Bem-vindo", Body: "Olá {{.name}}", DefaultData: []byte(`{}`)},
+		{TemplateKey: "welcome", Locale: "en", Title: "Welcome", Body: "Hi {{.name}}", DefaultData: []byte(`{"screen":"home"}`)},
+		{TemplateKey: "reminder", Locale: "en", Title: "Reminder", Body: "Don't forget", DefaultData: []byte(`{}`)},
+	} {
+		if _, err := queries.UpsertTemplate(ctx, template); err != nil {
+			t.Fatalf("UpsertTemplate(%s/%s) failed: %v", template.TemplateKey, template.Locale, err)
+		}
+	}
+
+	// Upserting an existing (template_key, locale) replaces it but keeps created_at
+	updated, err := queries.UpsertTemplate(ctx, sqlc.UpsertTemplateParams{
+		TemplateKey: "welcome", Locale: "en", Title: "Welcome!", Body: "Hi {{.name}}", DefaultData: []byte(`{}`),
+	})
+	if err != nil {
+		t.Fatalf("UpsertTemplate update failed: %v", err)
+	}
+	template, err := queries.GetTemplate(ctx, sqlc.GetTemplateParams{TemplateKey: "welcome", Locale: "en"})
+	if err != nil {
+		t.Fatalf("GetTemplate failed: %v", err)
+	}
+	if template.Title != "Welcome!" || string(template.DefaultData) != "{}" || !template.CreatedAt.Time.Equal(updated.CreatedAt.Time) {
+		t.Fatalf("unexpected template: %+v", template)
+	}
+
+	welcome, err := queries.ListTemplates(ctx, pgtype.Text{String: "welcome", Valid: true})
+	if err != nil {
+		t.Fatalf("ListTemplates failed: %v", err)
+	}
+	if len(welcome) != 2 || welcome[0].Locale != "en" || welcome[1].Locale != "pt-BR" {
+		t.Fatalf("unexpected welcome templates: %+v", welcome)
+	}
+	all, err := queries.ListTemplates(ctx, pgtype.Text{})
+	if err != nil {
+		t.Fatalf("ListTemplates failed: %v", err)
+	}
+	if len(all) != 3 || all[0].TemplateKey != "reminder" {
+		t.Fatalf("unexpected templates: %+v", all)
+	}
+
+	for want, params := range map[int64]sqlc.DeleteTemplateParams{
+		1: {TemplateKey: "welcome", Locale: "pt-BR"},
+		0: {TemplateKey: "welcome", Locale: "de"},
+	} {
+		deleted, err := queries.DeleteTemplate(ctx, params)
+		if err != nil || deleted != want {
+			t.Fatalf("DeleteTemplate(%s) = %d, %v; want %d", params.Locale, deleted, err, want)
+		}
+	}
+}
+
+func TestNotificationPreferenceQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	// Categories are seeded by the migration
+	categories, err := queries.ListNotificationCategories(ctx)
+	if err != nil {
+		t.Fatalf("ListNotificationCategories failed: %v", err)
+	}
+	if len(categories) != 4 || categories[0].Category != "marketing" {
+		t.Fatalf("unexpected categories: %+v", categories)
+	}
+	security, err := queries.GetNotificationCategory(ctx, "security")
+	if err != nil {
+		t.Fatalf("GetNotificationCategory failed: %v", err)
+	}
+	if !security.Mandatory || !security.DefaultEnabled {
+		t.Fatalf("unexpected security category: %+v", security)
+	}
+	if _, err := queries.GetNotificationCategory(ctx, "newsletter"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+
+	for _, preference := range []sqlc.CreateNotificationPreferenceParams{
+		{UserID: "user-1", DeviceID: "", Category: "marketing", Enabled: false},
+		{UserID: "user-1", DeviceID: "device-2", Category: "marketing", Enabled: true},
+		{UserID: "user-2", DeviceID: "", Category: "marketing", Enabled: false},
+	} {
+		if err := queries.CreateNotificationPreference(ctx, preference); err != nil {
+			t.Fatalf("CreateNotificationPreference(%+v) failed: %v", preference, err)
+		}
+	}
+
+	// Preferences reference an existing category
+	err = queries.CreateNotificationPreference(ctx, sqlc.CreateNotificationPreferenceParams{UserID: "user-1", Category: "newsletter"})
+	if err == nil {
+		t.Fatal("expected foreign key violation for a preference of an unknown category")
+	}
+
+	preferences, err := queries.ListNotificationPreferences(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("ListNotificationPreferences failed: %v", err)
+	}
+	if len(preferences) != 2 || preferences[0].DeviceID != "" || preferences[0].Enabled || !preferences[1].Enabled {
+		t.Fatalf("unexpected preferences: %+v", preferences)
+	}
+
+	if err := queries.DeleteNotificationPreferences(ctx, "user-1"); err != nil {
+		t.Fatalf("DeleteNotificationPreferences failed: %v", err)
+	}
+	for userID, want := range map[string]int{"user-1": 0, "user-2": 1} {
+		preferences, err := queries.ListNotificationPreferences(ctx, userID)
+		if err != nil || len(preferences) != want {
+			t.Fatalf("expected %d preferences for %s, got %+v, %v", want, userID, preferences, err)
+		}
+	}
+}
+
+func TestSegmentQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	if _, err := queries.GetSegment(ctx, "android"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+
+	created, err := queries.UpsertSegment(ctx, sqlc.UpsertSegmentParams{SegmentID: "android", Expression: `platform = "android"`})
+	if err != nil {
+		t.Fatalf("UpsertSegment failed: %v", err)
+	}
+	if _, err := queries.UpsertSegment(ctx, sqlc.UpsertSegmentParams{SegmentID: "beta", Description: "Beta testers", Expression: `app_version >= "3.0"`}); err != nil {
+		t.Fatalf("UpsertSegment failed: %v", err)
+	}
+
+	// Upserting an existing segment replaces it but keeps created_at
+	if _, err := queries.UpsertSegment(ctx, sqlc.UpsertSegmentParams{SegmentID: "android", Description: "Android", Expression: `platform = "android" AND last_seen > now-30d`}); err != nil {
+		t.Fatalf("UpsertSegment update failed: %v", err)
+	}
+	segment, err := queries.GetSegment(ctx, "android")
+	if err != nil {
+		t.Fatalf("GetSegment failed: %v", err)
+	}
+	if segment.Description != "Android" || segment.Expression != `platform = "android" AND last_seen > now-30d` || !segment.CreatedAt.Time.Equal(created.CreatedAt.Time) {
+		t.Fatalf("unexpected segment: %+v", segment)
+	}
+
+	segments, err := queries.ListSegments(ctx)
+	if err != nil || len(segments) != 2 || segments[0].SegmentID != "android" || segments[1].SegmentID != "beta" {
+		t.Fatalf("unexpected segments: %+v, %v", segments, err)
+	}
+
+	for segmentID, want := range map[string]int64{"beta": 1, "missing": 0} {
+		deleted, err := queries.DeleteSegment(ctx, segmentID)
+		if err != nil || deleted != want {
+			t.Fatalf("DeleteSegment(%s) = %d, %v; want %d", segmentID, deleted, err, want)
+		}
+	}
+}
+
+func TestSegmentVersionKey(t *testing.T) {
+	newQueries(t)
+
+	for version, want := range map[string]string{
+		"2.10":         "{2,10,0,0}",
+		"2.3.1-beta.1": "{2,3,1,0}",
+		"1.2.3.4.5":    "{1,2,3,4}",
+		"34":           "{34,0,0,0}",
+		"beta":         "",
+	} {
+		var key pgtype.Text
+		if err := testPool.QueryRow(context.Background(), "SELECT segment_version_key($1)::text", version).Scan(&key); err != nil {
+			t.Fatalf("segment_version_key(%s) failed: %v", version, err)
+		}
+		if key.String != want || key.Valid != (want != "") {
+			t.Errorf("segment_version_key(%s) = %+v; want %q", version, key, want)
+		}
+	}
+}
+
+func TestBroadcastQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	for _, device := range []sqlc.UpsertDeviceParams{
+		{UserID: "user-1", DeviceID: "device-1", Platform: "android", AppID: "default", FcmToken: "token-1", TokenType: "fcm"},
+		{UserID: "user-1", DeviceID: "device-2", Platform: "web", AppID: "default", FcmToken: "token-2", TokenType: "fcm"},
+		{UserID: "user-2", DeviceID: "device-3", Platform: "ios", AppID: "default", FcmToken: "token-3", TokenType: "fcm"},
+		{UserID: "user-3", DeviceID: "device-4", Platform: "android", AppID: "default", FcmToken: "token-4", TokenType: "fcm"},
+	} {
+		if err := queries.UpsertDevice(ctx, device); err != nil {
+			t.Fatalf("UpsertDevice(%s) failed: %v", device.DeviceID, err)
+		}
+	}
+
+	created, err := queries.CreateBroadcast(ctx, sqlc.CreateBroadcastParams{BroadcastID: "bc-1", Message: []byte(`{"category":"system"}`), BatchSize: 2})
+	if err != nil {
+		t.Fatalf("CreateBroadcast failed: %v", err)
+	}
+	if created.Status != "RUNNING" || created.TotalDevices != 3 || created.LastDeviceID != 0 || created.LeaseExpiresAt.Valid {
+		t.Fatalf("unexpected broadcast: %+v", created)
+	}
+
+	// A held lease keeps other invocations out until it expires
+	lease := pgtype.Timestamptz{Time: time.Now().Add(time.Minute).Truncate(time.Microsecond), Valid: true}
+	claimed, err := queries.ClaimBroadcast(ctx, sqlc.ClaimBroadcastParams{LeaseExpiresAt: lease, BroadcastID: pgtype.Text{String: "bc-1", Valid: true}})
+	if err != nil || !claimed.LeaseExpiresAt.Time.Equal(lease.Time) {
+		t.Fatalf("ClaimBroadcast = %+v, %v", claimed, err)
+	}
+	if _, err := queries.ClaimBroadcast(ctx, sqlc.ClaimBroadcastParams{LeaseExpiresAt: lease}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+
+	devices, err := queries.ListBroadcastDevices(ctx, sqlc.ListBroadcastDevicesParams{AfterID: 0, LimitCount: 2})
+	if err != nil || len(devices) != 2 || devices[0].DeviceID != "device-1" || devices[1].DeviceID != "device-3" {
+		t.Fatalf("unexpected devices: %+v, %v", devices, err)
+	}
+
+	checkpoint := sqlc.CheckpointBroadcastParams{
+		LastDeviceID:     devices[1].ID,
+		LeaseExpiresAt:   lease,
+		BroadcastID:      "bc-1",
+		PreviousDeviceID: 0,
+	}
+	broadcast, err := queries.CheckpointBroadcast(ctx, checkpoint)
+	if err != nil || broadcast.LastDeviceID != devices[1].ID || broadcast.Status != "RUNNING" {
+		t.Fatalf("CheckpointBroadcast = %+v, %v", broadcast, err)
+	}
+	// The same batch is only recorded once
+	if _, err := queries.CheckpointBroadcast(ctx, checkpoint); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+	broadcast, err = queries.RecordBroadcastSends(ctx, sqlc.RecordBroadcastSendsParams{Sent: 1, Failed: 1, BroadcastID: "bc-1"})
+	if err != nil || broadcast.SentCount != 1 || broadcast.FailedCount != 1 {
+		t.Fatalf("RecordBroadcastSends = %+v, %v", broadcast, err)
+	}
+
+	if err := queries.ReleaseBroadcast(ctx, sqlc.ReleaseBroadcastParams{BroadcastID: "bc-1", LeaseExpiresAt: lease}); err != nil {
+		t.Fatalf("ReleaseBroadcast failed: %v", err)
+	}
+	claimed, err = queries.ClaimBroadcast(ctx, sqlc.ClaimBroadcastParams{LeaseExpiresAt: lease})
+	if err != nil || claimed.BroadcastID != "bc-1" {
+		t.Fatalf("ClaimBroadcast = %+v, %v", claimed, err)
+	}
+
+	devices, err = queries.ListBroadcastDevices(ctx, sqlc.ListBroadcastDevicesParams{AfterID: broadcast.LastDeviceID, LimitCount: 2})
+	if err != nil || len(devices) != 1 || devices[0].DeviceID != "device-4" {
+		t.Fatalf("unexpected devices: %+v, %v", devices, err)
+	}
+	broadcast, err = queries.CheckpointBroadcast(ctx, sqlc.CheckpointBroadcastParams{
+		LastDeviceID:     devices[0].ID,
+		Completed:        true,
+		LeaseExpiresAt:   lease,
+		BroadcastID:      "bc-1",
+		PreviousDeviceID: broadcast.LastDeviceID,
+	})
+	if err != nil || broadcast.Status != "COMPLETED" || broadcast.LeaseExpiresAt.Valid || !broadcast.CompletedAt.Valid {
+		t.Fatalf("CheckpointBroadcast = %+v, %v", broadcast, err)
+	}
+	// Sends of the last batch are counted after it completed the broadcast
+	broadcast, err = queries.RecordBroadcastSends(ctx, sqlc.RecordBroadcastSendsParams{Sent: 1, BroadcastID: "bc-1"})
+	if err != nil || broadcast.Status != "COMPLETED" || broadcast.SentCount != 2 {
+		t.Fatalf("RecordBroadcastSends = %+v, %v", broadcast, err)
+	}
+	if _, err := queries.FailBroadcast(ctx, sqlc.FailBroadcastParams{BroadcastID: "bc-1", FailureReason: pgtype.Text{String: "late", Valid: true}}); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+
+	if _, err := queries.CreateBroadcast(ctx, sqlc.CreateBroadcastParams{BroadcastID: "bc-2", Message: []byte(`{}`), BatchSize: 500}); err != nil {
+		t.Fatalf("CreateBroadcast failed: %v", err)
+	}
+	failed, err := queries.FailBroadcast(ctx, sqlc.FailBroadcastParams{BroadcastID: "bc-2", FailureReason: pgtype.Text{String: "template deleted", Valid: true}})
+	if err != nil || failed.Status != "FAILED" || failed.FailureReason.String != "template deleted" {
+		t.Fatalf("FailBroadcast = %+v, %v", failed, err)
+	}
+
+	broadcasts, err := queries.ListBroadcasts(ctx, 10)
+	if err != nil || len(broadcasts) != 2 || broadcasts[0].BroadcastID != "bc-2" {
+		t.Fatalf("unexpected broadcasts: %+v, %v", broadcasts, err)
+	}
+	if got, err := queries.GetBroadcast(ctx, "bc-1"); err != nil || got.Status != "COMPLETED" {
+		t.Fatalf("GetBroadcast = %+v, %v", got, err)
+	}
+}
+
+func TestCampaignQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	campaign, err := queries.UpsertCampaign(ctx, sqlc.UpsertCampaignParams{CampaignID: "welcome", Category: "marketing", HoldoutPercent: 10})
+	if err != nil {
+		t.Fatalf("UpsertCampaign failed: %v", err)
+	}
+	if _, err := queries.UpsertCampaign(ctx, sqlc.UpsertCampaignParams{CampaignID: "other", Category: "unknown"}); err == nil {
+		t.Fatal("expected foreign key violation for an unknown category")
+	}
+	for _, variant := range []string{"b", "a"} {
+		err := queries.CreateCampaignVariant(ctx, sqlc.CreateCampaignVariantParams{
+			CampaignID: "welcome", Variant: variant, Weight: 1, Title: "Title " + variant, Body: "Body", Data: []byte(`{}`),
+		})
+		if err != nil {
+			t.Fatalf("CreateCampaignVariant(%s) failed: %v", variant, err)
+		}
+	}
+	variants, err := queries.ListCampaignVariants(ctx, pgtype.Text{String: "welcome", Valid: true})
+	if err != nil || len(variants) != 2 || variants[0].Variant != "a" || variants[1].Variant != "b" {
+		t.Fatalf("unexpected variants: %+v, %v", variants, err)
+	}
+	if got, err := queries.GetCampaign(ctx, "welcome"); err != nil || got.HoldoutPercent != 10 || !got.CreatedAt.Time.Equal(campaign.CreatedAt.Time) {
+		t.Fatalf("GetCampaign = %+v, %v", got, err)
+	}
+
+	// user-1 gets variant a on two devices and opens it on one; user-2 is held out
+	for _, assignment := range []sqlc.UpsertCampaignAssignmentParams{
+		{CampaignID: "welcome", UserID: "user-1", Variant: pgtype.Text{String: "b", Valid: true}},
+		{CampaignID: "welcome", UserID: "user-1", Variant: pgtype.Text{String: "a", Valid: true}},
+		{CampaignID: "welcome", UserID: "user-2"},
+	} {
+		if err := queries.UpsertCampaignAssignment(ctx, assignment); err != nil {
+			t.Fatalf("UpsertCampaignAssignment failed: %v", err)
+		}
+	}
+	counts, err := queries.CountCampaignAssignments(ctx, "welcome")
+	if err != nil || len(counts) != 2 || counts[0].Variant.String != "a" || counts[0].Users != 1 || counts[1].Variant.Valid || counts[1].Users != 1 {
+		t.Fatalf("unexpected assignments: %+v, %v", counts, err)
+	}
+
+	if err := queries.CreateMessage(ctx, sqlc.CreateMessageParams{MessageID: "msg-1", UserID: "user-1"}); err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+	for _, deviceID := range []string{"device-1", "device-2"} {
+		err := queries.CreateMessageDelivery(ctx, sqlc.CreateMessageDeliveryParams{
+			MessageID:  "msg-1",
+			DeviceID:   deviceID,
+			Platform:   "android",
+			AppID:      "default",
+			CampaignID: pgtype.Text{String: "welcome", Valid: true},
+			Variant:    pgtype.Text{String: "a", Valid: true},
+		})
+		if err != nil {
+			t.Fatalf("CreateMessageDelivery(%s) failed: %v", deviceID, err)
+		}
+		if err := queries.MarkMessageDeliverySent(ctx, sqlc.MarkMessageDeliverySentParams{MessageID: "msg-1", DeviceID: deviceID}); err != nil {
+			t.Fatalf("MarkMessageDeliverySent(%s) failed: %v", deviceID, err)
+		}
+	}
+	opened, err := queries.RecordMessageReceipt(ctx, sqlc.RecordMessageReceiptParams{Event: "opened", MessageID: "msg-1", DeviceID: "device-1"})
+	if err != nil || opened.CampaignID.String != "welcome" || opened.Variant.String != "a" {
+		t.Fatalf("RecordMessageReceipt = %+v, %v", opened, err)
+	}
+	stats, err := queries.GetCampaignDeliveryStats(ctx, "welcome")
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("unexpected stats: %+v, %v", stats, err)
+	}
+	expected := sqlc.GetCampaignDeliveryStatsRow{Variant: pgtype.Text{String: "a", Valid: true}, Deliveries: 2, Sent: 2, Delivered: 1, Opened: 1, OpenedUsers: 1}
+	if stats[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats[0])
+	}
+
+	// Variants and assignments go with the campaign; deliveries stay
+	if err := queries.DeleteCampaignVariants(ctx, "welcome"); err != nil {
+		t.Fatalf("DeleteCampaignVariants failed: %v", err)
+	}
+	if deleted, err := queries.DeleteCampaign(ctx, "welcome"); err != nil || deleted != 1 {
+		t.Fatalf("DeleteCampaign = %d, %v", deleted, err)
+	}
+	if counts, err := queries.CountCampaignAssignments(ctx, "welcome"); err != nil || len(counts) != 0 {
+		t.Fatalf("expected no assignments, got %+v, %v", counts, err)
+	}
+	if stats, err := queries.GetCampaignDeliveryStats(ctx, "welcome"); err != nil || len(stats) != 1 {
+		t.Fatalf("expected the deliveries to stay, got %+v, %v", stats, err)
+	}
+	if campaigns, err := queries.ListCampaigns(ctx); err != nil || len(campaigns) != 0 {
+		t.Fatalf("unexpected campaigns: %+v, %v", campaigns, err)
+	}
+}
+
+func TestWebhookQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	subscription, err := queries.CreateWebhookSubscription(ctx, sqlc.CreateWebhookSubscriptionParams{
+		SubscriptionID: "wh-1",
+		Url:            "https://example.com/hooks",
+		EventTypes:     []string{"message.sent", "message.failed"},
+		Secret:         "secret",
+	})
+	if err != nil {
+		t.Fatalf("CreateWebhookSubscription failed: %v", err)
+	}
+	if got, err := queries.GetWebhookSubscription(ctx, "wh-1"); err != nil || len(got.EventTypes) != 2 || !got.CreatedAt.Time.Equal(subscription.CreatedAt.Time) {
+		t.Fatalf("GetWebhookSubscription = %+v, %v", got, err)
+	}
+	if _, err := queries.CreateWebhookSubscription(ctx, sqlc.CreateWebhookSubscriptionParams{
+		SubscriptionID: "wh-2", Url: "https://example.com/other", EventTypes: []string{"device.registered"}, Secret: "secret",
+	}); err != nil {
+		t.Fatalf("CreateWebhookSubscription failed: %v", err)
+	}
+	if subscriptions, err := queries.ListWebhookSubscriptions(ctx); err != nil || len(subscriptions) != 2 || subscriptions[0].SubscriptionID != "wh-1" {
+		t.Fatalf("unexpected subscriptions: %+v, %v", subscriptions, err)
+	}
+
+	// Only subscriptions to the event type get a delivery
+	for i, eventType := range []string{"message.sent", "message.opened"} {
+		n, err := queries.EnqueueWebhookEvent(ctx, sqlc.EnqueueWebhookEventParams{
+			EventID: fmt.Sprintf("evt-%d", i), EventType: eventType, Payload: []byte(`{"type":"` + eventType + `"}`),
+		})
+		if err != nil || n != int64(1-i) {
+			t.Fatalf("EnqueueWebhookEvent(%s) = %d, %v", eventType, n, err)
+		}
+	}
+
+	// Claimed deliveries are leased: not claimed again until the lease expires
+	claim := sqlc.ClaimWebhookDeliveriesParams{LeaseExpiresAt: timeFromNow(time.Minute), LimitCount: 10}
+	claimed, err := queries.ClaimWebhookDeliveries(ctx, claim)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("ClaimWebhookDeliveries = %+v, %v", claimed, err)
+	}
+	delivery := claimed[0]
+	if delivery.EventID != "evt-0" || delivery.Url != "https://example.com/hooks" || delivery.Secret != "secret" || delivery.Attempts != 0 {
+		t.Fatalf("unexpected delivery: %+v", delivery)
+	}
+	if claimed, err := queries.ClaimWebhookDeliveries(ctx, claim); err != nil || len(claimed) != 0 {
+		t.Fatalf("leased delivery claimed again: %+v, %v", claimed, err)
+	}
+
+	// A failed attempt is retried at next_attempt_at
+	err = queries.RetryWebhookDelivery(ctx, sqlc.RetryWebhookDeliveryParams{
+		DeliveryID:    delivery.DeliveryID,
+		NextAttemptAt: timeFromNow(-time.Second),
+		LastError:     pgtype.Text{String: "status 500", Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("RetryWebhookDelivery failed: %v", err)
+	}
+	claimed, err = queries.ClaimWebhookDeliveries(ctx, claim)
+	if err != nil || len(claimed) != 1 || claimed[0].Attempts != 1 {
+		t.Fatalf("ClaimWebhookDeliveries after retry = %+v, %v", claimed, err)
+	}
+
+	// The last failed attempt moves the delivery to the dead letters
+	if n, err := queries.DeadLetterWebhookDelivery(ctx, sqlc.DeadLetterWebhookDeliveryParams{DeliveryID: delivery.DeliveryID, LastError: "status 503"}); err != nil || n != 1 {
+		t.Fatalf("DeadLetterWebhookDelivery = %d, %v", n, err)
+	}
+	deadLetters, err := queries.ListWebhookDeadLetters(ctx, sqlc.ListWebhookDeadLettersParams{SubscriptionID: "wh-1", LimitCount: 10})
+	if err != nil || len(deadLetters) != 1 {
+		t.Fatalf("ListWebhookDeadLetters = %+v, %v", deadLetters, err)
+	}
+	if deadLetter := deadLetters[0]; deadLetter.EventID != "evt-0" || deadLetter.Attempts != 2 || deadLetter.LastError != "status 503" || !deadLetter.FailedAt.Valid {
+		t.Fatalf("unexpected dead letter: %+v", deadLetter)
+	}
+	if claimed, err := queries.ClaimWebhookDeliveries(ctx, claim); err != nil || len(claimed) != 0 {
+		t.Fatalf("dead letter claimed: %+v, %v", claimed, err)
+	}
+
+	// Delivered deliveries are deleted
+	if _, err := queries.EnqueueWebhookEvent(ctx, sqlc.EnqueueWebhookEventParams{EventID: "evt-2", EventType: "message.failed", Payload: []byte(`{}`)}); err != nil {
+		t.Fatalf("EnqueueWebhookEvent failed: %v", err)
+	}
+	claimed, err = queries.ClaimWebhookDeliveries(ctx, claim)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("ClaimWebhookDeliveries = %+v, %v", claimed, err)
+	}
+	if err := queries.DeleteWebhookDelivery(ctx, claimed[0].DeliveryID); err != nil {
+		t.Fatalf("DeleteWebhookDelivery failed: %v", err)
+	}
+
+	// Dead letters go with the subscription
+	if n, err := queries.DeleteWebhookSubscription(ctx, "wh-1"); err != nil || n != 1 {
+		t.Fatalf("DeleteWebhookSubscription = %d, %v", n, err)
+	}
+	if deadLetters, err := queries.ListWebhookDeadLetters(ctx, sqlc.ListWebhookDeadLettersParams{SubscriptionID: "wh-1", LimitCount: 10}); err != nil || len(deadLetters) != 0 {
+		t.Fatalf("expected no dead letters, got %+v, %v", deadLetters, err)
+	}
+	if _, err := queries.GetWebhookSubscription(ctx, "wh-1"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+}
+
+func TestOutboxQueries(t *testing.T) {
+	ctx := context.Background()
+	queries := newQueries(t)
+
+	// The writer's entry is left alone until available_at; the other one is available
+	for i, availableIn := range []time.Duration{time.Minute, -time.Second} {
+		entry, err := queries.CreateOutboxEntry(ctx, sqlc.CreateOutboxEntryParams{
+			Kind: "webhook_event", Payload: []byte(fmt.Sprintf(`{"id":"evt-%d"}`, i)), AvailableAt: timeFromNow(availableIn),
+		})
+		if err != nil || entry.OutboxID != int64(i+1) || entry.Attempts != 0 || !entry.CreatedAt.Valid {
+			t.Fatalf("CreateOutboxEntry = %+v, %v", entry, err)
+		}
+	}
+
+	// Claimed entries are leased: not claimed again until the lease expires
+	claim := sqlc.ClaimOutboxEntriesParams{LeaseExpiresAt: timeFromNow(time.Minute), LimitCount: 10}
+	claimed, err := queries.ClaimOutboxEntries(ctx, claim)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("ClaimOutboxEntries = %+v, %v", claimed, err)
+	}
+	entry := claimed[0]
+	if entry.OutboxID != 2 || entry.Kind != "webhook_event" || entry.Attempts != 1 || !entry.AvailableAt.Time.Equal(claim.LeaseExpiresAt.Time) {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	if claimed, err := queries.ClaimOutboxEntries(ctx, claim); err != nil || len(claimed) != 0 {
+		t.Fatalf("leased entry claimed again: %+v, %v", claimed, err)
+	}
+
+	// A failed attempt is retried at available_at
+	err = queries.RetryOutboxEntry(ctx, sqlc.RetryOutboxEntryParams{
+		OutboxID:    entry.OutboxID,
+		AvailableAt: timeFromNow(-time.Second),
+		LastError:   pgtype.Text{String: "connection refused", Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("RetryOutboxEntry failed: %v", err)
+	}
+	claimed, err = queries.ClaimOutboxEntries(ctx, claim)
+	if err != nil || len(claimed) != 1 || claimed[0].Attempts != 2 || claimed[0].LastError.String != "connection refused" {
+		t.Fatalf("ClaimOutboxEntries after retry = %+v, %v", claimed, err)
+	}
+
+	// Only the first invocation to publish an entry deletes it
+	for i, want := range []int64{1, 0} {
+		if n, err := queries.DeleteOutboxEntry(ctx, entry.OutboxID); err != nil || n != want {
+			t.Fatalf("DeleteOutboxEntry #%d = %d, %v", i+1, n, err)
+		}
+	}
+}
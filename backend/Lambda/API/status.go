@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -12,14 +13,125 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
+// Values of test_runs.status
+const (
+	testRunStatusPending    = "PENDING"     // Sent, waiting for the device's ack
+	testRunStatusAcked      = "ACKED"       // Acknowledged by the device
+	testRunStatusExpired    = "EXPIRED"     // No ack before expires_at
+	testRunStatusSendFailed = "SEND_FAILED" // The message could not be sent
+)
+
+// GET /test/status?wait= long-polling
+const (
+	// maxStatusWait keeps a waiting request below the 29 second API Gateway integration timeout
+	maxStatusWait = 25 * time.Second
+	// testRunStatusChannel is notified with the nonce when a test run changes status,
+	// see migration 0007_test_run_status_notify
+	testRunStatusChannel = "test_run_status"
+)
+
 type StatusResponse struct {
-	Nonce   string     `json:"nonce"`
-	Status  string     `json:"status"`
-	AckedAt *time.Time `json:"acked_at,omitempty"` // Omit if nil (PENDING status)
+	Nonce         string     `json:"nonce"`
+	Status        string     `json:"status"`
+	AckedAt       *time.Time `json:"acked_at,omitempty"` // Omit if nil (not ACKED)
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	FailureReason string     `json:"failure_reason,omitempty"` // Set for EXPIRED and SEND_FAILED
+
+	// Reported by the device with its ack (omitted if not reported)
+	DeviceID   string `json:"device_id,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	AppVersion string `json:"app_version,omitempty"`
+	OSVersion  string `json:"os_version,omitempty"`
+
+	TestRunLatency
+
+	// Devices targeted by the run: "acked_device_count of device_count devices acked"
+	DeviceCount      int                     `json:"device_count"`
+	AckedDeviceCount int                     `json:"acked_device_count"`
+	Deliveries       []TestRunDeliveryStatus `json:"deliveries,omitempty"`
+}
+
+// TestRunDeliveryStatus is the delivery of a test run to one device
+type TestRunDeliveryStatus struct {
+	DeviceID      string     `json:"device_id"`
+	Platform      string     `json:"platform"`
+	AppID         string     `json:"app_id"`
+	Status        string     `json:"status"` // PENDING, SENT, SEND_FAILED or ACKED
+	FailureReason string     `json:"failure_reason,omitempty"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	AckedAt       *time.Time `json:"acked_at,omitempty"`
+	AppVersion    string     `json:"app_version,omitempty"`
+	OSVersion     string     `json:"os_version,omitempty"`
+	// From FCM accepting the message to the device's ack reaching the server
+	SendToAckMs *int64 `json:"send_to_ack_ms,omitempty"`
+}
+
+// Values of test_run_deliveries.status
+const (
+	deliveryStatusPending    = "PENDING"     // Not sent yet
+	deliveryStatusSent       = "SENT"        // Accepted by FCM
+	deliveryStatusSendFailed = "SEND_FAILED" // FCM rejected the message
+	deliveryStatusAcked      = "ACKED"       // Acknowledged by the device
+)
+
+// newTestRunDeliveryStatus converts a delivery row for the status response
+func newTestRunDeliveryStatus(delivery sqlc.TestRunDelivery) TestRunDeliveryStatus {
+	status := TestRunDeliveryStatus{
+		DeviceID:      delivery.DeviceID,
+		Platform:      delivery.Platform,
+		AppID:         delivery.AppID,
+		Status:        delivery.Status,
+		FailureReason: delivery.FailureReason.String,
+		AppVersion:    delivery.AppVersion.String,
+		OSVersion:     delivery.OsVersion.String,
+	}
+	if delivery.SentAt.Valid {
+		sentAt := delivery.SentAt.Time
+		status.SentAt = &sentAt
+	}
+	if delivery.AckedAt.Valid {
+		ackedAt := delivery.AckedAt.Time
+		status.AckedAt = &ackedAt
+	}
+	if delivery.SentAt.Valid && delivery.AckedAt.Valid {
+		ms := delivery.AckedAt.Time.Sub(delivery.SentAt.Time).Milliseconds()
+		status.SendToAckMs = &ms
+	}
+	return status
+}
+
+// TestRunLatency is the delivery latency of an acknowledged test run, in milliseconds
+type TestRunLatency struct {
+	// From sending (sent_time echoed by the device, or created_at) to the ack reaching the server
+	SendToAckMs *int64 `json:"send_to_ack_ms,omitempty"`
+	// From the device receiving the message (device clock) to the ack reaching the server
+	ReceiveToAckMs *int64 `json:"receive_to_ack_ms,omitempty"`
+}
+
+// testRunLatency computes the latencies of an ACKED test run
+func testRunLatency(testRun sqlc.TestRun) TestRunLatency {
+	var latency TestRunLatency
+	if testRun.Status != testRunStatusAcked || !testRun.AckedAt.Valid {
+		return latency
+	}
+
+	sentAt := testRun.CreatedAt
+	if testRun.SentAt.Valid {
+		sentAt = testRun.SentAt
+	}
+	if sentAt.Valid {
+		ms := testRun.AckedAt.Time.Sub(sentAt.Time).Milliseconds()
+		latency.SendToAckMs = &ms
+	}
+	if testRun.ReceivedAt.Valid {
+		ms := testRun.AckedAt.Time.Sub(testRun.ReceivedAt.Time).Milliseconds()
+		latency.ReceiveToAckMs = &ms
+	}
+	return latency
 }
 
 // TestStatusHandler is the Lambda handler for querying test run status
-func TestStatusHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func (s *Service) TestStatusHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	logger := common.NewLogger()
 	logger.Info(ctx, "Received test status request")
 
@@ -35,16 +147,33 @@ func TestStatusHandler(ctx context.Context, request events.APIGatewayProxyReques
 		return logger.BadRequest(ctx, err, "Missing required query parameter: nonce")
 	}
 
+	// Validate wait (seconds to hold the request while the run is PENDING)
+	wait, err := parseStatusWait(request.QueryStringParameters["wait"])
+	if err != nil {
+		return logger.BadRequest(ctx, err, fmt.Sprintf("wait must be 0-%d seconds", int(maxStatusWait.Seconds())))
+	}
+
 	// Get database connection
-	db, err := common.GetDBConnection()
+	queries, err := s.Store.Queries(ctx)
 	if err != nil {
 		return logger.InternalServerError(ctx, err, "Database connection failed")
 	}
-	defer common.CloseDBConnection(db)
+
+	// Listen before the first read, so a status change between the read and the wait is not missed
+	var subscription Subscription
+	if wait > 0 {
+		subscription, err = s.Store.Listen(ctx, testRunStatusChannel)
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Database connection failed")
+		}
+		defer subscription.Close()
+	}
 
 	// Query test run by nonce
-	queries := sqlc.New(db)
-	testRun, err := queries.GetTestRunByNonce(ctx, nonce)
+	testRun, err := s.readTestRun(ctx, logger, queries, nonce)
+	if err == nil && subscription != nil && testRun.Status == testRunStatusPending {
+		testRun, err = s.waitForTestRun(ctx, logger, queries, subscription, testRun, wait)
+	}
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			// nonce not found → 404
@@ -55,19 +184,108 @@ func TestStatusHandler(ctx context.Context, request events.APIGatewayProxyReques
 		return logger.InternalServerError(ctx, err, "Database query failed")
 	}
 
+	// Query the per-device deliveries (none for runs created before deliveries were tracked)
+	deliveries, err := queries.ListTestRunDeliveries(ctx, nonce)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
 	// Build response
 	response := StatusResponse{
-		Nonce:  testRun.Nonce,
-		Status: testRun.Status,
+		Nonce:          testRun.Nonce,
+		Status:         testRun.Status,
+		FailureReason:  testRun.FailureReason.String,
+		DeviceID:       testRun.AckDeviceID.String,
+		Platform:       testRun.AckPlatform.String,
+		AppVersion:     testRun.AckAppVersion.String,
+		OSVersion:      testRun.AckOsVersion.String,
+		TestRunLatency: testRunLatency(testRun),
+		DeviceCount:    len(deliveries),
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status == deliveryStatusAcked {
+			response.AckedDeviceCount++
+		}
+		response.Deliveries = append(response.Deliveries, newTestRunDeliveryStatus(delivery))
 	}
 
 	// Only include acked_at if status is ACKED and acked_at is valid
-	if testRun.Status == "ACKED" && testRun.AckedAt.Valid {
+	if testRun.Status == testRunStatusAcked && testRun.AckedAt.Valid {
 		ackedAt := testRun.AckedAt.Time
 		response.AckedAt = &ackedAt
 	}
+	if testRun.ExpiresAt.Valid {
+		expiresAt := testRun.ExpiresAt.Time
+		response.ExpiresAt = &expiresAt
+	}
 
-	logger.Info(ctx, "Test run status queried: nonce=%s, status=%s", nonce, testRun.Status)
+	logger.Info(ctx, "Test run status queried: nonce=%s, status=%s, acked=%d/%d",
+		nonce, testRun.Status, response.AckedDeviceCount, response.DeviceCount)
 
 	return logger.Success(ctx, response)
 }
+
+// readTestRun queries a test run by nonce. A PENDING run past its expiry is expired on read,
+// so pollers can stop waiting without relying on the sweeper having run.
+// Returns pgx.ErrNoRows if the run does not exist.
+func (s *Service) readTestRun(ctx context.Context, logger *common.Logger, queries sqlc.Querier, nonce string) (sqlc.TestRun, error) {
+	testRun, err := queries.GetTestRunByNonce(ctx, nonce)
+	if err != nil {
+		return sqlc.TestRun{}, err
+	}
+
+	if testRun.Status == testRunStatusPending && testRun.ExpiresAt.Valid && !s.Clock.Now().Before(testRun.ExpiresAt.Time) {
+		expiredRun, err := queries.ExpireTestRun(ctx, nonce)
+		if err == nil {
+			logger.Info(ctx, "Test run expired: nonce=%s", nonce)
+			return expiredRun, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return sqlc.TestRun{}, err
+		}
+		// pgx.ErrNoRows: acked or expired concurrently, read it again
+		return queries.GetTestRunByNonce(ctx, nonce)
+	}
+	return testRun, nil
+}
+
+// waitForTestRun waits until the PENDING testRun changes status, wait elapses or the run
+// reaches its expiry, whichever comes first, and returns the run as read afterwards.
+// Notifications come from the test_runs_status_notify trigger, so acks wake the request immediately.
+func (s *Service) waitForTestRun(ctx context.Context, logger *common.Logger, queries sqlc.Querier, subscription Subscription, testRun sqlc.TestRun, wait time.Duration) (sqlc.TestRun, error) {
+	if testRun.ExpiresAt.Valid {
+		if untilExpiry := testRun.ExpiresAt.Time.Sub(s.Clock.Now()); untilExpiry < wait {
+			wait = untilExpiry
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	for {
+		nonce, err := subscription.Next(waitCtx)
+		if err != nil {
+			if waitCtx.Err() == nil {
+				// The client polls again; report the run as it is now
+				logger.Error(ctx, err, "Waiting for test run status failed: nonce=%s", testRun.Nonce)
+			}
+			break
+		}
+		if nonce == testRun.Nonce {
+			break
+		}
+	}
+
+	return s.readTestRun(ctx, logger, queries, testRun.Nonce)
+}
+
+// parseStatusWait parses the wait query parameter in whole seconds, 0 if it is empty
+func parseStatusWait(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxStatusWait {
+		return 0, fmt.Errorf("invalid wait: %s", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
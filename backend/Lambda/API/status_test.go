@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestTestStatusHandler(t *testing.T) {
+	db := requireDB(t)
+	queries := sqlc.New(db)
+
+	_, err := queries.CreateTestRun(context.Background(), sqlc.CreateTestRunParams{
+		Nonce:     "nonce-1",
+		UserID:    "user-1",
+		ExpiresAt: pgtype.Timestamptz{Time: time.Now().Add(time.Minute), Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to create test run: %v", err)
+	}
+
+	response := invoke(t, testService.TestStatusHandler, "", map[string]string{"nonce": "nonce-1"})
+	expectStatus(t, response, 200)
+
+	var status StatusResponse
+	decodeBody(t, response, &status)
+	if status.Nonce != "nonce-1" || status.Status != "PENDING" || status.AckedAt != nil {
+		t.Fatalf("unexpected status: %s", response.Body)
+	}
+
+	if _, err := queries.AckTestRun(context.Background(), sqlc.AckTestRunParams{Nonce: "nonce-1"}); err != nil {
+		t.Fatalf("failed to ack test run: %v", err)
+	}
+
+	response = invoke(t, testService.TestStatusHandler, "", map[string]string{"nonce": "nonce-1"})
+	expectStatus(t, response, 200)
+
+	decodeBody(t, response, &status)
+	if status.Status != "ACKED" || status.AckedAt == nil {
+		t.Fatalf("expected ACKED status with acked_at, got %s", response.Body)
+	}
+}
+
+func TestTestStatusHandlerNotFound(t *testing.T) {
+	requireDB(t)
+
+	expectStatus(t, invoke(t, testService.TestStatusHandler, "", map[string]string{"nonce": "unknown"}), 404)
+}
+
+func TestTestStatusHandlerBadRequest(t *testing.T) {
+	expectStatus(t, invoke(t, testService.TestStatusHandler, "", nil), 400)
+	expectStatus(t, invoke(t, testService.TestStatusHandler, "", map[string]string{"nonce": ""}), 400)
+}
+
+func TestTestStatusHandlerDatabaseUnavailable(t *testing.T) {
+	withUnreachableDatabase(t)
+
+	expectStatus(t, invoke(t, testService.TestStatusHandler, "", map[string]string{"nonce": "nonce-1"}), 500)
+}
+
+// statusResult is the outcome of a TestStatusHandler call made in a goroutine.
+type statusResult struct {
+	status  StatusResponse
+	elapsed time.Duration
+}
+
+// waitForStatus calls TestStatusHandler for nonce-1 with wait in the background.
+func waitForStatus(t *testing.T, service *Service, wait string) <-chan statusResult {
+	t.Helper()
+	results := make(chan statusResult, 1)
+	go func() {
+		start := time.Now()
+		response, err := service.TestStatusHandler(context.Background(), events.APIGatewayProxyRequest{
+			QueryStringParameters: map[string]string{"nonce": "nonce-1", "wait": wait},
+		})
+		var status StatusResponse
+		if err == nil && response.StatusCode == 200 {
+			err = json.Unmarshal([]byte(response.Body), &status)
+		}
+		if err != nil || response.StatusCode != 200 {
+			t.Errorf("status request failed: %v %d %s", err, response.StatusCode, response.Body)
+		}
+		results <- statusResult{status: status, elapsed: time.Since(start)}
+	}()
+	return results
+}
+
+func TestTestStatusWaitWakesOnAck(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	sendE2ETest(t, service, "60")
+
+	results := waitForStatus(t, service, "20")
+
+	// Ack once the request is waiting for notifications
+	<-fakes.querier.waiting
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", DeviceId: "device-1"}), nil), 200)
+
+	result := <-results
+	if result.status.Status != testRunStatusAcked || result.status.AckedDeviceCount != 1 {
+		t.Fatalf("expected ACKED status, got %+v", result.status)
+	}
+	if result.elapsed > 10*time.Second {
+		t.Fatalf("ack did not wake the request: waited %s", result.elapsed)
+	}
+}
+
+func TestTestStatusWaitTimesOut(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerFakeDevices(t, service)
+	sendE2ETest(t, service, "60")
+
+	results := waitForStatus(t, service, "1")
+
+	// Changes of other runs do not end the wait
+	<-fakes.querier.waiting
+	fakes.querier.mu.Lock()
+	fakes.querier.notifyStatusLocked("other-nonce")
+	fakes.querier.mu.Unlock()
+
+	result := <-results
+	if result.status.Status != testRunStatusPending || result.elapsed < time.Second {
+		t.Fatalf("expected PENDING after waiting 1s, got %+v after %s", result.status, result.elapsed)
+	}
+}
+
+func TestTestStatusWaitStopsAtExpiry(t *testing.T) {
+	service, fakes := newFakeService(t)
+	seedTestRun(fakes, "nonce-1", "user-1", testRunStatusPending, 0, 0)
+	testRun := fakes.querier.testRuns["nonce-1"]
+	testRun.ExpiresAt = pgtype.Timestamptz{Time: fakes.clock.Now().Add(50 * time.Millisecond), Valid: true}
+	fakes.querier.testRuns["nonce-1"] = testRun
+
+	results := waitForStatus(t, service, "20")
+	<-fakes.querier.waiting
+	fakes.clock.Advance(time.Second)
+
+	result := <-results
+	if result.status.Status != testRunStatusExpired || result.elapsed > 10*time.Second {
+		t.Fatalf("expected EXPIRED once the run expired, got %+v after %s", result.status, result.elapsed)
+	}
+}
+
+func TestTestStatusWaitSkippedWhenDone(t *testing.T) {
+	service, fakes := newFakeService(t)
+	seedTestRun(fakes, "nonce-1", "user-1", testRunStatusAcked, 0, 100)
+
+	// A finished run is returned right away
+	start := time.Now()
+	response := invoke(t, service.TestStatusHandler, "", map[string]string{"nonce": "nonce-1", "wait": "25"})
+	expectStatus(t, response, 200)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("finished run was not returned right away: %s", elapsed)
+	}
+	if len(fakes.querier.subscriptions) != 0 {
+		t.Fatal("subscription was not closed")
+	}
+}
+
+func TestTestStatusWaitInvalid(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	for _, wait := range []string{"-1", "26", "soon", "1.5"} {
+		expectStatus(t, invoke(t, service.TestStatusHandler, "", map[string]string{"nonce": "nonce-1", "wait": wait}), 400)
+	}
+}
+
+func TestTestStatusHandlerWaitsForNotify(t *testing.T) {
+	db := requireDB(t)
+	queries := sqlc.New(db)
+
+	_, err := queries.CreateTestRun(context.Background(), sqlc.CreateTestRunParams{
+		Nonce:     "nonce-1",
+		UserID:    "user-1",
+		ExpiresAt: pgtype.Timestamptz{Time: time.Now().Add(time.Minute), Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to create test run: %v", err)
+	}
+
+	results := waitForStatus(t, testService, "20")
+
+	// There is no hook into the waiting request, so ack after giving it time to LISTEN;
+	// an earlier ack is reported by its first read instead
+	time.Sleep(500 * time.Millisecond)
+	if _, err := queries.AckTestRun(context.Background(), sqlc.AckTestRunParams{Nonce: "nonce-1"}); err != nil {
+		t.Fatalf("failed to ack test run: %v", err)
+	}
+
+	result := <-results
+	if result.status.Status != testRunStatusAcked || result.elapsed > 10*time.Second {
+		t.Fatalf("expected ACKED status woken by NOTIFY, got %+v after %s", result.status, result.elapsed)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fcm-tutorial/lambda/api/common"
+)
+
+// SweepTestRunsResult is returned by SweepTestRunsHandler
+type SweepTestRunsResult struct {
+	Expired int64 `json:"expired"` // Number of PENDING runs marked EXPIRED
+}
+
+// SweepTestRunsHandler is the Lambda handler that bulk-expires PENDING test runs past their expires_at.
+// It runs on an EventBridge schedule, so the event payload is ignored.
+func (s *Service) SweepTestRunsHandler(ctx context.Context) (*SweepTestRunsResult, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Sweeping expired test runs")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		logger.Error(ctx, err, "Database connection failed")
+		return nil, fmt.Errorf("database connection failed: %w", err)
+	}
+
+	expired, err := queries.ExpirePendingTestRuns(ctx)
+	if err != nil {
+		logger.Error(ctx, err, "Failed to expire test runs")
+		return nil, fmt.Errorf("failed to expire test runs: %w", err)
+	}
+
+	logger.Info(ctx, "Expired %d test runs", expired)
+
+	return &SweepTestRunsResult{Expired: expired}, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// sendE2ETest sends an e2e test message with nonce-1.
+func sendE2ETest(t *testing.T, service *Service, ackTimeoutSeconds string) {
+	t.Helper()
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"},"ack_timeout_seconds":`+ackTimeoutSeconds+`}`, nil), 200)
+}
+
+// testRunStatus returns the status response for nonce-1.
+func testRunStatus(t *testing.T, service *Service) StatusResponse {
+	t.Helper()
+	response := invoke(t, service.TestStatusHandler, "", map[string]string{"nonce": "nonce-1"})
+	expectStatus(t, response, 200)
+	var status StatusResponse
+	decodeBody(t, response, &status)
+	return status
+}
+
+func TestTestRunExpiresOnStatus(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	sendE2ETest(t, service, "30")
+
+	status := testRunStatus(t, service)
+	if status.Status != testRunStatusPending || status.ExpiresAt == nil || !status.ExpiresAt.Equal(fakes.clock.Now().Add(30*time.Second)) {
+		t.Fatalf("expected PENDING run expiring in 30s, got %+v", status)
+	}
+
+	fakes.clock.Advance(30 * time.Second)
+
+	status = testRunStatus(t, service)
+	if status.Status != testRunStatusExpired || status.FailureReason == "" {
+		t.Fatalf("expected EXPIRED run with reason, got %+v", status)
+	}
+
+	// A late ack is rejected
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1"}), nil), 404)
+}
+
+func TestTestRunDefaultAckTimeout(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	sendE2ETest(t, service, "0")
+
+	status := testRunStatus(t, service)
+	if status.ExpiresAt == nil || !status.ExpiresAt.Equal(fakes.clock.Now().Add(defaultAckTimeout)) {
+		t.Fatalf("expected default expiry, got %+v", status)
+	}
+}
+
+func TestTestRunInvalidAckTimeout(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	for _, timeout := range []string{"-1", "3601"} {
+		expectStatus(t, invoke(t, service.SendMessageHandler,
+			`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","ack_timeout_seconds":`+timeout+`}`, nil), 400)
+	}
+}
+
+func TestTestRunSendFailed(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	fakes.sender.FailToken("token-1", fakeRejection("INVALID_ARGUMENT"))
+
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 200)
+
+	status := testRunStatus(t, service)
+	if status.Status != testRunStatusSendFailed || status.FailureReason != "INVALID_ARGUMENT" {
+		t.Fatalf("expected SEND_FAILED run, got %+v", status)
+	}
+}
+
+func TestTestRunWithoutDevicesFails(t *testing.T) {
+	service, _ := newFakeService(t)
+	sendE2ETest(t, service, "30")
+
+	status := testRunStatus(t, service)
+	if status.Status != testRunStatusSendFailed || status.FailureReason == "" {
+		t.Fatalf("expected SEND_FAILED run, got %+v", status)
+	}
+}
+
+func TestSweepTestRunsHandler(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	sendE2ETest(t, service, "30")
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-2"},"ack_timeout_seconds":120}`, nil), 200)
+
+	fakes.clock.Advance(time.Minute)
+
+	result, err := service.SweepTestRunsHandler(t.Context())
+	if err != nil {
+		t.Fatalf("SweepTestRunsHandler failed: %v", err)
+	}
+	if result.Expired != 1 {
+		t.Fatalf("expected 1 expired run, got %d", result.Expired)
+	}
+	if status := testRunStatus(t, service); status.Status != testRunStatusExpired {
+		t.Fatalf("expected nonce-1 to be EXPIRED, got %+v", status)
+	}
+
+	fakes.querier.err = errors.New("query failed")
+	if _, err := service.SweepTestRunsHandler(t.Context()); err == nil {
+		t.Fatal("expected an error when the database fails")
+	}
+}
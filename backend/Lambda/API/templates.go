@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+)
+
+// Message templates: a title and body in Go text/template syntax per template key and locale,
+// e.g. "Hi {{.name}}". POST /messages/send with template_key renders the template in the locale of
+// each device (see selectTemplate), with the request's variables.
+
+// defaultTemplateLocale is the default of Service.DefaultLocale
+const defaultTemplateLocale = "en"
+
+var (
+	templateKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+	// BCP 47 language tags, roughly: a 2-3 letter language followed by subtags; "_" is accepted for "-"
+	localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{1,8})*$`)
+)
+
+// errTemplateRender is returned for templates that cannot be rendered with the request's variables
+var errTemplateRender = errors.New("template cannot be rendered")
+
+type PutTemplateRequest struct {
+	Title       string            `json:"title"`
+	Body        string            `json:"body"`
+	DefaultData map[string]string `json:"default_data"` // Optional, sent as FCM data and available as variables unless the request overrides them
+}
+
+type TemplateResponse struct {
+	TemplateKey string            `json:"template_key"`
+	Locale      string            `json:"locale"`
+	Title       string            `json:"title"`
+	Body        string            `json:"body"`
+	DefaultData map[string]string `json:"default_data"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+type ListTemplatesResponse struct {
+	Templates []TemplateResponse `json:"templates"`
+}
+
+type DeleteTemplateResponse struct {
+	OK bool `json:"ok"`
+}
+
+// ListTemplatesHandler is the Lambda handler for GET /templates?key=, listing every locale
+// of the template key, or all templates without key
+func (s *Service) ListTemplatesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list templates request")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	templates, err := queries.ListTemplates(ctx, optionalText(request.QueryStringParameters["key"]))
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	response := ListTemplatesResponse{Templates: make([]TemplateResponse, 0, len(templates))}
+	for _, tmpl := range templates {
+		templateResponse, err := newTemplateResponse(tmpl)
+		if err != nil {
+			return logger.InternalServerError(ctx, err, "Invalid template default_data")
+		}
+		response.Templates = append(response.Templates, templateResponse)
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// GetTemplateHandler is the Lambda handler for GET /templates/{key}/{locale}
+func (s *Service) GetTemplateHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received get template request")
+
+	key, locale, err := templatePathParameters(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid template key or locale")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	tmpl, err := queries.GetTemplate(ctx, sqlc.GetTemplateParams{TemplateKey: key, Locale: locale})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err := fmt.Errorf("template not found: key=%s, locale=%s", key, locale)
+			return logger.NotFound(ctx, err, "Template not found")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	response, err := newTemplateResponse(tmpl)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Invalid template default_data")
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// PutTemplateHandler is the Lambda handler for PUT /templates/{key}/{locale}.
+// It creates the template or replaces its title, body and default data.
+func (s *Service) PutTemplateHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received put template request")
+
+	key, locale, err := templatePathParameters(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid template key or locale")
+	}
+
+	// default_data must be an object of strings, like FCM data
+	var putRequest PutTemplateRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &putRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+
+	// Validate required fields
+	if putRequest.Title == "" || putRequest.Body == "" {
+		err := fmt.Errorf("missing required fields: title, body")
+		return logger.BadRequest(ctx, err, "Missing required fields")
+	}
+
+	// Reject syntax errors now rather than on every send
+	if _, err := parseMessageTemplate("title", putRequest.Title); err != nil {
+		return logger.BadRequest(ctx, err, "Invalid title template")
+	}
+	if _, err := parseMessageTemplate("body", putRequest.Body); err != nil {
+		return logger.BadRequest(ctx, err, "Invalid body template")
+	}
+
+	if putRequest.DefaultData == nil {
+		putRequest.DefaultData = map[string]string{}
+	}
+	defaultData, err := json.Marshal(putRequest.DefaultData)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to encode default_data")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	tmpl, err := queries.UpsertTemplate(ctx, sqlc.UpsertTemplateParams{
+		TemplateKey: key,
+		Locale:      locale,
+		Title:       putRequest.Title,
+		Body:        putRequest.Body,
+		DefaultData: defaultData,
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+
+	logger.Info(ctx, "Template saved: key=%s, locale=%s", key, locale)
+
+	response, err := newTemplateResponse(tmpl)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Invalid template default_data")
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// DeleteTemplateHandler is the Lambda handler for DELETE /templates/{key}/{locale}
+func (s *Service) DeleteTemplateHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received delete template request")
+
+	key, locale, err := templatePathParameters(request)
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid template key or locale")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	deleted, err := queries.DeleteTemplate(ctx, sqlc.DeleteTemplateParams{TemplateKey: key, Locale: locale})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+	if deleted == 0 {
+		err := fmt.Errorf("template not found: key=%s, locale=%s", key, locale)
+		return logger.NotFound(ctx, err, "Template not found")
+	}
+
+	logger.Info(ctx, "Template deleted: key=%s, locale=%s", key, locale)
+
+	return logger.Success(ctx, DeleteTemplateResponse{OK: true})
+}
+
+// templatePathParameters returns the validated template key and normalized locale of the path
+func templatePathParameters(request events.APIGatewayProxyRequest) (string, string, error) {
+	key := request.PathParameters["key"]
+	if !templateKeyPattern.MatchString(key) {
+		return "", "", fmt.Errorf("invalid template key: %q (must match %s)", key, templateKeyPattern)
+	}
+	locale, err := normalizeLocale(request.PathParameters["locale"])
+	if err != nil {
+		return "", "", err
+	}
+	return key, locale, nil
+}
+
+func newTemplateResponse(tmpl sqlc.Template) (TemplateResponse, error) {
+	defaultData, err := templateDefaultData(tmpl)
+	if err != nil {
+		return TemplateResponse{}, err
+	}
+	return TemplateResponse{
+		TemplateKey: tmpl.TemplateKey,
+		Locale:      tmpl.Locale,
+		Title:       tmpl.Title,
+		Body:        tmpl.Body,
+		DefaultData: defaultData,
+		CreatedAt:   tmpl.CreatedAt.Time,
+		UpdatedAt:   tmpl.UpdatedAt.Time,
+	}, nil
+}
+
+// templateDefaultData decodes templates.default_data, which PutTemplateHandler stores as an object of strings
+func templateDefaultData(tmpl sqlc.Template) (map[string]string, error) {
+	defaultData := map[string]string{}
+	if len(tmpl.DefaultData) == 0 {
+		return defaultData, nil
+	}
+	if err := json.Unmarshal(tmpl.DefaultData, &defaultData); err != nil {
+		return nil, fmt.Errorf("invalid default_data of template %s/%s: %w", tmpl.TemplateKey, tmpl.Locale, err)
+	}
+	return defaultData, nil
+}
+
+// normalizeLocale validates a locale and returns it in the canonical case of BCP 47:
+// "pt_br" and "PT-br" become "pt-BR", "zh-hant-tw" becomes "zh-Hant-TW"
+func normalizeLocale(locale string) (string, error) {
+	if !localePattern.MatchString(locale) {
+		return "", fmt.Errorf("invalid locale: %q", locale)
+	}
+	subtags := strings.FieldsFunc(locale, func(r rune) bool { return r == '-' || r == '_' })
+	subtags[0] = strings.ToLower(subtags[0])
+	for i, subtag := range subtags[1:] {
+		switch len(subtag) {
+		case 2: // Region
+			subtags[i+1] = strings.ToUpper(subtag)
+		case 4: // Script
+			subtags[i+1] = strings.ToUpper(subtag[:1]) + strings.ToLower(subtag[1:])
+		default:
+			subtags[i+1] = strings.ToLower(subtag)
+		}
+	}
+	return strings.Join(subtags, "-"), nil
+}
+
+// selectTemplate picks the template for a device locale from the locales of one template key:
+// the exact locale, then the locale with its last subtags dropped ("pt-BR" → "pt"), then defaultLocale.
+// Devices without a locale get the defaultLocale template.
+func selectTemplate(templates map[string]sqlc.Template, deviceLocale, defaultLocale string) (sqlc.Template, bool) {
+	if locale, err := normalizeLocale(deviceLocale); err == nil {
+		for {
+			if tmpl, ok := templates[locale]; ok {
+				return tmpl, true
+			}
+			i := strings.LastIndex(locale, "-")
+			if i < 0 {
+				break
+			}
+			locale = locale[:i]
+		}
+	}
+	tmpl, ok := templates[defaultLocale]
+	return tmpl, ok
+}
+
+// messageContent is what a device is sent apart from the message's data and tokens
+type messageContent struct {
+	Title       string
+	Body        string
+	DefaultData map[string]string // Data of the template, overridden by the request's data
+}
+
+// renderTemplateForDevices renders the templates of one template key for every device, in the
+// locale picked by selectTemplate, and returns the content by device ID. Each locale is rendered once.
+// Every variable referenced by a template must be provided or in its default_data, otherwise
+// errTemplateRender is returned.
+func renderTemplateForDevices(templates []sqlc.Template, devices []sqlc.ListActiveDevicesByPlatformsRow, variables map[string]any, defaultLocale string) (map[string]messageContent, error) {
+	byLocale := make(map[string]sqlc.Template, len(templates))
+	for _, tmpl := range templates {
+		byLocale[tmpl.Locale] = tmpl
+	}
+	if variables == nil {
+		variables = map[string]any{}
+	}
+
+	rendered := make(map[string]messageContent) // By template locale
+	contents := make(map[string]messageContent, len(devices))
+	for _, device := range devices {
+		tmpl, ok := selectTemplate(byLocale, device.Locale.String, defaultLocale)
+		if !ok {
+			return nil, fmt.Errorf("%w: no template for locale %q of device %s and no template for default locale %q",
+				errTemplateRender, device.Locale.String, device.DeviceID, defaultLocale)
+		}
+		content, ok := rendered[tmpl.Locale]
+		if !ok {
+			var err error
+			content, err = renderTemplate(tmpl, variables)
+			if err != nil {
+				return nil, err
+			}
+			rendered[tmpl.Locale] = content
+		}
+		contents[device.DeviceID] = content
+	}
+	return contents, nil
+}
+
+// renderTemplate renders the title and body of a template with variables. The template's
+// default_data is available as variables too, unless variables sets the same key.
+func renderTemplate(tmpl sqlc.Template, variables map[string]any) (messageContent, error) {
+	defaultData, err := templateDefaultData(tmpl)
+	if err != nil {
+		return messageContent{}, err
+	}
+	merged := make(map[string]any, len(defaultData)+len(variables))
+	for k, v := range defaultData {
+		merged[k] = v
+	}
+	for k, v := range variables {
+		merged[k] = v
+	}
+
+	title, err := executeMessageTemplate("title", tmpl.Title, merged)
+	if err != nil {
+		return messageContent{}, fmt.Errorf("%w: %s/%s: %v", errTemplateRender, tmpl.TemplateKey, tmpl.Locale, err)
+	}
+	body, err := executeMessageTemplate("body", tmpl.Body, merged)
+	if err != nil {
+		return messageContent{}, fmt.Errorf("%w: %s/%s: %v", errTemplateRender, tmpl.TemplateKey, tmpl.Locale, err)
+	}
+	return messageContent{Title: title, Body: body, DefaultData: defaultData}, nil
+}
+
+// parseMessageTemplate parses a title or body; executing it fails on variables that are not provided
+func parseMessageTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+func executeMessageTemplate(name, text string, variables map[string]any) (string, error) {
+	tmpl, err := parseMessageTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, variables); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// withDefaultData returns a copy of data with the keys of defaultData it does not set
+func withDefaultData(defaultData, data map[string]string) map[string]string {
+	merged := make(map[string]string, len(defaultData)+len(data))
+	for k, v := range defaultData {
+		merged[k] = v
+	}
+	for k, v := range data {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+)
+
+// invokeTemplate invokes a /templates/{key}/{locale} handler.
+func invokeTemplate(t *testing.T, handler apiHandler, key, locale, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Body:           body,
+		PathParameters: map[string]string{"key": key, "locale": locale},
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return response
+}
+
+// putTemplate creates or replaces a template through PutTemplateHandler.
+func putTemplate(t *testing.T, service *Service, key, locale, body string) {
+	t.Helper()
+	expectStatus(t, invokeTemplate(t, service.PutTemplateHandler, key, locale, body), 200)
+}
+
+// registerLocalizedDevices registers devices of user-1 in the locales pt-BR, de-AT and none.
+func registerLocalizedDevices(t *testing.T, service *Service) {
+	t.Helper()
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","locale":"pt_br"}`, nil), 200)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-2","fcm_token":"token-2","platform":"ios","locale":"de-AT"}`, nil), 200)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-3","fcm_token":"token-3","platform":"android"}`, nil), 200)
+}
+
+func TestNormalizeLocale(t *testing.T) {
+	for locale, want := range map[string]string{
+		"en":         "en",
+		"pt_br":      "pt-BR",
+		"PT-br":      "pt-BR",
+		"zh-hant-tw": "zh-Hant-TW",
+		"es-419":     "es-419",
+	} {
+		if got, err := normalizeLocale(locale); err != nil || got != want {
+			t.Errorf("normalizeLocale(%q) = %q, %v; want %q", locale, got, err, want)
+		}
+	}
+	for _, locale := range []string{"", "e", "english", "en--US", "en-", "en US", "en-US-toolongsubtag"} {
+		if _, err := normalizeLocale(locale); err == nil {
+			t.Errorf("normalizeLocale(%q) accepted an invalid locale", locale)
+		}
+	}
+}
+
+func TestSelectTemplate(t *testing.T) {
+	templates := map[string]sqlc.Template{
+		"en":    {Locale: "en"},
+		"pt":    {Locale: "pt"},
+		"zh-TW": {Locale: "zh-TW"},
+	}
+	for deviceLocale, want := range map[string]string{
+		"pt-BR":      "pt",
+		"zh-TW":      "zh-TW",
+		"zh-Hant-TW": "en", // Only trailing subtags are dropped
+		"de":         "en",
+		"":           "en",
+		"not a tag":  "en",
+	} {
+		if got, ok := selectTemplate(templates, deviceLocale, "en"); !ok || got.Locale != want {
+			t.Errorf("selectTemplate(%q) = %q, %v; want %q", deviceLocale, got.Locale, ok, want)
+		}
+	}
+
+	if _, ok := selectTemplate(templates, "de", "fr"); ok {
+		t.Error("selected a template without a template in the default locale")
+	}
+}
+
+func TestTemplateCRUD(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	expectStatus(t, invokeTemplate(t, service.GetTemplateHandler, "welcome", "en", ""), 404)
+	putTemplate(t, service, "welcome", "en", `{"title":"Welcome","body":"Hi {{.name}}","default_data":{"screen":"home"}}`)
+	putTemplate(t, service, "welcome", "PT_br", `{"title":"Bem-vindo","body":"Olá {{.name}}"}`)
+	putTemplate(t, service, "reminder", "en", `{"title":"Reminder","body":"Don't forget"}`)
+
+	// Replacing a template keeps its creation time
+	fakes.clock.Advance(time.Minute)
+	putTemplate(t, service, "welcome", "en", `{"title":"Welcome!","body":"Hi {{.name}}","default_data":{"screen":"home"}}`)
+
+	response := invokeTemplate(t, service.GetTemplateHandler, "welcome", "en", "")
+	expectStatus(t, response, 200)
+	var got TemplateResponse
+	decodeBody(t, response, &got)
+	if got.Title != "Welcome!" || got.DefaultData["screen"] != "home" || !got.UpdatedAt.After(got.CreatedAt) {
+		t.Fatalf("unexpected template: %+v", got)
+	}
+
+	response = invoke(t, service.ListTemplatesHandler, "", map[string]string{"key": "welcome"})
+	expectStatus(t, response, 200)
+	var list ListTemplatesResponse
+	decodeBody(t, response, &list)
+	if len(list.Templates) != 2 || list.Templates[0].Locale != "en" || list.Templates[1].Locale != "pt-BR" {
+		t.Fatalf("unexpected templates: %+v", list)
+	}
+	response = invoke(t, service.ListTemplatesHandler, "", nil)
+	expectStatus(t, response, 200)
+	decodeBody(t, response, &list)
+	if len(list.Templates) != 3 {
+		t.Fatalf("expected all three templates, got %+v", list)
+	}
+
+	expectStatus(t, invokeTemplate(t, service.DeleteTemplateHandler, "welcome", "pt-br", ""), 200)
+	expectStatus(t, invokeTemplate(t, service.DeleteTemplateHandler, "welcome", "pt-BR", ""), 404)
+	expectStatus(t, invokeTemplate(t, service.GetTemplateHandler, "welcome", "pt-BR", ""), 404)
+}
+
+func TestPutTemplateRejectsInvalidTemplates(t *testing.T) {
+	service, fakes := newFakeService(t)
+
+	for name, request := range map[string]struct{ key, locale, body string }{
+		"key":          {"Welcome Message", "en", `{"title":"Welcome","body":"Hi"}`},
+		"locale":       {"welcome", "english", `{"title":"Welcome","body":"Hi"}`},
+		"no body":      {"welcome", "en", `{"title":"Welcome"}`},
+		"syntax":       {"welcome", "en", `{"title":"Welcome","body":"Hi {{.name"}`},
+		"default_data": {"welcome", "en", `{"title":"Welcome","body":"Hi","default_data":{"count":1}}`},
+	} {
+		if response := invokeTemplate(t, service.PutTemplateHandler, request.key, request.locale, request.body); response.StatusCode != 400 {
+			t.Errorf("%s: expected 400, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+	if len(fakes.querier.templates) != 0 {
+		t.Fatalf("invalid templates were stored: %+v", fakes.querier.templates)
+	}
+}
+
+func TestSendTemplateMessage(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerLocalizedDevices(t, service)
+	putTemplate(t, service, "welcome", "en", `{"title":"Welcome","body":"Hi {{.name}}, you have {{.count}} points","default_data":{"screen":"home","campaign":"spring"}}`)
+	putTemplate(t, service, "welcome", "pt", `{"title":"Bem-vindo","body":"Olá {{.name}}, você tem {{.count}} pontos","default_data":{"screen":"inicio"}}`)
+
+	response := invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","template_key":"welcome","variables":{"name":"Ana","count":3},"data":{"campaign":"summer"}}`, nil)
+	expectStatus(t, response, 200)
+
+	// device-1 (pt-BR) falls back to pt, device-2 (de-AT) and device-3 (no locale) to the default en
+	for token, want := range map[string]PushMessage{
+		"token-1": {Title: "Bem-vindo", Body: "Olá Ana, você tem 3 pontos", Data: map[string]string{"screen": "inicio", "campaign": "summer"}},
+		"token-2": {Title: "Welcome", Body: "Hi Ana, you have 3 points", Data: map[string]string{"screen": "home", "campaign": "summer"}},
+		"token-3": {Title: "Welcome", Body: "Hi Ana, you have 3 points", Data: map[string]string{"screen": "home", "campaign": "summer"}},
+	} {
+		got := sentMessageTo(t, fakes, token)
+		if got.Title != want.Title || got.Body != want.Body {
+			t.Errorf("%s: expected %q / %q, got %q / %q", token, want.Title, want.Body, got.Title, got.Body)
+		}
+		for k, v := range want.Data {
+			if got.Data[k] != v {
+				t.Errorf("%s: expected data %s=%q, got %q", token, k, v, got.Data[k])
+			}
+		}
+		if got.Data[messageIDDataKey] == "" || got.Data[receiptTokenDataKey] == "" {
+			t.Errorf("%s: template message without message_id or receipt_token: %+v", token, got.Data)
+		}
+	}
+}
+
+func TestSendTemplateMessageDefaultData(t *testing.T) {
+	service, fakes := newFakeService(t)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	putTemplate(t, service, "reminder", "en", `{"title":"Reminder","body":"Open {{.screen}}, {{.name}}","default_data":{"screen":"home","name":"there"}}`)
+
+	// default_data fills the variables the request leaves out; the FCM data keeps default_data
+	for variables, want := range map[string]string{
+		`{}`:                 "Open home, there",
+		`{"name":"Ana"}`:     "Open home, Ana",
+		`{"screen":"inbox"}`: "Open inbox, there",
+	} {
+		expectStatus(t, invoke(t, service.SendMessageHandler,
+			`{"user_id":"user-1","category":"system","template_key":"reminder","variables":`+variables+`}`, nil), 200)
+		sent := fakes.sender.Sent()
+		got := sent[len(sent)-1]
+		if got.Body != want || got.Data["screen"] != "home" {
+			t.Errorf("variables %s: expected %q with screen=home, got %q with screen=%q", variables, want, got.Body, got.Data["screen"])
+		}
+	}
+}
+
+func TestSendTemplateMessageErrors(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerLocalizedDevices(t, service)
+	putTemplate(t, service, "welcome", "en", `{"title":"Welcome","body":"Hi {{.name}}"}`)
+	putTemplate(t, service, "greeting", "pt", `{"title":"Olá","body":"Olá"}`)
+
+	for name, body := range map[string]string{
+		"missing variable":  `{"user_id":"user-1","category":"system","template_key":"welcome","variables":{"nome":"Ana"}}`,
+		"no variables":      `{"user_id":"user-1","category":"system","template_key":"welcome"}`,
+		"unknown key":       `{"user_id":"user-1","category":"system","template_key":"farewell","variables":{"name":"Ana"}}`,
+		"no default locale": `{"user_id":"user-1","category":"system","template_key":"greeting"}`,
+		"title and key":     `{"user_id":"user-1","category":"system","template_key":"welcome","title":"Hello","variables":{"name":"Ana"}}`,
+		"variables only":    `{"user_id":"user-1","category":"system","title":"Hello","body":"World","variables":{"name":"Ana"}}`,
+		"neither":           `{"user_id":"user-1"}`,
+	} {
+		if response := invoke(t, service.SendMessageHandler, body, nil); response.StatusCode != 400 {
+			t.Errorf("%s: expected 400, got %d: %s", name, response.StatusCode, response.Body)
+		}
+	}
+
+	// Rendering fails before anything is persisted or sent
+	if len(fakes.sender.Sent()) != 0 || len(fakes.querier.messages) != 0 {
+		t.Fatalf("message sent or created for a template that cannot be rendered")
+	}
+}
+
+func TestRegisterDeviceLocale(t *testing.T) {
+	service, fakes := newFakeService(t)
+	registerLocalizedDevices(t, service)
+
+	devices, err := fakes.querier.ListActiveDevicesByPlatforms(t.Context(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 || devices[0].Locale.String != "pt-BR" || devices[1].Locale.String != "de-AT" || devices[2].Locale.Valid {
+		t.Fatalf("unexpected device locales: %+v", devices)
+	}
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","locale":"Portuguese"}`, nil), 400)
+}
+
+func TestTemplateHandlers(t *testing.T) {
+	requireDB(t)
+	expectStatus(t, invoke(t, testService.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android","locale":"pt-BR"}`, nil), 200)
+	registerDevice(t, "user-1", "device-2", "token-2", "ios")
+
+	putTemplate(t, testService, "welcome", "en", `{"title":"Welcome","body":"Hi {{.name}}","default_data":{"screen":"home"}}`)
+	putTemplate(t, testService, "welcome", "pt-BR", `{"title":"Bem-vindo","body":"Olá {{.name}}"}`)
+
+	response := invoke(t, testService.ListTemplatesHandler, "", map[string]string{"key": "welcome"})
+	expectStatus(t, response, 200)
+	var list ListTemplatesResponse
+	decodeBody(t, response, &list)
+	if len(list.Templates) != 2 || list.Templates[0].DefaultData["screen"] != "home" {
+		t.Fatalf("unexpected templates: %+v", list)
+	}
+
+	expectStatus(t, invoke(t, testService.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","template_key":"welcome","variables":{"name":"Ana"}}`, nil), 200)
+	bodies := map[string]string{}
+	for _, message := range testFCM.Messages() {
+		bodies[message.Token] = message.Body
+	}
+	if bodies["token-1"] != "Olá Ana" || bodies["token-2"] != "Hi Ana" {
+		t.Fatalf("unexpected rendered bodies: %v", bodies)
+	}
+
+	expectStatus(t, invoke(t, testService.SendMessageHandler, `{"user_id":"user-1","category":"system","template_key":"welcome"}`, nil), 400)
+
+	expectStatus(t, invokeTemplate(t, testService.DeleteTemplateHandler, "welcome", "pt-BR", ""), 200)
+	expectStatus(t, invokeTemplate(t, testService.GetTemplateHandler, "welcome", "pt-BR", ""), 404)
+}
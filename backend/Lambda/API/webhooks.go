@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/common"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Webhooks tell other systems about deliveries, registrations and acks. Handlers emit an event
+// through the outbox, in the transaction of the change (see emitWebhookEvent); publishing it
+// enqueues one delivery per subscription to its type (see publishWebhookEvent). WebhookHandler,
+// which runs on a schedule, POSTs due deliveries to their subscription's URL, signed with its
+// secret (see signWebhookPayload). Failed deliveries are retried with exponential backoff and
+// moved to webhook_dead_letters after webhookMaxAttempts. Deliveries are at least once:
+// receivers dedupe on the X-Webhook-ID header, the ID of the event.
+
+// Webhook event types
+const (
+	webhookMessageSent            = "message.sent"             // FCM accepted a message for a device
+	webhookMessageFailed          = "message.failed"           // A message could not be sent to a device
+	webhookDeviceRegistered       = "device.registered"        // A device was registered or updated
+	webhookDeviceTokenInvalidated = "device.token_invalidated" // FCM or APNs rejected a device's token; the device was deactivated
+	webhookTestRunAcked           = "test_run.acked"           // A device acked an e2e test run
+)
+
+// webhookEventTypes are the event types subscriptions can choose from
+var webhookEventTypes = []string{
+	webhookMessageSent,
+	webhookMessageFailed,
+	webhookDeviceRegistered,
+	webhookDeviceTokenInvalidated,
+	webhookTestRunAcked,
+}
+
+// Headers of webhook deliveries
+const (
+	webhookIDHeader        = "X-Webhook-ID"        // Event ID, the same for every attempt
+	webhookEventHeader     = "X-Webhook-Event"     // Event type
+	webhookTimestampHeader = "X-Webhook-Timestamp" // Unix time of the attempt, signed with the payload
+	webhookSignatureHeader = "X-Webhook-Signature" // sha256=<hex HMAC-SHA256 of timestamp + "." + payload>
+)
+
+// Limits of subscriptions
+const (
+	minWebhookSecretLength = 16
+	maxWebhookSecretLength = 256
+	maxWebhookURLLength    = 2048
+)
+
+// Paging of GET /webhooks/{subscription_id}/dead-letters
+const (
+	defaultWebhookDeadLettersLimit = 20
+	maxWebhookDeadLettersLimit     = 100
+)
+
+const (
+	// webhookMaxAttempts is the number of attempts before a delivery is dead-lettered
+	webhookMaxAttempts = 8
+	// webhookInitialBackoff is the delay after the first failed attempt; it doubles after every attempt
+	webhookInitialBackoff = 30 * time.Second
+	// webhookMaxBackoff caps the delay between attempts
+	webhookMaxBackoff = time.Hour
+	// webhookRequestTimeout bounds one attempt, including reading the response
+	webhookRequestTimeout = 10 * time.Second
+	// webhookBatchSize is the number of deliveries claimed at a time
+	webhookBatchSize = 100
+	// webhookConcurrency bounds the attempts in flight per batch
+	webhookConcurrency = 10
+	// webhookLease is how long an invocation holds the deliveries it claimed. It must exceed the
+	// time to attempt one batch, or another invocation attempts them again.
+	webhookLease = 2 * time.Minute
+	// webhookBatchMargin is the time a batch needs; no batch starts with less time left
+	webhookBatchMargin = 2 * webhookRequestTimeout
+	// webhookWorkerTime is how long WebhookHandler delivers without a Lambda deadline
+	webhookWorkerTime = 5 * time.Minute
+	// maxWebhookErrorBody is how much of a failed response's body is recorded as the error
+	maxWebhookErrorBody = 512
+)
+
+type CreateWebhookRequest struct {
+	URL         string   `json:"url"`         // https URL the events are POSTed to
+	EventTypes  []string `json:"event_types"` // Events to deliver, e.g. ["message.sent", "message.failed"]
+	Secret      string   `json:"secret"`      // Signs the payloads, 16-256 characters; never returned
+	Description string   `json:"description"`
+}
+
+type WebhookResponse struct {
+	SubscriptionID string    `json:"subscription_id"`
+	URL            string    `json:"url"`
+	EventTypes     []string  `json:"event_types"`
+	Description    string    `json:"description"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ListWebhooksResponse struct {
+	Webhooks []WebhookResponse `json:"webhooks"`
+}
+
+type DeleteWebhookResponse struct {
+	OK bool `json:"ok"`
+}
+
+// WebhookDeadLetterResponse is a delivery that failed webhookMaxAttempts times
+type WebhookDeadLetterResponse struct {
+	DeliveryID int64           `json:"delivery_id"`
+	EventID    string          `json:"event_id"`
+	EventType  string          `json:"event_type"`
+	Payload    json.RawMessage `json:"payload"` // The event as it would have been delivered
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
+
+type ListWebhookDeadLettersResponse struct {
+	DeadLetters []WebhookDeadLetterResponse `json:"dead_letters"`
+}
+
+// WebhookEvent is the payload of a webhook delivery
+type WebhookEvent struct {
+	ID        string    `json:"id"`   // e.g. "evt-…", also sent as X-Webhook-ID
+	Type      string    `json:"type"` // One of webhookEventTypes
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"` // MessageEventData, DeviceEventData or TestRunAckedEventData
+}
+
+// MessageEventData is the data of message.sent and message.failed events, one per device
+type MessageEventData struct {
+	MessageID     string `json:"message_id"`
+	UserID        string `json:"user_id"`
+	DeviceID      string `json:"device_id"`
+	Platform      string `json:"platform"`
+	AppID         string `json:"app_id"`
+	CampaignID    string `json:"campaign_id,omitempty"`
+	Variant       string `json:"variant,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`          // e2e test messages only
+	FailureReason string `json:"failure_reason,omitempty"` // message.failed only
+}
+
+// DeviceEventData is the data of device.registered and device.token_invalidated events
+type DeviceEventData struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	Platform string `json:"platform"`
+	AppID    string `json:"app_id"`
+	Locale   string `json:"locale,omitempty"`
+}
+
+// TestRunAckedEventData is the data of test_run.acked events
+type TestRunAckedEventData struct {
+	Nonce    string `json:"nonce"`
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	TestRunLatency
+}
+
+// WebhookResult is returned by WebhookHandler
+type WebhookResult struct {
+	Delivered    int `json:"delivered"`     // Deliveries the receiver accepted
+	Retried      int `json:"retried"`       // Failed attempts that will be retried
+	DeadLettered int `json:"dead_lettered"` // Deliveries that failed for the last time
+}
+
+// ListWebhooksHandler is the Lambda handler for GET /webhooks
+func (s *Service) ListWebhooksHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list webhooks request")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	subscriptions, err := queries.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	response := ListWebhooksResponse{Webhooks: make([]WebhookResponse, 0, len(subscriptions))}
+	for _, subscription := range subscriptions {
+		response.Webhooks = append(response.Webhooks, newWebhookResponse(subscription))
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// CreateWebhookHandler is the Lambda handler for POST /webhooks. Events emitted from then on are
+// delivered to the new subscription.
+func (s *Service) CreateWebhookHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received create webhook request")
+
+	var createRequest CreateWebhookRequest
+	if errorResp := logger.ParseRequestBody(ctx, request.Body, &createRequest); errorResp != nil {
+		return logger.BadRequest(ctx, nil, "Invalid request body")
+	}
+	eventTypes, err := createRequest.validate()
+	if err != nil {
+		return logger.BadRequest(ctx, err, "Invalid webhook")
+	}
+	if err := s.checkWebhookHost(ctx, createRequest.URL); err != nil {
+		return logger.BadRequest(ctx, err, "Webhook host not allowed")
+	}
+
+	subscriptionID, err := newWebhookSubscriptionID()
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Failed to generate subscription ID")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	subscription, err := queries.CreateWebhookSubscription(ctx, sqlc.CreateWebhookSubscriptionParams{
+		SubscriptionID: subscriptionID,
+		Url:            createRequest.URL,
+		EventTypes:     eventTypes,
+		Secret:         createRequest.Secret,
+		Description:    createRequest.Description,
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+
+	logger.Info(ctx, "Webhook created: subscription_id=%s, event_types=%v", subscriptionID, eventTypes)
+
+	return logger.Success(ctx, newWebhookResponse(subscription))
+}
+
+// GetWebhookHandler is the Lambda handler for GET /webhooks/{subscription_id}
+func (s *Service) GetWebhookHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received get webhook request")
+
+	subscriptionID := request.PathParameters["subscription_id"]
+	if subscriptionID == "" {
+		return logger.BadRequest(ctx, nil, "Missing subscription_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	subscription, err := queries.GetWebhookSubscription(ctx, subscriptionID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err := fmt.Errorf("webhook not found: %s", subscriptionID)
+			return logger.NotFound(ctx, err, "Webhook not found")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	return logger.Success(ctx, newWebhookResponse(subscription))
+}
+
+// DeleteWebhookHandler is the Lambda handler for DELETE /webhooks/{subscription_id}.
+// Pending deliveries and dead letters of the subscription are deleted with it.
+func (s *Service) DeleteWebhookHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received delete webhook request")
+
+	subscriptionID := request.PathParameters["subscription_id"]
+	if subscriptionID == "" {
+		return logger.BadRequest(ctx, nil, "Missing subscription_id")
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	deleted, err := queries.DeleteWebhookSubscription(ctx, subscriptionID)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database operation failed")
+	}
+	if deleted == 0 {
+		err := fmt.Errorf("webhook not found: %s", subscriptionID)
+		return logger.NotFound(ctx, err, "Webhook not found")
+	}
+
+	logger.Info(ctx, "Webhook deleted: subscription_id=%s", subscriptionID)
+
+	return logger.Success(ctx, DeleteWebhookResponse{OK: true})
+}
+
+// ListWebhookDeadLettersHandler is the Lambda handler for GET /webhooks/{subscription_id}/dead-letters?limit=,
+// newest first
+func (s *Service) ListWebhookDeadLettersHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Received list webhook dead letters request")
+
+	subscriptionID := request.PathParameters["subscription_id"]
+	if subscriptionID == "" {
+		return logger.BadRequest(ctx, nil, "Missing subscription_id")
+	}
+
+	limit := defaultWebhookDeadLettersLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxWebhookDeadLettersLimit {
+			err := fmt.Errorf("invalid limit: %s", value)
+			return logger.BadRequest(ctx, err, fmt.Sprintf("limit must be 1-%d", maxWebhookDeadLettersLimit))
+		}
+	}
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database connection failed")
+	}
+
+	if _, err := queries.GetWebhookSubscription(ctx, subscriptionID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err := fmt.Errorf("webhook not found: %s", subscriptionID)
+			return logger.NotFound(ctx, err, "Webhook not found")
+		}
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	deadLetters, err := queries.ListWebhookDeadLetters(ctx, sqlc.ListWebhookDeadLettersParams{
+		SubscriptionID: subscriptionID,
+		LimitCount:     int32(limit),
+	})
+	if err != nil {
+		return logger.InternalServerError(ctx, err, "Database query failed")
+	}
+
+	response := ListWebhookDeadLettersResponse{DeadLetters: make([]WebhookDeadLetterResponse, 0, len(deadLetters))}
+	for _, deadLetter := range deadLetters {
+		response.DeadLetters = append(response.DeadLetters, WebhookDeadLetterResponse{
+			DeliveryID: deadLetter.DeliveryID,
+			EventID:    deadLetter.EventID,
+			EventType:  deadLetter.EventType,
+			Payload:    deadLetter.Payload,
+			Attempts:   int(deadLetter.Attempts),
+			LastError:  deadLetter.LastError,
+			CreatedAt:  deadLetter.CreatedAt.Time,
+			FailedAt:   deadLetter.FailedAt.Time,
+		})
+	}
+
+	return logger.Success(ctx, response)
+}
+
+// WebhookHandler is the Lambda handler that delivers due webhook deliveries, until there are none
+// or the Lambda deadline is near. It runs on an EventBridge schedule, so the event payload is ignored.
+func (s *Service) WebhookHandler(ctx context.Context) (*WebhookResult, error) {
+	logger := common.NewLogger()
+	logger.Info(ctx, "Delivering webhooks")
+
+	// Get database connection
+	queries, err := s.Store.Queries(ctx)
+	if err != nil {
+		logger.Error(ctx, err, "Database connection failed")
+		return nil, fmt.Errorf("database connection failed: %w", err)
+	}
+
+	stopAt := broadcastStopAt(ctx, webhookWorkerTime)
+	result := &WebhookResult{}
+	for time.Until(stopAt) >= webhookBatchMargin {
+		deliveries, err := queries.ClaimWebhookDeliveries(ctx, sqlc.ClaimWebhookDeliveriesParams{
+			LeaseExpiresAt: pgtype.Timestamptz{Time: s.Clock.Now().Add(webhookLease), Valid: true},
+			LimitCount:     webhookBatchSize,
+		})
+		if err != nil {
+			logger.Error(ctx, err, "Failed to claim webhook deliveries")
+			return result, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+		}
+		if len(deliveries) == 0 {
+			break
+		}
+
+		for i, err := range s.postWebhooks(ctx, deliveries) {
+			if err := s.recordWebhookAttempt(ctx, logger, queries, deliveries[i], err, result); err != nil {
+				logger.Error(ctx, err, "Failed to record webhook attempt: delivery_id=%d", deliveries[i].DeliveryID)
+				return result, fmt.Errorf("failed to record webhook attempt: %w", err)
+			}
+		}
+	}
+
+	logger.Info(ctx, "Delivered %d webhooks, %d to retry, %d dead-lettered", result.Delivered, result.Retried, result.DeadLettered)
+
+	return result, nil
+}
+
+// postWebhooks attempts up to webhookConcurrency deliveries at a time and returns the error of each
+func (s *Service) postWebhooks(ctx context.Context, deliveries []sqlc.ClaimWebhookDeliveriesRow) []error {
+	errs := make([]error, len(deliveries))
+	inFlight := make(chan struct{}, webhookConcurrency)
+	var wg sync.WaitGroup
+	for i, delivery := range deliveries {
+		wg.Add(1)
+		inFlight <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			errs[i] = s.postWebhook(ctx, delivery)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// postWebhook POSTs the stored event to the subscription's URL. Any 2xx response is a success.
+func (s *Service) postWebhook(ctx context.Context, delivery sqlc.ClaimWebhookDeliveriesRow) error {
+	timestamp := strconv.FormatInt(s.Clock.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, delivery.EventID)
+	req.Header.Set(webhookEventHeader, delivery.EventType)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := s.WebhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookErrorBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// recordWebhookAttempt deletes a delivered delivery, or schedules the next attempt of a failed
+// one, or moves it to webhook_dead_letters after its last attempt
+func (s *Service) recordWebhookAttempt(ctx context.Context, logger *common.Logger, queries sqlc.Querier, delivery sqlc.ClaimWebhookDeliveriesRow, attemptErr error, result *WebhookResult) error {
+	if attemptErr == nil {
+		result.Delivered++
+		return queries.DeleteWebhookDelivery(ctx, delivery.DeliveryID)
+	}
+
+	attempts := int(delivery.Attempts) + 1
+	if attempts >= webhookMaxAttempts {
+		logger.Error(ctx, attemptErr, "Webhook dead-lettered after %d attempts: delivery_id=%d, subscription_id=%s, event_id=%s",
+			attempts, delivery.DeliveryID, delivery.SubscriptionID, delivery.EventID)
+		result.DeadLettered++
+		_, err := queries.DeadLetterWebhookDelivery(ctx, sqlc.DeadLetterWebhookDeliveryParams{
+			DeliveryID: delivery.DeliveryID,
+			LastError:  attemptErr.Error(),
+		})
+		return err
+	}
+
+	backoff := webhookBackoff(attempts)
+	logger.Info(ctx, "Webhook attempt %d failed, retrying in %s: delivery_id=%d, subscription_id=%s, error=%v",
+		attempts, backoff, delivery.DeliveryID, delivery.SubscriptionID, attemptErr)
+	result.Retried++
+	return queries.RetryWebhookDelivery(ctx, sqlc.RetryWebhookDeliveryParams{
+		DeliveryID:    delivery.DeliveryID,
+		NextAttemptAt: pgtype.Timestamptz{Time: s.Clock.Now().Add(backoff), Valid: true},
+		LastError:     optionalText(attemptErr.Error()),
+	})
+}
+
+// webhookBackoff is the delay after the given number of failed attempts:
+// webhookInitialBackoff doubled after every attempt, up to webhookMaxBackoff
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookInitialBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
+
+// signWebhookPayload returns the X-Webhook-Signature of a payload: the hex HMAC-SHA256 of
+// timestamp + "." + payload with the subscription's secret. Receivers recompute it over the raw
+// body and reject old timestamps, so a captured delivery cannot be replayed later.
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// emitWebhookEvent writes an event as a webhook_event outbox entry in the caller's transaction,
+// so it is emitted if and only if the domain change commits. The caller publishes the entry
+// once the transaction has committed, see publishOutbox.
+func (s *Service) emitWebhookEvent(ctx context.Context, queries sqlc.Querier, eventType string, data any) (sqlc.Outbox, error) {
+	eventID, err := newWebhookEventID()
+	if err != nil {
+		return sqlc.Outbox{}, fmt.Errorf("failed to generate webhook event ID: %w", err)
+	}
+	return s.enqueueOutbox(ctx, queries, outboxWebhookEvent, WebhookEvent{
+		ID:        eventID,
+		Type:      eventType,
+		CreatedAt: s.Clock.Now().UTC(),
+		Data:      data,
+	})
+}
+
+// publishWebhookEvent enqueues the event of a webhook_event entry for every subscription to its
+// type, and deletes the entry in the same transaction
+func (s *Service) publishWebhookEvent(ctx context.Context, logger *common.Logger, entry sqlc.Outbox) error {
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(entry.Payload, &event); err != nil {
+		return fmt.Errorf("invalid webhook_event payload: %w", err)
+	}
+
+	var subscriptions int64
+	err := s.Store.InTx(ctx, func(queries sqlc.Querier) error {
+		deleted, err := queries.DeleteOutboxEntry(ctx, entry.OutboxID)
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return errOutboxEntryPublished
+		}
+		subscriptions, err = queries.EnqueueWebhookEvent(ctx, sqlc.EnqueueWebhookEventParams{
+			EventID:   event.ID,
+			EventType: event.Type,
+			Payload:   entry.Payload,
+		})
+		return err
+	})
+	if errors.Is(err, errOutboxEntryPublished) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to enqueue webhook event %s: %w", event.ID, err)
+	}
+	if subscriptions > 0 {
+		logger.Info(ctx, "Webhook event enqueued: event_id=%s, event_type=%s, subscriptions=%d", event.ID, event.Type, subscriptions)
+	}
+	return nil
+}
+
+// validate checks a subscription and returns its event types without duplicates
+func (r CreateWebhookRequest) validate() ([]string, error) {
+	if len(r.URL) > maxWebhookURLLength {
+		return nil, fmt.Errorf("url must be at most %d characters", maxWebhookURLLength)
+	}
+	parsed, err := url.Parse(r.URL)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return nil, fmt.Errorf("invalid url %q: must be an absolute https URL", r.URL)
+	}
+	if len(r.Secret) < minWebhookSecretLength || len(r.Secret) > maxWebhookSecretLength {
+		return nil, fmt.Errorf("secret must be %d-%d characters", minWebhookSecretLength, maxWebhookSecretLength)
+	}
+	if len(r.EventTypes) == 0 {
+		return nil, fmt.Errorf("missing required field: event_types (any of %v)", webhookEventTypes)
+	}
+
+	known := make(map[string]bool, len(webhookEventTypes))
+	for _, eventType := range webhookEventTypes {
+		known[eventType] = true
+	}
+	eventTypes := make([]string, 0, len(r.EventTypes))
+	seen := make(map[string]bool, len(r.EventTypes))
+	for _, eventType := range r.EventTypes {
+		if !known[eventType] {
+			return nil, fmt.Errorf("unknown event type %q (must be one of %v)", eventType, webhookEventTypes)
+		}
+		if !seen[eventType] {
+			seen[eventType] = true
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	return eventTypes, nil
+}
+
+// errWebhookAddressNotAllowed is returned for webhook hosts on loopback, link-local, private or
+// shared addresses, e.g. the instance metadata endpoint 169.254.169.254 or other hosts in the VPC
+var errWebhookAddressNotAllowed = errors.New("webhook address not allowed")
+
+// errWebhookRedirectNotAllowed is returned when a receiver redirects a webhook to a URL that is not https
+var errWebhookRedirectNotAllowed = errors.New("webhook redirect not allowed")
+
+var (
+	// sharedAddressSpace is 100.64.0.0/10, used by carrier-grade NAT and not covered by IsPrivate
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+	// nat64Prefix is the well-known NAT64 prefix; its last 32 bits are the IPv4 address reached
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+)
+
+// webhookAddressAllowed reports whether webhooks may be posted to addr: public unicast addresses
+// only. NAT64 addresses are judged by the IPv4 address they translate to.
+func webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if nat64Prefix.Contains(addr) {
+		ip := addr.As16()
+		addr = netip.AddrFrom4([4]byte(ip[12:]))
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// checkWebhookHost resolves the host of a validated subscription URL and rejects it if any of its
+// addresses is not allowed. DNS can change after the subscription is created, so WebhookClient
+// checks every connection again when it dials (see newWebhookClient).
+func (s *Service) checkWebhookHost(ctx context.Context, rawURL string) error {
+	if s.WebhookAllowPrivate {
+		return nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", parsed.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve webhook host %s: %w", parsed.Hostname(), err)
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", errWebhookAddressNotAllowed, parsed.Hostname(), addr)
+		}
+	}
+	return nil
+}
+
+// webhookDialControl refuses connections to addresses webhooks may not be posted to. It runs after
+// DNS resolution, for every connection, including those of redirects.
+func webhookDialControl(network, address string, conn syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, address)
+	}
+	if !webhookAddressAllowed(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, address)
+	}
+	return nil
+}
+
+// webhookCheckRedirect follows up to 10 redirects, like the default client, but only to https
+// URLs, so a redirect cannot send a signed payload in the clear.
+func webhookCheckRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("%w: %s", errWebhookRedirectNotAllowed, req.URL.Redacted())
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// newWebhookClient creates the client that posts webhook deliveries. Unless allowPrivate is set,
+// it only connects to public addresses (see webhookDialControl). It uses no proxy, whose address
+// would be checked instead of the receiver's, and follows https redirects only.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookRequestTimeout}
+	if !allowPrivate {
+		dialer.Control = webhookDialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookRequestTimeout, Transport: transport, CheckRedirect: webhookCheckRedirect}
+}
+
+func newWebhookSubscriptionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "wh-" + hex.EncodeToString(b), nil
+}
+
+func newWebhookEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "evt-" + hex.EncodeToString(b), nil
+}
+
+// newWebhookResponse leaves out the secret, which is never returned
+func newWebhookResponse(subscription sqlc.WebhookSubscription) WebhookResponse {
+	return WebhookResponse{
+		SubscriptionID: subscription.SubscriptionID,
+		URL:            subscription.Url,
+		EventTypes:     subscription.EventTypes,
+		Description:    subscription.Description,
+		CreatedAt:      subscription.CreatedAt.Time,
+	}
+}
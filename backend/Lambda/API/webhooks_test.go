@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fcm-tutorial/lambda/api/sqlc"
+)
+
+const testWebhookSecret = "webhook-secret-0123456789"
+
+// receivedWebhook is a delivery received by a webhookReceiver.
+type receivedWebhook struct {
+	HeaderID    string          `json:"-"` // X-Webhook-ID
+	HeaderEvent string          `json:"-"` // X-Webhook-Event
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// webhookReceiver is an httptest server that verifies the signature of every delivery
+// and answers with a configurable status.
+type webhookReceiver struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	received []receivedWebhook
+	attempts int
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{t: t, status: http.StatusOK}
+	r.server = httptest.NewTLSServer(http.HandlerFunc(r.handle))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// testWebhookClient returns a client created by newWebhookClient that trusts the certificate
+// of httptest TLS servers, which is the same for every server.
+func testWebhookClient(allowPrivate bool) *http.Client {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	client := newWebhookClient(allowPrivate)
+	client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	return client
+}
+
+func (r *webhookReceiver) URL() string { return r.server.URL + "/hooks" }
+
+// SetStatus makes the receiver answer with status from now on.
+func (r *webhookReceiver) SetStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+// Received returns the deliveries accepted so far, ordered by event type and data:
+// WebhookHandler posts concurrently, so they arrive in any order.
+func (r *webhookReceiver) Received() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	received := append([]receivedWebhook(nil), r.received...)
+	sort.Slice(received, func(i, j int) bool {
+		if received[i].Type != received[j].Type {
+			return received[i].Type < received[j].Type
+		}
+		return string(received[i].Data) < string(received[j].Data)
+	})
+	return received
+}
+
+// Attempts returns the number of requests received so far, including rejected ones.
+func (r *webhookReceiver) Attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts
+}
+
+func (r *webhookReceiver) handle(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timestamp := req.Header.Get(webhookTimestampHeader)
+	expected := signWebhookPayload(testWebhookSecret, timestamp, body)
+	if timestamp == "" || !hmac.Equal([]byte(req.Header.Get(webhookSignatureHeader)), []byte(expected)) {
+		r.t.Errorf("invalid webhook signature %q for timestamp %q", req.Header.Get(webhookSignatureHeader), timestamp)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	delivery := receivedWebhook{HeaderID: req.Header.Get(webhookIDHeader), HeaderEvent: req.Header.Get(webhookEventHeader)}
+	if err := json.Unmarshal(body, &delivery); err != nil {
+		r.t.Errorf("invalid webhook payload %s: %v", body, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.status/100 != 2 {
+		http.Error(w, "unavailable", r.status)
+		return
+	}
+	r.received = append(r.received, delivery)
+	w.WriteHeader(r.status)
+}
+
+// createWebhook subscribes url to eventTypes through CreateWebhookHandler.
+func createWebhook(t *testing.T, service *Service, url string, eventTypes ...string) WebhookResponse {
+	t.Helper()
+	body, err := json.Marshal(CreateWebhookRequest{URL: url, EventTypes: eventTypes, Secret: testWebhookSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := invoke(t, service.CreateWebhookHandler, string(body), nil)
+	expectStatus(t, response, 200)
+	var webhook WebhookResponse
+	decodeBody(t, response, &webhook)
+	return webhook
+}
+
+// invokeWebhook invokes a /webhooks/{subscription_id} handler.
+func invokeWebhook(t *testing.T, handler apiHandler, subscriptionID string, query map[string]string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"subscription_id": subscriptionID},
+		QueryStringParameters: query,
+	})
+	if err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return response
+}
+
+// deliverWebhooks runs WebhookHandler once.
+func deliverWebhooks(t *testing.T, service *Service) WebhookResult {
+	t.Helper()
+	result, err := service.WebhookHandler(t.Context())
+	if err != nil {
+		t.Fatalf("WebhookHandler failed: %v", err)
+	}
+	return *result
+}
+
+// receivedEvents returns the event types of the deliveries.
+func receivedEvents(deliveries []receivedWebhook) []string {
+	var eventTypes []string
+	for _, delivery := range deliveries {
+		eventTypes = append(eventTypes, delivery.Type)
+	}
+	return eventTypes
+}
+
+func TestWebhookCRUD(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	response := invoke(t, service.CreateWebhookHandler,
+		`{"url":"https://example.com/hooks","event_types":["message.sent","message.failed","message.sent"],"secret":"`+testWebhookSecret+`","description":"analytics"}`, nil)
+	expectStatus(t, response, 200)
+	if strings.Contains(response.Body, testWebhookSecret) {
+		t.Fatalf("secret returned: %s", response.Body)
+	}
+	var created WebhookResponse
+	decodeBody(t, response, &created)
+	if !strings.HasPrefix(created.SubscriptionID, "wh-") || created.URL != "https://example.com/hooks" ||
+		fmt.Sprint(created.EventTypes) != "[message.sent message.failed]" || created.Description != "analytics" {
+		t.Fatalf("unexpected webhook: %+v", created)
+	}
+
+	response = invokeWebhook(t, service.GetWebhookHandler, created.SubscriptionID, nil)
+	expectStatus(t, response, 200)
+	var webhook WebhookResponse
+	decodeBody(t, response, &webhook)
+	if webhook.SubscriptionID != created.SubscriptionID || !webhook.CreatedAt.Equal(created.CreatedAt) {
+		t.Fatalf("unexpected webhook: %+v", webhook)
+	}
+
+	response = invoke(t, service.ListWebhooksHandler, "", nil)
+	expectStatus(t, response, 200)
+	var list ListWebhooksResponse
+	decodeBody(t, response, &list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].SubscriptionID != created.SubscriptionID {
+		t.Fatalf("unexpected webhooks: %+v", list)
+	}
+
+	expectStatus(t, invokeWebhook(t, service.DeleteWebhookHandler, created.SubscriptionID, nil), 200)
+	expectStatus(t, invokeWebhook(t, service.DeleteWebhookHandler, created.SubscriptionID, nil), 404)
+	expectStatus(t, invokeWebhook(t, service.GetWebhookHandler, created.SubscriptionID, nil), 404)
+	expectStatus(t, invokeWebhook(t, service.ListWebhookDeadLettersHandler, created.SubscriptionID, nil), 404)
+	expectStatus(t, invokeWebhook(t, service.GetWebhookHandler, "", nil), 400)
+}
+
+func TestCreateWebhookRejectsInvalidWebhooks(t *testing.T) {
+	service, _ := newFakeService(t)
+
+	for name, body := range map[string]string{
+		"invalid JSON":       `not json`,
+		"missing url":        `{"event_types":["message.sent"],"secret":"` + testWebhookSecret + `"}`,
+		"relative url":       `{"url":"/hooks","event_types":["message.sent"],"secret":"` + testWebhookSecret + `"}`,
+		"other scheme":       `{"url":"ftp://example.com/hooks","event_types":["message.sent"],"secret":"` + testWebhookSecret + `"}`,
+		"plain http":         `{"url":"http://example.com/hooks","event_types":["message.sent"],"secret":"` + testWebhookSecret + `"}`,
+		"missing secret":     `{"url":"https://example.com/hooks","event_types":["message.sent"]}`,
+		"short secret":       `{"url":"https://example.com/hooks","event_types":["message.sent"],"secret":"short"}`,
+		"missing event type": `{"url":"https://example.com/hooks","secret":"` + testWebhookSecret + `"}`,
+		"unknown event type": `{"url":"https://example.com/hooks","event_types":["message.opened"],"secret":"` + testWebhookSecret + `"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectStatus(t, invoke(t, service.CreateWebhookHandler, body, nil), 400)
+		})
+	}
+}
+
+func TestWebhookDeliversSignedEvents(t *testing.T) {
+	service, fakes := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookDeviceRegistered, webhookMessageSent, webhookTestRunAcked)
+	// Only subscribed event types are delivered
+	other := newWebhookReceiver(t)
+	createWebhook(t, service, other.URL(), webhookMessageFailed)
+
+	registerFakeDevices(t, service)
+	expectStatus(t, invoke(t, service.SendMessageHandler,
+		`{"user_id":"user-1","category":"system","title":"E2E","body":"Test","data":{"type":"e2e_test","nonce":"nonce-1"}}`, nil), 200)
+	fakes.clock.Advance(2 * time.Second)
+	expectStatus(t, invoke(t, service.TestAckHandler, ackBody(t, service, TestAckRequest{Nonce: "nonce-1", DeviceId: "device-2"}), nil), 200)
+
+	result := deliverWebhooks(t, service)
+	if result != (WebhookResult{Delivered: 5}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	received := receiver.Received()
+	if got := fmt.Sprint(receivedEvents(received)); got != "[device.registered device.registered message.sent message.sent test_run.acked]" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+	if other.Attempts() != 0 {
+		t.Fatalf("unsubscribed receiver got %d deliveries", other.Attempts())
+	}
+
+	seen := make(map[string]bool)
+	for _, delivery := range received {
+		if delivery.HeaderID != delivery.ID || delivery.HeaderEvent != delivery.Type || seen[delivery.ID] {
+			t.Fatalf("headers do not match the event: %+v", delivery)
+		}
+		seen[delivery.ID] = true
+	}
+
+	var sent MessageEventData
+	if err := json.Unmarshal(received[2].Data, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sent.MessageID, "msg-") || sent.UserID != "user-1" || sent.DeviceID != "device-1" || sent.Nonce != "nonce-1" {
+		t.Fatalf("unexpected message.sent data: %+v", sent)
+	}
+	var acked TestRunAckedEventData
+	if err := json.Unmarshal(received[4].Data, &acked); err != nil {
+		t.Fatal(err)
+	}
+	if acked.Nonce != "nonce-1" || acked.UserID != "user-1" || acked.DeviceID != "device-2" || acked.Platform != "ios" ||
+		acked.SendToAckMs == nil || *acked.SendToAckMs != 2000 {
+		t.Fatalf("unexpected test_run.acked data: %+v", acked)
+	}
+
+	// Delivered deliveries are gone
+	if result := deliverWebhooks(t, service); result != (WebhookResult{}) {
+		t.Fatalf("expected nothing to deliver, got %+v", result)
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	service, fakes := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookDeviceRegistered)
+	receiver.SetStatus(http.StatusServiceUnavailable)
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	if result := deliverWebhooks(t, service); result != (WebhookResult{Retried: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// Not attempted again before the backoff has passed
+	fakes.clock.Advance(webhookInitialBackoff - time.Second)
+	if result := deliverWebhooks(t, service); result != (WebhookResult{}) {
+		t.Fatalf("retried before the backoff: %+v", result)
+	}
+	fakes.clock.Advance(time.Second)
+	if result := deliverWebhooks(t, service); result != (WebhookResult{Retried: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// The next attempt succeeds, with the same event ID
+	receiver.SetStatus(http.StatusNoContent)
+	fakes.clock.Advance(webhookBackoff(2))
+	if result := deliverWebhooks(t, service); result != (WebhookResult{Delivered: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if received := receiver.Received(); len(received) != 1 || receiver.Attempts() != 3 || received[0].Type != webhookDeviceRegistered {
+		t.Fatalf("unexpected deliveries: %+v after %d attempts", received, receiver.Attempts())
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	service, fakes := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	webhook := createWebhook(t, service, receiver.URL(), webhookDeviceRegistered)
+	receiver.SetStatus(http.StatusInternalServerError)
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	for attempt := 1; attempt < webhookMaxAttempts; attempt++ {
+		if result := deliverWebhooks(t, service); result != (WebhookResult{Retried: 1}) {
+			t.Fatalf("attempt %d: unexpected result: %+v", attempt, result)
+		}
+		fakes.clock.Advance(webhookBackoff(attempt))
+	}
+	if result := deliverWebhooks(t, service); result != (WebhookResult{DeadLettered: 1}) {
+		t.Fatalf("unexpected result of the last attempt: %+v", result)
+	}
+	if receiver.Attempts() != webhookMaxAttempts {
+		t.Fatalf("expected %d attempts, got %d", webhookMaxAttempts, receiver.Attempts())
+	}
+
+	// Dead letters are not retried
+	fakes.clock.Advance(webhookMaxBackoff)
+	if result := deliverWebhooks(t, service); result != (WebhookResult{}) {
+		t.Fatalf("dead letter retried: %+v", result)
+	}
+
+	response := invokeWebhook(t, service.ListWebhookDeadLettersHandler, webhook.SubscriptionID, nil)
+	expectStatus(t, response, 200)
+	var list ListWebhookDeadLettersResponse
+	decodeBody(t, response, &list)
+	if len(list.DeadLetters) != 1 {
+		t.Fatalf("expected one dead letter, got %+v", list)
+	}
+	deadLetter := list.DeadLetters[0]
+	var event WebhookEvent
+	if err := json.Unmarshal(deadLetter.Payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetter.Attempts != webhookMaxAttempts || deadLetter.EventType != webhookDeviceRegistered || event.ID != deadLetter.EventID ||
+		!strings.Contains(deadLetter.LastError, "status 500") {
+		t.Fatalf("unexpected dead letter: %+v", deadLetter)
+	}
+
+	expectStatus(t, invokeWebhook(t, service.ListWebhookDeadLettersHandler, webhook.SubscriptionID, map[string]string{"limit": "0"}), 400)
+}
+
+func TestWebhookUnreachableEndpoint(t *testing.T) {
+	service, _ := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookDeviceRegistered)
+	receiver.server.Close()
+
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+	if result := deliverWebhooks(t, service); result != (WebhookResult{Retried: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestSendMessageInvalidatesUnregisteredToken(t *testing.T) {
+	service, fakes := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookMessageFailed, webhookDeviceTokenInvalidated)
+	registerFakeDevices(t, service)
+	fakes.sender.FailToken("token-1", fmt.Errorf("%w: status=404", errPushTokenUnregistered))
+
+	expectStatus(t, invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil), 200)
+
+	device, err := fakes.querier.GetDeviceByDeviceID(t.Context(), "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.IsActive {
+		t.Fatal("device with unregistered token still active")
+	}
+
+	deliverWebhooks(t, service)
+	received := receiver.Received()
+	if got := fmt.Sprint(receivedEvents(received)); got != "[device.token_invalidated message.failed]" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+	var failed MessageEventData
+	if err := json.Unmarshal(received[1].Data, &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed.DeviceID != "device-1" || !strings.Contains(failed.FailureReason, "unregistered") {
+		t.Fatalf("unexpected message.failed data: %+v", failed)
+	}
+
+	// Other failures leave the device active
+	fakes.sender.FailToken("token-2", fmt.Errorf("FCM unavailable"))
+	expectStatus(t, invoke(t, service.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil), 200)
+	if device, err := fakes.querier.GetDeviceByDeviceID(t.Context(), "device-2"); err != nil || !device.IsActive {
+		t.Fatalf("device deactivated after a transient failure: %+v, %v", device, err)
+	}
+}
+
+func TestCreateWebhookRejectsPrivateAddresses(t *testing.T) {
+	service, _ := newFakeService(t)
+	service.WebhookAllowPrivate = false
+
+	for _, url := range []string{
+		"https://127.0.0.1/hooks",
+		"https://localhost:8443/hooks",
+		"https://169.254.169.254/latest/meta-data",
+		"https://10.0.12.7/hooks",
+		"https://192.168.1.20/hooks",
+		"https://[::1]/hooks",
+		"https://[::ffff:172.16.0.1]/hooks",
+		"https://[fe80::1]/hooks",
+		"https://0.0.0.0/hooks",
+	} {
+		t.Run(url, func(t *testing.T) {
+			body := `{"url":"` + url + `","event_types":["message.sent"],"secret":"` + testWebhookSecret + `"}`
+			expectStatus(t, invoke(t, service.CreateWebhookHandler, body, nil), 400)
+		})
+	}
+
+	// Public addresses are fine
+	expectStatus(t, invoke(t, service.CreateWebhookHandler,
+		`{"url":"https://203.0.113.10/hooks","event_types":["message.sent"],"secret":"`+testWebhookSecret+`"}`, nil), 200)
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	service, _ := newFakeService(t)
+	receiver := newWebhookReceiver(t)
+	createWebhook(t, service, receiver.URL(), webhookDeviceRegistered)
+	expectStatus(t, invoke(t, service.RegisterDeviceHandler,
+		`{"user_id":"user-1","device_id":"device-1","fcm_token":"token-1","platform":"android"}`, nil), 200)
+
+	// The host resolves to a loopback address by the time the webhook is posted
+	service.WebhookAllowPrivate = false
+	service.WebhookClient = testWebhookClient(false)
+	if result := deliverWebhooks(t, service); result != (WebhookResult{Retried: 1}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if attempts := receiver.Attempts(); attempts != 0 {
+		t.Fatalf("expected no request to reach the receiver, got %d", attempts)
+	}
+	err := service.postWebhook(t.Context(), sqlc.ClaimWebhookDeliveriesRow{Url: receiver.URL(), Payload: []byte(`{}`)})
+	if !errors.Is(err, errWebhookAddressNotAllowed) {
+		t.Fatalf("expected errWebhookAddressNotAllowed, got %v", err)
+	}
+}
+
+func TestWebhookClientRefusesInsecureRedirects(t *testing.T) {
+	service, _ := newFakeService(t)
+	var insecureAttempts atomic.Int32
+	insecure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { insecureAttempts.Add(1) }))
+	t.Cleanup(insecure.Close)
+	receiver := newWebhookReceiver(t)
+	redirect := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := receiver.URL()
+		if r.URL.Path == "/insecure" {
+			target = insecure.URL + "/hooks"
+		}
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	}))
+	t.Cleanup(redirect.Close)
+	service.WebhookClient = testWebhookClient(true)
+
+	err := service.postWebhook(t.Context(), sqlc.ClaimWebhookDeliveriesRow{Url: redirect.URL + "/insecure", Payload: []byte(`{}`)})
+	if !errors.Is(err, errWebhookRedirectNotAllowed) {
+		t.Fatalf("expected errWebhookRedirectNotAllowed, got %v", err)
+	}
+	if attempts := insecureAttempts.Load(); attempts != 0 {
+		t.Fatalf("expected no request to reach the http receiver, got %d", attempts)
+	}
+
+	// Redirects to https URLs are followed
+	if err := service.postWebhook(t.Context(), sqlc.ClaimWebhookDeliveriesRow{Url: redirect.URL + "/secure", Secret: testWebhookSecret, Payload: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts := receiver.Attempts(); attempts != 1 {
+		t.Fatalf("expected the https receiver to get the webhook, got %d requests", attempts)
+	}
+}
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	for address, want := range map[string]bool{
+		"203.0.113.10":       true,
+		"2001:db8::1":        true,
+		"127.0.0.1":          false,
+		"169.254.169.254":    false,
+		"10.1.2.3":           false,
+		"172.31.255.1":       false,
+		"192.168.0.1":        false,
+		"0.0.0.0":            false,
+		"224.0.0.1":          false,
+		"::1":                false,
+		"fe80::1":            false,
+		"fd00::1":            false,
+		"::ffff:127.0.0.1":   false,
+		"::ffff:203.0.113.1": true,
+		"100.64.0.1":         false,
+		"100.127.255.254":    false,
+		"100.128.0.1":        true,
+		"64:ff9b::a00:1":     false,
+		"64:ff9b::a9fe:a9fe": false,
+		"64:ff9b::cb00:710a": true,
+	} {
+		if got := webhookAddressAllowed(netip.MustParseAddr(address)); got != want {
+			t.Errorf("webhookAddressAllowed(%s) = %t, want %t", address, got, want)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		8:  time.Hour,
+		20: time.Hour,
+	} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookHandlers(t *testing.T) {
+	requireDB(t)
+	receiver := newWebhookReceiver(t)
+	webhook := createWebhook(t, testService, receiver.URL(), webhookDeviceRegistered, webhookMessageSent)
+
+	registerDevice(t, "user-1", "device-1", "token-1", "android")
+	expectStatus(t, invoke(t, testService.SendMessageHandler, `{"user_id":"user-1","category":"system","title":"Hello","body":"World"}`, nil), 200)
+
+	if result := deliverWebhooks(t, testService); result != (WebhookResult{Delivered: 2}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if got := fmt.Sprint(receivedEvents(receiver.Received())); got != "[device.registered message.sent]" {
+		t.Fatalf("unexpected events: %s", got)
+	}
+
+	expectStatus(t, invokeWebhook(t, testService.ListWebhookDeadLettersHandler, webhook.SubscriptionID, nil), 200)
+	expectStatus(t, invokeWebhook(t, testService.DeleteWebhookHandler, webhook.SubscriptionID, nil), 200)
+	expectStatus(t, invokeWebhook(t, testService.GetWebhookHandler, webhook.SubscriptionID, nil), 404)
+}
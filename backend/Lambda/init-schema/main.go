@@ -6,9 +6,7 @@ import (
 	"os"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
-	dbgen "github.com/fcm-tutorial/lambda/init-schema/sqlc"
+	"github.com/fcm-tutorial/credentials"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -17,104 +15,101 @@ func main() {
 	lambda.Start(handler)
 }
 
-// getSecret retrieves a secret value from AWS Secrets Manager
-func getSecret(ctx context.Context, secretARN string) (string, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to load AWS config: %w", err)
-	}
-
-	client := secretsmanager.NewFromConfig(cfg)
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId: &secretARN,
-	}
-
-	result, err := client.GetSecretValue(ctx, input)
-	if err != nil {
-		return "", fmt.Errorf("failed to get secret value: %w", err)
-	}
-
-	if result.SecretString == nil {
-		return "", fmt.Errorf("secret value is nil")
-	}
-
-	return *result.SecretString, nil
-}
-
-func handler(ctx context.Context) error {
+// handler runs a migration command chosen by the event payload, e.g. {"command": "status"}.
+// An empty payload applies all pending migrations.
+func handler(ctx context.Context, event MigrationEvent) (*MigrationResult, error) {
 	// Get RDS connection info from environment variables
 	rdsHost := os.Getenv("RDS_HOST")
 	rdsPort := os.Getenv("RDS_PORT")
 	rdsDBName := os.Getenv("RDS_DB_NAME")
 	rdsUsername := os.Getenv("RDS_USERNAME")
-	rdsPasswordSecretARN := os.Getenv("RDS_PASSWORD_SECRET_ARN")
 
-	if rdsHost == "" || rdsPort == "" || rdsDBName == "" || rdsUsername == "" || rdsPasswordSecretARN == "" {
-		return fmt.Errorf("missing required RDS environment variables: RDS_HOST, RDS_PORT, RDS_DB_NAME, RDS_USERNAME, RDS_PASSWORD_SECRET_ARN")
+	if rdsHost == "" || rdsPort == "" || rdsDBName == "" || rdsUsername == "" {
+		return nil, fmt.Errorf("missing required RDS environment variables: RDS_HOST, RDS_PORT, RDS_DB_NAME, RDS_USERNAME")
 	}
 
-	// Get RDS password from Secrets Manager
-	rdsPassword, err := getSecret(ctx, rdsPasswordSecretARN)
+	authMode, err := credentials.RDSAuthMode()
 	if err != nil {
-		return fmt.Errorf("failed to retrieve RDS password from Secrets Manager: %w", err)
+		return nil, err
 	}
 
-	// Build connection string
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
-		rdsHost, rdsPort, rdsUsername, rdsPassword, rdsDBName)
+	// Build connection string (password is set below depending on RDS_AUTH_MODE)
+	connStr := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=require",
+		rdsHost, rdsPort, rdsUsername, rdsDBName)
 
-	// Connect to database using pgx/v5
-	pool, err := pgxpool.New(ctx, connStr)
+	poolConfig, err := pgxpool.ParseConfig(connStr)
 	if err != nil {
-		return fmt.Errorf("failed to connect to database: %w", err)
+		return nil, fmt.Errorf("failed to parse connection string: %w", err)
 	}
-	defer pool.Close()
 
-	// Test connection
-	if err := pool.Ping(ctx); err != nil {
-		return fmt.Errorf("failed to ping database: %w", err)
+	if authMode == credentials.RDSAuthModeIAM {
+		// Authenticate every new connection with a short-lived IAM auth token
+		tokenSource, err := credentials.NewRDSIAMTokenSource(ctx, rdsHost, rdsPort, rdsUsername)
+		if err != nil {
+			return nil, err
+		}
+		poolConfig.BeforeConnect = tokenSource.BeforeConnect
+	} else {
+		rdsPasswordSecretARN := os.Getenv("RDS_PASSWORD_SECRET_ARN")
+		if rdsPasswordSecretARN == "" {
+			return nil, fmt.Errorf("missing required RDS environment variable: RDS_PASSWORD_SECRET_ARN")
+		}
+
+		// Get RDS password from the secret backend (Secrets Manager by default)
+		secrets, err := credentials.DefaultSecretProvider(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create secret provider: %w", err)
+		}
+		rdsPassword, err := secrets.GetSecret(ctx, rdsPasswordSecretARN)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve RDS password: %w", err)
+		}
+		poolConfig.ConnConfig.Password = rdsPassword
 	}
 
-	// Read and execute SQL schema from file
-	// Try multiple possible paths (Lambda container paths)
-	sqlScriptPaths := []string{
-		"/var/task/Schema/init.sql",
-		"/var/runtime/Schema/init.sql",
-		"./Schema/init.sql",
-		"../../Schema/init.sql",
+	// Connect to database using pgx/v5
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
+	defer pool.Close()
 
-	var sqlScript string
-	var sqlScriptPath string
-	for _, path := range sqlScriptPaths {
-		if data, err := os.ReadFile(path); err == nil {
-			sqlScript = string(data)
-			sqlScriptPath = path
-			break
+	// Test connection
+	if err := pool.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	// Run the requested migration command (up, down, status, verify)
+	result, err := runMigrationCommand(ctx, pool, event)
+	if result != nil {
+		for _, status := range result.Migrations {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			if status.Problem != "" {
+				state += " (" + status.Problem + ")"
+			}
+			fmt.Printf("%s: %s\n", migrationLabel(status.Version, status.Name), state)
 		}
 	}
-
-	if sqlScript == "" {
-		return fmt.Errorf("failed to find init.sql in any of the expected paths: %v", sqlScriptPaths)
+	if err != nil {
+		return result, err
 	}
 
-	// Execute SQL script to create tables
-	// pgx can handle multiple statements
-	if _, err := pool.Exec(ctx, sqlScript); err != nil {
-		return fmt.Errorf("failed to execute SQL script from %s: %w", sqlScriptPath, err)
+	if result.Command != commandUp {
+		return result, nil
 	}
 
-	// Verify tables exist using sqlc
-	queries := dbgen.New(pool)
-	tableCount, err := queries.CountTables(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to verify tables: %w", err)
+	if err := printDevices(ctx, pool); err != nil {
+		return result, err
 	}
 
-	if tableCount != 2 {
-		return fmt.Errorf("expected 2 tables in public schema, but found %d", tableCount)
-	}
+	return result, nil
+}
 
+// printDevices prints the devices table to the logs after migrating.
+func printDevices(ctx context.Context, pool *pgxpool.Pool) error {
 	// Query and print devices table
 	fmt.Println("==========================================")
 	fmt.Println("Querying devices table...")
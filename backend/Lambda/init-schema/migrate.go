@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"sort"
+	"time"
+
+	dbgen "github.com/fcm-tutorial/lambda/init-schema/sqlc"
+	"github.com/fcm-tutorial/schema"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// schemaMigrationsTableSQL creates the bookkeeping table for applied migrations.
+// The same file is part of the sqlc schema.
+//
+//go:embed schema_migrations.sql
+var schemaMigrationsTableSQL string
+
+// migrationLockKey identifies the Postgres advisory lock held while a command runs.
+// Concurrent invocations wait for the lock instead of applying migrations twice.
+const migrationLockKey int64 = 7_461_726_001
+
+// Supported migration commands (MigrationEvent.Command).
+const (
+	commandUp     = "up"     // Apply all pending migrations (default)
+	commandDown   = "down"   // Roll back the last N applied migrations
+	commandStatus = "status" // Report applied and pending migrations
+	commandVerify = "verify" // Fail unless all migrations are applied and unchanged
+)
+
+// MigrationEvent is the Lambda event payload, e.g. {"command": "down", "steps": 1}.
+// An empty payload runs "up".
+type MigrationEvent struct {
+	Command string `json:"command"`
+	Steps   int    `json:"steps"` // Number of migrations to roll back for "down" (default: 1)
+}
+
+// MigrationStatus describes one migration, as embedded in this build and as recorded in the database.
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	Problem   string     `json:"problem,omitempty"` // e.g. checksum mismatch, unknown to this build
+}
+
+// MigrationResult is returned by the Lambda handler.
+type MigrationResult struct {
+	Command    string            `json:"command"`
+	Applied    []string          `json:"applied,omitempty"`
+	RolledBack []string          `json:"rolled_back,omitempty"`
+	Migrations []MigrationStatus `json:"migrations"` // State after the command
+}
+
+// runMigrationCommand runs a migration command while holding the migration advisory lock.
+func runMigrationCommand(ctx context.Context, pool *pgxpool.Pool, event MigrationEvent) (*MigrationResult, error) {
+	command := event.Command
+	if command == "" {
+		command = commandUp
+	}
+
+	migrations, err := schema.Migrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	// Advisory locks belong to a session, so keep one connection for the whole command
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		// Use a fresh context: the invocation context may already be cancelled
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			fmt.Printf("WARNING: failed to release migration lock: %v\n", err)
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, schemaMigrationsTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	result := &MigrationResult{Command: command}
+	queries := dbgen.New(conn)
+
+	switch command {
+	case commandUp:
+		if err := checkAppliedMigrations(ctx, queries, migrations); err != nil {
+			return nil, err
+		}
+		result.Applied, err = migrateUp(ctx, conn, queries, migrations)
+	case commandDown:
+		steps := event.Steps
+		if steps == 0 {
+			steps = 1
+		}
+		if steps < 0 {
+			return nil, fmt.Errorf("invalid steps: %d", steps)
+		}
+		result.RolledBack, err = migrateDown(ctx, conn, queries, migrations, steps)
+	case commandStatus, commandVerify:
+		// Status is collected below for every command
+	default:
+		return nil, fmt.Errorf("unknown command: %s (must be '%s', '%s', '%s' or '%s')",
+			command, commandUp, commandDown, commandStatus, commandVerify)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Migrations, err = migrationStatus(ctx, queries, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	if command == commandVerify {
+		for _, status := range result.Migrations {
+			if !status.Applied {
+				return result, fmt.Errorf("migration %s is not applied", migrationLabel(status.Version, status.Name))
+			}
+			if status.Problem != "" {
+				return result, fmt.Errorf("migration %s: %s", migrationLabel(status.Version, status.Name), status.Problem)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// migrateUp applies all pending migrations in version order, each in its own transaction.
+func migrateUp(ctx context.Context, conn *pgxpool.Conn, queries *dbgen.Queries, migrations []schema.Migration) ([]string, error) {
+	appliedRows, err := queries.ListAppliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	applied := make(map[int64]bool, len(appliedRows))
+	for _, row := range appliedRows {
+		applied[row.Version] = true
+	}
+
+	var appliedNow []string
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+
+		label := migrationLabel(migration.Version, migration.Name)
+		fmt.Printf("Applying migration %s...\n", label)
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return appliedNow, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+
+		// pgx runs multi-statement SQL without arguments through the simple protocol
+		if _, err := tx.Exec(ctx, migration.Up); err != nil {
+			tx.Rollback(ctx)
+			return appliedNow, fmt.Errorf("failed to apply migration %s: %w", label, err)
+		}
+
+		err = queries.WithTx(tx).InsertAppliedMigration(ctx, dbgen.InsertAppliedMigrationParams{
+			Version:  migration.Version,
+			Name:     migration.Name,
+			Checksum: migration.Checksum(),
+		})
+		if err != nil {
+			tx.Rollback(ctx)
+			return appliedNow, fmt.Errorf("failed to record migration %s: %w", label, err)
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return appliedNow, fmt.Errorf("failed to commit migration %s: %w", label, err)
+		}
+
+		appliedNow = append(appliedNow, label)
+	}
+
+	return appliedNow, nil
+}
+
+// migrateDown rolls back the last steps applied migrations, newest first.
+func migrateDown(ctx context.Context, conn *pgxpool.Conn, queries *dbgen.Queries, migrations []schema.Migration, steps int) ([]string, error) {
+	appliedRows, err := queries.ListAppliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	if steps > len(appliedRows) {
+		return nil, fmt.Errorf("cannot roll back %d migrations: only %d applied", steps, len(appliedRows))
+	}
+
+	byVersion := make(map[int64]schema.Migration, len(migrations))
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+
+	var rolledBack []string
+	for i := len(appliedRows) - 1; i >= len(appliedRows)-steps; i-- {
+		row := appliedRows[i]
+		label := migrationLabel(row.Version, row.Name)
+
+		migration, ok := byVersion[row.Version]
+		if !ok {
+			return rolledBack, fmt.Errorf("cannot roll back migration %s: not included in this build", label)
+		}
+
+		fmt.Printf("Rolling back migration %s...\n", label)
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return rolledBack, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, migration.Down); err != nil {
+			tx.Rollback(ctx)
+			return rolledBack, fmt.Errorf("failed to roll back migration %s: %w", label, err)
+		}
+
+		if err := queries.WithTx(tx).DeleteAppliedMigration(ctx, row.Version); err != nil {
+			tx.Rollback(ctx)
+			return rolledBack, fmt.Errorf("failed to unrecord migration %s: %w", label, err)
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return rolledBack, fmt.Errorf("failed to commit rollback of %s: %w", label, err)
+		}
+
+		rolledBack = append(rolledBack, label)
+	}
+
+	return rolledBack, nil
+}
+
+// checkAppliedMigrations refuses to migrate a database whose applied migrations
+// were edited after being applied or are unknown to this build.
+func checkAppliedMigrations(ctx context.Context, queries *dbgen.Queries, migrations []schema.Migration) error {
+	statuses, err := migrationStatus(ctx, queries, migrations)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if status.Problem != "" {
+			return fmt.Errorf("migration %s: %s", migrationLabel(status.Version, status.Name), status.Problem)
+		}
+	}
+	return nil
+}
+
+// migrationStatus merges embedded migrations with the rows in schema_migrations.
+func migrationStatus(ctx context.Context, queries *dbgen.Queries, migrations []schema.Migration) ([]MigrationStatus, error) {
+	appliedRows, err := queries.ListAppliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	applied := make(map[int64]dbgen.SchemaMigration, len(appliedRows))
+	for _, row := range appliedRows {
+		applied[row.Version] = row
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	known := make(map[int64]bool, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = true
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+
+		if row, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			if row.AppliedAt.Valid {
+				appliedAt := row.AppliedAt.Time
+				status.AppliedAt = &appliedAt
+			}
+			if row.Checksum != migration.Checksum() {
+				status.Problem = "checksum mismatch: migration was modified after it was applied"
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	// Migrations recorded in the database but missing from this build (e.g. an older image)
+	for _, row := range appliedRows {
+		if known[row.Version] {
+			continue
+		}
+		status := MigrationStatus{
+			Version: row.Version,
+			Name:    row.Name,
+			Applied: true,
+			Problem: "applied but not included in this build",
+		}
+		if row.AppliedAt.Valid {
+			appliedAt := row.AppliedAt.Time
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+// migrationLabel formats a migration as it appears in file names, e.g. "0002_devices_app_id".
+func migrationLabel(version int64, name string) string {
+	return fmt.Sprintf("%04d_%s", version, name)
+}
@@ -1,6 +1,12 @@
--- name: CountTables :one
-SELECT COUNT(*) 
-FROM information_schema.tables 
-WHERE table_schema = 'public' 
-AND table_name IN ('devices', 'test_runs');
+-- name: ListAppliedMigrations :many
+SELECT version, name, checksum, applied_at
+FROM schema_migrations
+ORDER BY version;
 
+-- name: InsertAppliedMigration :exec
+INSERT INTO schema_migrations (version, name, checksum, applied_at)
+VALUES ($1, $2, $3, NOW());
+
+-- name: DeleteAppliedMigration :exec
+DELETE FROM schema_migrations
+WHERE version = $1;
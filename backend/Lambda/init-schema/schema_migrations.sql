@@ -0,0 +1,7 @@
+-- Bookkeeping table for applied migrations (created by the migrator before running migrations)
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version     BIGINT PRIMARY KEY,
+  name        TEXT NOT NULL,
+  checksum    TEXT NOT NULL, -- SHA-256 of the up SQL
+  applied_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -16,12 +16,42 @@ type Device struct {
 	FcmToken  string             `json:"fcm_token"`
 	IsActive  bool               `json:"is_active"`
 	UpdatedAt pgtype.Timestamptz `json:"updated_at"`
+	AppID     string             `json:"app_id"`
+}
+
+type SchemaMigration struct {
+	Version   int64              `json:"version"`
+	Name      string             `json:"name"`
+	Checksum  string             `json:"checksum"`
+	AppliedAt pgtype.Timestamptz `json:"applied_at"`
 }
 
 type TestRun struct {
-	Nonce     string             `json:"nonce"`
-	UserID    string             `json:"user_id"`
-	Status    string             `json:"status"`
-	CreatedAt pgtype.Timestamptz `json:"created_at"`
-	AckedAt   pgtype.Timestamptz `json:"acked_at"`
+	Nonce         string             `json:"nonce"`
+	UserID        string             `json:"user_id"`
+	Status        string             `json:"status"`
+	CreatedAt     pgtype.Timestamptz `json:"created_at"`
+	AckedAt       pgtype.Timestamptz `json:"acked_at"`
+	ExpiresAt     pgtype.Timestamptz `json:"expires_at"`
+	FailureReason pgtype.Text        `json:"failure_reason"`
+	AckDeviceID   pgtype.Text        `json:"ack_device_id"`
+	AckPlatform   pgtype.Text        `json:"ack_platform"`
+	AckAppVersion pgtype.Text        `json:"ack_app_version"`
+	AckOsVersion  pgtype.Text        `json:"ack_os_version"`
+	SentAt        pgtype.Timestamptz `json:"sent_at"`
+	ReceivedAt    pgtype.Timestamptz `json:"received_at"`
+}
+
+type TestRunDelivery struct {
+	Nonce         string             `json:"nonce"`
+	DeviceID      string             `json:"device_id"`
+	Platform      string             `json:"platform"`
+	AppID         string             `json:"app_id"`
+	Status        string             `json:"status"`
+	FailureReason pgtype.Text        `json:"failure_reason"`
+	SentAt        pgtype.Timestamptz `json:"sent_at"`
+	AckedAt       pgtype.Timestamptz `json:"acked_at"`
+	AppVersion    pgtype.Text        `json:"app_version"`
+	OsVersion     pgtype.Text        `json:"os_version"`
+	ReceivedAt    pgtype.Timestamptz `json:"received_at"`
 }
@@ -9,7 +9,9 @@ import (
 )
 
 type Querier interface {
-	CountTables(ctx context.Context) (int64, error)
+	DeleteAppliedMigration(ctx context.Context, version int64) error
+	InsertAppliedMigration(ctx context.Context, arg InsertAppliedMigrationParams) error
+	ListAppliedMigrations(ctx context.Context) ([]SchemaMigration, error)
 }
 
 var _ Querier = (*Queries)(nil)
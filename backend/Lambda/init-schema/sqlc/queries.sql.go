@@ -9,16 +9,59 @@ import (
 	"context"
 )
 
-const countTables = `-- name: CountTables :one
-SELECT COUNT(*) 
-FROM information_schema.tables 
-WHERE table_schema = 'public' 
-AND table_name IN ('devices', 'test_runs')
+const deleteAppliedMigration = `-- name: DeleteAppliedMigration :exec
+DELETE FROM schema_migrations
+WHERE version = $1
 `
 
-func (q *Queries) CountTables(ctx context.Context) (int64, error) {
-	row := q.db.QueryRow(ctx, countTables)
-	var count int64
-	err := row.Scan(&count)
-	return count, err
+func (q *Queries) DeleteAppliedMigration(ctx context.Context, version int64) error {
+	_, err := q.db.Exec(ctx, deleteAppliedMigration, version)
+	return err
+}
+
+const insertAppliedMigration = `-- name: InsertAppliedMigration :exec
+INSERT INTO schema_migrations (version, name, checksum, applied_at)
+VALUES ($1, $2, $3, NOW())
+`
+
+type InsertAppliedMigrationParams struct {
+	Version  int64  `json:"version"`
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+}
+
+func (q *Queries) InsertAppliedMigration(ctx context.Context, arg InsertAppliedMigrationParams) error {
+	_, err := q.db.Exec(ctx, insertAppliedMigration, arg.Version, arg.Name, arg.Checksum)
+	return err
+}
+
+const listAppliedMigrations = `-- name: ListAppliedMigrations :many
+SELECT version, name, checksum, applied_at
+FROM schema_migrations
+ORDER BY version
+`
+
+func (q *Queries) ListAppliedMigrations(ctx context.Context) ([]SchemaMigration, error) {
+	rows, err := q.db.Query(ctx, listAppliedMigrations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SchemaMigration
+	for rows.Next() {
+		var i SchemaMigration
+		if err := rows.Scan(
+			&i.Version,
+			&i.Name,
+			&i.Checksum,
+			&i.AppliedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
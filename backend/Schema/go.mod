@@ -0,0 +1,3 @@
+module github.com/fcm-tutorial/schema
+
+go 1.24.0
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS test_runs;
+DROP TABLE IF EXISTS devices;
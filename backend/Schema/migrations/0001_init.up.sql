@@ -1,3 +1,6 @@
+-- Baseline schema
+-- Uses IF NOT EXISTS so databases created before migrations were introduced can adopt it
+
 -- Devices table: stores FCM device registrations
 CREATE TABLE IF NOT EXISTS devices (
   id          SERIAL PRIMARY KEY,
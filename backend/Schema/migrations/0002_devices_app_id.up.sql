@@ -0,0 +1,3 @@
+-- Firebase app the device belongs to (see FCM_APP_SECRETS)
+-- IF NOT EXISTS: the column may already have been added by the old init.sql
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS app_id TEXT NOT NULL DEFAULT 'default';
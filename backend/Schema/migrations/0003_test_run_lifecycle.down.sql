@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS test_runs_pending_expires_at_idx;
+ALTER TABLE test_runs DROP CONSTRAINT IF EXISTS test_runs_status_check;
+-- Runs in the new states can't be represented by the old schema
+UPDATE test_runs SET status = 'PENDING' WHERE status IN ('EXPIRED', 'SEND_FAILED');
+ALTER TABLE test_runs DROP COLUMN IF EXISTS failure_reason;
+ALTER TABLE test_runs DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,16 @@
+-- Test run lifecycle: runs that are never acknowledged expire, and runs whose
+-- push could not be sent are marked as failed
+
+-- Time after which a PENDING run becomes EXPIRED (set from the send request)
+ALTER TABLE test_runs ADD COLUMN expires_at TIMESTAMPTZ;
+UPDATE test_runs SET expires_at = created_at + INTERVAL '5 minutes';
+ALTER TABLE test_runs ALTER COLUMN expires_at SET NOT NULL;
+
+-- Why the run is EXPIRED or SEND_FAILED
+ALTER TABLE test_runs ADD COLUMN failure_reason TEXT;
+
+ALTER TABLE test_runs ADD CONSTRAINT test_runs_status_check
+  CHECK (status IN ('PENDING', 'ACKED', 'EXPIRED', 'SEND_FAILED'));
+
+-- Used by the sweeper to find PENDING runs past their expiry
+CREATE INDEX test_runs_pending_expires_at_idx ON test_runs (expires_at) WHERE status = 'PENDING';
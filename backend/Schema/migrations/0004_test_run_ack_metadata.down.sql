@@ -0,0 +1,6 @@
+ALTER TABLE test_runs DROP COLUMN IF EXISTS received_at;
+ALTER TABLE test_runs DROP COLUMN IF EXISTS sent_at;
+ALTER TABLE test_runs DROP COLUMN IF EXISTS ack_os_version;
+ALTER TABLE test_runs DROP COLUMN IF EXISTS ack_app_version;
+ALTER TABLE test_runs DROP COLUMN IF EXISTS ack_platform;
+ALTER TABLE test_runs DROP COLUMN IF EXISTS ack_device_id;
@@ -0,0 +1,7 @@
+-- Details reported by the device with its ack, used to measure delivery latency
+ALTER TABLE test_runs ADD COLUMN ack_device_id TEXT;
+ALTER TABLE test_runs ADD COLUMN ack_platform TEXT;    -- From devices, looked up by ack_device_id
+ALTER TABLE test_runs ADD COLUMN ack_app_version TEXT;
+ALTER TABLE test_runs ADD COLUMN ack_os_version TEXT;
+ALTER TABLE test_runs ADD COLUMN sent_at TIMESTAMPTZ;     -- data.sent_time echoed by the device
+ALTER TABLE test_runs ADD COLUMN received_at TIMESTAMPTZ; -- Device clock when the message arrived
@@ -0,0 +1,18 @@
+-- One row per device targeted by an e2e test run. Rows are created together
+-- with the run, before anything is sent, so a fast device can never ack a run
+-- that does not exist yet.
+CREATE TABLE test_run_deliveries (
+  nonce          TEXT NOT NULL REFERENCES test_runs (nonce) ON DELETE CASCADE,
+  device_id      TEXT NOT NULL,
+  platform       TEXT NOT NULL,
+  app_id         TEXT NOT NULL,
+  status         TEXT NOT NULL DEFAULT 'PENDING'
+    CHECK (status IN ('PENDING', 'SENT', 'SEND_FAILED', 'ACKED')),
+  failure_reason TEXT,        -- Set for SEND_FAILED
+  sent_at        TIMESTAMPTZ, -- FCM accepted the message
+  acked_at       TIMESTAMPTZ,
+  app_version    TEXT,        -- Reported by the device with its ack
+  os_version     TEXT,
+  received_at    TIMESTAMPTZ,
+  PRIMARY KEY (nonce, device_id)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS test_runs_created_at_idx;
+DROP INDEX IF EXISTS test_runs_user_id_created_at_idx;
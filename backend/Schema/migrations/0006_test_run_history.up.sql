@@ -0,0 +1,4 @@
+-- Test run history (GET /test/runs, GET /test/runs/stats): runs are listed newest
+-- first with keyset pagination on (created_at, nonce), per user or across all users
+CREATE INDEX test_runs_user_id_created_at_idx ON test_runs (user_id, created_at DESC, nonce DESC);
+CREATE INDEX test_runs_created_at_idx ON test_runs (created_at DESC, nonce DESC);
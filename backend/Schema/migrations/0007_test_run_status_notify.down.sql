@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS test_runs_status_notify ON test_runs;
+DROP FUNCTION IF EXISTS notify_test_run_status();
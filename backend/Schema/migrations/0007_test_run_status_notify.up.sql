@@ -0,0 +1,16 @@
+-- Notify the test_run_status channel with the nonce whenever a test run changes
+-- status (acked by AckTestRun, expired or send failed), so GET /test/status?wait=
+-- requests listening on the channel wake up instead of polling. Notifications
+-- are delivered when the changing transaction commits.
+CREATE FUNCTION notify_test_run_status() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify('test_run_status', NEW.nonce);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER test_runs_status_notify
+  AFTER UPDATE OF status ON test_runs
+  FOR EACH ROW
+  WHEN (OLD.status IS DISTINCT FROM NEW.status)
+  EXECUTE FUNCTION notify_test_run_status();
@@ -0,0 +1,26 @@
+-- Every message sent by POST /messages/send, with one row per targeted device.
+-- Like test run deliveries, rows are created before anything is sent, so a
+-- receipt can never arrive for a message that does not exist yet.
+CREATE TABLE messages (
+  message_id TEXT PRIMARY KEY,
+  user_id    TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE message_deliveries (
+  message_id     TEXT NOT NULL REFERENCES messages (message_id) ON DELETE CASCADE,
+  device_id      TEXT NOT NULL,
+  platform       TEXT NOT NULL,
+  app_id         TEXT NOT NULL,
+  status         TEXT NOT NULL DEFAULT 'PENDING'
+    CHECK (status IN ('PENDING', 'SENT', 'SEND_FAILED')),
+  failure_reason TEXT,        -- Set for SEND_FAILED
+  sent_at        TIMESTAMPTZ, -- FCM accepted the message
+  delivered_at   TIMESTAMPTZ, -- First receipt of each event reported by the device
+  opened_at      TIMESTAMPTZ,
+  dismissed_at   TIMESTAMPTZ,
+  PRIMARY KEY (message_id, device_id)
+);
+
+-- Delivery and open rates over time
+CREATE INDEX messages_created_at_idx ON messages (created_at DESC);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS templates;
+ALTER TABLE devices DROP COLUMN IF EXISTS locale;
@@ -0,0 +1,16 @@
+-- Locale reported by the device (BCP 47, e.g. "pt-BR"), used to pick message templates.
+-- NULL means the default locale.
+ALTER TABLE devices ADD COLUMN locale TEXT;
+
+-- Message templates: title and body are Go text/template sources rendered with the
+-- variables of /messages/send. default_data is merged under the request's data.
+CREATE TABLE templates (
+  template_key TEXT NOT NULL,
+  locale       TEXT NOT NULL,
+  title        TEXT NOT NULL,
+  body         TEXT NOT NULL,
+  default_data JSONB NOT NULL DEFAULT '{}',
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (template_key, locale)
+);
@@ -0,0 +1,25 @@
+-- Categories every message of POST /messages/send belongs to. Users can opt out of a
+-- category unless it is mandatory; default_enabled applies until they set a preference.
+CREATE TABLE notification_categories (
+  category        TEXT PRIMARY KEY,
+  description     TEXT NOT NULL DEFAULT '',
+  mandatory       BOOLEAN NOT NULL DEFAULT FALSE,
+  default_enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+INSERT INTO notification_categories (category, description, mandatory, default_enabled) VALUES
+  ('system',        'E2E tests, delivery probes and other operational messages', TRUE,  TRUE),
+  ('security',      'Security alerts such as new sign-ins',                      TRUE,  TRUE),
+  ('transactional', 'Messages about the user''s own activity',                   FALSE, TRUE),
+  ('marketing',     'Promotions and announcements',                              FALSE, TRUE);
+
+-- Explicit preferences: device_id '' is the user-wide preference of a category, any other
+-- device_id overrides it for that device only
+CREATE TABLE notification_preferences (
+  user_id    TEXT NOT NULL,
+  device_id  TEXT NOT NULL DEFAULT '',
+  category   TEXT NOT NULL REFERENCES notification_categories (category) ON DELETE CASCADE,
+  enabled    BOOLEAN NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, device_id, category)
+);
@@ -0,0 +1,6 @@
+ALTER TABLE devices
+  DROP COLUMN IF EXISTS app_version,
+  DROP COLUMN IF EXISTS os_version,
+  DROP COLUMN IF EXISTS device_model,
+  DROP COLUMN IF EXISTS timezone,
+  DROP COLUMN IF EXISTS sdk_version;
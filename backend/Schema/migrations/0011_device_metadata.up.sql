@@ -0,0 +1,8 @@
+-- Optional metadata reported by the app on registration, for targeting (e.g. by app version),
+-- quiet hours by timezone and diagnosing platform-specific failures
+ALTER TABLE devices
+  ADD COLUMN app_version  TEXT, -- e.g. '1.2.3'
+  ADD COLUMN os_version   TEXT, -- e.g. 'Android 14', 'iOS 18.1'
+  ADD COLUMN device_model TEXT, -- e.g. 'Pixel 8'
+  ADD COLUMN timezone     TEXT, -- IANA name, e.g. 'Europe/Lisbon'
+  ADD COLUMN sdk_version  TEXT; -- Platform SDK level, e.g. Android API level '34'
@@ -0,0 +1,2 @@
+DROP FUNCTION IF EXISTS segment_version_key(TEXT);
+DROP TABLE IF EXISTS segments;
@@ -0,0 +1,19 @@
+-- Saved audience segments: a filter expression over device attributes, e.g.
+-- platform = "android" AND app_version >= "2.3" AND last_seen > now-30d.
+-- The API compiles the expression into a parameterized condition on devices.
+CREATE TABLE segments (
+  segment_id  TEXT PRIMARY KEY,
+  description TEXT NOT NULL DEFAULT '',
+  expression  TEXT NOT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Sort key of dotted versions such as devices.app_version, so that '2.10' > '2.9':
+-- the first four numeric components, padded with zeros ('2.3' -> {2,3,0,0}).
+-- Pre-release and build suffixes are ignored. NULL for values not starting with a number.
+CREATE FUNCTION segment_version_key(version TEXT) RETURNS NUMERIC[] AS $$
+  SELECT CASE WHEN version ~ '^[0-9]' THEN
+    (string_to_array(substring(version FROM '^[0-9]+(?:\.[0-9]+){0,3}'), '.')::NUMERIC[] || ARRAY[0, 0, 0, 0]::NUMERIC[])[1:4]
+  END
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
@@ -0,0 +1,25 @@
+-- Messages to every active device, sent in batches of devices in devices.id order.
+-- last_device_id is the checkpoint: each batch is recorded once it has been sent, so an
+-- invocation that stops (e.g. a Lambda timeout) is resumed after the last recorded batch.
+CREATE TABLE broadcasts (
+  broadcast_id     TEXT PRIMARY KEY,
+  message          JSONB NOT NULL, -- category, title, body, data, template_key and variables
+  batch_size       INTEGER NOT NULL,
+  status           TEXT NOT NULL DEFAULT 'RUNNING'
+    CHECK (status IN ('RUNNING', 'COMPLETED', 'FAILED')),
+  failure_reason   TEXT,            -- Set for FAILED
+  total_devices    INTEGER NOT NULL, -- Active devices when the broadcast was created
+  last_device_id   INTEGER NOT NULL DEFAULT 0,
+  sent_count       INTEGER NOT NULL DEFAULT 0,
+  failed_count     INTEGER NOT NULL DEFAULT 0,
+  suppressed_count INTEGER NOT NULL DEFAULT 0,
+  lease_expires_at TIMESTAMPTZ,     -- Held by the invocation sending batches; NULL when none is
+  created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  completed_at     TIMESTAMPTZ      -- Set for COMPLETED and FAILED
+);
+
+-- Finding broadcasts to resume
+CREATE INDEX broadcasts_running_idx ON broadcasts (created_at) WHERE status = 'RUNNING';
+-- Listing recent broadcasts
+CREATE INDEX broadcasts_created_at_idx ON broadcasts (created_at DESC);
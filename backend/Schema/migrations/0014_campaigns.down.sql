@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS message_deliveries_campaign_idx;
+ALTER TABLE message_deliveries
+  DROP COLUMN IF EXISTS campaign_id,
+  DROP COLUMN IF EXISTS variant;
+DROP TABLE IF EXISTS campaign_assignments;
+DROP TABLE IF EXISTS campaign_variants;
+DROP TABLE IF EXISTS campaigns;
@@ -0,0 +1,40 @@
+-- A/B tests of push copy. Users are assigned to a variant (or the holdout group) by hashing
+-- user_id with the campaign id, so a user stays in the same variant across sends.
+CREATE TABLE campaigns (
+  campaign_id     TEXT PRIMARY KEY,
+  description     TEXT NOT NULL DEFAULT '',
+  category        TEXT NOT NULL REFERENCES notification_categories (category),
+  holdout_percent INTEGER NOT NULL DEFAULT 0
+    CHECK (holdout_percent BETWEEN 0 AND 99), -- Users that get no message, for comparison
+  created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Copies of a campaign; users outside the holdout group are split by weight
+CREATE TABLE campaign_variants (
+  campaign_id TEXT NOT NULL REFERENCES campaigns (campaign_id) ON DELETE CASCADE,
+  variant     TEXT NOT NULL,
+  weight      INTEGER NOT NULL CHECK (weight > 0),
+  title       TEXT NOT NULL,
+  body        TEXT NOT NULL,
+  data        JSONB NOT NULL DEFAULT '{}', -- Merged under the request's data
+  PRIMARY KEY (campaign_id, variant)
+);
+
+-- Every user a campaign was sent to, including the holdout group (variant NULL)
+CREATE TABLE campaign_assignments (
+  campaign_id TEXT NOT NULL REFERENCES campaigns (campaign_id) ON DELETE CASCADE,
+  user_id     TEXT NOT NULL,
+  variant     TEXT, -- NULL for the holdout group
+  assigned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (campaign_id, user_id)
+);
+
+-- The variant each delivery was sent with. Receipts are recorded on the delivery, so they are
+-- attributed to the variant too. Not a foreign key: deliveries outlive deleted campaigns.
+ALTER TABLE message_deliveries
+  ADD COLUMN campaign_id TEXT,
+  ADD COLUMN variant     TEXT;
+
+-- Per-variant stats of a campaign
+CREATE INDEX message_deliveries_campaign_idx ON message_deliveries (campaign_id, variant) WHERE campaign_id IS NOT NULL;
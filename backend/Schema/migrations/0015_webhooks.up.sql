@@ -0,0 +1,44 @@
+-- Subscriptions of other systems to delivery events. Each event is POSTed to the subscription's
+-- URL, signed with HMAC-SHA256 using its secret.
+CREATE TABLE webhook_subscriptions (
+  subscription_id TEXT PRIMARY KEY,
+  url             TEXT NOT NULL,
+  event_types     TEXT[] NOT NULL, -- e.g. {message.sent,message.failed}
+  secret          TEXT NOT NULL,   -- HMAC key; never returned by the API
+  description     TEXT NOT NULL DEFAULT '',
+  created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Events waiting to be delivered to a subscription, one row per event and subscription.
+-- A row is deleted once delivered; failed attempts are retried with backoff at next_attempt_at,
+-- and moved to webhook_dead_letters after the last attempt.
+CREATE TABLE webhook_deliveries (
+  delivery_id     BIGSERIAL PRIMARY KEY,
+  subscription_id TEXT NOT NULL REFERENCES webhook_subscriptions (subscription_id) ON DELETE CASCADE,
+  event_id        TEXT NOT NULL,
+  event_type      TEXT NOT NULL,
+  payload         JSONB NOT NULL, -- The request body, the same on every attempt
+  attempts        INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error      TEXT,
+  created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Finding due deliveries
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at);
+
+-- Deliveries that failed every attempt
+CREATE TABLE webhook_dead_letters (
+  delivery_id     BIGINT PRIMARY KEY,
+  subscription_id TEXT NOT NULL REFERENCES webhook_subscriptions (subscription_id) ON DELETE CASCADE,
+  event_id        TEXT NOT NULL,
+  event_type      TEXT NOT NULL,
+  payload         JSONB NOT NULL,
+  attempts        INTEGER NOT NULL,
+  last_error      TEXT NOT NULL,
+  created_at      TIMESTAMPTZ NOT NULL, -- When the event was emitted
+  failed_at       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Listing the dead letters of a subscription
+CREATE INDEX webhook_dead_letters_subscription_idx ON webhook_dead_letters (subscription_id, failed_at DESC);
@@ -0,0 +1,16 @@
+-- Side effects of domain changes (FCM sends and webhook events), written in the same transaction
+-- as the change. The request that wrote an entry publishes it after the commit; the relay
+-- publishes entries left behind by requests that failed or timed out. Publishing is at least
+-- once, and an entry is deleted once published.
+CREATE TABLE outbox (
+  outbox_id    BIGSERIAL PRIMARY KEY,
+  kind         TEXT NOT NULL,        -- fcm_send or webhook_event
+  payload      JSONB NOT NULL,
+  attempts     INTEGER NOT NULL DEFAULT 0, -- Attempts of the relay
+  available_at TIMESTAMPTZ NOT NULL, -- The relay leaves the entry alone until then: the writer's or relay's lease, or a retry's backoff
+  last_error   TEXT,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Finding entries for the relay
+CREATE INDEX outbox_available_idx ON outbox (available_at);
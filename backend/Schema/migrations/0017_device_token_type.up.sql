@@ -0,0 +1,5 @@
+-- Which push service the device's token belongs to: 'fcm' registration tokens are sent through
+-- FCM, 'apns' device tokens (iOS apps without the Firebase SDK) directly through APNs
+ALTER TABLE devices
+  ADD COLUMN token_type TEXT NOT NULL DEFAULT 'fcm' CHECK (token_type IN ('fcm', 'apns')),
+  ADD CONSTRAINT devices_apns_ios_check CHECK (token_type <> 'apns' OR platform = 'ios');
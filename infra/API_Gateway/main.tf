@@ -189,6 +189,799 @@ resource "aws_lambda_permission" "test_status_permission" {
   source_arn    = "${aws_api_gateway_rest_api.fcm_api.execution_arn}/*/*"
 }
 
+# /test/runs
+resource "aws_api_gateway_resource" "test_runs" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.test.id
+  path_part   = "runs"
+}
+
+# /test/runs/stats
+resource "aws_api_gateway_resource" "test_runs_stats" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.test_runs.id
+  path_part   = "stats"
+}
+
+# GET /test/runs
+resource "aws_api_gateway_method" "test_runs_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.test_runs.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /test/runs (routed by the api function)
+resource "aws_api_gateway_integration" "test_runs_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.test_runs.id
+  http_method = aws_api_gateway_method.test_runs_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /test/runs/stats
+resource "aws_api_gateway_method" "test_runs_stats_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.test_runs_stats.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /test/runs/stats (routed by the api function)
+resource "aws_api_gateway_integration" "test_runs_stats_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.test_runs_stats.id
+  http_method = aws_api_gateway_method.test_runs_stats_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# /messages/{id}
+resource "aws_api_gateway_resource" "message" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.messages.id
+  path_part   = "{id}"
+}
+
+# /messages/{id}/receipt
+resource "aws_api_gateway_resource" "message_receipt" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.message.id
+  path_part   = "receipt"
+}
+
+# POST /messages/{id}/receipt
+resource "aws_api_gateway_method" "message_receipt_post" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.message_receipt.id
+  http_method   = "POST"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.id" = true
+  }
+}
+
+# Lambda integration for POST /messages/{id}/receipt (routed by the api function)
+resource "aws_api_gateway_integration" "message_receipt_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.message_receipt.id
+  http_method = aws_api_gateway_method.message_receipt_post.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# /templates
+resource "aws_api_gateway_resource" "templates" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_rest_api.fcm_api.root_resource_id
+  path_part   = "templates"
+}
+
+# /templates/{key}
+resource "aws_api_gateway_resource" "template_key" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.templates.id
+  path_part   = "{key}"
+}
+
+# /templates/{key}/{locale}
+resource "aws_api_gateway_resource" "template" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.template_key.id
+  path_part   = "{locale}"
+}
+
+# GET /templates
+resource "aws_api_gateway_method" "templates_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.templates.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /templates (routed by the api function)
+resource "aws_api_gateway_integration" "templates_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.templates.id
+  http_method = aws_api_gateway_method.templates_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /templates/{key}/{locale}
+resource "aws_api_gateway_method" "template_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.template.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.key"    = true
+    "method.request.path.locale" = true
+  }
+}
+
+# Lambda integration for GET /templates/{key}/{locale} (routed by the api function)
+resource "aws_api_gateway_integration" "template_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.template.id
+  http_method = aws_api_gateway_method.template_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# PUT /templates/{key}/{locale}
+resource "aws_api_gateway_method" "template_put" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.template.id
+  http_method   = "PUT"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.key"    = true
+    "method.request.path.locale" = true
+  }
+}
+
+# Lambda integration for PUT /templates/{key}/{locale} (routed by the api function)
+resource "aws_api_gateway_integration" "template_put_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.template.id
+  http_method = aws_api_gateway_method.template_put.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# DELETE /templates/{key}/{locale}
+resource "aws_api_gateway_method" "template_delete" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.template.id
+  http_method   = "DELETE"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.key"    = true
+    "method.request.path.locale" = true
+  }
+}
+
+# Lambda integration for DELETE /templates/{key}/{locale} (routed by the api function)
+resource "aws_api_gateway_integration" "template_delete_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.template.id
+  http_method = aws_api_gateway_method.template_delete.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# /users
+resource "aws_api_gateway_resource" "users" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_rest_api.fcm_api.root_resource_id
+  path_part   = "users"
+}
+
+# /users/{user_id}
+resource "aws_api_gateway_resource" "user" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.users.id
+  path_part   = "{user_id}"
+}
+
+# /users/{user_id}/preferences
+resource "aws_api_gateway_resource" "user_preferences" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.user.id
+  path_part   = "preferences"
+}
+
+# GET /users/{user_id}/preferences
+resource "aws_api_gateway_method" "user_preferences_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.user_preferences.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.user_id" = true
+  }
+}
+
+# Lambda integration for GET /users/{user_id}/preferences (routed by the api function)
+resource "aws_api_gateway_integration" "user_preferences_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.user_preferences.id
+  http_method = aws_api_gateway_method.user_preferences_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# PUT /users/{user_id}/preferences
+resource "aws_api_gateway_method" "user_preferences_put" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.user_preferences.id
+  http_method   = "PUT"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.user_id" = true
+  }
+}
+
+# Lambda integration for PUT /users/{user_id}/preferences (routed by the api function)
+resource "aws_api_gateway_integration" "user_preferences_put_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.user_preferences.id
+  http_method = aws_api_gateway_method.user_preferences_put.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /devices
+resource "aws_api_gateway_method" "devices_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.devices.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /devices (routed by the api function)
+resource "aws_api_gateway_integration" "devices_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.devices.id
+  http_method = aws_api_gateway_method.devices_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# /segments
+resource "aws_api_gateway_resource" "segments" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_rest_api.fcm_api.root_resource_id
+  path_part   = "segments"
+}
+
+# /segments/{segment_id}
+resource "aws_api_gateway_resource" "segment" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.segments.id
+  path_part   = "{segment_id}"
+}
+
+# /segments/{segment_id}/preview
+resource "aws_api_gateway_resource" "segment_preview" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.segment.id
+  path_part   = "preview"
+}
+
+# /segments/{segment_id}/send
+resource "aws_api_gateway_resource" "segment_send" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.segment.id
+  path_part   = "send"
+}
+
+# GET /segments
+resource "aws_api_gateway_method" "segments_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.segments.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /segments (routed by the api function)
+resource "aws_api_gateway_integration" "segments_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.segments.id
+  http_method = aws_api_gateway_method.segments_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /segments/{segment_id}
+resource "aws_api_gateway_method" "segment_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.segment.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.segment_id" = true
+  }
+}
+
+# Lambda integration for GET /segments/{segment_id} (routed by the api function)
+resource "aws_api_gateway_integration" "segment_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.segment.id
+  http_method = aws_api_gateway_method.segment_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# PUT /segments/{segment_id}
+resource "aws_api_gateway_method" "segment_put" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.segment.id
+  http_method   = "PUT"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.segment_id" = true
+  }
+}
+
+# Lambda integration for PUT /segments/{segment_id} (routed by the api function)
+resource "aws_api_gateway_integration" "segment_put_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.segment.id
+  http_method = aws_api_gateway_method.segment_put.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# DELETE /segments/{segment_id}
+resource "aws_api_gateway_method" "segment_delete" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.segment.id
+  http_method   = "DELETE"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.segment_id" = true
+  }
+}
+
+# Lambda integration for DELETE /segments/{segment_id} (routed by the api function)
+resource "aws_api_gateway_integration" "segment_delete_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.segment.id
+  http_method = aws_api_gateway_method.segment_delete.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /segments/{segment_id}/preview
+resource "aws_api_gateway_method" "segment_preview_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.segment_preview.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.segment_id" = true
+  }
+}
+
+# Lambda integration for GET /segments/{segment_id}/preview (routed by the api function)
+resource "aws_api_gateway_integration" "segment_preview_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.segment_preview.id
+  http_method = aws_api_gateway_method.segment_preview_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# POST /segments/{segment_id}/send
+resource "aws_api_gateway_method" "segment_send_post" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.segment_send.id
+  http_method   = "POST"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.segment_id" = true
+  }
+}
+
+# Lambda integration for POST /segments/{segment_id}/send (routed by the api function)
+resource "aws_api_gateway_integration" "segment_send_post_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.segment_send.id
+  http_method = aws_api_gateway_method.segment_send_post.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# /broadcasts
+resource "aws_api_gateway_resource" "broadcasts" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_rest_api.fcm_api.root_resource_id
+  path_part   = "broadcasts"
+}
+
+# /broadcasts/{broadcast_id}
+resource "aws_api_gateway_resource" "broadcast" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.broadcasts.id
+  path_part   = "{broadcast_id}"
+}
+
+# GET /broadcasts
+resource "aws_api_gateway_method" "broadcasts_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.broadcasts.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /broadcasts (routed by the api function)
+resource "aws_api_gateway_integration" "broadcasts_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.broadcasts.id
+  http_method = aws_api_gateway_method.broadcasts_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# POST /broadcasts
+resource "aws_api_gateway_method" "broadcasts_post" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.broadcasts.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+# Lambda integration for POST /broadcasts (routed by the api function)
+resource "aws_api_gateway_integration" "broadcasts_post_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.broadcasts.id
+  http_method = aws_api_gateway_method.broadcasts_post.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /broadcasts/{broadcast_id}
+resource "aws_api_gateway_method" "broadcast_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.broadcast.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.broadcast_id" = true
+  }
+}
+
+# Lambda integration for GET /broadcasts/{broadcast_id} (routed by the api function)
+resource "aws_api_gateway_integration" "broadcast_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.broadcast.id
+  http_method = aws_api_gateway_method.broadcast_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# /campaigns
+resource "aws_api_gateway_resource" "campaigns" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_rest_api.fcm_api.root_resource_id
+  path_part   = "campaigns"
+}
+
+# /campaigns/{campaign_id}
+resource "aws_api_gateway_resource" "campaign" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.campaigns.id
+  path_part   = "{campaign_id}"
+}
+
+# /campaigns/{campaign_id}/stats
+resource "aws_api_gateway_resource" "campaign_stats" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.campaign.id
+  path_part   = "stats"
+}
+
+# GET /campaigns
+resource "aws_api_gateway_method" "campaigns_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.campaigns.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /campaigns (routed by the api function)
+resource "aws_api_gateway_integration" "campaigns_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.campaigns.id
+  http_method = aws_api_gateway_method.campaigns_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /campaigns/{campaign_id}
+resource "aws_api_gateway_method" "campaign_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.campaign.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.campaign_id" = true
+  }
+}
+
+# Lambda integration for GET /campaigns/{campaign_id} (routed by the api function)
+resource "aws_api_gateway_integration" "campaign_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.campaign.id
+  http_method = aws_api_gateway_method.campaign_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# PUT /campaigns/{campaign_id}
+resource "aws_api_gateway_method" "campaign_put" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.campaign.id
+  http_method   = "PUT"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.campaign_id" = true
+  }
+}
+
+# Lambda integration for PUT /campaigns/{campaign_id} (routed by the api function)
+resource "aws_api_gateway_integration" "campaign_put_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.campaign.id
+  http_method = aws_api_gateway_method.campaign_put.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# DELETE /campaigns/{campaign_id}
+resource "aws_api_gateway_method" "campaign_delete" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.campaign.id
+  http_method   = "DELETE"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.campaign_id" = true
+  }
+}
+
+# Lambda integration for DELETE /campaigns/{campaign_id} (routed by the api function)
+resource "aws_api_gateway_integration" "campaign_delete_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.campaign.id
+  http_method = aws_api_gateway_method.campaign_delete.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /campaigns/{campaign_id}/stats
+resource "aws_api_gateway_method" "campaign_stats_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.campaign_stats.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.campaign_id" = true
+  }
+}
+
+# Lambda integration for GET /campaigns/{campaign_id}/stats (routed by the api function)
+resource "aws_api_gateway_integration" "campaign_stats_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.campaign_stats.id
+  http_method = aws_api_gateway_method.campaign_stats_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# /webhooks
+resource "aws_api_gateway_resource" "webhooks" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_rest_api.fcm_api.root_resource_id
+  path_part   = "webhooks"
+}
+
+# /webhooks/{subscription_id}
+resource "aws_api_gateway_resource" "webhook" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.webhooks.id
+  path_part   = "{subscription_id}"
+}
+
+# /webhooks/{subscription_id}/dead-letters
+resource "aws_api_gateway_resource" "webhook_dead_letters" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  parent_id   = aws_api_gateway_resource.webhook.id
+  path_part   = "dead-letters"
+}
+
+# GET /webhooks
+resource "aws_api_gateway_method" "webhooks_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.webhooks.id
+  http_method   = "GET"
+  authorization = "NONE"
+}
+
+# Lambda integration for GET /webhooks (routed by the api function)
+resource "aws_api_gateway_integration" "webhooks_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.webhooks.id
+  http_method = aws_api_gateway_method.webhooks_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# POST /webhooks
+resource "aws_api_gateway_method" "webhooks_post" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.webhooks.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+# Lambda integration for POST /webhooks (routed by the api function)
+resource "aws_api_gateway_integration" "webhooks_post_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.webhooks.id
+  http_method = aws_api_gateway_method.webhooks_post.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /webhooks/{subscription_id}
+resource "aws_api_gateway_method" "webhook_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.webhook.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.subscription_id" = true
+  }
+}
+
+# Lambda integration for GET /webhooks/{subscription_id} (routed by the api function)
+resource "aws_api_gateway_integration" "webhook_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.webhook.id
+  http_method = aws_api_gateway_method.webhook_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# DELETE /webhooks/{subscription_id}
+resource "aws_api_gateway_method" "webhook_delete" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.webhook.id
+  http_method   = "DELETE"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.subscription_id" = true
+  }
+}
+
+# Lambda integration for DELETE /webhooks/{subscription_id} (routed by the api function)
+resource "aws_api_gateway_integration" "webhook_delete_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.webhook.id
+  http_method = aws_api_gateway_method.webhook_delete.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# GET /webhooks/{subscription_id}/dead-letters
+resource "aws_api_gateway_method" "webhook_dead_letters_get" {
+  rest_api_id   = aws_api_gateway_rest_api.fcm_api.id
+  resource_id   = aws_api_gateway_resource.webhook_dead_letters.id
+  http_method   = "GET"
+  authorization = "NONE"
+
+  request_parameters = {
+    "method.request.path.subscription_id" = true
+  }
+}
+
+# Lambda integration for GET /webhooks/{subscription_id}/dead-letters (routed by the api function)
+resource "aws_api_gateway_integration" "webhook_dead_letters_get_integration" {
+  rest_api_id = aws_api_gateway_rest_api.fcm_api.id
+  resource_id = aws_api_gateway_resource.webhook_dead_letters.id
+  http_method = aws_api_gateway_method.webhook_dead_letters_get.http_method
+
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = "arn:aws:apigateway:${var.aws_region}:lambda:path/2015-03-31/functions/${var.api_lambda_arn}/invocations"
+}
+
+# Lambda permission for API Gateway to invoke the api function
+resource "aws_lambda_permission" "api_permission" {
+  statement_id  = "AllowAPIGatewayInvokeApi"
+  action        = "lambda:InvokeFunction"
+  function_name = var.api_lambda_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_api_gateway_rest_api.fcm_api.execution_arn}/*/*"
+}
+
 resource "aws_api_gateway_deployment" "fcm_deployment" {
   rest_api_id = aws_api_gateway_rest_api.fcm_api.id
 
@@ -198,10 +991,68 @@ resource "aws_api_gateway_deployment" "fcm_deployment" {
       aws_api_gateway_method.messages_send_post.id,
       aws_api_gateway_method.test_ack_post.id,
       aws_api_gateway_method.test_status_get.id,
+      aws_api_gateway_method.test_runs_get.id,
+      aws_api_gateway_method.test_runs_stats_get.id,
+      aws_api_gateway_method.message_receipt_post.id,
+      aws_api_gateway_method.templates_get.id,
+      aws_api_gateway_method.template_get.id,
+      aws_api_gateway_method.template_put.id,
+      aws_api_gateway_method.template_delete.id,
+      aws_api_gateway_method.user_preferences_get.id,
+      aws_api_gateway_method.user_preferences_put.id,
+      aws_api_gateway_method.devices_get.id,
+      aws_api_gateway_method.segments_get.id,
+      aws_api_gateway_method.segment_get.id,
+      aws_api_gateway_method.segment_put.id,
+      aws_api_gateway_method.segment_delete.id,
+      aws_api_gateway_method.segment_preview_get.id,
+      aws_api_gateway_method.segment_send_post.id,
+      aws_api_gateway_method.broadcasts_get.id,
+      aws_api_gateway_method.broadcasts_post.id,
+      aws_api_gateway_method.broadcast_get.id,
+      aws_api_gateway_method.campaigns_get.id,
+      aws_api_gateway_method.campaign_get.id,
+      aws_api_gateway_method.campaign_put.id,
+      aws_api_gateway_method.campaign_delete.id,
+      aws_api_gateway_method.campaign_stats_get.id,
+      aws_api_gateway_method.webhooks_get.id,
+      aws_api_gateway_method.webhooks_post.id,
+      aws_api_gateway_method.webhook_get.id,
+      aws_api_gateway_method.webhook_delete.id,
+      aws_api_gateway_method.webhook_dead_letters_get.id,
       aws_api_gateway_integration.devices_register_integration.id,
       aws_api_gateway_integration.messages_send_integration.id,
       aws_api_gateway_integration.test_ack_integration.id,
       aws_api_gateway_integration.test_status_integration.id,
+      aws_api_gateway_integration.test_runs_integration.id,
+      aws_api_gateway_integration.test_runs_stats_integration.id,
+      aws_api_gateway_integration.message_receipt_integration.id,
+      aws_api_gateway_integration.templates_integration.id,
+      aws_api_gateway_integration.template_get_integration.id,
+      aws_api_gateway_integration.template_put_integration.id,
+      aws_api_gateway_integration.template_delete_integration.id,
+      aws_api_gateway_integration.user_preferences_get_integration.id,
+      aws_api_gateway_integration.user_preferences_put_integration.id,
+      aws_api_gateway_integration.devices_get_integration.id,
+      aws_api_gateway_integration.segments_get_integration.id,
+      aws_api_gateway_integration.segment_get_integration.id,
+      aws_api_gateway_integration.segment_put_integration.id,
+      aws_api_gateway_integration.segment_delete_integration.id,
+      aws_api_gateway_integration.segment_preview_get_integration.id,
+      aws_api_gateway_integration.segment_send_post_integration.id,
+      aws_api_gateway_integration.broadcasts_get_integration.id,
+      aws_api_gateway_integration.broadcasts_post_integration.id,
+      aws_api_gateway_integration.broadcast_get_integration.id,
+      aws_api_gateway_integration.campaigns_get_integration.id,
+      aws_api_gateway_integration.campaign_get_integration.id,
+      aws_api_gateway_integration.campaign_put_integration.id,
+      aws_api_gateway_integration.campaign_delete_integration.id,
+      aws_api_gateway_integration.campaign_stats_get_integration.id,
+      aws_api_gateway_integration.webhooks_get_integration.id,
+      aws_api_gateway_integration.webhooks_post_integration.id,
+      aws_api_gateway_integration.webhook_get_integration.id,
+      aws_api_gateway_integration.webhook_delete_integration.id,
+      aws_api_gateway_integration.webhook_dead_letters_get_integration.id,
     ]))
   }
 
@@ -3,11 +3,96 @@ output "endpoint_devices_register" {
   value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/devices/register"
 }
 
+output "endpoint_devices" {
+  description = "GET /devices"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/devices"
+}
+
 output "endpoint_messages_send" {
   description = "POST /messages/send"
   value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/messages/send"
 }
 
+output "endpoint_message_receipt" {
+  description = "POST /messages/{id}/receipt"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/messages/{id}/receipt"
+}
+
+output "endpoint_templates" {
+  description = "GET /templates"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/templates"
+}
+
+output "endpoint_template" {
+  description = "GET, PUT and DELETE /templates/{key}/{locale}"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/templates/{key}/{locale}"
+}
+
+output "endpoint_user_preferences" {
+  description = "GET and PUT /users/{user_id}/preferences"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/users/{user_id}/preferences"
+}
+
+output "endpoint_segments" {
+  description = "GET /segments"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/segments"
+}
+
+output "endpoint_segment" {
+  description = "GET, PUT and DELETE /segments/{segment_id}"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/segments/{segment_id}"
+}
+
+output "endpoint_segment_preview" {
+  description = "GET /segments/{segment_id}/preview"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/segments/{segment_id}/preview"
+}
+
+output "endpoint_segment_send" {
+  description = "POST /segments/{segment_id}/send"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/segments/{segment_id}/send"
+}
+
+output "endpoint_broadcasts" {
+  description = "GET and POST /broadcasts"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/broadcasts"
+}
+
+output "endpoint_broadcast" {
+  description = "GET /broadcasts/{broadcast_id}"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/broadcasts/{broadcast_id}"
+}
+
+output "endpoint_campaigns" {
+  description = "GET /campaigns"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/campaigns"
+}
+
+output "endpoint_campaign" {
+  description = "GET, PUT and DELETE /campaigns/{campaign_id}"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/campaigns/{campaign_id}"
+}
+
+output "endpoint_campaign_stats" {
+  description = "GET /campaigns/{campaign_id}/stats"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/campaigns/{campaign_id}/stats"
+}
+
+output "endpoint_webhooks" {
+  description = "GET and POST /webhooks"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/webhooks"
+}
+
+output "endpoint_webhook" {
+  description = "GET and DELETE /webhooks/{subscription_id}"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/webhooks/{subscription_id}"
+}
+
+output "endpoint_webhook_dead_letters" {
+  description = "GET /webhooks/{subscription_id}/dead-letters"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/webhooks/{subscription_id}/dead-letters"
+}
+
 output "endpoint_test_ack" {
   description = "POST /test/ack"
   value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/test/ack"
@@ -18,6 +103,16 @@ output "endpoint_test_status" {
   value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/test/status"
 }
 
+output "endpoint_test_runs" {
+  description = "GET /test/runs"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/test/runs"
+}
+
+output "endpoint_test_runs_stats" {
+  description = "GET /test/runs/stats"
+  value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}/test/runs/stats"
+}
+
 output "api_base_url" {
   description = "API Gateway base URL"
   value       = "https://${aws_api_gateway_rest_api.fcm_api.id}.execute-api.${var.aws_region}.amazonaws.com/${aws_api_gateway_stage.fcm_stage.stage_name}"
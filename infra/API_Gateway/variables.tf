@@ -55,3 +55,13 @@ variable "test_status_lambda_name" {
   description = "Name of testStatusHandler Lambda function (for Permission)"
   type        = string
 }
+
+variable "api_lambda_arn" {
+  description = "ARN of routerHandler Lambda function serving the remaining routes (for Integration URI)"
+  type        = string
+}
+
+variable "api_lambda_name" {
+  description = "Name of routerHandler Lambda function (for Permission)"
+  type        = string
+}
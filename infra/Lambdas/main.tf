@@ -73,7 +73,7 @@ resource "aws_iam_role_policy_attachment" "lambda_logs" {
   policy_arn = "arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"
 }
 
-# Policy for Secrets Manager access - Required to read FCM credentials and RDS password
+# Policy for Secrets Manager access - Required to read FCM credentials (all apps) and RDS password
 # Allows Lambda to read secrets from Secrets Manager
 resource "aws_iam_role_policy" "lambda_secrets" {
   name = "${var.environment}-lambda-secrets-policy"
@@ -88,9 +88,40 @@ resource "aws_iam_role_policy" "lambda_secrets" {
           "secretsmanager:GetSecretValue",
           "secretsmanager:DescribeSecret"
         ]
+        Resource = concat(
+          [
+            var.secrets_manager_secret_arn,
+            var.rds_password_secret_arn,
+            var.ack_token_secret_arn
+          ],
+          values(var.fcm_app_secrets),
+          values(var.apns_app_secrets)
+        )
+      }
+    ]
+  })
+}
+
+# Policy for RDS IAM authentication - Only created when rds_auth_mode = "iam"
+# Allows Lambda to generate auth tokens for the database user (directly or through RDS Proxy)
+data "aws_caller_identity" "current" {}
+
+resource "aws_iam_role_policy" "lambda_rds_iam" {
+  count = var.rds_auth_mode == "iam" ? 1 : 0
+
+  name = "${var.environment}-lambda-rds-iam-policy"
+  role = aws_iam_role.lambda.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "rds-db:connect"
+        ]
         Resource = [
-          var.secrets_manager_secret_arn,
-          var.rds_password_secret_arn
+          "arn:aws:rds-db:${var.aws_region}:${data.aws_caller_identity.current.account_id}:dbuser:${var.rds_iam_resource_id}/${var.rds_username}"
         ]
       }
     ]
@@ -167,7 +198,12 @@ resource "aws_lambda_function" "register_device" {
       RDS_DB_NAME             = var.rds_db_name
       RDS_USERNAME            = var.rds_username
       RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
       SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
     }
   }
 
@@ -207,7 +243,12 @@ resource "aws_lambda_function" "send_message" {
       RDS_DB_NAME             = var.rds_db_name
       RDS_USERNAME            = var.rds_username
       RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
       SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
     }
   }
 
@@ -248,7 +289,12 @@ resource "aws_lambda_function" "test_ack" {
       RDS_DB_NAME             = var.rds_db_name
       RDS_USERNAME            = var.rds_username
       RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
       SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
     }
   }
 
@@ -289,7 +335,12 @@ resource "aws_lambda_function" "test_status" {
       RDS_DB_NAME             = var.rds_db_name
       RDS_USERNAME            = var.rds_username
       RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
       SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
     }
   }
 
@@ -298,6 +349,408 @@ resource "aws_lambda_function" "test_status" {
   }
 }
 
+# Lambda function: routerHandler
+# Serves API routes that have no function of their own (GET /test/runs, GET /test/runs/stats),
+# dispatching on the API Gateway resource and method. New endpoints are added to apiRoutes in the
+# API code and routed here, instead of each getting a function, image tag and deploy-script plumbing.
+# Reuses the test-status image: all API functions share one binary selected by LAMBDA_HANDLER.
+resource "aws_lambda_function" "api" {
+  function_name = "${var.environment}-routerHandler"
+  role          = aws_iam_role.lambda.arn
+  package_type  = "Image"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  image_uri = "${aws_ecr_repository.lambda_images.repository_url}:test-status-${var.image_tag}"
+
+  image_config {
+    command = ["bootstrap"]
+  }
+
+  vpc_config {
+    subnet_ids         = var.private_subnet_ids
+    security_group_ids = [var.lambda_security_group_id]
+  }
+
+  environment {
+    variables = {
+      LAMBDA_HANDLER          = "RouterHandler"
+      RDS_HOST                = var.rds_host
+      RDS_PORT                = tostring(var.rds_port)
+      RDS_DB_NAME             = var.rds_db_name
+      RDS_USERNAME            = var.rds_username
+      RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
+      SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
+    }
+  }
+
+  tags = {
+    Name = "${var.environment}-routerHandler"
+  }
+}
+
+# Lambda function: sweepTestRunsHandler
+# Marks PENDING e2e test runs past their expires_at as EXPIRED, on a schedule.
+# Reuses the test-status image: all API functions share one binary selected by LAMBDA_HANDLER.
+resource "aws_lambda_function" "sweep_test_runs" {
+  function_name = "${var.environment}-sweepTestRunsHandler"
+  role          = aws_iam_role.lambda.arn
+  package_type  = "Image"
+  timeout       = var.lambda_timeout
+  memory_size   = var.lambda_memory_size
+
+  image_uri = "${aws_ecr_repository.lambda_images.repository_url}:test-status-${var.image_tag}"
+
+  # For Lambda provided runtime, handler is the executable name
+  # The entrypoint script will call /var/runtime/bootstrap
+  image_config {
+    command = ["bootstrap"]
+  }
+
+  vpc_config {
+    subnet_ids         = var.private_subnet_ids
+    security_group_ids = [var.lambda_security_group_id]
+  }
+
+  environment {
+    variables = {
+      LAMBDA_HANDLER          = "SweepTestRunsHandler"
+      RDS_HOST                = var.rds_host
+      RDS_PORT                = tostring(var.rds_port)
+      RDS_DB_NAME             = var.rds_db_name
+      RDS_USERNAME            = var.rds_username
+      RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
+      SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
+    }
+  }
+
+  tags = {
+    Name = "${var.environment}-sweepTestRunsHandler"
+  }
+}
+
+# Schedule for sweepTestRunsHandler
+resource "aws_cloudwatch_event_rule" "sweep_test_runs" {
+  name                = "${var.environment}-sweepTestRuns"
+  description         = "Expire PENDING e2e test runs past their expires_at"
+  schedule_expression = var.test_run_sweep_schedule
+}
+
+resource "aws_cloudwatch_event_target" "sweep_test_runs" {
+  rule = aws_cloudwatch_event_rule.sweep_test_runs.name
+  arn  = aws_lambda_function.sweep_test_runs.arn
+}
+
+resource "aws_lambda_permission" "sweep_test_runs_events" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.sweep_test_runs.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.sweep_test_runs.arn
+}
+
+# Lambda function: broadcastHandler
+# Resumes RUNNING broadcasts from their last checkpoint, on a schedule, until its timeout is near.
+# Reuses the test-status image: all API functions share one binary selected by LAMBDA_HANDLER.
+resource "aws_lambda_function" "broadcast" {
+  function_name = "${var.environment}-broadcastHandler"
+  role          = aws_iam_role.lambda.arn
+  package_type  = "Image"
+  timeout       = var.broadcast_timeout_seconds
+  memory_size   = var.lambda_memory_size
+
+  image_uri = "${aws_ecr_repository.lambda_images.repository_url}:test-status-${var.image_tag}"
+
+  # For Lambda provided runtime, handler is the executable name
+  # The entrypoint script will call /var/runtime/bootstrap
+  image_config {
+    command = ["bootstrap"]
+  }
+
+  vpc_config {
+    subnet_ids         = var.private_subnet_ids
+    security_group_ids = [var.lambda_security_group_id]
+  }
+
+  environment {
+    variables = {
+      LAMBDA_HANDLER          = "BroadcastHandler"
+      RDS_HOST                = var.rds_host
+      RDS_PORT                = tostring(var.rds_port)
+      RDS_DB_NAME             = var.rds_db_name
+      RDS_USERNAME            = var.rds_username
+      RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
+      SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
+    }
+  }
+
+  tags = {
+    Name = "${var.environment}-broadcastHandler"
+  }
+}
+
+# Schedule for broadcastHandler
+resource "aws_cloudwatch_event_rule" "broadcast" {
+  name                = "${var.environment}-broadcast"
+  description         = "Resume RUNNING broadcasts from their last checkpoint"
+  schedule_expression = var.broadcast_schedule
+}
+
+resource "aws_cloudwatch_event_target" "broadcast" {
+  rule = aws_cloudwatch_event_rule.broadcast.name
+  arn  = aws_lambda_function.broadcast.arn
+}
+
+resource "aws_lambda_permission" "broadcast_events" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.broadcast.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.broadcast.arn
+}
+
+# Lambda function: webhookHandler
+# Posts due webhook deliveries on a schedule, retrying failures with backoff until they are dead-lettered.
+# Reuses the test-status image: all API functions share one binary selected by LAMBDA_HANDLER.
+resource "aws_lambda_function" "webhook" {
+  function_name = "${var.environment}-webhookHandler"
+  role          = aws_iam_role.lambda.arn
+  package_type  = "Image"
+  timeout       = var.webhook_timeout_seconds
+  memory_size   = var.lambda_memory_size
+
+  image_uri = "${aws_ecr_repository.lambda_images.repository_url}:test-status-${var.image_tag}"
+
+  # For Lambda provided runtime, handler is the executable name
+  # The entrypoint script will call /var/runtime/bootstrap
+  image_config {
+    command = ["bootstrap"]
+  }
+
+  vpc_config {
+    subnet_ids         = var.private_subnet_ids
+    security_group_ids = [var.lambda_security_group_id]
+  }
+
+  environment {
+    variables = {
+      LAMBDA_HANDLER          = "WebhookHandler"
+      RDS_HOST                = var.rds_host
+      RDS_PORT                = tostring(var.rds_port)
+      RDS_DB_NAME             = var.rds_db_name
+      RDS_USERNAME            = var.rds_username
+      RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
+      SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
+    }
+  }
+
+  tags = {
+    Name = "${var.environment}-webhookHandler"
+  }
+}
+
+# Schedule for webhookHandler
+resource "aws_cloudwatch_event_rule" "webhook" {
+  name                = "${var.environment}-webhook"
+  description         = "Post due webhook deliveries"
+  schedule_expression = var.webhook_schedule
+}
+
+resource "aws_cloudwatch_event_target" "webhook" {
+  rule = aws_cloudwatch_event_rule.webhook.name
+  arn  = aws_lambda_function.webhook.arn
+}
+
+resource "aws_lambda_permission" "webhook_events" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.webhook.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.webhook.arn
+}
+
+# Lambda function: relayHandler
+# Publishes the outbox entries (FCM sends, webhook events) their writers did not, e.g. after a timeout or crash.
+# Reuses the test-status image: all API functions share one binary selected by LAMBDA_HANDLER.
+resource "aws_lambda_function" "relay" {
+  function_name = "${var.environment}-relayHandler"
+  role          = aws_iam_role.lambda.arn
+  package_type  = "Image"
+  timeout       = var.relay_timeout_seconds
+  memory_size   = var.lambda_memory_size
+
+  image_uri = "${aws_ecr_repository.lambda_images.repository_url}:test-status-${var.image_tag}"
+
+  # For Lambda provided runtime, handler is the executable name
+  # The entrypoint script will call /var/runtime/bootstrap
+  image_config {
+    command = ["bootstrap"]
+  }
+
+  vpc_config {
+    subnet_ids         = var.private_subnet_ids
+    security_group_ids = [var.lambda_security_group_id]
+  }
+
+  environment {
+    variables = {
+      LAMBDA_HANDLER          = "RelayHandler"
+      RDS_HOST                = var.rds_host
+      RDS_PORT                = tostring(var.rds_port)
+      RDS_DB_NAME             = var.rds_db_name
+      RDS_USERNAME            = var.rds_username
+      RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
+      SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
+    }
+  }
+
+  tags = {
+    Name = "${var.environment}-relayHandler"
+  }
+}
+
+# Schedule for relayHandler
+resource "aws_cloudwatch_event_rule" "relay" {
+  name                = "${var.environment}-relay"
+  description         = "Publish leftover outbox entries"
+  schedule_expression = var.relay_schedule
+}
+
+resource "aws_cloudwatch_event_target" "relay" {
+  rule = aws_cloudwatch_event_rule.relay.name
+  arn  = aws_lambda_function.relay.arn
+}
+
+resource "aws_lambda_permission" "relay_events" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.relay.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.relay.arn
+}
+
+# Lambda function: probeHandler - Only created when probe_user_id is set
+# Synthetic delivery probe: sends an e2e test message to the canary user on a schedule,
+# waits for the ack and writes pass/fail and latency as CloudWatch EMF metrics.
+# Reuses the test-status image: all API functions share one binary selected by LAMBDA_HANDLER.
+resource "aws_lambda_function" "probe" {
+  count = var.probe_user_id != "" ? 1 : 0
+
+  function_name = "${var.environment}-probeHandler"
+  role          = aws_iam_role.lambda.arn
+  package_type  = "Image"
+  # The probe waits up to probe_timeout_seconds for the ack
+  timeout     = var.probe_timeout_seconds + 30
+  memory_size = var.lambda_memory_size
+
+  image_uri = "${aws_ecr_repository.lambda_images.repository_url}:test-status-${var.image_tag}"
+
+  # For Lambda provided runtime, handler is the executable name
+  # The entrypoint script will call /var/runtime/bootstrap
+  image_config {
+    command = ["bootstrap"]
+  }
+
+  vpc_config {
+    subnet_ids         = var.private_subnet_ids
+    security_group_ids = [var.lambda_security_group_id]
+  }
+
+  environment {
+    variables = {
+      LAMBDA_HANDLER          = "ProbeHandler"
+      RDS_HOST                = var.rds_host
+      RDS_PORT                = tostring(var.rds_port)
+      RDS_DB_NAME             = var.rds_db_name
+      RDS_USERNAME            = var.rds_username
+      RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
+      SECRET_ARN              = var.secrets_manager_secret_arn
+      FCM_APP_SECRETS         = jsonencode(var.fcm_app_secrets)
+      APNS_APP_SECRETS        = jsonencode(var.apns_app_secrets)
+      ACK_TOKEN_SECRET_ARN    = var.ack_token_secret_arn
+      DEFAULT_LOCALE          = var.default_locale
+      PROBE_USER_ID           = var.probe_user_id
+      PROBE_TIMEOUT           = "${var.probe_timeout_seconds}s"
+      ENVIRONMENT             = var.environment
+    }
+  }
+
+  tags = {
+    Name = "${var.environment}-probeHandler"
+  }
+}
+
+# Schedule for probeHandler
+resource "aws_cloudwatch_event_rule" "probe" {
+  count = var.probe_user_id != "" ? 1 : 0
+
+  name                = "${var.environment}-deliveryProbe"
+  description         = "Send a synthetic e2e test message to the canary user and measure delivery"
+  schedule_expression = var.probe_schedule
+}
+
+resource "aws_cloudwatch_event_target" "probe" {
+  count = var.probe_user_id != "" ? 1 : 0
+
+  rule = aws_cloudwatch_event_rule.probe[0].name
+  arn  = aws_lambda_function.probe[0].arn
+}
+
+resource "aws_lambda_permission" "probe_events" {
+  count = var.probe_user_id != "" ? 1 : 0
+
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.probe[0].function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.probe[0].arn
+}
+
+# Alarm when probes keep failing (or stop reporting)
+resource "aws_cloudwatch_metric_alarm" "probe_failing" {
+  count = var.probe_user_id != "" ? 1 : 0
+
+  alarm_name          = "${var.environment}-deliveryProbeFailing"
+  alarm_description   = "Synthetic push notifications are not being acknowledged by the canary device"
+  namespace           = "FCMTutorial/Probe"
+  metric_name         = "ProbeSuccess"
+  dimensions          = { Environment = var.environment }
+  statistic           = "Maximum"
+  period              = 900
+  evaluation_periods  = var.probe_alarm_evaluation_periods
+  comparison_operator = "LessThanThreshold"
+  threshold           = 1
+  treat_missing_data  = "breaching"
+  alarm_actions       = var.probe_alarm_actions
+  ok_actions          = var.probe_alarm_actions
+}
+
 # Lambda function: initSchema (for database schema initialization)
 resource "aws_lambda_function" "init_schema" {
   function_name = "${var.environment}-initSchema"
@@ -326,6 +779,7 @@ resource "aws_lambda_function" "init_schema" {
       RDS_DB_NAME             = var.rds_db_name
       RDS_USERNAME            = var.rds_username
       RDS_PASSWORD_SECRET_ARN = var.rds_password_secret_arn
+      RDS_AUTH_MODE           = var.rds_auth_mode
     }
   }
 
@@ -43,6 +43,41 @@ output "test_status_function_name" {
   value       = aws_lambda_function.test_status.function_name
 }
 
+output "api_function_arn" {
+  description = "ARN of routerHandler Lambda function"
+  value       = aws_lambda_function.api.arn
+}
+
+output "api_function_name" {
+  description = "Name of routerHandler Lambda function"
+  value       = aws_lambda_function.api.function_name
+}
+
+output "sweep_test_runs_function_name" {
+  description = "Name of sweepTestRunsHandler Lambda function"
+  value       = aws_lambda_function.sweep_test_runs.function_name
+}
+
+output "broadcast_function_name" {
+  description = "Name of broadcastHandler Lambda function"
+  value       = aws_lambda_function.broadcast.function_name
+}
+
+output "webhook_function_name" {
+  description = "Name of webhookHandler Lambda function"
+  value       = aws_lambda_function.webhook.function_name
+}
+
+output "relay_function_name" {
+  description = "Name of relayHandler Lambda function"
+  value       = aws_lambda_function.relay.function_name
+}
+
+output "probe_function_name" {
+  description = "Name of probeHandler Lambda function (null if probe_user_id is not set)"
+  value       = one(aws_lambda_function.probe[*].function_name)
+}
+
 output "ecr_repository_url" {
   description = "ECR repository URL for Lambda container images"
   value       = aws_ecr_repository.lambda_images.repository_url
@@ -57,11 +57,106 @@ variable "secrets_manager_secret_arn" {
   type        = string
 }
 
+variable "fcm_app_secrets" {
+  description = "Additional Firebase apps: map of app ID to Secrets Manager ARN of that project's service account JSON. The 'default' app uses secrets_manager_secret_arn"
+  type        = map(string)
+  default     = {}
+}
+
+variable "apns_app_secrets" {
+  description = "iOS apps sending directly with APNs: map of app ID to Secrets Manager ARN of the app's APNs signing key JSON (team_id, key_id, private_key, topic, sandbox)"
+  type        = map(string)
+  default     = {}
+}
+
 variable "rds_password_secret_arn" {
   description = "Secrets Manager secret ARN for RDS password"
   type        = string
 }
 
+variable "ack_token_secret_arn" {
+  description = "Secrets Manager secret ARN for the key signing e2e test ack tokens"
+  type        = string
+}
+
+variable "default_locale" {
+  description = "Locale of message templates used for devices without a template in their own locale"
+  type        = string
+  default     = "en"
+}
+
+variable "test_run_sweep_schedule" {
+  description = "EventBridge schedule expression for sweepTestRunsHandler, which expires unacknowledged e2e test runs"
+  type        = string
+  default     = "rate(5 minutes)"
+}
+
+variable "broadcast_schedule" {
+  description = "EventBridge schedule expression for broadcastHandler, which resumes RUNNING broadcasts"
+  type        = string
+  default     = "rate(1 minute)"
+}
+
+variable "broadcast_timeout_seconds" {
+  description = "Timeout of broadcastHandler. It sends batches until the timeout is near; a broadcast it leaves RUNNING is resumed by the next run"
+  type        = number
+  default     = 300
+}
+
+variable "webhook_schedule" {
+  description = "EventBridge schedule expression for webhookHandler, which posts due webhook deliveries"
+  type        = string
+  default     = "rate(1 minute)"
+}
+
+variable "webhook_timeout_seconds" {
+  description = "Timeout of webhookHandler. It posts batches until the timeout is near; deliveries it leaves due are posted by the next run"
+  type        = number
+  default     = 300
+}
+
+variable "relay_schedule" {
+  description = "EventBridge schedule expression for relayHandler, which publishes leftover outbox entries"
+  type        = string
+  default     = "rate(1 minute)"
+}
+
+variable "relay_timeout_seconds" {
+  description = "Timeout of relayHandler. It publishes entries until the timeout is near; entries it leaves are claimed again by a later run"
+  type        = number
+  default     = 300
+}
+
+variable "probe_user_id" {
+  description = "Canary user_id for the synthetic delivery probe (probeHandler). Its device must run the app and ack e2e test messages. Empty disables the probe"
+  type        = string
+  default     = ""
+}
+
+variable "probe_schedule" {
+  description = "EventBridge schedule expression for probeHandler"
+  type        = string
+  default     = "rate(15 minutes)"
+}
+
+variable "probe_timeout_seconds" {
+  description = "How long probeHandler waits for the canary device's ack"
+  type        = number
+  default     = 60
+}
+
+variable "probe_alarm_evaluation_periods" {
+  description = "Number of consecutive 15-minute periods without a passing probe before the alarm fires"
+  type        = number
+  default     = 2
+}
+
+variable "probe_alarm_actions" {
+  description = "ARNs (e.g. SNS topics) notified when the delivery probe alarm changes state"
+  type        = list(string)
+  default     = []
+}
+
 variable "lambda_timeout" {
   description = "Lambda function timeout in seconds"
   type        = number
@@ -81,3 +176,20 @@ variable "image_tag" {
   default     = "latest"
 }
 
+
+variable "rds_auth_mode" {
+  description = "Database authentication mode for Lambdas: 'password' (Secrets Manager) or 'iam' (RDS IAM auth token, e.g. via RDS Proxy)"
+  type        = string
+  default     = "password"
+
+  validation {
+    condition     = contains(["password", "iam"], var.rds_auth_mode)
+    error_message = "rds_auth_mode must be 'password' or 'iam'."
+  }
+}
+
+variable "rds_iam_resource_id" {
+  description = "RDS instance resource ID (db-XXXX) or RDS Proxy ID (prx-XXXX) allowed for rds-db:connect. Required when rds_auth_mode is 'iam'"
+  type        = string
+  default     = ""
+}
@@ -76,6 +76,8 @@ resource "aws_db_instance" "main" {
   db_subnet_group_name   = aws_db_subnet_group.main.name
   vpc_security_group_ids = [aws_security_group.rds.id]
 
+  iam_database_authentication_enabled = var.iam_database_authentication_enabled
+
   backup_retention_period = 7
   backup_window          = "03:00-04:00"
   maintenance_window     = "mon:04:00-mon:05:00"
@@ -90,14 +92,20 @@ resource "aws_db_instance" "main" {
   }
 }
 
-# Local values for schema file path
+# Local values for schema migrations directory
 # Defaults to standard project structure if not provided
 locals {
-  init_schema_file_path = var.init_schema_file_path != "" ? var.init_schema_file_path : "${path.module}/../../backend/Schema/init.sql"
+  schema_migrations_dir = var.schema_migrations_dir != "" ? var.schema_migrations_dir : "${path.module}/../../backend/Schema/migrations"
+
+  # Changes whenever a migration file is added or modified
+  schema_migrations_hash = sha1(join(",", [
+    for f in sort(fileset(local.schema_migrations_dir, "*.sql")) : "${f}:${filemd5("${local.schema_migrations_dir}/${f}")}"
+  ]))
 }
 
-# Database Schema Initialization
-# Automatically invokes initSchema Lambda after RDS is created and available
+# Database Schema Migrations
+# Automatically invokes initSchema Lambda ("up" command) after RDS is created
+# and whenever the migrations change
 resource "aws_lambda_invocation" "init_schema" {
   count = var.init_schema_lambda_name != "" ? 1 : 0
 
@@ -105,11 +113,11 @@ resource "aws_lambda_invocation" "init_schema" {
 
   triggers = {
     rds_endpoint = aws_db_instance.main.endpoint
-    schema_hash  = filemd5(local.init_schema_file_path)
+    schema_hash  = local.schema_migrations_hash
   }
 
   input = jsonencode({
-    action = "init_schema"
+    command = "up"
   })
 
   depends_on = [
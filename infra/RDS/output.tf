@@ -22,3 +22,8 @@ output "rds_username" {
   description = "RDS database username"
   value       = aws_db_instance.main.username
 }
+
+output "rds_resource_id" {
+  description = "RDS instance resource ID (used in rds-db:connect IAM policies)"
+  value       = aws_db_instance.main.resource_id
+}
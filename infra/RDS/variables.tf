@@ -60,9 +60,15 @@ variable "init_schema_lambda_name" {
   default     = ""
 }
 
-variable "init_schema_file_path" {
-  description = "Path to the database schema initialization SQL file. If empty, the module uses the default path ../../backend/Schema/init.sql relative to this module directory. Can be absolute or relative."
+variable "schema_migrations_dir" {
+  description = "Path to the database migrations directory. If empty, the module uses the default path ../../backend/Schema/migrations relative to this module directory. Can be absolute or relative."
   type        = string
   default     = ""
 }
 
+
+variable "iam_database_authentication_enabled" {
+  description = "Enable IAM database authentication (required when Lambdas use RDS_AUTH_MODE=iam)"
+  type        = bool
+  default     = false
+}
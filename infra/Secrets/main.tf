@@ -5,6 +5,10 @@ terraform {
       source  = "hashicorp/aws"
       version = "~> 5.0"
     }
+    random = {
+      source  = "hashicorp/random"
+      version = "~> 3.6"
+    }
   }
 }
 
@@ -87,3 +91,25 @@ resource "aws_secretsmanager_secret_version" "rds_password" {
   }
 }
 
+# Key for signing the ack tokens of e2e test messages (HMAC-SHA256).
+# Generated once; replacing random_password.ack_token_key rotates it, which
+# invalidates the tokens of test runs still in flight.
+resource "random_password" "ack_token_key" {
+  length  = 64
+  special = false
+}
+
+resource "aws_secretsmanager_secret" "ack_token_key" {
+  name                    = "${var.environment}-ack-token-key"
+  description             = "HMAC key signing e2e test ack tokens"
+  recovery_window_in_days = var.recovery_window_in_days
+
+  tags = {
+    Name = "${var.environment}-ack-token-key"
+  }
+}
+
+resource "aws_secretsmanager_secret_version" "ack_token_key" {
+  secret_id     = aws_secretsmanager_secret.ack_token_key.id
+  secret_string = random_password.ack_token_key.result
+}
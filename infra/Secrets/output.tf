@@ -23,3 +23,7 @@ output "rds_password_secret_name" {
   value       = aws_secretsmanager_secret.rds_password.name
 }
 
+output "ack_token_secret_arn" {
+  description = "ARN of the ack token signing key secret"
+  value       = aws_secretsmanager_secret.ack_token_key.arn
+}
@@ -245,10 +245,12 @@ terraform_apply "infra/Secrets" "Secrets Manager" \
 cd "$PROJECT_ROOT/infra/Secrets"
 SECRET_ARN=$(terraform output -raw secret_arn)
 RDS_PASSWORD_SECRET_ARN=$(terraform output -raw rds_password_secret_arn)
+ACK_TOKEN_SECRET_ARN=$(terraform output -raw ack_token_secret_arn)
 
 echo -e "${GREEN}Secrets Output:${NC}"
 echo -e "  FCM Secret ARN: $SECRET_ARN"
 echo -e "  RDS Password Secret ARN: $RDS_PASSWORD_SECRET_ARN"
+echo -e "  Ack Token Secret ARN: $ACK_TOKEN_SECRET_ARN"
 
 # Step 4: Deploy Lambdas (if not skipped)
 if [ "$SKIP_LAMBDAS" = false ]; then
@@ -280,6 +282,7 @@ if [ "$SKIP_LAMBDAS" = false ]; then
         "-var=rds_db_name=$RDS_DB_NAME"
         "-var=secrets_manager_secret_arn=$SECRET_ARN"
         "-var=rds_password_secret_arn=$RDS_PASSWORD_SECRET_ARN"
+        "-var=ack_token_secret_arn=$ACK_TOKEN_SECRET_ARN"
         "-var=rds_username=$TF_VAR_rds_username"
         "-var=image_tag=$IMAGE_TAG"
     )
@@ -392,6 +395,8 @@ EOF
     TEST_ACK_NAME=$(terraform output -raw test_ack_function_name)
     TEST_STATUS_ARN=$(terraform output -raw test_status_function_arn)
     TEST_STATUS_NAME=$(terraform output -raw test_status_function_name)
+    API_ARN=$(terraform output -raw api_function_arn)
+    API_NAME=$(terraform output -raw api_function_name)
     INIT_SCHEMA_NAME=$(terraform output -raw init_schema_function_name 2>/dev/null || echo "")
     
     echo -e "${GREEN}Lambda Functions deployed successfully!${NC}"
@@ -400,6 +405,7 @@ EOF
     echo -e "  Send Message ARN: $SEND_MESSAGE_ARN"
     echo -e "  Test Ack ARN: $TEST_ACK_ARN"
     echo -e "  Test Status ARN: $TEST_STATUS_ARN"
+    echo -e "  API Router ARN: $API_ARN"
     echo -e "  Init Schema Name: $INIT_SCHEMA_NAME"
     echo -e "  ECR Repository: $ECR_REPO_URL"
     
@@ -451,6 +457,8 @@ else
     TEST_ACK_NAME=""
     TEST_STATUS_ARN=""
     TEST_STATUS_NAME=""
+    API_ARN=""
+    API_NAME=""
 fi
 
 # Step 5: Deploy API Gateway (if not skipped and Lambdas are deployed)
@@ -465,7 +473,9 @@ if [ "$SKIP_API_GATEWAY" = false ] && [ "$SKIP_LAMBDAS" = false ]; then
             -var="test_ack_lambda_arn=$TEST_ACK_ARN" \
             -var="test_ack_lambda_name=$TEST_ACK_NAME" \
             -var="test_status_lambda_arn=$TEST_STATUS_ARN" \
-            -var="test_status_lambda_name=$TEST_STATUS_NAME"
+            -var="test_status_lambda_name=$TEST_STATUS_NAME" \
+            -var="api_lambda_arn=$API_ARN" \
+            -var="api_lambda_name=$API_NAME"
         
         # Get API Gateway output
         cd "$PROJECT_ROOT/infra/API_Gateway"
@@ -31,6 +31,8 @@ load_env_file()
 API_BASE_URL = os.environ.get('API_BASE_URL', '').rstrip('/')
 TEST_USER_ID = os.environ.get('TEST_USER_ID', '').strip()
 TIMEOUT_SECONDS = int(os.environ.get('TIMEOUT_SECONDS', '30'))
+# The server holds each status request until the run leaves PENDING, for at most this long
+MAX_WAIT_SECONDS = 25
 
 if not API_BASE_URL:
     print('[ERROR] API_BASE_URL is not set', file=sys.stderr)
@@ -96,12 +98,15 @@ def main():
 
         payload = {
             'user_id': TEST_USER_ID,
+            'category': 'system',
             'title': 'FCM E2E Test',
             'body': 'Test message',
             'data': {
                 'type': 'e2e_test',
                 'nonce': nonce,
             },
+            # The run expires on the server when we stop waiting
+            'ack_timeout_seconds': TIMEOUT_SECONDS,
         }
 
         print(f'[DEBUG] Payload: {json.dumps(payload)}')
@@ -113,13 +118,14 @@ def main():
             print('[ERROR] /messages/send returned error', file=sys.stderr)
             sys.exit(1)
 
-        # 3. Poll GET /test/status?nonce={nonce}
-        status_url = f'{API_BASE_URL}/test/status?nonce={nonce}'
+        # 3. Long-poll GET /test/status?nonce={nonce}&wait={seconds}
         deadline = time.time() + TIMEOUT_SECONDS
 
-        print(f'[INFO] Start polling {status_url} for up to {TIMEOUT_SECONDS}s')
+        print(f'[INFO] Start polling {API_BASE_URL}/test/status?nonce={nonce} for up to {TIMEOUT_SECONDS}s')
 
         while time.time() < deadline:
+            wait = max(0, min(MAX_WAIT_SECONDS, int(deadline - time.time())))
+            status_url = f'{API_BASE_URL}/test/status?nonce={nonce}&wait={wait}'
             try:
                 status_code, body = http_request(status_url)
                 print(f'[DEBUG] GET {status_url} -> HTTP {status_code}, body={body}')
@@ -138,7 +144,22 @@ def main():
 
                     if status == 'ACKED':
                         print('[SUCCESS] Status became ACKED 🎉')
+                        print(f"[INFO] {status_data.get('acked_device_count')} of "
+                              f"{status_data.get('device_count')} devices acked")
+                        print(f"[INFO] platform={status_data.get('platform')}, "
+                              f"send_to_ack_ms={status_data.get('send_to_ack_ms')}, "
+                              f"receive_to_ack_ms={status_data.get('receive_to_ack_ms')}")
                         sys.exit(0)
+
+                    # Terminal failure states: no point in polling further
+                    if status in ('EXPIRED', 'SEND_FAILED'):
+                        reason = status_data.get('failure_reason') or 'unknown'
+                        print(f'[ERROR] Test run {status}: {reason}', file=sys.stderr)
+                        sys.exit(2)
+
+                    # Still PENDING after the server-side wait: ask again right away
+                    if wait > 0:
+                        continue
             except Exception as e:
                 # Continue polling on error
                 print(f'[DEBUG] Polling error: {e}')
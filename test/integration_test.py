@@ -112,6 +112,7 @@ def test_send_message(user_id, expect_zero_devices=False):
     url = f'{API_BASE_URL}/messages/send'
     payload = {
         'user_id': user_id,
+        'category': 'system',
         'title': 'Integration Test Message',
         'body': 'Test message body',
         'data': {
@@ -181,9 +182,13 @@ def test_test_status():
     return True
 
 def test_test_ack(nonce=None):
-    """Test POST /test/ack endpoint"""
+    """Test POST /test/ack endpoint
+
+    Acks must carry the ack_token that only the targeted device receives with the
+    message, so acks made here (without a token, or with a forged one) are rejected.
+    """
     if nonce:
-        print('\n[TEST] Test Ack (Valid)')
+        print('\n[TEST] Test Ack (Unsigned - Should Be Rejected)')
     else:
         print('\n[TEST] Test Ack (Non-existent)')
     print('=' * 50)
@@ -192,39 +197,25 @@ def test_test_ack(nonce=None):
     if not nonce:
         nonce = str(uuid.uuid4())
     url = f'{API_BASE_URL}/test/ack'
-    payload = {
-        'nonce': nonce
-    }
-    
-    print(f'POST {url}')
-    print(f'Payload: {json.dumps(payload, indent=2)}')
-    
-    status_code, body = http_request(url, method='POST', data=payload)
-    print(f'Response: HTTP {status_code}')
-    print(f'Body: {body}')
-    
-    if nonce:
-        # Valid nonce should succeed
-        if status_code != 200:
-            print(f'[FAIL] Expected 200, got {status_code}')
-            return False
-        try:
-            response_data = json.loads(body)
-            if not response_data.get('ok'):
-                print(f'[FAIL] Expected ok=true, got {response_data}')
-                return False
-            print('[PASS] Test ack successful')
-            return True
-        except json.JSONDecodeError:
-            print(f'[FAIL] Invalid JSON response: {body}')
-            return False
-    else:
-        # Should return error for non-existent nonce
-        if status_code < 400:
-            print(f'[FAIL] Expected error status (4xx), got {status_code}')
+    payloads = [
+        {'nonce': nonce},
+        {'nonce': nonce, 'ack_token': 'eyJuIjoiZm9yZ2VkIn0.Zm9yZ2VkLXNpZ25hdHVyZQ'},
+    ]
+    
+    for payload in payloads:
+        print(f'POST {url}')
+        print(f'Payload: {json.dumps(payload, indent=2)}')
+        
+        status_code, body = http_request(url, method='POST', data=payload)
+        print(f'Response: HTTP {status_code}')
+        print(f'Body: {body}')
+        
+        if status_code != 401:
+            print(f'[FAIL] Expected 401 for an ack without a valid ack_token, got {status_code}')
             return False
-        print('[PASS] Test ack correctly returned error for non-existent nonce')
-        return True
+    
+    print('[PASS] Test ack correctly rejected acks without a valid ack_token')
+    return True
 
 def test_device_registration_duplicate(user_id, device_id):
     """Test registering the same device again (should update, not fail)"""
@@ -365,6 +356,7 @@ def test_send_message_with_test_run(user_id):
     url = f'{API_BASE_URL}/messages/send'
     payload = {
         'user_id': user_id,
+        'category': 'system',
         'title': 'E2E Test Message',
         'body': 'Test message for creating test run',
         'data': {
@@ -467,6 +459,7 @@ def test_send_message_user_not_found():
     url = f'{API_BASE_URL}/messages/send'
     payload = {
         'user_id': fake_user_id,
+        'category': 'system',
         'title': 'Test Message',
         'body': 'Test message body',
         'data': {}
@@ -684,7 +677,7 @@ def main():
     print('Test Suite 4: Test Acknowledgment')
     print('=' * 50)
     
-    # Test 4.1: Test Ack (valid nonce) - ack the test run we created, then verify status
+    # Test 4.1: Test Ack (valid nonce, no ack_token) - must be rejected and leave the run unacked
     if test_run_nonce:
         # Double-check that test run still exists before attempting to ack
         print(f'\n[VERIFY] Verifying test run exists before ack: nonce={test_run_nonce}')
@@ -708,19 +701,19 @@ def main():
                     if test_test_ack(test_run_nonce):
                         tests_passed += 1
                         
-                        # Test 4.2: Verify status changed to ACKED
-                        print('\n[TEST] Test Status (After Ack - Should be ACKED)')
+                        # Test 4.2: Verify the rejected acks did not change the status
+                        print('\n[TEST] Test Status (After Rejected Ack - Should Still Be PENDING)')
                         print('=' * 50)
                         url = f'{API_BASE_URL}/test/status?nonce={test_run_nonce}'
                         status_code, body = http_request(url)
                         if status_code == 200:
                             try:
                                 response_data = json.loads(body)
-                                if response_data.get('status') == 'ACKED':
-                                    print('[PASS] Test status correctly shows ACKED after acknowledgment')
+                                if response_data.get('status') != 'ACKED':
+                                    print(f'[PASS] Test status is {response_data.get("status")}, not ACKED, after rejected acks')
                                     tests_passed += 1
                                 else:
-                                    print(f'[FAIL] Expected status=ACKED, got status={response_data.get("status")}')
+                                    print('[FAIL] Test run was ACKED by an ack without a valid ack_token')
                                     tests_failed += 1
                             except json.JSONDecodeError:
                                 print(f'[FAIL] Invalid JSON response: {body}')